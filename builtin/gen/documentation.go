@@ -2,11 +2,12 @@ package gen
 
 import (
 	"context"
-	"fmt"
+	"html"
 	"io"
 	"sort"
 	"strings"
 
+	"github.com/lithammer/dedent"
 	"github.com/openllb/doxygen-parser/doxygen"
 	"github.com/openllb/hlb/parser"
 	"github.com/openllb/hlb/parser/ast"
@@ -55,20 +56,14 @@ func GenerateDocumentation(ctx context.Context, r io.Reader) (*Documentation, er
 		}
 
 		var (
-			group  *doxygen.Group
+			fc     *funcComment
 			kind   string
 			name   string
 			fields []Field
 		)
 
 		if fd.Doc != nil {
-			var commentBlock []string
-			for _, comment := range fd.Doc.List {
-				text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "#"))
-				commentBlock = append(commentBlock, fmt.Sprintf("%s\n", text))
-			}
-
-			group, err = doxygen.Parse(strings.NewReader(strings.Join(commentBlock, "")))
+			fc, err = parseFuncComment(fd.Doc)
 			if err != nil {
 				return nil, err
 			}
@@ -103,14 +98,8 @@ func GenerateDocumentation(ctx context.Context, r io.Reader) (*Documentation, er
 					Name:     fieldName,
 				}
 
-				if group != nil {
-					for _, dparam := range group.Params {
-						if dparam.Name != fieldName {
-							continue
-						}
-
-						field.Doc = dparam.Description
-					}
+				if fc != nil {
+					field.Doc = fc.Params[fieldName]
 				}
 
 				fields = append(fields, field)
@@ -123,8 +112,8 @@ func GenerateDocumentation(ctx context.Context, r io.Reader) (*Documentation, er
 			Params: fields,
 		}
 
-		if group != nil {
-			funcDoc.Doc = strings.TrimSpace(group.Doc)
+		if fc != nil {
+			funcDoc.Doc = fc.Doc
 		}
 
 		if fd.Kind().Primary() == ast.Option {
@@ -171,3 +160,96 @@ func GenerateDocumentation(ctx context.Context, r io.Reader) (*Documentation, er
 
 	return &doc, nil
 }
+
+// funcComment is the parsed doc comment of a function declaration.
+type funcComment struct {
+	Doc      string
+	Return   string
+	Params   map[string]string
+	Examples []string
+	Options  []string
+}
+
+// parseFuncComment parses the doxygen doc comment of a function declaration.
+// The `Example:` sections and `@option` annotations of the comment are parsed
+// separately from the rest of it.
+func parseFuncComment(cg *ast.CommentGroup) (*funcComment, error) {
+	comment, examples, options := splitComment(cg)
+	group, err := doxygen.Parse(strings.NewReader(comment))
+	if err != nil {
+		return nil, err
+	}
+
+	fc := &funcComment{
+		Doc:      unescape(group.Doc),
+		Return:   unescape(group.Return.Description),
+		Params:   make(map[string]string),
+		Examples: examples,
+		Options:  options,
+	}
+	for _, param := range group.Params {
+		fc.Params[param.Name] = unescape(param.Description)
+	}
+	return fc, nil
+}
+
+// unescape trims and unescapes the HTML entities introduced by the doxygen
+// parser.
+func unescape(s string) string {
+	return html.UnescapeString(strings.TrimSpace(s))
+}
+
+// splitComment separates the `Example:` sections and `@option` annotations
+// of a doc comment from the rest of the comment. An example continues until
+// the next example, a doxygen command or the end of the comment.
+func splitComment(cg *ast.CommentGroup) (comment string, examples, options []string) {
+	if cg == nil {
+		return
+	}
+
+	var (
+		lines     []string
+		example   []string
+		inExample bool
+	)
+	flush := func() {
+		if inExample {
+			examples = append(examples, strings.TrimSpace(dedent.Dedent(strings.Join(example, "\n"))))
+		}
+		example = nil
+	}
+
+	var commentLines []string
+	for _, c := range cg.List {
+		commentLines = append(commentLines, c.Lines()...)
+	}
+
+	for _, text := range commentLines {
+		text = strings.TrimPrefix(text, " ")
+
+		trimmed := strings.TrimSpace(text)
+		switch {
+		case trimmed == "Example:":
+			flush()
+			inExample = true
+		case strings.HasPrefix(trimmed, "@option "):
+			flush()
+			inExample = false
+			options = append(options, strings.TrimSpace(strings.TrimPrefix(trimmed, "@option ")))
+		case strings.HasPrefix(trimmed, "@"):
+			flush()
+			inExample = false
+			lines = append(lines, trimmed)
+		case inExample:
+			example = append(example, text)
+		default:
+			lines = append(lines, trimmed)
+		}
+	}
+	flush()
+
+	for _, line := range lines {
+		comment += line + "\n"
+	}
+	return
+}
@@ -0,0 +1,319 @@
+package gen
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// ModuleDoc documents the functions of a module, and optionally the modules
+// it imports and the builtin functions.
+type ModuleDoc struct {
+	Name     string       `json:"name,omitempty"`
+	Filename string       `json:"filename"`
+	Funcs    []*FuncDoc   `json:"funcs"`
+	Imports  []*ModuleDoc `json:"imports,omitempty"`
+	Builtins []*FuncDoc   `json:"builtins,omitempty"`
+}
+
+// FuncDoc documents a function declaration.
+type FuncDoc struct {
+	Kind     string      `json:"kind"`
+	Name     string      `json:"name"`
+	Doc      string      `json:"doc,omitempty"`
+	Params   []*FieldDoc `json:"params,omitempty"`
+	Effects  []*FieldDoc `json:"effects,omitempty"`
+	Return   string      `json:"return,omitempty"`
+	Options  []string    `json:"options,omitempty"`
+	Examples []string    `json:"examples,omitempty"`
+}
+
+// FieldDoc documents a parameter or effect of a function.
+type FieldDoc struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Doc      string `json:"doc,omitempty"`
+	Variadic bool   `json:"variadic,omitempty"`
+}
+
+// Signature returns the function signature as it is declared in HLB.
+func (fd *FuncDoc) Signature() string {
+	sig := fmt.Sprintf("%s %s(%s)", fd.Kind, fd.Name, joinFields(fd.Params))
+	if len(fd.Effects) > 0 {
+		sig = fmt.Sprintf("%s binds (%s)", sig, joinFields(fd.Effects))
+	}
+	return sig
+}
+
+func joinFields(fields []*FieldDoc) string {
+	var strs []string
+	for _, field := range fields {
+		str := fmt.Sprintf("%s %s", field.Kind, field.Name)
+		if field.Variadic {
+			str = "variadic " + str
+		}
+		strs = append(strs, str)
+	}
+	return strings.Join(strs, ", ")
+}
+
+// moduleDocInfo holds the options for generating module documentation.
+type moduleDocInfo struct {
+	ctx        context.Context
+	imports    bool
+	builtins   bool
+	unexported bool
+}
+
+type ModuleDocOption func(*moduleDocInfo)
+
+// WithImports documents the modules imported by local file paths recursively.
+// The context is used to parse the imported modules.
+func WithImports(ctx context.Context) ModuleDocOption {
+	return func(info *moduleDocInfo) {
+		info.ctx = ctx
+		info.imports = true
+	}
+}
+
+// WithBuiltins documents the builtin functions alongside the module.
+func WithBuiltins() ModuleDocOption {
+	return func(info *moduleDocInfo) {
+		info.builtins = true
+	}
+}
+
+// WithUnexported documents functions that are not exported by the module.
+func WithUnexported() ModuleDocOption {
+	return func(info *moduleDocInfo) {
+		info.unexported = true
+	}
+}
+
+// GenerateModuleDocumentation returns the documentation of the functions
+// exported by a module. Functions are documented in source order, and imports
+// in the order they are declared, so generated documentation diffs cleanly.
+func GenerateModuleDocumentation(mod *ast.Module, opts ...ModuleDocOption) (*ModuleDoc, error) {
+	info := &moduleDocInfo{ctx: context.Background()}
+	for _, opt := range opts {
+		opt(info)
+	}
+
+	doc, err := generateModule(mod, info, make(map[string]struct{}))
+	if err != nil {
+		return nil, err
+	}
+
+	if info.builtins {
+		doc.Builtins, err = generateFuncs(builtin.Module, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func generateModule(mod *ast.Module, info *moduleDocInfo, seen map[string]struct{}) (*ModuleDoc, error) {
+	seen[mod.Pos.Filename] = struct{}{}
+
+	funcs, err := generateFuncs(mod, info.unexported)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &ModuleDoc{
+		Filename: mod.Pos.Filename,
+		Funcs:    funcs,
+	}
+	if !info.imports {
+		return doc, nil
+	}
+
+	for _, decl := range mod.Decls {
+		id := decl.Import
+		if id == nil {
+			continue
+		}
+
+		filename, ok := importFilename(mod, id)
+		if !ok {
+			continue
+		}
+		if _, ok := seen[filename]; ok {
+			continue
+		}
+
+		imod, err := parseImport(info.ctx, mod, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		idoc, err := generateModule(imod, info, seen)
+		if err != nil {
+			return nil, err
+		}
+		idoc.Name = id.Name.Text
+		doc.Imports = append(doc.Imports, idoc)
+	}
+	return doc, nil
+}
+
+// importFilename returns the filename of an import declared by a local file
+// path. Imports from filesystems, remote URIs or interpolated strings cannot
+// be resolved without compiling the module.
+func importFilename(mod *ast.Module, id *ast.ImportDecl) (string, bool) {
+	if mod.Directory == nil {
+		return "", false
+	}
+
+	str := id.DeprecatedPath
+	if str == nil && id.Expr != nil && id.Expr.BasicLit != nil {
+		str = id.Expr.BasicLit.Str
+	}
+	if str == nil {
+		return "", false
+	}
+	for _, f := range str.Fragments {
+		if f.Interpolated != nil {
+			return "", false
+		}
+	}
+
+	path := str.Unquoted()
+	if strings.Contains(path, "://") {
+		return "", false
+	}
+
+	filename, err := parser.ResolvePath(filepath.Dir(mod.Pos.Filename), path)
+	if err != nil {
+		return "", false
+	}
+	return filename, true
+}
+
+func parseImport(ctx context.Context, mod *ast.Module, filename string) (*ast.Module, error) {
+	rc, err := mod.Directory.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	imod, err := parser.Parse(ctx, &parser.NamedReader{
+		Reader: rc,
+		Value:  filename,
+	})
+	if err != nil {
+		return nil, err
+	}
+	imod.Directory = mod.Directory
+	return imod, nil
+}
+
+func generateFuncs(mod *ast.Module, unexported bool) ([]*FuncDoc, error) {
+	exported := make(map[string]struct{})
+	for _, decl := range mod.Decls {
+		if decl.Export != nil {
+			exported[decl.Export.Name.Text] = struct{}{}
+		}
+	}
+
+	funcs := []*FuncDoc{}
+	for _, decl := range mod.Decls {
+		fd := decl.Func
+		if fd == nil || fd.Sig == nil || fd.Sig.Name == nil {
+			continue
+		}
+		if _, ok := exported[fd.Sig.Name.Text]; !ok && !unexported {
+			continue
+		}
+
+		fun, err := generateFunc(fd)
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, fun)
+	}
+	return funcs, nil
+}
+
+func generateFunc(fd *ast.FuncDecl) (*FuncDoc, error) {
+	fun := &FuncDoc{
+		Kind: string(fd.Kind()),
+		Name: fd.Sig.Name.Text,
+	}
+
+	fc, err := parseFuncComment(fd.Doc)
+	if err != nil {
+		return nil, err
+	}
+	fun.Doc = fc.Doc
+	fun.Return = fc.Return
+	fun.Examples = fc.Examples
+
+	fun.Params = fieldDocs(fd.Sig.Params, fc.Params)
+	if fd.Sig.Effects != nil {
+		fun.Effects = fieldDocs(fd.Sig.Effects.Effects, fc.Params)
+	}
+	fun.Options = optionKinds(fd, fc.Options)
+	return fun, nil
+}
+
+func fieldDocs(fl *ast.FieldList, docs map[string]string) []*FieldDoc {
+	if fl == nil {
+		return nil
+	}
+
+	var fields []*FieldDoc
+	for _, field := range fl.Fields() {
+		fields = append(fields, &FieldDoc{
+			Kind:     string(field.Kind()),
+			Name:     field.Name.Text,
+			Doc:      docs[field.Name.Text],
+			Variadic: field.Modifier != nil && field.Modifier.Variadic != nil,
+		})
+	}
+	return fields
+}
+
+// optionKinds returns the option kinds accepted by a function in sorted
+// order. Builtins accept the option kind of their name, and functions accept
+// the option kinds of the calls in their body as well as any kinds annotated
+// with `@option`.
+func optionKinds(fd *ast.FuncDecl, annotated []string) []string {
+	kinds := make(map[string]struct{})
+	for _, kind := range annotated {
+		kinds[kind] = struct{}{}
+	}
+
+	addKind := func(name string) {
+		kind := ast.Kind(fmt.Sprintf("%s::%s", ast.Option, name))
+		if _, ok := builtin.Lookup.ByKind[kind]; ok {
+			kinds[string(kind)] = struct{}{}
+		}
+	}
+
+	if fd.Body == nil {
+		addKind(fd.Sig.Name.Text)
+	} else {
+		ast.Match(fd.Body, ast.MatchOpts{},
+			func(call *ast.CallStmt) {
+				if call.Name != nil && call.Name.Reference == nil {
+					addKind(call.Name.Ident.Text)
+				}
+			},
+		)
+	}
+
+	var options []string
+	for kind := range kinds {
+		options = append(options, kind)
+	}
+	sort.Strings(options)
+	return options
+}
@@ -0,0 +1,314 @@
+package gen
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lithammer/dedent"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	filename string
+	content  string
+}
+
+func TestGenerateModuleDocumentation(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		files    []testFile
+		opts     []ModuleDocOption
+		expected string
+	}
+
+	for _, tc := range []testCase{{
+		"exported functions in source order",
+		[]testFile{{
+			"build.hlb",
+			`
+			export test
+			export build
+
+			# Builds the project.
+			#
+			# @param version the go version.
+			# @return the built filesystem.
+			fs build(string version) {
+				image "golang:${version}"
+				run "go build ./..." with option {
+					dir "/src"
+				}
+			}
+
+			fs helper() {
+				scratch
+			}
+
+			# Tests the project.
+			fs test() {
+				build "1.18"
+				run "go test ./..."
+			}
+			`,
+		}},
+		nil,
+		`
+		# build.hlb
+
+		## ` + "`fs build(string version)`" + `
+
+		Builds the project.
+
+		**Parameters**
+
+		- ` + "`string version`" + `: the go version.
+
+		**Returns** the built filesystem.
+
+		**Options**
+
+		- ` + "`option::image`" + `
+		- ` + "`option::run`" + `
+
+		## ` + "`fs test()`" + `
+
+		Tests the project.
+
+		**Options**
+
+		- ` + "`option::run`" + `
+		`,
+	}, {
+		"examples, effects and annotated options",
+		[]testFile{{
+			"build.hlb",
+			`
+			export goRun
+
+			# Runs a go command.
+			#
+			# Example:
+			#   goRun "build" with option {
+			#       dir "/src"
+			#   } as out
+			#
+			# @option option::run
+			# @param command the go subcommand.
+			# @param out the output directory.
+			fs goRun(string command) binds (fs out) {
+				image "golang"
+			}
+			`,
+		}},
+		nil,
+		`
+		# build.hlb
+
+		## ` + "`fs goRun(string command) binds (fs out)`" + `
+
+		Runs a go command.
+
+		**Parameters**
+
+		- ` + "`string command`" + `: the go subcommand.
+
+		**Effects**
+
+		- ` + "`fs out`" + `: the output directory.
+
+		**Options**
+
+		- ` + "`option::image`" + `
+		- ` + "`option::run`" + `
+
+		**Example**
+
+		` + "```hlb" + `
+		goRun "build" with option {
+		    dir "/src"
+		} as out
+		` + "```" + `
+		`,
+	}, {
+		"unexported functions",
+		[]testFile{{
+			"build.hlb",
+			`
+			fs helper() {
+				scratch
+			}
+			`,
+		}},
+		[]ModuleDocOption{WithUnexported()},
+		`
+		# build.hlb
+
+		## ` + "`fs helper()`" + `
+		`,
+	}, {
+		"recursive imports in declaration order",
+		[]testFile{{
+			"build.hlb",
+			`
+			import node from "./lib/node.hlb"
+			import golang from "./lib/go.hlb"
+			import remote from fs {
+				image "openllb/remote.hlb"
+			}
+
+			export build
+
+			fs build() {
+				golang.goImage
+			}
+			`,
+		}, {
+			"lib/go.hlb",
+			`
+			import base from "./base.hlb"
+
+			export goImage
+
+			# A golang image.
+			fs goImage() {
+				base.alpine
+			}
+			`,
+		}, {
+			"lib/node.hlb",
+			`
+			export nodeImage
+
+			fs nodeImage() {
+				image "node"
+			}
+			`,
+		}, {
+			"lib/base.hlb",
+			`
+			export alpine
+
+			fs alpine() {
+				image "alpine"
+			}
+			`,
+		}},
+		[]ModuleDocOption{WithImports(context.Background())},
+		`
+		# build.hlb
+
+		## ` + "`fs build()`" + `
+
+		# node (lib/node.hlb)
+
+		## ` + "`fs nodeImage()`" + `
+
+		**Options**
+
+		- ` + "`option::image`" + `
+
+		# golang (lib/go.hlb)
+
+		## ` + "`fs goImage()`" + `
+
+		A golang image.
+
+		# base (lib/base.hlb)
+
+		## ` + "`fs alpine()`" + `
+
+		**Options**
+
+		- ` + "`option::image`" + `
+		`,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mod := parseTestFiles(t, tc.files)
+
+			doc, err := GenerateModuleDocumentation(mod, tc.opts...)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			err = WriteModuleMarkdown(&buf, doc)
+			require.NoError(t, err)
+			require.Equal(t, strings.TrimPrefix(dedent.Dedent(tc.expected), "\n"), buf.String())
+		})
+	}
+}
+
+func TestGenerateModuleDocumentationBuiltins(t *testing.T) {
+	t.Parallel()
+
+	mod := parseTestFiles(t, []testFile{{
+		"build.hlb",
+		`
+		export build
+
+		fs build() {
+			scratch
+		}
+		`,
+	}})
+
+	doc, err := GenerateModuleDocumentation(mod, WithBuiltins())
+	require.NoError(t, err)
+	require.Len(t, doc.Funcs, 1)
+
+	var names []string
+	for _, fun := range doc.Builtins {
+		names = append(names, fun.Signature())
+	}
+	require.Equal(t, "fs scratch()", names[0])
+	require.Contains(t, names, "fs image(string ref)")
+	require.Contains(t, names, "option::run mount(fs input, string mountPoint) binds (fs target)")
+
+	for _, fun := range doc.Builtins {
+		if fun.Name == "image" && fun.Kind == "fs" {
+			require.Equal(t, []string{"option::image"}, fun.Options)
+			require.NotEmpty(t, fun.Doc)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = WriteModuleJSON(&buf, doc)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), `"builtins": [`)
+}
+
+func parseTestFiles(t *testing.T, files []testFile) *ast.Module {
+	dir := t.TempDir()
+	for _, f := range files {
+		filename := filepath.Join(dir, f.filename)
+		err := os.MkdirAll(filepath.Dir(filename), 0o755)
+		require.NoError(t, err)
+
+		err = os.WriteFile(filename, []byte(dedent.Dedent(f.content)), 0o644)
+		require.NoError(t, err)
+	}
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	rc, err := os.Open(filepath.Join(dir, files[0].filename))
+	require.NoError(t, err)
+	defer rc.Close()
+
+	mod, err := parser.Parse(ctx, &parser.NamedReader{
+		Reader: rc,
+		Value:  files[0].filename,
+	})
+	require.NoError(t, err)
+	mod.Directory = parser.NewLocalDirectory(dir, "")
+	return mod
+}
@@ -0,0 +1,85 @@
+package gen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteModuleJSON writes the documentation of a module as indented JSON.
+func WriteModuleJSON(w io.Writer, doc *ModuleDoc) error {
+	dt, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", dt)
+	return err
+}
+
+// WriteModuleMarkdown writes the documentation of a module as Markdown, with
+// each module as a top-level section followed by its imports and then the
+// builtins.
+func WriteModuleMarkdown(w io.Writer, doc *ModuleDoc) error {
+	var sb strings.Builder
+	writeModule(&sb, doc)
+	if len(doc.Builtins) > 0 {
+		sb.WriteString("# Builtins\n\n")
+		for _, fun := range doc.Builtins {
+			writeFunc(&sb, fun)
+		}
+	}
+	_, err := io.WriteString(w, strings.TrimRight(sb.String(), "\n")+"\n")
+	return err
+}
+
+func writeModule(sb *strings.Builder, doc *ModuleDoc) {
+	if doc.Name != "" {
+		fmt.Fprintf(sb, "# %s (%s)\n\n", doc.Name, doc.Filename)
+	} else {
+		fmt.Fprintf(sb, "# %s\n\n", doc.Filename)
+	}
+	for _, fun := range doc.Funcs {
+		writeFunc(sb, fun)
+	}
+	for _, idoc := range doc.Imports {
+		writeModule(sb, idoc)
+	}
+}
+
+func writeFunc(sb *strings.Builder, fun *FuncDoc) {
+	fmt.Fprintf(sb, "## `%s`\n\n", fun.Signature())
+	if fun.Doc != "" {
+		fmt.Fprintf(sb, "%s\n\n", fun.Doc)
+	}
+	writeFields(sb, "Parameters", fun.Params)
+	writeFields(sb, "Effects", fun.Effects)
+	if fun.Return != "" {
+		fmt.Fprintf(sb, "**Returns** %s\n\n", fun.Return)
+	}
+	if len(fun.Options) > 0 {
+		sb.WriteString("**Options**\n\n")
+		for _, kind := range fun.Options {
+			fmt.Fprintf(sb, "- `%s`\n", kind)
+		}
+		sb.WriteString("\n")
+	}
+	for _, example := range fun.Examples {
+		fmt.Fprintf(sb, "**Example**\n\n```hlb\n%s\n```\n\n", example)
+	}
+}
+
+func writeFields(sb *strings.Builder, title string, fields []*FieldDoc) {
+	if len(fields) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "**%s**\n\n", title)
+	for _, field := range fields {
+		fmt.Fprintf(sb, "- `%s`", joinFields([]*FieldDoc{field}))
+		if field.Doc != "" {
+			fmt.Fprintf(sb, ": %s", field.Doc)
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+}
@@ -20,6 +20,32 @@ type FuncLookup struct {
 var (
 	Lookup = BuiltinLookup{
 		ByKind: map[ast.Kind]LookupByKind{
+			ast.Bool: {
+				Func: map[string]FuncLookup{
+					"tryRun": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "command", false),
+							ast.NewField(ast.String, "args", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"exists": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"isDir": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
 			ast.Filesystem: {
 				Func: map[string]FuncLookup{
 					"scratch": {
@@ -32,6 +58,10 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"selectPlatform": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
 					"http": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "url", false),
@@ -51,12 +81,44 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"localGit": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"tarContext": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"frontend": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "source", false),
 						},
 						Effects: []*ast.Field{},
 					},
+					"devFrontend": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "source", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"dockerfile": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "context", false),
+							ast.NewField(ast.String, "filename", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"dockerfileStages": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "context", false),
+							ast.NewField(ast.String, "filename", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"shell": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "arg", true),
@@ -103,9 +165,22 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
-					"rm": {
+					"writeFile": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "path", false),
+							ast.NewField(ast.String, "content", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"rm": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "paths", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"whiteout": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "paths", true),
 						},
 						Effects: []*ast.Field{},
 					},
@@ -117,6 +192,14 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"fetchArchive": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "url", false),
+							ast.NewField(ast.String, "digest", false),
+							ast.NewField(ast.String, "dest", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"merge": {
 						Params: []*ast.Field{
 							ast.NewField(ast.Filesystem, "inputs", true),
@@ -129,6 +212,22 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"combine": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "stages", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"strip": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "paths", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"scan": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
 					"dockerPush": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "ref", false),
@@ -205,6 +304,55 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"imageConfig": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"assert": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Bool, "condition", false),
+							ast.NewField(ast.String, "message", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"fail": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "message", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"assertEq": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "actual", false),
+							ast.NewField(ast.String, "expected", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"assertExists": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"assertFileContains": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+							ast.NewField(ast.String, "substring", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::combine": {
+				Func: map[string]FuncLookup{
+					"conflict": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "policy", false),
+						},
+						Effects: []*ast.Field{},
+					},
 				},
 			},
 			"option::copy": {
@@ -239,12 +387,30 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"chownFrom": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"chmod": {
 						Params: []*ast.Field{
 							ast.NewField(ast.Int, "filemode", false),
 						},
 						Effects: []*ast.Field{},
 					},
+					"fileMode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"dirMode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"createdTime": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "created", false),
@@ -263,17 +429,40 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
-				},
-			},
-			"option::dockerPush": {
-				Func: map[string]FuncLookup{
-					"stargz": {
+					"excludeExtensions": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "extensions", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"maxSize": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "bytes", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"substitute": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "placeholder", false),
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"exportIgnore": {
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
+					"manifest": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{
+							ast.NewField(ast.Filesystem, "manifest", false),
+						},
+					},
 				},
 			},
-			"option::frontend": {
+			"option::devFrontend": {
 				Func: map[string]FuncLookup{
 					"input": {
 						Params: []*ast.Field{
@@ -291,177 +480,852 @@ var (
 					},
 				},
 			},
-			"option::git": {
+			"option::dockerPush": {
 				Func: map[string]FuncLookup{
-					"keepGitDir": {
+					"stargz": {
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-				},
-			},
-			"option::http": {
-				Func: map[string]FuncLookup{
-					"checksum": {
+					"maxImageSize": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "digest", false),
+							ast.NewField(ast.Int, "bytes", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"chmod": {
+				},
+			},
+			"option::dockerfile": {
+				Func: map[string]FuncLookup{
+					"stage": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "filemode", false),
+							ast.NewField(ast.String, "name", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"filename": {
+					"arg": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "name", false),
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
 						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::image": {
+			"option::dockerfileStages": {
 				Func: map[string]FuncLookup{
-					"resolve": {
-						Params:  []*ast.Field{},
-						Effects: []*ast.Field{},
-					},
-					"platform": {
+					"arg": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "os", false),
-							ast.NewField(ast.String, "arch", false),
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
 						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::local": {
+			"option::download": {
 				Func: map[string]FuncLookup{
-					"includePatterns": {
+					"filename": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "pattern", true),
+							ast.NewField(ast.String, "template", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"excludePatterns": {
-						Params: []*ast.Field{
-							ast.NewField(ast.String, "pattern", true),
-						},
+					"contentFilename": {
+						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::localRun": {
+			"option::exists": {
 				Func: map[string]FuncLookup{
-					"ignoreError": {
-						Params:  []*ast.Field{},
-						Effects: []*ast.Field{},
-					},
-					"includeStderr": {
+					"noFollow": {
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-					"onlyStderr": {
-						Params:  []*ast.Field{},
+				},
+			},
+			"option::fetchArchive": {
+				Func: map[string]FuncLookup{
+					"chown": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "owner", false),
+						},
 						Effects: []*ast.Field{},
 					},
-					"shlex": {
+				},
+			},
+			"option::fileMode": {
+				Func: map[string]FuncLookup{
+					"noFollow": {
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::manifest": {
+			"option::frontend": {
 				Func: map[string]FuncLookup{
-					"platform": {
+					"input": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "os", false),
-							ast.NewField(ast.String, "arch", false),
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.Filesystem, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"opt": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"digest": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "digest", false),
 						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::mkdir": {
+			"option::git": {
 				Func: map[string]FuncLookup{
-					"createParents": {
+					"keepGitDir": {
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-					"chown": {
+					"depth": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "owner", false),
+							ast.NewField(ast.Int, "depth", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"createdTime": {
+					"shallowSince": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "created", false),
+							ast.NewField(ast.String, "date", false),
 						},
 						Effects: []*ast.Field{},
 					},
-				},
-			},
-			"option::mkfile": {
-				Func: map[string]FuncLookup{
-					"chown": {
+					"commit": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "owner", false),
+							ast.NewField(ast.String, "sha", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"createdTime": {
+					"fallback": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "created", false),
+							ast.NewField(ast.String, "remotes", true),
 						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::mount": {
+			"option::healthcheck": {
 				Func: map[string]FuncLookup{
-					"readonly": {
-						Params:  []*ast.Field{},
+					"interval": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "interval", false),
+						},
 						Effects: []*ast.Field{},
 					},
-					"tmpfs": {
-						Params:  []*ast.Field{},
+					"timeout": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "timeout", false),
+						},
 						Effects: []*ast.Field{},
 					},
-					"sourcePath": {
+					"startPeriod": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "startPeriod", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"retries": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "retries", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::http": {
+				Func: map[string]FuncLookup{
+					"checksum": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "digest", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"chmod": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"filename": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "name", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"fallback": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "urls", true),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::image": {
+				Func: map[string]FuncLookup{
+					"resolve": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"platform": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "os", false),
+							ast.NewField(ast.String, "arch", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::imageConfig": {
+				Func: map[string]FuncLookup{
+					"entrypoint": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "args", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"cmd": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "args", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"env": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"workdir": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"user": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "name", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"label": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"removeLabel": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "key", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"volume": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "mountpoints", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"exposed": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "ports", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"stopSignal": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "signal", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"healthcheck": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "test", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"argsEscaped": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Bool, "escaped", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::isDir": {
+				Func: map[string]FuncLookup{
+					"noFollow": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::local": {
+				Func: map[string]FuncLookup{
+					"includePatterns": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "pattern", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"excludePatterns": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "pattern", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"ignoreFile": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"useIgnoreFile": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"verifyManifest": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"allowExtra": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"largeFileThreshold": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "bytes", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::localGit": {
+				Func: map[string]FuncLookup{
+					"includeUntracked": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"submodules": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"subdir": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"repoRelative": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::localRun": {
+				Func: map[string]FuncLookup{
+					"ignoreError": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"includeStderr": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"onlyStderr": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"shlex": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::manifest": {
+				Func: map[string]FuncLookup{
+					"platform": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "os", false),
+							ast.NewField(ast.String, "arch", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::mkdir": {
+				Func: map[string]FuncLookup{
+					"createParents": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"chown": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "owner", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"createdTime": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "created", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::mkfile": {
+				Func: map[string]FuncLookup{
+					"chown": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "owner", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"createdTime": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "created", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::mount": {
+				Func: map[string]FuncLookup{
+					"readonly": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"tmpfs": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"sourcePath": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"cache": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "cacheid", false),
+							ast.NewField(ast.String, "sharingmode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::perPlatform": {
+				Func: map[string]FuncLookup{
+					"separator": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "separator", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::rm": {
+				Func: map[string]FuncLookup{
+					"allowNotFound": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"allowWildcard": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"except": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "pattern", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::run": {
+				Func: map[string]FuncLookup{
+					"readonlyRootfs": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"env": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"dir": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"workdirCreate": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"user": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "name", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"ignoreCache": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"network": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "networkmode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"security": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "securitymode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"shlex": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"stdin": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "content", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"stdinFile": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"dependsOn": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "step", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"host": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "hostname", false),
+							ast.NewField(ast.String, "address", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"ssh": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"forward": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "src", false),
+							ast.NewField(ast.String, "dest", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"secret": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "localPath", false),
+							ast.NewField(ast.String, "mountPoint", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"secretFile": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "localPath", false),
+							ast.NewField(ast.String, "target", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"secretDir": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "localGlob", false),
+							ast.NewField(ast.String, "targetDir", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"mount": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "mountPoint", false),
+						},
+						Effects: []*ast.Field{
+							ast.NewField(ast.Filesystem, "target", false),
+						},
+					},
+					"capture": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{
+							ast.NewField(ast.Filesystem, "output", false),
+						},
+					},
+				},
+			},
+			"option::runtimeSpec": {
+				Func: map[string]FuncLookup{
+					"publish": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "hostPort", false),
+							ast.NewField(ast.String, "containerPort", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"bind": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "hostPath", false),
+							ast.NewField(ast.String, "containerPath", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"env": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "key", false),
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"commandOverride": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "args", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"format": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "format", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::scan": {
+				Func: map[string]FuncLookup{
+					"severityThreshold": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "severity", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"ignore": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"reportPath": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "path", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"cache": {
+				},
+			},
+			"option::secret": {
+				Func: map[string]FuncLookup{
+					"uid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"gid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"mode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"includePatterns": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "pattern", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"excludePatterns": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "pattern", true),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::secretDir": {
+				Func: map[string]FuncLookup{
+					"optional": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"uid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"gid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"mode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::secretFile": {
+				Func: map[string]FuncLookup{
+					"optional": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"uid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"gid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"mode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::selectPlatform": {
+				Func: map[string]FuncLookup{
+					"when": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "platform", false),
+							ast.NewField(ast.Filesystem, "input", false),
+						},
+						Effects: []*ast.Field{},
+					},
+				},
+			},
+			"option::ssh": {
+				Func: map[string]FuncLookup{
+					"target": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "mountPoint", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"localPaths": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", true),
+						},
+						Effects: []*ast.Field{},
+					},
+					"uid": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"gid": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "cacheid", false),
-							ast.NewField(ast.String, "sharingmode", false),
+							ast.NewField(ast.Int, "id", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"mode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "filemode", false),
 						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::rm": {
+			"option::strip": {
 				Func: map[string]FuncLookup{
-					"allowNotFound": {
-						Params:  []*ast.Field{},
+					"helper": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "helper", false),
+						},
 						Effects: []*ast.Field{},
 					},
-					"allowWildcard": {
-						Params:  []*ast.Field{},
+				},
+			},
+			"option::tarContext": {
+				Func: map[string]FuncLookup{
+					"input": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"stripComponents": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Int, "n", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"subdir": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"checksum": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "digest", false),
+						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"option::run": {
+			"option::template": {
 				Func: map[string]FuncLookup{
-					"readonlyRootfs": {
-						Params:  []*ast.Field{},
+					"stringField": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "name", false),
+							ast.NewField(ast.String, "value", false),
+						},
 						Effects: []*ast.Field{},
 					},
+				},
+			},
+			"option::tryRun": {
+				Func: map[string]FuncLookup{
 					"env": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "key", false),
@@ -501,131 +1365,91 @@ var (
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-					"host": {
-						Params: []*ast.Field{
-							ast.NewField(ast.String, "hostname", false),
-							ast.NewField(ast.String, "address", false),
-						},
-						Effects: []*ast.Field{},
-					},
-					"ssh": {
-						Params:  []*ast.Field{},
-						Effects: []*ast.Field{},
-					},
-					"forward": {
+					"stdin": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "src", false),
-							ast.NewField(ast.String, "dest", false),
+							ast.NewField(ast.String, "content", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"secret": {
+					"host": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "localPath", false),
-							ast.NewField(ast.String, "mountPoint", false),
+							ast.NewField(ast.String, "hostname", false),
+							ast.NewField(ast.String, "address", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"mount": {
-						Params: []*ast.Field{
-							ast.NewField(ast.Filesystem, "input", false),
-							ast.NewField(ast.String, "mountPoint", false),
-						},
-						Effects: []*ast.Field{
-							ast.NewField(ast.Filesystem, "target", false),
-						},
-					},
 				},
 			},
-			"option::secret": {
+			"option::writeFile": {
 				Func: map[string]FuncLookup{
-					"uid": {
+					"mode": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "id", false),
+							ast.NewField(ast.Int, "filemode", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"gid": {
+					"chown": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "id", false),
+							ast.NewField(ast.String, "owner", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"mode": {
+					"createdTime": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "filemode", false),
+							ast.NewField(ast.String, "created", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"includePatterns": {
-						Params: []*ast.Field{
-							ast.NewField(ast.String, "pattern", true),
-						},
+					"append": {
+						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-					"excludePatterns": {
-						Params: []*ast.Field{
-							ast.NewField(ast.String, "pattern", true),
-						},
+					"createIfMissing": {
+						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-				},
-			},
-			"option::ssh": {
-				Func: map[string]FuncLookup{
-					"target": {
-						Params: []*ast.Field{
-							ast.NewField(ast.String, "mountPoint", false),
-						},
+					"templated": {
+						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
-					"localPaths": {
+					"field": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "path", true),
+							ast.NewField(ast.String, "name", false),
+							ast.NewField(ast.String, "value", false),
 						},
 						Effects: []*ast.Field{},
 					},
-					"uid": {
+				},
+			},
+			"pipeline": {
+				Func: map[string]FuncLookup{
+					"stage": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "id", false),
+							ast.NewField("pipeline", "pipelines", true),
 						},
 						Effects: []*ast.Field{},
 					},
-					"gid": {
+					"sequence": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "id", false),
+							ast.NewField(ast.Filesystem, "stages", true),
 						},
 						Effects: []*ast.Field{},
 					},
-					"mode": {
+					"gate": {
 						Params: []*ast.Field{
-							ast.NewField(ast.Int, "filemode", false),
+							ast.NewField(ast.String, "message", false),
 						},
 						Effects: []*ast.Field{},
 					},
-				},
-			},
-			"option::template": {
-				Func: map[string]FuncLookup{
-					"stringField": {
+					"stageEnv": {
 						Params: []*ast.Field{
-							ast.NewField(ast.String, "name", false),
+							ast.NewField(ast.String, "key", false),
 							ast.NewField(ast.String, "value", false),
 						},
 						Effects: []*ast.Field{},
 					},
 				},
 			},
-			"pipeline": {
-				Func: map[string]FuncLookup{
-					"stage": {
-						Params: []*ast.Field{
-							ast.NewField("pipeline", "pipelines", true),
-						},
-						Effects: []*ast.Field{},
-					},
-				},
-			},
 			ast.String: {
 				Func: map[string]FuncLookup{
 					"format": {
@@ -649,10 +1473,35 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"sensitive": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "value", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"localOs": {
 						Params:  []*ast.Field{},
 						Effects: []*ast.Field{},
 					},
+					"bindingName": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"targetOs": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"targetArch": {
+						Params:  []*ast.Field{},
+						Effects: []*ast.Field{},
+					},
+					"perPlatform": {
+						Params: []*ast.Field{
+							ast.NewField(ast.String, "body", false),
+							ast.NewField(ast.String, "platforms", true),
+						},
+						Effects: []*ast.Field{},
+					},
 					"localRun": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "command", false),
@@ -660,6 +1509,45 @@ var (
 						},
 						Effects: []*ast.Field{},
 					},
+					"gitCommit": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "repo", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"gitBranch": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "repo", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"fileMode": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"readFile": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "path", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"imageConfigDiff": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+						},
+						Effects: []*ast.Field{},
+					},
+					"runtimeSpec": {
+						Params: []*ast.Field{
+							ast.NewField(ast.Filesystem, "input", false),
+							ast.NewField(ast.String, "ref", false),
+						},
+						Effects: []*ast.Field{},
+					},
 					"manifest": {
 						Params: []*ast.Field{
 							ast.NewField(ast.String, "ref", false),
@@ -704,6 +1592,21 @@ option::image resolve()
 # @return an option to specify the platform for an OCI image config.
 option::image platform(string os, string arch)
 
+# Selects a filesystem for the target platform, like a different base image
+# for each architecture. Only the selected filesystem is evaluated, and it is
+# an error if none is given for the target platform.
+#
+# @return the filesystem selected for the target platform.
+fs selectPlatform()
+
+# Selects a filesystem when building for a platform. The first one for the
+# target platform is selected.
+#
+# @param platform the platform in the form of os/arch, like &#34;linux/arm64&#34;.
+# @param input the filesystem to select.
+# @return an option to select a filesystem for the platform.
+option::selectPlatform when(string platform, fs input)
+
 # A filesystem with a file retrieved from a HTTP URL.
 #
 # @param url a fully-qualified URL to send a HTTP GET request.
@@ -729,6 +1632,16 @@ option::http chmod(int filemode)
 # @return an option to provide a name for the file.
 option::http filename(string name)
 
+# Alternate URLs of the resource, like mirrors, that are tried in order when
+# the URL before them fails. Each URL is fetched when the build is generated
+# until one succeeds, and the build uses it. If every URL fails, the errors of
+# all of them are reported together. The option may be repeated to append more
+# URLs.
+#
+# @param urls the fully-qualified URLs to try after the URL of http.
+# @return an option to fall back to other URLs.
+option::http fallback(variadic string urls)
+
 # A filesystem with the files from a git repository checked out from
 # a git reference. Note that by default, the &#34;.git&#34; directory is not included.
 #
@@ -737,13 +1650,49 @@ option::http filename(string name)
 # @return a filesystem containing files from a git repository.
 fs git(string remote, string ref)
 
-# Keeps the &#34;.git&#34; directory of the git repository.
+# Keeps the &#34;.git&#34; directory of the git repository. The repository is fetched
+# with a depth of 1, so the &#34;.git&#34; directory contains a shallow history grafted
+# at the checked out commit.
 #
 # @return the option to keep the &#34;.git&#34; directory.
 option::git keepGitDir()
 
+# Limits the number of commits fetched from the tip of the git reference.
+# BuildKit always fetches git sources with a depth of 1, so any other depth is
+# an error rather than being silently ignored.
+#
+# @param depth the number of commits to fetch, must be 1.
+# @return an option to set the shallow clone depth.
+option::git depth(int depth)
+
+# Fetches only the history after a date. BuildKit git sources do not support
+# fetching history by date, so this option is always an error.
+#
+# @param date the date to fetch history after.
+# @return an option to fetch history after a date.
+option::git shallowSince(string date)
+
+# Checks out exactly the given commit. The git reference is advisory only and
+# the filesystem is keyed by the commit, so the build cache is stable even
+# when the reference is a branch that moves.
+#
+# @param sha the full 40 character hexadecimal commit sha.
+# @return an option to check out a specific commit.
+option::git commit(string sha)
+
+# Alternate remotes of the repository, like mirrors, that are tried in order
+# when the remote before them fails. Each remote is fetched when the build is
+# generated until one succeeds, and the build checks out the same reference
+# from it. If every remote fails, the errors of all of them are reported
+# together. The option may be repeated to append more remotes.
+#
+# @param remotes the fully qualified git remotes to try after the remote of git.
+# @return an option to fall back to other remotes.
+option::git fallback(variadic string remotes)
+
 # A filesystem with the files synced up from a file or directory on the local
-# system.
+# system. Directories inside the module&#39;s directory exclude the files matched
+# by the .hlbignore in the module&#39;s directory, if any, without any options.
 #
 # @param path the local path to a file or directory to sync up.
 # @return a filesystem containing local files.
@@ -763,28 +1712,243 @@ option::local includePatterns(variadic string pattern)
 # @return an option to sync files that don&#39;t match any pattern.
 option::local excludePatterns(variadic string pattern)
 
-# Generates a filesystem using an external frontend.
+# Exclude the files matched by an ignore file with the same syntax as a
+# .dockerignore file. The ignore file is read from the host, so it is read
+# even if it excludes itself. Patterns prefixed with &#34;!&#34; re-include files
+# excluded by earlier patterns, and the patterns of excludePatterns are
+# applied after them. If local path is for a file, then the ignore file is
+# ignored.
+#
+# @param path the path to the ignore file, relative to the module.
+# @return an option to exclude the files matched by the ignore file.
+option::local ignoreFile(string path)
+
+# Exclude the files matched by the first of .hlbignore or .dockerignore that
+# exists in the root of the local directory, as if it was given to ignoreFile.
+# Nothing is excluded if neither exists.
+#
+# @return an option to exclude the files matched by the default ignore file.
+option::local useIgnoreFile()
+
+# Fail the build if the files synced up do not match a manifest of expected
+# files. Each line of the manifest is the path of a file relative to the local
+# directory, its size and its sha256 digest, separated by spaces. Missing
+# files, modified files and files that are not in the manifest are reported.
+# Files are verified in the build after they are synced, so they are the files
+# the build uses, and files excluded from the sync are not required by the
+# manifest.
+#
+# @param path the path to the manifest, relative to the module.
+# @return an option to verify the synced files against the manifest.
+option::local verifyManifest(string path)
+
+# Allow files that are not in the manifest given to verifyManifest, so that
+# only the files in the manifest are verified.
+#
+# @return an option to allow files that are not in the manifest.
+option::local allowExtra()
+
+# Skip transferring files at least as large as a threshold when their content
+# has not changed since they were last synced, even if their modification time
+# has. Large files are hashed on the host and recorded in a transfer cache, and
+# a file with the same content is synced with the modification time it was
+# first synced with, so BuildKit keeps its copy of the file. The build then
+# checks the digests of the large files it has, failing if one changed while it
+# was synced, and restores their modification times, so the files synced are
+# the same as without the option. The local source is transferred as usual if
+# BuildKit cannot report whether it has a copy of the files. The files skipped
+# and sent are reported in the progress of the build.
+#
+# @param bytes the size in bytes from which files are hashed before syncing.
+# @return an option to skip transferring large files that have not changed.
+option::local largeFileThreshold(int bytes)
+
+# A filesystem with the files git tracks in the repository of a local path,
+# synced up from the worktree with their unstaged modifications. Files that
+# are not tracked, like dependencies and build outputs, are left out without
+# maintaining exclude patterns. The index is read without running git, and a
+# directory without tracked files is left out as a whole, so the local source
+# stays small and its cache key only changes when the tracked files do.
+#
+# @param path the local path to a file or directory in the repository.
+# @return a filesystem containing the tracked files of the repository.
+fs localGit(string path)
+
+# Includes the files that are not tracked unless they are ignored by the
+# .gitignore files or the info/exclude file of the repository.
+#
+# @return an option to include untracked files.
+option::localGit includeUntracked()
+
+# Includes the tracked files of the submodules that are checked out, which are
+# left out by default.
+#
+# @return an option to include submodules.
+option::localGit submodules()
+
+# Syncs only a directory of the repository, whose files are relative to the
+# directory unless repoRelative is also set.
+#
+# @param path the directory relative to the root of the repository.
+# @return an option to sync a directory of the repository.
+option::localGit subdir(string path)
+
+# Keeps the paths of the files of a subdir relative to the root of the
+# repository instead of the subdir.
+#
+# @return an option to keep paths relative to the root of the repository.
+option::localGit repoRelative()
+
+# A filesystem with the contents of a tarball, like the build context docker
+# build reads from a tarball. The tarball may be compressed with gzip, bzip2,
+# xz or zstd. Hard links, symlinks, modes and ownership of its entries are
+# preserved, and entries that would be unpacked outside of the filesystem are
+# rejected.
+#
+# A tarball on the host has its entries checked before the build, and is
+# synced up on its own to be unpacked by BuildKit, so it is never unpacked on
+# the host.
+#
+# @param path the path to the tarball on the host, or in the filesystem given
+# to input.
+# @return a filesystem with the contents of the tarball.
+fs tarContext(string path)
+
+# Reads the tarball from a filesystem instead of the host. Its entries are
+# only checked as it is unpacked, so a tarball with an entry outside of the
+# filesystem fails the build, and a file that is not a tarball is not
+# unpacked.
+#
+# @param input the filesystem with the tarball, whose path is relative to the
+# root of the filesystem.
+# @return an option to read the tarball from a filesystem.
+option::tarContext input(fs input)
+
+# Strips leading components from the paths of the entries, like tar
+# --strip-components. Entries with no more components than that are left out.
+#
+# @param n the number of leading components to strip.
+# @return an option to strip leading components from the paths of the entries.
+option::tarContext stripComponents(int n)
+
+# Unpacks only a directory of the tarball, whose entries are relative to the
+# directory. The directory is selected after stripComponents. For a tarball on
+# the host, it is an error if the directory is not in the tarball, and for a
+# tarball in a filesystem the filesystem is empty instead.
+#
+# @param path the directory relative to the root of the tarball.
+# @return an option to unpack a directory of the tarball.
+option::tarContext subdir(string path)
+
+# Verifies the checksum of a tarball on the host against a digest before it is
+# synced up. The synced tarball is cached by its checksum instead of its path,
+# so that tarballs at different paths, like in the workspaces of CI jobs,
+# share the cache.
+#
+# @param digest a checksum in the form of an OCI digest.
+# https://github.com/opencontainers/image-spec/blob/master/descriptor.md#digests
+# @return an option to verify the checksum of the tarball.
+option::tarContext checksum(string digest)
+
+# Generates a filesystem using an external frontend. The ref of the frontend is
+# resolved once and the frontend is run by the digest it resolved to, which
+# must match its digest option and its digest in hlb.lock if it has them. Refs
+# with a digest are run as is.
 #
-# @param frontend a filesystem with an executable that runs a BuildKit gateway
-# GRPC client over stdio.
+# @param source an image ref of a frontend that runs a BuildKit gateway GRPC
+# client over stdio.
 # @return a filesystem generated by the external frontend.
 fs frontend(string source)
 
 # Provide an input filesystem to the external frontend. Read the documentation
 # for the frontend to see what it will accept.
 #
-# @param key an unique key for the input.
-# @param value a filesystem as an input.
-# @return an option to provide an input filesystem to the external frontend.
-option::frontend input(string key, fs value)
+# @param key an unique key for the input.
+# @param value a filesystem as an input.
+# @return an option to provide an input filesystem to the external frontend.
+option::frontend input(string key, fs value)
+
+# Provide a key value pair to the external frontend. Read the documentation
+# for the frontend to see what it will accept.
+#
+# @param key an unique key for the option.
+# @param value a value for the option.
+# @return an option to provide a key value pair to the external frontend.
+option::frontend opt(string key, string value)
+
+# Verifies the digest that the ref of the frontend resolves to, so that a tag
+# moved to another image fails instead of running it.
+#
+# @param digest the manifest digest of the frontend image, in the form of an
+# OCI digest.
+# @return an option to verify the digest of the frontend.
+option::frontend digest(string digest)
+
+# Generates a filesystem using an external frontend built from source, so that
+# a frontend can be developed without pushing its image to a registry. The
+# frontend runs the entrypoint of its filesystem&#39;s image config, like the image
+# of a frontend run by frontend. Its inputs may not be keyed &#34;dockerfile&#34; or
+# &#34;hlb-frontend&#34;, which are used to load the frontend into BuildKit.
+#
+# @param source a filesystem with a frontend that runs a BuildKit gateway GRPC
+# client over stdio.
+# @return a filesystem generated by the external frontend.
+fs devFrontend(fs source)
+
+# Provide an input filesystem to the external frontend. Read the documentation
+# for the frontend to see what it will accept.
+#
+# @param key an unique key for the input.
+# @param value a filesystem as an input.
+# @return an option to provide an input filesystem to the external frontend.
+option::devFrontend input(string key, fs value)
+
+# Provide a key value pair to the external frontend. Read the documentation
+# for the frontend to see what it will accept.
+#
+# @param key an unique key for the option.
+# @param value a value for the option.
+# @return an option to provide a key value pair to the external frontend.
+option::devFrontend opt(string key, string value)
+
+# Generates a filesystem by building a Dockerfile with the Dockerfile frontend.
+#
+# @param context a filesystem with the Dockerfile, which is also used as the
+# build context.
+# @param filename the path to the Dockerfile in the context.
+# @return a filesystem of the Dockerfile&#39;s target stage.
+fs dockerfile(fs context, string filename)
+
+# Sets the stage of the Dockerfile to build, instead of its last stage.
+#
+# @param name the name of a stage defined with &#34;FROM ... AS name&#34;.
+# @return an option to build a stage of the Dockerfile.
+option::dockerfile stage(string name)
+
+# Sets a build arg for the Dockerfile.
+#
+# @param key the name of the build arg.
+# @param value the value of the build arg.
+# @return an option to set a build arg for the Dockerfile.
+option::dockerfile arg(string key, string value)
+
+# Generates the filesystem of the last stage of a Dockerfile. When imported,
+# each named stage is a member of the import, and stages with names that are
+# not identifiers are quoted after the dot. The Dockerfile is read once, and
+# every stage is built with the same context and build args.
+#
+# @param context a filesystem with the Dockerfile, which is also used as the
+# build context.
+# @param filename the path to the Dockerfile in the context.
+# @return a filesystem of the last stage of the Dockerfile.
+fs dockerfileStages(fs context, string filename)
 
-# Provide a key value pair to the external frontend. Read the documentation
-# for the frontend to see what it will accept.
+# Sets a build arg for every stage of the Dockerfile.
 #
-# @param key an unique key for the option.
-# @param value a value for the option.
-# @return an option to provide a key value pair to the external frontend.
-option::frontend opt(string key, string value)
+# @param key the name of the build arg.
+# @param value the value of the build arg.
+# @return an option to set a build arg for the Dockerfile.
+option::dockerfileStages arg(string key, string value)
 
 # Sets the current shell command to use when executing subsequent &#34;run&#34;
 # methods. By default, this is [&#34;sh&#34;, &#34;-c&#34;].
@@ -822,6 +1986,13 @@ option::run env(string key, string value)
 # @return an option to set the working directory.
 option::run dir(string path)
 
+# Creates the working directory of the run command with its parents when it
+# does not exist in the filesystem, instead of failing before the command runs.
+# The directory is owned by the user of the run command.
+#
+# @return an option to create the working directory.
+option::run workdirCreate()
+
 # Sets the current user for the duration of the run command.
 #
 # @param name the name of the user.
@@ -859,6 +2030,39 @@ option::run security(string securitymode)
 # @return an option to attempt to optimize the command execution remoiving the /bin/sh -c &#34;...&#34; wrapper when possible.
 option::run shlex()
 
+# Pipes a string into the stdin of the run command, like a heredoc. BuildKit
+# execs have no stdin, so the input is mounted readonly at &#34;/run/hlb/stdin&#34; and
+# the command is wrapped with a shell to redirect from it. A command given as a
+# single string already runs in &#34;/bin/sh&#34; of the filesystem, which is used. Any
+# other command is wrapped with a static shell mounted at &#34;/run/hlb/shim&#34;, so
+# images without a shell can be given stdin.
+#
+# The input is never part of the layers of the run, but it is part of the
+# cache key, so the run is repeated when it changes. Anyone with access to the
+# build&#39;s cache can read it, so pass secrets with the &#34;secret&#34; option instead.
+#
+# @param content the data to pipe into stdin.
+# @return an option to pipe a string into stdin.
+option::run stdin(string content)
+
+# Pipes a file from a filesystem into the stdin of the run command. See
+# &#34;stdin&#34; for how the file is provided to the command.
+#
+# @param input the filesystem containing the file.
+# @param path the path of the file within input.
+# @return an option to pipe a file into stdin.
+option::run stdinFile(fs input, string path)
+
+# Orders the run command after another filesystem has been built, even when
+# they are otherwise independent. This is useful when the run command must
+# observe a side effect of the step, such as writes to a shared cache mount.
+# No files from the step are visible to the run command, and changes to the
+# step&#39;s contents do not invalidate the run command&#39;s cache.
+#
+# @param step the filesystem that must be built first.
+# @return an option to order the run command after a step.
+option::run dependsOn(fs step)
+
 # Adds a host entry to /etc/hosts for the duration of the run command.
 #
 # @param hostname the host name of the entry, may include spaces to delimit
@@ -884,22 +2088,60 @@ option::run ssh()
 option::run forward(string src, string dest)
 
 # Mounts a secure file for the duration of the run command. Secrets are
-# attached via a tmpfs mount, so all the data stays in volatile memory.
+# attached via a tmpfs mount, so all the data stays in volatile memory. The
+# contents of secrets are redacted from the progress, logs and errors of the
+# build.
 #
 # @param localPath the filepath for a secure file or directory.
 # @param mountPoint the directory where the secret is attached.
 # @return an option to mount a secret.
 option::run secret(string localPath, string mountPoint)
 
+# Mounts a local file as a secret for the duration of the run command. The
+# local file is registered as a secret source of the build session, so its
+# contents are never part of the build graph or its cache keys, and they are
+# redacted from the progress, logs and errors of the build.
+#
+# @param localPath the filepath of a local file, relative to the module
+# directory unless the invoker sets a secret root.
+# @param target the filepath where the secret is attached.
+# @return an option to mount a local file as a secret.
+option::run secretFile(string localPath, string target)
+
+# Mounts each local file matched by a glob as a secret for the duration of the
+# run command. Each file is attached under the target directory with its
+# basename. Directories matched by the glob are rejected rather than flattened,
+# so that files from different directories cannot be attached at the same
+# path.
+#
+# @param localGlob a glob of local files, relative to the module directory
+# unless the invoker sets a secret root.
+# @param targetDir the directory where the secrets are attached.
+# @return an option to mount local files as secrets.
+option::run secretDir(string localGlob, string targetDir)
+
 # Attaches an additional filesystem for the duration of the run command.
 #
 # @param input the additional filesystem to mount. the input&#39;s root filesystem
 # becomes available from the mountPoint directory.
 # @param mountPoint the directory where the mount is attached.
-# @param target the output filesystem after run executes
+# @param target the output filesystem after run executes. if the mount has a
+# sourcePath, the target is rooted at that path. readonly and cache mounts
+# cannot be bound.
 # @return an option to mount an additional filesystem.
 option::run mount(fs input, string mountPoint) binds (fs target)
 
+# Captures a file or directory written by the run command, like a test report
+# or coverage profile, without mounting a filesystem to write it to.
+#
+# @param path the path of the file or directory. relative paths are relative
+# to the working directory of the run command, and paths in a mount are
+# captured from the mount. readonly, cache and tmpfs mounts cannot be captured
+# from.
+# @param output a filesystem with the file or directory at its root.
+# @return an option to capture the output of the run command.
+option::run capture(string path) binds (fs output)
+
 # Sets the target directory to mount the SSH agent socket. By default, it is
 # mounted to &#34;/run/buildkit/ssh_agent.${N}&#34;, where N is the index of the 
 # socket. If $SSH_AUTH_SOCK is not set, it will set SSH_AUTH_SOCK to the
@@ -969,6 +2211,53 @@ option::secret includePatterns(variadic string pattern)
 # @return an option to attach files that don&#39;t match any pattern.
 option::secret excludePatterns(variadic string pattern)
 
+# Allows the local file to not exist, in which case no secret is attached.
+#
+# @return an option to allow the local file to not exist.
+option::secretFile optional()
+
+# Sets the user ID for the secret. By default, the UID is 0.
+#
+# @param id the user ID.
+# @return an option to set the user ID of the secret.
+option::secretFile uid(int id)
+
+# Sets the group ID for the secret. By default, the GID is 0.
+#
+# @param id the group ID.
+# @return an option to set the group ID of the secret.
+option::secretFile gid(int id)
+
+# Sets the file mode for the secret. By default, the mode is 0o400.
+#
+# @param filemode the new file mode for the secret.
+# @return an option to set the file mode of the secret.
+option::secretFile mode(int filemode)
+
+# Allows the glob to match no local files, in which case no secrets are
+# attached.
+#
+# @return an option to allow the glob to match no local files.
+option::secretDir optional()
+
+# Sets the user ID for the secrets. By default, the UID is 0.
+#
+# @param id the user ID.
+# @return an option to set the user ID of the secrets.
+option::secretDir uid(int id)
+
+# Sets the group ID for the secrets. By default, the GID is 0.
+#
+# @param id the group ID.
+# @return an option to set the group ID of the secrets.
+option::secretDir gid(int id)
+
+# Sets the file mode for the secrets. By default, the mode is 0o400.
+#
+# @param filemode the new file mode for the secrets.
+# @return an option to set the file mode of the secrets.
+option::secretDir mode(int filemode)
+
 # Sets the mount to be attached as a read-only filesystem.
 #
 # @return an option to attach the mount as a read-only filesystem..
@@ -1072,11 +2361,68 @@ option::mkfile chown(string owner)
 # @return an option to set the created time of the file.
 option::mkfile createdTime(string created)
 
-# Removes a file from the current filesystem.
+# Writes content to a file in the current filesystem, like mkfile with the
+# content last so that a heredoc can follow the path.
+#
+# @param path the path of the file.
+# @param content the contents of the file.
+# @return a filesystem with the file written.
+fs writeFile(string path, string content)
+
+# Sets the permissions of the file, which defaults to 0o644. When appending,
+# the permissions of an existing file are kept unless set.
+#
+# @param filemode the permissions of the file, from 0 to 0o7777.
+# @return an option to set the permissions of the file.
+option::writeFile mode(int filemode)
+
+# Change the owner of the file.
+#
+# @param owner the user:group owner of the file.
+# @return an option to change the owner of the file.
+option::writeFile chown(string owner)
+
+# Sets the created time of the file. It cannot be used with append.
+#
+# @param created the created time in the RFC3339 format.
+# @return an option to set the created time of the file.
+option::writeFile createdTime(string created)
+
+# Appends the content to the file instead of replacing it. The file is read
+# and written when the filesystem is solved, so the result is cached with the
+# contents of the file as usual. It is an error if the file does not exist,
+# unless createIfMissing is also set.
+#
+# Appending runs a helper alpine image with the filesystem mounted.
+#
+# @return an option to append to the file.
+option::writeFile append()
+
+# Creates the file if it does not exist when appending.
+#
+# @return an option to create a missing file when appending.
+option::writeFile createIfMissing()
+
+# Processes the content as a Go text template before writing it, with the
+# fields set by field.
+#
+# @return an option to process the content as a template.
+option::writeFile templated()
+
+# Add a string field with provided name to be available inside the template
+# of a templated file.
 #
-# @param path the path of the file to remove.
-# @return a filesystem with a file removed.
-fs rm(string path)
+# @param name the name of the field inside the template.
+# @param value the value of the field.
+# @return an option to add a field to the template.
+option::writeFile field(string name, string value)
+
+# Removes files from the current filesystem. All the paths are removed by a
+# single file operation.
+#
+# @param paths the paths of the files to remove.
+# @return a filesystem with the files removed.
+fs rm(variadic string paths)
 
 # Allows the file to not be found.
 #
@@ -1088,6 +2434,25 @@ option::rm allowNotFound()
 # @return an option to allow wildcards in the path to remove.
 option::rm allowWildcard()
 
+# Protects the files that match a pattern from being removed. The protected
+# files are restored from the filesystem before removal within the same file
+# operation, so the result only depends on the inputs and is cached as usual.
+# The option may be given more than once.
+#
+# @param pattern a pattern for files that should not be removed.
+# @return an option to keep the files that match the pattern.
+option::rm except(string pattern)
+
+# Removes paths from the current filesystem in a layer of their own, so that
+# they stay absent in the final image even if a base image provides them. When
+# the image is exported, the layer records a whiteout for each path that exists
+# in the layers below, which hides it however the layers are applied. Paths
+# that do not exist are ignored, and wildcards are not supported.
+#
+# @param paths the paths to remove.
+# @return a filesystem with the paths removed.
+fs whiteout(variadic string paths)
+
 # Copies a file from an input filesystem into the current filesystem.
 #
 # @param input the filesystem to copy from.
@@ -1134,12 +2499,40 @@ option::copy allowEmptyWildcard()
 # @return an option to change the owner of the copy path.
 option::copy chown(string owner)
 
+# Resolve the user and group names of chown to numeric ids using the
+# /etc/passwd and /etc/group files of a filesystem. The names are resolved
+# when the build is generated, so the copy has the right owner even if the
+# destination has no such users, like a scratch image. Has no effect without
+# chown.
+#
+# @param input the filesystem with the users and groups.
+# @return an option to resolve the owner names of the copy path.
+option::copy chownFrom(fs input)
+
 # Modifies the permissions of the copied files.
 #
 # @param filemode the new permissions of the file.
 # @return an option to chmod the file.
 option::copy chmod(int filemode)
 
+# Modifies the permissions of the regular files being copied, leaving the
+# directories unchanged. Use it with dirMode to fix the permissions of a
+# copied tree, like 0o644 for files and 0o755 for directories. The permissions
+# are changed with a helper alpine image before the files are copied, so the
+# source filesystem is left unchanged. Cannot be combined with chmod.
+#
+# @param filemode the new permissions of the files.
+# @return an option to chmod the copied files.
+option::copy fileMode(int filemode)
+
+# Modifies the permissions of the directories being copied, including the
+# source path if it is a directory, leaving the files unchanged. Cannot be
+# combined with chmod.
+#
+# @param filemode the new permissions of the directories.
+# @return an option to chmod the copied directories.
+option::copy dirMode(int filemode)
+
 # Sets the created time of the copy path.
 #
 # @param created the created time in the RFC3339 format.
@@ -1154,12 +2547,85 @@ option::copy createdTime(string created)
 option::copy includePatterns(variadic string pattern)
 
 # Copy only files that do not match any of the excluded patterns. If source
-# path is for a file, then exclude patterns are ignored.
+# path is for a file, then exclude patterns are ignored. Patterns prefixed
+# with &#34;!&#34; re-include files excluded by earlier patterns, like a
+# .dockerignore file, and the last pattern that matches a file wins.
 #
 # @param pattern a list of patterns for files that should not be copied.
 # @return an option to copy files that don&#39;t match any pattern.
 option::copy excludePatterns(variadic string pattern)
 
+# Copy only files that do not have any of the excluded extensions, at any depth
+# within the source path. If source path is for a file, then excluded
+# extensions are ignored.
+#
+# @param extensions a list of file extensions, like &#34;a&#34; or &#34;.gz&#34;.
+# @return an option to copy files that don&#39;t have any of the extensions.
+option::copy excludeExtensions(variadic string extensions)
+
+# Copy only files that are at most the given size. Larger files within the
+# source path are skipped, and if the source path is itself a larger file then
+# nothing is copied. Sizes are only known before the build for local sources,
+# so this option is not supported when copying from other filesystems.
+#
+# @param bytes the maximum size in bytes of files to copy.
+# @return an option to skip files larger than the size.
+option::copy maxSize(int bytes)
+
+# Replace every occurrence of a placeholder with a value in the text files
+# being copied. Files containing a NUL byte are considered binary and are left
+# unchanged. The option may be repeated, and substitutions are applied in order.
+#
+# The substitutions are applied with a helper alpine image before the files are
+# copied, so the source filesystem is left unchanged.
+#
+# @param placeholder the literal text to replace.
+# @param value the text to replace the placeholder with.
+# @return an option to substitute placeholders in the copied text files.
+option::copy substitute(string placeholder, string value)
+
+# Exclude the files with the export-ignore attribute in the .gitattributes at
+# the root of a git source, like git archive does. Patterns without a slash
+# match at any depth, and a later line that unsets the attribute re-includes
+# the files it matches. The patterns of excludePatterns are applied after
+# them. Nothing is excluded if the repository has no .gitattributes, and
+# this option is not supported when copying from other filesystems.
+#
+# @return an option to exclude export-ignored files.
+option::copy exportIgnore()
+
+# Record a manifest of the files brought in by the copy. Each line of the
+# manifest is the sha256 digest, mode in octal and path of a copied file
+# relative to the root of the filesystem, separated by spaces and sorted by
+# path. Only regular files and symlinks are recorded, and a symlink is recorded
+# by its target. The files are recorded as they are copied, after options like
+# substitute and fileMode are applied.
+#
+# @param path the path to write the manifest to. relative paths are relative to
+# the working directory.
+# @param manifest a filesystem with only the manifest at the path.
+# @return an option to record a manifest of the copied files.
+option::copy manifest(string path) binds (fs manifest)
+
+# Downloads an archive from a HTTP URL, verifies its checksum and unpacks it
+# into the current filesystem, like copying from http with the checksum option
+# and unpack. The checksum is verified before unpacking, so an archive that
+# does not match fails the build without changing the filesystem. A file that
+# is not an archive is copied into the destination as is.
+#
+# @param url a fully-qualified URL to send a HTTP GET request.
+# @param digest the checksum of the archive in the form of an OCI digest.
+# @param dest the directory to unpack the archive into, which is created if it
+# does not exist.
+# @return a filesystem with the archive unpacked.
+fs fetchArchive(string url, string digest, string dest)
+
+# Change the owner of the unpacked files.
+#
+# @param owner the user:group owner of the files.
+# @return an option to change the owner of the files.
+option::fetchArchive chown(string owner)
+
 # Merges one or more input filesystems into the current filesystem.
 #
 # @param input filesystems to merge.
@@ -1173,6 +2639,79 @@ fs merge(variadic fs inputs)
 # @return differences from base
 fs diff(fs base)
 
+# Combines stages that are built in parallel into a new filesystem, like
+# merging each of them onto scratch. This is the fan-out then combine pattern,
+# where independent stages are built concurrently and their outputs are
+# gathered into one filesystem. The image config is taken from the first
+# stage.
+#
+# By default, a path in more than one stage is taken from the last of them.
+#
+# @param stages the filesystems to build in parallel and combine.
+# @return a filesystem with the union of the stages.
+fs combine(variadic fs stages)
+
+# Sets how a path in more than one stage is combined.
+#
+# @param policy the conflict policy, must be one of the following:
+# - last: take the path from the last stage that has it.
+# - first: take the path from the first stage that has it.
+# - error: fail the build if the path differs between stages. Paths that are
+# identical in every stage are not conflicts. The stages are compared in a
+# helper alpine image.
+# @return an option to set how conflicting paths are combined.
+option::combine conflict(string policy)
+
+# Removes debug symbols from ELF binaries in the current filesystem to reduce
+# their size. Files that are not ELF binaries are left unchanged with a warning
+# in the build output.
+#
+# The binaries are stripped with binutils from a helper image, which defaults
+# to alpine with binutils installed.
+#
+# @param paths the paths of the binaries to strip.
+# @return the filesystem with debug symbols removed from the binaries.
+fs strip(variadic string paths)
+
+# Strip binaries using a helper filesystem instead of the default. The helper
+# must provide /bin/sh, head, od and a binutils compatible strip in its PATH.
+#
+# @param helper the filesystem to run strip in.
+# @return an option to strip binaries using the helper.
+option::strip helper(fs helper)
+
+# Scans the filesystem for vulnerabilities and license violations, and fails
+# the build if any are at or above the severity threshold. The build fails
+# before the calls after scan, so a scan before dockerPush prevents an image
+# that violates the policy from being pushed.
+#
+# By default, the filesystem is scanned by running trivy with the filesystem
+# mounted read-only.
+#
+# @return an option to scan the filesystem.
+fs scan()
+
+# Sets the lowest severity that fails the build, which defaults to HIGH.
+#
+# @param severity one of UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL.
+# @return an option to set the severity threshold of the scan.
+option::scan severityThreshold(string severity)
+
+# Ignores a finding, which can be repeated to ignore many findings.
+#
+# @param id the ID of a vulnerability, like a CVE ID, or the name of a license.
+# @return an option to ignore a finding of the scan.
+option::scan ignore(string id)
+
+# Writes the JSON report of the scan into the filesystem. When the scan
+# fails, the filesystem is never built, so the report is written to the path
+# under the working directory instead.
+#
+# @param path the path to write the report to, whose parent directories are
+# created if they don&#39;t exist.
+# @return an option to write the report of the scan.
+option::scan reportPath(string path)
+
 # Pushes the filesystem to a registry following the distribution
 # spec: https://github.com/opencontainers/distribution-spec/
 #
@@ -1191,6 +2730,15 @@ fs dockerPush(string ref) binds (string digest)
 # @return an option to compress image as eStargz before pushing.
 option::dockerPush stargz()
 
+# Fails the build if the pushed image is larger than a size budget. The size of
+# an image is the size of its config and compressed layers in the registry, so
+# the image is first pushed by its digest and only tagged if it fits in the
+# budget. Not supported by the buildkit embedded in the docker engine.
+#
+# @param bytes the largest allowed size of the image in bytes.
+# @return an option to enforce a size budget on the pushed image.
+option::dockerPush maxImageSize(int bytes)
+
 # Loads the filesystem as a Docker image to the docker client found in your
 # environment.
 #
@@ -1205,6 +2753,29 @@ fs dockerLoad(string ref)
 # @return an option to download a filesystem to the local system.
 fs download(string localPath)
 
+# Names the downloaded file with a Go text template, when the filesystem is a
+# single file. The file is written to the local path with the name, instead of
+# the name it has in the filesystem. The template has the fields:
+#
+#   .Name   the name of the file in the filesystem.
+#   .Base   the name without its extension.
+#   .Ext    the extension of the name, like &#34;.tar.gz&#34;, or the extension of its
+#           content type when the name has none.
+#   .Digest the hex encoded sha256 digest of the file.
+#
+# @param template the template of the name, like &#34;app-{{.Digest}}{{.Ext}}&#34;.
+# @return an option to name the downloaded file.
+option::download filename(string template)
+
+# Names the downloaded file after its content, when the filesystem is a single
+# file. The http source already names its file from the Content-Disposition
+# header of the response, or the path of its URL, so the name is kept and the
+# extension of its content type is added when the name has none. This is the
+# same as filename(&#34;{{.Base}}{{.Ext}}&#34;).
+#
+# @return an option to name the downloaded file after its content.
+option::download contentFilename()
+
 # Downloads the filesystem as a tarball to a local path.
 #
 # @param localPath the destination filepath for the tarball.
@@ -1251,11 +2822,14 @@ fs cmd(variadic string args)
 fs label(string key, string value)
 
 # Exposes a set of network ports at runtime. The default is TCP if the protocol
-# is not specified.
+# is not specified. Ports are specified as port[/protocol] or as a range
+# start-end[/protocol], where the protocol is one of tcp, udp or sctp. Ports
+# exposed by the base image are kept, and exposing them again is warned about.
 #
 # This metadata is only useful when exporting as a Docker image.
 #
-# @param ports the set of ports to expose.
+# @param ports the set of ports to expose, like &#34;8080&#34;, &#34;53/udp&#34; or
+# &#34;9000-9005/tcp&#34;.
 # @return the filesystem with exposed ports set.
 fs expose(variadic string ports)
 
@@ -1280,11 +2854,174 @@ fs volumes(variadic string mountpoints)
 # @return the filesystem with the stop signal set.
 fs stopSignal(string signal)
 
+# Sets many fields of the image config at once. The options are applied in
+# order, and fields that are not set are kept from the base image. Unlike the
+# builtins that set a single field, labels can also be removed.
+#
+# This metadata is only useful when exporting as a Docker image.
+#
+# @return the filesystem with the image config changed.
+fs imageConfig()
+
+# Defines a list of arguments to use as the command to execute when the
+# container starts.
+#
+# @param args the command to execute.
+# @return an option to set the entrypoint.
+option::imageConfig entrypoint(variadic string args)
+
+# Sets the default arguments to the entrypoint of the container.
+#
+# @param args the default arguments.
+# @return an option to set the default arguments to the entrypoint.
+option::imageConfig cmd(variadic string args)
+
+# Sets an environment key pair for the container and for all subsequent calls
+# in this filesystem block.
+#
+# @param key the environment key.
+# @param value the environment value.
+# @return an option to set an environment key pair.
+option::imageConfig env(string key, string value)
+
+# Sets the working directory for the container and for all subsequent calls in
+# this filesystem block. A relative path is relative to the current working
+# directory.
+#
+# @param path the new working directory.
+# @return an option to set the working directory.
+option::imageConfig workdir(string path)
+
+# Sets the user for the container and for all subsequent calls in this
+# filesystem block.
+#
+# @param name the name of the user.
+# @return an option to set the user.
+option::imageConfig user(string name)
+
+# Sets arbitrary metadata for the container.
+#
+# @param key the metadata key.
+# @param value the metadata value.
+# @return an option to set a metadata key pair.
+option::imageConfig label(string key, string value)
+
+# Removes metadata of the container, including metadata set by the base image.
+#
+# @param key the metadata key.
+# @return an option to remove a metadata key pair.
+option::imageConfig removeLabel(string key)
+
+# Marks a set of mount points as holding externally mounted volumes.
+#
+# @param mountpoints the set of mountpoints to mark.
+# @return an option to add volumes.
+option::imageConfig volume(variadic string mountpoints)
+
+# Exposes a set of network ports at runtime, in the same format as expose.
+#
+# @param ports the set of ports to expose, like &#34;8080&#34; or &#34;53/udp&#34;.
+# @return an option to expose ports.
+option::imageConfig exposed(variadic string ports)
+
+# Sets the system call signal that will be sent to the container to exit.
+#
+# @param signal the stop signal to send to the container.
+# @return an option to set the stop signal.
+option::imageConfig stopSignal(string signal)
+
+# Sets the check that the container is healthy. The check is either &#34;NONE&#34; to
+# disable the check of the base image, &#34;CMD&#34; followed by a command and its
+# arguments, or &#34;CMD-SHELL&#34; followed by a command run with the default shell.
+#
+# @param test the check to run.
+# @return an option to set the healthcheck.
+option::imageConfig healthcheck(variadic string test)
+
+# Sets whether the arguments of the entrypoint and command are already escaped,
+# which is only meaningful for Windows images.
+#
+# @param escaped whether the arguments are escaped.
+# @return an option to set whether the arguments are escaped.
+option::imageConfig argsEscaped(bool escaped)
+
+# Sets the time between running the check.
+#
+# @param interval the duration between checks, like &#34;30s&#34;.
+# @return an option to set the interval of the healthcheck.
+option::healthcheck interval(string interval)
+
+# Sets the time after which a check that hasn&#39;t completed is considered to have
+# failed.
+#
+# @param timeout the duration of a check, like &#34;5s&#34;.
+# @return an option to set the timeout of the healthcheck.
+option::healthcheck timeout(string timeout)
+
+# Sets the time the container is given to start, during which failed checks
+# are not counted.
+#
+# @param startPeriod the duration to start the container, like &#34;1m&#34;.
+# @return an option to set the start period of the healthcheck.
+option::healthcheck startPeriod(string startPeriod)
+
+# Sets the number of consecutive failed checks for the container to be
+# unhealthy.
+#
+# @param retries the number of retries.
+# @return an option to set the retries of the healthcheck.
+option::healthcheck retries(int retries)
+
+# Fails the build if a condition is false. The filesystem is unchanged, so
+# assertions can be made between other statements.
+#
+# @param condition the condition that must be true.
+# @param message the message to fail with.
+# @return the filesystem unchanged.
+fs assert(bool condition, string message)
+
+# Fails the build with a message, like an assert whose condition is always
+# false. The statements after it in a block are never run.
+#
+# @param message the message to fail with.
+# @return never returns, the build fails instead.
+fs fail(string message)
+
+# Fails the build if a string is not equal to the expected string, reporting
+# both values.
+#
+# @param actual the string to check.
+# @param expected the string it must be equal to.
+# @return the filesystem unchanged.
+fs assertEq(string actual, string expected)
+
+# Fails the build if a path does not exist in a filesystem. The path is matched
+# literally, so wildcards are not supported. Symbolic links are followed.
+#
+# @param input the filesystem to look in.
+# @param path the path that must exist.
+# @return the filesystem unchanged.
+fs assertExists(fs input, string path)
+
+# Fails the build if a file in a filesystem does not contain a substring.
+#
+# @param input the filesystem to look in.
+# @param path the path of the file to read.
+# @param substring the substring the file must contain.
+# @return the filesystem unchanged.
+fs assertFileContains(fs input, string path, string substring)
+
 # A format specifier that is interpolated with values.
 #
+# The verbs of the format specifier are those of Go&#39;s fmt package, with flags,
+# widths, precisions and argument indexes like %[1]s to format a value more
+# than once. Strings are formatted with %s, %q, %x, %X or %v, ints with %d, %b,
+# %o, %O, %x, %X, %c, %q or %v, and bools with %t or %v. Every value must be
+# formatted by a verb of its kind.
+#
 # @param formatString the format specifier.
-# @param values the list of values to be interpolated into the format
-# specifier.
+# @param values the list of strings, ints or bools to be interpolated into the
+# format specifier.
 # @return the resulting string from formatting.
 string format(string formatString, variadic string values)
 
@@ -1298,17 +3035,66 @@ string localArch()
 # @return the current working directory.
 string localCwd()
 
-# An environment variable from the client&#39;s local environment.
+# An environment variable from the client&#39;s local environment. Within a
+# pipeline, values set by stageEnv take precedence. Values of variables whose
+# names contain TOKEN, PASSWORD, KEY or SECRET, or the sensitive patterns set by
+# the invoker, are redacted from the progress, logs and errors of the build.
 #
 # @param key the environment variable&#39;s key.
 # @return the environment variable&#39;s value.
 string localEnv(string key)
 
+# Marks a string as sensitive, so that it is redacted from the progress, logs
+# and errors of the build, along with its base64 and URL encodings. Values
+# shorter than 5 characters are never redacted, because they are too likely to
+# appear in unrelated output.
+#
+# @param value the sensitive string.
+# @return the string as is.
+string sensitive(string value)
+
 # The OS from the clients local environment.
 #
 # @return the OS
 string localOs()
 
+# The name the current function was called by. Within a function evaluated
+# through one of its bindings, like a target declared with as, this is the
+# name of the binding, and otherwise it is the name of the function. Functions
+# called from the current function have their own name.
+#
+# @return the name of the current function.
+string bindingName()
+
+# The OS of the platform being built for, which is the platform being
+# evaluated within perPlatform, or otherwise the default platform.
+#
+# @return the OS of the target platform.
+string targetOs()
+
+# The architecture of the platform being built for, which is the platform being
+# evaluated within perPlatform, or otherwise the default platform.
+#
+# @return the architecture of the target platform.
+string targetArch()
+
+# Evaluates a string once for each platform and joins the results. Within the
+# body, targetOs and targetArch resolve to the platform being evaluated, and
+# images are resolved for it. The bodies of each platform are evaluated
+# concurrently, but the results are always joined in the order the platforms
+# were given, separated by newlines by default.
+#
+# @param body the string to evaluate for each platform.
+# @param platforms the platforms to evaluate the body for, like &#34;linux/arm64&#34;.
+# @return the results of each platform joined by the separator.
+string perPlatform(string body, variadic string platforms)
+
+# Sets the separator the results of each platform are joined by.
+#
+# @param separator the text between the results of each platform.
+# @return an option to set the separator.
+option::perPlatform separator(string separator)
+
 # Executes an command in the local environment.
 #
 # If exactly one arg is given it will be wrapped with /bin/sh -c &#39;arg&#39;.
@@ -1342,6 +3128,213 @@ option::localRun onlyStderr()
 # /bin/sh -c &#34;...&#34; wrapper when possible.
 option::localRun shlex()
 
+# The commit checked out by a git source or a local git repository. For a git
+# source pinned to a commit, the commit is returned as is. Otherwise the ref is
+# resolved with the git client in the local environment.
+#
+# @param repo a filesystem from a git source or a local directory within a git
+# repository.
+# @return the full commit sha.
+string gitCommit(fs repo)
+
+# The branch checked out by a git source or a local git repository. A git
+# source without a ref returns the default branch of the remote.
+#
+# @param repo a filesystem from a git source or a local directory within a git
+# repository.
+# @return the short branch name, like &#34;main&#34;.
+string gitBranch(fs repo)
+
+# Whether a command succeeds in a filesystem. Unlike &#34;run&#34;, a command that
+# exits with a non-zero status does not fail the build, so its result can gate
+# the steps that follow. The command is wrapped with &#34;/bin/sh&#34; to record its
+# exit status, which must exist in the filesystem, and the filesystem is
+# unchanged by the command.
+#
+# If exactly one arg is given it will be wrapped with /bin/sh -c &#39;arg&#39;.
+# If more than one arg is given, it will be executed directly, without a shell.
+#
+# @param input the filesystem to execute the command in.
+# @param command a command to execute.
+# @param args optional arguments to the command.
+# @return true if the command exits with a zero status, otherwise false.
+bool tryRun(fs input, string command, variadic string args)
+
+# Sets an environment key pair for the duration of the command.
+#
+# @param key the environment key.
+# @param value the environment value.
+# @return an option to set an environment key pair.
+option::tryRun env(string key, string value)
+
+# Sets the working directory for the duration of the command.
+#
+# @param path the new working directory.
+# @return an option to set the working directory.
+option::tryRun dir(string path)
+
+# Sets the current user for the duration of the command.
+#
+# @param name the name of the user.
+# @return an option to set the current user.
+option::tryRun user(string name)
+
+# Ignore any previously cached results for the command, so that it is run
+# again to check whether it still succeeds.
+#
+# @return an option to ignore existing cache for the command.
+option::tryRun ignoreCache()
+
+# Sets the networking mode for the duration of the command. See &#34;run&#34; for the
+# network modes.
+#
+# @param networkmode the network mode of the container, one of &#34;unset&#34;, &#34;host&#34;
+# or &#34;none&#34;.
+# @return an option to set the networking mode.
+option::tryRun network(string networkmode)
+
+# Sets the security mode for the duration of the command. See &#34;run&#34; for the
+# security modes.
+#
+# @param securitymode the security mode of the container, one of &#34;sandbox&#34; or
+# &#34;insecure&#34;.
+# @return an option to set the security mode.
+option::tryRun security(string securitymode)
+
+# Attempt to lex the single-argument shell command provided to &#34;tryRun&#34;
+# to determine if a &#34;/bin/sh -c &#39;...&#39;&#34; wrapper needs to be added.
+#
+# @return an option to attempt to optimize the command execution removing the
+# /bin/sh -c &#34;...&#34; wrapper when possible.
+option::tryRun shlex()
+
+# Pipes a string into the stdin of the command. See &#34;stdin&#34; of &#34;run&#34; for how
+# the input is provided to the command.
+#
+# @param content the data to pipe into stdin.
+# @return an option to pipe a string into stdin.
+option::tryRun stdin(string content)
+
+# Adds a host entry to /etc/hosts for the duration of the command.
+#
+# @param hostname the host name of the entry, may include spaces to delimit
+# multiple host names.
+# @param address the IP of the entry.
+# @return an option to add a host entry.
+option::tryRun host(string hostname, string address)
+
+# Whether a path exists in a filesystem. The path is matched literally, so
+# wildcards are not supported. Symbolic links are followed, so a link to a
+# missing path does not exist.
+#
+# @param input the filesystem to look in.
+# @param path the path to look for.
+# @return true if the path exists, otherwise false.
+bool exists(fs input, string path)
+
+# Checks the path itself instead of following it if it is a symbolic link.
+#
+# @return an option to not follow symbolic links.
+option::exists noFollow()
+
+# Whether a path in a filesystem is a directory. The path is matched literally,
+# so wildcards are not supported. Symbolic links are followed, and it is an
+# error if the path does not exist.
+#
+# @param input the filesystem to look in.
+# @param path the path to check.
+# @return true if the path is a directory, otherwise false.
+bool isDir(fs input, string path)
+
+# Checks the path itself instead of following it if it is a symbolic link.
+#
+# @return an option to not follow symbolic links.
+option::isDir noFollow()
+
+# The permissions of a path in a filesystem. The path is matched literally, so
+# wildcards are not supported. Symbolic links are followed, and it is an error
+# if the path does not exist.
+#
+# @param input the filesystem to look in.
+# @param path the path to check.
+# @return the permissions in octal, like &#34;0644&#34;.
+string fileMode(fs input, string path)
+
+# Checks the path itself instead of following it if it is a symbolic link.
+#
+# @return an option to not follow symbolic links.
+option::fileMode noFollow()
+
+# The contents of a file in a filesystem. The path is matched literally, so
+# wildcards are not supported. Symbolic links are followed, and it is an error
+# if the file does not exist.
+#
+# @param input the filesystem to read from.
+# @param path the path of the file to read.
+# @return the contents of the file.
+string readFile(fs input, string path)
+
+# A report of the changes to the image config of a filesystem relative to the
+# image it started from, like the environment variables, labels and exposed
+# ports it adds, removes or changes, and the entrypoint it replaces. The report
+# is a JSON object with the canonical reference of the base image and a field
+# for each part of the config that changed, so that inherited config and
+# unintended changes can be audited, for instance by printing it in CI. A
+# filesystem that did not start from an image is compared to an empty config.
+#
+# @param input the filesystem whose image config is compared.
+# @return the changes to the image config as JSON.
+string imageConfigDiff(fs input)
+
+# A spec to run the image of a filesystem locally, like for smoke tests, which
+# can be written to a file with writeFile or printed by a target. The spec runs
+# the entrypoint and command of the image config, and publishes the ports it
+# exposes on the same ports of the host unless they are published otherwise.
+# By default the spec is a docker run command line.
+#
+# @param input the filesystem whose image config is run.
+# @param ref the reference the image is run as, like the reference it is
+# pushed or loaded as.
+# @return the spec to run the image.
+string runtimeSpec(fs input, string ref)
+
+# Publishes a port of the container on a port of the host. An exposed port that
+# is published this way is not published on the same port of the host.
+#
+# @param hostPort the port of the host.
+# @param containerPort the port of the container with an optional protocol, like
+# 8080 or 53/udp.
+# @return an option to publish a port.
+option::runtimeSpec publish(int hostPort, string containerPort)
+
+# Binds a path of the host into the container.
+#
+# @param hostPath the path of the host.
+# @param containerPath the absolute path in the container.
+# @return an option to bind a path of the host.
+option::runtimeSpec bind(string hostPath, string containerPath)
+
+# Sets an environment variable of the container, in addition to the ones of the
+# image config.
+#
+# @param key the name of the environment variable.
+# @param value the value of the environment variable.
+# @return an option to set an environment variable.
+option::runtimeSpec env(string key, string value)
+
+# Replaces the command of the image config, which is run by its entrypoint.
+#
+# @param args the command and its arguments.
+# @return an option to replace the command.
+option::runtimeSpec commandOverride(variadic string args)
+
+# Sets the format of the spec.
+#
+# @param format either docker for a docker run command line, or compose for a
+# compose file with a service named after the reference.
+# @return an option to set the format of the spec.
+option::runtimeSpec format(string format)
+
 # Fetch an OCI image&#39;s manifest from the registry. This uses the current platform
 # by default.
 #
@@ -1380,5 +3373,33 @@ option::template stringField(string name, string value)
 # @return a pipeline that returns when all its targets have finished.
 pipeline stage(variadic pipeline pipelines)
 
+# Executes filesystem stages one after another, where each stage starts from
+# the filesystem produced by the previous stage, as if its statements were
+# written in the same filesystem block. The first stage starts from scratch.
+#
+# @param stages the filesystems to build on top of each other in order.
+# @return a pipeline that returns when the final filesystem has been built.
+pipeline sequence(variadic fs stages)
+
+# Pauses the pipeline until the gate is approved, like before promoting a
+# release from staging to production. Gates are approved by the gate handler
+# of the run, which prompts on the terminal when run interactively. The stages
+# before the gate are finished before it is reached, and the stages after it
+# start only once it is approved. A gate that is rejected or times out fails
+# the pipeline.
+#
+# @param message the message describing what is being approved.
+# @return a pipeline that returns when the gate has been approved.
+pipeline gate(string message)
+
+# Sets a value in the environment of the pipeline, which is read by localEnv
+# in the statements after it, including in the pipelines and filesystems they
+# call, before the environment of the local system.
+#
+# @param key the name of the environment variable.
+# @param value the value of the environment variable.
+# @return the pipeline it is called on.
+pipeline stageEnv(string key, string value)
+
 `
 )
@@ -2,6 +2,7 @@ package checker
 
 import (
 	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/parser/ast"
 )
 
@@ -39,3 +40,53 @@ func NewBuiltinScope(builtins builtin.BuiltinLookup) *ast.Scope {
 
 	return scope
 }
+
+// RunDefaults is the name of the option::run function that a module declares
+// to set the default options of every run in the module.
+const RunDefaults = "runDefaults"
+
+var (
+	NetworkModes     = []string{"unset", "host", "none"}
+	SecurityModes    = []string{"sandbox", "insecure"}
+	SharingModes     = []string{"shared", "private", "locked"}
+	ConflictPolicies = []string{"last", "first", "error"}
+
+	// RuntimeSpecFormats are the formats of a runtimeSpec.
+	RuntimeSpecFormats = []string{"docker", "compose"}
+
+	// Severities are the severities of scan findings, from least to most
+	// severe.
+	Severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+)
+
+// Enum is a string parameter of a builtin that only accepts specific values.
+type Enum struct {
+	Index  int
+	Values []string
+	Err    func(arg ast.Node, value string, values []string) error
+}
+
+// BuiltinEnums are the enum parameters of builtins, keyed by the kind and name
+// of the builtin.
+var BuiltinEnums = map[ast.Kind]map[string]Enum{
+	"option::run": {
+		"network":  {0, NetworkModes, errdefs.WithInvalidNetworkMode},
+		"security": {0, SecurityModes, errdefs.WithInvalidSecurityMode},
+	},
+	"option::tryRun": {
+		"network":  {0, NetworkModes, errdefs.WithInvalidNetworkMode},
+		"security": {0, SecurityModes, errdefs.WithInvalidSecurityMode},
+	},
+	"option::mount": {
+		"cache": {1, SharingModes, errdefs.WithInvalidSharingMode},
+	},
+	"option::combine": {
+		"conflict": {0, ConflictPolicies, errdefs.WithInvalidConflictPolicy},
+	},
+	"option::scan": {
+		"severityThreshold": {0, Severities, errdefs.WithInvalidSeverity},
+	},
+	"option::runtimeSpec": {
+		"format": {0, RuntimeSpecFormats, errdefs.WithInvalidRuntimeSpecFormat},
+	},
+}
@@ -7,18 +7,23 @@ package checker
 
 import (
 	"fmt"
+	"path"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/openllb/hlb/diagnostic"
 	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/imageutil"
+	"github.com/openllb/hlb/pkg/llbutil"
 )
 
 func SemanticPass(mod *ast.Module) error {
 	c := &checker{
 		dups: make(map[string][]ast.Node),
 	}
-	return c.SemanticPass(mod)
+	return errdefs.WithCheckError(c.SemanticPass(mod))
 }
 
 // Check fills in semantic data in the module and check for semantic errors.
@@ -26,7 +31,7 @@ func SemanticPass(mod *ast.Module) error {
 // References that refer to imported identifiers are checked with
 // CheckReferences after imports have been resolved.
 func Check(mod *ast.Module) error {
-	return new(checker).Check(mod)
+	return errdefs.WithCheckError(new(checker).Check(mod))
 }
 
 // CheckReferences checks for semantic errors for references. Imported modules
@@ -36,7 +41,7 @@ func CheckReferences(mod *ast.Module, name string) error {
 		checkRefs: true,
 		dups:      make(map[string][]ast.Node),
 	}
-	return c.CheckReferences(mod, name)
+	return errdefs.WithCheckError(c.CheckReferences(mod, name))
 }
 
 type checker struct {
@@ -219,7 +224,44 @@ func (c *checker) Check(mod *ast.Module) error {
 				obj.Exported = true
 			}
 		},
+		func(call *ast.CallStmt) {
+			err := c.checkMountBind(call)
+			if err != nil {
+				c.err(err)
+			}
+			err = c.checkExpose(call)
+			if err != nil {
+				c.err(err)
+			}
+			err = c.checkStatPath(call.Name, call.Args)
+			if err != nil {
+				c.err(err)
+			}
+			err = c.checkWriteFile(call)
+			if err != nil {
+				c.err(err)
+			}
+			err = c.checkRuntimeSpec(call)
+			if err != nil {
+				c.err(err)
+			}
+		},
+		func(call *ast.CallExpr) {
+			err := c.checkStatPath(call.Name, call.Arguments())
+			if err != nil {
+				c.err(err)
+			}
+		},
 		func(fd *ast.FuncDecl) {
+			err := c.checkRunDefaults(fd)
+			if err != nil {
+				c.err(err)
+			}
+			err = c.checkPrewarm(fd)
+			if err != nil {
+				c.err(err)
+			}
+
 			if fd.Sig.Params != nil {
 				err := c.checkFieldList(fd.Sig.Params.Fields())
 				if err != nil {
@@ -248,9 +290,87 @@ func (c *checker) Check(mod *ast.Module) error {
 		return &diagnostic.Error{Diagnostics: c.errs}
 	}
 
+	ast.Match(mod, ast.MatchOpts{},
+		func(_ *ast.ImportDecl, ie *ast.IdentExpr) {
+			err := c.checkBindScope(mod.Scope, nil, ie)
+			if err != nil {
+				c.err(err)
+			}
+		},
+		func(fd *ast.FuncDecl, ie *ast.IdentExpr) {
+			err := c.checkBindScope(fd.Scope, fd, ie)
+			if err != nil {
+				c.err(err)
+			}
+		},
+	)
+	if len(c.errs) > 0 {
+		return &diagnostic.Error{Diagnostics: c.errs}
+	}
+
 	return nil
 }
 
+// checkBindScope checks that an identifier in a function, or outside of any
+// function if fd is nil, only refers to a binding where it is visible: in the
+// statements after the one that binds it in the innermost block around it,
+// including the blocks nested in them. Evaluating a binding evaluates its
+// closure up to and including that statement, so an earlier use would depend
+// on itself, and a use in another function would depend on the closure's
+// arguments.
+func (c *checker) checkBindScope(scope *ast.Scope, fd *ast.FuncDecl, ie *ast.IdentExpr) error {
+	if ie.Reference != nil {
+		return nil
+	}
+
+	obj := scope.Lookup(ie.Ident.Text)
+	if obj == nil {
+		return nil
+	}
+	binds, ok := obj.Node.(*ast.BindClause)
+	if !ok || binds.Closure == nil {
+		return nil
+	}
+	if binds.Closure != fd {
+		return errdefs.WithBindOutOfScope(ie.Ident, obj.Ident, binds.Closure.Sig.Name)
+	}
+
+	block := bindBlock(fd.Body, binds)
+	if !contains(block, ie) {
+		return errdefs.WithBindOutOfBlock(ie.Ident, obj.Ident)
+	}
+	for _, stmt := range block.Stmts() {
+		if contains(stmt, binds) {
+			if ie.Position().Offset < stmt.End().Offset {
+				return errdefs.WithBindUsedBeforeBound(ie.Ident, obj.Ident)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// bindBlock returns the innermost block of a function body around a bind
+// clause. Option blocks are skipped, because their bindings are bound by the
+// call the options are for.
+func bindBlock(body *ast.BlockStmt, binds *ast.BindClause) *ast.BlockStmt {
+	block := body
+	ast.Match(body, ast.MatchOpts{},
+		func(bs *ast.BlockStmt) {
+			if bs.Kind().Primary() != ast.Option && contains(bs, binds) && contains(block, bs) {
+				block = bs
+			}
+		},
+	)
+	return block
+}
+
+// contains returns true if the source of node is within the source of parent.
+func contains(parent, node ast.Node) bool {
+	return parent.Position().Offset <= node.Position().Offset &&
+		node.End().Offset <= parent.End().Offset
+}
+
 func (c *checker) CheckReferences(mod *ast.Module, name string) error {
 	// Third pass over the CST.
 	// 3. After imports have resolved, semantic checks of imported identifiers.
@@ -310,18 +430,41 @@ func (c *checker) checkNestedCallExpr(scope *ast.Scope, ie *ast.IdentExpr, args
 	}
 
 	var kset *ast.KindSet
-	if index < 0 {
+	switch {
+	case index >= 0:
+		kset = ast.NewKindSet(signature[index])
+	case isInterpolated(args, call):
+		// Calls interpolated into a string or heredoc argument are string-like.
+		kset = ast.NewKindSet(ast.String, ast.Int, ast.Bool)
+	default:
 		// If its not within args, check with clause.
 		if with == nil || with.Expr == nil || with.Expr.CallExpr != call || ie.Reference != nil {
 			return errdefs.WithInternalErrorf(call, "expected to find %q in %q", call.Name, args)
 		}
 		kset = ast.NewKindSet(ast.Kind("option::" + ie.Ident.Text))
-	} else {
-		kset = ast.NewKindSet(signature[index])
 	}
 	return c.checkCallExpr(scope, kset, call)
 }
 
+// isInterpolated returns true if call is directly interpolated within one of
+// the string or heredoc literals in args.
+func isInterpolated(args []*ast.Expr, call *ast.CallExpr) bool {
+	found := false
+	for _, arg := range args {
+		if arg.BasicLit == nil {
+			continue
+		}
+		ast.Match(arg.BasicLit, ast.MatchOpts{},
+			func(interp *ast.Interpolated) {
+				if interp.Expr != nil && interp.Expr.CallExpr == call {
+					found = true
+				}
+			},
+		)
+	}
+	return found
+}
+
 func (c *checker) err(err error) {
 	c.errs = append(c.errs, err)
 }
@@ -350,11 +493,14 @@ func (c *checker) checkFieldList(fields []*ast.Field) error {
 }
 
 func (c *checker) checkBlock(block *ast.BlockStmt) error {
-	for _, stmt := range block.Stmts() {
+	stmts := block.Stmts()
+	for i, stmt := range stmts {
 		kset := ast.NewKindSet(block.Kind())
 
 		var err error
 		switch {
+		case stmt.From != nil:
+			err = c.checkFromStmt(block, stmts[0], i, stmt.From)
 		case stmt.Call != nil:
 			err = c.checkCallStmt(block.Scope, kset, stmt.Call)
 		case stmt.Expr != nil:
@@ -368,6 +514,257 @@ func (c *checker) checkBlock(block *ast.BlockStmt) error {
 	return nil
 }
 
+// checkFromStmt checks that a from statement starts a filesystem block from a
+// filesystem.
+func (c *checker) checkFromStmt(block *ast.BlockStmt, first *ast.Stmt, i int, from *ast.FromStmt) error {
+	if block.Kind().Primary() != ast.Filesystem {
+		return errdefs.WithFromNotFilesystem(from.From, block.Kind())
+	}
+	if i > 0 {
+		var start ast.Node
+		switch {
+		case first.Call != nil:
+			start = first.Call.Name
+		case first.Expr != nil:
+			start = first.Expr.Expr
+		default:
+			start = first.From.From
+		}
+		return errdefs.WithFromNotFirst(from.From, start)
+	}
+	return c.checkExpr(block.Scope, ast.NewKindSet(ast.Filesystem), from.Expr)
+}
+
+// checkMountBind checks that bound mounts are not readonly or cache mounts,
+// as their contents after the run are not meaningful.
+func (c *checker) checkMountBind(call *ast.CallStmt) error {
+	if call.BindClause == nil || call.WithClause == nil || call.Name.Reference != nil {
+		return nil
+	}
+	if call.Name.Ident.Text != "mount" {
+		return nil
+	}
+
+	var opts []*ast.IdentExpr
+	switch expr := call.WithClause.Expr; {
+	case expr.CallExpr != nil:
+		opts = append(opts, expr.CallExpr.Name)
+	case expr.FuncLit != nil:
+		for _, stmt := range expr.FuncLit.Body.Stmts() {
+			if stmt.Call != nil {
+				opts = append(opts, stmt.Call.Name)
+			}
+		}
+	}
+
+	for _, opt := range opts {
+		if opt == nil || opt.Ident == nil || opt.Reference != nil {
+			continue
+		}
+		switch opt.Ident.Text {
+		case "readonly":
+			return errdefs.WithBindReadonlyMount(call.BindClause.As, opt)
+		case "cache":
+			return errdefs.WithBindCacheMount(call.BindClause.As, opt)
+		}
+	}
+	return nil
+}
+
+// checkWriteFile checks that the literal mode of a writeFile is a valid
+// permission, and that an appended file does not set a created time, because
+// the file is not created.
+func (c *checker) checkWriteFile(call *ast.CallStmt) error {
+	if call.WithClause == nil || call.Name == nil || call.Name.Reference != nil {
+		return nil
+	}
+	if call.Name.Ident.Text != "writeFile" {
+		return nil
+	}
+
+	var appendOpt, createdTime ast.Node
+	for _, opt := range optionCalls(call.WithClause) {
+		if opt.name == nil || opt.name.Ident == nil || opt.name.Reference != nil {
+			continue
+		}
+		switch opt.name.Ident.Text {
+		case "mode":
+			if len(opt.args) != 1 || opt.args[0].BasicLit == nil {
+				continue
+			}
+			lit := opt.args[0].BasicLit
+			var mode int64
+			switch {
+			case lit.Decimal != nil:
+				mode = int64(*lit.Decimal)
+			case lit.Numeric != nil:
+				mode = lit.Numeric.Value
+			default:
+				continue
+			}
+			if mode < 0 || mode > 0o7777 {
+				return errdefs.WithInvalidFileMode(opt.args[0], mode)
+			}
+		case "append":
+			appendOpt = opt.name
+		case "createdTime":
+			createdTime = opt.name
+		}
+	}
+	if appendOpt != nil && createdTime != nil {
+		return errdefs.WithAppendCreatedTime(createdTime, appendOpt)
+	}
+	return nil
+}
+
+// optCall is a call of an option in a with clause.
+type optCall struct {
+	name *ast.IdentExpr
+	args []*ast.Expr
+}
+
+// optionCalls returns the calls of options in a with clause, which is either
+// a single option or a block of options.
+func optionCalls(with *ast.WithClause) []optCall {
+	var opts []optCall
+	switch expr := with.Expr; {
+	case expr.CallExpr != nil:
+		opts = append(opts, optCall{expr.CallExpr.Name, expr.CallExpr.Arguments()})
+	case expr.FuncLit != nil:
+		for _, stmt := range expr.FuncLit.Body.Stmts() {
+			if stmt.Call != nil {
+				opts = append(opts, optCall{stmt.Call.Name, stmt.Call.Args})
+			}
+		}
+	}
+	return opts
+}
+
+// checkRuntimeSpec checks that the literal ports published by a runtimeSpec
+// are valid and published on different ports of the host, and that the paths
+// bound into the container are absolute.
+func (c *checker) checkRuntimeSpec(call *ast.CallStmt) error {
+	if call.WithClause == nil || call.Name == nil || call.Name.Reference != nil {
+		return nil
+	}
+	if call.Name.Ident.Text != "runtimeSpec" {
+		return nil
+	}
+
+	published := make(map[string]ast.Node)
+	for _, opt := range optionCalls(call.WithClause) {
+		if opt.name == nil || opt.name.Ident == nil || opt.name.Reference != nil || len(opt.args) != 2 {
+			continue
+		}
+		switch opt.name.Ident.Text {
+		case "publish":
+			hostPort, ok := intLit(opt.args[0])
+			if !ok {
+				continue
+			}
+			if err := imageutil.ValidatePort(hostPort); err != nil {
+				return errdefs.WithInvalidPublishPort(opt.args[0], strconv.Itoa(hostPort), err)
+			}
+			if opt.args[1].BasicLit == nil {
+				continue
+			}
+			spec, ok := opt.args[1].BasicLit.StringValue()
+			if !ok {
+				continue
+			}
+			port, err := imageutil.ParsePublishPort(spec)
+			if err != nil {
+				return errdefs.WithInvalidPublishPort(opt.args[1], spec, err)
+			}
+			key := imageutil.HostPort(hostPort, port)
+			if first, ok := published[key]; ok {
+				return errdefs.WithPublishConflict(key, first, opt.args[0])
+			}
+			published[key] = opt.args[0]
+		case "bind":
+			if opt.args[1].BasicLit == nil {
+				continue
+			}
+			containerPath, ok := opt.args[1].BasicLit.StringValue()
+			if ok && !path.IsAbs(containerPath) {
+				return errdefs.WithRelativeContainerPath(opt.args[1], containerPath)
+			}
+		}
+	}
+	return nil
+}
+
+// intLit returns the value of an int literal.
+func intLit(expr *ast.Expr) (int, bool) {
+	lit := expr.BasicLit
+	switch {
+	case lit == nil:
+		return 0, false
+	case lit.Decimal != nil:
+		return *lit.Decimal, true
+	case lit.Numeric != nil:
+		return int(lit.Numeric.Value), true
+	}
+	return 0, false
+}
+
+// checkRunDefaults checks that the run defaults of a module are options for
+// run without parameters, since they are applied to every run in the module
+// without being called.
+func (c *checker) checkRunDefaults(fd *ast.FuncDecl) error {
+	if fd.Sig.Name == nil || fd.Sig.Name.Text != RunDefaults || fd.Sig.Type == nil {
+		return nil
+	}
+
+	var params []*ast.Field
+	if fd.Sig.Params != nil {
+		params = fd.Sig.Params.Fields()
+	}
+	if fd.Sig.Type.Kind != ast.Kind("option::run") || len(params) > 0 {
+		return errdefs.WithInvalidRunDefaults(fd.Sig, RunDefaults)
+	}
+	return nil
+}
+
+// checkPrewarm checks that functions marked to prime the cache are fs
+// functions without parameters, since they are solved without being called.
+func (c *checker) checkPrewarm(fd *ast.FuncDecl) error {
+	if !fd.Doc.HasPragma(PrewarmPragma) || fd.Sig.Type == nil || fd.Sig.Name == nil {
+		return nil
+	}
+
+	var params []*ast.Field
+	if fd.Sig.Params != nil {
+		params = fd.Sig.Params.Fields()
+	}
+	if fd.Sig.Type.Kind != ast.Filesystem || len(params) > 0 {
+		return errdefs.WithInvalidPrewarm(fd.Sig, fd.Sig.Name.Text)
+	}
+	return nil
+}
+
+// checkExpose checks that the literal ports of an expose are valid, so that
+// malformed ports are caught before the image config is consumed.
+func (c *checker) checkExpose(call *ast.CallStmt) error {
+	if call.Name == nil || call.Name.Reference != nil || call.Name.Ident.Text != "expose" {
+		return nil
+	}
+	for _, arg := range call.Args {
+		if arg.BasicLit == nil {
+			continue
+		}
+		spec, ok := arg.BasicLit.StringValue()
+		if !ok {
+			continue
+		}
+		_, err := imageutil.ParsePortSpec(spec)
+		if err != nil {
+			return errdefs.WithInvalidPortSpec(arg, spec, err)
+		}
+	}
+	return nil
+}
+
 func (c *checker) checkType(node ast.Node, kset *ast.KindSet, actual ast.Kind, opts ...diagnostic.Option) error {
 	if !kset.Has(actual) {
 		expected := kset.Kinds()
@@ -379,6 +776,85 @@ func (c *checker) checkType(node ast.Node, kset *ast.KindSet, actual ast.Kind, o
 	return nil
 }
 
+// checkStatPath checks that the literal path of a builtin that stats a path is
+// not a pattern, because the path is never globbed.
+func (c *checker) checkStatPath(name *ast.IdentExpr, args []*ast.Expr) error {
+	if name == nil || name.Reference != nil || len(args) < 2 {
+		return nil
+	}
+	switch name.Ident.Text {
+	case "exists", "isDir", "fileMode":
+	default:
+		return nil
+	}
+	arg := args[1]
+	if arg.BasicLit == nil {
+		return nil
+	}
+	path, ok := arg.BasicLit.StringValue()
+	if !ok || !strings.Contains(path, "*") {
+		return nil
+	}
+	return errdefs.WithStatPattern(arg, path)
+}
+
+// lookupBuiltinCall returns the declaration of the builtin called by ie, or
+// nil if ie doesn't call a builtin.
+func (c *checker) lookupBuiltinCall(scope *ast.Scope, kset *ast.KindSet, ie *ast.IdentExpr) (*ast.FuncDecl, error) {
+	if ie.Reference != nil {
+		return nil, nil
+	}
+	obj := scope.Lookup(ie.Ident.Text)
+	if obj == nil {
+		return nil, nil
+	}
+	bd, ok := obj.Node.(*ast.BuiltinDecl)
+	if !ok {
+		return nil, nil
+	}
+	return c.lookupBuiltin(ie.Ident, kset, bd)
+}
+
+// checkEnum checks that the literal arguments of a builtin's enum parameter
+// are one of its values, so that typos are caught before solving.
+func (c *checker) checkEnum(fd *ast.FuncDecl, ie *ast.IdentExpr, args []*ast.Expr) error {
+	enum, ok := BuiltinEnums[fd.Kind()][ie.Ident.Text]
+	if !ok || enum.Index >= len(args) {
+		return nil
+	}
+	arg := args[enum.Index]
+	if arg.BasicLit == nil {
+		return nil
+	}
+	value, ok := arg.BasicLit.StringValue()
+	if !ok {
+		return nil
+	}
+	for _, v := range enum.Values {
+		if value == v {
+			return nil
+		}
+	}
+	return enum.Err(arg, value, enum.Values)
+}
+
+// checkCommitSHA checks that the literal sha of a git commit option is a full
+// commit sha, because BuildKit only checks out commits by their full sha.
+func (c *checker) checkCommitSHA(fd *ast.FuncDecl, ie *ast.IdentExpr, args []*ast.Expr) error {
+	if fd.Kind() != "option::git" || ie.Ident.Text != "commit" || len(args) == 0 {
+		return nil
+	}
+	arg := args[0]
+	if arg.BasicLit == nil {
+		return nil
+	}
+	sha, ok := arg.BasicLit.StringValue()
+	if !ok || llbutil.IsCommitSHA(sha) {
+		return nil
+	}
+	return errdefs.WithInvalidCommitSHA(arg, sha)
+}
+
 func (c *checker) checkCallStmt(scope *ast.Scope, kset *ast.KindSet, call *ast.CallStmt) error {
 	if call.Breakpoint() {
 		return nil
@@ -387,6 +863,12 @@ func (c *checker) checkCallStmt(scope *ast.Scope, kset *ast.KindSet, call *ast.C
 	if err != nil {
 		return err
 	}
+	if call.From != nil {
+		err = c.checkCopyFrom(scope, call)
+		if err != nil {
+			return err
+		}
+	}
 	var kinds []ast.Kind
 	for _, field := range signature {
 		kinds = append(kinds, field.Kind())
@@ -395,6 +877,43 @@ func (c *checker) checkCallStmt(scope *ast.Scope, kset *ast.KindSet, call *ast.C
 	return nil
 }
 
+// checkCopyFrom checks that a copy from a stage names a filesystem function of
+// the module that starts from a source, so that every copy from the stage can
+// share its result. Functions with parameters cannot be named without
+// arguments, so stages never have parameters.
+func (c *checker) checkCopyFrom(scope *ast.Scope, call *ast.CallStmt) error {
+	ie := call.Name
+	if ie.Reference != nil || ie.Ident.Text != "copy" {
+		return errdefs.WithFromNotCopy(call.From, ie)
+	}
+	if obj := scope.Lookup(ie.Ident.Text); obj == nil {
+		return errdefs.WithFromNotCopy(call.From, ie)
+	} else if _, ok := obj.Node.(*ast.BuiltinDecl); !ok {
+		return errdefs.WithFromNotCopy(call.From, ie)
+	}
+	if len(call.Args) == 0 {
+		return nil
+	}
+
+	arg := call.Args[0]
+	ce := arg.CallExpr
+	if ce == nil || ce.List != nil || ce.Name.Reference != nil {
+		return errdefs.WithInvalidStage(arg, "expected the name of a filesystem function in this module")
+	}
+	obj := scope.Lookup(ce.Name.Ident.Text)
+	if obj == nil {
+		return errdefs.WithUndefinedIdent(ce.Name, nil)
+	}
+	fd, ok := obj.Node.(*ast.FuncDecl)
+	if !ok {
+		return errdefs.WithInvalidStage(arg, "expected the name of a filesystem function in this module")
+	}
+	if !IsIndependent(fd) {
+		return errdefs.WithInvalidStage(arg, "stages must start from a source or a from statement", errdefs.Defined(fd.Sig.Name))
+	}
+	return nil
+}
+
 func (c *checker) checkCallExpr(scope *ast.Scope, kset *ast.KindSet, call *ast.CallExpr) error {
 	if call.Breakpoint() {
 		return nil
@@ -440,14 +959,41 @@ func (c *checker) checkCall(scope *ast.Scope, kset *ast.KindSet, ie *ast.IdentEx
 		)
 	}
 
+	format := isFormat(scope, ie)
 	for i, arg := range args {
-		kind := params[i].Type.Kind
-		err := c.checkExpr(scope, ast.NewKindSet(kind), arg)
+		pset := ast.NewKindSet(params[i].Type.Kind)
+		if format && i > 0 {
+			// Values are formatted by their verbs, so they may be any
+			// string-like kind.
+			pset = ast.NewKindSet(ast.String, ast.Int, ast.Bool)
+		}
+		err := c.checkExpr(scope, pset, arg)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	fd, err := c.lookupBuiltinCall(scope, kset, ie)
+	if err != nil {
+		return nil, err
+	}
+	if fd != nil {
+		err = c.checkEnum(fd, ie, args)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.checkCommitSHA(fd, ie, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.checkFormat(scope, ie, args)
+	if err != nil {
+		return nil, err
+	}
+
 	if with != nil {
 		// Inherit the secondary type from the calling function name.
 		kind := ast.Kind(fmt.Sprintf("%s::%s", ast.Option, ie.Ident))
@@ -531,12 +1077,11 @@ func (c *checker) checkBasicLit(scope *ast.Scope, kind ast.Kind, lit *ast.BasicL
 }
 
 func (c *checker) checkStringFragments(scope *ast.Scope, fragments []*ast.StringFragment) error {
-	kset := ast.NewKindSet(ast.String, ast.Int, ast.Bool)
 	for _, f := range fragments {
 		if f.Interpolated == nil {
 			continue
 		}
-		err := c.checkExpr(scope, kset, f.Interpolated.Expr)
+		err := c.checkInterpolated(scope, f.Interpolated)
 		if err != nil {
 			return err
 		}
@@ -545,12 +1090,11 @@ func (c *checker) checkStringFragments(scope *ast.Scope, fragments []*ast.String
 }
 
 func (c *checker) checkHeredocFragments(scope *ast.Scope, fragments []*ast.HeredocFragment) error {
-	kset := ast.NewKindSet(ast.String, ast.Int, ast.Bool)
 	for _, f := range fragments {
 		if f.Interpolated == nil {
 			continue
 		}
-		err := c.checkExpr(scope, kset, f.Interpolated.Expr)
+		err := c.checkInterpolated(scope, f.Interpolated)
 		if err != nil {
 			return err
 		}
@@ -558,6 +1102,16 @@ func (c *checker) checkHeredocFragments(scope *ast.Scope, fragments []*ast.Hered
 	return nil
 }
 
+// checkInterpolated checks an interpolated expression, which may be any
+// expression including nested calls that evaluates to a string-like kind.
+func (c *checker) checkInterpolated(scope *ast.Scope, interp *ast.Interpolated) error {
+	if interp.Expr == nil {
+		return errdefs.WithEmptyInterpolation(interp)
+	}
+	kset := ast.NewKindSet(ast.String, ast.Int, ast.Bool)
+	return c.checkExpr(scope, kset, interp.Expr)
+}
+
 func (c *checker) checkIdentExpr(scope *ast.Scope, kset *ast.KindSet, ie *ast.IdentExpr) (ident *ast.Ident, signature []*ast.Field, err error) {
 	return c.checkIdentExprHelper(scope, kset, ie, ie.Ident)
 }
@@ -8,7 +8,6 @@ import (
 	"github.com/lithammer/dedent"
 	"github.com/openllb/hlb/builtin"
 	"github.com/openllb/hlb/diagnostic"
-	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/parser"
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/filebuffer"
@@ -163,299 +162,240 @@ func TestChecker_Check(t *testing.T) {
 		`,
 		nil,
 	}, {
-		"wrong number of args",
-		`
-		fs default() {
-			image
-		}
-		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithNumArgs(
-				ast.Search(mod, "image"), 1, 0,
-				errdefs.Defined(ast.Search(builtin.Module, "image")),
-			)
-		},
-	}, {
-		"errors with duplicate function names",
+		"basic function export",
 		`
-		fs duplicate(string ref) {}
-		fs duplicate(string ref) {
-			image ref
-		}
+		export myFunction
+
+		fs myFunction() {}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithDuplicates([]ast.Node{
-				ast.Search(mod, "duplicate"),
-				ast.Search(mod, "duplicate", ast.WithSkip(1)),
-			})
-		},
+		nil,
 	}, {
-		"errors with function and alias name collisions",
+		"basic alias export",
 		`
-		fs duplicate() {}
-		fs bar() {
+		export myAlias
+
+		fs myFunction() {
 			run "echo Hello" with option {
-				mount scratch "/src" as duplicate
+				mount fs { scratch; } "/src" as myAlias
 			}
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithDuplicates([]ast.Node{
-				ast.Search(mod, "duplicate"),
-				ast.Search(mod, "duplicate", ast.WithSkip(1)),
-			})
-		},
+		nil,
 	}, {
-		"errors with function and builtin name collisions",
+		"basic pipeline support",
 		`
-		fs image() {
-			run "echo Hello"
+		pipeline default() {
+			stage pipelineA image("b")
+			pipelineC
+		}
+		pipeline pipelineA() {
+			stage image("a")
+		}
+		pipeline pipelineC() {
+			stage localRun("c")
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithDuplicates([]ast.Node{
-				ast.Search(builtin.Module, "image"),
-				ast.Search(mod, "image"),
-			})
-		},
+		nil,
 	}, {
-		"errors with alias and builtin name collisions",
+		"per platform string function literal",
 		`
 		fs default() {
-			run "echo Hello" with option {
-				mount scratch "/" as image
+			mkfile "/platforms" 0o644 string {
+				perPlatform string {
+					format "%s/%s" targetOs targetArch
+				} "linux/amd64" "linux/arm64" with separator(" ")
 			}
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithDuplicates([]ast.Node{
-				ast.Search(builtin.Module, "image"),
-				ast.Search(mod, "image"),
-			})
-		},
+		nil,
 	}, {
-		"errors with duplicate alias names",
+		"no error when input doesn't end with newline",
+		`# comment\nfs default() {\n  scratch\n}\n# comment`,
+		nil,
+	}, {
+		"no error when bind list is empty",
 		`
 		fs default() {
-			run "echo hello" with option {
-				mount scratch "/src" as duplicate
-			}
-			run "echo hello" with option {
-				mount scratch "/src" as duplicate
-			}
+			dockerPush "some/ref" as ()
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithDuplicates([]ast.Node{
-				ast.Search(mod, "duplicate"),
-				ast.Search(mod, "duplicate", ast.WithSkip(1)),
-			})
-		},
+		nil,
 	}, {
-		"errors when calling import",
+		"enum builtin options",
 		`
-		import foo from "./foo.hlb"
-
 		fs default() {
-			foo
+			image "alpine"
+			run "echo" with option {
+				network "host"
+				security "sandbox"
+				mount scratch "/cache" with cache("id", "locked")
+			}
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithCallImport(
-				ast.Search(mod, "foo", ast.WithSkip(1)),
-				ast.Search(mod, "foo"),
-			)
-		},
-	}, {
-		"basic function export",
-		`
-		export myFunction
-
-		fs myFunction() {}
-		`,
 		nil,
 	}, {
-		"basic alias export",
+		"tryRun gates a step",
 		`
-		export myAlias
+		fs default() {
+			image "alpine"
+			assert tryRun(image("alpine"), "test -f /etc/os-release") "missing os-release"
+			run "echo" with option {
+				network "none"
+			}
+		}
 
-		fs myFunction() {
-			run "echo Hello" with option {
-				mount fs { scratch; } "/src" as myAlias
+		bool healthy() {
+			tryRun image("alpine") "wget" "-q" "localhost" with option {
+				network "host"
+				env "A" "B"
 			}
 		}
+
+		fs gated() {
+			image "alpine"
+			assert healthy "unhealthy"
+		}
 		`,
 		nil,
 	}, {
-		"errors when export does not exist",
+		"stat builtins",
 		`
-		export foo
+		bool hasRelease() {
+			exists image("alpine") "/etc/alpine-release" with noFollow
+		}
+
+		string shellMode() {
+			fileMode image("alpine") "/bin/sh"
+		}
+
+		fs default() {
+			mkfile "etc-is-dir" 0o644 "${isDir(image("alpine"), "/etc")}"
+		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithUndefinedIdent(
-				ast.Search(mod, "foo"),
-				nil,
-			)
-		},
+		nil,
 	}, {
-		"errors when a reference called on non-import",
+		"nested calls in heredoc interpolation",
 		`
-		fs myFunction() {}
-		fs badReferenceCaller() {
-			myFunction.build
+		fs default() {
+			mkfile "file" 0o644 <<-EOF
+				${format("%s-%s", localOs, format("%s", localArch))}
+			EOF
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithNotImport(
-				ast.Search(mod, "myFunction.build").(*ast.IdentExpr),
-				ast.Search(mod, "myFunction"),
-			)
-		},
+		nil,
 	}, {
-		"basic pipeline support",
+		"format values of any string-like kind",
 		`
-		pipeline default() {
-			stage pipelineA image("b")
-			pipelineC
-		}
-		pipeline pipelineA() {
-			stage image("a")
-		}
-		pipeline pipelineC() {
-			stage localRun("c")
+		int count() { 3; }
+		fs default() {
+			mkfile "file" 0o644 format("%[1]s-%[1]s %d %03d %t %x %q", "tag", count, 7, true, "hex", 65)
 		}
 		`,
 		nil,
 	}, {
-		"errors when fs statement is called in a pipeline block",
+		"binding used after the statement that binds it",
 		`
-		pipeline badGroup() {
+		fs default() {
 			image "alpine"
+			run "make" with option {
+				mount scratch "/out" as out
+			}
+			copy out "/" "/usr/local"
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithWrongType(
-				ast.Search(mod, "image"),
-				[]ast.Kind{ast.Pipeline},
-				ast.Filesystem,
-				errdefs.Defined(ast.Search(builtin.Module, "image")),
-			)
-		},
-	}, {
-		"no error when input doesn't end with newline",
-		`# comment\nfs default() {\n  scratch\n}\n# comment`,
 		nil,
 	}, {
-		"errors without bind target",
+		"binding used in a nested block after the statement that binds it",
 		`
 		fs default() {
-			dockerPush "some/ref" as
+			image "alpine"
+			run "make" with option {
+				mount scratch "/out" as out
+			}
+			run "make install" with option {
+				mount out "/out"
+			}
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithNoBindTarget(ast.Search(mod, "as"))
-		},
+		nil,
 	}, {
-		"no error when bind list is empty",
+		"binding used in the nested block it is bound in",
 		`
 		fs default() {
-			dockerPush "some/ref" as ()
+			image "alpine"
+			copy fs {
+				image "golang"
+				run "make" with option {
+					mount scratch "/out" as out
+				}
+				copy out "/" "/bin"
+			} "/bin" "/usr/local/bin"
 		}
 		`,
 		nil,
 	}, {
-		"errors with wrong type for default bind",
+		"binding forwarded as function argument",
 		`
+		fs install(fs artifacts) {
+			image "alpine"
+			copy artifacts "/" "/usr/local"
+		}
 		fs default() {
-			dockerPush "some/ref:latest" as imageID
-			imageID
+			image "alpine"
+			run "make" with option {
+				mount scratch "/out" as out
+			}
+			install out
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithWrongType(
-				ast.Search(mod, "imageID", ast.WithSkip(1)),
-				[]ast.Kind{ast.Filesystem},
-				ast.String,
-				errdefs.Defined(ast.Search(mod, "imageID")),
-			)
-		},
+		nil,
 	}, {
-		"errors with wrong type for named bind",
+		"from a parameter",
 		`
-		fs default() {
-			dockerPush "some/ref:latest" as (digest imageID)
-			imageID
+		fs default(fs base) {
+			from base
+			run "make"
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithWrongType(
-				ast.Search(mod, "imageID", ast.WithSkip(1)),
-				[]ast.Kind{ast.Filesystem},
-				ast.String,
-				errdefs.Defined(ast.Search(mod, "imageID")),
-			)
-		},
+		nil,
 	}, {
-		"errors when binding without side effects",
+		"from an import member",
 		`
+		import lib from "./lib.hlb"
 		fs default() {
-			run "cmd" as nothing
+			from lib.build
+			run "make"
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithNoBindEffects(
-				ast.Search(mod, "run"),
-				ast.Search(mod, "as"),
-				errdefs.Defined(
-					ast.Search(builtin.Module, "run"),
-				),
-			)
-		},
+		nil,
 	}, {
-		"errors when binding unknown side effects",
+		"from an inline fs literal",
 		`
 		fs default() {
-			dockerPush "some/ref:latest" as (undefined foo)
+			from fs {
+				image "alpine"
+			}
+			run "make"
 		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithUndefinedBindTarget(
-				ast.Search(mod, "dockerPush"),
-				ast.Search(mod, "undefined"),
-			)
-		},
+		nil,
 	}, {
-		"errors when binding inside an option function declaration",
+		"copy from a stage",
 		`
-		option::run foo() {
-			mount scratch "/out" as default
+		fs builder() {
+			image "golang"
+			run "go build -o /out/app"
 		}
-		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithNoBindClosure(
-				ast.Search(mod, "as"),
-				ast.Search(mod, "option::run"),
-			)
-		},
-	}, {
-		"errors when binding inside an argument expression",
-		`
+
 		fs default() {
-			foo option::run {
-				mount scratch "/tmp" as bar
+			image "alpine"
+			copy from builder "/out/app" "/usr/bin/app"
+			copy from builder "/out" "/opt" with option {
+				createDestPath
 			}
 		}
-
-		fs foo(option::run opts) {
-			run with opts
-		}
 		`,
-		func(mod *ast.Module) error {
-			return errdefs.WithNoBindClosure(
-				ast.Search(mod, "as"),
-				ast.Search(mod, "option::run"),
-			)
-		},
+		nil,
 	}, {
 		"run with options",
 		`
@@ -493,6 +433,210 @@ func TestChecker_Check(t *testing.T) {
 	}
 }
 
+// formatArgs returns the args of the first call to format in mod.
+func formatArgs(mod *ast.Module) []*ast.Expr {
+	var args []*ast.Expr
+	ast.Match(mod, ast.MatchOpts{},
+		func(call *ast.CallExpr) {
+			if args == nil && call.Name.Ident.Text == "format" {
+				args = call.Arguments()
+			}
+		},
+	)
+	return args
+}
+
+func TestIsMemoizable(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected map[string]bool
+	}{{
+		"source filesystems and strings",
+		`
+		fs base() {
+			image "alpine"
+			run "apk add make"
+		}
+		fs derived() {
+			base
+			run "make"
+		}
+		string version() {
+			format "v%s" "1.2"
+		}
+		`,
+		map[string]bool{"base": true, "derived": true, "version": true},
+	}, {
+		"caller dependent declarations",
+		`
+		fs withParam(string ref) {
+			image ref
+		}
+		fs noSource() {
+			run "make"
+		}
+		fs empty() {}
+		option::run opts() {
+			dir "/src"
+		}
+		`,
+		map[string]bool{"withParam": false, "noSource": false, "empty": false, "opts": false},
+	}, {
+		"transitively impure declarations",
+		`
+		string tag() {
+			localEnv "TAG"
+		}
+		fs base() {
+			image "alpine:${tag}"
+		}
+		fs derived() {
+			base
+			run "make"
+		}
+		`,
+		map[string]bool{"tag": false, "base": false, "derived": false},
+	}, {
+		"nomemo pragma",
+		`
+		# hlb:nomemo
+		fs base() {
+			image "alpine"
+		}
+		`,
+		map[string]bool{"base": false},
+	}, {
+		"from statements",
+		`
+		fs noSource() {
+			run "make"
+		}
+		fs rebased() {
+			from noSource
+			run "make install"
+		}
+		`,
+		map[string]bool{"noSource": false, "rebased": true},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err)
+
+			err = SemanticPass(mod)
+			require.NoError(t, err)
+
+			err = Check(mod)
+			require.NoError(t, err)
+
+			for name, expected := range tc.expected {
+				obj := mod.Scope.Lookup(name)
+				require.NotNil(t, obj, name)
+				require.Equal(t, expected, IsMemoizable(obj.Node.(*ast.FuncDecl)), name)
+			}
+		})
+	}
+}
+
+func TestIsDeferrable(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected []bool
+	}{{
+		"expressions without effects",
+		`
+		fs use(fs a, fs b, string c) {
+			a
+		}
+		fs default() {
+			use image("alpine") fs {
+				image "busybox"
+				run "make"
+			} format("v%d", 1)
+		}
+		`,
+		[]bool{true, true, true},
+	}, {
+		"call statements with bindings",
+		`
+		fs use(fs a, fs b, string c) {
+			a
+		}
+		fs default() {
+			use fs {
+				image "alpine"
+				run "make" with option {
+					mount scratch "/out" as out
+				}
+			} image("busybox") "v1"
+		}
+		`,
+		[]bool{false, true, true},
+	}, {
+		"breakpoints",
+		`
+		fs debugged() {
+			image "busybox"
+			breakpoint
+		}
+		fs indirect() {
+			debugged
+			run "make"
+		}
+		fs use(fs a, fs b, fs c) {
+			a
+		}
+		fs default() {
+			use fs {
+				image "alpine"
+				breakpoint
+			} indirect fs {
+				image "alpine"
+				run "make" with breakpoint
+			}
+		}
+		`,
+		[]bool{false, false, false},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err)
+
+			err = SemanticPass(mod)
+			require.NoError(t, err)
+
+			err = Check(mod)
+			require.NoError(t, err)
+
+			var actual []bool
+			ast.Match(mod, ast.MatchOpts{},
+				func(call *ast.CallStmt) {
+					if call.Name.Ident.Text != "use" {
+						return
+					}
+					for _, arg := range call.Arguments() {
+						actual = append(actual, IsDeferrable(mod.Scope, arg))
+					}
+				},
+			)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
 func validateError(t *testing.T, ctx context.Context, expected, actual error, name string) {
 	switch {
 	case expected == nil:
@@ -0,0 +1,12 @@
+package checker_test
+
+import (
+	"testing"
+
+	"github.com/openllb/hlb/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+	conformance.Run(t, "testdata/conformance")
+}
@@ -0,0 +1,353 @@
+package checker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// FormatVerbKinds are the verbs of the format builtin and the kinds of values
+// they format.
+var FormatVerbKinds = map[rune][]ast.Kind{
+	'v': {ast.String, ast.Int, ast.Bool},
+	's': {ast.String},
+	'q': {ast.String, ast.Int},
+	'x': {ast.String, ast.Int},
+	'X': {ast.String, ast.Int},
+	'd': {ast.Int},
+	'b': {ast.Int},
+	'o': {ast.Int},
+	'O': {ast.Int},
+	'c': {ast.Int},
+	't': {ast.Bool},
+}
+
+// FormatVerb is a verb of a format string that formats an argument.
+type FormatVerb struct {
+	// Verb is the character that selects how the argument is formatted.
+	Verb rune
+
+	// Arg is the index of the argument that is formatted.
+	Arg int
+
+	// Start and End are the byte offsets of the verb in the format string,
+	// from its percent sign to after its verb character.
+	Start, End int
+}
+
+// FormatError is a format string that is malformed or does not match the
+// arguments it formats.
+type FormatError struct {
+	Message string
+
+	// Start and End are the byte offsets in the format string of the verb
+	// the error is about, or -1 if it is about an argument no verb formats.
+	Start, End int
+
+	// Arg is the index of the argument the error is about, or -1 if the
+	// verb is malformed.
+	Arg int
+}
+
+func (e *FormatError) Error() string {
+	return e.Message
+}
+
+// ParseFormat parses the verbs of a format string like fmt.Sprintf, with
+// flags, widths, precisions and argument indexes. Widths and precisions
+// cannot be taken from arguments.
+func ParseFormat(format string) ([]FormatVerb, error) {
+	var (
+		verbs []FormatVerb
+		arg   int
+	)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		start := i
+		verbErr := func(end int, msg string, a ...interface{}) error {
+			return &FormatError{
+				Message: fmt.Sprintf(msg, a...),
+				Start:   start,
+				End:     end,
+				Arg:     -1,
+			}
+		}
+
+		// index parses an argument index like [1] at i.
+		index := func() error {
+			if i >= len(format) || format[i] != '[' {
+				return nil
+			}
+			end := strings.IndexByte(format[i:], ']')
+			if end < 0 {
+				return verbErr(len(format), "unterminated argument index")
+			}
+			n, err := strconv.Atoi(format[i+1 : i+end])
+			if err != nil || n < 1 {
+				return verbErr(i+end+1, "invalid argument index %s", format[i:i+end+1])
+			}
+			arg = n - 1
+			i += end + 1
+			return nil
+		}
+
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0 {
+			i++
+		}
+		err := index()
+		if err != nil {
+			return nil, err
+		}
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			err = index()
+			if err != nil {
+				return nil, err
+			}
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				i++
+			}
+		}
+		err = index()
+		if err != nil {
+			return nil, err
+		}
+
+		if i >= len(format) {
+			return nil, verbErr(i, "missing verb at end of format string")
+		}
+		verb := rune(format[i])
+		switch {
+		case verb == '%':
+			continue
+		case verb == '*':
+			return nil, verbErr(i+1, "width and precision cannot be taken from args")
+		}
+		if _, ok := FormatVerbKinds[verb]; !ok {
+			return nil, verbErr(i+1, "unknown verb %s", format[start:i+1])
+		}
+
+		verbs = append(verbs, FormatVerb{
+			Verb:  verb,
+			Arg:   arg,
+			Start: start,
+			End:   i + 1,
+		})
+		arg++
+	}
+	return verbs, nil
+}
+
+// CheckFormatArgs checks that the verbs of a format string format arguments
+// of the given kinds, and that every argument is formatted. Arguments of kind
+// ast.None are not checked against their verbs.
+func CheckFormatArgs(format string, verbs []FormatVerb, kinds []ast.Kind) error {
+	formatted := make([]bool, len(kinds))
+	for _, v := range verbs {
+		text := format[v.Start:v.End]
+		if v.Arg >= len(kinds) {
+			return &FormatError{
+				Message: fmt.Sprintf("%s formats arg %d, found %d args", text, v.Arg+1, len(kinds)),
+				Start:   v.Start,
+				End:     v.End,
+				Arg:     -1,
+			}
+		}
+		formatted[v.Arg] = true
+
+		kind := kinds[v.Arg]
+		if kind == ast.None || kindIn(kind, FormatVerbKinds[v.Verb]) {
+			continue
+		}
+		return &FormatError{
+			Message: fmt.Sprintf("%s cannot format %s", text, kind),
+			Start:   v.Start,
+			End:     v.End,
+			Arg:     v.Arg,
+		}
+	}
+
+	for i, ok := range formatted {
+		if !ok {
+			return &FormatError{
+				Message: fmt.Sprintf("arg %d is not formatted by any verb", i+1),
+				Start:   -1,
+				End:     -1,
+				Arg:     i,
+			}
+		}
+	}
+	return nil
+}
+
+func kindIn(kind ast.Kind, kinds []ast.Kind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// isFormat returns true if ie calls the format builtin, whose values may be
+// any string-like kind.
+func isFormat(scope *ast.Scope, ie *ast.IdentExpr) bool {
+	if ie.Reference != nil || ie.Ident.Text != "format" {
+		return false
+	}
+	obj := scope.Lookup(ie.Ident.Text)
+	if obj == nil {
+		return false
+	}
+	_, ok := obj.Node.(*ast.BuiltinDecl)
+	return ok
+}
+
+// checkFormat checks that a literal format string of the format builtin is
+// well formed and formats each of its values with a verb for its kind.
+// Format strings that are not literals are checked when they are formatted.
+func (c *checker) checkFormat(scope *ast.Scope, ie *ast.IdentExpr, args []*ast.Expr) error {
+	if len(args) == 0 || !isFormat(scope, ie) || args[0].BasicLit == nil {
+		return nil
+	}
+	lit := args[0].BasicLit
+	format, positions, ok := formatLiteral(lit)
+	if !ok {
+		return nil
+	}
+
+	verbs, err := ParseFormat(format)
+	if err == nil {
+		kinds := make([]ast.Kind, len(args)-1)
+		for i, arg := range args[1:] {
+			kinds[i] = exprKind(scope, arg)
+		}
+		err = CheckFormatArgs(format, verbs, kinds)
+	}
+	if err == nil {
+		return nil
+	}
+
+	ferr := err.(*FormatError)
+	if ferr.Start < 0 {
+		return errdefs.WithUnformattedArg(args[ferr.Arg+1], args[0], ferr)
+	}
+	verb := ast.Mixin{Pos: positions[ferr.Start], EndPos: positions[ferr.End]}
+	if ferr.Arg >= 0 {
+		return errdefs.WithInvalidFormat(verb, ferr, errdefs.FormatArg(args[ferr.Arg+1], exprKind(scope, args[ferr.Arg+1])))
+	}
+	return errdefs.WithInvalidFormat(verb, ferr)
+}
+
+// formatLiteral returns the value of a string literal without
+// interpolations, and the source position of each byte of the value followed
+// by the position after the value.
+func formatLiteral(lit *ast.BasicLit) (string, []lexer.Position, bool) {
+	var (
+		sb        strings.Builder
+		positions []lexer.Position
+	)
+	// add appends the source text of a value, advancing the position over
+	// each byte of the source.
+	add := func(pos lexer.Position, value, source string) lexer.Position {
+		if value == source {
+			for i := 0; i < len(source); i++ {
+				positions = append(positions, pos)
+				pos = advance(pos, source[i])
+			}
+		} else {
+			for i := 0; i < len(value); i++ {
+				positions = append(positions, pos)
+			}
+			for i := 0; i < len(source); i++ {
+				pos = advance(pos, source[i])
+			}
+		}
+		sb.WriteString(value)
+		return pos
+	}
+
+	switch {
+	case lit.Str != nil:
+		pos := advance(lit.Str.Pos, '"')
+		for _, f := range lit.Str.Fragments {
+			switch {
+			case f.Interpolated != nil:
+				return "", nil, false
+			case f.Escaped != nil:
+				escaped := *f.Escaped
+				value := "$"
+				if escaped[1] != '$' {
+					r, _, _, err := strconv.UnquoteChar(escaped, '"')
+					if err != nil {
+						return "", nil, false
+					}
+					value = string(r)
+				}
+				pos = add(f.Pos, value, escaped)
+			case f.Text != nil:
+				pos = add(f.Pos, *f.Text, *f.Text)
+			}
+		}
+		positions = append(positions, pos)
+	case lit.RawString != nil:
+		pos := add(advance(lit.RawString.Pos, '`'), lit.RawString.Text, lit.RawString.Text)
+		positions = append(positions, pos)
+	default:
+		return "", nil, false
+	}
+	return sb.String(), positions, true
+}
+
+func advance(pos lexer.Position, b byte) lexer.Position {
+	pos.Offset++
+	if b == '\n' {
+		pos.Line++
+		pos.Column = 1
+	} else {
+		pos.Column++
+	}
+	return pos
+}
+
+// exprKind returns the kind an expression is formatted as, or ast.None if it
+// is not known until it is evaluated.
+func exprKind(scope *ast.Scope, expr *ast.Expr) ast.Kind {
+	switch {
+	case expr.BasicLit != nil:
+		return expr.BasicLit.Kind()
+	case expr.FuncLit != nil:
+		return expr.FuncLit.Type.Kind
+	case expr.CallExpr != nil:
+		ie := expr.CallExpr.Name
+		if ie.Reference != nil {
+			return ast.None
+		}
+		obj := scope.Lookup(ie.Ident.Text)
+		if obj == nil {
+			return ast.None
+		}
+		if bd, ok := obj.Node.(*ast.BuiltinDecl); ok {
+			// Builtins are looked up by the first string-like kind they have.
+			for _, kind := range []ast.Kind{ast.String, ast.Int, ast.Bool} {
+				if kindIn(kind, bd.Kinds) {
+					return kind
+				}
+			}
+			return ast.None
+		}
+		return obj.Kind
+	}
+	return ast.None
+}
@@ -0,0 +1,142 @@
+package checker
+
+import (
+	"testing"
+
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFormat(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		format string
+		kinds  []ast.Kind
+		// args are the indexes of the args formatted by each verb.
+		args []int
+		err  *FormatError
+	}{{
+		"no verbs",
+		"plain 100%% text",
+		nil,
+		nil,
+		nil,
+	}, {
+		"string verbs",
+		"%s %q %x %X %v",
+		[]ast.Kind{ast.String, ast.String, ast.String, ast.String, ast.String},
+		[]int{0, 1, 2, 3, 4},
+		nil,
+	}, {
+		"int verbs",
+		"%d %b %o %O %x %X %c %q %v",
+		[]ast.Kind{ast.Int, ast.Int, ast.Int, ast.Int, ast.Int, ast.Int, ast.Int, ast.Int, ast.Int},
+		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8},
+		nil,
+	}, {
+		"bool verbs",
+		"%t %v",
+		[]ast.Kind{ast.Bool, ast.Bool},
+		[]int{0, 1},
+		nil,
+	}, {
+		"flags, width and precision",
+		"%-10s|%+05d|%#x|%8.3s|% d",
+		[]ast.Kind{ast.String, ast.Int, ast.Int, ast.String, ast.Int},
+		[]int{0, 1, 2, 3, 4},
+		nil,
+	}, {
+		"indexed reuse",
+		"%[1]s-%[1]s-%[2]d",
+		[]ast.Kind{ast.String, ast.Int},
+		[]int{0, 0, 1},
+		nil,
+	}, {
+		"index continues from the indexed arg",
+		"%[2]d %s %[1]s",
+		[]ast.Kind{ast.String, ast.Int, ast.String},
+		[]int{1, 2, 0},
+		nil,
+	}, {
+		"unknown kinds are not checked",
+		"%d %s",
+		[]ast.Kind{ast.None, ast.None},
+		[]int{0, 1},
+		nil,
+	}, {
+		"wrong kind",
+		"%s-%d",
+		[]ast.Kind{ast.String, ast.String},
+		[]int{0, 1},
+		&FormatError{"%d cannot format string", 3, 5, 1},
+	}, {
+		"too few args",
+		"%s %s",
+		[]ast.Kind{ast.String},
+		[]int{0, 1},
+		&FormatError{"%s formats arg 2, found 1 args", 3, 5, -1},
+	}, {
+		"index out of range",
+		"%[3]s",
+		[]ast.Kind{ast.String, ast.String},
+		[]int{2},
+		&FormatError{"%[3]s formats arg 3, found 2 args", 0, 5, -1},
+	}, {
+		"too many args",
+		"%s",
+		[]ast.Kind{ast.String, ast.String},
+		[]int{0},
+		&FormatError{"arg 2 is not formatted by any verb", -1, -1, 1},
+	}, {
+		"unknown verb",
+		"a %y",
+		nil,
+		nil,
+		&FormatError{"unknown verb %y", 2, 4, -1},
+	}, {
+		"missing verb",
+		"100%",
+		nil,
+		nil,
+		&FormatError{"missing verb at end of format string", 3, 4, -1},
+	}, {
+		"invalid index",
+		"%[0]s",
+		nil,
+		nil,
+		&FormatError{"invalid argument index [0]", 0, 4, -1},
+	}, {
+		"unterminated index",
+		"%[1s",
+		nil,
+		nil,
+		&FormatError{"unterminated argument index", 0, 4, -1},
+	}, {
+		"width from args",
+		"%*d",
+		nil,
+		nil,
+		&FormatError{"width and precision cannot be taken from args", 0, 2, -1},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			verbs, err := ParseFormat(tc.format)
+			if err == nil {
+				var args []int
+				for _, verb := range verbs {
+					args = append(args, verb.Arg)
+				}
+				require.Equal(t, tc.args, args)
+
+				err = CheckFormatArgs(tc.format, verbs, tc.kinds)
+			}
+			if tc.err == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.Equal(t, tc.err, err)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package checker
+
+import (
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// NoMemoPragma is the pragma that opts a function declaration out of
+// memoization, e.g. `# hlb:nomemo`.
+const NoMemoPragma = "nomemo"
+
+// PrewarmPragma is the pragma that marks a function declaration to be solved
+// when priming the cache, e.g. `# hlb:prewarm`. Only zero-parameter fs
+// declarations may be marked.
+const PrewarmPragma = "prewarm"
+
+var (
+	// impureBuiltins may produce different values each time they are called, so
+	// functions that transitively call them are never memoized.
+	impureBuiltins = map[string]struct{}{
+		"localRun":  {},
+		"localEnv":  {},
+		"arg":       {},
+		"uuid":      {},
+		"timestamp": {},
+	}
+
+	// sourceBuiltins ignore the filesystem they are called on, so a filesystem
+	// block beginning with one does not depend on its caller.
+	sourceBuiltins = map[string]struct{}{
+		"scratch":     {},
+		"image":       {},
+		"http":        {},
+		"git":         {},
+		"local":       {},
+		"localGit":    {},
+		"frontend":    {},
+		"devFrontend": {},
+	}
+)
+
+// IsMemoizable returns true if the value of a function declaration can be
+// computed once and reused by every call site. Only zero-parameter fs and
+// string declarations that don't depend on their caller's value and are
+// transitively free of impure builtins and imports are memoizable.
+func IsMemoizable(fd *ast.FuncDecl) bool {
+	if fd.Body == nil || len(fd.Body.Stmts()) == 0 || fd.Doc.HasPragma(NoMemoPragma) {
+		return false
+	}
+	if fd.Sig.Params != nil && len(fd.Sig.Params.Fields()) > 0 {
+		return false
+	}
+
+	switch fd.Kind() {
+	case ast.String:
+	case ast.Filesystem:
+		if !isIndependent(fd.Body) {
+			return false
+		}
+	default:
+		return false
+	}
+	return isPure(fd, make(map[*ast.FuncDecl]bool))
+}
+
+// IsIndependent returns true if the value of a filesystem declaration does not
+// depend on the value it is called on, regardless of whether it is pure.
+func IsIndependent(fd *ast.FuncDecl) bool {
+	return fd.Body != nil && fd.Kind() == ast.Filesystem && isIndependent(fd.Body)
+}
+
+// isIndependent returns true if the filesystem block begins with a source and
+// therefore ignores the value it is called on.
+func isIndependent(block *ast.BlockStmt) bool {
+	stmts := block.Stmts()
+	if len(stmts) == 0 {
+		return false
+	}
+
+	stmt := stmts[0]
+	switch {
+	case stmt.From != nil:
+		return true
+	case stmt.Call != nil:
+		ie := stmt.Call.Name
+		if ie.Reference != nil {
+			return false
+		}
+		obj := block.Scope.Lookup(ie.Ident.Text)
+		if obj == nil {
+			return false
+		}
+		switch n := obj.Node.(type) {
+		case *ast.BuiltinDecl:
+			_, ok := sourceBuiltins[n.Name]
+			return ok
+		case *ast.FuncDecl:
+			return n.Body != nil && isIndependent(n.Body)
+		}
+	case stmt.Expr != nil && stmt.Expr.Expr.FuncLit != nil:
+		return isIndependent(stmt.Expr.Expr.FuncLit.Body)
+	}
+	return false
+}
+
+// isPure returns true if the function declaration is transitively free of
+// impure builtins and references to imported modules.
+func isPure(fd *ast.FuncDecl, seen map[*ast.FuncDecl]bool) bool {
+	if pure, ok := seen[fd]; ok {
+		return pure
+	}
+	// Optimistically assume recursive references are pure, the final result is
+	// determined by the rest of the body.
+	seen[fd] = true
+	if fd.Body == nil {
+		return true
+	}
+
+	pure := true
+	ast.Match(fd.Body, ast.MatchOpts{},
+		func(ie *ast.IdentExpr) {
+			if !pure {
+				return
+			}
+			if ie.Reference != nil {
+				pure = false
+				return
+			}
+
+			obj := fd.Scope.Lookup(ie.Ident.Text)
+			if obj == nil {
+				return
+			}
+			switch n := obj.Node.(type) {
+			case *ast.BuiltinDecl:
+				_, impure := impureBuiltins[n.Name]
+				pure = !impure
+			case *ast.FuncDecl:
+				pure = isPure(n, seen)
+			case *ast.BindClause:
+				if n.Closure != nil {
+					pure = isPure(n.Closure, seen)
+				}
+			case *ast.ImportDecl:
+				pure = false
+			}
+		},
+	)
+	seen[fd] = pure
+	return pure
+}
+
+// IsDeferrable returns true if an argument expression can be emitted when its
+// value is first used instead of when the call is made, because emitting it
+// has no effect that the caller could observe. Expressions that bind names
+// with call statements or reach a breakpoint are emitted eagerly.
+func IsDeferrable(scope *ast.Scope, expr *ast.Expr) bool {
+	binds := false
+	ast.Match(expr, ast.MatchOpts{},
+		func(call *ast.CallStmt) {
+			if call.BindClause != nil {
+				binds = true
+			}
+		},
+	)
+	return !binds && !reachesBreakpoint(scope, expr, make(map[*ast.FuncDecl]struct{}))
+}
+
+// reachesBreakpoint returns true if a node or the functions it calls
+// transitively contain a breakpoint.
+func reachesBreakpoint(scope *ast.Scope, node ast.Node, seen map[*ast.FuncDecl]struct{}) bool {
+	found := false
+	ast.Match(node, ast.MatchOpts{},
+		func(call *ast.CallStmt) {
+			if call.Breakpoint() {
+				found = true
+			}
+		},
+		func(call *ast.CallExpr) {
+			if call.Breakpoint() {
+				found = true
+			}
+		},
+		func(ie *ast.IdentExpr) {
+			if found || ie.Reference != nil {
+				return
+			}
+			obj := scope.Lookup(ie.Ident.Text)
+			if obj == nil {
+				return
+			}
+			fd, ok := obj.Node.(*ast.FuncDecl)
+			if !ok || fd.Body == nil {
+				return
+			}
+			if _, ok := seen[fd]; ok {
+				return
+			}
+			seen[fd] = struct{}{}
+			found = reachesBreakpoint(fd.Scope, fd.Body, seen)
+		},
+	)
+	return found
+}
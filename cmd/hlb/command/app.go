@@ -30,6 +30,7 @@ func App() *cli.App {
 		runCommand,
 		formatCommand,
 		lintCommand,
+		docCommand,
 		moduleCommand,
 		langserverCommand,
 	}
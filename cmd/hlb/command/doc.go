@@ -0,0 +1,105 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb"
+	"github.com/openllb/hlb/builtin/gen"
+	cli "github.com/urfave/cli/v2"
+)
+
+var docCommand = &cli.Command{
+	Name:      "doc",
+	Usage:     "generates documentation for a hlb module",
+	ArgsUsage: "<uri>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "set the documentation format (json, markdown)",
+			Value: "markdown",
+		},
+		&cli.BoolFlag{
+			Name:  "imports",
+			Usage: "include modules imported by local file paths recursively",
+		},
+		&cli.BoolFlag{
+			Name:  "builtins",
+			Usage: "include the builtin functions",
+		},
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "include functions that are not exported",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		uri, err := GetURI(c)
+		if err != nil {
+			return err
+		}
+
+		cln, ctx, err := hlb.Client(Context(), c.String("addr"))
+		if err != nil {
+			return err
+		}
+		ctx = hlb.WithDefaultContext(ctx, cln)
+
+		return Doc(ctx, cln, uri, DocInfo{
+			Format:   c.String("format"),
+			Imports:  c.Bool("imports"),
+			Builtins: c.Bool("builtins"),
+			All:      c.Bool("all"),
+		})
+	},
+}
+
+type DocInfo struct {
+	Format   string
+	Imports  bool
+	Builtins bool
+	All      bool
+	Stdin    io.Reader
+	Stdout   io.Writer
+}
+
+func Doc(ctx context.Context, cln *client.Client, uri string, info DocInfo) error {
+	if info.Stdin == nil {
+		info.Stdin = os.Stdin
+	}
+	if info.Stdout == nil {
+		info.Stdout = os.Stdout
+	}
+
+	mod, err := ParseModuleURI(ctx, cln, info.Stdin, uri)
+	if err != nil {
+		return err
+	}
+
+	var opts []gen.ModuleDocOption
+	if info.Imports {
+		opts = append(opts, gen.WithImports(ctx))
+	}
+	if info.Builtins {
+		opts = append(opts, gen.WithBuiltins())
+	}
+	if info.All {
+		opts = append(opts, gen.WithUnexported())
+	}
+
+	doc, err := gen.GenerateModuleDocumentation(mod, opts...)
+	if err != nil {
+		return err
+	}
+
+	switch info.Format {
+	case "json":
+		return gen.WriteModuleJSON(info.Stdout, doc)
+	case "markdown", "md":
+		return gen.WriteModuleMarkdown(info.Stdout, doc)
+	default:
+		return fmt.Errorf("unknown documentation format %q", info.Format)
+	}
+}
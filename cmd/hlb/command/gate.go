@@ -0,0 +1,80 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/openllb/hlb/codegen"
+)
+
+// ErrGateRejected is returned by PromptGate when a gate is not approved.
+var ErrGateRejected = errors.New("rejected at the prompt")
+
+// PromptGate returns a gate handler that asks for the approval of each gate
+// on a terminal, one gate at a time.
+//
+// A read of the terminal can't be interrupted, so a prompt that is given up on
+// leaves its read to the next prompt instead of starting another one. The line
+// answers the next prompt, and is never read by two prompts at once.
+func PromptGate(r io.Reader, w io.Writer) codegen.GateHandler {
+	var (
+		mu      sync.Mutex
+		br      = bufio.NewReader(r)
+		lines   = make(chan promptLine)
+		reading bool
+	)
+	return func(ctx context.Context, msg string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fmt.Fprintf(w, "\ngate: %s [y/N] ", msg)
+		if !reading {
+			reading = true
+			go func() {
+				line, err := br.ReadString('\n')
+				lines <- promptLine{line, err}
+			}()
+		}
+
+		var pl promptLine
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case pl = <-lines:
+			reading = false
+		}
+		if pl.err != nil && (!errors.Is(pl.err, io.EOF) || pl.line == "") {
+			return pl.err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(pl.line)) {
+		case "y", "yes":
+			return nil
+		}
+		return ErrGateRejected
+	}
+}
+
+type promptLine struct {
+	line string
+	err  error
+}
+
+// ParseTarget parses a target and its args, which are separated by spaces and
+// quoted like a shell, e.g. `deploy staging "v1.2 rc"`.
+func ParseTarget(target string) (codegen.Target, error) {
+	parts, err := shellquote.Split(target)
+	if err != nil {
+		return codegen.Target{}, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if len(parts) == 0 {
+		return codegen.Target{}, fmt.Errorf("invalid target %q: missing name", target)
+	}
+	return codegen.Target{Name: parts[0], Args: parts[1:]}, nil
+}
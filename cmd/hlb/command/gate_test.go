@@ -0,0 +1,45 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromptGate(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	var out bytes.Buffer
+	prompt := PromptGate(pr, &out)
+
+	// A prompt given up on returns without an answer.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := prompt(ctx, "deploy?")
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The next prompt is answered by the next line, which the read of the
+	// prompt given up on doesn't keep for itself.
+	done := make(chan error, 1)
+	go func() {
+		done <- prompt(context.Background(), "release?")
+	}()
+	_, err = io.WriteString(pw, "y\n")
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	go func() {
+		done <- prompt(context.Background(), "announce?")
+	}()
+	_, err = io.WriteString(pw, "n\n")
+	require.NoError(t, err)
+	require.ErrorIs(t, <-done, ErrGateRejected)
+
+	require.Equal(t, "\ngate: deploy? [y/N] \ngate: release? [y/N] \ngate: announce? [y/N] ", out.String())
+}
@@ -175,7 +175,7 @@ func Vendor(ctx context.Context, cln *client.Client, uri string, info VendorInfo
 
 	if !hasImports {
 		fmt.Printf("No imports found in %s\n", mod.Pos.Filename)
-		return nil
+		return module.LockFrontends(ctx, info.Tidy, mod)
 	}
 
 	p, err := solver.NewProgress(ctx)
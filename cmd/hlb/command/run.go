@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/moby/buildkit/client"
@@ -18,9 +19,11 @@ import (
 	"github.com/openllb/hlb/diagnostic"
 	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/module"
 	"github.com/openllb/hlb/parser"
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/openllb/hlb/pkg/redact"
 	"github.com/openllb/hlb/pkg/steer"
 	"github.com/openllb/hlb/rpc/dapserver"
 	"github.com/openllb/hlb/solver"
@@ -37,7 +40,7 @@ var runCommand = &cli.Command{
 		&cli.StringSliceFlag{
 			Name:    "target",
 			Aliases: []string{"t"},
-			Usage:   "specify target filesystem to solve",
+			Usage:   "specify target to solve, followed by its args separated by spaces",
 			Value:   cli.NewStringSlice("default"),
 		},
 		&cli.BoolFlag{
@@ -48,6 +51,10 @@ var runCommand = &cli.Command{
 			Name:  "dap",
 			Usage: "set debugger fronted to DAP over stdio",
 		},
+		&cli.BoolFlag{
+			Name:  "test",
+			Usage: "run the targets whose names start with \"test\" and report which failed",
+		},
 		&cli.BoolFlag{
 			Name:  "tree",
 			Usage: "print out the request tree without solving",
@@ -66,6 +73,70 @@ var runCommand = &cli.Command{
 			Name:  "platform",
 			Usage: "set default platform for image resolution",
 		},
+		&cli.StringFlag{
+			Name:  "lint",
+			Usage: "set how lint findings are handled (off, warn, error)",
+			Value: "warn",
+		},
+		&cli.StringFlag{
+			Name:  "output-delimiter",
+			Usage: "set the delimiter written between string targets, defaults to a newline",
+		},
+		&cli.StringFlag{
+			Name:  "metadata-file",
+			Usage: "write the names, digests and sizes of pushed images to a JSON file",
+		},
+		&cli.BoolFlag{
+			Name:  "require-pinned-frontends",
+			Usage: "fail if a frontend is not pinned by a digest, a digest option or hlb.lock",
+		},
+		&cli.BoolFlag{
+			Name:  "no-preflight",
+			Usage: "skip checking that the working directory and user of each run exist before running it",
+		},
+		&cli.BoolFlag{
+			Name:  "deny-local",
+			Usage: "deny localRun and localEnv, except for those allowed by --allow-local-run and --allow-local-env",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allow-local-run",
+			Usage: "allow localRun to run a command, denying all others",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allow-local-env",
+			Usage: "allow localEnv to read an environment variable, denying all others",
+		},
+		&cli.StringFlag{
+			Name:  "sandbox-imports",
+			Usage: "only let imported modules read local files under a directory, and deny them localRun, the ssh agent and forwarding network addresses",
+		},
+		&cli.StringSliceFlag{
+			Name:  "sensitive-env",
+			Usage: "redact the values of environment variables read with localEnv whose names contain a pattern",
+			Value: cli.NewStringSlice(codegen.DefaultSensitiveEnv...),
+		},
+		&cli.StringFlag{
+			Name:  "stop-at",
+			Usage: "solve the targets only up to a statement, given as file.hlb:LINE or funcName#N",
+		},
+		&cli.StringFlag{
+			Name:  "stop-download",
+			Usage: "download the filesystem at --stop-at to a directory instead of only solving it",
+		},
+		&cli.DurationFlag{
+			Name:  "gate-timeout",
+			Usage: "time to wait for the approval of each gate in a pipeline, 0 to wait indefinitely",
+		},
+		&cli.StringFlag{
+			Name:  "transfer-cache",
+			Usage: "set the file recording the large files synced up by local sources with largeFileThreshold, empty to not keep it",
+			Value: solver.DefaultTransferCachePath(),
+		},
+		&cli.DurationFlag{
+			Name:  "reconnect",
+			Usage: "time to spend reconnecting when the connection to buildkitd is lost mid-build, 0 to disable",
+			Value: time.Minute,
+		},
 	},
 	Action: func(c *cli.Context) error {
 		uri, err := GetURI(c)
@@ -84,13 +155,53 @@ var runCommand = &cli.Command{
 			controlDebugger = ControlDebuggerTUI(os.Stdin, os.Stdout, os.Stderr)
 		}
 
+		var reconnect *solver.ReconnectPolicy
+		if budget := c.Duration("reconnect"); budget > 0 {
+			addr := c.String("addr")
+			reconnect = &solver.ReconnectPolicy{
+				Dial: func(ctx context.Context) (*client.Client, error) {
+					cln, _, err := hlb.Client(ctx, addr)
+					return cln, err
+				},
+				Budget: budget,
+			}
+		}
+
+		// An empty delimiter can be set, so it is only unset without the flag.
+		var outputDelim *string
+		if c.IsSet("output-delimiter") {
+			delim := c.String("output-delimiter")
+			outputDelim = &delim
+		}
+
+		targets := c.StringSlice("target")
+		if c.Bool("test") && !c.IsSet("target") {
+			targets = nil
+		}
+
 		return Run(ctx, cln, uri, RunInfo{
 			Tree:            c.Bool("tree"),
-			Targets:         c.StringSlice("target"),
+			Test:            c.Bool("test"),
+			Targets:         targets,
 			LLB:             c.Bool("llb"),
 			Backtrace:       c.Bool("backtrace"),
 			LogOutput:       c.String("log-output"),
 			DefaultPlatform: c.String("platform"),
+			Lint:            c.String("lint"),
+			OutputDelimiter: outputDelim,
+			MetadataFile:    c.String("metadata-file"),
+			SensitiveEnv:    c.StringSlice("sensitive-env"),
+			StopAt:          c.String("stop-at"),
+			StopDownload:    c.String("stop-download"),
+			GateTimeout:     c.Duration("gate-timeout"),
+			DenyLocal:       c.Bool("deny-local"),
+			PinFrontends:    c.Bool("require-pinned-frontends"),
+			NoPreflight:     c.Bool("no-preflight"),
+			AllowLocalRun:   c.StringSlice("allow-local-run"),
+			AllowLocalEnv:   c.StringSlice("allow-local-env"),
+			SandboxImports:  c.String("sandbox-imports"),
+			TransferCache:   c.String("transfer-cache"),
+			Reconnect:       reconnect,
 			Debug:           c.Bool("debug"),
 			DAP:             c.Bool("dap"),
 			ControlDebugger: controlDebugger,
@@ -111,7 +222,7 @@ func GetURI(c *cli.Context) (uri string, err error) {
 
 func ParseModuleURI(ctx context.Context, cln *client.Client, stdin io.Reader, uri string) (*ast.Module, error) {
 	if uri == "-" {
-		return parser.Parse(ctx, &parser.NamedReader{
+		return codegen.ParseModule(ctx, &parser.NamedReader{
 			Reader: stdin,
 			Value:  "<stdin>",
 		})
@@ -133,11 +244,57 @@ func ControlDebuggerTUI(stdin io.Reader, stdout, stderr io.Writer) ControlDebugg
 type RunInfo struct {
 	DAP             bool
 	Tree            bool
+	Test            bool // run the tests of the module instead of its targets
 	Backtrace       bool
 	Targets         []string
 	LLB             bool
 	LogOutput       string
-	DefaultPlatform string // format: osname/osarch
+	DefaultPlatform string  // format: osname/osarch
+	Lint            string  // one of off, warn or error
+	OutputDelimiter *string // written between string targets, defaults to a newline
+	MetadataFile    string  // path that the metadata of pushed images is written to
+
+	// SensitiveEnv are the patterns of the names of environment variables
+	// whose values are redacted, which defaults to
+	// codegen.DefaultSensitiveEnv.
+	SensitiveEnv []string
+
+	// StopAt stops every target at a statement, given as file.hlb:LINE or
+	// funcName#N, so that its state there can be solved or inspected with a
+	// debugger. StopDownload is where its filesystem is downloaded.
+	StopAt       string
+	StopDownload string
+
+	// GateHandler approves the gates of pipelines, which defaults to a prompt
+	// when stdin is a terminal.
+	GateHandler codegen.GateHandler
+	GateTimeout time.Duration
+
+	// DenyLocal restricts localRun and localEnv to the commands and
+	// environment variables allowed, which is implied by allowing any.
+	DenyLocal     bool
+	AllowLocalRun []string
+	AllowLocalEnv []string
+
+	// SandboxImports is the directory imported modules may read local files
+	// under, and sandboxes them when set.
+	SandboxImports string
+
+	// TransferCache is the file recording the large files synced up by local
+	// sources, so that unchanged files are not transferred again by later
+	// runs.
+	TransferCache string
+
+	// PinFrontends requires every frontend to be pinned, and frontends are
+	// always verified against the lockfile of the working directory.
+	PinFrontends bool
+
+	// NoPreflight skips checking the working directory and user of each run
+	// before it is run.
+	NoPreflight bool
+
+	// Reconnect re-submits requests when the connection to buildkitd is lost.
+	Reconnect *solver.ReconnectPolicy
 
 	Stdin  io.Reader
 	Stderr io.Writer
@@ -155,7 +312,7 @@ type RunInfo struct {
 }
 
 func Run(ctx context.Context, cln *client.Client, uri string, info RunInfo) (err error) {
-	if len(info.Targets) == 0 {
+	if len(info.Targets) == 0 && !info.Test {
 		info.Targets = []string{"default"}
 	}
 	if info.Stdin == nil {
@@ -182,6 +339,13 @@ func Run(ctx context.Context, cln *client.Client, uri string, info RunInfo) (err
 		}
 		ctx = codegen.WithDefaultPlatform(ctx, specs.Platform{OS: platformParts[0], Architecture: platformParts[1]})
 	}
+	if cln != nil {
+		// Helpers that only change files run on the platform of the workers.
+		workers, err := cln.ListWorkers(ctx)
+		if err == nil && len(workers) > 0 && len(workers[0].Platforms) > 0 {
+			ctx = codegen.WithBuildPlatform(ctx, workers[0].Platforms[0])
+		}
+	}
 
 	var (
 		progressOpts []solver.ProgressOption
@@ -233,27 +397,50 @@ func Run(ctx context.Context, cln *client.Client, uri string, info RunInfo) (err
 	ctx = codegen.WithProgress(ctx, p)
 	ctx = codegen.WithMultiWriter(ctx, p.MultiWriter())
 
+	// Sensitive values are redacted from errors as well as from the progress
+	// of the build.
+	redactions := redact.NewSet()
 	defer func() {
 		if err == nil {
 			return
 		}
-		numErrs := displayError(ctx, info.Stderr, err, info.Backtrace)
-		err = errdefs.WithAbort(err, numErrs)
+		w := redactions.NewWriter(info.Stderr)
+		numErrs := displayError(ctx, w, err, info.Backtrace)
+		_ = w.Flush()
+		err = errdefs.WithAbort(solver.RedactError(redactions, err), numErrs)
 	}()
 
 	var mod *ast.Module
 	if info.Reader == nil {
 		mod, err = ParseModuleURI(ctx, cln, info.Stdin, uri)
 	} else {
-		mod, err = parser.Parse(ctx, info.Reader, filebuffer.WithEphemeral())
+		mod, err = codegen.ParseModule(ctx, info.Reader, filebuffer.WithEphemeral())
 	}
 	if err != nil {
 		return err
 	}
 
+	// String targets are written to stdout, unless it is used by the debug
+	// adapter protocol.
+	output := info.Stdout
+	if info.DAP {
+		output = info.Stderr
+	}
+
+	if info.StopDownload != "" && info.StopAt == "" {
+		return fmt.Errorf("--stop-download requires --stop-at")
+	}
+
 	var targets []codegen.Target
-	for _, target := range info.Targets {
-		targets = append(targets, codegen.Target{Name: target})
+	for _, t := range info.Targets {
+		target, err := ParseTarget(t)
+		if err != nil {
+			return err
+		}
+		target.Output = output
+		target.StopAt = info.StopAt
+		target.StopDownload = info.StopDownload
+		targets = append(targets, target)
 	}
 
 	g, ctx := errgroup.WithContext(ctx)
@@ -277,7 +464,63 @@ func Run(ctx context.Context, cln *client.Client, uri string, info RunInfo) (err
 		})
 	}
 
-	solveReq, err := hlb.Compile(ctx, cln, info.Stderr, mod, targets)
+	opts := []codegen.CodeGenOption{codegen.WithRedaction(redactions)}
+	if info.SensitiveEnv != nil {
+		opts = append(opts, codegen.WithSensitiveEnv(info.SensitiveEnv))
+	}
+	if info.Lint != "" {
+		mode, err := codegen.ParseLintMode(info.Lint)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, codegen.WithLintMode(mode))
+	}
+	if info.Test {
+		opts = append(opts, codegen.WithTestMode())
+	}
+	if info.OutputDelimiter != nil {
+		opts = append(opts, codegen.WithOutputDelimiter(*info.OutputDelimiter))
+	}
+	if info.MetadataFile != "" {
+		opts = append(opts, codegen.WithMetadataFile(info.MetadataFile))
+	}
+	gateHandler := info.GateHandler
+	if gateHandler == nil && !info.Debug && !info.DAP {
+		// The debugger reads stdin, so gates are only prompted without it.
+		if f, ok := info.Stdin.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+			gateHandler = PromptGate(info.Stdin, info.Stderr)
+		}
+	}
+	if gateHandler != nil {
+		opts = append(opts, codegen.WithGateHandler(gateHandler))
+	}
+	if info.GateTimeout > 0 {
+		opts = append(opts, codegen.WithGateTimeout(info.GateTimeout))
+	}
+	if info.DenyLocal || len(info.AllowLocalRun) > 0 || len(info.AllowLocalEnv) > 0 {
+		opts = append(opts, codegen.WithLocalAllowList(info.AllowLocalRun, info.AllowLocalEnv))
+	}
+	if info.SandboxImports != "" {
+		opts = append(opts, codegen.WithImportSandbox(info.SandboxImports))
+	}
+	lf, err := module.ReadLockfile()
+	if err != nil {
+		return err
+	}
+	if lf != nil {
+		opts = append(opts, codegen.WithLockfile(lf))
+	}
+	if info.PinFrontends {
+		opts = append(opts, codegen.WithRequirePinnedFrontends())
+	}
+	if info.TransferCache != "" {
+		opts = append(opts, codegen.WithTransferCache(solver.OpenTransferCache(info.TransferCache)))
+	}
+	if info.NoPreflight {
+		opts = append(opts, codegen.WithoutPreflight())
+	}
+
+	solveReq, err := hlb.Compile(ctx, cln, info.Stderr, mod, targets, opts...)
 	if err != nil {
 		perr := p.Wait()
 		// Ignore early exits from the debugger.
@@ -317,7 +560,11 @@ func Run(ctx context.Context, cln *client.Client, uri string, info RunInfo) (err
 		if dapWriter != nil {
 			defer dapWriter.Close()
 		}
-		return solveReq.Solve(ctx, cln, p.MultiWriter())
+		var opts []solver.SolveOption
+		if info.Reconnect != nil {
+			opts = append(opts, solver.WithReconnect(*info.Reconnect))
+		}
+		return solveReq.Solve(ctx, cln, p.MultiWriter(), opts...)
 	})
 
 	err = g.Wait()
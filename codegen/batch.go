@@ -0,0 +1,229 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/linter"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/openllb/hlb/solver"
+	"golang.org/x/sync/singleflight"
+)
+
+// ModuleTargets is a parsed and checked module and the targets to generate
+// from it.
+type ModuleTargets struct {
+	Module  *ast.Module
+	Targets []Target
+}
+
+// GenerateAll generates the targets of many modules as a single request.
+//
+// The modules share one CodeGen, so a module imported by several of them is
+// parsed and checked once, and image configs are resolved once per ref across
+// the batch. Each module keeps its own scope and memoized values. Every target
+// is named after its module and target so that failures are attributed to it.
+func GenerateAll(ctx context.Context, cln *client.Client, resolver Resolver, specs []ModuleTargets, opts ...CodeGenOption) (solver.Request, error) {
+	if imr := ImageResolver(ctx); imr != nil {
+		ctx = WithImageResolver(ctx, CacheImageResolver(imr))
+	}
+
+	cg := New(cln, resolver, opts...)
+	hr := newHookRun(cg.hooks)
+	ctx = withHookRun(ctx, hr)
+
+	sd := newSourceDedup()
+	ctx = withSourceDedup(ctx, sd)
+
+	var requests []solver.Request
+	for _, spec := range specs {
+		prefix := spec.Module.Pos.Filename
+		reqs, err := cg.generate(ctx, spec.Module, prefix, spec.Targets)
+		if err != nil {
+			if hr != nil {
+				return nil, hr.withErr(err)
+			}
+			return nil, err
+		}
+		for i, req := range reqs {
+			requests = append(requests, solver.Named(targetName(prefix, spec.Targets[i]), req))
+		}
+	}
+	var result solver.Request = &dedupRequest{
+		w:   cg.diagnosticWriter,
+		sd:  sd,
+		req: solver.Parallel(requests...),
+	}
+	if hr != nil {
+		return hr.Request(result), nil
+	}
+	return result, nil
+}
+
+// ModuleCache is a content-addressed cache of imported modules that have been
+// parsed and checked, keyed by the digest of their source so that changes to
+// an import are never served from it. Every code generator has its own cache
+// by default, which WithModuleCache replaces with one shared by the code
+// generators of a long-running process.
+type ModuleCache struct {
+	g      singleflight.Group
+	mu     sync.Mutex
+	mods   map[string]*cachedModule
+	cached map[*ast.Module]struct{}
+
+	// bindMu serializes binding the imports of cached modules, whose scopes
+	// are shared by every code generator using the cache.
+	bindMu sync.Mutex
+}
+
+// cachedModule is an imported module with the source it was parsed from and
+// its lint findings, which are reported by every build importing it because
+// linting rewrites deprecated syntax and can only find it once.
+type cachedModule struct {
+	mod      *ast.Module
+	fb       *filebuffer.FileBuffer
+	findings []*linter.Finding
+}
+
+// NewModuleCache returns an empty module cache.
+func NewModuleCache() *ModuleCache {
+	return &ModuleCache{
+		mods:   make(map[string]*cachedModule),
+		cached: make(map[*ast.Module]struct{}),
+	}
+}
+
+// WithModuleCache sets the cache of imported modules, so that a stable import
+// is parsed and checked once by every code generator sharing the cache.
+func WithModuleCache(mc *ModuleCache) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.modules = mc
+	}
+}
+
+// Do returns the cached module for key, invoking fn at most once. Modules are
+// only cached when fn succeeds, and an empty key is never cached.
+func (mc *ModuleCache) Do(key string, fn func() (*cachedModule, error)) (*cachedModule, error) {
+	if key == "" {
+		return fn()
+	}
+
+	v, err, _ := mc.g.Do(key, func() (interface{}, error) {
+		mc.mu.Lock()
+		cm, ok := mc.mods[key]
+		mc.mu.Unlock()
+		if ok {
+			return cm, nil
+		}
+
+		cm, err := fn()
+		if err != nil {
+			return nil, err
+		}
+
+		mc.mu.Lock()
+		mc.mods[key] = cm
+		mc.cached[cm.mod] = struct{}{}
+		mc.mu.Unlock()
+		return cm, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*cachedModule), nil
+}
+
+// has returns true if a module is in the cache.
+func (mc *ModuleCache) has(mod *ast.Module) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	_, ok := mc.cached[mod]
+	return ok
+}
+
+// bind binds an import to its module and checks the references to it. The
+// imports of a cached module may be bound by any build sharing the cache, so
+// the binding is only read by check, and each build reads its own bindings.
+func (mc *ModuleCache) bind(obj *ast.Object, imod *ast.Module, check func() error) error {
+	mc.bindMu.Lock()
+	defer mc.bindMu.Unlock()
+	obj.Data = imod
+	return check()
+}
+
+// bound returns the module an import was bound to, which is read under the
+// same lock as it is bound.
+func (mc *ModuleCache) bound(obj *ast.Object) (*ast.Module, bool) {
+	mc.bindMu.Lock()
+	defer mc.bindMu.Unlock()
+	imod, ok := obj.Data.(*ast.Module)
+	return imod, ok
+}
+
+// importBindings are the modules that imports were bound to by a code
+// generator, because the imports of cached modules are re-resolved by every
+// build so that their own imports are never stale.
+type importBindings struct {
+	mu   sync.Mutex
+	mods map[*ast.ImportDecl]*ast.Module
+}
+
+func newImportBindings() *importBindings {
+	return &importBindings{mods: make(map[*ast.ImportDecl]*ast.Module)}
+}
+
+func (ib *importBindings) get(id *ast.ImportDecl) (*ast.Module, bool) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	imod, ok := ib.mods[id]
+	return imod, ok
+}
+
+func (ib *importBindings) set(id *ast.ImportDecl, imod *ast.Module) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	ib.mods[id] = imod
+}
+
+// fileImportKey returns the cache key of an import from a local file, which
+// is keyed by the content digest of the file so that changes to it are never
+// served from the cache. Other imports return an empty key.
+func fileImportKey(ctx context.Context, dir ast.Directory, uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "" && u.Scheme != "file") {
+		return ""
+	}
+
+	filename, err := parser.ResolvePath(ModuleDir(ctx), u.Host+u.Path)
+	if err != nil {
+		return ""
+	}
+
+	rc, err := dir.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+
+	dt, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("file://%s/%s@%s", dir.Path(), filename, digest.FromBytes(dt))
+}
+
+// fsImportKey returns the cache key of an import from a filesystem, which is
+// keyed by the digest of the filesystem.
+func fsImportKey(dir ast.Directory) string {
+	if dir.Digest() == "" {
+		return ""
+	}
+	return fmt.Sprintf("fs://%s/%s", dir.Digest(), ModuleFilename)
+}
@@ -12,28 +12,46 @@ var (
 	Callables = map[ast.Kind]map[string]interface{}{
 		ast.Filesystem: {
 			"scratch":               Scratch{},
+			"selectPlatform":        SelectPlatform{},
 			"image":                 Image{},
 			"http":                  HTTP{},
 			"git":                   Git{},
 			"local":                 Local{},
+			"localGit":              LocalGit{},
+			"tarContext":            TarContext{},
 			"frontend":              Frontend{},
+			"devFrontend":           DevFrontend{},
+			"dockerfile":            Dockerfile{},
+			"dockerfileStages":      DockerfileStages{},
 			"run":                   Run{},
 			"env":                   Env{},
 			"dir":                   Dir{},
 			"user":                  User{},
 			"mkdir":                 Mkdir{},
 			"mkfile":                Mkfile{},
+			"writeFile":             WriteFile{},
 			"rm":                    Rm{},
+			"whiteout":              Whiteout{},
 			"copy":                  Copy{},
+			"fetchArchive":          FetchArchive{},
 			"merge":                 Merge{},
 			"diff":                  Diff{},
+			"combine":               Combine{},
+			"strip":                 Strip{},
 			"entrypoint":            Entrypoint{},
 			"cmd":                   Cmd{},
 			"label":                 Label{},
 			"expose":                Expose{},
 			"volumes":               Volumes{},
 			"stopSignal":            StopSignal{},
+			"imageConfig":           ImageConfig{},
+			"assert":                Assert{},
+			"fail":                  Fail{},
+			"assertEq":              AssertEq{},
+			"assertExists":          AssertExists{},
+			"assertFileContains":    AssertFileContains{},
 			"dockerPush":            DockerPush{},
+			"scan":                  Scan{},
 			"dockerLoad":            DockerLoad{},
 			"download":              Download{},
 			"downloadTarball":       DownloadTarball{},
@@ -41,54 +59,128 @@ var (
 			"downloadDockerTarball": DownloadDockerTarball{},
 		},
 		ast.String: {
-			"format":    Format{},
-			"template":  Template{},
-			"manifest":  Manifest{},
-			"localArch": LocalArch{},
-			"localOs":   LocalOS{},
-			"localCwd":  LocalCwd{},
-			"localEnv":  LocalEnv{},
-			"localRun":  LocalRun{},
+			"format":          Format{},
+			"template":        Template{},
+			"manifest":        Manifest{},
+			"localArch":       LocalArch{},
+			"localOs":         LocalOS{},
+			"bindingName":     BindingName{},
+			"targetOs":        TargetOS{},
+			"targetArch":      TargetArch{},
+			"perPlatform":     PerPlatform{},
+			"localCwd":        LocalCwd{},
+			"localEnv":        LocalEnv{},
+			"sensitive":       Sensitive{},
+			"localRun":        LocalRun{},
+			"gitCommit":       GitCommitSHA{},
+			"gitBranch":       GitBranch{},
+			"fileMode":        FileMode{},
+			"readFile":        ReadFile{},
+			"imageConfigDiff": ImageConfigDiff{},
+			"runtimeSpec":     RuntimeSpec{},
+		},
+		ast.Bool: {
+			"exists": Exists{},
+			"isDir":  IsDir{},
+			"tryRun": TryRun{},
 		},
 		ast.Pipeline: {
 			"stage":    Stage{},
 			"parallel": Stage{},
+			"sequence": Sequence{},
+			"gate":     Gate{},
+			"stageEnv": StageEnv{},
 		},
 		"option::image": {
 			"resolve":  Resolve{},
 			"platform": Platform{},
 		},
+		"option::selectPlatform": {
+			"when": SelectPlatformWhen{},
+		},
 		"option::http": {
 			"checksum": Checksum{},
 			"chmod":    Chmod{},
 			"filename": Filename{},
+			"fallback": Fallback{},
 		},
 		"option::git": {
-			"keepGitDir": KeepGitDir{},
+			"keepGitDir":   KeepGitDir{},
+			"depth":        GitDepth{},
+			"shallowSince": GitShallowSince{},
+			"commit":       GitCommit{},
+			"fallback":     Fallback{},
 		},
 		"option::local": {
-			"includePatterns": IncludePatterns{},
-			"excludePatterns": ExcludePatterns{},
+			"includePatterns":    IncludePatterns{},
+			"excludePatterns":    ExcludePatterns{},
+			"ignoreFile":         IgnoreFile{},
+			"useIgnoreFile":      UseIgnoreFile{},
+			"verifyManifest":     VerifyManifest{},
+			"allowExtra":         AllowExtra{},
+			"largeFileThreshold": LargeFileThreshold{},
+		},
+		"option::localGit": {
+			"includeUntracked": IncludeUntracked{},
+			"submodules":       Submodules{},
+			"subdir":           Subdir{},
+			"repoRelative":     RepoRelative{},
+		},
+		"option::tarContext": {
+			"input":           TarInput{},
+			"stripComponents": StripComponents{},
+			"subdir":          Subdir{},
+			"checksum":        TarChecksum{},
 		},
 		"option::frontend": {
+			"input":  FrontendInput{},
+			"opt":    FrontendOpt{},
+			"digest": FrontendDigest{},
+		},
+		"option::devFrontend": {
 			"input": FrontendInput{},
 			"opt":   FrontendOpt{},
 		},
+		"option::dockerfile": {
+			"stage": DockerfileStage{},
+			"arg":   DockerfileArg{},
+		},
+		"option::dockerfileStages": {
+			"arg": DockerfileArg{},
+		},
 		"option::run": {
 			"readonlyRootfs": ReadonlyRootfs{},
+			"capture":        Capture{},
 			"env":            RunEnv{},
 			"dir":            RunDir{},
+			"workdirCreate":  WorkdirCreate{},
 			"user":           RunUser{},
 			"ignoreCache":    IgnoreCache{},
 			"network":        Network{},
 			"security":       Security{},
 			"shlex":          Shlex{},
+			"stdin":          Stdin{},
+			"stdinFile":      StdinFile{},
+			"dependsOn":      DependsOn{},
 			"host":           Host{},
 			"ssh":            SSH{},
 			"forward":        Forward{},
 			"secret":         Secret{},
+			"secretFile":     SecretFile{},
+			"secretDir":      SecretDir{},
 			"mount":          Mount{},
 		},
+		"option::tryRun": {
+			"env":         RunEnv{},
+			"dir":         RunDir{},
+			"user":        RunUser{},
+			"ignoreCache": IgnoreCache{},
+			"network":     Network{},
+			"security":    Security{},
+			"shlex":       Shlex{},
+			"stdin":       Stdin{},
+			"host":        Host{},
+		},
 		"option::ssh": {
 			"target":     MountTarget{},
 			"uid":        UID{},
@@ -103,6 +195,18 @@ var (
 			"includePatterns": IncludePatterns{},
 			"excludePatterns": ExcludePatterns{},
 		},
+		"option::secretFile": {
+			"optional": SecretOptional{},
+			"uid":      UID{},
+			"gid":      GID{},
+			"mode":     UtilChmod{},
+		},
+		"option::secretDir": {
+			"optional": SecretOptional{},
+			"uid":      UID{},
+			"gid":      GID{},
+			"mode":     UtilChmod{},
+		},
 		"option::mount": {
 			"readonly":   Readonly{},
 			"tmpfs":      Tmpfs{},
@@ -118,9 +222,22 @@ var (
 			"chown":       Chown{},
 			"createdTime": CreatedTime{},
 		},
+		"option::writeFile": {
+			"mode":            WriteFileMode{},
+			"chown":           Chown{},
+			"createdTime":     CreatedTime{},
+			"append":          WriteFileAppend{},
+			"createIfMissing": WriteFileCreateIfMissing{},
+			"templated":       WriteFileTemplated{},
+			"field":           StringField{},
+		},
+		"option::fetchArchive": {
+			"chown": Chown{},
+		},
 		"option::rm": {
 			"allowNotFound": AllowNotFound{},
 			"allowWildcard": AllowWildcard{},
+			"except":        Except{},
 		},
 		"option::copy": {
 			"followSymlinks":     FollowSymlinks{},
@@ -130,10 +247,44 @@ var (
 			"allowWildcard":      CopyAllowWildcard{},
 			"allowEmptyWildcard": AllowEmptyWildcard{},
 			"chown":              UtilChown{},
+			"chownFrom":          ChownFrom{},
 			"chmod":              UtilChmod{},
+			"fileMode":           CopyFileMode{},
+			"dirMode":            CopyDirMode{},
 			"createdTime":        UtilCreatedTime{},
 			"includePatterns":    IncludePatterns{},
 			"excludePatterns":    ExcludePatterns{},
+			"excludeExtensions":  ExcludeExtensions{},
+			"maxSize":            MaxSize{},
+			"substitute":         Substitute{},
+			"exportIgnore":       ExportIgnore{},
+			"manifest":           CopyManifest{},
+		},
+		"option::imageConfig": {
+			"entrypoint":  ConfigEntrypoint{},
+			"cmd":         ConfigCmd{},
+			"env":         ConfigEnv{},
+			"workdir":     ConfigWorkdir{},
+			"user":        ConfigUser{},
+			"label":       ConfigLabel{},
+			"removeLabel": ConfigRemoveLabel{},
+			"volume":      ConfigVolume{},
+			"exposed":     ConfigExposed{},
+			"stopSignal":  ConfigStopSignal{},
+			"healthcheck": ConfigHealthcheck{},
+			"argsEscaped": ConfigArgsEscaped{},
+		},
+		"option::healthcheck": {
+			"interval":    HealthcheckInterval{},
+			"timeout":     HealthcheckTimeout{},
+			"startPeriod": HealthcheckStartPeriod{},
+			"retries":     HealthcheckRetries{},
+		},
+		"option::combine": {
+			"conflict": CombineConflict{},
+		},
+		"option::strip": {
+			"helper": StripHelper{},
 		},
 		"option::localRun": {
 			"ignoreError":   IgnoreError{},
@@ -144,11 +295,40 @@ var (
 		"option::template": {
 			"stringField": StringField{},
 		},
+		"option::perPlatform": {
+			"separator": PerPlatformSeparator{},
+		},
+		"option::exists": {
+			"noFollow": NoFollow{},
+		},
+		"option::isDir": {
+			"noFollow": NoFollow{},
+		},
+		"option::fileMode": {
+			"noFollow": NoFollow{},
+		},
 		"option::manifest": {
 			"platform": Platform{},
 		},
+		"option::scan": {
+			"severityThreshold": ScanSeverityThreshold{},
+			"ignore":            ScanIgnore{},
+			"reportPath":        ScanReportPath{},
+		},
+		"option::runtimeSpec": {
+			"publish":         RuntimeSpecPublish{},
+			"bind":            RuntimeSpecBind{},
+			"env":             RuntimeSpecEnv{},
+			"commandOverride": RuntimeSpecCommandOverride{},
+			"format":          RuntimeSpecFormat{},
+		},
 		"option::dockerPush": {
-			"stargz": Stargz{},
+			"stargz":       Stargz{},
+			"maxImageSize": MaxImageSize{},
+		},
+		"option::download": {
+			"filename":        DownloadFilename{},
+			"contentFilename": DownloadContentFilename{},
 		},
 	}
 )
@@ -0,0 +1,111 @@
+package codegen
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/openllb/hlb/errdefs"
+)
+
+type Assert struct{}
+
+func (a Assert) Call(ctx context.Context, cln *client.Client, val Value, opts Option, condition bool, message string) (Value, error) {
+	if !condition {
+		return nil, errdefs.WithAssertFailed(Arg(ctx, 0), message)
+	}
+	return val, nil
+}
+
+type Fail struct{}
+
+func (f Fail) Call(ctx context.Context, cln *client.Client, val Value, opts Option, message string) (Value, error) {
+	return nil, errdefs.WithFailed(ProgramCounter(ctx), message)
+}
+
+type AssertEq struct{}
+
+func (ae AssertEq) Call(ctx context.Context, cln *client.Client, val Value, opts Option, actual, expected string) (Value, error) {
+	if actual != expected {
+		return nil, errdefs.WithAssertNotEqual(Arg(ctx, 0), Arg(ctx, 1), actual, expected)
+	}
+	return val, nil
+}
+
+type AssertExists struct{}
+
+func (ae AssertExists) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, p string) (Value, error) {
+	_, err := statPath(ctx, cln, input, p, opts)
+	if err != nil {
+		if errdefs.IsNotExist(err) {
+			return nil, errdefs.WithAssertNotExist(Arg(ctx, 1), Arg(ctx, 0), p)
+		}
+		return nil, err
+	}
+	return val, nil
+}
+
+type AssertFileContains struct{}
+
+func (afc AssertFileContains) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, p, substring string) (Value, error) {
+	dt, err := readPath(ctx, cln, input, p)
+	if err != nil {
+		if errdefs.IsNotExist(err) {
+			return nil, errdefs.WithAssertNotExist(Arg(ctx, 1), Arg(ctx, 0), p)
+		}
+		return nil, err
+	}
+	if !strings.Contains(string(dt), substring) {
+		return nil, errdefs.WithAssertNotContains(Arg(ctx, 2), Arg(ctx, 1), p, substring)
+	}
+	return val, nil
+}
+
+// readPath reads a file in a filesystem by solving it.
+func readPath(ctx context.Context, cln *client.Client, fs Filesystem, p string) ([]byte, error) {
+	def, err := fs.State.Marshal(ctx, llb.Platform(fs.Platform))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		dt      []byte
+		readErr error
+	)
+	err = gatewayBuild(ctx, cln, fs.SolveOpts, fs.SessionOpts, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		res, err := c.Solve(ctx, gateway.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := res.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+
+		// Missing files are not a build failure, so the error is returned
+		// outside of the build.
+		dt, readErr = readRef(ctx, ref, p)
+		return gateway.NewResult(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dt, readErr
+}
+
+// readRef reads a file in a solved reference.
+func readRef(ctx context.Context, ref gateway.Reference, p string) ([]byte, error) {
+	p = path.Clean("/" + p)
+	if ref == nil {
+		// Scratch has no files.
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return ref.ReadFile(ctx, gateway.ReadRequest{Filename: p})
+}
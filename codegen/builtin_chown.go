@@ -0,0 +1,150 @@
+package codegen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+const (
+	PasswdPath = "/etc/passwd"
+	GroupPath  = "/etc/group"
+)
+
+type ChownFrom struct {
+	Input Filesystem
+	Node  ast.Node
+}
+
+func (cf ChownFrom) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &ChownFrom{
+		Input: input,
+		Node:  Arg(ctx, 0),
+	}))
+}
+
+// Resolve resolves the user and group names of a user[:group] owner to
+// numeric ids, like BuildKit does with the destination's files. A user without
+// a group is owned by the user's primary group, and a numeric user without a
+// group by the group with the same id.
+func (cf *ChownFrom) Resolve(ctx context.Context, cln *client.Client, owner string) (string, error) {
+	return resolveOwner(cf.Node, owner, func(p string) ([]byte, error) {
+		return readPath(ctx, cln, cf.Input, p)
+	})
+}
+
+// resolveOwner resolves an owner with the files returned by read, which are
+// only read when a name needs to be resolved. A missing file has no entries.
+func resolveOwner(node ast.Node, owner string, read func(p string) ([]byte, error)) (string, error) {
+	name := owner
+	groupName := ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		name, groupName = owner[:i], owner[i+1:]
+	}
+
+	var uid, gid int
+	if id, err := strconv.Atoi(name); err == nil {
+		uid, gid = id, id
+	} else {
+		dt, err := read(PasswdPath)
+		if err != nil && !errdefs.IsNotExist(err) {
+			return "", err
+		}
+		user, ok := parsePasswd(dt)[name]
+		if !ok {
+			return "", errdefs.WithUnknownOwner(node, "user", name, PasswdPath)
+		}
+		uid, gid = user.uid, user.gid
+	}
+
+	if groupName != "" {
+		id, err := strconv.Atoi(groupName)
+		if err == nil {
+			gid = id
+		} else {
+			dt, err := read(GroupPath)
+			if err != nil && !errdefs.IsNotExist(err) {
+				return "", err
+			}
+			id, ok := parseGroup(dt)[groupName]
+			if !ok {
+				return "", errdefs.WithUnknownOwner(node, "group", groupName, GroupPath)
+			}
+			gid = id
+		}
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
+type passwdEntry struct {
+	uid, gid int
+}
+
+// parsePasswd parses the ids of the users in a passwd file, skipping
+// malformed lines. The first entry of a user wins.
+func parsePasswd(dt []byte) map[string]passwdEntry {
+	users := make(map[string]passwdEntry)
+	for _, fields := range parseDatabase(dt) {
+		if len(fields) < 4 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		if _, ok := users[fields[0]]; !ok {
+			users[fields[0]] = passwdEntry{uid, gid}
+		}
+	}
+	return users
+}
+
+// parseGroup parses the ids of the groups in a group file, skipping malformed
+// lines. The first entry of a group wins.
+func parseGroup(dt []byte) map[string]int {
+	groups := make(map[string]int)
+	for _, fields := range parseDatabase(dt) {
+		if len(fields) < 3 {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		if _, ok := groups[fields[0]]; !ok {
+			groups[fields[0]] = gid
+		}
+	}
+	return groups
+}
+
+// parseDatabase splits the colon separated lines of a passwd or group file,
+// skipping blank lines and comments.
+func parseDatabase(dt []byte) [][]string {
+	var entries [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(dt))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
@@ -0,0 +1,87 @@
+package codegen
+
+import (
+	"os"
+	"testing"
+
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveOwner(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		PasswdPath: "# users\nroot:x:0:0:root:/root:/bin/sh\n\nappuser:x:1000:1001::/home/appuser:/bin/sh\nbroken:x:abc:1\nappuser:x:2000:2000::/:/bin/sh\n",
+		GroupPath:  "root:x:0:\nstaff:x:50:appuser\n",
+	}
+	read := func(p string) ([]byte, error) {
+		dt, ok := files[p]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+		return []byte(dt), nil
+	}
+	node := &ast.Ident{Text: "passwd"}
+
+	for _, tc := range []struct {
+		name     string
+		owner    string
+		expected string
+		err      error
+	}{{
+		"user with primary group",
+		"appuser",
+		"1000:1001",
+		nil,
+	}, {
+		"user and group",
+		"appuser:staff",
+		"1000:50",
+		nil,
+	}, {
+		"numeric user",
+		"1234",
+		"1234:1234",
+		nil,
+	}, {
+		"user and numeric group",
+		"appuser:7",
+		"1000:7",
+		nil,
+	}, {
+		"unknown user",
+		"nobody",
+		"",
+		errdefs.WithUnknownOwner(node, "user", "nobody", PasswdPath),
+	}, {
+		"malformed user",
+		"broken",
+		"",
+		errdefs.WithUnknownOwner(node, "user", "broken", PasswdPath),
+	}, {
+		"unknown group",
+		"root:wheel",
+		"",
+		errdefs.WithUnknownOwner(node, "group", "wheel", GroupPath),
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			owner, err := resolveOwner(node, tc.owner, read)
+			if tc.err != nil {
+				require.EqualError(t, err, tc.err.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, owner)
+		})
+	}
+
+	t.Run("missing files", func(t *testing.T) {
+		_, err := resolveOwner(node, "appuser", func(p string) ([]byte, error) {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		})
+		require.EqualError(t, err, errdefs.WithUnknownOwner(node, "user", "appuser", PasswdPath).Error())
+	})
+}
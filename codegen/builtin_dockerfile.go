@@ -0,0 +1,302 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	dockerfileFrontend = "dockerfile.v0"
+
+	// Keys for the inputs and options of the Dockerfile frontend.
+	dockerfileKeyContext    = "context"
+	dockerfileKeyDockerfile = "dockerfile"
+	dockerfileKeyFilename   = "filename"
+	dockerfileKeyTarget     = "target"
+	dockerfileKeyPlatform   = "platform"
+	dockerfileBuildArgKey   = "build-arg:"
+)
+
+type Dockerfile struct{}
+
+func (d Dockerfile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, filename string) (Value, error) {
+	req, solveOpts, sessionOpts, err := dockerfileRequest(ctx, input, filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var fs Filesystem
+	err = gatewayBuild(ctx, cln, solveOpts, sessionOpts, func(ctx context.Context, c gateway.Client) (res *gateway.Result, err error) {
+		fs, res, err = frontendFilesystem(ctx, c, req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, fs)
+}
+
+type DockerfileStages struct{}
+
+func (ds DockerfileStages) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, filename string) (Value, error) {
+	req, solveOpts, sessionOpts, err := dockerfileRequest(ctx, input, filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var stages *dockerfileStages
+	err = gatewayBuild(ctx, cln, solveOpts, sessionOpts, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		stages, err = solveDockerfileStages(ctx, c, req)
+		return gateway.NewResult(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := NewValue(ctx, stages.last)
+	if err != nil {
+		return nil, err
+	}
+	return &stagesValue{fs, stages}, nil
+}
+
+type DockerfileStage struct{}
+
+func (ds DockerfileStage) Call(ctx context.Context, cln *client.Client, val Value, opts Option, name string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, llbutil.FrontendOpt(dockerfileKeyTarget, name)))
+}
+
+type DockerfileArg struct{}
+
+func (da DockerfileArg) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key, value string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, llbutil.FrontendOpt(dockerfileBuildArgKey+key, value)))
+}
+
+// dockerfileRequest returns a request to the Dockerfile frontend for a
+// Dockerfile in the context filesystem, which is also used as the build
+// context.
+func dockerfileRequest(ctx context.Context, input Filesystem, filename string, opts Option) (req gateway.SolveRequest, solveOpts []solver.SolveOption, sessionOpts []llbutil.SessionOption, err error) {
+	def, err := input.State.Marshal(ctx, llb.Platform(input.Platform))
+	if err != nil {
+		return
+	}
+
+	req = gateway.SolveRequest{
+		Frontend: dockerfileFrontend,
+		FrontendOpt: map[string]string{
+			dockerfileKeyFilename: filename,
+			dockerfileKeyPlatform: platforms.Format(input.Platform),
+		},
+		FrontendInputs: map[string]*pb.Definition{
+			dockerfileKeyContext:    def.ToPB(),
+			dockerfileKeyDockerfile: def.ToPB(),
+		},
+	}
+
+	solveOpts = append(solveOpts, input.SolveOpts...)
+	sessionOpts = append(sessionOpts, input.SessionOpts...)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llbutil.GatewayOption:
+			o(&req)
+		case solver.SolveOption:
+			solveOpts = append(solveOpts, o)
+		case llbutil.SessionOption:
+			sessionOpts = append(sessionOpts, o)
+		}
+	}
+	return
+}
+
+// dockerfileStages are the named stages of a Dockerfile, each solved as a
+// separate target of the Dockerfile frontend.
+type dockerfileStages struct {
+	filename string
+	names    []string
+	stages   map[string]Filesystem
+
+	// last is the filesystem of the default target, which is the last stage.
+	last Filesystem
+}
+
+// solveDockerfileStages reads the Dockerfile from the request's inputs to find
+// its named stages, and solves each of them within the same build so that they
+// share the context transfer.
+func solveDockerfileStages(ctx context.Context, c gateway.Client, req gateway.SolveRequest) (*dockerfileStages, error) {
+	filename := req.FrontendOpt[dockerfileKeyFilename]
+	res, err := c.Solve(ctx, gateway.SolveRequest{
+		Definition: req.FrontendInputs[dockerfileKeyDockerfile],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := res.SingleRef()
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+
+	dt, err := ref.ReadFile(ctx, gateway.ReadRequest{Filename: filename})
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := parseDockerfileStages(dt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", filename)
+	}
+
+	ds := &dockerfileStages{
+		filename: filename,
+		names:    names,
+		stages:   make(map[string]Filesystem),
+	}
+
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(ctx)
+	for _, name := range names {
+		name := name
+		g.Go(func() error {
+			sreq := req
+			sreq.FrontendOpt = make(map[string]string)
+			for k, v := range req.FrontendOpt {
+				sreq.FrontendOpt[k] = v
+			}
+			sreq.FrontendOpt[dockerfileKeyTarget] = name
+
+			fs, _, err := frontendFilesystem(ctx, c, sreq)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			ds.stages[name] = fs
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		fs, _, err := frontendFilesystem(ctx, c, req)
+		ds.last = fs
+		return err
+	})
+
+	return ds, g.Wait()
+}
+
+// parseDockerfileStages returns the names of the named stages in a
+// Dockerfile, in the order they are defined.
+func parseDockerfileStages(dt []byte) ([]string, error) {
+	res, err := parser.Parse(bytes.NewReader(dt))
+	if err != nil {
+		return nil, err
+	}
+
+	stages, _, err := instructions.Parse(res.AST)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, stage := range stages {
+		if stage.Name != "" {
+			names = append(names, stage.Name)
+		}
+	}
+	return names, nil
+}
+
+// stagesValue is the filesystem of the last stage of a Dockerfile, that can
+// also be imported to reference each of its named stages.
+type stagesValue struct {
+	Value
+	stages *dockerfileStages
+}
+
+// dockerfileStagesOf returns the Dockerfile stages of a value, if it is the
+// result of dockerfileStages.
+func dockerfileStagesOf(val Value) (*dockerfileStages, bool) {
+	for {
+		switch v := val.(type) {
+		case *stagesValue:
+			return v.stages, true
+		case *lazyValue:
+			v.wait()
+			val = v.val
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Module returns a module exporting each named stage as a filesystem. The
+// references of the importing module are checked against the stages first,
+// so that unknown stages are reported with the stages that were found.
+func (ds *dockerfileStages) Module(ctx context.Context, mod *ast.Module, id *ast.ImportDecl) (*ast.Module, error) {
+	var err error
+	ast.Match(mod, ast.MatchOpts{},
+		func(ie *ast.IdentExpr) {
+			if err != nil || ie.Reference == nil || ie.Ident.Text != id.Name.Text {
+				return
+			}
+			name := ie.Reference.Ident.Text
+			if _, ok := ds.stages[name]; !ok {
+				err = errdefs.WithUnknownDockerfileStage(ie.Reference.Ident, id.Name, name, ds.names)
+			}
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	imod := &ast.Module{URI: "dockerfile://" + ds.filename}
+	imod.Scope = ast.NewScope(nil, ast.ModuleScope, imod)
+	for _, name := range ds.names {
+		ret := NewRegister(ctx)
+		err = ret.Set(ds.stages[name])
+		if err != nil {
+			return nil, err
+		}
+
+		ident := ast.NewIdent(name)
+		imod.Scope.Insert(&ast.Object{
+			Kind:     ast.Filesystem,
+			Ident:    ident,
+			Node:     &ast.Field{Type: ast.NewType(ast.Filesystem), Name: ident},
+			Data:     ret,
+			Exported: true,
+		})
+	}
+	return imod, nil
+}
@@ -0,0 +1,224 @@
+package codegen
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lithammer/dedent"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+	fstypes "github.com/tonistiigi/fsutil/types"
+	"github.com/xlab/treeprint"
+)
+
+// dockerfileRef is a solved reference with a state and files that can be
+// read.
+type dockerfileRef struct {
+	state llb.State
+	files map[string][]byte
+}
+
+func (r *dockerfileRef) ToState() (llb.State, error) {
+	return r.state, nil
+}
+
+func (r *dockerfileRef) ReadFile(ctx context.Context, req gateway.ReadRequest) ([]byte, error) {
+	return r.files[req.Filename], nil
+}
+
+func (r *dockerfileRef) StatFile(ctx context.Context, req gateway.StatRequest) (*fstypes.Stat, error) {
+	return nil, nil
+}
+
+func (r *dockerfileRef) ReadDir(ctx context.Context, req gateway.ReadDirRequest) ([]*fstypes.Stat, error) {
+	return nil, nil
+}
+
+// fakeDockerfileGateway is a gateway with a context containing a Dockerfile,
+// which builds each target of the Dockerfile frontend as an image named after
+// the target.
+type fakeDockerfileGateway struct {
+	gateway.Client
+	files map[string][]byte
+
+	mu   sync.Mutex
+	reqs []gateway.SolveRequest
+}
+
+func (g *fakeDockerfileGateway) Solve(ctx context.Context, req gateway.SolveRequest) (*gateway.Result, error) {
+	res := gateway.NewResult()
+	if req.Frontend == "" {
+		res.SetRef(&dockerfileRef{files: g.files})
+		return res, nil
+	}
+
+	g.mu.Lock()
+	g.reqs = append(g.reqs, req)
+	g.mu.Unlock()
+
+	target := req.FrontendOpt[dockerfileKeyTarget]
+	if target == "" {
+		target = "default"
+	}
+	res.SetRef(&dockerfileRef{state: llb.Image(target)})
+	return res, nil
+}
+
+const threeStageDockerfile = `
+FROM alpine AS runtime-deps
+RUN apk add --no-cache ca-certificates
+
+FROM golang:alpine AS builder
+ARG VERSION
+RUN go build -ldflags "-X main.version=${VERSION}" -o /out/app .
+
+FROM runtime-deps
+COPY --from=builder /out/app /usr/bin/app
+`
+
+func TestSolveDockerfileStages(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	fs, err := ZeroValue(ctx).Filesystem()
+	require.NoError(t, err)
+
+	req, _, _, err := dockerfileRequest(ctx, fs, "build/Dockerfile", Option{
+		llbutil.FrontendOpt(dockerfileBuildArgKey+"VERSION", "v1.2.3"),
+	})
+	require.NoError(t, err)
+
+	g := &fakeDockerfileGateway{files: map[string][]byte{
+		"build/Dockerfile": []byte(threeStageDockerfile),
+	}}
+	ds, err := solveDockerfileStages(ctx, g, req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"runtime-deps", "builder"}, ds.names)
+	require.Len(t, ds.stages, 2)
+
+	// Each stage and the last stage are separate targets with the same build
+	// args.
+	targets := make(map[string]bool)
+	for _, req := range g.reqs {
+		require.Equal(t, dockerfileFrontend, req.Frontend)
+		require.Equal(t, "build/Dockerfile", req.FrontendOpt[dockerfileKeyFilename])
+		require.Equal(t, "v1.2.3", req.FrontendOpt[dockerfileBuildArgKey+"VERSION"])
+		targets[req.FrontendOpt[dockerfileKeyTarget]] = true
+	}
+	require.Equal(t, map[string]bool{"runtime-deps": true, "builder": true, "": true}, targets)
+}
+
+func TestDockerfileStagesImport(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name  string
+		input string
+		fn    func(mod *ast.Module) error
+	}
+
+	for _, tc := range []testCase{{
+		"copy from middle stage",
+		`
+		import stages from dockerfileStages(fs { scratch; }, "Dockerfile")
+
+		fs default() {
+			stages."runtime-deps"
+			copy stages.builder "/out/app" "/usr/bin/app"
+		}
+		`,
+		nil,
+	}, {
+		"unknown stage",
+		`
+		import stages from dockerfileStages(fs { scratch; }, "Dockerfile")
+
+		fs default() {
+			stages.runtime
+		}
+		`,
+		func(mod *ast.Module) error {
+			return errdefs.WithUnknownDockerfileStage(
+				ast.Search(mod, "runtime"),
+				ast.Search(mod, "stages"),
+				"runtime",
+				[]string{"runtime-deps", "builder"},
+			)
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx = WithSessionID(ctx, identity.NewID())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err)
+
+			err = checker.Check(mod)
+			require.NoError(t, err)
+
+			fs, err := ZeroValue(ctx).Filesystem()
+			require.NoError(t, err)
+
+			req, _, _, err := dockerfileRequest(ctx, fs, "Dockerfile", nil)
+			require.NoError(t, err)
+
+			g := &fakeDockerfileGateway{files: map[string][]byte{
+				"Dockerfile": []byte(threeStageDockerfile),
+			}}
+			ds, err := solveDockerfileStages(ctx, g, req)
+			require.NoError(t, err)
+
+			obj := mod.Scope.Lookup("stages")
+			require.NotNil(t, obj)
+
+			id := obj.Node.(*ast.ImportDecl)
+			imod, err := ds.Module(ctx, mod, id)
+			if tc.fn != nil {
+				expected := tc.fn(mod)
+				require.Error(t, err)
+				require.Equal(t, expected.Error(), err.Error())
+				return
+			}
+			require.NoError(t, err)
+			obj.Data = imod
+
+			err = checker.CheckReferences(mod, "stages")
+			require.NoError(t, err)
+
+			request, err := New(nil, nil).Generate(ctx, mod, []Target{{Name: "default"}})
+			require.NoError(t, err)
+
+			def, err := llb.Image("runtime-deps").File(
+				llb.Copy(llb.Image("builder"), "/out/app", "/usr/bin/app"),
+			).Marshal(ctx, llb.LinuxAmd64)
+			require.NoError(t, err)
+
+			expected := treeprint.New()
+			err = solver.Single(&solver.Params{Def: def}).Tree(expected)
+			require.NoError(t, err)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err)
+			require.Equal(t, expected.String(), actual.String())
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package codegen
+
+import (
+	"context"
+	"net/url"
+	"path"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultFetchFilename is the name of a fetched archive whose URL has no path.
+const DefaultFetchFilename = "archive"
+
+type FetchArchive struct{}
+
+func (fa FetchArchive) Call(ctx context.Context, cln *client.Client, val Value, opts Option, rawurl string, dgst digest.Digest, dest string) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var copyOpts []llb.CopyOption
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llb.CopyOption:
+			copyOpts = append(copyOpts, o)
+		}
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, Arg(ctx, 0).WithError(err)
+	}
+	filename := path.Base(u.Path)
+	if filename == "." || filename == "/" {
+		filename = DefaultFetchFilename
+	}
+
+	// The checksum is verified by the http source, so a mismatch fails the
+	// source and the copy that unpacks it never runs.
+	httpOpts := []llb.HTTPOption{llb.Checksum(dgst), llb.Filename(filename)}
+	for _, opt := range SourceMap(ctx) {
+		httpOpts = append(httpOpts, opt)
+	}
+	archive := llb.HTTP(rawurl, httpOpts...)
+
+	copyOpts = append([]llb.CopyOption{&llb.CopyInfo{
+		AttemptUnpack:  true,
+		CreateDestPath: true,
+	}}, copyOpts...)
+	fs.State = fs.State.File(
+		llb.Copy(archive, filename, dest, copyOpts...),
+		SourceMap(ctx)...,
+	)
+	commitHistory(fs.Image, false, "FETCH %s %s", rawurl, dest)
+
+	return NewValue(ctx, fs)
+}
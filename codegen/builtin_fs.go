@@ -1,6 +1,7 @@
 package codegen
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -9,10 +10,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/buildx/util/imagetools"
 	"github.com/docker/buildx/util/progress"
@@ -25,10 +28,15 @@ import (
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/session/filesync"
 	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/local"
 	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/gitindex"
+	"github.com/openllb/hlb/pkg/ignorefile"
+	"github.com/openllb/hlb/pkg/imageutil"
 	"github.com/openllb/hlb/pkg/llbutil"
 	"github.com/openllb/hlb/pkg/stargzutil"
 	"github.com/openllb/hlb/solver"
@@ -41,8 +49,21 @@ const (
 	// HistoryComment is an indicator in the image history that the history layer
 	// was produced by the HLB compiler.
 	HistoryComment = "hlb.v0"
+
+	// HelperImage is the image of the helpers that builtins run to change
+	// files in ways that file operations can't, like substituting placeholders
+	// or stripping binaries. It is pinned by digest so that every build runs
+	// the same helpers.
+	HelperImage = "docker.io/library/alpine:3.16@sha256:452e7292acee0ee16c332324d7de05fa2c99f9994ecc9f0779c602916a672ae4"
 )
 
+// helperImage returns the image of the helpers that only change the files
+// mounted into them. They don't depend on the platform of the files, so they
+// run on the build platform instead of being emulated.
+func helperImage(ctx context.Context) llb.State {
+	return llb.Image(HelperImage, llb.Platform(BuildPlatform(ctx)))
+}
+
 func commitHistory(img *solver.ImageSpec, empty bool, format string, a ...interface{}) {
 	img.History = append(img.History, specs.History{
 		// Set a zero value on Created for more reproducible builds
@@ -54,6 +75,36 @@ func commitHistory(img *solver.ImageSpec, empty bool, format string, a ...interf
 	img.Created = &time.Time{}
 }
 
+type SelectPlatform struct{}
+
+func (sp SelectPlatform) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	target := platforms.Normalize(DefaultPlatform(ctx))
+	match := platforms.NewMatcher(target)
+
+	var mapped []string
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *SelectPlatformWhen:
+			if !match.Match(o.Platform) {
+				mapped = append(mapped, platforms.Format(o.Platform))
+				continue
+			}
+
+			// Only the selected filesystem is evaluated.
+			v, err := o.Input(ctx, nil)
+			if err != nil {
+				return nil, err
+			}
+			fs, err := v.Filesystem()
+			if err != nil {
+				return nil, err
+			}
+			return NewValue(ctx, fs)
+		}
+	}
+	return nil, errdefs.WithUnmappedPlatform(ProgramCounter(ctx), platforms.Format(target), mapped)
+}
+
 type Scratch struct{}
 
 func (s Scratch) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
@@ -88,6 +139,7 @@ func (i Image) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 	var (
 		st         = llb.Image(ref, imageOpts...)
 		image      = &solver.ImageSpec{}
+		base       = &solver.ImageSpec{}
 		resolver   = ImageResolver(ctx)
 		resolveOpt = llb.ResolveImageConfigOpt{
 			Platform: &platform,
@@ -98,9 +150,9 @@ func (i Image) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		}
 	)
 	if resolver != nil {
-		dgst, config, err := resolver.ResolveImageConfig(ctx, ref, resolveOpt)
+		dgst, config, err := getSourceDedup(ctx).resolveImageConfig(ctx, resolver, ref, resolveOpt)
 		if err != nil {
-			return nil, Arg(ctx, 0).WithError(err)
+			return nil, Arg(ctx, 0).WithError(errdefs.WithSourceFetchError(err))
 		}
 
 		image.Canonical, err = reference.WithDigest(named, dgst)
@@ -117,47 +169,221 @@ func (i Image) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		if err != nil {
 			return nil, Arg(ctx, 0).WithError(err)
 		}
+
+		// The base config is unmarshalled separately so that it never shares
+		// maps and slices with the config that is changed.
+		err = json.Unmarshal(config, base)
+		if err != nil {
+			return nil, Arg(ctx, 0).WithError(err)
+		}
+		base.Canonical = image.Canonical
 	}
 
 	return NewValue(ctx, Filesystem{
 		State:    st,
 		Image:    image,
+		Base:     base,
 		Platform: platform,
+		baseArg:  Arg(ctx, 0),
 	})
 }
 
 type HTTP struct{}
 
 func (h HTTP) Call(ctx context.Context, cln *client.Client, val Value, opts Option, url string) (Value, error) {
-	var httpOpts []llb.HTTPOption
+	var (
+		httpOpts []llb.HTTPOption
+		urls     = []string{url}
+	)
 	for _, opt := range opts {
 		switch o := opt.(type) {
 		case llb.HTTPOption:
 			httpOpts = append(httpOpts, o)
+		case *Fallback:
+			urls = append(urls, o.URLs...)
 		}
 	}
 	for _, opt := range SourceMap(ctx) {
 		httpOpts = append(httpOpts, opt)
 	}
 
-	return NewValue(ctx, llb.HTTP(url, httpOpts...))
+	st, err := fallbackSource(ctx, cln, urls, func(url string) llb.State {
+		return llb.HTTP(url, httpOpts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st, err = getSourceDedup(ctx).httpSource(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, st)
 }
 
 type Git struct{}
 
 func (g Git) Call(ctx context.Context, cln *client.Client, val Value, opts Option, remote, ref string) (Value, error) {
-	var gitOpts []llb.GitOption
+	var (
+		gitOpts []llb.GitOption
+		remotes = []string{remote}
+	)
 	for _, opt := range opts {
 		switch o := opt.(type) {
 		case llb.GitOption:
 			gitOpts = append(gitOpts, o)
+		case *Fallback:
+			remotes = append(remotes, o.URLs...)
+		case llbutil.GitCommitOption:
+			// The ref is advisory when a commit is given, the source is keyed by
+			// the commit so that it is stable even if the ref moves.
+			ref = o.SHA
 		}
 	}
 	for _, opt := range SourceMap(ctx) {
 		gitOpts = append(gitOpts, opt)
 	}
 
-	return NewValue(ctx, llb.Git(remote, ref, gitOpts...))
+	st, err := fallbackSource(ctx, cln, remotes, func(remote string) llb.State {
+		return llb.Git(remote, ref, gitOpts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st, err = getSourceDedup(ctx).gitSource(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, st)
+}
+
+// localSourceDir returns the absolute path of the local directory that st is
+// sourced from, or an empty string if st is not a local source. Local sources
+// of a single file return the directory of the file.
+func localSourceDir(ctx context.Context, st llb.State) (string, error) {
+	src, err := llbutil.SourceOp(ctx, st)
+	if err != nil || src == nil || !strings.HasPrefix(src.Identifier, "local://") {
+		return "", err
+	}
+
+	dir := strings.TrimPrefix(src.Identifier, "local://")
+	if !filepath.IsAbs(dir) {
+		cwd, err := local.Cwd(ctx)
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cwd, dir)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	return dir, nil
+}
+
+// readIgnoreFile returns the patterns of an ignore file for the local
+// directory localPath. The ignore file is read from the module's directory
+// rather than the synced files, so it is read even if it excludes itself.
+func readIgnoreFile(dir ast.Directory, localPath string, ignoreFile *LocalIgnoreFile) ([]string, error) {
+	var (
+		filename = ignoreFile.Path
+		rc       io.ReadCloser
+		err      error
+	)
+	if filename != "" {
+		rc, err = dir.Open(filename)
+		if err != nil {
+			if errdefs.IsNotExist(err) {
+				return nil, errdefs.WithIgnoreFileNotExist(err, ignoreFile.Node, filename)
+			}
+			return nil, ignoreFile.Node.WithError(err)
+		}
+	} else {
+		// The default ignore files are optional, so nothing is excluded when
+		// none of them exist.
+		for _, name := range ignorefile.DefaultNames {
+			filename = filepath.Join(localPath, name)
+			f, err := dir.Open(filename)
+			if err == nil {
+				rc = f
+				break
+			}
+			if !errdefs.IsNotExist(err) {
+				return nil, ignoreFile.Node.WithError(err)
+			}
+		}
+		if rc == nil {
+			return nil, nil
+		}
+	}
+	defer rc.Close()
+
+	patterns, err := ignorefile.Parse(rc)
+	if err != nil {
+		var ipe *ignorefile.InvalidPatternError
+		if errors.As(err, &ipe) {
+			return nil, errdefs.WithInvalidPattern(ignoreFile.Node, ipe.Pattern, ipe.Err)
+		}
+		return nil, ignoreFile.Node.WithError(err)
+	}
+	return patterns, nil
+}
+
+// readManifest reads a manifest from the module's directory.
+func readManifest(dir ast.Directory, manifest *LocalManifest) ([]ManifestEntry, error) {
+	rc, err := dir.Open(manifest.Path)
+	if err != nil {
+		if errdefs.IsNotExist(err) {
+			return nil, errdefs.WithManifestNotExist(err, manifest.Node, manifest.Path)
+		}
+		return nil, manifest.Node.WithError(err)
+	}
+	defer rc.Close()
+
+	entries, err := ReadLocalManifest(rc)
+	if err != nil {
+		return nil, errdefs.WithInvalidManifest(err, manifest.Node, manifest.Path)
+	}
+	return entries, nil
+}
+
+// verifyManifest verifies the files of a local source against the entries of
+// a manifest once they are synced up, so that the files that are verified are
+// the files that are built and are never transferred twice.
+func verifyManifest(ctx context.Context, v Value, manifest *LocalManifest, entries []ManifestEntry, allowExtra bool) (Value, error) {
+	fs, err := v.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	input := llb.Scratch().File(
+		llb.Mkfile("/manifest", 0o644, verifyManifestInput(entries)),
+	)
+	opts := []llb.RunOption{
+		llb.Args([]string{
+			"/bin/sh", "-c", VerifyManifestScript, "verify",
+			VerifyManifestMountpoint,
+			path.Join(VerifyManifestInputMountpoint, "manifest"),
+			strconv.FormatBool(allowExtra),
+			strconv.Itoa(maxManifestDiscrepancies),
+			manifest.Path,
+		}),
+		llb.AddMount(VerifyManifestMountpoint, fs.State),
+		llb.AddMount(VerifyManifestInputMountpoint, input, llb.Readonly),
+		llb.WithCustomNamef("verify local files against manifest %s", manifest.Path),
+	}
+	for _, opt := range SourceMap(ctx) {
+		opts = append(opts, opt)
+	}
+
+	es := helperImage(ctx).Run(opts...)
+	fs.State = es.GetMount(VerifyManifestMountpoint)
+	return NewValue(ctx, fs)
 }
 
 type Local struct{}
@@ -168,17 +394,57 @@ func (l Local) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		return nil, err
 	}
 
+	// Modules imported from a filesystem read their own files, and only
+	// modules in local directories read the host.
 	dir := Module(ctx).Directory
+	absPath := localPath
+	if dir.Definition() == nil {
+		if !filepath.IsAbs(absPath) {
+			cwd, err := local.Cwd(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			absPath = filepath.Join(cwd, localPath)
+		}
+
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "local", Path: absPath})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localPath, err)
+		}
+	}
+
 	fi, err := dir.Stat(localPath)
 	if err != nil {
 		return nil, Arg(ctx, 0).WithError(err)
 	}
 
-	var localOpts []llb.LocalOption
+	var (
+		localOpts       []llb.LocalOption
+		includePatterns []string
+		excludePatterns []string
+		ignoreFiles     []*LocalIgnoreFile
+		manifest        *LocalManifest
+		allowExtra      bool
+		threshold       int64
+	)
 	for _, opt := range opts {
 		switch o := opt.(type) {
+		case llbutil.IncludePatterns:
+			includePatterns = append(includePatterns, o...)
+			localOpts = append(localOpts, o)
+		case llbutil.ExcludePatterns:
+			excludePatterns = append(excludePatterns, o...)
 		case llb.LocalOption:
 			localOpts = append(localOpts, o)
+		case *LocalIgnoreFile:
+			ignoreFiles = append(ignoreFiles, o)
+		case *LocalManifest:
+			manifest = o
+		case AllowExtraFiles:
+			allowExtra = true
+		case *LargeFileThreshold:
+			threshold = o.Bytes
 		}
 	}
 	for _, opt := range SourceMap(ctx) {
@@ -186,9 +452,34 @@ func (l Local) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 	}
 
 	localDir := localPath
-	if !fi.IsDir() {
+	if fi.IsDir() {
+		// Patterns from the module's .hlbignore and ignore files come first
+		// so that explicit exclude patterns cannot be re-included by their
+		// negations.
+		var patterns []string
+		if rel, ok := moduleRelative(ctx, localPath); ok {
+			modulePatterns, err := moduleIgnore(ctx, dir)
+			if err != nil {
+				return nil, err
+			}
+			patterns = ignorefile.Rebase(modulePatterns, rel)
+		}
+		for _, ignoreFile := range ignoreFiles {
+			ignorePatterns, err := readIgnoreFile(dir, localPath, ignoreFile)
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, ignorePatterns...)
+		}
+		excludePatterns = append(patterns, excludePatterns...)
+		if len(excludePatterns) > 0 {
+			localOpts = append(localOpts, llbutil.WithExcludePatterns(excludePatterns))
+		}
+	} else {
 		filename := filepath.Base(localPath)
 		localDir = filepath.Dir(localPath)
+		includePatterns = []string{filename}
+		excludePatterns = nil
 
 		// When localPath is a filename instead of a directory, include and exclude
 		// patterns should be ignored.
@@ -198,6 +489,22 @@ func (l Local) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		)
 	}
 
+	var entries []ManifestEntry
+	if manifest != nil {
+		if dir.Definition() != nil {
+			return nil, errdefs.WithUnsupportedVerifyManifest(manifest.Node)
+		}
+
+		entries, err = readManifest(dir, manifest)
+		if err != nil {
+			return nil, err
+		}
+		entries, err = syncedEntries(entries, includePatterns, excludePatterns)
+		if err != nil {
+			return nil, manifest.Node.WithError(err)
+		}
+	}
+
 	if dir.Definition() != nil {
 		copyOpts := []llb.CopyOption{
 			llbutil.WithCopyDirContentsOnly(true),
@@ -224,20 +531,44 @@ func (l Local) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		return NewValue(ctx, fs)
 	}
 
-	absPath := localPath
-	if !filepath.IsAbs(absPath) {
-		cwd, err := local.Cwd(ctx)
-		if err != nil {
-			return nil, err
+	var large *largeFileOpts
+	if threshold > 0 {
+		large = &largeFileOpts{
+			threshold:       threshold,
+			includePatterns: includePatterns,
+			excludePatterns: excludePatterns,
 		}
-
-		absPath = filepath.Join(cwd, localPath)
 	}
+	v, err := localSource(ctx, localPath, absPath, localDir, localOpts, large)
+	if err != nil || manifest == nil {
+		return v, err
+	}
+	return verifyManifest(ctx, v, manifest, entries, allowExtra)
+}
+
+// largeFileOpts are the options of a local source that skips transferring
+// unchanged large files, with the patterns of the files it syncs up.
+type largeFileOpts struct {
+	threshold       int64
+	includePatterns []string
+	excludePatterns []string
+}
 
+// localSource returns a filesystem synced up from dir on the host, named by
+// name and identified by the absolute path it was resolved from. With large
+// file options, files at least as large as their threshold are only
+// transferred when their content has changed.
+func localSource(ctx context.Context, name, absPath, dir string, localOpts []llb.LocalOption, large *largeFileOpts) (Value, error) {
 	id, err := llbutil.LocalID(ctx, absPath, localOpts...)
 	if err != nil {
 		return nil, err
 	}
+	if large != nil {
+		// Large files are synced up with the modification times they were
+		// first synced up with, so BuildKit keeps a copy separate from the
+		// plain local source.
+		id = digest.FromString(fmt.Sprintf("%s,largeFileThreshold:%d", id, large.threshold)).String()
+	}
 	localOpts = append(localOpts, llb.SharedKeyHint(id))
 
 	sessionID := SessionID(ctx)
@@ -245,21 +576,240 @@ func (l Local) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		localOpts = append(localOpts, llb.SessionID(sessionID))
 	}
 
+	// Targets that sync up the same local source share its registration in
+	// the session, but each has its own state for its source map.
+	reg, err := getSourceDedup(ctx).registerLocal(id, name, dir, func() (*localRegistration, error) {
+		return registerLocal(ctx, id, name, dir, large)
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	fs := Filesystem{
-		State:    llb.Local(localPath, localOpts...),
-		Platform: DefaultPlatform(ctx),
+		State:       llb.Local(name, localOpts...),
+		Platform:    DefaultPlatform(ctx),
+		SessionOpts: reg.sessionOpts[:len(reg.sessionOpts):len(reg.sessionOpts)],
+		SolveOpts:   reg.solveOpts[:len(reg.solveOpts):len(reg.solveOpts)],
 	}
-	fs.SessionOpts = append(fs.SessionOpts, llbutil.WithSyncedDir(id, filesync.SyncedDir{
-		Name: localPath,
-		Dir:  localDir,
-		Map: func(_ string, st *fstypes.Stat) bool {
+	if len(reg.largeFiles) > 0 {
+		fs.State = restoreLargeFiles(ctx, name, fs, reg.largeFiles)
+	}
+	return NewValue(ctx, fs)
+}
+
+// registerLocal returns the registration of the synced directory of a local
+// source in the session. The large files of a local source with large file
+// options are hashed once for every target that syncs it up.
+func registerLocal(ctx context.Context, id, name, dir string, large *largeFileOpts) (*localRegistration, error) {
+	reg := &localRegistration{}
+	mapStat := func(_ string, st *fstypes.Stat) bool {
+		st.Uid = 0
+		st.Gid = 0
+		return true
+	}
+	if large != nil {
+		// The large files are hashed from the synced directory, which is
+		// relative to the working directory.
+		hostDir := dir
+		if !filepath.IsAbs(hostDir) {
+			cwd, err := local.Cwd(ctx)
+			if err != nil {
+				return nil, err
+			}
+			hostDir = filepath.Join(cwd, dir)
+		}
+
+		var err error
+
+		lf := solver.NewLargeFiles(TransferCache(ctx), name, id, hostDir, large.threshold)
+		reg.largeFiles, err = lf.Scan(ctx, large.includePatterns, large.excludePatterns)
+		if err != nil {
+			return nil, err
+		}
+		mapStat = func(path string, st *fstypes.Stat) bool {
 			st.Uid = 0
 			st.Gid = 0
-			return true
-		},
+			return lf.Map(path, st)
+		}
+		reg.solveOpts = append(reg.solveOpts, solver.WithLargeFiles(lf))
+	}
+	reg.sessionOpts = append(reg.sessionOpts, llbutil.WithSyncedDir(id, filesync.SyncedDir{
+		Name: name,
+		Dir:  dir,
+		Map:  mapStat,
 	}))
+	return reg, nil
+}
 
-	return NewValue(ctx, fs)
+const (
+	// LargeFilesMountpoint is where the files of a local source are mounted
+	// to check the digests of its large files.
+	LargeFilesMountpoint = "/run/hlb/large-files"
+
+	// LargeFilesInputMountpoint is where the digests of the large files are
+	// mounted.
+	LargeFilesInputMountpoint = "/run/hlb/large-files-digests"
+)
+
+// LargeFilesScript checks the large files of a local source in the directory
+// of its first argument against the sha256sums file of its second argument,
+// and fails with the files that do not match.
+const LargeFilesScript = `set -e
+cd "$1"
+if ! out="$(sha256sum -c "$2" 2>&1)"; then
+	echo "large files changed while they were synced:"
+	printf '%s\n' "$out" | grep -v ': OK$' || true
+	exit 1
+fi
+`
+
+// restoreLargeFiles checks the digests of the large files BuildKit has after
+// a local source is synced up, so that a file that changed after it was
+// hashed or a stale copy is never built, and restores the modification times
+// they have on the host.
+func restoreLargeFiles(ctx context.Context, name string, fs Filesystem, files []solver.LargeFile) llb.State {
+	var sums strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&sums, "%s  %s\n", file.Digest.Encoded(), file.Path)
+	}
+	input := llb.Scratch().File(
+		llb.Mkfile("/sha256sums", 0o644, []byte(sums.String())),
+	)
+
+	opts := []llb.RunOption{
+		llb.Args([]string{
+			"/bin/sh", "-c", LargeFilesScript, "verify",
+			LargeFilesMountpoint,
+			path.Join(LargeFilesInputMountpoint, "sha256sums"),
+		}),
+		llb.AddMount(LargeFilesMountpoint, fs.State),
+		llb.AddMount(LargeFilesInputMountpoint, input, llb.Readonly),
+		llb.WithCustomNamef("verify %d large files of %s", len(files), name),
+	}
+	for _, opt := range SourceMap(ctx) {
+		opts = append(opts, opt)
+	}
+	verified := helperImage(ctx).Run(opts...).GetMount(LargeFilesMountpoint)
+
+	// Files skipped by the sync have the modification times they were first
+	// synced up with, so every large file is copied over itself with its
+	// modification time on the host.
+	var fa *llb.FileAction
+	for _, file := range files {
+		p := path.Join("/", file.Path)
+		copyOpt := llbutil.WithCreatedTime(time.Unix(0, file.ModTime))
+		if fa == nil {
+			fa = llb.Copy(verified, p, p, copyOpt)
+		} else {
+			fa = fa.Copy(verified, p, p, copyOpt)
+		}
+	}
+	return verified.File(fa, SourceMap(ctx)...)
+}
+
+type LocalGit struct{}
+
+func (lg LocalGit) Call(ctx context.Context, cln *client.Client, val Value, opts Option, localPath string) (Value, error) {
+	localPath, err := parser.ResolvePath(ModuleDir(ctx), localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index and worktree are only read from the host, so modules imported
+	// from a filesystem cannot sync their own repository.
+	if Module(ctx).Directory.Definition() != nil {
+		return nil, errdefs.WithLocalGitImported(ProgramCounter(ctx))
+	}
+
+	absPath := localPath
+	if !filepath.IsAbs(absPath) {
+		cwd, err := local.Cwd(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		absPath = filepath.Join(cwd, localPath)
+	}
+
+	root, err := gitindex.FindRoot(absPath)
+	if err != nil {
+		if errors.Is(err, gitindex.ErrNotRepository) {
+			return nil, errdefs.WithNotRepository(Arg(ctx, 0), localPath)
+		}
+		return nil, Arg(ctx, 0).WithError(err)
+	}
+
+	var (
+		localOpts    []llb.LocalOption
+		gitOpts      gitindex.Options
+		subdir       *LocalGitSubdir
+		repoRelative bool
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case UntrackedFiles:
+			gitOpts.Untracked = true
+		case SubmoduleFiles:
+			gitOpts.Submodules = true
+		case *LocalGitSubdir:
+			subdir = o
+		case RepoRelativePaths:
+			repoRelative = true
+		}
+	}
+	for _, opt := range SourceMap(ctx) {
+		localOpts = append(localOpts, opt)
+	}
+
+	var dir string
+	if subdir != nil {
+		dir = path.Clean(filepath.ToSlash(subdir.Path))
+		if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+			return nil, errdefs.WithInvalidSubdir(subdir.Node, subdir.Path, "must be relative to the root of the repository")
+		}
+		if dir == "." {
+			dir = ""
+		}
+		fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil || !fi.IsDir() {
+			return nil, errdefs.WithInvalidSubdir(subdir.Node, subdir.Path, "is not a directory in the repository")
+		}
+	}
+
+	// The files are synced from the subdir unless their paths are kept
+	// relative to the root, in which case the root is synced with only the
+	// subdir included.
+	syncDir := filepath.Join(root, filepath.FromSlash(dir))
+	if repoRelative {
+		syncDir = root
+	}
+	err = CheckHostAccess(ctx, HostAccess{Builtin: "localGit", Path: syncDir})
+	if err != nil {
+		return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localPath, err)
+	}
+
+	excludePatterns, err := gitindex.ExcludePatterns(root, dir, gitOpts)
+	if err != nil {
+		return nil, Arg(ctx, 0).WithError(err)
+	}
+	if repoRelative && dir != "" {
+		prefix := gitindex.EscapePattern(dir)
+		for i, pattern := range excludePatterns {
+			excludePatterns[i] = prefix + "/" + pattern
+		}
+		localOpts = append(localOpts, llbutil.IncludePatterns([]string{prefix}))
+	}
+	if len(excludePatterns) > 0 {
+		localOpts = append(localOpts, llbutil.WithExcludePatterns(excludePatterns))
+	}
+
+	// The synced directory is named relative to the path it was found from,
+	// like the directories of local.
+	rel, err := filepath.Rel(absPath, syncDir)
+	if err != nil {
+		return nil, err
+	}
+	return localSource(ctx, filepath.Join(localPath, rel), syncDir, syncDir, localOpts, nil)
 }
 
 type Frontend struct{}
@@ -269,43 +819,145 @@ func (f Frontend) Call(ctx context.Context, cln *client.Client, val Value, opts
 	if err != nil {
 		return nil, errdefs.WithInvalidImageRef(err, Arg(ctx, 0), source)
 	}
-	source = reference.TagNameOnly(named).String()
 
 	req := gateway.SolveRequest{
-		Frontend: "gateway.v0",
-		FrontendOpt: map[string]string{
-			"source": source,
-		},
+		Frontend:       "gateway.v0",
+		FrontendOpt:    make(map[string]string),
 		FrontendInputs: make(map[string]*pb.Definition),
 	}
 
-	var (
-		solveOpts   []solver.SolveOption
-		sessionOpts []llbutil.SessionOption
-	)
+	solveOpts, sessionOpts := frontendOptions(&req, opts)
+	var expected *PinnedDigest
+	for _, opt := range opts {
+		if o, ok := opt.(*PinnedDigest); ok {
+			expected = o
+		}
+	}
+
+	// The frontend is run by the digest it was verified against, so the tag
+	// cannot be moved between verifying and running it.
+	req.FrontendOpt["source"], err = pinFrontend(ctx, named, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	var fs Filesystem
+	err = gatewayBuild(ctx, cln, solveOpts, sessionOpts, func(ctx context.Context, c gateway.Client) (res *gateway.Result, err error) {
+		fs, res, err = frontendFilesystem(ctx, c, req)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, fs)
+}
+
+// frontendOptions applies the options of a frontend to its request, and
+// returns the solve and session options of its inputs.
+func frontendOptions(req *gateway.SolveRequest, opts Option) (solveOpts []solver.SolveOption, sessionOpts []llbutil.SessionOption) {
 	for _, opt := range opts {
 		switch o := opt.(type) {
 		case llbutil.GatewayOption:
-			o(&req)
+			o(req)
 		case solver.SolveOption:
 			solveOpts = append(solveOpts, o)
 		case llbutil.SessionOption:
 			sessionOpts = append(sessionOpts, o)
 		}
 	}
+	return
+}
 
-	s, err := llbutil.NewSession(ctx, sessionOpts...)
+// devFrontendInput is the key of the input with the filesystem of a frontend
+// run by devFrontend.
+const devFrontendInput = "hlb-frontend"
+
+type DevFrontend struct{}
+
+func (df DevFrontend) Call(ctx context.Context, cln *client.Client, val Value, opts Option, source Filesystem) (Value, error) {
+	req := gateway.SolveRequest{
+		Frontend:       "gateway.v0",
+		FrontendOpt:    make(map[string]string),
+		FrontendInputs: make(map[string]*pb.Definition),
+	}
+	solveOpts, sessionOpts := frontendOptions(&req, opts)
+	for _, key := range []string{"dockerfile", devFrontendInput} {
+		if _, ok := req.FrontendInputs[key]; ok {
+			return nil, ProgramCounter(ctx).WithError(fmt.Errorf("input %q is reserved by devFrontend", key))
+		}
+	}
+
+	err := withDevFrontend(ctx, &req, source)
 	if err != nil {
 		return nil, err
 	}
+	solveOpts = append(solveOpts, source.SolveOpts...)
+	sessionOpts = append(sessionOpts, source.SessionOpts...)
 
-	g, ctx := errgroup.WithContext(ctx)
-
-	fs, err := ZeroValue(ctx).Filesystem()
+	var fs Filesystem
+	err = gatewayBuild(ctx, cln, solveOpts, sessionOpts, func(ctx context.Context, c gateway.Client) (res *gateway.Result, err error) {
+		fs, res, err = frontendFilesystem(ctx, c, req)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return NewValue(ctx, fs)
+}
+
+// withDevFrontend sets a frontend request to run the frontend of a filesystem
+// instead of an image. BuildKit only runs frontends from images, or from the
+// result of another frontend in development mode, so the filesystem is passed
+// to the Dockerfile frontend as a named context with its image config, and
+// built by a Dockerfile with just a FROM of it. The frontend is loaded from
+// the build's inputs, so its image is never pushed.
+func withDevFrontend(ctx context.Context, req *gateway.SolveRequest, source Filesystem) error {
+	def, err := source.State.Marshal(ctx, llb.Platform(source.Platform))
+	if err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(source.Image)
+	if err != nil {
+		return err
+	}
+	md, err := json.Marshal(map[string][]byte{
+		llbutil.KeyContainerImageConfig: config,
+	})
+	if err != nil {
+		return err
+	}
+
+	dockerfile, err := llb.Scratch().File(
+		llb.Mkfile("Dockerfile", 0o644, []byte(fmt.Sprintf("FROM %s\n", devFrontendInput))),
+	).Marshal(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Options prefixed with "gateway-" are only passed to the Dockerfile
+	// frontend, while the inputs are passed to both frontends.
+	req.FrontendOpt["source"] = "dockerfile.v0"
+	req.FrontendOpt["gateway-devel"] = "true"
+	req.FrontendOpt["gateway-context:"+devFrontendInput] = "input:" + devFrontendInput
+	req.FrontendOpt["gateway-input-metadata:"+devFrontendInput] = string(md)
+	req.FrontendInputs["dockerfile"] = dockerfile.ToPB()
+	req.FrontendInputs[devFrontendInput] = def.ToPB()
+	return nil
+}
+
+// gatewayBuild runs a build function against BuildKit with a session for the
+// given options.
+func gatewayBuild(ctx context.Context, cln *client.Client, solveOpts []solver.SolveOption, sessionOpts []llbutil.SessionOption, f gateway.BuildFunc) error {
+	s, err := llbutil.NewSession(ctx, sessionOpts...)
+	if err != nil {
+		return err
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
 	g.Go(func() error {
 		return s.Run(ctx, cln.Dialer())
 	})
@@ -318,44 +970,42 @@ func (f Frontend) Call(ctx context.Context, cln *client.Client, val Value, opts
 			pw = mw.WithPrefix("", false)
 		}
 
-		return solver.Build(ctx, cln, s, pw, func(ctx context.Context, c gateway.Client) (res *gateway.Result, err error) {
-			res, err = c.Solve(ctx, req)
-			if err != nil {
-				return
-			}
-
-			ref, err := res.SingleRef()
-			if err != nil {
-				return
-			}
+		return solver.Build(ctx, cln, s, pw, f, solveOpts...)
+	})
 
-			if ref == nil {
-				fs.State = llb.Scratch()
-			} else {
-				fs.State, err = ref.ToState()
-				if err != nil {
-					return
-				}
-			}
+	return g.Wait()
+}
 
-			imageSpec, ok := res.Metadata[llbutil.KeyContainerImageConfig]
-			if ok {
-				err = json.Unmarshal(imageSpec, fs.Image)
-				if err != nil {
-					return
-				}
-			}
+// frontendFilesystem solves a frontend request and returns its result as a
+// filesystem with the image config produced by the frontend.
+func frontendFilesystem(ctx context.Context, c gateway.Client, req gateway.SolveRequest) (fs Filesystem, res *gateway.Result, err error) {
+	fs, err = ZeroValue(ctx).Filesystem()
+	if err != nil {
+		return
+	}
 
-			return
-		}, solveOpts...)
-	})
+	res, err = c.Solve(ctx, req)
+	if err != nil {
+		return
+	}
 
-	err = g.Wait()
+	ref, err := res.SingleRef()
 	if err != nil {
-		return nil, err
+		return
 	}
 
-	return NewValue(ctx, fs)
+	if ref != nil {
+		fs.State, err = ref.ToState()
+		if err != nil {
+			return
+		}
+	}
+
+	imageSpec, ok := res.Metadata[llbutil.KeyContainerImageConfig]
+	if ok {
+		err = json.Unmarshal(imageSpec, fs.Image)
+	}
+	return
 }
 
 type Env struct{}
@@ -366,8 +1016,7 @@ func (e Env) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 		return nil, err
 	}
 
-	fs.State = fs.State.AddEnv(key, value)
-	fs.Image.Config.Env = append(fs.Image.Config.Env, fmt.Sprintf("%s=%s", key, value))
+	setEnv(key, value)(&fs)
 	return NewValue(ctx, fs)
 }
 
@@ -379,13 +1028,8 @@ func (d Dir) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 		return nil, err
 	}
 
-	if !path.IsAbs(wd) {
-		wd = path.Join("/", fs.Image.Config.WorkingDir, wd)
-	}
-
-	fs.State = fs.State.Dir(wd)
-	fs.Image.Config.WorkingDir = wd
-	commitHistory(fs.Image, true, "WORKDIR %s", wd)
+	setWorkdir(wd, Arg(ctx, 0))(&fs)
+	commitHistory(fs.Image, true, "WORKDIR %s", fs.Image.Config.WorkingDir)
 	return NewValue(ctx, fs)
 }
 
@@ -397,8 +1041,7 @@ func (u User) Call(ctx context.Context, cln *client.Client, val Value, opts Opti
 		return nil, err
 	}
 
-	fs.State = fs.State.User(name)
-	fs.Image.Config.User = name
+	setUser(name, Arg(ctx, 0))(&fs)
 	commitHistory(fs.Image, true, "USER %s", name)
 	return NewValue(ctx, fs)
 }
@@ -411,8 +1054,13 @@ func (r Run) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 		solveOpts   []solver.SolveOption
 		sessionOpts []llbutil.SessionOption
 		bind        string
+		bindPath    string
 		shlex       = false
 		image       *solver.ImageSpec
+		capture     *Capture
+		stdin       *Stdin
+		steps       []llb.State
+		secrets     = make(map[string]*SecretTarget)
 	)
 	for _, opt := range opts {
 		switch o := opt.(type) {
@@ -424,9 +1072,21 @@ func (r Run) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 			sessionOpts = append(sessionOpts, o)
 		case *Mount:
 			bind = o.Bind
+			bindPath = o.SourcePath
 			image = o.Image
+		case *Capture:
+			capture = o
 		case *Shlex:
 			shlex = true
+		case *Stdin:
+			stdin = o
+		case *DependsOn:
+			steps = append(steps, o.Step)
+		case *SecretTarget:
+			if first, ok := secrets[o.Target]; ok {
+				return nil, errdefs.WithDuplicateSecretTarget(o.Target, first.Path, o.Path, first.Node, o.Node)
+			}
+			secrets[o.Target] = o
 		}
 	}
 	for _, opt := range SourceMap(ctx) {
@@ -438,136 +1098,596 @@ func (r Run) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 		return nil, err
 	}
 
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
 	customName := strings.ReplaceAll(shellquote.Join(runArgs...), "\n", "\\n")
-	runOpts = append(runOpts, llb.Args(runArgs), llb.WithCustomName(customName))
+	execArgs := runArgs
+	if stdin != nil {
+		var stdinOpts []llb.RunOption
+		execArgs, stdinOpts = stdin.Wrap(runArgs, fs.Platform)
+		runOpts = append(runOpts, stdinOpts...)
+	}
+	if hooks := getRunHooks(ctx); hooks != nil {
+		var hookOpts []llb.RunOption
+		execArgs, hookOpts = hooks.Wrap(execArgs, fs.Platform)
+		runOpts = append(runOpts, hookOpts...)
+	}
+	if len(steps) > 0 {
+		runOpts = append(runOpts, llb.AddMount(BarrierMountpoint, llbutil.Barrier(steps...), llb.Readonly))
+	}
+	runOpts = append(runOpts, llb.Args(execArgs), llb.WithCustomName(customName))
 
 	err = llbutil.ShimReadonlyMountpoints(runOpts)
 	if err != nil {
 		return nil, err
 	}
 
+	fs, err = preflightRun(ctx, fs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	run := fs.State.Run(runOpts...)
+	switch {
+	case capture != nil:
+		fs.State, err = captureState(ctx, fs.State, run, runOpts, capture)
+		if err != nil {
+			return nil, err
+		}
+		fs.Image = &solver.ImageSpec{}
+	case bind != "":
+		fs.State = llbutil.SelectPath(run.GetMount(bind), bindPath)
+	default:
+		fs.State = run.Root()
+	}
+	if image != nil {
+		fs.Image = image
+	}
+
+	fs.SolveOpts = append(fs.SolveOpts, solveOpts...)
+	fs.SessionOpts = append(fs.SessionOpts, sessionOpts...)
+	commitHistory(fs.Image, false, "RUN %s", strings.Join(runArgs, " "))
+
+	return NewValue(ctx, fs)
+}
+
+type SetBreakpoint struct{}
+
+func (sb SetBreakpoint) Call(ctx context.Context, cln *client.Client, val Value, opts Option, args ...string) (Value, error) {
+	return val, nil
+}
+
+type Mkdir struct{}
+
+func (m Mkdir) Call(ctx context.Context, cln *client.Client, val Value, opts Option, path string, mode os.FileMode) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var mkdirOpts []llb.MkdirOption
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llb.MkdirOption:
+			mkdirOpts = append(mkdirOpts, o)
+		}
+	}
+
+	fs.State = fs.State.File(
+		llb.Mkdir(path, mode, mkdirOpts...),
+		SourceMap(ctx)...,
+	)
+	return NewValue(ctx, fs)
+}
+
+type Mkfile struct{}
+
+func (m Mkfile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, path string, mode os.FileMode, content string) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var mkfileOpts []llb.MkfileOption
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llb.MkfileOption:
+			mkfileOpts = append(mkfileOpts, o)
+		}
+	}
+
+	fs.State = fs.State.File(
+		llb.Mkfile(path, mode, []byte(content), mkfileOpts...),
+		SourceMap(ctx)...,
+	)
+	return NewValue(ctx, fs)
+}
+
+type Rm struct{}
+
+func (m Rm) Call(ctx context.Context, cln *client.Client, val Value, opts Option, paths ...string) (Value, error) {
 	fs, err := val.Filesystem()
 	if err != nil {
 		return nil, err
 	}
 
-	run := fs.State.Run(runOpts...)
-	if bind != "" {
-		fs.State = run.GetMount(bind)
-	} else {
-		fs.State = run.Root()
+	var (
+		rmOpts []llb.RmOption
+		except []string
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llb.RmOption:
+			rmOpts = append(rmOpts, o)
+		case *Except:
+			except = append(except, o.Pattern)
+		}
+	}
+	if len(paths) == 0 {
+		return NewValue(ctx, fs)
+	}
+
+	var action *llb.FileAction
+	for _, p := range paths {
+		if action == nil {
+			action = llb.Rm(p, rmOpts...)
+		} else {
+			action = action.Rm(p, rmOpts...)
+		}
+	}
+
+	// Rather than resolving the protected files ahead of the build, restore
+	// them from the filesystem before removal so that the file operation is
+	// fully described by its inputs.
+	if len(except) > 0 {
+		dir, err := fs.State.GetDir(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var patterns []string
+		for _, pattern := range except {
+			if !path.IsAbs(pattern) {
+				pattern = path.Join(dir, pattern)
+			}
+			patterns = append(patterns, strings.TrimPrefix(pattern, "/"))
+		}
+		action = action.Copy(fs.State, "/", "/", &llb.CopyInfo{
+			CopyDirContentsOnly: true,
+			IncludePatterns:     patterns,
+		})
+	}
+
+	fs.State = fs.State.File(action, SourceMap(ctx)...)
+	return NewValue(ctx, fs)
+}
+
+type Whiteout struct{}
+
+func (w Whiteout) Call(ctx context.Context, cln *client.Client, val Value, opts Option, paths ...string) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return NewValue(ctx, fs)
+	}
+
+	// The paths are removed in a file operation of their own, so that the
+	// exported layer holds only the whiteouts.
+	action := llb.Rm(paths[0], llb.WithAllowNotFound(true))
+	for _, p := range paths[1:] {
+		action = action.Rm(p, llb.WithAllowNotFound(true))
+	}
+	fs.State = fs.State.File(action, SourceMap(ctx)...)
+	commitHistory(fs.Image, false, "WHITEOUT %s", strings.Join(paths, " "))
+
+	return NewValue(ctx, fs)
+}
+
+type Copy struct{}
+
+func (m Copy) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, src, dest string) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		copyOpts      []llb.CopyOption
+		chown         *llbutil.Chown
+		chownFrom     *ChownFrom
+		maxSize       *MaxSize
+		substitutions []*Substitute
+		exportIgnore  *ExportIgnore
+		chmod         bool
+		fileMode      *CopyFileMode
+		dirMode       *CopyDirMode
+		manifest      *CopyManifest
+		wildcard      bool
+		contentsOnly  bool
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llbutil.AllowWildcard:
+			wildcard = bool(o)
+			copyOpts = append(copyOpts, o)
+		case llbutil.CopyDirContentsOnly:
+			contentsOnly = bool(o)
+			copyOpts = append(copyOpts, o)
+		case llbutil.Chown:
+			chown = &o
+		case *ChownFrom:
+			chownFrom = o
+		case *ExportIgnore:
+			exportIgnore = o
+		case *CopyFileMode:
+			fileMode = o
+		case *CopyDirMode:
+			dirMode = o
+		case llbutil.Chmod:
+			chmod = true
+			copyOpts = append(copyOpts, o)
+		case llb.CopyOption:
+			copyOpts = append(copyOpts, o)
+		case *MaxSize:
+			maxSize = o
+		case *Substitute:
+			substitutions = append(substitutions, o)
+		case *CopyManifest:
+			manifest = o
+		}
+	}
+
+	if chown != nil {
+		owner := string(*chown)
+		if chownFrom != nil {
+			owner, err = chownFrom.Resolve(ctx, cln, owner)
+			if err != nil {
+				return nil, err
+			}
+		}
+		copyOpts = append(copyOpts, llbutil.WithChown(owner))
 	}
-	if image != nil {
-		fs.Image = image
+
+	if exportIgnore != nil {
+		patterns, err := exportIgnore.Patterns(ctx, cln, input, src)
+		if err != nil {
+			return nil, err
+		}
+		// Export-ignored files are excluded first, so that explicit patterns
+		// are applied after them.
+		if len(patterns) > 0 {
+			copyOpts = append([]llb.CopyOption{llbutil.WithExcludePatterns(patterns)}, copyOpts...)
+		}
 	}
 
-	fs.SolveOpts = append(fs.SolveOpts, solveOpts...)
-	fs.SessionOpts = append(fs.SessionOpts, sessionOpts...)
-	commitHistory(fs.Image, false, "RUN %s", strings.Join(runArgs, " "))
+	if maxSize != nil {
+		dir, err := localSourceDir(ctx, input.State)
+		if err != nil {
+			return nil, err
+		}
+		if dir == "" {
+			return nil, errdefs.WithUnsupportedMaxSize(ProgramCounter(ctx))
+		}
 
-	return NewValue(ctx, fs)
-}
+		excluded, skip, err := largeFiles(filepath.Join(dir, src), maxSize.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return copyManifest(ctx, fs, fs.State, manifest)
+		}
+		if len(excluded) > 0 {
+			copyOpts = append(copyOpts, llbutil.WithExcludePatterns(excluded))
+		}
+	}
 
-type SetBreakpoint struct{}
+	if len(substitutions) > 0 {
+		args := []string{"/bin/sh", "-c", SubstituteScript, "substitute", path.Join(SubstituteMountpoint, src), strconv.FormatBool(wildcard)}
+		for _, s := range substitutions {
+			args = append(args, s.Placeholder, s.Value)
+		}
 
-func (sb SetBreakpoint) Call(ctx context.Context, cln *client.Client, val Value, opts Option, args ...string) (Value, error) {
-	return val, nil
-}
+		es := helperImage(ctx).Run(
+			llb.Args(args),
+			llb.AddMount(SubstituteMountpoint, input.State),
+			llb.WithCustomNamef("substitute placeholders in %s", src),
+		)
+		input.State = es.GetMount(SubstituteMountpoint)
+	}
 
-type Mkdir struct{}
+	if fileMode != nil || dirMode != nil {
+		if chmod {
+			return nil, errdefs.WithConflictingCopyModes(ProgramCounter(ctx))
+		}
 
-func (m Mkdir) Call(ctx context.Context, cln *client.Client, val Value, opts Option, path string, mode os.FileMode) (Value, error) {
-	fs, err := val.Filesystem()
-	if err != nil {
-		return nil, err
+		// Empty modes are left unchanged by the script.
+		var modes [2]string
+		if fileMode != nil {
+			modes[0] = fmt.Sprintf("%o", fileMode.Mode.Perm())
+		}
+		if dirMode != nil {
+			modes[1] = fmt.Sprintf("%o", dirMode.Mode.Perm())
+		}
+
+		es := helperImage(ctx).Run(
+			llb.Args([]string{"/bin/sh", "-c", ChmodScript, "chmod", path.Join(ChmodMountpoint, src), strconv.FormatBool(wildcard), modes[0], modes[1]}),
+			llb.AddMount(ChmodMountpoint, input.State),
+			llb.WithCustomNamef("chmod %s", src),
+		)
+		input.State = es.GetMount(ChmodMountpoint)
 	}
 
-	var mkdirOpts []llb.MkdirOption
-	for _, opt := range opts {
-		switch o := opt.(type) {
-		case llb.MkdirOption:
-			mkdirOpts = append(mkdirOpts, o)
+	// Copying the contents of what was just copied again doesn't change the
+	// filesystem, so identical adjacent copies of contents are coalesced into
+	// a single layer. Other copies aren't, because a directory copied again
+	// is nested in the directory the first copy created.
+	var key digest.Digest
+	if contentsOnly {
+		key, err = copyKey(ctx, fs, input.State, src, dest, copyOpts)
+		if err != nil {
+			return nil, err
 		}
 	}
+	if key != "" && fs.lastCopy != nil && fs.lastCopy.output == fs.State.Output() && fs.lastCopy.key == key {
+		return copyManifest(ctx, fs, fs.lastCopy.base, manifest)
+	}
 
+	base := fs.State
 	fs.State = fs.State.File(
-		llb.Mkdir(path, mode, mkdirOpts...),
+		llb.Copy(input.State, src, dest, copyOpts...),
 		SourceMap(ctx)...,
 	)
-	return NewValue(ctx, fs)
-}
+	fs.lastCopy = nil
+	if key != "" {
+		fs.lastCopy = &copyAction{base: base, output: fs.State.Output(), key: key}
+	}
+	fs.SolveOpts = append(fs.SolveOpts, input.SolveOpts...)
+	fs.SessionOpts = append(fs.SessionOpts, input.SessionOpts...)
+	commitHistory(fs.Image, false, "COPY %s %s", src, dest)
 
-type Mkfile struct{}
+	return copyManifest(ctx, fs, base, manifest)
+}
 
-func (m Mkfile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, path string, mode os.FileMode, content string) (Value, error) {
-	fs, err := val.Filesystem()
-	if err != nil {
-		return nil, err
+// copyManifest records a manifest of the files a copy brought into the
+// filesystem, which are the difference from base, the filesystem before the
+// copy. The files are where the copy put them, like in a directory that
+// already existed at its destination. The manifest is written into the
+// filesystem, or returned on its own if the option is bound. Without a
+// manifest the filesystem is returned as is.
+func copyManifest(ctx context.Context, fs Filesystem, base llb.State, manifest *CopyManifest) (Value, error) {
+	if manifest == nil {
+		return NewValue(ctx, fs)
+	}
+	copied := llb.Scratch()
+	if base.Output() != fs.State.Output() {
+		copied = llb.Diff(base, fs.State)
 	}
 
-	var mkfileOpts []llb.MkfileOption
-	for _, opt := range opts {
-		switch o := opt.(type) {
-		case llb.MkfileOption:
-			mkfileOpts = append(mkfileOpts, o)
+	p := manifest.Path
+	if !path.IsAbs(p) {
+		dir, err := fs.State.GetDir(ctx)
+		if err != nil {
+			return nil, err
 		}
+		p = path.Join("/", dir, p)
+	}
+	p = path.Clean(p)
+
+	es := helperImage(ctx).Run(
+		llb.Args([]string{"/bin/sh", "-c", ManifestScript, "manifest", ManifestMountpoint, path.Join(ManifestOutputMountpoint, p)}),
+		llb.AddMount(ManifestMountpoint, copied, llb.Readonly),
+		llb.AddMount(ManifestOutputMountpoint, llb.Scratch()),
+		llb.WithCustomNamef("record manifest %s", p),
+	)
+	st := es.GetMount(ManifestOutputMountpoint)
+
+	if manifest.Bind {
+		fs.State = st
+		fs.Image = &solver.ImageSpec{}
+		return NewValue(ctx, fs)
 	}
 
 	fs.State = fs.State.File(
-		llb.Mkfile(path, mode, []byte(content), mkfileOpts...),
+		llb.Copy(st, p, p, llbutil.WithCreateDestPath(true)),
 		SourceMap(ctx)...,
 	)
+	commitHistory(fs.Image, false, "MANIFEST %s", p)
 	return NewValue(ctx, fs)
 }
 
-type Rm struct{}
+// copyAction is the copy that produced the output of a filesystem from base.
+type copyAction struct {
+	base   llb.State
+	output llb.Output
+	key    digest.Digest
+}
 
-func (m Rm) Call(ctx context.Context, cln *client.Client, val Value, opts Option, path string) (Value, error) {
-	fs, err := val.Filesystem()
+// copyKey returns a digest of everything that determines the result of a copy
+// onto a filesystem, except for the filesystem itself.
+func copyKey(ctx context.Context, fs Filesystem, input llb.State, src, dest string, copyOpts []llb.CopyOption) (digest.Digest, error) {
+	dir, err := fs.State.GetDir(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	var rmOpts []llb.RmOption
-	for _, opt := range opts {
-		switch o := opt.(type) {
-		case llb.RmOption:
-			rmOpts = append(rmOpts, o)
-		}
+	def, err := llb.Scratch().Dir(dir).File(
+		llb.Copy(input, src, dest, copyOpts...),
+	).Marshal(ctx, llb.Platform(fs.Platform))
+	if err != nil {
+		return "", err
 	}
+	return digest.FromBytes(bytes.Join(def.Def, nil)), nil
+}
 
-	fs.State = fs.State.File(
-		llb.Rm(path, rmOpts...),
-		SourceMap(ctx)...,
+const (
+	// SubstituteMountpoint is where the copy source is mounted in the helper.
+	SubstituteMountpoint = "/run/hlb/substitute"
+
+	// ChmodMountpoint is where the copy source is mounted in the helper for
+	// fileMode and dirMode, which uses the same image as substitute.
+	ChmodMountpoint = "/run/hlb/chmod"
+
+	// ManifestMountpoint is where the copied files are mounted in the helper
+	// for manifest, which uses the same image as substitute.
+	ManifestMountpoint = "/run/hlb/manifest"
+
+	// ManifestOutputMountpoint is where the helper for manifest writes the
+	// manifest.
+	ManifestOutputMountpoint = "/run/hlb/manifest-output"
+)
+
+// ManifestScript writes a manifest of the regular files and symlinks under a
+// path, given as the first argument, to the file given as the second. Each
+// line is the sha256 digest, octal mode and path of a file relative to the
+// first argument, sorted by path. A symlink is recorded by its target.
+const ManifestScript = `set -e
+mkdir -p "$(dirname "$2")"
+cd "$1"
+find . \( -type f -o -type l \) | LC_ALL=C sort | while IFS= read -r file; do
+	if [ -L "$file" ]; then
+		sum="$(printf '%s' "$(readlink "$file")" | sha256sum)"
+	else
+		sum="$(sha256sum < "$file")"
+	fi
+	printf 'sha256:%s %s %s\n' "${sum%% *}" "$(stat -c %a "$file")" "${file#./}"
+done > "$2"
+`
+
+// matchScript defines match, which prints the path given as its first
+// argument, or the existing paths it matches if the second argument is "true",
+// like the wildcard source of a copy with allowWildcard.
+const matchScript = `match() {
+	if [ "$2" != true ]; then
+		printf '%s\n' "$1"
+		return
+	fi
+	(
+		IFS=
+		for p in $1; do
+			if [ -e "$p" ] || [ -L "$p" ]; then
+				printf '%s\n' "$p"
+			fi
+		done
 	)
-	return NewValue(ctx, fs)
 }
+`
+
+// ChmodScript changes the permissions of the regular files and directories
+// under a path, given as the first argument. The second argument is "true" if
+// the path is a wildcard, and is followed by the modes of files and directories
+// in octal. An empty mode is left unchanged, and symlinks are not followed.
+const ChmodScript = matchScript + `set -e
+match "$1" "$2" | while IFS= read -r root; do
+	if [ -n "$3" ]; then
+		find "$root" -type f -exec chmod "$3" {} +
+	fi
+	if [ -n "$4" ]; then
+		find "$root" -type d -exec chmod "$4" {} +
+	fi
+done
+`
+
+// SubstituteScript replaces placeholders with values in the regular files
+// under a path, given as the first argument. The second argument is "true" if
+// the path is a wildcard, and is followed by pairs of placeholders and values.
+// Files containing a NUL byte are skipped as binary, and other files are
+// otherwise left byte for byte, including a missing final newline.
+const SubstituteScript = matchScript + `set -e
+root="$1"
+wildcard="$2"
+shift 2
+tmp="$(mktemp)"
+match "$root" "$wildcard" | while IFS= read -r path; do
+	find "$path" -type f
+done | while IFS= read -r file; do
+	if [ "$(tr -d '\000' < "$file" | wc -c)" -ne "$(wc -c < "$file")" ]; then
+		continue
+	fi
+	partial=0
+	if [ -n "$(tail -c 1 "$file" | tr -d '\n')" ]; then
+		partial=1
+	fi
+	awk -v partial="$partial" '
+	BEGIN {
+		for (i = 2; i < ARGC; i += 2) {
+			old[++n] = ARGV[i]
+			new[n] = ARGV[i + 1]
+			ARGV[i] = ""
+			ARGV[i + 1] = ""
+		}
+	}
+	{
+		line = $0
+		for (k = 1; k <= n; k++) {
+			out = ""
+			while ((p = index(line, old[k])) > 0) {
+				out = out substr(line, 1, p - 1) new[k]
+				line = substr(line, p + length(old[k]))
+			}
+			line = out line
+		}
+		if (NR > 1) {
+			printf "\n"
+		}
+		printf "%s", line
+	}
+	END {
+		if (NR > 0 && !partial) {
+			printf "\n"
+		}
+	}' "$file" "$@" > "$tmp"
+	if ! cmp -s "$file" "$tmp"; then
+		cat "$tmp" > "$file"
+	fi
+done
+rm "$tmp"`
 
-type Copy struct{}
-
-func (m Copy) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, src, dest string) (Value, error) {
-	fs, err := val.Filesystem()
+// largeFiles returns exclude patterns for the files within path that are
+// larger than maxSize, relative to path. If path is itself a file larger than
+// maxSize, skip is true.
+func largeFiles(path string, maxSize int64) (excluded []string, skip bool, err error) {
+	fi, err := os.Stat(path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if !fi.IsDir() {
+		return nil, fi.Size() > maxSize, nil
 	}
 
-	var copyOpts []llb.CopyOption
-	for _, opt := range opts {
-		switch o := opt.(type) {
-		case llb.CopyOption:
-			copyOpts = append(copyOpts, o)
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() <= maxSize {
+			return nil
 		}
-	}
 
-	fs.State = fs.State.File(
-		llb.Copy(input.State, src, dest, copyOpts...),
-		SourceMap(ctx)...,
-	)
-	fs.SolveOpts = append(fs.SolveOpts, input.SolveOpts...)
-	fs.SessionOpts = append(fs.SessionOpts, input.SessionOpts...)
-	commitHistory(fs.Image, false, "COPY %s %s", src, dest)
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		excluded = append(excluded, escapePattern(filepath.ToSlash(rel)))
+		return nil
+	})
+	return excluded, false, err
+}
 
-	return NewValue(ctx, fs)
+// escapePattern escapes the pattern metacharacters in a filename so that the
+// pattern only matches the filename itself.
+func escapePattern(filename string) string {
+	var sb strings.Builder
+	for _, r := range filename {
+		switch r {
+		case '*', '?', '[', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
 }
 
 type Merge struct{}
@@ -610,6 +1730,164 @@ func (d Diff) Call(ctx context.Context, cln *client.Client, val Value, opts Opti
 	return NewValue(ctx, fs)
 }
 
+const (
+	// CombineMountpoint is where the stages are mounted in the helper, each in
+	// a directory named after its index.
+	CombineMountpoint = "/run/hlb/combine"
+)
+
+// CombineScript fails if a path that is not a directory differs between any
+// two of the directories given as arguments.
+const CombineScript = `set -e
+out="$(mktemp)"
+i=0
+for a in "$@"; do
+	i=$((i + 1))
+	j=0
+	for b in "$@"; do
+		j=$((j + 1))
+		[ "$j" -gt "$i" ] || continue
+		(cd "$a" && find . ! -type d) | while IFS= read -r p; do
+			if [ ! -e "$b/$p" ] && [ ! -L "$b/$p" ]; then
+				continue
+			fi
+			if [ -L "$a/$p" ] || [ -L "$b/$p" ]; then
+				[ "$(readlink "$a/$p")" = "$(readlink "$b/$p")" ] && continue
+			elif [ -f "$a/$p" ] && [ -f "$b/$p" ]; then
+				cmp -s "$a/$p" "$b/$p" && continue
+			fi
+			echo "/${p#./} differs between stages $i and $j" >> "$out"
+		done
+	done
+done
+if [ -s "$out" ]; then
+	echo "error: conflicting paths in combined stages:" >&2
+	cat "$out" >&2
+	exit 1
+fi`
+
+type Combine struct{}
+
+func (c Combine) Call(ctx context.Context, cln *client.Client, val Value, opts Option, stages ...Filesystem) (Value, error) {
+	if len(stages) == 0 {
+		return nil, errors.New("combine takes at least one filesystem as arguments")
+	}
+
+	policy := ConflictLast
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *CombineConflict:
+			policy = o.Policy
+		}
+	}
+
+	fs := stages[0]
+	var states []llb.State
+	for _, stage := range stages {
+		states = append(states, stage.State)
+	}
+	for _, stage := range stages[1:] {
+		fs.SolveOpts = append(fs.SolveOpts, stage.SolveOpts...)
+		fs.SessionOpts = append(fs.SessionOpts, stage.SessionOpts...)
+	}
+
+	switch policy {
+	case ConflictFirst:
+		for i, j := 0, len(states)-1; i < j; i, j = i+1, j-1 {
+			states[i], states[j] = states[j], states[i]
+		}
+	case ConflictError:
+		args := []string{"/bin/sh", "-c", CombineScript, "combine"}
+		runOpts := []llb.RunOption{llb.WithCustomName("checking combined stages for conflicts")}
+		for i, st := range states {
+			mountpoint := path.Join(CombineMountpoint, strconv.Itoa(i))
+			args = append(args, mountpoint)
+			runOpts = append(runOpts, llb.AddMount(mountpoint, st, llb.Readonly))
+		}
+		runOpts = append(runOpts, llb.Args(args))
+
+		// The check has no output, but merging its empty output makes the
+		// combined filesystem depend on it.
+		es := helperImage(ctx).Run(runOpts...)
+		states = append(states, es.AddMount(path.Join(CombineMountpoint, "out"), llb.Scratch()))
+	}
+
+	if len(states) == 1 {
+		fs.State = states[0]
+	} else {
+		fs.State = llb.Merge(states, SourceMap(ctx)...)
+	}
+	commitHistory(fs.Image, false, "COMBINE %d stages", len(stages))
+
+	return NewValue(ctx, fs)
+}
+
+const (
+	// StripMountpoint is where the filesystem being stripped is mounted in the
+	// helper.
+	StripMountpoint = "/run/hlb/strip"
+)
+
+// StripScript strips debug symbols from each file that begins with the ELF
+// magic number, and warns about the rest.
+const StripScript = `set -e
+for path in "$@"; do
+	target="` + StripMountpoint + `$path"
+	if [ ! -f "$target" ]; then
+		echo "error: $path is not a file" >&2
+		exit 1
+	fi
+	if [ "$(head -c 4 "$target" | od -An -tx1 | tr -d ' \n')" = "7f454c46" ]; then
+		strip --strip-debug "$target"
+	else
+		echo "warning: skipping $path, not an ELF binary" >&2
+	fi
+done`
+
+type Strip struct{}
+
+func (s Strip) Call(ctx context.Context, cln *client.Client, val Value, opts Option, paths ...string) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var helper *Filesystem
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *StripHelper:
+			helper = &o.Helper
+		}
+	}
+	// Unlike the other helpers, strip runs on the platform of the filesystem,
+	// because binutils only strips binaries of its own architecture.
+	if helper == nil {
+		helper = &Filesystem{
+			State: llb.Image(HelperImage, llb.Platform(fs.Platform)).Run(
+				llb.Shlex("apk add --no-cache binutils"),
+				llb.WithCustomName("installing binutils for strip"),
+			).Root(),
+		}
+	}
+
+	args := []string{"/bin/sh", "-c", StripScript, "strip"}
+	for _, p := range paths {
+		args = append(args, path.Join("/", p))
+	}
+
+	es := helper.State.Run(
+		llb.Args(args),
+		llb.AddMount(StripMountpoint, fs.State),
+		llb.WithCustomNamef("strip %s", strings.Join(paths, " ")),
+	)
+	fs.State = es.GetMount(StripMountpoint)
+	fs.SolveOpts = append(fs.SolveOpts, helper.SolveOpts...)
+	fs.SessionOpts = append(fs.SessionOpts, helper.SessionOpts...)
+	commitHistory(fs.Image, false, "STRIP %s", strings.Join(paths, " "))
+
+	return NewValue(ctx, fs)
+}
+
 type Entrypoint struct{}
 
 func (e Entrypoint) Call(ctx context.Context, cln *client.Client, val Value, opts Option, entrypoint ...string) (Value, error) {
@@ -618,7 +1896,7 @@ func (e Entrypoint) Call(ctx context.Context, cln *client.Client, val Value, opt
 		return nil, err
 	}
 
-	fs.Image.Config.Entrypoint = entrypoint
+	setEntrypoint(entrypoint)(&fs)
 	commitHistory(fs.Image, true, "ENTRYPOINT %q", entrypoint)
 	return NewValue(ctx, fs)
 }
@@ -631,7 +1909,7 @@ func (c Cmd) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 		return nil, err
 	}
 
-	fs.Image.Config.Cmd = cmd
+	setCmd(cmd)(&fs)
 	return NewValue(ctx, fs)
 }
 
@@ -643,11 +1921,7 @@ func (l Label) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		return nil, err
 	}
 
-	if fs.Image.Config.Labels == nil {
-		fs.Image.Config.Labels = make(map[string]string)
-	}
-
-	fs.Image.Config.Labels[key] = value
+	setLabel(key, value)(&fs)
 
 	// In Dockerfile, multiple labels can be specified in the same LABEL command
 	// leading to one history element. This checks if the previous history
@@ -670,14 +1944,25 @@ func (e Expose) Call(ctx context.Context, cln *client.Client, val Value, opts Op
 		return nil, err
 	}
 
-	if fs.Image.Config.ExposedPorts == nil {
-		fs.Image.Config.ExposedPorts = make(map[string]struct{})
+	expanded, err := expandPorts(ctx, ports)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, port := range ports {
-		fs.Image.Config.ExposedPorts[port] = struct{}{}
+	// Ports exposed twice in a module are found by the linter, but the ports
+	// of the base image are only known once it is resolved.
+	if fs.Base != nil && fs.baseArg != nil {
+		for i, spec := range ports {
+			specPorts, _ := imageutil.ParsePortSpec(spec)
+			for _, port := range specPorts {
+				if _, ok := fs.Base.Config.ExposedPorts[port]; ok {
+					getLintWarner(ctx).warn(Module(ctx), errdefs.WithBasePortExposed(Module(ctx), port, fs.baseArg, Arg(ctx, i)))
+				}
+			}
+		}
 	}
 
+	addExposedPorts(expanded)(&fs)
 	return NewValue(ctx, fs)
 }
 
@@ -689,14 +1974,7 @@ func (Volumes) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		return nil, err
 	}
 
-	if fs.Image.Config.Volumes == nil {
-		fs.Image.Config.Volumes = make(map[string]struct{})
-	}
-
-	for _, mountpoint := range mountpoints {
-		fs.Image.Config.Volumes[mountpoint] = struct{}{}
-	}
-
+	addVolumes(mountpoints)(&fs)
 	return NewValue(ctx, fs)
 }
 
@@ -708,7 +1986,7 @@ func (ss StopSignal) Call(ctx context.Context, cln *client.Client, val Value, op
 		return nil, err
 	}
 
-	fs.Image.Config.StopSignal = signal
+	setStopSignal(signal)(&fs)
 	return NewValue(ctx, fs)
 }
 
@@ -742,13 +2020,18 @@ func (dp DockerPush) Call(ctx context.Context, cln *client.Client, val Value, op
 		}),
 	)
 
-	stargz := false
+	var (
+		stargz bool
+		budget *MaxImageSize
+	)
 	for _, opt := range opts {
 		switch o := opt.(type) {
 		case solver.SolveOption:
 			exportFS.SolveOpts = append(exportFS.SolveOpts, o)
 		case *Stargz:
 			stargz = true
+		case *MaxImageSize:
+			budget = o
 		}
 	}
 
@@ -785,9 +2068,26 @@ func (dp DockerPush) Call(ctx context.Context, cln *client.Client, val Value, op
 				}
 
 				pw := mw.WithPrefix("", false)
-				return progress.Wrap("pushing "+ref, pw.Write, func(l progress.SubLogger) error {
-					return pushWithMoby(ctx, dockerAPI, ref, l)
+				var dgst digest.Digest
+				err := progress.Wrap("pushing "+ref, pw.Write, func(l progress.SubLogger) error {
+					var err error
+					dgst, err = pushWithMoby(ctx, dockerAPI, ref, l)
+					return err
 				})
+				if err != nil {
+					return errdefs.WithExportError(err)
+				}
+				if mf := getMetadataFile(ctx); mf != nil {
+					// The digest of the image in the docker engine is not its
+					// digest in the registry, so it is resolved after the push
+					// if the docker engine didn't report it.
+					err = mf.Record(ctx, registryResolver(dockerAPI.Auth), exportFS.Platform, ref, dgst)
+					if err != nil {
+						return err
+					}
+				}
+				postExport(ctx, ExportInfo{Kind: ExportDockerPush, Ref: ref, Digest: dgst})
+				return nil
 			}),
 		)
 		return NewValue(ctx, exportFS)
@@ -796,6 +2096,31 @@ func (dp DockerPush) Call(ctx context.Context, cln *client.Client, val Value, op
 	exportFS.SolveOpts = append(exportFS.SolveOpts,
 		solver.WithPushImage(ref),
 	)
+	withExportHook(ctx, &exportFS, ExportDockerPush, ref, "")
+	if mf := getMetadataFile(ctx); mf != nil {
+		exportFS.SolveOpts = append(exportFS.SolveOpts,
+			solver.WithCallback(func(ctx context.Context, resp *client.SolveResponse) error {
+				dgst := digest.Digest(resp.ExporterResponse[llbutil.KeyContainerImageDigest])
+				return mf.Record(ctx, registryResolver(dockerAPI.Auth), exportFS.Platform, ref, dgst)
+			}),
+		)
+	}
+	if budget != nil {
+		// The image is pushed by its digest and only tagged once it fits in
+		// its size budget, so that the tag never points to an image over
+		// budget.
+		exportFS.SolveOpts = append(exportFS.SolveOpts,
+			solver.WithPushByDigest(),
+			solver.WithCallback(func(ctx context.Context, resp *client.SolveResponse) error {
+				dgst := resp.ExporterResponse[llbutil.KeyContainerImageDigest]
+				if dgst == "" {
+					return fmt.Errorf("no digest available for pushed image %s", ref)
+				}
+				pushed := fmt.Sprintf("%s@%s", named.Name(), dgst)
+				return tagWithinBudget(ctx, registryResolver(dockerAPI.Auth), exportFS.Platform, pushed, ref, budget)
+			}),
+		)
+	}
 
 	exportValue, err := NewValue(ctx, exportFS)
 	if err != nil {
@@ -831,17 +2156,66 @@ func (dp DockerPush) Call(ctx context.Context, cln *client.Client, val Value, op
 	return NewValue(ctx, fs)
 }
 
-func pushWithMoby(ctx context.Context, dockerAPI DockerAPIClient, ref string, l progress.SubLogger) error {
-	creds, err := imagetools.RegistryAuthForRef(ref, dockerAPI.Auth)
+// tagWithinBudget tags the image pushed to src as ref, unless the image is
+// larger than the size budget.
+func tagWithinBudget(ctx context.Context, resolver remotes.Resolver, platform specs.Platform, src, ref string, budget *MaxImageSize) error {
+	err := checkImageSize(ctx, resolver, platform, src, budget)
+	if err != nil {
+		return err
+	}
+	return imageutil.Tag(ctx, resolver, src, ref)
+}
+
+// checkImageSize returns an error if the image pushed to ref is larger than
+// the size budget.
+func checkImageSize(ctx context.Context, resolver remotes.Resolver, platform specs.Platform, ref string, budget *MaxImageSize) error {
+	size, err := imageutil.ImageSize(ctx, resolver, platforms.Only(platform), ref)
 	if err != nil {
 		return err
 	}
+	if size > budget.Bytes {
+		return errdefs.WithImageSizeExceeded(budget.Node, ref, size, budget.Bytes)
+	}
+	return nil
+}
+
+// registryResolver returns a resolver that authenticates to registries with
+// the credentials of the docker CLI, if there are any.
+func registryResolver(auth imagetools.Auth) remotes.Resolver {
+	var opts []docker.AuthorizerOpt
+	if auth != nil {
+		opts = append(opts, docker.WithAuthCreds(func(host string) (string, string, error) {
+			if host == "registry-1.docker.io" {
+				host = "https://index.docker.io/v1/"
+			}
+			ac, err := auth.GetAuthConfig(host)
+			if err != nil {
+				return "", "", err
+			}
+			if ac.IdentityToken != "" {
+				return "", ac.IdentityToken, nil
+			}
+			return ac.Username, ac.Password, nil
+		}))
+	}
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(opts...)),
+		),
+	})
+}
+
+func pushWithMoby(ctx context.Context, dockerAPI DockerAPIClient, ref string, l progress.SubLogger) (digest.Digest, error) {
+	creds, err := imagetools.RegistryAuthForRef(ref, dockerAPI.Auth)
+	if err != nil {
+		return "", err
+	}
 
 	rc, err := dockerAPI.ImagePush(ctx, ref, types.ImagePushOptions{
 		RegistryAuth: creds,
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	started := map[string]*client.VertexStatus{}
@@ -857,17 +2231,28 @@ func pushWithMoby(ctx context.Context, dockerAPI DockerAPIClient, ref string, l
 	}()
 
 	dec := json.NewDecoder(rc)
-	var parsedError error
+	var (
+		parsedError error
+		dgst        digest.Digest
+	)
 	for {
 		var jm jsonmessage.JSONMessage
 		if err := dec.Decode(&jm); err != nil {
 			if parsedError != nil {
-				return parsedError
+				return "", parsedError
 			}
 			if err == io.EOF {
 				break
 			}
-			return err
+			return "", err
+		}
+		if jm.Aux != nil {
+			// The docker engine reports the digest of the image in the
+			// registry once it is pushed.
+			var pr types.PushResult
+			if err := json.Unmarshal(*jm.Aux, &pr); err == nil && pr.Digest != "" {
+				dgst = digest.Digest(pr.Digest)
+			}
 		}
 		if jm.ID != "" {
 			id := "pushing layer " + jm.ID
@@ -903,7 +2288,7 @@ func pushWithMoby(ctx context.Context, dockerAPI DockerAPIClient, ref string, l
 			parsedError = jm.Error
 		}
 	}
-	return nil
+	return dgst, nil
 }
 
 type DockerLoad struct{}
@@ -936,12 +2321,14 @@ func (dl DockerLoad) Call(ctx context.Context, cln *client.Client, val Value, op
 		exportFS.SolveOpts = append(exportFS.SolveOpts,
 			solver.WithDownloadMoby(ref),
 		)
+		withExportHook(ctx, &exportFS, ExportDockerLoad, ref, "")
 		return NewValue(ctx, exportFS)
 	}
 
 	exportFS.SolveOpts = append(exportFS.SolveOpts,
 		solver.WithDownloadDockerTarball(ref),
 	)
+	withExportHook(ctx, &exportFS, ExportDockerLoad, ref, "")
 
 	r, w := io.Pipe()
 	exportFS.SessionOpts = append(exportFS.SessionOpts,
@@ -975,7 +2362,7 @@ func (dl DockerLoad) Call(ctx context.Context, cln *client.Client, val Value, op
 
 		resp, err := dockerAPI.ImageLoad(ctx, r, true)
 		if err != nil {
-			return err
+			return errdefs.WithExportError(err)
 		}
 		defer resp.Body.Close()
 
@@ -1013,15 +2400,33 @@ func (d Download) Call(ctx context.Context, cln *client.Client, val Value, opts
 		return nil, err
 	}
 
-	exportFS.SolveOpts = append(exportFS.SolveOpts, solver.WithDownload(localPath))
+	var filename *DownloadFilename
 	for _, opt := range opts {
 		switch o := opt.(type) {
 		case solver.SolveOption:
 			exportFS.SolveOpts = append(exportFS.SolveOpts, o)
+		case *DownloadFilename:
+			filename = o
+		}
+	}
+
+	// A named file is downloaded to a temporary directory first, so that it
+	// can be told apart from the files already in the local path.
+	syncDir := localPath
+	if filename != nil {
+		err = os.MkdirAll(localPath, 0755)
+		if err != nil {
+			return nil, err
+		}
+		syncDir, err = os.MkdirTemp(localPath, ".download-")
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	exportFS.SessionOpts = append(exportFS.SessionOpts, llbutil.WithSyncTargetDir(localPath))
+	exportFS.SolveOpts = append(exportFS.SolveOpts, solver.WithDownload(syncDir))
+	exportFS.SessionOpts = append(exportFS.SessionOpts, llbutil.WithSyncTargetDir(syncDir))
+	withExportHook(ctx, &exportFS, ExportDownload, "", localPath)
 
 	exportValue, err := NewValue(ctx, exportFS)
 	if err != nil {
@@ -1036,7 +2441,16 @@ func (d Download) Call(ctx context.Context, cln *client.Client, val Value, opts
 	g, ctx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		return request.Solve(ctx, cln, MultiWriter(ctx))
+		if filename == nil {
+			return request.Solve(ctx, cln, MultiWriter(ctx))
+		}
+		defer os.RemoveAll(syncDir)
+
+		err := request.Solve(ctx, cln, MultiWriter(ctx))
+		if err != nil {
+			return err
+		}
+		return errdefs.WithExportError(moveDownload(syncDir, localPath, filename))
 	})
 
 	fs, err := val.Filesystem()
@@ -1081,6 +2495,7 @@ func (dt DownloadTarball) Call(ctx context.Context, cln *client.Client, val Valu
 	}
 
 	exportFS.SessionOpts = append(exportFS.SessionOpts, llbutil.WithSyncTarget(llbutil.OutputFromWriter(f)))
+	withExportHook(ctx, &exportFS, ExportDownloadTarball, "", localPath)
 
 	exportValue, err := NewValue(ctx, exportFS)
 	if err != nil {
@@ -1145,6 +2560,7 @@ func (dot DownloadOCITarball) Call(ctx context.Context, cln *client.Client, val
 	}
 
 	exportFS.SessionOpts = append(exportFS.SessionOpts, llbutil.WithSyncTarget(llbutil.OutputFromWriter(f)))
+	withExportHook(ctx, &exportFS, ExportDownloadOCITarball, "", localPath)
 
 	exportValue, err := NewValue(ctx, exportFS)
 	if err != nil {
@@ -1218,6 +2634,7 @@ func (dot DownloadDockerTarball) Call(ctx context.Context, cln *client.Client, v
 	}
 
 	exportFS.SessionOpts = append(exportFS.SessionOpts, llbutil.WithSyncTarget(llbutil.OutputFromWriter(f)))
+	withExportHook(ctx, &exportFS, ExportDownloadDockerTarball, ref, localPath)
 
 	exportValue, err := NewValue(ctx, exportFS)
 	if err != nil {
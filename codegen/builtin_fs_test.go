@@ -0,0 +1,635 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	cerrdefs "github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/docker/api/types"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+)
+
+// manifestResolver resolves every ref to a single manifest, and records the
+// refs pushed to.
+type manifestResolver struct {
+	desc   specs.Descriptor
+	dt     []byte
+	pushed []string
+}
+
+func (mr *manifestResolver) Resolve(ctx context.Context, ref string) (string, specs.Descriptor, error) {
+	return ref, mr.desc, nil
+}
+
+func (mr *manifestResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return mr, nil
+}
+
+func (mr *manifestResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	mr.pushed = append(mr.pushed, ref)
+	return mr, nil
+}
+
+func (mr *manifestResolver) Push(ctx context.Context, desc specs.Descriptor) (content.Writer, error) {
+	return nil, cerrdefs.ErrAlreadyExists
+}
+
+func (mr *manifestResolver) Fetch(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(mr.dt)), nil
+}
+
+func TestCheckImageSize(t *testing.T) {
+	t.Parallel()
+
+	dt, err := json.Marshal(specs.Manifest{
+		Config: specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Size: 500},
+		Layers: []specs.Descriptor{
+			{MediaType: specs.MediaTypeImageLayerGzip, Size: 1500},
+		},
+	})
+	require.NoError(t, err)
+
+	resolver := &manifestResolver{
+		desc: specs.Descriptor{
+			MediaType: specs.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(dt),
+			Size:      int64(len(dt)),
+		},
+		dt: dt,
+	}
+
+	mod, err := parser.Parse(context.Background(), strings.NewReader(`
+fs default() {
+	image "alpine"
+	dockerPush "app" with maxImageSize(1999)
+}
+`))
+	require.NoError(t, err)
+	node := ast.Search(mod, "maxImageSize(1999)")
+	require.NotNil(t, node)
+
+	platform := specs.Platform{OS: "linux", Architecture: "amd64"}
+	err = checkImageSize(context.Background(), resolver, platform, "docker.io/library/app:latest", &MaxImageSize{
+		Bytes: 2000,
+		Node:  node,
+	})
+	require.NoError(t, err)
+
+	err = checkImageSize(context.Background(), resolver, platform, "docker.io/library/app:latest", &MaxImageSize{
+		Bytes: 1999,
+		Node:  node,
+	})
+	require.Error(t, err)
+	require.Equal(t, errdefs.WithImageSizeExceeded(node, "docker.io/library/app:latest", 2000, 1999).Error(), err.Error())
+	require.Contains(t, err.Error(), "is 2000 bytes, exceeding its size budget of 1999 bytes")
+	require.Len(t, diagnostic.Spans(err), 1)
+}
+
+func TestTagWithinBudget(t *testing.T) {
+	t.Parallel()
+
+	dt, err := json.Marshal(specs.Manifest{
+		Config: specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Size: 500},
+		Layers: []specs.Descriptor{
+			{MediaType: specs.MediaTypeImageLayerGzip, Size: 1500},
+		},
+	})
+	require.NoError(t, err)
+
+	desc := specs.Descriptor{
+		MediaType: specs.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}
+	pushed := "docker.io/library/app@" + desc.Digest.String()
+	platform := specs.Platform{OS: "linux", Architecture: "amd64"}
+
+	// An image over its budget is never tagged.
+	resolver := &manifestResolver{desc: desc, dt: dt}
+	err = tagWithinBudget(context.Background(), resolver, platform, pushed, "docker.io/library/app:latest", &MaxImageSize{
+		Bytes: 1999,
+		Node:  &ast.BasicLit{},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeding its size budget of 1999 bytes")
+	require.Empty(t, resolver.pushed)
+
+	resolver = &manifestResolver{desc: desc, dt: dt}
+	err = tagWithinBudget(context.Background(), resolver, platform, pushed, "docker.io/library/app:latest", &MaxImageSize{
+		Bytes: 2000,
+		Node:  &ast.BasicLit{},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker.io/library/app:latest"}, resolver.pushed)
+}
+
+func TestDevFrontend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	source := Filesystem{
+		State:    llb.Scratch().File(llb.Mkfile("/frontend", 0o755, []byte("#!/bin/sh"))),
+		Image:    &solver.ImageSpec{},
+		Platform: specs.Platform{OS: "linux", Architecture: "amd64"},
+	}
+	source.Image.Config.Entrypoint = []string{"/frontend"}
+
+	req := gateway.SolveRequest{
+		Frontend:       "gateway.v0",
+		FrontendOpt:    map[string]string{"build-arg:VERSION": "1"},
+		FrontendInputs: map[string]*pb.Definition{"context": {}},
+	}
+	err := withDevFrontend(ctx, &req, source)
+	require.NoError(t, err)
+
+	// The frontend is built by the Dockerfile frontend from its filesystem
+	// instead of being pulled from a registry.
+	md := req.FrontendOpt["gateway-input-metadata:hlb-frontend"]
+	delete(req.FrontendOpt, "gateway-input-metadata:hlb-frontend")
+	require.Equal(t, map[string]string{
+		"build-arg:VERSION":            "1",
+		"source":                       "dockerfile.v0",
+		"gateway-devel":                "true",
+		"gateway-context:hlb-frontend": "input:hlb-frontend",
+	}, req.FrontendOpt)
+
+	// The frontend runs the entrypoint of the image config of its filesystem.
+	var meta map[string][]byte
+	err = json.Unmarshal([]byte(md), &meta)
+	require.NoError(t, err)
+	var image solver.ImageSpec
+	err = json.Unmarshal(meta[llbutil.KeyContainerImageConfig], &image)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/frontend"}, image.Config.Entrypoint)
+
+	def, err := source.State.Marshal(ctx, llb.Platform(source.Platform))
+	require.NoError(t, err)
+	require.Equal(t, def.ToPB(), req.FrontendInputs[devFrontendInput])
+	require.Contains(t, req.FrontendInputs, "context")
+
+	var dockerfile []string
+	for _, dt := range req.FrontendInputs["dockerfile"].Def {
+		var op pb.Op
+		err = op.Unmarshal(dt)
+		require.NoError(t, err)
+		if file := op.GetFile(); file != nil {
+			mkfile := file.Actions[0].GetMkfile()
+			dockerfile = append(dockerfile, mkfile.Path, string(mkfile.Data))
+		}
+	}
+	require.Equal(t, []string{"/Dockerfile", "FROM hlb-frontend\n"}, dockerfile)
+}
+
+func TestDevFrontendReservedInput(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	fs default() {
+		devFrontend scratch with option {
+			input "dockerfile" scratch
+		}
+	}
+	`)
+	_, err := New(nil, nil).Generate(ctx, mod, []Target{{Name: "default"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `input "dockerfile" is reserved by devFrontend`)
+}
+
+func TestSubstituteScript(t *testing.T) {
+	t.Parallel()
+
+	for _, tool := range []string{"sh", "awk", "find", "tr", "wc", "tail", "cmp", "mktemp"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.conf":     "version={{VERSION}}\nenv={{ENV}} {{ENV}}\n",
+		"app.env":      "VERSION={{VERSION}}",
+		"nested/x.txt": "no placeholders\n",
+		"nested/y.txt": "\n\n{{VERSION}}\n\n",
+		"bin/app":      "\x7fELF\x00{{VERSION}}",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0600))
+	}
+
+	out, err := exec.Command("sh", "-c", SubstituteScript, "substitute", dir, "false",
+		"{{VERSION}}", "1.2.3",
+		"{{ENV}}", "prod&co\\1",
+	).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	for name, expected := range map[string]string{
+		"app.conf":     "version=1.2.3\nenv=prod&co\\1 prod&co\\1\n",
+		"app.env":      "VERSION=1.2.3",
+		"nested/x.txt": "no placeholders\n",
+		"nested/y.txt": "\n\n1.2.3\n\n",
+		"bin/app":      "\x7fELF\x00{{VERSION}}",
+	} {
+		dt, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(dt), name)
+	}
+
+	// A wildcard only substitutes the files it matches.
+	for _, name := range []string{"a.tmpl", "b.tmpl", "c.txt"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("{{VERSION}}"), 0600))
+	}
+	out, err = exec.Command("sh", "-c", SubstituteScript, "substitute", filepath.Join(dir, "*.tmpl"), "true",
+		"{{VERSION}}", "2.0.0",
+	).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	for name, expected := range map[string]string{
+		"a.tmpl": "2.0.0",
+		"b.tmpl": "2.0.0",
+		"c.txt":  "{{VERSION}}",
+	} {
+		dt, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(dt), name)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "app.conf"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestVerifyManifestScript(t *testing.T) {
+	t.Parallel()
+
+	for _, tool := range []string{"sh", "awk", "find", "sort", "sha256sum", "mktemp", "readlink", "wc"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.txt":          "a",
+		"sub/b.txt":      "b",
+		"with space.txt": "c",
+	} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0600))
+	}
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(dir, "link")))
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteLocalManifest(dir, &buf))
+	entries, err := ReadLocalManifest(&buf)
+	require.NoError(t, err)
+
+	manifest := filepath.Join(t.TempDir(), "manifest")
+	require.NoError(t, ioutil.WriteFile(manifest, verifyManifestInput(entries), 0600))
+
+	verify := func(allowExtra bool) (string, error) {
+		out, err := exec.Command("sh", "-c", VerifyManifestScript, "verify", dir, manifest,
+			fmt.Sprint(allowExtra), fmt.Sprint(maxManifestDiscrepancies), "src.manifest",
+		).CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := verify(false)
+	require.NoError(t, err, out)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub/b.txt"), []byte("B"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "with space.txt"), []byte("cc"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "link")))
+	require.NoError(t, os.Symlink("b.txt", filepath.Join(dir, "link")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "extra.txt"), nil, 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "a.txt")))
+
+	out, err = verify(false)
+	require.Error(t, err)
+	require.Equal(t, strings.Join([]string{
+		"local files do not match manifest src.manifest",
+		"  missing a.txt (src.manifest:1)",
+		fmt.Sprintf("  modified link (src.manifest:2): expected %s, got %s", digest.FromString("a.txt"), digest.FromString("b.txt")),
+		fmt.Sprintf("  modified sub/b.txt (src.manifest:3): expected %s, got %s", digest.FromString("b"), digest.FromString("B")),
+		"  modified with space.txt (src.manifest:4): expected 1 bytes, got 2 bytes",
+		"  extra extra.txt",
+		"",
+	}, "\n"), out)
+
+	// Files that are not in the manifest are allowed with allowExtra.
+	out, err = verify(true)
+	require.Error(t, err)
+	require.NotContains(t, out, "extra.txt")
+	require.Contains(t, out, "missing a.txt")
+}
+
+func TestChmodScript(t *testing.T) {
+	t.Parallel()
+
+	for _, tool := range []string{"sh", "find", "chmod"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "static/app.js", "static/img/logo.png"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		require.NoError(t, ioutil.WriteFile(p, nil, 0600))
+	}
+	require.NoError(t, os.Symlink("index.html", filepath.Join(dir, "default.html")))
+
+	out, err := exec.Command("sh", "-c", ChmodScript, "chmod", dir, "false", "644", "755").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	for name, expected := range map[string]os.FileMode{
+		".":                   os.ModeDir | 0755,
+		"static":              os.ModeDir | 0755,
+		"static/img":          os.ModeDir | 0755,
+		"index.html":          0644,
+		"static/app.js":       0644,
+		"static/img/logo.png": 0644,
+		"default.html":        os.ModeSymlink,
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		if expected&os.ModeSymlink != 0 {
+			require.Equal(t, os.ModeSymlink, fi.Mode().Type(), name)
+			continue
+		}
+		require.Equal(t, expected, fi.Mode(), name)
+	}
+
+	// An empty mode leaves the permissions unchanged.
+	out, err = exec.Command("sh", "-c", ChmodScript, "chmod", dir, "false", "", "700").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	fi, err := os.Stat(filepath.Join(dir, "static"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	fi, err = os.Stat(filepath.Join(dir, "index.html"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	// A wildcard only changes the paths it matches.
+	out, err = exec.Command("sh", "-c", ChmodScript, "chmod", filepath.Join(dir, "static", "*.js"), "true", "600", "").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	fi, err = os.Stat(filepath.Join(dir, "static", "app.js"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	fi, err = os.Stat(filepath.Join(dir, "index.html"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+}
+
+func TestManifestScript(t *testing.T) {
+	t.Parallel()
+
+	for _, tool := range []string{"sh", "find", "sort", "sha256sum", "stat", "readlink"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	for name, file := range map[string]struct {
+		content string
+		mode    os.FileMode
+	}{
+		"srv/app.conf":     {"listen 80\n", 0644},
+		"srv/bin/app":      {"\x7fELF", 0755},
+		"srv/my report.md": {"", 0600},
+	} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(file.content), file.mode))
+		require.NoError(t, os.Chmod(p, file.mode))
+	}
+	require.NoError(t, os.Symlink("bin/app", filepath.Join(dir, "srv/current")))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "srv/empty"), 0755))
+
+	manifest := filepath.Join(t.TempDir(), "out/manifest.txt")
+	out, err := exec.Command("sh", "-c", ManifestScript, "manifest", dir, manifest).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	dt, err := ioutil.ReadFile(manifest)
+	require.NoError(t, err)
+	require.Equal(t, strings.Join([]string{
+		fmt.Sprintf("%s 644 srv/app.conf", digest.FromString("listen 80\n")),
+		fmt.Sprintf("%s 755 srv/bin/app", digest.FromString("\x7fELF")),
+		fmt.Sprintf("%s 777 srv/current", digest.FromString("bin/app")),
+		fmt.Sprintf("%s 600 srv/my report.md", digest.FromString("")),
+		"",
+	}, "\n"), string(dt))
+}
+
+func TestStdin(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	execDigest := func(t *testing.T, content string) (digest.Digest, *llb.Definition) {
+		val, err := Stdin{}.Call(ctx, nil, ZeroValue(ctx), nil, content)
+		require.NoError(t, err)
+		opts, err := val.Option()
+		require.NoError(t, err)
+		require.Len(t, opts, 1)
+
+		args, runOpts := opts[0].(*Stdin).Wrap([]string{"/bin/sh", "-c", "psql"}, specs.Platform{OS: "linux", Architecture: "amd64"})
+		require.Equal(t, []string{"/bin/sh", "-c", `exec "$@" < /run/hlb/stdin`, "stdin", "/bin/sh", "-c", "psql"}, args)
+
+		st := llb.Image("postgres").Run(append(runOpts, llb.Args(args))...).Root()
+		def, err := st.Marshal(ctx, llb.LinuxAmd64)
+		require.NoError(t, err)
+
+		// The exec is the second to last op, before the op that selects its
+		// output.
+		return digest.FromBytes(def.Def[len(def.Def)-2]), def
+	}
+
+	t.Run("content changes the cache key", func(t *testing.T) {
+		a, _ := execDigest(t, "CREATE TABLE foo ();")
+		b, _ := execDigest(t, "CREATE TABLE foo ();")
+		c, _ := execDigest(t, "CREATE TABLE bar ();")
+		require.Equal(t, a, b)
+		require.NotEqual(t, a, c)
+	})
+
+	t.Run("multi-megabyte document", func(t *testing.T) {
+		content := strings.Repeat("INSERT INTO foo VALUES (1);\n", 4<<20/28)
+		_, def := execDigest(t, content)
+
+		var found bool
+		for _, dt := range def.Def {
+			var op pb.Op
+			require.NoError(t, op.Unmarshal(dt))
+			if file := op.GetFile(); file != nil {
+				mkfile := file.Actions[0].GetMkfile()
+				require.NotNil(t, mkfile)
+				require.Equal(t, content, string(mkfile.Data))
+				found = true
+			}
+			if exec := op.GetExec(); exec != nil {
+				for _, arg := range exec.Meta.Args {
+					require.Less(t, len(arg), 1024)
+				}
+			}
+		}
+		require.True(t, found)
+	})
+}
+
+func TestCombineScript(t *testing.T) {
+	t.Parallel()
+
+	for _, tool := range []string{"sh", "find", "cmp", "readlink", "mktemp"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+
+	type stage map[string]string
+
+	for _, tc := range []struct {
+		name      string
+		stages    []stage
+		conflicts []string
+	}{{
+		"disjoint stages",
+		[]stage{{"bin/a": "a"}, {"bin/b": "b"}, {"lib/c": "c"}},
+		nil,
+	}, {
+		"identical files",
+		[]stage{{"etc/os-release": "alpine"}, {"etc/os-release": "alpine", "bin/b": "b"}},
+		nil,
+	}, {
+		"differing files",
+		[]stage{{"bin/app": "v1"}, {"bin/tool": "tool"}, {"bin/app": "v2"}},
+		[]string{"/bin/app differs between stages 1 and 3"},
+	}, {
+		"file and directory",
+		[]stage{{"app": "file"}, {"app/main": "main"}},
+		[]string{"/app differs between stages 1 and 2"},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			args := []string{"-c", CombineScript, "combine"}
+			for i, files := range tc.stages {
+				dir := filepath.Join(root, fmt.Sprint(i))
+				require.NoError(t, os.MkdirAll(dir, 0755))
+				for name, content := range files {
+					p := filepath.Join(dir, name)
+					require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+					require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+				}
+				args = append(args, dir)
+			}
+
+			out, err := exec.Command("sh", args...).CombinedOutput()
+			if len(tc.conflicts) == 0 {
+				require.NoError(t, err, string(out))
+				return
+			}
+			require.Error(t, err)
+			for _, conflict := range tc.conflicts {
+				require.Contains(t, string(out), conflict)
+			}
+		})
+	}
+}
+
+func TestLargeFilesScript(t *testing.T) {
+	t.Parallel()
+
+	for _, tool := range []string{"sh", "sha256sum", "grep"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %s", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "models"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "models/weights.bin"), []byte("weights"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "archive.tar"), []byte("archive"), 0600))
+
+	sums := filepath.Join(t.TempDir(), "sha256sums")
+	require.NoError(t, ioutil.WriteFile(sums, []byte(fmt.Sprintf("%s  models/weights.bin\n%s  archive.tar\n",
+		digest.FromString("weights").Encoded(),
+		digest.FromString("archive").Encoded(),
+	)), 0600))
+
+	verify := func() (string, error) {
+		out, err := exec.Command("sh", "-c", LargeFilesScript, "verify", dir, sums).CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := verify()
+	require.NoError(t, err, out)
+
+	// A large file that changed after it was hashed fails the build.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "archive.tar"), []byte("changed"), 0600))
+	out, err = verify()
+	require.Error(t, err)
+	require.Contains(t, out, "large files changed while they were synced:")
+	require.Contains(t, out, "archive.tar")
+	require.NotContains(t, out, "weights.bin")
+}
+
+type fakePushClient struct {
+	dockerclient.APIClient
+	messages string
+}
+
+func (c *fakePushClient) ImagePush(ctx context.Context, ref string, opts types.ImagePushOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(c.messages)), nil
+}
+
+type fakeSubLogger struct{}
+
+func (fakeSubLogger) Wrap(name string, fn func() error) error { return fn() }
+func (fakeSubLogger) Log(stream int, dt []byte)               {}
+func (fakeSubLogger) SetStatus(*client.VertexStatus)          {}
+
+func TestPushWithMobyDigest(t *testing.T) {
+	t.Parallel()
+
+	dockerAPI := DockerAPIClient{
+		APIClient: &fakePushClient{messages: `{"status":"Pushed","id":"abc"}
+{"status":"latest: digest: sha256:def size: 528"}
+{"progressDetail":{},"aux":{"Tag":"latest","Digest":"sha256:def","Size":528}}
+`},
+	}
+	dgst, err := pushWithMoby(context.Background(), dockerAPI, "docker.io/library/app:latest", fakeSubLogger{})
+	require.NoError(t, err)
+	require.Equal(t, digest.Digest("sha256:def"), dgst)
+}
@@ -0,0 +1,488 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/imageutil"
+	"github.com/openllb/hlb/solver"
+)
+
+// ConfigMutation changes the image config of a filesystem. The image config
+// builtins and the options of imageConfig are mutations, so that they change
+// the config the same way. Fields that also apply to later calls in the
+// filesystem block, like the environment, working directory and user, are set
+// on its state too.
+//
+// Mutations copy the maps and slices they change, because the config may be
+// shared with the base image and other filesystems.
+type ConfigMutation func(fs *Filesystem)
+
+// mutateConfig applies mutations to the filesystem of val in order.
+func mutateConfig(ctx context.Context, val Value, mutations ...ConfigMutation) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+	for _, mutate := range mutations {
+		mutate(&fs)
+	}
+	return NewValue(ctx, fs)
+}
+
+func setEnv(key, value string) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.State = fs.State.AddEnv(key, value)
+		env := fs.Image.Config.Env
+		fs.Image.Config.Env = append(env[:len(env):len(env)], fmt.Sprintf("%s=%s", key, value))
+	}
+}
+
+// setWorkdir sets the working directory, relative to the current working
+// directory if it is not absolute. The argument setting it is kept for the
+// preflight of later runs.
+func setWorkdir(wd string, arg ast.Node) ConfigMutation {
+	return func(fs *Filesystem) {
+		if !path.IsAbs(wd) {
+			wd = path.Join("/", fs.Image.Config.WorkingDir, wd)
+		}
+		fs.State = fs.State.Dir(wd)
+		fs.Image.Config.WorkingDir = wd
+		fs.workdirArg = arg
+	}
+}
+
+func setUser(name string, arg ast.Node) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.State = fs.State.User(name)
+		fs.Image.Config.User = name
+		fs.userArg = arg
+	}
+}
+
+func setEntrypoint(args []string) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.Entrypoint = args
+	}
+}
+
+func setCmd(args []string) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.Cmd = args
+	}
+}
+
+func setLabel(key, value string) ConfigMutation {
+	return func(fs *Filesystem) {
+		labels := make(map[string]string, len(fs.Image.Config.Labels)+1)
+		for k, v := range fs.Image.Config.Labels {
+			labels[k] = v
+		}
+		labels[key] = value
+		fs.Image.Config.Labels = labels
+	}
+}
+
+func removeLabel(key string) ConfigMutation {
+	return func(fs *Filesystem) {
+		if _, ok := fs.Image.Config.Labels[key]; !ok {
+			return
+		}
+		labels := make(map[string]string, len(fs.Image.Config.Labels))
+		for k, v := range fs.Image.Config.Labels {
+			if k != key {
+				labels[k] = v
+			}
+		}
+		fs.Image.Config.Labels = labels
+	}
+}
+
+func addVolumes(mountpoints []string) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.Volumes = union(fs.Image.Config.Volumes, mountpoints)
+	}
+}
+
+// addExposedPorts exposes ports, which must already be expanded from their
+// port specs.
+func addExposedPorts(ports []string) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.ExposedPorts = union(fs.Image.Config.ExposedPorts, ports)
+	}
+}
+
+func union(set map[string]struct{}, keys []string) map[string]struct{} {
+	u := make(map[string]struct{}, len(set)+len(keys))
+	for k := range set {
+		u[k] = struct{}{}
+	}
+	for _, k := range keys {
+		u[k] = struct{}{}
+	}
+	return u
+}
+
+func setStopSignal(signal string) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.StopSignal = signal
+	}
+}
+
+func setHealthcheck(hc *solver.HealthConfig) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.Healthcheck = hc
+	}
+}
+
+func setArgsEscaped(escaped bool) ConfigMutation {
+	return func(fs *Filesystem) {
+		fs.Image.Config.ArgsEscaped = escaped
+	}
+}
+
+// expandPorts expands the port specs of a builtin's arguments.
+func expandPorts(ctx context.Context, specs []string) ([]string, error) {
+	var ports []string
+	for i, spec := range specs {
+		expanded, err := imageutil.ParsePortSpec(spec)
+		if err != nil {
+			return nil, errdefs.WithInvalidPortSpec(Arg(ctx, i), spec, err)
+		}
+		ports = append(ports, expanded...)
+	}
+	return ports, nil
+}
+
+type ImageConfig struct{}
+
+func (ic ImageConfig) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	var mutations []ConfigMutation
+	for _, opt := range opts {
+		if mutate, ok := opt.(ConfigMutation); ok {
+			mutations = append(mutations, mutate)
+		}
+	}
+	return mutateConfig(ctx, val, mutations...)
+}
+
+// configOption returns the options of val with a config mutation.
+func configOption(ctx context.Context, val Value, mutate ConfigMutation) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, mutate))
+}
+
+type ConfigEntrypoint struct{}
+
+func (ce ConfigEntrypoint) Call(ctx context.Context, cln *client.Client, val Value, opts Option, args ...string) (Value, error) {
+	return configOption(ctx, val, setEntrypoint(args))
+}
+
+type ConfigCmd struct{}
+
+func (cc ConfigCmd) Call(ctx context.Context, cln *client.Client, val Value, opts Option, args ...string) (Value, error) {
+	return configOption(ctx, val, setCmd(args))
+}
+
+type ConfigEnv struct{}
+
+func (ce ConfigEnv) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key, value string) (Value, error) {
+	return configOption(ctx, val, setEnv(key, value))
+}
+
+type ConfigWorkdir struct{}
+
+func (cw ConfigWorkdir) Call(ctx context.Context, cln *client.Client, val Value, opts Option, wd string) (Value, error) {
+	return configOption(ctx, val, setWorkdir(wd, Arg(ctx, 0)))
+}
+
+type ConfigUser struct{}
+
+func (cu ConfigUser) Call(ctx context.Context, cln *client.Client, val Value, opts Option, name string) (Value, error) {
+	return configOption(ctx, val, setUser(name, Arg(ctx, 0)))
+}
+
+type ConfigLabel struct{}
+
+func (cl ConfigLabel) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key, value string) (Value, error) {
+	return configOption(ctx, val, setLabel(key, value))
+}
+
+type ConfigRemoveLabel struct{}
+
+func (crl ConfigRemoveLabel) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key string) (Value, error) {
+	return configOption(ctx, val, removeLabel(key))
+}
+
+type ConfigVolume struct{}
+
+func (cv ConfigVolume) Call(ctx context.Context, cln *client.Client, val Value, opts Option, mountpoints ...string) (Value, error) {
+	return configOption(ctx, val, addVolumes(mountpoints))
+}
+
+type ConfigExposed struct{}
+
+func (ce ConfigExposed) Call(ctx context.Context, cln *client.Client, val Value, opts Option, specs ...string) (Value, error) {
+	ports, err := expandPorts(ctx, specs)
+	if err != nil {
+		return nil, err
+	}
+	return configOption(ctx, val, addExposedPorts(ports))
+}
+
+type ConfigStopSignal struct{}
+
+func (css ConfigStopSignal) Call(ctx context.Context, cln *client.Client, val Value, opts Option, signal string) (Value, error) {
+	return configOption(ctx, val, setStopSignal(signal))
+}
+
+type ConfigArgsEscaped struct{}
+
+func (cae ConfigArgsEscaped) Call(ctx context.Context, cln *client.Client, val Value, opts Option, escaped bool) (Value, error) {
+	return configOption(ctx, val, setArgsEscaped(escaped))
+}
+
+// HealthcheckOption changes how a healthcheck is run.
+type HealthcheckOption func(hc *solver.HealthConfig)
+
+type ConfigHealthcheck struct{}
+
+func (ch ConfigHealthcheck) Call(ctx context.Context, cln *client.Client, val Value, opts Option, test ...string) (Value, error) {
+	if len(test) == 0 {
+		return nil, errdefs.WithInvalidHealthcheck(ProgramCounter(ctx), "expected NONE, CMD or CMD-SHELL and its arguments")
+	}
+	switch test[0] {
+	case "NONE":
+		if len(test) > 1 {
+			return nil, errdefs.WithInvalidHealthcheck(Arg(ctx, 1), "NONE takes no arguments")
+		}
+	case "CMD", "CMD-SHELL":
+		if len(test) == 1 {
+			return nil, errdefs.WithInvalidHealthcheck(Arg(ctx, 0), fmt.Sprintf("%s requires a command", test[0]))
+		}
+	default:
+		return nil, errdefs.WithInvalidHealthcheck(Arg(ctx, 0), "expected NONE, CMD or CMD-SHELL")
+	}
+
+	hc := &solver.HealthConfig{Test: test}
+	for _, opt := range opts {
+		if o, ok := opt.(HealthcheckOption); ok {
+			o(hc)
+		}
+	}
+	return configOption(ctx, val, setHealthcheck(hc))
+}
+
+// healthcheckOption returns the options of val with a healthcheck option.
+func healthcheckOption(ctx context.Context, val Value, opt HealthcheckOption) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, opt))
+}
+
+type HealthcheckInterval struct{}
+
+func (hi HealthcheckInterval) Call(ctx context.Context, cln *client.Client, val Value, opts Option, interval time.Duration) (Value, error) {
+	return healthcheckOption(ctx, val, func(hc *solver.HealthConfig) {
+		hc.Interval = interval
+	})
+}
+
+type HealthcheckTimeout struct{}
+
+func (ht HealthcheckTimeout) Call(ctx context.Context, cln *client.Client, val Value, opts Option, timeout time.Duration) (Value, error) {
+	return healthcheckOption(ctx, val, func(hc *solver.HealthConfig) {
+		hc.Timeout = timeout
+	})
+}
+
+type HealthcheckStartPeriod struct{}
+
+func (hsp HealthcheckStartPeriod) Call(ctx context.Context, cln *client.Client, val Value, opts Option, startPeriod time.Duration) (Value, error) {
+	return healthcheckOption(ctx, val, func(hc *solver.HealthConfig) {
+		hc.StartPeriod = startPeriod
+	})
+}
+
+type HealthcheckRetries struct{}
+
+func (hr HealthcheckRetries) Call(ctx context.Context, cln *client.Client, val Value, opts Option, retries int) (Value, error) {
+	return healthcheckOption(ctx, val, func(hc *solver.HealthConfig) {
+		hc.Retries = retries
+	})
+}
+
+// ConfigDiff is a report of the changes to the image config of a filesystem
+// relative to its base image. Parts of the config that are unchanged are nil.
+type ConfigDiff struct {
+	// Base is the canonical reference of the base image, or empty if the
+	// filesystem did not start from an image.
+	Base string `json:"base,omitempty"`
+
+	Env          *MapDiff   `json:"env,omitempty"`
+	Labels       *MapDiff   `json:"labels,omitempty"`
+	ExposedPorts *SetDiff   `json:"exposedPorts,omitempty"`
+	Volumes      *SetDiff   `json:"volumes,omitempty"`
+	Entrypoint   *ValueDiff `json:"entrypoint,omitempty"`
+	Cmd          *ValueDiff `json:"cmd,omitempty"`
+	WorkingDir   *ValueDiff `json:"workingDir,omitempty"`
+	User         *ValueDiff `json:"user,omitempty"`
+	StopSignal   *ValueDiff `json:"stopSignal,omitempty"`
+	Healthcheck  *ValueDiff `json:"healthcheck,omitempty"`
+}
+
+// MapDiff is the keys added, removed and changed in a map, like the
+// environment or the labels.
+type MapDiff struct {
+	Added   map[string]string    `json:"added,omitempty"`
+	Removed map[string]string    `json:"removed,omitempty"`
+	Changed map[string]ValueDiff `json:"changed,omitempty"`
+}
+
+// SetDiff is the sorted elements added to and removed from a set, like the
+// exposed ports or the volumes.
+type SetDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ValueDiff is a value of the base image that was changed.
+type ValueDiff struct {
+	Base  interface{} `json:"base"`
+	Final interface{} `json:"final"`
+}
+
+// DiffImageConfig returns the changes of the config of final relative to the
+// config of base. A nil base is an empty config.
+func DiffImageConfig(base, final *solver.ImageSpec) *ConfigDiff {
+	if base == nil {
+		base = &solver.ImageSpec{}
+	}
+	if final == nil {
+		final = &solver.ImageSpec{}
+	}
+
+	diff := &ConfigDiff{}
+	if base.Canonical != nil {
+		diff.Base = base.Canonical.String()
+	}
+
+	bc, fc := base.Config, final.Config
+	diff.Env = diffMap(envMap(bc.Env), envMap(fc.Env))
+	diff.Labels = diffMap(bc.Labels, fc.Labels)
+	diff.ExposedPorts = diffSet(bc.ExposedPorts, fc.ExposedPorts)
+	diff.Volumes = diffSet(bc.Volumes, fc.Volumes)
+	diff.Entrypoint = diffValue(bc.Entrypoint, fc.Entrypoint)
+	diff.Cmd = diffValue(bc.Cmd, fc.Cmd)
+	diff.WorkingDir = diffValue(bc.WorkingDir, fc.WorkingDir)
+	diff.User = diffValue(bc.User, fc.User)
+	diff.StopSignal = diffValue(bc.StopSignal, fc.StopSignal)
+	diff.Healthcheck = diffValue(bc.Healthcheck, fc.Healthcheck)
+	return diff
+}
+
+// envMap returns the environment variables of a config by key. Later
+// variables override earlier ones, like they do in a container.
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m
+}
+
+func diffMap(base, final map[string]string) *MapDiff {
+	diff := &MapDiff{}
+	for k, fv := range final {
+		bv, ok := base[k]
+		switch {
+		case !ok:
+			if diff.Added == nil {
+				diff.Added = make(map[string]string)
+			}
+			diff.Added[k] = fv
+		case bv != fv:
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]ValueDiff)
+			}
+			diff.Changed[k] = ValueDiff{Base: bv, Final: fv}
+		}
+	}
+	for k, bv := range base {
+		if _, ok := final[k]; !ok {
+			if diff.Removed == nil {
+				diff.Removed = make(map[string]string)
+			}
+			diff.Removed[k] = bv
+		}
+	}
+	if diff.Added == nil && diff.Removed == nil && diff.Changed == nil {
+		return nil
+	}
+	return diff
+}
+
+func diffSet(base, final map[string]struct{}) *SetDiff {
+	diff := &SetDiff{}
+	for k := range final {
+		if _, ok := base[k]; !ok {
+			diff.Added = append(diff.Added, k)
+		}
+	}
+	for k := range base {
+		if _, ok := final[k]; !ok {
+			diff.Removed = append(diff.Removed, k)
+		}
+	}
+	if diff.Added == nil && diff.Removed == nil {
+		return nil
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// diffValue compares values of the same type. Empty values are the same,
+// like a nil and an empty slice, since both are omitted from the config.
+func diffValue(base, final interface{}) *ValueDiff {
+	bv, fv := reflect.ValueOf(base), reflect.ValueOf(final)
+	if (isEmpty(bv) && isEmpty(fv)) || reflect.DeepEqual(base, final) {
+		return nil
+	}
+	return &ValueDiff{Base: base, Final: final}
+}
+
+func isEmpty(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice {
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+type ImageConfigDiff struct{}
+
+func (icd ImageConfigDiff) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem) (Value, error) {
+	dt, err := json.MarshalIndent(DiffImageConfig(input.Base, input.Image), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, string(dt))
+}
@@ -1,17 +1,21 @@
 package codegen
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/containerd/containerd/platforms"
 	shellquote "github.com/kballard/go-shellquote"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
@@ -21,9 +25,11 @@ import (
 	"github.com/moby/buildkit/util/entitlements"
 	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openllb/hlb/checker"
 	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/parser"
 	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/gitattributes"
 	"github.com/openllb/hlb/pkg/llbutil"
 	"github.com/openllb/hlb/pkg/sockproxy"
 	"github.com/openllb/hlb/solver"
@@ -59,6 +65,27 @@ func (c Chmod) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 	return NewValue(ctx, append(retOpts, llb.Chmod(mode)))
 }
 
+type SelectPlatformWhen struct {
+	Platform specs.Platform
+	Input    Thunk
+}
+
+func (spw SelectPlatformWhen) Call(ctx context.Context, cln *client.Client, val Value, opts Option, platform string, input Thunk) (Value, error) {
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, errdefs.WithInvalidPlatform(err, Arg(ctx, 0), platform)
+	}
+
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &SelectPlatformWhen{
+		Platform: platforms.Normalize(p),
+		Input:    input,
+	}))
+}
+
 type Filename struct{}
 
 func (f Filename) Call(ctx context.Context, cln *client.Client, val Value, opts Option, filename string) (Value, error) {
@@ -81,6 +108,42 @@ func (kgd KeepGitDir) Call(ctx context.Context, cln *client.Client, val Value, o
 	return NewValue(ctx, append(retOpts, llb.KeepGitDir()))
 }
 
+type GitDepth struct{}
+
+func (gd GitDepth) Call(ctx context.Context, cln *client.Client, val Value, opts Option, depth int) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	// BuildKit git sources are always fetched with a depth of 1 and have no
+	// attribute to change it.
+	if depth != 1 {
+		return nil, errdefs.WithUnsupportedGitDepth(Arg(ctx, 0), depth)
+	}
+	return NewValue(ctx, retOpts)
+}
+
+type GitShallowSince struct{}
+
+func (gss GitShallowSince) Call(ctx context.Context, cln *client.Client, val Value, opts Option, date string) (Value, error) {
+	return nil, errdefs.WithUnsupportedGitOption(ProgramCounter(ctx), "shallowSince")
+}
+
+type GitCommit struct{}
+
+func (gc GitCommit) Call(ctx context.Context, cln *client.Client, val Value, opts Option, sha string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if !llbutil.IsCommitSHA(sha) {
+		return nil, errdefs.WithInvalidCommitSHA(Arg(ctx, 0), sha)
+	}
+	return NewValue(ctx, append(retOpts, llbutil.GitCommitOption{SHA: sha}))
+}
+
 type IncludePatterns struct{}
 
 func (ip IncludePatterns) Call(ctx context.Context, cln *client.Client, val Value, opts Option, patterns ...string) (Value, error) {
@@ -100,9 +163,327 @@ func (ep ExcludePatterns) Call(ctx context.Context, cln *client.Client, val Valu
 		return nil, err
 	}
 
+	for i, pattern := range patterns {
+		err = llbutil.ValidatePattern(pattern)
+		if err != nil {
+			return nil, errdefs.WithInvalidPattern(Arg(ctx, i), pattern, err)
+		}
+	}
 	return NewValue(ctx, append(retOpts, llbutil.WithExcludePatterns(patterns)))
 }
 
+type ExcludeExtensions struct{}
+
+func (ee ExcludeExtensions) Call(ctx context.Context, cln *client.Client, val Value, opts Option, extensions ...string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for _, ext := range extensions {
+		patterns = append(patterns, "**/*."+strings.TrimPrefix(ext, "."))
+	}
+	return NewValue(ctx, append(retOpts, llbutil.WithExcludePatterns(patterns)))
+}
+
+// LocalIgnoreFile is an ignore file whose patterns are excluded from a local
+// source. When Path is empty, the default ignore files are looked up in the
+// root of the local directory instead.
+type LocalIgnoreFile struct {
+	Path string
+	Node ast.Node
+}
+
+type IgnoreFile struct{}
+
+func (igf IgnoreFile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, filename string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err = parser.ResolvePath(ModuleDir(ctx), filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &LocalIgnoreFile{Path: filename, Node: Arg(ctx, 0)}))
+}
+
+type UseIgnoreFile struct{}
+
+func (uif UseIgnoreFile) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &LocalIgnoreFile{Node: ProgramCounter(ctx)}))
+}
+
+// LocalManifest is a manifest of the files expected in a local source, which
+// fails the build if the files synced up do not match it.
+type LocalManifest struct {
+	Path string
+	Node ast.Node
+}
+
+type VerifyManifest struct{}
+
+func (vm VerifyManifest) Call(ctx context.Context, cln *client.Client, val Value, opts Option, filename string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err = parser.ResolvePath(ModuleDir(ctx), filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &LocalManifest{Path: filename, Node: Arg(ctx, 0)}))
+}
+
+// AllowExtraFiles allows a local source to have files that are not in its
+// manifest.
+type AllowExtraFiles struct{}
+
+type AllowExtra struct{}
+
+func (ae AllowExtra) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, AllowExtraFiles{}))
+}
+
+// LargeFileThreshold skips transferring the files of a local source that are
+// at least as large as Bytes when their content has not changed.
+type LargeFileThreshold struct {
+	Bytes int64
+}
+
+func (lft LargeFileThreshold) Call(ctx context.Context, cln *client.Client, val Value, opts Option, bytes int) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes < 1 {
+		return nil, errdefs.WithInvalidLargeFileThreshold(Arg(ctx, 0), bytes)
+	}
+	return NewValue(ctx, append(retOpts, &LargeFileThreshold{Bytes: int64(bytes)}))
+}
+
+// UntrackedFiles syncs the files of a worktree that git does not track and
+// does not ignore with localGit.
+type UntrackedFiles struct{}
+
+type IncludeUntracked struct{}
+
+func (iu IncludeUntracked) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, UntrackedFiles{}))
+}
+
+// SubmoduleFiles syncs the tracked files of submodules with localGit.
+type SubmoduleFiles struct{}
+
+type Submodules struct{}
+
+func (s Submodules) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, SubmoduleFiles{}))
+}
+
+// LocalGitSubdir scopes localGit to a directory of the worktree.
+type LocalGitSubdir struct {
+	Path string
+	Node ast.Node
+}
+
+type Subdir struct{}
+
+func (s Subdir) Call(ctx context.Context, cln *client.Client, val Value, opts Option, subdir string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &LocalGitSubdir{Path: subdir, Node: Arg(ctx, 0)}))
+}
+
+// RepoRelativePaths keeps the paths of the files of a localGit subdir relative
+// to the root of the worktree.
+type RepoRelativePaths struct{}
+
+type RepoRelative struct{}
+
+func (rr RepoRelative) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, RepoRelativePaths{}))
+}
+
+type MaxSize struct {
+	Bytes int64
+}
+
+func (ms MaxSize) Call(ctx context.Context, cln *client.Client, val Value, opts Option, bytes int) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes < 0 {
+		return nil, errdefs.WithInvalidMaxSize(Arg(ctx, 0), bytes)
+	}
+	return NewValue(ctx, append(retOpts, &MaxSize{Bytes: int64(bytes)}))
+}
+
+// ExportIgnore excludes the files with the export-ignore attribute in the
+// .gitattributes of a git source from a copy.
+type ExportIgnore struct {
+	Node ast.Node
+}
+
+func (ei ExportIgnore) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &ExportIgnore{Node: ProgramCounter(ctx)}))
+}
+
+// Patterns returns the exclude patterns for copying src from a git source.
+// The .gitattributes is read from the root of the repository, and a
+// repository without one excludes nothing.
+func (ei *ExportIgnore) Patterns(ctx context.Context, cln *client.Client, input Filesystem, src string) ([]string, error) {
+	source, err := llbutil.SourceOp(ctx, input.State)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil || !strings.HasPrefix(source.Identifier, "git://") {
+		return nil, errdefs.WithUnsupportedExportIgnore(ei.Node)
+	}
+
+	dt, err := readPath(ctx, cln, input, gitattributes.Filename)
+	if err != nil {
+		if errdefs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	patterns, err := gitattributes.ExportIgnore(bytes.NewReader(dt), src)
+	if err != nil {
+		return nil, ei.Node.WithError(err)
+	}
+	return patterns, nil
+}
+
+type Substitute struct {
+	Placeholder string
+	Value       string
+}
+
+func (s Substitute) Call(ctx context.Context, cln *client.Client, val Value, opts Option, placeholder, value string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if placeholder == "" {
+		return nil, errdefs.WithEmptyPlaceholder(Arg(ctx, 0))
+	}
+	return NewValue(ctx, append(retOpts, &Substitute{Placeholder: placeholder, Value: value}))
+}
+
+type CopyManifest struct {
+	Path string
+	Bind bool
+}
+
+func (cm CopyManifest) Call(ctx context.Context, cln *client.Client, val Value, opts Option, p string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &CopyManifest{
+		Path: p,
+		Bind: Binding(ctx).Binds() == "manifest",
+	}))
+}
+
+type CopyFileMode struct {
+	Mode os.FileMode
+}
+
+func (cfm CopyFileMode) Call(ctx context.Context, cln *client.Client, val Value, opts Option, mode os.FileMode) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &CopyFileMode{Mode: mode}))
+}
+
+type CopyDirMode struct {
+	Mode os.FileMode
+}
+
+func (cdm CopyDirMode) Call(ctx context.Context, cln *client.Client, val Value, opts Option, mode os.FileMode) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &CopyDirMode{Mode: mode}))
+}
+
+// Conflict policies for combining stages.
+const (
+	ConflictLast  = "last"
+	ConflictFirst = "first"
+	ConflictError = "error"
+)
+
+type CombineConflict struct {
+	Policy string
+}
+
+func (cc CombineConflict) Call(ctx context.Context, cln *client.Client, val Value, opts Option, policy string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	switch policy {
+	case ConflictLast, ConflictFirst, ConflictError:
+	default:
+		return nil, errdefs.WithInvalidConflictPolicy(Arg(ctx, 0), policy, checker.ConflictPolicies)
+	}
+	return NewValue(ctx, append(retOpts, &CombineConflict{Policy: policy}))
+}
+
+type StripHelper struct {
+	Helper Filesystem
+}
+
+func (sh StripHelper) Call(ctx context.Context, cln *client.Client, val Value, opts Option, helper Filesystem) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &StripHelper{Helper: helper}))
+}
+
 type FrontendInput struct{}
 
 func (fi FrontendInput) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key string, input Filesystem) (Value, error) {
@@ -138,6 +519,20 @@ func (fo FrontendOpt) Call(ctx context.Context, cln *client.Client, val Value, o
 	return NewValue(ctx, append(retOpts, llbutil.FrontendOpt(key, value)))
 }
 
+type FrontendDigest struct{}
+
+func (fd FrontendDigest) Call(ctx context.Context, cln *client.Client, val Value, opts Option, dgst digest.Digest) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &PinnedDigest{
+		Digest: dgst,
+		Node:   ProgramCounter(ctx),
+	}))
+}
+
 type CreateParents struct{}
 
 func (cp CreateParents) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
@@ -237,6 +632,26 @@ func (cdp CreateDestPath) Call(ctx context.Context, cln *client.Client, val Valu
 	return NewValue(ctx, append(retOpts, llbutil.WithCreateDestPath(true)))
 }
 
+type Except struct {
+	Pattern string
+}
+
+func (e Except) Call(ctx context.Context, cln *client.Client, val Value, opts Option, pattern string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(pattern, "!") {
+		return nil, errdefs.WithInvalidPattern(Arg(ctx, 0), pattern, fmt.Errorf("except patterns cannot be negated"))
+	}
+	err = llbutil.ValidatePattern(pattern)
+	if err != nil {
+		return nil, errdefs.WithInvalidPattern(Arg(ctx, 0), pattern, err)
+	}
+	return NewValue(ctx, append(retOpts, &Except{Pattern: pattern}))
+}
+
 type CopyAllowWildcard struct{}
 
 func (caw CopyAllowWildcard) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
@@ -308,6 +723,19 @@ func (sf StringField) Call(ctx context.Context, cln *client.Client, val Value, o
 	return NewValue(ctx, append(retOpts, &TemplateField{name, value}))
 }
 
+type PerPlatformSeparator struct {
+	Separator string
+}
+
+func (pps PerPlatformSeparator) Call(ctx context.Context, cln *client.Client, val Value, opts Option, separator string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &PerPlatformSeparator{Separator: separator}))
+}
+
 type LocalRunOption struct {
 	IgnoreError   bool
 	OnlyStderr    bool
@@ -364,6 +792,109 @@ func (s Shlex) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 	return NewValue(ctx, append(retOpts, &Shlex{}))
 }
 
+const (
+	// StdinMountpoint is where the stdin input is mounted during a run.
+	// BuildKit execs have no stdin, so the run args are wrapped to redirect
+	// from it.
+	StdinMountpoint = "/run/hlb/stdin"
+
+	// StdinShimImage is the image of the static shell that redirects stdin
+	// for runs that do not already run in the shell of their filesystem, which
+	// may not have one.
+	StdinShimImage = "docker.io/library/busybox:1.35-musl"
+
+	// StdinShimMountpoint is where the shim image is mounted during a run.
+	StdinShimMountpoint = "/run/hlb/shim"
+)
+
+type Stdin struct {
+	Input llb.State
+	Path  string
+}
+
+func (s Stdin) Call(ctx context.Context, cln *client.Client, val Value, opts Option, content string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	input := llb.Scratch().File(
+		llb.Mkfile("stdin", 0o644, []byte(content)),
+		SourceMap(ctx)...,
+	)
+	return NewValue(ctx, append(retOpts, &Stdin{Input: input, Path: "stdin"}))
+}
+
+// Wrap wraps args with a shell that redirects stdin from the mounted input,
+// and returns the options that mount it. Args that run in the shell of the
+// filesystem are wrapped with it, and other args with the shell of
+// StdinShimImage, so that images without a shell like distroless ones can be
+// given stdin. The input is only mounted, so it is never part of the layers of
+// the run, but its content is part of the cache key.
+func (s *Stdin) Wrap(args []string, platform specs.Platform) ([]string, []llb.RunOption) {
+	runOpts := []llb.RunOption{&llbutil.MountRunOption{
+		Source: s.Input,
+		Target: StdinMountpoint,
+		Opts: []interface{}{
+			llbutil.WithReadonlyMount(),
+			llbutil.WithSourcePath(s.Path),
+		},
+	}}
+
+	shell := "/bin/sh"
+	if len(args) == 0 || args[0] != shell {
+		shell = path.Join(StdinShimMountpoint, "bin/sh")
+		runOpts = append(runOpts, &llbutil.MountRunOption{
+			Source: llb.Image(StdinShimImage, llb.Platform(platform)),
+			Target: StdinShimMountpoint,
+			Opts:   []interface{}{llbutil.WithReadonlyMount()},
+		})
+	}
+	return append([]string{shell, "-c", fmt.Sprintf(`exec "$@" < %s`, StdinMountpoint), "stdin"}, args...), runOpts
+}
+
+// BarrierMountpoint is where the barrier for the steps a run depends on is
+// mounted.
+const BarrierMountpoint = "/run/hlb/barrier"
+
+type DependsOn struct {
+	Step llb.State
+}
+
+func (do DependsOn) Call(ctx context.Context, cln *client.Client, val Value, opts Option, step Filesystem) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	retOpts = append(retOpts, &DependsOn{Step: step.State})
+	for _, opt := range step.SolveOpts {
+		retOpts = append(retOpts, opt)
+	}
+	for _, opt := range step.SessionOpts {
+		retOpts = append(retOpts, opt)
+	}
+	return NewValue(ctx, retOpts)
+}
+
+type StdinFile struct{}
+
+func (sf StdinFile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, path string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	retOpts = append(retOpts, &Stdin{Input: input.State, Path: path})
+	for _, opt := range input.SolveOpts {
+		retOpts = append(retOpts, opt)
+	}
+	for _, opt := range input.SessionOpts {
+		retOpts = append(retOpts, opt)
+	}
+	return NewValue(ctx, retOpts)
+}
+
 func ShlexArgs(args []string, shlex bool) ([]string, error) {
 	if len(args) == 0 {
 		return nil, nil
@@ -415,7 +946,7 @@ func (rd RunDir) Call(ctx context.Context, cln *client.Client, val Value, opts O
 		return nil, err
 	}
 
-	return NewValue(ctx, append(retOpts, llbutil.WithDir(path)))
+	return NewValue(ctx, append(retOpts, llbutil.WithDir(path), &workdirArg{Arg(ctx, 0)}))
 }
 
 type RunUser struct{}
@@ -426,7 +957,7 @@ func (ru RunUser) Call(ctx context.Context, cln *client.Client, val Value, opts
 		return nil, err
 	}
 
-	return NewValue(ctx, append(retOpts, llbutil.WithUser(name)))
+	return NewValue(ctx, append(retOpts, llbutil.WithUser(name), &userArg{Arg(ctx, 0)}))
 }
 
 type IgnoreCache struct{}
@@ -458,7 +989,7 @@ func (n Network) Call(ctx context.Context, cln *client.Client, val Value, opts O
 	case "none":
 		netMode = pb.NetMode_NONE
 	default:
-		return nil, errdefs.WithInvalidNetworkMode(Arg(ctx, 0), mode, []string{"unset", "host", "none"})
+		return nil, errdefs.WithInvalidNetworkMode(Arg(ctx, 0), mode, checker.NetworkModes)
 	}
 
 	return NewValue(ctx, append(retOpts, llbutil.WithNetwork(netMode)))
@@ -480,7 +1011,7 @@ func (s Security) Call(ctx context.Context, cln *client.Client, val Value, opts
 		securityMode = pb.SecurityMode_INSECURE
 		retOpts = append(retOpts, solver.WithEntitlement(entitlements.EntitlementSecurityInsecure))
 	default:
-		return nil, errdefs.WithInvalidSecurityMode(Arg(ctx, 0), mode, []string{"sandbox", "insecure"})
+		return nil, errdefs.WithInvalidSecurityMode(Arg(ctx, 0), mode, checker.SecurityModes)
 	}
 
 	return NewValue(ctx, append(retOpts, llbutil.WithSecurity(securityMode)))
@@ -518,6 +1049,19 @@ func (s SSH) Call(ctx context.Context, cln *client.Client, val Value, opts Optio
 		}
 	}
 
+	if len(localPaths) == 0 {
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "ssh"})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(ProgramCounter(ctx), "the ssh agent", err)
+		}
+	}
+	for _, localPath := range localPaths {
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "ssh", Path: localPath})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(ProgramCounter(ctx), localPath, err)
+		}
+	}
+
 	sort.Strings(localPaths)
 	id := llbutil.SSHID(localPaths...)
 	sshOpts = append(sshOpts, llbutil.WithID(id))
@@ -548,12 +1092,21 @@ func (f Forward) Call(ctx context.Context, cln *client.Client, val Value, opts O
 		if err != nil {
 			return nil, Arg(ctx, 0).WithError(err)
 		}
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "forward", Path: localPath})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localPath, err)
+		}
 		_, err = os.Stat(filepath.Dir(localPath))
 		if err != nil {
 			return nil, Arg(ctx, 0).WithError(err)
 		}
 		id = digest.FromString(localPath).String()
 	} else {
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "forward", Address: src.String()})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), src.String(), err)
+		}
+
 		dialerFunc := func() (net.Conn, error) {
 			var dialer net.Dialer
 			conn, err := dialer.DialContext(ctx, src.Scheme, src.Host)
@@ -643,18 +1196,30 @@ func (s Secret) Call(ctx context.Context, cln *client.Client, val Value, opts Op
 		return nil, err
 	}
 
+	err = CheckHostAccess(ctx, HostAccess{Builtin: "secret", Path: localPath})
+	if err != nil {
+		return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localPath, err)
+	}
+
 	localFiles, err := llbutil.FilterLocalFiles(localPath, includePatterns, excludePatterns)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, localFile := range localFiles {
+		// Files under the directory may be symlinks out of it.
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "secret", Path: localFile})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localFile, err)
+		}
+
 		mountpoint := filepath.Join(
 			mountpoint,
 			strings.TrimPrefix(localFile, localPath),
 		)
 
 		id := llbutil.SecretID(localFile)
+		redactSecretFile(ctx, localFile)
 
 		retOpts = append(retOpts,
 			llbutil.WithSecret(
@@ -671,9 +1236,159 @@ func (s Secret) Call(ctx context.Context, cln *client.Client, val Value, opts Op
 	return NewValue(ctx, retOpts)
 }
 
+// SecretTarget records where a local file is attached as a secret, so that
+// run can reject two secrets attached at the same target.
+type SecretTarget struct {
+	Target string
+	Path   string
+	Node   ast.Node
+}
+
+type SecretOptional struct{}
+
+func (so SecretOptional) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &SecretOptional{}))
+}
+
+type SecretFile struct{}
+
+func (sf SecretFile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, localPath, target string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	secretOpts, optional := localSecretOptions(opts)
+
+	localPath, err = parser.ResolvePath(SecretRoot(ctx), localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = CheckHostAccess(ctx, HostAccess{Builtin: "secretFile", Path: localPath})
+	if err != nil {
+		return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localPath, err)
+	}
+
+	fi, err := os.Stat(localPath)
+	switch {
+	case os.IsNotExist(err):
+		if optional {
+			return NewValue(ctx, retOpts)
+		}
+		return nil, errdefs.WithSecretNotFound(Arg(ctx, 0), localPath)
+	case err != nil:
+		return nil, err
+	case fi.IsDir():
+		return nil, errdefs.WithSecretDirectory(Arg(ctx, 0), localPath)
+	}
+
+	retOpts = append(retOpts, localSecret(ctx, localPath, target, secretOpts)...)
+	return NewValue(ctx, retOpts)
+}
+
+type SecretDir struct{}
+
+func (sd SecretDir) Call(ctx context.Context, cln *client.Client, val Value, opts Option, localGlob, targetDir string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	secretOpts, optional := localSecretOptions(opts)
+
+	pattern, err := parser.ResolvePath(SecretRoot(ctx), localGlob)
+	if err != nil {
+		return nil, err
+	}
+
+	err = CheckHostAccess(ctx, HostAccess{Builtin: "secretDir", Path: pattern})
+	if err != nil {
+		return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), pattern, err)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, errdefs.WithInvalidPattern(Arg(ctx, 0), localGlob, err)
+	}
+	if len(matches) == 0 {
+		if optional {
+			return NewValue(ctx, retOpts)
+		}
+		return nil, errdefs.WithSecretNotFound(Arg(ctx, 0), pattern)
+	}
+
+	attached := make(map[string]string)
+	for _, match := range matches {
+		// Matches may be symlinks out of the directory of the pattern.
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "secretDir", Path: match})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), match, err)
+		}
+
+		fi, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return nil, errdefs.WithSecretDirectory(Arg(ctx, 0), match)
+		}
+
+		target := path.Join(targetDir, filepath.Base(match))
+		if first, ok := attached[target]; ok {
+			return nil, errdefs.WithDuplicateSecretTarget(target, first, match, Arg(ctx, 0), Arg(ctx, 0))
+		}
+		attached[target] = match
+
+		retOpts = append(retOpts, localSecret(ctx, match, target, secretOpts)...)
+	}
+	return NewValue(ctx, retOpts)
+}
+
+// localSecretOptions returns the secret options of secretFile and secretDir,
+// and whether the local files are optional.
+func localSecretOptions(opts Option) (secretOpts []llb.SecretOption, optional bool) {
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llb.SecretOption:
+			secretOpts = append(secretOpts, o)
+		case *SecretOptional:
+			optional = true
+		}
+	}
+	return
+}
+
+// localSecret returns the options to attach a local file as a secret at
+// target. The file is only registered as a secret source of the session, so
+// its contents never become part of the definition, and its contents are
+// redacted from the output of the build.
+func localSecret(ctx context.Context, localPath, target string, secretOpts []llb.SecretOption) []interface{} {
+	id := llbutil.SecretID(localPath)
+	redactSecretFile(ctx, localPath)
+	return []interface{}{
+		llbutil.WithSecret(target, append(secretOpts, llbutil.WithID(id))...),
+		llbutil.WithSecretSource(id, secretsprovider.Source{
+			ID:       id,
+			FilePath: localPath,
+		}),
+		&SecretTarget{
+			Target: target,
+			Path:   localPath,
+			Node:   ProgramCounter(ctx),
+		},
+	}
+}
+
 type Mount struct {
-	Bind  string
-	Image *solver.ImageSpec
+	Bind       string
+	SourcePath string
+	Image      *solver.ImageSpec
 }
 
 func (m Mount) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, mountpoint string) (Value, error) {
@@ -682,12 +1397,16 @@ func (m Mount) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		return nil, err
 	}
 
-	var cache *Cache
+	var (
+		cache      *Cache
+		sourcePath string
+	)
 	for _, opt := range opts {
-		var ok bool
-		cache, ok = opt.(*Cache)
-		if ok {
-			break
+		switch o := opt.(type) {
+		case *Cache:
+			cache = o
+		case llbutil.SourcePathMountOption:
+			sourcePath = o.Path
 		}
 	}
 
@@ -695,7 +1414,11 @@ func (m Mount) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 		if cache != nil {
 			return nil, errdefs.WithBindCacheMount(Binding(ctx).Bind.As, cache)
 		}
-		retOpts = append(retOpts, &Mount{Bind: mountpoint, Image: input.Image})
+		retOpts = append(retOpts, &Mount{
+			Bind:       mountpoint,
+			SourcePath: sourcePath,
+			Image:      input.Image,
+		})
 	}
 
 	retOpts = append(retOpts, &llbutil.MountRunOption{
@@ -725,6 +1448,81 @@ func (mt MountTarget) Call(ctx context.Context, cln *client.Client, val Value, o
 	return NewValue(ctx, append(retOpts, llbutil.WithTarget(target)))
 }
 
+type Capture struct {
+	Path string
+	Node ast.Node
+}
+
+func (c Capture) Call(ctx context.Context, cln *client.Client, val Value, opts Option, p string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if Binding(ctx).Binds() == "output" {
+		retOpts = append(retOpts, &Capture{
+			Path: p,
+			Node: Arg(ctx, 0),
+		})
+	}
+	return NewValue(ctx, retOpts)
+}
+
+// captureState returns a filesystem with the file or directory at the path of
+// a capture after a run. Relative paths are relative to the working directory
+// of the run, and paths in a mount are captured from the mount's output.
+func captureState(ctx context.Context, st llb.State, run llb.ExecState, runOpts []llb.RunOption, capture *Capture) (llb.State, error) {
+	p := capture.Path
+	if !path.IsAbs(p) {
+		ei := &llb.ExecInfo{State: st}
+		for _, opt := range runOpts {
+			opt.SetRunOption(ei)
+		}
+		dir, err := ei.State.GetDir(ctx)
+		if err != nil {
+			return llb.State{}, err
+		}
+		p = path.Join("/", dir, p)
+	}
+	p = path.Clean(p)
+
+	// The path is in the mount with the longest mountpoint containing it.
+	var mount *llbutil.MountRunOption
+	for _, opt := range runOpts {
+		mnt, ok := opt.(*llbutil.MountRunOption)
+		if !ok {
+			continue
+		}
+		target := path.Clean(mnt.Target)
+		if p != target && !strings.HasPrefix(p, strings.TrimSuffix(target, "/")+"/") {
+			continue
+		}
+		if mount == nil || len(target) > len(path.Clean(mount.Target)) {
+			mount = mnt
+		}
+	}
+
+	src, srcPath := run.Root(), p
+	if mount != nil {
+		target := path.Clean(mount.Target)
+		sourcePath := "/"
+		for _, opt := range mount.Opts {
+			switch o := opt.(type) {
+			case llbutil.ReadonlyMountOption, llbutil.CacheMountOption, llbutil.TmpfsMountOption:
+				return llb.State{}, errdefs.WithCaptureNoOutput(capture.Node, p, target)
+			case llbutil.SourcePathMountOption:
+				sourcePath = o.Path
+			}
+		}
+		src = run.GetMount(mount.Target)
+		srcPath = path.Join("/", sourcePath, strings.TrimPrefix(p, target))
+	}
+
+	return llb.Scratch().File(llb.Copy(src, srcPath, path.Join("/", path.Base(p)), &llb.CopyInfo{
+		FollowSymlinks: true,
+	})), nil
+}
+
 type UID struct{}
 
 func (u UID) Call(ctx context.Context, cln *client.Client, val Value, opts Option, uid int) (Value, error) {
@@ -818,7 +1616,7 @@ func (c Cache) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 	case "locked":
 		sharing = llb.CacheMountLocked
 	default:
-		return nil, errdefs.WithInvalidSharingMode(Arg(ctx, 1), mode, []string{"shared", "private", "locked"})
+		return nil, errdefs.WithInvalidSharingMode(Arg(ctx, 1), mode, checker.SharingModes)
 	}
 
 	retOpts = append(retOpts, &Cache{ProgramCounter(ctx)}, llbutil.WithPersistentCacheDir(id, sharing))
@@ -854,3 +1652,66 @@ func (s Stargz) Call(ctx context.Context, cln *client.Client, val Value, opts Op
 
 	return NewValue(ctx, append(retOpts, &Stargz{}))
 }
+
+type MaxImageSize struct {
+	Bytes int64
+	Node  ast.Node
+}
+
+func (mis MaxImageSize) Call(ctx context.Context, cln *client.Client, val Value, opts Option, bytes int) (Value, error) {
+	// The docker engine tags the image as it pushes it, so the size budget
+	// could only be checked after the tag is published.
+	dockerAPI := DockerAPI(ctx)
+	if dockerAPI.Moby {
+		return nil, errdefs.WithDockerEngineUnsupported(ProgramCounter(ctx))
+	}
+
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes < 0 {
+		return nil, errdefs.WithInvalidMaxSize(Arg(ctx, 0), bytes)
+	}
+	return NewValue(ctx, append(retOpts, &MaxImageSize{
+		Bytes: int64(bytes),
+		Node:  ProgramCounter(ctx),
+	}))
+}
+
+// DownloadFilename names the single file of a download.
+type DownloadFilename struct {
+	Template *template.Template
+	Node     ast.Node
+}
+
+func (df DownloadFilename) Call(ctx context.Context, cln *client.Client, val Value, opts Option, text string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errdefs.WithInvalidFilenameTemplate(err, Arg(ctx, 0))
+	}
+	return NewValue(ctx, append(retOpts, &DownloadFilename{
+		Template: tmpl,
+		Node:     ProgramCounter(ctx),
+	}))
+}
+
+type DownloadContentFilename struct{}
+
+func (dcf DownloadContentFilename) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &DownloadFilename{
+		Template: contentFilenameTemplate,
+		Node:     ProgramCounter(ctx),
+	}))
+}
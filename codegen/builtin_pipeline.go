@@ -2,8 +2,11 @@ package codegen
 
 import (
 	"context"
+	"sync"
 
 	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/solver"
 )
 
@@ -22,3 +25,105 @@ func (s Stage) Call(ctx context.Context, cln *client.Client, val Value, opts Opt
 	next := solver.Parallel(requests...)
 	return NewValue(ctx, solver.Sequential(current, next))
 }
+
+type Sequence struct{}
+
+func (s Sequence) Call(ctx context.Context, cln *client.Client, val Value, opts Option, stages ...Thunk) (Value, error) {
+	if len(stages) == 0 {
+		return val, nil
+	}
+
+	current, err := val.Request()
+	if err != nil {
+		return nil, err
+	}
+
+	var state Value
+	for _, stage := range stages {
+		state, err = stage(ctx, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	next, err := state.Request()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, solver.Sequential(current, next))
+}
+
+type Gate struct{}
+
+func (g Gate) Call(ctx context.Context, cln *client.Client, val Value, opts Option, message string) (Value, error) {
+	current, err := val.Request()
+	if err != nil {
+		return nil, err
+	}
+
+	gate := &gateRequest{
+		policy:  getGatePolicy(ctx),
+		node:    ProgramCounter(ctx),
+		message: message,
+	}
+	return NewValue(ctx, solver.Sequential(current, gate))
+}
+
+type StageEnv struct{}
+
+func (se StageEnv) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key, value string) (Value, error) {
+	env := getStageEnv(ctx)
+	if env == nil {
+		return nil, errdefs.WithInternalErrorf(ProgramCounter(ctx), "stageEnv outside of a pipeline")
+	}
+	env.Set(key, value)
+	return val, nil
+}
+
+// stageEnvironment holds the values set by stageEnv, which are read by
+// localEnv before the environment of the host. Each pipeline declaration has
+// its own, so the values it sets are seen by the pipelines it calls but not
+// the pipelines that called it.
+type stageEnvironment struct {
+	parent *stageEnvironment
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newStageEnvironment(parent *stageEnvironment) *stageEnvironment {
+	return &stageEnvironment{
+		parent: parent,
+		values: make(map[string]string),
+	}
+}
+
+func (se *stageEnvironment) Set(key, value string) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.values[key] = value
+}
+
+func (se *stageEnvironment) Lookup(key string) (string, bool) {
+	for ; se != nil; se = se.parent {
+		se.mu.Lock()
+		value, ok := se.values[key]
+		se.mu.Unlock()
+		if ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// isStageEnv returns true if the statement calls the builtin stageEnv.
+func isStageEnv(scope *ast.Scope, stmt *ast.Stmt) bool {
+	if stmt.Call == nil || stmt.Call.Name.Reference != nil {
+		return false
+	}
+	obj := scope.Lookup(stmt.Call.Name.Ident.Text)
+	if obj == nil {
+		return false
+	}
+	bd, ok := obj.Node.(*ast.BuiltinDecl)
+	return ok && bd.Name == "stageEnv"
+}
@@ -0,0 +1,291 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/imageutil"
+)
+
+const (
+	RuntimeSpecDocker  = "docker"
+	RuntimeSpecCompose = "compose"
+)
+
+// runtimeSpec is a spec to run an image, which is rendered in the format of a
+// runtimeSpec.
+type runtimeSpec struct {
+	Ref         string
+	Service     string
+	Entrypoint  []string
+	Command     []string
+	Publishes   []portPublish
+	Binds       []string
+	Environment [][2]string
+}
+
+// portPublish publishes Port of the container on HostPort, both in the format
+// of ExposedPorts.
+type portPublish struct {
+	HostPort string
+	Port     string
+}
+
+// String returns the publish in the format of docker and compose, which
+// leaves out the default TCP protocol.
+func (pp portPublish) String() string {
+	host := pp.HostPort[:strings.Index(pp.HostPort, "/")]
+	return fmt.Sprintf("%s:%s", host, strings.TrimSuffix(pp.Port, "/tcp"))
+}
+
+type RuntimeSpec struct{}
+
+func (rs RuntimeSpec) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, ref string) (Value, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, errdefs.WithInvalidImageRef(err, Arg(ctx, 1), ref)
+	}
+
+	spec := &runtimeSpec{
+		Ref:     ref,
+		Service: path.Base(reference.Path(named)),
+	}
+	var exposed map[string]struct{}
+	if input.Image != nil {
+		spec.Entrypoint = input.Image.Config.Entrypoint
+		spec.Command = input.Image.Config.Cmd
+		exposed = input.Image.Config.ExposedPorts
+	}
+
+	var (
+		format    = RuntimeSpecDocker
+		published = make(map[string]ast.Node)
+		ports     = make(map[string]struct{})
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *RuntimeSpecPublish:
+			hostPort := imageutil.HostPort(o.HostPort, o.Port)
+			if first, ok := published[hostPort]; ok {
+				return nil, errdefs.WithPublishConflict(hostPort, first, o.Node)
+			}
+			published[hostPort] = o.Node
+			ports[o.Port] = struct{}{}
+			spec.Publishes = append(spec.Publishes, portPublish{hostPort, o.Port})
+		case *RuntimeSpecBind:
+			spec.Binds = append(spec.Binds, fmt.Sprintf("%s:%s", o.HostPath, o.ContainerPath))
+		case *RuntimeSpecEnv:
+			spec.Environment = append(spec.Environment, [2]string{o.Key, o.Value})
+		case *RuntimeSpecCommandOverride:
+			spec.Command = o.Args
+		case *RuntimeSpecFormat:
+			format = o.Format
+		}
+	}
+
+	// Exposed ports that are not published otherwise are published on the
+	// same port of the host. Image configs may expose a port without its
+	// protocol, so they are parsed like the ports that are published.
+	normalized := make(map[string]struct{}, len(exposed))
+	for key := range exposed {
+		port, err := imageutil.ParsePublishPort(key)
+		if err != nil {
+			return nil, Arg(ctx, 0).WithError(fmt.Errorf("invalid exposed port %q: %w", key, err))
+		}
+		normalized[port] = struct{}{}
+	}
+	for _, port := range sortPorts(normalized) {
+		if _, ok := ports[port]; ok {
+			continue
+		}
+		if node, ok := published[port]; ok {
+			return nil, errdefs.WithPublishExposedConflict(node, port)
+		}
+		spec.Publishes = append(spec.Publishes, portPublish{port, port})
+	}
+
+	switch format {
+	case RuntimeSpecCompose:
+		return NewValue(ctx, spec.compose())
+	default:
+		return NewValue(ctx, spec.docker())
+	}
+}
+
+// sortPorts sorts ports in the format of ExposedPorts by their number, and
+// then by their protocol.
+func sortPorts(set map[string]struct{}) []string {
+	number := func(port string) int {
+		n, _ := strconv.Atoi(port[:strings.Index(port+"/", "/")])
+		return n
+	}
+
+	var ports []string
+	for port := range set {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		ni, nj := number(ports[i]), number(ports[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return ports[i] < ports[j]
+	})
+	return ports
+}
+
+// docker renders the spec as a docker run command line. The entrypoint and
+// command are always given, because overriding the entrypoint also clears the
+// command of the image.
+func (rs *runtimeSpec) docker() string {
+	lines := []string{"docker run --rm"}
+	for _, pp := range rs.Publishes {
+		lines = append(lines, "-p "+shellquote.Join(pp.String()))
+	}
+	for _, bind := range rs.Binds {
+		lines = append(lines, "-v "+shellquote.Join(bind))
+	}
+	for _, env := range rs.Environment {
+		lines = append(lines, "-e "+shellquote.Join(env[0]+"="+env[1]))
+	}
+
+	args := append([]string{}, rs.Entrypoint...)
+	if len(args) > 0 {
+		lines = append(lines, "--entrypoint "+shellquote.Join(args[0]))
+		args = args[1:]
+	}
+	args = append(args, rs.Command...)
+	lines = append(lines, shellquote.Join(append([]string{rs.Ref}, args...)...))
+	return strings.Join(lines, " \\\n  ") + "\n"
+}
+
+// compose renders the spec as a compose file with a single service. Strings
+// are quoted as JSON, which is also YAML.
+func (rs *runtimeSpec) compose() string {
+	quote := func(s string) string {
+		dt, _ := json.Marshal(s)
+		return string(dt)
+	}
+	list := func(ss []string) string {
+		var quoted []string
+		for _, s := range ss {
+			quoted = append(quoted, quote(s))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "services:\n  %s:\n", quote(rs.Service))
+	fmt.Fprintf(&sb, "    image: %s\n", quote(rs.Ref))
+	if len(rs.Entrypoint) > 0 {
+		fmt.Fprintf(&sb, "    entrypoint: %s\n", list(rs.Entrypoint))
+	}
+	if len(rs.Command) > 0 {
+		fmt.Fprintf(&sb, "    command: %s\n", list(rs.Command))
+	}
+	if len(rs.Publishes) > 0 {
+		sb.WriteString("    ports:\n")
+		for _, pp := range rs.Publishes {
+			fmt.Fprintf(&sb, "      - %s\n", quote(pp.String()))
+		}
+	}
+	if len(rs.Binds) > 0 {
+		sb.WriteString("    volumes:\n")
+		for _, bind := range rs.Binds {
+			fmt.Fprintf(&sb, "      - %s\n", quote(bind))
+		}
+	}
+	if len(rs.Environment) > 0 {
+		sb.WriteString("    environment:\n")
+		for _, env := range rs.Environment {
+			fmt.Fprintf(&sb, "      %s: %s\n", quote(env[0]), quote(env[1]))
+		}
+	}
+	return sb.String()
+}
+
+// runtimeSpecOption returns the options of val with a runtimeSpec option.
+func runtimeSpecOption(ctx context.Context, val Value, opt interface{}) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, opt))
+}
+
+type RuntimeSpecPublish struct {
+	HostPort int
+	Port     string
+	Node     ast.Node
+}
+
+func (rsp RuntimeSpecPublish) Call(ctx context.Context, cln *client.Client, val Value, opts Option, hostPort int, containerPort string) (Value, error) {
+	if err := imageutil.ValidatePort(hostPort); err != nil {
+		return nil, errdefs.WithInvalidPublishPort(Arg(ctx, 0), strconv.Itoa(hostPort), err)
+	}
+	port, err := imageutil.ParsePublishPort(containerPort)
+	if err != nil {
+		return nil, errdefs.WithInvalidPublishPort(Arg(ctx, 1), containerPort, err)
+	}
+	return runtimeSpecOption(ctx, val, &RuntimeSpecPublish{
+		HostPort: hostPort,
+		Port:     port,
+		Node:     Arg(ctx, 0),
+	})
+}
+
+type RuntimeSpecBind struct {
+	HostPath      string
+	ContainerPath string
+}
+
+func (rsb RuntimeSpecBind) Call(ctx context.Context, cln *client.Client, val Value, opts Option, hostPath, containerPath string) (Value, error) {
+	if !path.IsAbs(containerPath) {
+		return nil, errdefs.WithRelativeContainerPath(Arg(ctx, 1), containerPath)
+	}
+	return runtimeSpecOption(ctx, val, &RuntimeSpecBind{
+		HostPath:      hostPath,
+		ContainerPath: containerPath,
+	})
+}
+
+type RuntimeSpecEnv struct {
+	Key   string
+	Value string
+}
+
+func (rse RuntimeSpecEnv) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key, value string) (Value, error) {
+	return runtimeSpecOption(ctx, val, &RuntimeSpecEnv{Key: key, Value: value})
+}
+
+type RuntimeSpecCommandOverride struct {
+	Args []string
+}
+
+func (rsco RuntimeSpecCommandOverride) Call(ctx context.Context, cln *client.Client, val Value, opts Option, args ...string) (Value, error) {
+	return runtimeSpecOption(ctx, val, &RuntimeSpecCommandOverride{Args: args})
+}
+
+type RuntimeSpecFormat struct {
+	Format string
+}
+
+func (rsf RuntimeSpecFormat) Call(ctx context.Context, cln *client.Client, val Value, opts Option, format string) (Value, error) {
+	switch format {
+	case RuntimeSpecDocker, RuntimeSpecCompose:
+	default:
+		return nil, errdefs.WithInvalidRuntimeSpecFormat(Arg(ctx, 0), format, checker.RuntimeSpecFormats)
+	}
+	return runtimeSpecOption(ctx, val, &RuntimeSpecFormat{Format: format})
+}
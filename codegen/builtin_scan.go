@@ -0,0 +1,349 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// Scanner scans a filesystem for vulnerabilities and license violations.
+type Scanner interface {
+	Scan(ctx context.Context, cln *client.Client, fs Filesystem) (*ScanReport, error)
+}
+
+// ScanReport is the report of a scan, which is written as JSON by the
+// reportPath option of scan.
+type ScanReport struct {
+	Findings []ScanFinding `json:"findings"`
+}
+
+// ScanFinding is a vulnerability or license violation found by a scan.
+type ScanFinding struct {
+	// ID is the identifier of a vulnerability, like a CVE ID, or the name of
+	// a license.
+	ID string `json:"id"`
+
+	// Package is the name of the package the finding is in.
+	Package string `json:"package,omitempty"`
+
+	// Version is the installed version of the package.
+	Version string `json:"version,omitempty"`
+
+	// Severity is one of UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL.
+	Severity string `json:"severity"`
+
+	Title string `json:"title,omitempty"`
+}
+
+func (f ScanFinding) String() string {
+	s := f.ID
+	if f.Package != "" {
+		s = fmt.Sprintf("%s in %s", s, f.Package)
+		if f.Version != "" {
+			s = fmt.Sprintf("%s %s", s, f.Version)
+		}
+	}
+	return fmt.Sprintf("%s (%s)", s, f.Severity)
+}
+
+// severityRank ranks a severity by its index in checker.Severities. Unknown
+// severities rank with UNKNOWN.
+func severityRank(severity string) int {
+	for i, s := range checker.Severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+	return 0
+}
+
+// ScanError is the error of a scan with findings at or above its severity
+// threshold. It holds the full report, so that callers can still write it
+// with errors.As.
+type ScanError struct {
+	Report    *ScanReport
+	Threshold string
+
+	// Exceeded are the findings at or above the threshold that were not
+	// ignored, with the most severe first.
+	Exceeded []ScanFinding
+}
+
+// maxScanErrorFindings is the number of findings listed in a ScanError.
+const maxScanErrorFindings = 5
+
+func (se *ScanError) Error() string {
+	counts := make(map[string]int)
+	for _, f := range se.Exceeded {
+		counts[strings.ToUpper(f.Severity)]++
+	}
+	var summary []string
+	for i := len(checker.Severities) - 1; i >= 0; i-- {
+		if n := counts[checker.Severities[i]]; n > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", n, checker.Severities[i]))
+		}
+	}
+
+	var top []string
+	for i, f := range se.Exceeded {
+		if i == maxScanErrorFindings {
+			top = append(top, fmt.Sprintf("and %d more", len(se.Exceeded)-i))
+			break
+		}
+		top = append(top, f.String())
+	}
+	return fmt.Sprintf("scan found %d findings at or above %s (%s): %s",
+		len(se.Exceeded), se.Threshold, strings.Join(summary, ", "), strings.Join(top, ", "))
+}
+
+const (
+	// DefaultSeverityThreshold is the lowest severity that fails a scan,
+	// unless overridden with severityThreshold.
+	DefaultSeverityThreshold = "HIGH"
+
+	// ScanImage is the image of the default scanner.
+	ScanImage = "docker.io/aquasec/trivy:0.45.1"
+
+	// ScanMountpoint is where the filesystem being scanned is mounted in the
+	// default scanner.
+	ScanMountpoint = "/run/hlb/scan"
+
+	// ScanOutputMountpoint is where the default scanner writes its report.
+	ScanOutputMountpoint = "/run/hlb/scan-output"
+)
+
+// TrivyScanner is the default scanner, which runs trivy in a container with
+// the filesystem mounted read-only.
+type TrivyScanner struct {
+	// Image is the trivy image, which defaults to ScanImage.
+	Image string
+}
+
+func (ts *TrivyScanner) Scan(ctx context.Context, cln *client.Client, fs Filesystem) (*ScanReport, error) {
+	image := ts.Image
+	if image == "" {
+		image = ScanImage
+	}
+
+	es := llb.Image(image, llb.Platform(fs.Platform)).Run(
+		llb.Args([]string{
+			"trivy", "rootfs",
+			"--quiet",
+			"--scanners", "vuln,license",
+			"--format", "json",
+			"--output", path.Join(ScanOutputMountpoint, "report.json"),
+			ScanMountpoint,
+		}),
+		llb.AddMount(ScanMountpoint, fs.State, llb.Readonly),
+		llb.WithCustomName("scanning filesystem"),
+	)
+	output := Filesystem{
+		State:       es.AddMount(ScanOutputMountpoint, llb.Scratch()),
+		Platform:    fs.Platform,
+		SolveOpts:   fs.SolveOpts,
+		SessionOpts: fs.SessionOpts,
+	}
+
+	dt, err := readPath(ctx, cln, output, "report.json")
+	if err != nil {
+		return nil, err
+	}
+	return parseTrivyReport(dt)
+}
+
+// parseTrivyReport parses the vulnerabilities and licenses of trivy's JSON
+// report.
+func parseTrivyReport(dt []byte) (*ScanReport, error) {
+	var tr struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				Severity         string
+				Title            string
+			}
+			Licenses []struct {
+				Severity string
+				PkgName  string
+				Name     string
+			}
+		}
+	}
+	err := json.Unmarshal(dt, &tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trivy report: %w", err)
+	}
+
+	report := &ScanReport{}
+	for _, result := range tr.Results {
+		for _, v := range result.Vulnerabilities {
+			report.Findings = append(report.Findings, ScanFinding{
+				ID:       v.VulnerabilityID,
+				Package:  v.PkgName,
+				Version:  v.InstalledVersion,
+				Severity: v.Severity,
+				Title:    v.Title,
+			})
+		}
+		for _, l := range result.Licenses {
+			report.Findings = append(report.Findings, ScanFinding{
+				ID:       l.Name,
+				Package:  l.PkgName,
+				Severity: l.Severity,
+				Title:    "license " + l.Name,
+			})
+		}
+	}
+	return report, nil
+}
+
+type Scan struct{}
+
+func (s Scan) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		threshold  = DefaultSeverityThreshold
+		ignored    = make(map[string]struct{})
+		reportPath *ScanReportPath
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *ScanSeverityThreshold:
+			threshold = o.Severity
+		case *ScanIgnore:
+			ignored[o.ID] = struct{}{}
+		case *ScanReportPath:
+			reportPath = o
+		}
+	}
+
+	report, err := getScanner(ctx).Scan(ctx, cln, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		dt       []byte
+		filename string
+	)
+	if reportPath != nil {
+		dt, err = json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		filename = path.Join("/", reportPath.Path)
+	}
+
+	var exceeded []ScanFinding
+	for _, f := range report.Findings {
+		if _, ok := ignored[f.ID]; ok {
+			continue
+		}
+		if severityRank(f.Severity) >= severityRank(threshold) {
+			exceeded = append(exceeded, f)
+		}
+	}
+	if len(exceeded) > 0 {
+		sort.SliceStable(exceeded, func(i, j int) bool {
+			return severityRank(exceeded[i].Severity) > severityRank(exceeded[j].Severity)
+		})
+
+		// The filesystem is never built when the scan fails, so the report is
+		// written to the working directory instead.
+		if reportPath != nil {
+			err = writeHostScanReport(ctx, reportPath.Node, filename, dt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, errdefs.WithScanFailed(&ScanError{
+			Report:    report,
+			Threshold: threshold,
+			Exceeded:  exceeded,
+		}, ProgramCounter(ctx), threshold)
+	}
+
+	if reportPath != nil {
+		fs.State = fs.State.File(
+			llb.Mkdir(path.Dir(filename), 0o755, llb.WithParents(true)).
+				Mkfile(filename, 0o644, dt),
+			SourceMap(ctx)...,
+		)
+	}
+	return NewValue(ctx, fs)
+}
+
+// writeHostScanReport writes the report of a failed scan to its filename under
+// the working directory.
+func writeHostScanReport(ctx context.Context, node ast.Node, filename string, dt []byte) error {
+	cwd, err := local.Cwd(ctx)
+	if err != nil {
+		return err
+	}
+
+	hostPath := filepath.Join(cwd, filepath.FromSlash(filename))
+	err = CheckHostAccess(ctx, HostAccess{Builtin: "scan", Path: hostPath})
+	if err != nil {
+		return errdefs.WithHostWriteDenied(node, hostPath, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(hostPath), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(hostPath, dt, 0o644)
+}
+
+// scanOption returns the options of val with a scan option.
+func scanOption(ctx context.Context, val Value, opt interface{}) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, opt))
+}
+
+type ScanSeverityThreshold struct {
+	Severity string
+}
+
+func (sst ScanSeverityThreshold) Call(ctx context.Context, cln *client.Client, val Value, opts Option, severity string) (Value, error) {
+	return scanOption(ctx, val, &ScanSeverityThreshold{Severity: severity})
+}
+
+type ScanIgnore struct {
+	ID string
+}
+
+func (si ScanIgnore) Call(ctx context.Context, cln *client.Client, val Value, opts Option, id string) (Value, error) {
+	return scanOption(ctx, val, &ScanIgnore{ID: id})
+}
+
+type ScanReportPath struct {
+	Path string
+	Node ast.Node
+}
+
+func (srp ScanReportPath) Call(ctx context.Context, cln *client.Client, val Value, opts Option, p string) (Value, error) {
+	return scanOption(ctx, val, &ScanReportPath{
+		Path: p,
+		Node: Arg(ctx, 0),
+	})
+}
@@ -0,0 +1,50 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrivyReport(t *testing.T) {
+	t.Parallel()
+
+	report, err := parseTrivyReport([]byte(`{
+		"SchemaVersion": 2,
+		"Results": [{
+			"Target": "/run/hlb/scan",
+			"Vulnerabilities": [{
+				"VulnerabilityID": "CVE-2023-0001",
+				"PkgName": "openssl",
+				"InstalledVersion": "3.0.1",
+				"Severity": "CRITICAL",
+				"Title": "buffer overflow"
+			}]
+		}, {
+			"Target": "OS Packages",
+			"Class": "license",
+			"Licenses": [{
+				"Severity": "HIGH",
+				"Category": "restricted",
+				"PkgName": "readline",
+				"Name": "GPL-3.0"
+			}]
+		}]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, []ScanFinding{{
+		ID:       "CVE-2023-0001",
+		Package:  "openssl",
+		Version:  "3.0.1",
+		Severity: "CRITICAL",
+		Title:    "buffer overflow",
+	}, {
+		ID:       "GPL-3.0",
+		Package:  "readline",
+		Severity: "HIGH",
+		Title:    "license GPL-3.0",
+	}}, report.Findings)
+
+	_, err = parseTrivyReport([]byte("not json"))
+	require.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/errdefs"
+	fstypes "github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/singleflight"
+)
+
+type NoFollow struct{}
+
+func (nf NoFollow) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	return NewValue(ctx, append(opts, nf))
+}
+
+type Exists struct{}
+
+func (e Exists) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, p string) (Value, error) {
+	_, err := statPath(ctx, cln, input, p, opts)
+	if err != nil {
+		if errdefs.IsNotExist(err) {
+			return NewValue(ctx, false)
+		}
+		return nil, err
+	}
+	return NewValue(ctx, true)
+}
+
+type IsDir struct{}
+
+func (id IsDir) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, p string) (Value, error) {
+	st, err := statPath(ctx, cln, input, p, opts)
+	if err != nil {
+		return nil, withStatNotExist(ctx, err, p)
+	}
+	return NewValue(ctx, os.FileMode(st.Mode).IsDir())
+}
+
+type FileMode struct{}
+
+func (fm FileMode) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, p string) (Value, error) {
+	st, err := statPath(ctx, cln, input, p, opts)
+	if err != nil {
+		return nil, withStatNotExist(ctx, err, p)
+	}
+	return NewValue(ctx, fmt.Sprintf("%04o", unixPerm(os.FileMode(st.Mode))))
+}
+
+type ReadFile struct{}
+
+func (rf ReadFile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, p string) (Value, error) {
+	dt, err := readPath(ctx, cln, input, p)
+	if err != nil {
+		return nil, withStatNotExist(ctx, err, p)
+	}
+	return NewValue(ctx, string(dt))
+}
+
+func withStatNotExist(ctx context.Context, err error, p string) error {
+	if errdefs.IsNotExist(err) {
+		return errdefs.WithStatNotExist(err, Arg(ctx, 1), Arg(ctx, 0), p)
+	}
+	return err
+}
+
+// unixPerm returns the permission bits of mode including the setuid, setgid
+// and sticky bits, which os.FileMode keeps outside of its permission bits.
+func unixPerm(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// statPath stats a path in a filesystem by solving it. Paths are never
+// globbed, and the results are cached for the rest of the Generate.
+func statPath(ctx context.Context, cln *client.Client, fs Filesystem, p string, opts Option) (*fstypes.Stat, error) {
+	if strings.Contains(p, "*") {
+		return nil, errdefs.WithStatPattern(Arg(ctx, 1), p)
+	}
+
+	follow := true
+	for _, opt := range opts {
+		if _, ok := opt.(NoFollow); ok {
+			follow = false
+		}
+	}
+
+	def, err := fs.State.Marshal(ctx, llb.Platform(fs.Platform))
+	if err != nil {
+		return nil, err
+	}
+
+	stat := func() (*fstypes.Stat, error) {
+		return solveStat(ctx, cln, fs, def, p, follow)
+	}
+
+	c := getStatCache(ctx)
+	if c == nil {
+		return stat()
+	}
+
+	var dgst string
+	if len(def.Def) > 0 {
+		dgst = digest.FromBytes(def.Def[len(def.Def)-1]).String()
+	}
+	return c.Do(fmt.Sprintf("%s:%s:%t", dgst, p, follow), stat)
+}
+
+func solveStat(ctx context.Context, cln *client.Client, fs Filesystem, def *llb.Definition, p string, follow bool) (*fstypes.Stat, error) {
+	var (
+		st      *fstypes.Stat
+		statErr error
+	)
+	err := gatewayBuild(ctx, cln, fs.SolveOpts, fs.SessionOpts, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		res, err := c.Solve(ctx, gateway.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := res.SingleRef()
+		if err != nil {
+			return nil, err
+		}
+
+		// Missing paths are not a build failure, so the error is returned
+		// outside of the build.
+		st, statErr = statRef(ctx, ref, p, follow)
+		return gateway.NewResult(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, statErr
+}
+
+// statRef stats a path in a solved reference. BuildKit resolves symbolic
+// links in the path when stating it, so to not follow a symbolic link the
+// path is found in its parent directory instead.
+func statRef(ctx context.Context, ref gateway.Reference, p string, follow bool) (*fstypes.Stat, error) {
+	p = path.Clean("/" + p)
+	if ref == nil {
+		// Scratch has only its root directory.
+		if p == "/" {
+			return &fstypes.Stat{Path: "/", Mode: uint32(os.ModeDir | 0755)}, nil
+		}
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+
+	if follow || p == "/" {
+		return ref.StatFile(ctx, gateway.StatRequest{Path: p})
+	}
+
+	dir, base := path.Split(p)
+	sts, err := ref.ReadDir(ctx, gateway.ReadDirRequest{
+		Path:           dir,
+		IncludePattern: base,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range sts {
+		if st.Path == base {
+			return st, nil
+		}
+	}
+	return nil, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+}
+
+// statCache holds the results of stating paths for a single Generate, keyed
+// by the digest of the filesystem definition and the path.
+type statCache struct {
+	g       singleflight.Group
+	mu      sync.Mutex
+	results map[string]statResult
+}
+
+type statResult struct {
+	st  *fstypes.Stat
+	err error
+}
+
+func newStatCache() *statCache {
+	return &statCache{results: make(map[string]statResult)}
+}
+
+// Do returns the cached result for key, invoking fn at most once even when
+// called concurrently.
+func (c *statCache) Do(key string, fn func() (*fstypes.Stat, error)) (*fstypes.Stat, error) {
+	c.mu.Lock()
+	res, ok := c.results[key]
+	c.mu.Unlock()
+	if ok {
+		return res.st, res.err
+	}
+
+	v, _, _ := c.g.Do(key, func() (interface{}, error) {
+		st, err := fn()
+		res := statResult{st, err}
+
+		c.mu.Lock()
+		c.results[key] = res
+		c.mu.Unlock()
+		return res, nil
+	})
+	res = v.(statResult)
+	return res.st, res.err
+}
@@ -0,0 +1,217 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/stretchr/testify/require"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// fakeRef is a solved reference whose files are looked up like BuildKit's
+// gateway does, following symbolic links when stating a path and not when
+// reading a directory.
+type fakeRef struct {
+	files map[string]*fstypes.Stat
+}
+
+func (r *fakeRef) ToState() (llb.State, error) {
+	return llb.Scratch(), nil
+}
+
+func (r *fakeRef) ReadFile(ctx context.Context, req gateway.ReadRequest) ([]byte, error) {
+	return nil, nil
+}
+
+func (r *fakeRef) StatFile(ctx context.Context, req gateway.StatRequest) (*fstypes.Stat, error) {
+	p := req.Path
+	for i := 0; i < 40; i++ {
+		st, ok := r.files[p]
+		if !ok {
+			return nil, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+		}
+		if os.FileMode(st.Mode)&os.ModeSymlink == 0 {
+			return st, nil
+		}
+		p = st.Linkname
+		if !path.IsAbs(p) {
+			p = path.Join(path.Dir(req.Path), p)
+		}
+	}
+	return nil, &os.PathError{Op: "lstat", Path: req.Path, Err: os.ErrInvalid}
+}
+
+func (r *fakeRef) ReadDir(ctx context.Context, req gateway.ReadDirRequest) ([]*fstypes.Stat, error) {
+	var sts []*fstypes.Stat
+	for p, st := range r.files {
+		dir, base := path.Split(p)
+		if path.Clean(dir) != path.Clean(req.Path) {
+			continue
+		}
+		ok, err := filepath.Match(req.IncludePattern, base)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			st := *st
+			st.Path = base
+			sts = append(sts, &st)
+		}
+	}
+	return sts, nil
+}
+
+func TestStatRef(t *testing.T) {
+	t.Parallel()
+
+	// A filesystem with paths from an alpine image layer, and a file created
+	// by mkfile.
+	ref := &fakeRef{files: map[string]*fstypes.Stat{
+		"/":                   {Mode: uint32(os.ModeDir | 0755)},
+		"/bin":                {Mode: uint32(os.ModeDir | 0755)},
+		"/bin/busybox":        {Mode: 0755},
+		"/bin/sh":             {Mode: uint32(os.ModeSymlink | 0777), Linkname: "/bin/busybox"},
+		"/etc":                {Mode: uint32(os.ModeDir | 0755)},
+		"/etc/alpine-release": {Mode: 0644},
+		"/etc/localtime":      {Mode: uint32(os.ModeSymlink | 0777), Linkname: "zoneinfo/UTC"},
+		"/tmp":                {Mode: uint32(os.ModeDir | os.ModeSticky | 0777)},
+		"/app":                {Mode: uint32(os.ModeDir | 0755)},
+		"/app/config.yaml":    {Mode: 0600},
+	}}
+
+	type testCase struct {
+		name     string
+		ref      gateway.Reference
+		path     string
+		follow   bool
+		notExist bool
+		isDir    bool
+		mode     string
+	}
+
+	for _, tc := range []testCase{{
+		name:   "file from mkfile",
+		ref:    ref,
+		path:   "/app/config.yaml",
+		follow: true,
+		mode:   "0600",
+	}, {
+		name:   "relative path",
+		ref:    ref,
+		path:   "app/config.yaml",
+		follow: true,
+		mode:   "0600",
+	}, {
+		name:   "directory from image",
+		ref:    ref,
+		path:   "/etc",
+		follow: true,
+		isDir:  true,
+		mode:   "0755",
+	}, {
+		name:   "sticky directory",
+		ref:    ref,
+		path:   "/tmp",
+		follow: true,
+		isDir:  true,
+		mode:   "1777",
+	}, {
+		name:   "symlink is followed",
+		ref:    ref,
+		path:   "/bin/sh",
+		follow: true,
+		mode:   "0755",
+	}, {
+		name: "symlink is not followed",
+		ref:  ref,
+		path: "/bin/sh",
+		mode: "0777",
+	}, {
+		name:     "dangling symlink does not exist when followed",
+		ref:      ref,
+		path:     "/etc/localtime",
+		follow:   true,
+		notExist: true,
+	}, {
+		name: "dangling symlink exists when not followed",
+		ref:  ref,
+		path: "/etc/localtime",
+		mode: "0777",
+	}, {
+		name:     "missing path",
+		ref:      ref,
+		path:     "/app/missing.yaml",
+		follow:   true,
+		notExist: true,
+	}, {
+		name:     "missing path when not followed",
+		ref:      ref,
+		path:     "/app/missing.yaml",
+		notExist: true,
+	}, {
+		name:   "scratch root",
+		path:   "/",
+		follow: true,
+		isDir:  true,
+		mode:   "0755",
+	}, {
+		name:     "scratch path",
+		path:     "/etc",
+		follow:   true,
+		notExist: true,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			st, err := statRef(context.Background(), tc.ref, tc.path, tc.follow)
+			if tc.notExist {
+				require.Error(t, err)
+				require.True(t, errdefs.IsNotExist(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.isDir, os.FileMode(st.Mode).IsDir())
+			require.Equal(t, tc.mode, fmt.Sprintf("%04o", unixPerm(os.FileMode(st.Mode))))
+		})
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	t.Parallel()
+
+	c := newStatCache()
+
+	var (
+		mu    sync.Mutex
+		calls int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := c.Do("digest:/etc:true", func() (*fstypes.Stat, error) {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				return &fstypes.Stat{Mode: uint32(os.ModeDir | 0755)}, nil
+			})
+			require.NoError(t, err)
+			require.True(t, os.FileMode(st.Mode).IsDir())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, calls)
+
+	_, err := c.Do("digest:/missing:true", func() (*fstypes.Stat, error) {
+		return nil, &os.PathError{Op: "lstat", Path: "/missing", Err: os.ErrNotExist}
+	})
+	require.True(t, errdefs.IsNotExist(err))
+}
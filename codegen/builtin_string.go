@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -14,18 +16,59 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openllb/hlb/checker"
 	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/imageutil"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"golang.org/x/sync/errgroup"
 )
 
 type Format struct{}
 
-func (f Format) Call(ctx context.Context, cln *client.Client, val Value, opts Option, formatStr string, values ...string) (Value, error) {
-	var a []interface{}
+// Call formats values with the verbs of a format string. Literal format
+// strings are checked by the checker, but others are only known now, so they
+// are checked again rather than letting fmt write its errors into the result.
+func (f Format) Call(ctx context.Context, cln *client.Client, val Value, opts Option, formatStr string, values ...Value) (Value, error) {
+	verbs, err := checker.ParseFormat(formatStr)
+	if err != nil {
+		return nil, errdefs.WithInvalidFormat(ProgramCounter(ctx), err)
+	}
+
+	var (
+		a     []interface{}
+		kinds []ast.Kind
+	)
 	for _, value := range values {
-		a = append(a, value)
+		var (
+			v   interface{}
+			err error
+		)
+		switch value.Kind() {
+		case ast.Int:
+			v, err = value.Int()
+		case ast.Bool:
+			var str string
+			str, err = value.String()
+			if err == nil {
+				v, err = strconv.ParseBool(str)
+			}
+		default:
+			v, err = value.String()
+		}
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+		kinds = append(kinds, value.Kind())
+	}
+
+	err = checker.CheckFormatArgs(formatStr, verbs, kinds)
+	if err != nil {
+		return nil, errdefs.WithInvalidFormat(ProgramCounter(ctx), err)
 	}
 	return NewValue(ctx, fmt.Sprintf(formatStr, a...))
 }
@@ -33,10 +76,20 @@ func (f Format) Call(ctx context.Context, cln *client.Client, val Value, opts Op
 type Template struct{}
 
 func (t Template) Call(ctx context.Context, cln *client.Client, val Value, opts Option, text string) (Value, error) {
-	tmpl, err := template.New("").Parse(text)
+	out, err := executeTemplate(text, opts)
 	if err != nil {
 		return nil, err
 	}
+	return NewValue(ctx, out)
+}
+
+// executeTemplate processes text as a Go text template with the fields in
+// opts.
+func executeTemplate(text string, opts Option) (string, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
 
 	data := map[string]interface{}{}
 	for _, opt := range opts {
@@ -49,10 +102,9 @@ func (t Template) Call(ctx context.Context, cln *client.Client, val Value, opts
 	buf := bytes.NewBufferString("")
 	err = tmpl.Execute(buf, data)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	return NewValue(ctx, buf.String())
+	return buf.String(), nil
 }
 
 type LocalArch struct{}
@@ -61,6 +113,70 @@ func (la LocalArch) Call(ctx context.Context, cln *client.Client, val Value, opt
 	return NewValue(ctx, local.Arch(ctx))
 }
 
+type BindingName struct{}
+
+func (bn BindingName) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	return NewValue(ctx, getBindingName(ctx))
+}
+
+type TargetOS struct{}
+
+func (to TargetOS) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	return NewValue(ctx, DefaultPlatform(ctx).OS)
+}
+
+type TargetArch struct{}
+
+func (ta TargetArch) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	return NewValue(ctx, DefaultPlatform(ctx).Architecture)
+}
+
+type PerPlatform struct{}
+
+func (pp PerPlatform) Call(ctx context.Context, cln *client.Client, val Value, opts Option, body Thunk, targets ...string) (Value, error) {
+	separator := "\n"
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *PerPlatformSeparator:
+			separator = o.Separator
+		}
+	}
+
+	var targetPlatforms []specs.Platform
+	for i, target := range targets {
+		p, err := platforms.Parse(target)
+		if err != nil {
+			return nil, errdefs.WithInvalidPlatform(err, Arg(ctx, i+1), target)
+		}
+		targetPlatforms = append(targetPlatforms, p)
+	}
+
+	results := make([]string, len(targetPlatforms))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, p := range targetPlatforms {
+		i, p := i, p
+		g.Go(func() error {
+			// Memoized values may depend on the platform, so each platform is
+			// evaluated with its own memo.
+			ctx := withMemo(gctx, newMemo())
+			ctx = WithDefaultPlatform(ctx, p)
+
+			v, err := body(ctx, nil)
+			if err != nil {
+				return err
+			}
+			results[i], err = v.String()
+			return err
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, strings.Join(results, separator))
+}
+
 type LocalCwd struct{}
 
 func (lc LocalCwd) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
@@ -80,7 +196,21 @@ func (lo LocalOS) Call(ctx context.Context, cln *client.Client, val Value, opts
 type LocalEnv struct{}
 
 func (le LocalEnv) Call(ctx context.Context, cln *client.Client, val Value, opts Option, key string) (Value, error) {
-	return NewValue(ctx, local.Env(ctx, key))
+	// Values set by stageEnv in the pipelines being emitted take precedence.
+	if value, ok := getStageEnv(ctx).Lookup(key); ok {
+		return NewValue(ctx, value)
+	}
+
+	err := CheckHostAccess(ctx, HostAccess{Builtin: "localEnv", Key: key})
+	if err != nil {
+		return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), "environment variable "+key, err)
+	}
+
+	value := local.Env(ctx, key)
+	if isSensitiveEnv(ctx, key) {
+		Redactions(ctx).Add(key, value)
+	}
+	return NewValue(ctx, value)
 }
 
 type LocalRun struct{}
@@ -104,6 +234,11 @@ func (lr LocalRun) Call(ctx context.Context, cln *client.Client, val Value, opts
 		return nil, err
 	}
 
+	err = CheckHostAccess(ctx, HostAccess{Builtin: "localRun", Command: runArgs})
+	if err != nil {
+		return nil, errdefs.WithHostCommandDenied(Arg(ctx, 0), strings.Join(runArgs, " "), err)
+	}
+
 	cmd := exec.CommandContext(ctx, runArgs[0], runArgs[1:]...)
 	cmd.Env = local.Environ(ctx)
 	cmd.Dir = ModuleDir(ctx)
@@ -120,12 +255,159 @@ func (lr LocalRun) Call(ctx context.Context, cln *client.Client, val Value, opts
 
 	err = cmd.Run()
 	if err != nil && !localRunOpts.IgnoreError {
-		return nil, err
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		return nil, errdefs.WithExecError(err, exitCode, ProgramCounter(ctx).Position())
 	}
 
 	return NewValue(ctx, strings.TrimRight(buf.String(), "\n"))
 }
 
+type GitCommitSHA struct{}
+
+func (gc GitCommitSHA) Call(ctx context.Context, cln *client.Client, val Value, opts Option, repo Filesystem) (Value, error) {
+	src, err := newGitRepo(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var sha string
+	switch {
+	case src.dir != "":
+		sha, err = gitOutput(ctx, src.dir, "rev-parse", "HEAD")
+	case llbutil.IsCommitSHA(src.ref):
+		sha = src.ref
+	default:
+		sha, err = src.lsRemote(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, sha)
+}
+
+type GitBranch struct{}
+
+func (gb GitBranch) Call(ctx context.Context, cln *client.Client, val Value, opts Option, repo Filesystem) (Value, error) {
+	src, err := newGitRepo(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var branch string
+	switch {
+	case src.dir != "":
+		branch, err = gitOutput(ctx, src.dir, "symbolic-ref", "--short", "HEAD")
+	case llbutil.IsCommitSHA(src.ref):
+		err = fmt.Errorf("git source is pinned to commit %s and has no branch", src.ref)
+	case src.ref == "" || src.ref == "HEAD":
+		branch, err = src.defaultBranch(ctx)
+	default:
+		branch = strings.TrimPrefix(src.ref, "refs/heads/")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, branch)
+}
+
+// gitRepo is either a remote git source and its ref, or a local directory
+// within a git repository.
+type gitRepo struct {
+	remote string
+	ref    string
+	dir    string
+}
+
+func newGitRepo(ctx context.Context, repo Filesystem) (*gitRepo, error) {
+	src, err := llbutil.SourceOp(ctx, repo.State)
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return nil, errdefs.WithNotGitRepository(Arg(ctx, 0))
+	}
+
+	switch {
+	case strings.HasPrefix(src.Identifier, "git://"):
+		parts := strings.SplitN(strings.TrimPrefix(src.Identifier, "git://"), "#", 2)
+		r := &gitRepo{remote: parts[0]}
+		if len(parts) == 2 {
+			r.ref = parts[1]
+		}
+		if url, ok := src.Attrs[pb.AttrFullRemoteURL]; ok {
+			r.remote = url
+		}
+		return r, nil
+	case strings.HasPrefix(src.Identifier, "local://"):
+		dir, err := localSourceDir(ctx, repo.State)
+		if err != nil {
+			return nil, err
+		}
+		return &gitRepo{dir: dir}, nil
+	}
+	return nil, errdefs.WithNotGitRepository(Arg(ctx, 0))
+}
+
+func (r *gitRepo) lsRemote(ctx context.Context) (string, error) {
+	ref := r.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := gitOutput(ctx, "", "ls-remote", r.remote, ref)
+	if err != nil {
+		return "", err
+	}
+	sha := strings.SplitN(out, "\t", 2)[0]
+	if sha == "" {
+		return "", fmt.Errorf("ref %q not found in %s", ref, r.remote)
+	}
+	return sha, nil
+}
+
+func (r *gitRepo) defaultBranch(ctx context.Context) (string, error) {
+	out, err := gitOutput(ctx, "", "ls-remote", "--symref", r.remote, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "ref: ") && strings.HasSuffix(line, "\tHEAD") {
+			ref := strings.TrimSuffix(strings.TrimPrefix(line, "ref: "), "\tHEAD")
+			return strings.TrimPrefix(ref, "refs/heads/"), nil
+		}
+	}
+	return "", fmt.Errorf("no default branch found for %s", r.remote)
+}
+
+// gitOutput runs the git client in the local environment and returns its
+// trimmed output. If dir is not empty, git runs in that directory of the
+// host, which must be allowed by the host policy.
+func gitOutput(ctx context.Context, dir string, args ...string) (string, error) {
+	if dir != "" {
+		err := CheckHostAccess(ctx, HostAccess{Builtin: "localGit", Path: dir})
+		if err != nil {
+			return "", errdefs.WithHostAccessDenied(Arg(ctx, 0), dir, err)
+		}
+		args = append([]string{"-C", dir}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = local.Environ(ctx)
+
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
 type Manifest struct{}
 
 func (m Manifest) Call(ctx context.Context, cln *client.Client, val Value, opts Option, ref string) (Value, error) {
@@ -0,0 +1,105 @@
+package codegen
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		format   string
+		values   []interface{}
+		expected string
+		err      string
+	}{{
+		"string verbs",
+		"%s|%q|%x|%X|%v",
+		[]interface{}{"a", "b c", "hi", "hi", "d"},
+		`a|"b c"|6869|6869|d`,
+		"",
+	}, {
+		"int verbs",
+		"%d|%b|%o|%O|%x|%X|%c|%q|%v",
+		[]interface{}{42, 5, 8, 8, 255, 255, 65, 66, 7},
+		"42|101|10|0o10|ff|FF|A|'B'|7",
+		"",
+	}, {
+		"bool verbs",
+		"%t|%v",
+		[]interface{}{true, false},
+		"true|false",
+		"",
+	}, {
+		"flags, width and precision",
+		"[%-4s|%4s|%.2s|%05d|%+d|%#x]",
+		[]interface{}{"ab", "ab", "abc", 42, 42, 255},
+		"[ab  |  ab|ab|00042|+42|0xff]",
+		"",
+	}, {
+		"indexed reuse",
+		"%[1]s-%[1]s-%[2]d-%s",
+		[]interface{}{"tag", 1, "x"},
+		"tag-tag-1-x",
+		"",
+	}, {
+		"percent",
+		"100%%",
+		nil,
+		"100%",
+		"",
+	}, {
+		"wrong kind",
+		"%d",
+		[]interface{}{"42"},
+		"",
+		"invalid format string: %d cannot format string",
+	}, {
+		"too few values",
+		"%s-%s",
+		[]interface{}{"a"},
+		"",
+		"invalid format string: %s formats arg 2, found 1 args",
+	}, {
+		"too many values",
+		"%s",
+		[]interface{}{"a", "b"},
+		"",
+		"invalid format string: arg 2 is not formatted by any verb",
+	}, {
+		"unknown verb",
+		"%y",
+		nil,
+		"",
+		"invalid format string: unknown verb %y",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := WithProgramCounter(context.Background(), &ast.Ident{Text: "format"})
+
+			var values []Value
+			for _, v := range tc.values {
+				value, err := NewValue(ctx, v)
+				require.NoError(t, err)
+				values = append(values, value)
+			}
+
+			val, err := Format{}.Call(ctx, nil, nil, nil, tc.format, values...)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+
+			actual, err := val.String()
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
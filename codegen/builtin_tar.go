@@ -0,0 +1,355 @@
+package codegen
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/pkg/errors"
+)
+
+type TarContext struct{}
+
+func (tc TarContext) Call(ctx context.Context, cln *client.Client, val Value, opts Option, tarPath string) (Value, error) {
+	var (
+		input    *TarInput
+		strip    *StripComponents
+		subdir   *LocalGitSubdir
+		checksum *TarChecksum
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *TarInput:
+			input = o
+		case *StripComponents:
+			strip = o
+		case *LocalGitSubdir:
+			subdir = o
+		case *TarChecksum:
+			checksum = o
+		}
+	}
+
+	var (
+		n  int
+		sd string
+	)
+	if strip != nil {
+		n = strip.N
+	}
+	if subdir != nil {
+		sd = path.Clean(filepath.ToSlash(subdir.Path))
+		if path.IsAbs(sd) || sd == ".." || strings.HasPrefix(sd, "../") {
+			return nil, errdefs.WithInvalidSubdir(subdir.Node, subdir.Path, "must be relative to the root of the tarball")
+		}
+		if sd == "." {
+			sd = ""
+		}
+	}
+
+	// A tarball in a filesystem is only read by BuildKit, which rejects
+	// entries outside of the filesystem as it unpacks them.
+	if input != nil {
+		if checksum != nil {
+			return nil, errdefs.WithUnsupportedTarChecksum(checksum.Node, input.Node)
+		}
+		return NewValue(ctx, Filesystem{
+			State:       selectTarEntries(unpackTar(input.Input.State, path.Join("/", tarPath)), n, sd),
+			Platform:    input.Input.Platform,
+			SolveOpts:   input.Input.SolveOpts,
+			SessionOpts: input.Input.SessionOpts,
+		})
+	}
+
+	localPath, err := parser.ResolvePath(ModuleDir(ctx), tarPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like local, modules imported from a filesystem read their own files,
+	// and only modules in local directories read the host.
+	dir := Module(ctx).Directory
+	absPath := localPath
+	if dir.Definition() == nil {
+		if !filepath.IsAbs(absPath) {
+			cwd, err := local.Cwd(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			absPath = filepath.Join(cwd, localPath)
+		}
+
+		err = CheckHostAccess(ctx, HostAccess{Builtin: "tarContext", Path: absPath})
+		if err != nil {
+			return nil, errdefs.WithHostAccessDenied(Arg(ctx, 0), localPath, err)
+		}
+	}
+
+	fi, err := dir.Stat(localPath)
+	if err != nil {
+		return nil, Arg(ctx, 0).WithError(err)
+	}
+	if fi.IsDir() {
+		return nil, errdefs.WithNotTarball(Arg(ctx, 0), localPath, fmt.Errorf("is a directory"))
+	}
+
+	if checksum != nil {
+		actual, err := fileDigest(dir, localPath, checksum.Digest.Algorithm())
+		if err != nil {
+			return nil, Arg(ctx, 0).WithError(err)
+		}
+		if actual != checksum.Digest {
+			return nil, errdefs.WithTarChecksumMismatch(checksum.Node, localPath, checksum.Digest, actual)
+		}
+	}
+
+	entries, err := readTarball(dir, localPath)
+	if err != nil {
+		var te *tarEntryError
+		if errors.As(err, &te) {
+			return nil, errdefs.WithTarPathTraversal(Arg(ctx, 0), localPath, te.Entry)
+		}
+		return nil, errdefs.WithNotTarball(Arg(ctx, 0), localPath, err)
+	}
+	if sd != "" && !hasTarDir(entries, n, sd) {
+		return nil, errdefs.WithInvalidSubdir(subdir.Node, subdir.Path, "is not a directory in the tarball")
+	}
+
+	var fs Filesystem
+	if dir.Definition() != nil {
+		defop, err := llb.NewDefinitionOp(dir.Definition().ToPB())
+		if err != nil {
+			return nil, err
+		}
+		fs = Filesystem{
+			State:    unpackTar(llb.NewState(defop), localPath),
+			Platform: DefaultPlatform(ctx),
+		}
+	} else {
+		// Only the tarball is synced up, so it is unpacked by BuildKit
+		// instead of on the host.
+		filename := filepath.Base(localPath)
+		localOpts := []llb.LocalOption{
+			llbutil.IncludePatterns([]string{filename}),
+			llbutil.ExcludePatterns([]string{}),
+		}
+		for _, opt := range SourceMap(ctx) {
+			localOpts = append(localOpts, opt)
+		}
+
+		// A tarball with a checksum is identified by it instead of its path,
+		// so the same tarball at another path is synced up to the same cache.
+		id := absPath
+		if checksum != nil {
+			id = checksum.Digest.String()
+		}
+
+		v, err := localSource(ctx, localPath, id, filepath.Dir(localPath), localOpts, nil)
+		if err != nil {
+			return nil, err
+		}
+		fs, err = v.Filesystem()
+		if err != nil {
+			return nil, err
+		}
+		fs.State = unpackTar(fs.State, path.Join("/", filename))
+	}
+
+	fs.State = selectTarEntries(fs.State, n, sd)
+	return NewValue(ctx, fs)
+}
+
+// unpackTar returns a filesystem with the tarball at a path of st unpacked
+// into it.
+func unpackTar(st llb.State, tarPath string) llb.State {
+	return llb.Scratch().File(
+		llb.Copy(st, tarPath, "/", llbutil.WithAttemptUnpack(true)),
+	)
+}
+
+// selectTarEntries returns a filesystem with the entries of an unpacked
+// tarball with n leading components stripped from their paths, and only those
+// under subdir if it is not empty.
+//
+// The entries with n components stripped are the children of the directories
+// n components deep, so they are copied to the root by a wildcard. Entries
+// with no more than n components aren't matched, like tar --strip-components.
+func selectTarEntries(st llb.State, n int, subdir string) llb.State {
+	if n == 0 && subdir == "" {
+		return st
+	}
+
+	src := strings.Repeat("/*", n)
+	if subdir != "" {
+		src = path.Join(src, escapePattern(subdir))
+	}
+	return llb.Scratch().File(
+		llb.Copy(st, path.Join("/", src, "*"), "/",
+			llbutil.WithAllowWildcard(true),
+			llbutil.WithAllowEmptyWildcard(true),
+		),
+	)
+}
+
+// hasTarDir returns true if subdir is a directory of the entries with n
+// leading components stripped from their paths.
+func hasTarDir(entries []string, n int, subdir string) bool {
+	for _, entry := range entries {
+		parts := strings.Split(entry, "/")
+		if len(parts) <= n {
+			continue
+		}
+		p := strings.Join(parts[n:], "/")
+		if p == subdir || strings.HasPrefix(p, subdir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// tarEntryError is returned for an entry of a tarball that would be unpacked
+// outside of the filesystem.
+type tarEntryError struct {
+	Entry string
+}
+
+func (e *tarEntryError) Error() string {
+	return fmt.Sprintf("entry %q is outside of the filesystem", e.Entry)
+}
+
+// readTarball returns the cleaned paths of the entries of a tarball, which
+// may be compressed. The tarball is streamed, so only the headers of its
+// entries are kept.
+//
+// Entries that BuildKit would reject as it unpacks them, because they or the
+// targets of their links are outside of the filesystem, are rejected with a
+// tarEntryError.
+func readTarball(dir ast.Directory, filename string) ([]string, error) {
+	f, err := dir.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dr, err := archive.DecompressStream(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	var entries []string
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if outsideTar(name) {
+			return nil, &tarEntryError{Entry: hdr.Name}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			if outsideTar(path.Clean(hdr.Linkname)) {
+				return nil, &tarEntryError{Entry: hdr.Name}
+			}
+		case tar.TypeSymlink:
+			if outsideTar(path.Join(path.Dir(name), hdr.Linkname)) {
+				return nil, &tarEntryError{Entry: hdr.Name}
+			}
+		}
+		entries = append(entries, strings.TrimPrefix(name, "/"))
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("has no entries")
+	}
+	return entries, nil
+}
+
+// fileDigest returns the digest of a file in an algorithm.
+func fileDigest(dir ast.Directory, filename string, algorithm digest.Algorithm) (digest.Digest, error) {
+	f, err := dir.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return algorithm.FromReader(f)
+}
+
+// outsideTar returns true if a cleaned path relative to the root of a
+// tarball is outside of it.
+func outsideTar(p string) bool {
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+type TarInput struct {
+	Input Filesystem
+	Node  ast.Node
+}
+
+func (ti TarInput) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &TarInput{
+		Input: input,
+		Node:  ProgramCounter(ctx),
+	}))
+}
+
+type StripComponents struct {
+	N int
+}
+
+func (sc StripComponents) Call(ctx context.Context, cln *client.Client, val Value, opts Option, n int) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 0 {
+		return nil, errdefs.WithInvalidStripComponents(Arg(ctx, 0), n)
+	}
+	return NewValue(ctx, append(retOpts, &StripComponents{N: n}))
+}
+
+type TarChecksum struct {
+	Digest digest.Digest
+	Node   ast.Node
+}
+
+func (tc TarChecksum) Call(ctx context.Context, cln *client.Client, val Value, opts Option, dgst digest.Digest) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	err = dgst.Validate()
+	if err != nil {
+		return nil, Arg(ctx, 0).WithError(err)
+	}
+	return NewValue(ctx, append(retOpts, &TarChecksum{
+		Digest: dgst,
+		Node:   ProgramCounter(ctx),
+	}))
+}
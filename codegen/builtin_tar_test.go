@@ -0,0 +1,275 @@
+package codegen
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+var projectEntries = []tarEntry{
+	{name: "proj-1.0/", typeflag: tar.TypeDir},
+	{name: "proj-1.0/README", content: "readme\n"},
+	{name: "proj-1.0/src/", typeflag: tar.TypeDir},
+	{name: "proj-1.0/src/main.go", content: "package main\n"},
+	{name: "proj-1.0/src/current", typeflag: tar.TypeSymlink, linkname: "main.go"},
+	{name: "proj-1.0/src/hard", typeflag: tar.TypeLink, linkname: "proj-1.0/src/main.go"},
+	{name: "VERSION", content: "1.0\n"},
+}
+
+// writeTarball writes a tarball of entries to a file, compressed with gzip or
+// zstd, or uncompressed if compression is empty.
+func writeTarball(t *testing.T, filename, compression string, entries []tarEntry) {
+	f, err := os.Create(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var w io.WriteCloser = f
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(f)
+	case "zstd":
+		w, err = zstd.NewWriter(f)
+		require.NoError(t, err)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Uid:      1000,
+			Gid:      1000,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if entry.typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	if w != f {
+		require.NoError(t, w.Close())
+	}
+}
+
+func TestReadTarball(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		compression := compression
+		t.Run(fmt.Sprintf("compression %q", compression), func(t *testing.T) {
+			t.Parallel()
+
+			filename := filepath.Join(t.TempDir(), "context.tar")
+			writeTarball(t, filename, compression, projectEntries)
+
+			entries, err := readTarball(parser.NewLocalDirectory("/", ""), filename)
+			require.NoError(t, err)
+			require.Equal(t, []string{
+				"proj-1.0",
+				"proj-1.0/README",
+				"proj-1.0/src",
+				"proj-1.0/src/main.go",
+				"proj-1.0/src/current",
+				"proj-1.0/src/hard",
+				"VERSION",
+			}, entries)
+		})
+	}
+
+	filename := filepath.Join(t.TempDir(), "context.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("not a tarball"), 0644))
+	_, err := readTarball(parser.NewLocalDirectory("/", ""), filename)
+	require.Error(t, err)
+}
+
+func TestTarContextTraversal(t *testing.T) {
+	t.Parallel()
+
+	for _, entry := range []tarEntry{
+		{name: "../evil", content: "evil"},
+		{name: "proj/../../evil", content: "evil"},
+		{name: "proj/passwd", typeflag: tar.TypeSymlink, linkname: "../../etc/passwd"},
+		{name: "proj/shadow", typeflag: tar.TypeLink, linkname: "../etc/shadow"},
+	} {
+		entry := entry
+		t.Run(entry.name, func(t *testing.T) {
+			t.Parallel()
+
+			filename := filepath.Join(t.TempDir(), "context.tar.gz")
+			writeTarball(t, filename, "gzip", []tarEntry{
+				{name: "proj/", typeflag: tar.TypeDir},
+				entry,
+			})
+
+			ctx, mod := parseTestModule(t, fmt.Sprintf(`
+			fs default() {
+				tarContext %q
+			}
+			`, filename))
+			v, err := New(nil, nil).EmitTarget(ctx, mod, Target{Name: "default"})
+			require.NoError(t, err)
+			_, err = v.Filesystem()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), fmt.Sprintf("has entry %q outside of the filesystem", entry.name))
+		})
+	}
+}
+
+// tarContextCopies returns the copy actions of the filesystem of the default
+// target, in the order they are run.
+func tarContextCopies(ctx context.Context, t *testing.T, mod *ast.Module) []*pb.FileActionCopy {
+	v, err := New(nil, nil).EmitTarget(ctx, mod, Target{Name: "default"})
+	require.NoError(t, err)
+	fs, err := v.Filesystem()
+	require.NoError(t, err)
+
+	def, err := fs.State.Marshal(ctx, llb.LinuxAmd64)
+	require.NoError(t, err)
+
+	var copies []*pb.FileActionCopy
+	for _, dt := range def.Def {
+		var op pb.Op
+		require.NoError(t, op.Unmarshal(dt))
+		if file := op.GetFile(); file != nil {
+			for _, action := range file.Actions {
+				if cp := action.GetCopy(); cp != nil {
+					copies = append(copies, cp)
+				}
+			}
+		}
+	}
+	return copies
+}
+
+func TestTarContext(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "context.tar.zst")
+	writeTarball(t, filename, "zstd", projectEntries)
+	dt, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	dgst := digest.FromBytes(dt)
+
+	t.Run("unpack", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, mod := parseTestModule(t, fmt.Sprintf(`
+		fs default() {
+			tarContext %q
+		}
+		`, filename))
+		copies := tarContextCopies(ctx, t, mod)
+		require.Len(t, copies, 1)
+		require.Equal(t, "/context.tar.zst", copies[0].Src)
+		require.Equal(t, "/", copies[0].Dest)
+		require.True(t, copies[0].AttemptUnpackDockerCompatibility)
+	})
+
+	t.Run("strip components and subdir", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, mod := parseTestModule(t, fmt.Sprintf(`
+		fs default() {
+			tarContext %q with option {
+				stripComponents 1
+				subdir "src"
+				checksum %q
+			}
+		}
+		`, filename, dgst))
+		copies := tarContextCopies(ctx, t, mod)
+		require.Len(t, copies, 2)
+		require.True(t, copies[0].AttemptUnpackDockerCompatibility)
+		require.Equal(t, "/*/src/*", copies[1].Src)
+		require.Equal(t, "/", copies[1].Dest)
+		require.True(t, copies[1].AllowWildcard)
+		require.False(t, copies[1].AttemptUnpackDockerCompatibility)
+	})
+
+	t.Run("input", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, mod := parseTestModule(t, `
+		fs default() {
+			tarContext "dist/app.tar.gz" with option {
+				input image("builder")
+				stripComponents 2
+			}
+		}
+		`)
+		copies := tarContextCopies(ctx, t, mod)
+		require.Len(t, copies, 2)
+		require.Equal(t, "/dist/app.tar.gz", copies[0].Src)
+		require.True(t, copies[0].AttemptUnpackDockerCompatibility)
+		require.Equal(t, "/*/*/*", copies[1].Src)
+	})
+
+	for _, tc := range []struct {
+		name string
+		opts string
+		err  string
+	}{{
+		"checksum mismatch",
+		fmt.Sprintf("checksum %q", digest.FromString("other")),
+		fmt.Sprintf("has checksum %s, expected %s", dgst, digest.FromString("other")),
+	}, {
+		"subdir not in tarball",
+		"subdir \"src\"",
+		"invalid subdir src",
+	}, {
+		"subdir outside of tarball",
+		"subdir \"../src\"",
+		"invalid subdir ../src",
+	}, {
+		"checksum with input",
+		fmt.Sprintf("input scratch\nchecksum %q", dgst),
+		"checksum is only supported for tarballs on the host",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, mod := parseTestModule(t, fmt.Sprintf(`
+			fs default() {
+				tarContext %q with option {
+					%s
+				}
+			}
+			`, filename, tc.opts))
+			v, err := New(nil, nil).EmitTarget(ctx, mod, Target{Name: "default"})
+			require.NoError(t, err)
+			_, err = v.Filesystem()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
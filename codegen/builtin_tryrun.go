@@ -0,0 +1,104 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/openllb/hlb/pkg/llbutil"
+)
+
+// ExitStatusMountpoint is where the exit status of a tryRun command is
+// written. BuildKit fails an exec that exits with a non-zero status, so the
+// command is wrapped to record its status and exit successfully instead.
+const ExitStatusMountpoint = "/run/hlb/status"
+
+type TryRun struct{}
+
+func (tr TryRun) Call(ctx context.Context, cln *client.Client, val Value, opts Option, input Filesystem, command string, args ...string) (Value, error) {
+	var (
+		runOpts []llb.RunOption
+		shlex   = false
+		stdin   *Stdin
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llb.RunOption:
+			runOpts = append(runOpts, o)
+		case *Shlex:
+			shlex = true
+		case *Stdin:
+			stdin = o
+		}
+	}
+	for _, opt := range SourceMap(ctx) {
+		runOpts = append(runOpts, opt)
+	}
+
+	runArgs, err := ShlexArgs(append([]string{command}, args...), shlex)
+	if err != nil {
+		return nil, err
+	}
+
+	customName := strings.ReplaceAll(shellquote.Join(runArgs...), "\n", "\\n")
+	// The exit status is recorded with the shell of the filesystem, which
+	// also redirects stdin.
+	execArgs := exitStatusArgs(path.Join(ExitStatusMountpoint, "code"), runArgs)
+	if stdin != nil {
+		var stdinOpts []llb.RunOption
+		execArgs, stdinOpts = stdin.Wrap(execArgs, input.Platform)
+		runOpts = append(runOpts, stdinOpts...)
+	}
+	runOpts = append(runOpts,
+		&llbutil.MountRunOption{
+			Source: llb.Scratch(),
+			Target: ExitStatusMountpoint,
+		},
+		llb.Args(execArgs),
+		llb.WithCustomName(customName),
+	)
+
+	err = llbutil.ShimReadonlyMountpoints(runOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	run := input.State.Run(runOpts...)
+	status := Filesystem{
+		State:       run.GetMount(ExitStatusMountpoint),
+		Platform:    input.Platform,
+		SolveOpts:   input.SolveOpts,
+		SessionOpts: input.SessionOpts,
+	}
+
+	dt, err := readPath(ctx, cln, status, "code")
+	if err != nil {
+		return nil, err
+	}
+	code, err := parseExitStatus(dt)
+	if err != nil {
+		return nil, ProgramCounter(ctx).WithError(err)
+	}
+	return NewValue(ctx, code == 0)
+}
+
+// exitStatusArgs wraps args with a shell that writes their exit status to
+// statusPath, so that the command always succeeds.
+func exitStatusArgs(statusPath string, args []string) []string {
+	return append([]string{"/bin/sh", "-c", fmt.Sprintf(`"$@"; echo $? > %s`, statusPath), "tryRun"}, args...)
+}
+
+// parseExitStatus parses the exit status written by the exitStatusArgs
+// wrapper.
+func parseExitStatus(dt []byte) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(string(dt)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid exit status %q", strings.TrimSpace(string(dt)))
+	}
+	return code, nil
+}
@@ -0,0 +1,70 @@
+package codegen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitStatusArgs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected int
+	}{{
+		"success",
+		[]string{"true"},
+		0,
+	}, {
+		"failure",
+		[]string{"false"},
+		1,
+	}, {
+		"shell command",
+		[]string{"/bin/sh", "-c", "echo checking; exit 3"},
+		3,
+	}, {
+		"args with spaces",
+		[]string{"test", "a b", "=", "a b"},
+		0,
+	}, {
+		"command not found",
+		[]string{"does-not-exist"},
+		127,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			statusPath := filepath.Join(t.TempDir(), "code")
+			args := exitStatusArgs(statusPath, tc.args)
+
+			// The wrapper succeeds so that the exec does not fail the build.
+			err := exec.Command(args[0], args[1:]...).Run()
+			require.NoError(t, err)
+
+			dt, err := os.ReadFile(statusPath)
+			require.NoError(t, err)
+
+			code, err := parseExitStatus(dt)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, code)
+		})
+	}
+}
+
+func TestParseExitStatus(t *testing.T) {
+	t.Parallel()
+
+	code, err := parseExitStatus([]byte("0\n"))
+	require.NoError(t, err)
+	require.Equal(t, 0, code)
+
+	_, err = parseExitStatus(nil)
+	require.EqualError(t, err, `invalid exit status ""`)
+}
@@ -0,0 +1,172 @@
+package codegen
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+)
+
+const (
+	// DefaultWriteFileMode is the mode of a written file, unless overridden
+	// with mode.
+	DefaultWriteFileMode os.FileMode = 0o644
+
+	// AppendMountpoint is where the filesystem being appended to is mounted
+	// in the helper.
+	AppendMountpoint = "/run/hlb/append"
+
+	// AppendContentMountpoint is where the content being appended is mounted
+	// in the helper, as a file named content.
+	AppendContentMountpoint = "/run/hlb/append-content"
+)
+
+// AppendScript appends the content to a file, which must exist unless its
+// second argument is "true".
+const AppendScript = `set -e
+target="` + AppendMountpoint + `$1"
+if [ ! -e "$target" ]; then
+	if [ "$2" != "true" ]; then
+		echo "error: $1 does not exist" >&2
+		exit 1
+	fi
+	: > "$target"
+	chmod 0644 "$target"
+fi
+cat ` + AppendContentMountpoint + `/content >> "$target"
+`
+
+type WriteFile struct{}
+
+func (wf WriteFile) Call(ctx context.Context, cln *client.Client, val Value, opts Option, p, content string) (Value, error) {
+	fs, err := val.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mode            = DefaultWriteFileMode
+		modeSet         bool
+		appendFile      bool
+		createIfMissing bool
+		templated       bool
+		mkfileOpts      []llb.MkfileOption
+		copyOpts        []llb.CopyOption
+	)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *WriteFileMode:
+			mode, modeSet = o.Mode, true
+		case *WriteFileAppend:
+			appendFile = true
+		case *WriteFileCreateIfMissing:
+			createIfMissing = true
+		case *WriteFileTemplated:
+			templated = true
+		case llb.ChownOption:
+			mkfileOpts = append(mkfileOpts, o)
+			copyOpts = append(copyOpts, o)
+		case llb.MkfileOption:
+			mkfileOpts = append(mkfileOpts, o)
+		}
+	}
+
+	if templated {
+		content, err = executeTemplate(content, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !appendFile {
+		fs.State = fs.State.File(
+			llb.Mkfile(p, mode, []byte(content), mkfileOpts...),
+			SourceMap(ctx)...,
+		)
+		return NewValue(ctx, fs)
+	}
+
+	if !path.IsAbs(p) {
+		dir, err := fs.State.GetDir(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p = path.Join("/", dir, p)
+	}
+
+	// The file is read and written by the helper at solve time, and the
+	// filesystem is an input of the helper, so the result is cached with
+	// the contents of the file as usual.
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"/bin/sh", "-c", AppendScript, "append", p, strconv.FormatBool(createIfMissing)}),
+		llb.AddMount(AppendContentMountpoint, llb.Scratch().File(
+			llb.Mkfile("/content", 0o644, []byte(content)),
+		), llb.Readonly),
+		llb.AddMount(AppendMountpoint, fs.State),
+		llb.WithCustomNamef("append to %s", p),
+	}
+	for _, opt := range SourceMap(ctx) {
+		runOpts = append(runOpts, opt)
+	}
+	es := helperImage(ctx).Run(runOpts...)
+	fs.State = es.GetMount(AppendMountpoint)
+
+	// The helper keeps the mode and owner of an existing file, so they are
+	// only changed when set.
+	if modeSet || len(copyOpts) > 0 {
+		info := &llb.CopyInfo{}
+		if modeSet {
+			info.Mode = &mode
+		}
+		fs.State = fs.State.File(
+			llb.Copy(fs.State, p, p, append([]llb.CopyOption{info}, copyOpts...)...),
+			SourceMap(ctx)...,
+		)
+	}
+	return NewValue(ctx, fs)
+}
+
+type WriteFileMode struct {
+	Mode os.FileMode
+}
+
+func (wfm WriteFileMode) Call(ctx context.Context, cln *client.Client, val Value, opts Option, mode os.FileMode) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &WriteFileMode{Mode: mode}))
+}
+
+type WriteFileAppend struct{}
+
+func (wfa WriteFileAppend) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &WriteFileAppend{}))
+}
+
+type WriteFileCreateIfMissing struct{}
+
+func (wfc WriteFileCreateIfMissing) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &WriteFileCreateIfMissing{}))
+}
+
+type WriteFileTemplated struct{}
+
+func (wft WriteFileTemplated) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &WriteFileTemplated{}))
+}
@@ -4,10 +4,14 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/docker/buildx/util/progress"
 	"github.com/lithammer/dedent"
 	"github.com/moby/buildkit/client"
 	"github.com/openllb/hlb/checker"
@@ -17,30 +21,200 @@ import (
 	"github.com/openllb/hlb/parser"
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/pkg/redact"
 	"github.com/openllb/hlb/solver"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 )
 
 type CodeGen struct {
-	cln      *client.Client
-	resolver Resolver
-	dbgr     *debugger
-	g        singleflight.Group
+	cln           *client.Client
+	resolver      Resolver
+	dbgr          *debugger
+	g             singleflight.Group
+	importTimeout time.Duration
+	importSem     *semaphore.Weighted
+	modules       *ModuleCache
+	imports       *importBindings
+	secretRoot    string
+	hostPolicy    HostPolicy
+	sandbox       *importSandbox
+	scanner       Scanner
+	outputDelim   string
+	metadata      *metadataFile
+	gates         gatePolicy
+	lockfile      *Lockfile
+	testMode      bool
+	hooks         *Hooks
+	runHooks      *RunHooks
+	redactions    *redact.Set
+	sensitiveEnv  []string
+	evalPool      *evalPool
+	transferCache *solver.TransferCache
+
+	prewarmAllImages bool
+
+	requirePinnedFrontends bool
+
+	noPreflight bool
+
+	lintMode         LintMode
+	importLintMode   LintMode
+	diagnosticWriter io.Writer
+	lints            *lintResults
 }
 
-func New(cln *client.Client, resolver Resolver) *CodeGen {
-	return &CodeGen{
-		cln:      cln,
-		resolver: resolver,
+// DefaultImportConcurrency is the default number of fs-based imports that are
+// resolved concurrently.
+const DefaultImportConcurrency = 4
+
+type CodeGenOption func(*CodeGen)
+
+// WithImportTimeout bounds how long each fs-based import may take to resolve.
+// A timeout of zero waits indefinitely.
+func WithImportTimeout(d time.Duration) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.importTimeout = d
+	}
+}
+
+// WithImportConcurrency sets the number of fs-based imports that are resolved
+// concurrently.
+func WithImportConcurrency(n int) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.importSem = semaphore.NewWeighted(int64(n))
+	}
+}
+
+// WithSecretRoot sets the directory that local secret paths are relative to,
+// instead of the directory of the module declaring them.
+func WithSecretRoot(dir string) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.secretRoot = dir
+	}
+}
+
+// WithTransferCache sets the cache of the large files synced up by local
+// sources with largeFileThreshold, which is only kept in memory by default.
+func WithTransferCache(cache *solver.TransferCache) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.transferCache = cache
+	}
+}
+
+// HostAccess describes a read of the host by a builtin, or the write of the
+// report of a failed scan.
+type HostAccess struct {
+	// Builtin is the name of the builtin reading the host.
+	Builtin string
+
+	// Path is the local path or glob being read or written.
+	Path string
+
+	// Command is the command and its args run by localRun.
+	Command []string
+
+	// Key is the environment variable read by localEnv.
+	Key string
+
+	// Address is the network address dialed by forward.
+	Address string
+}
+
+// HostPolicy decides whether a builtin may read the host, and vetoes the read
+// by returning an error.
+type HostPolicy func(ctx context.Context, access HostAccess) error
+
+// WithHostPolicy adds a policy that is consulted before local, secret,
+// secretFile and secretDir read local files, ssh and forward forward sockets
+// or addresses, localRun runs a command and localEnv reads an environment
+// variable. A read is vetoed if any of the policies veto it.
+func WithHostPolicy(policy HostPolicy) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.addHostPolicy(policy)
+	}
+}
+
+func (cg *CodeGen) addHostPolicy(policy HostPolicy) {
+	prev := cg.hostPolicy
+	switch {
+	case policy == nil:
+	case prev == nil:
+		cg.hostPolicy = policy
+	default:
+		cg.hostPolicy = func(ctx context.Context, access HostAccess) error {
+			err := prev(ctx, access)
+			if err != nil {
+				return err
+			}
+			return policy(ctx, access)
+		}
 	}
 }
 
+// WithScanner sets the scanner used by scan, instead of running trivy in a
+// container.
+func WithScanner(scanner Scanner) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.scanner = scanner
+	}
+}
+
+func New(cln *client.Client, resolver Resolver, opts ...CodeGenOption) *CodeGen {
+	cg := &CodeGen{
+		cln:            cln,
+		resolver:       resolver,
+		importSem:      semaphore.NewWeighted(DefaultImportConcurrency),
+		modules:        NewModuleCache(),
+		imports:        newImportBindings(),
+		importLintMode: LintWarn,
+		lints:          newLintResults(),
+		outputDelim:    DefaultOutputDelimiter,
+		transferCache:  solver.NewTransferCache(),
+	}
+	for _, opt := range opts {
+		opt(cg)
+	}
+	return cg
+}
+
+// Target is a target of a module to generate. It used to only have a name, so
+// it could be constructed from an unkeyed literal like Target{"default"},
+// which no longer compiles. Construct it with keyed fields, since more are
+// added as targets gain settings.
 type Target struct {
 	Name string
+
+	// Args are the arguments of the target's parameters, which are parsed
+	// according to their types. Only string, int and bool parameters can be
+	// set this way.
+	Args []string
+
+	// Output is where the value of a string target is written, which
+	// defaults to stdout. Other targets ignore it.
+	Output io.Writer
+
+	// StopAt is a statement where the target stops, given as either
+	// `file.hlb:LINE` or `funcName#N` for the Nth statement of a function.
+	// The block of the statement stops emitting after it, and the value
+	// after it is the value of the target, so exports declared later are
+	// skipped.
+	StopAt string
+
+	// StopDownload is a local directory where the filesystem of a target
+	// stopped at StopAt is downloaded. If empty, it is only solved.
+	StopDownload string
 }
 
-func (cg *CodeGen) Generate(ctx context.Context, mod *ast.Module, targets []Target) (result solver.Request, err error) {
+// Generate returns the request of the targets of a module, with the kind of
+// each target so that a driver knows how to handle its output.
+func (cg *CodeGen) Generate(ctx context.Context, mod *ast.Module, targets []Target) (*Result, error) {
+	var (
+		result solver.Request
+		err    error
+	)
 	if GetDebugger(ctx) != nil {
 		switch dbgr := GetDebugger(ctx).(type) {
 		case testDebugger:
@@ -50,43 +224,356 @@ func (cg *CodeGen) Generate(ctx context.Context, mod *ast.Module, targets []Targ
 		}
 		ctx = WithGlobalSolveOpts(ctx, solver.WithErrorHandler(cg.errorHandler))
 	}
+	stop := func() {}
+	if cg.dbgr != nil {
+		// Every register evaluates with a context derived from this one, so
+		// ending the debugging session cancels their solves.
+		ctx, stop = cg.dbgr.withTerminate(ctx)
+	}
 
-	var requests []solver.Request
-	for i, target := range targets {
-		_, ok := mod.Scope.Objects[target.Name]
+	if cg.lintMode != LintOff {
+		cg.Lint(ctx, mod, targets...)
+	}
+
+	hr := newHookRun(cg.hooks)
+	ctx = withHookRun(ctx, hr)
+
+	sd := newSourceDedup()
+	ctx = withSourceDedup(ctx, sd)
+
+	if cg.testMode {
+		if len(targets) == 0 {
+			targets = Tests(mod)
+		}
+		result, err = cg.generateTests(ctx, mod, targets)
+	} else {
+		var requests []solver.Request
+		requests, err = cg.generate(ctx, mod, "", targets)
+		result = &dedupRequest{
+			w:   cg.diagnosticWriter,
+			sd:  sd,
+			req: solver.Parallel(requests...),
+		}
+	}
+	lerr := cg.reportLint(ctx)
+	if err != nil {
+		stop()
+		if hr != nil {
+			return nil, hr.withErr(err)
+		}
+		return nil, err
+	}
+	if lerr != nil {
+		stop()
+		return nil, lerr
+	}
+	if hr != nil {
+		result = hr.Request(result)
+	}
+	if cg.dbgr != nil {
+		result = &terminateRequest{Request: result, stop: stop}
+	}
+	return &Result{
+		Request: result,
+		Targets: generatedTargets(mod, targets),
+	}, nil
+}
+
+// EmitTarget emits a single target of a module and returns its value without
+// building it, so that values of any kind can be inspected.
+func (cg *CodeGen) EmitTarget(ctx context.Context, mod *ast.Module, target Target) (Value, error) {
+	ctx, err := cg.generateContext(ctx, mod, []Target{target})
+	if err != nil {
+		return nil, err
+	}
+	return cg.emitTarget(ctx, mod, 0, target)
+}
+
+// generateContext returns a context for generating the targets of a module.
+func (cg *CodeGen) generateContext(ctx context.Context, mod *ast.Module, targets []Target) (context.Context, error) {
+	// Module-level constants are evaluated at most once per Generate.
+	ctx = withMemo(ctx, newMemo())
+	ctx = withStatCache(ctx, newStatCache())
+	ctx = withSecretRoot(ctx, cg.secretRoot)
+	ctx = withHostPolicy(ctx, cg.hostPolicy)
+	ctx = withScanner(ctx, cg.scanner)
+	ctx = withRunHooks(ctx, cg.runHooks)
+	ctx = withSensitiveEnv(ctx, cg.sensitiveEnv)
+	ctx = withMetadataFile(ctx, cg.metadata)
+	ctx = withGatePolicy(ctx, cg.gates)
+	ctx = withLockfile(ctx, cg.lockfile)
+	ctx = withEvalPool(ctx, cg.evalPool)
+	ctx = withTransferCache(ctx, cg.transferCache)
+	ctx = withPreflight(ctx, !cg.noPreflight)
+	ctx = withLintWarner(ctx, &lintWarner{lr: cg.lints, mode: cg.lintMode})
+	ctx = withMetrics(ctx, solver.MetricsFromOptions(GlobalSolveOpts(ctx)...))
+
+	// Sensitive values are redacted from every solve, including those of the
+	// values of other targets. They are redacted by the context of the solves
+	// rather than by the solve options of each value, so the requests that
+	// are returned are solved with it by redactedRequest.
+	redactions := cg.redactions
+	if redactions == nil {
+		redactions = redact.NewSet()
+	}
+	ctx = withRedactions(ctx, redactions)
+	ctx = solver.WithRedactionSet(ctx, redactions)
+
+	// Sources are shared by the targets of a Generate, including the modules
+	// of a GenerateAll, but never across them.
+	if getSourceDedup(ctx) == nil {
+		ctx = withSourceDedup(ctx, newSourceDedup())
+	}
+
+	if cg.requirePinnedFrontends {
+		err := checkPinnedFrontends(mod, cg.lockfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Targets that ignore the value they are called on have a single resulting
+	// state, which is shared by other targets that reference them so that the
+	// subgraph is only built once.
+	shared := make(map[*ast.FuncDecl]struct{})
+	for _, target := range targets {
+		obj, ok := mod.Scope.Objects[target.Name]
 		if !ok {
-			return nil, fmt.Errorf("target %q is not defined in %s", target.Name, mod.Pos.Filename)
+			return nil, errdefs.WithUndefinedTarget(fmt.Errorf("target %q is not defined in %s", target.Name, mod.Pos.Filename), target.Name)
+		}
+		if fd, ok := obj.Node.(*ast.FuncDecl); ok && checker.IsIndependent(fd) {
+			shared[fd] = struct{}{}
 		}
+	}
 
-		// Yield before compiling anything.
-		ret := NewRegister(ctx)
-		if cg.dbgr != nil {
-			err := cg.dbgr.yield(ctx, mod.Scope, mod, ret.Value(), nil, nil)
-			if err != nil {
-				return nil, err
+	// Stages copied from by name are shared the same way, even if they are
+	// impure, like stages of a Dockerfile.
+	ast.Match(mod, ast.MatchOpts{},
+		func(call *ast.CallStmt) {
+			if call.From == nil || len(call.Args) == 0 || call.Args[0].CallExpr == nil {
+				return
+			}
+			obj, ok := mod.Scope.Objects[call.Args[0].CallExpr.Name.Ident.Text]
+			if !ok {
+				return
+			}
+			if fd, ok := obj.Node.(*ast.FuncDecl); ok && checker.IsIndependent(fd) {
+				shared[fd] = struct{}{}
 			}
+		},
+	)
+	return withTargets(ctx, shared), nil
+}
+
+// emitTarget emits the i-th target of a module.
+func (cg *CodeGen) emitTarget(ctx context.Context, mod *ast.Module, i int, target Target) (Value, error) {
+	// Yield before compiling anything.
+	ret := NewRegister(ctx)
+	if cg.dbgr != nil {
+		err := cg.dbgr.yield(ctx, mod.Scope, mod, ret.Value(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Build expression for target.
+	ie := ast.NewIdentExpr(target.Name)
+	ie.Pos.Filename = "target"
+	ie.Pos.Line = i
+
+	args, err := targetArgs(ctx, mod, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var sp *stopPoint
+	if target.StopAt != "" {
+		stmt, err := resolveStopAt(mod, target.StopAt)
+		if err != nil {
+			return nil, err
+		}
+		sp = &stopPoint{stmt: stmt}
+		ctx = withStopPoint(ctx, sp)
+	}
+
+	// Every target has a return register.
+	err = cg.EmitIdentExpr(ctx, mod.Scope, ie, ie.Ident, args, nil, nil, ret)
+	if err != nil {
+		return nil, err
+	}
+	if sp != nil {
+		return stopTarget(ctx, sp, target, ret.Value())
+	}
+	return ret.Value(), nil
+}
+
+// stopTarget returns the value of a target at its stop point. The target is
+// evaluated until the stop point is reached, which fails the rest of it with
+// errStopped.
+func stopTarget(ctx context.Context, sp *stopPoint, target Target, val Value) (Value, error) {
+	val = unwrapLazy(val)
+	stopped := sp.value()
+	if stopped == nil {
+		if ev, ok := val.(*errorValue); ok {
+			return nil, ev.err
 		}
+		return nil, fmt.Errorf("target %s never reached its stop point %s", target.Name, target.StopAt)
+	}
+	if target.StopDownload == "" {
+		return stopped, nil
+	}
+
+	fs, err := stopped.Filesystem()
+	if err != nil {
+		return nil, fmt.Errorf("stop point %s of target %s must be a filesystem to download it: %w", target.StopAt, target.Name, err)
+	}
+	fs.SolveOpts = append(fs.SolveOpts, solver.WithDownload(target.StopDownload))
+	fs.SessionOpts = append(fs.SessionOpts, llbutil.WithSyncTargetDir(target.StopDownload))
+	return NewValue(ctx, fs)
+}
+
+// generate returns a request for each target of a module. Targets are named
+// after the module's prefix, if any, for the hooks of the build.
+func (cg *CodeGen) generate(ctx context.Context, mod *ast.Module, prefix string, targets []Target) ([]solver.Request, error) {
+	ctx, err := cg.generateContext(ctx, mod, targets)
+	if err != nil {
+		return nil, err
+	}
 
-		// Build expression for target.
-		ie := ast.NewIdentExpr(target.Name)
-		ie.Pos.Filename = "target"
-		ie.Pos.Line = i
+	outputs := newOutputSequence(cg.outputDelim)
 
-		// Every target has a return register.
-		err := cg.EmitIdentExpr(ctx, mod.Scope, ie, ie.Ident, nil, nil, nil, ret)
+	var (
+		requests []solver.Request
+		hooks    []*targetHooks
+	)
+	for i, target := range targets {
+		request, th, err := cg.generateTarget(ctx, mod, i, prefix, target, outputs)
 		if err != nil {
+			// The targets generated before are never solved, so they are
+			// reported as canceled.
+			for _, th := range hooks {
+				th.postTarget(ctx, context.Canceled)
+			}
 			return nil, err
 		}
+		if th != nil {
+			hooks = append(hooks, th)
+		}
+		requests = append(requests, redactedRequest(ctx, request))
+	}
+	return requests, nil
+}
+
+// generateTarget returns the request of the i-th target of a module, calling
+// the hooks of the build around it.
+func (cg *CodeGen) generateTarget(ctx context.Context, mod *ast.Module, i int, prefix string, target Target, outputs *outputSequence) (solver.Request, *targetHooks, error) {
+	name := targetName(prefix, target)
+	hr := getHookRun(ctx)
+	if hr == nil {
+		request, err := cg.emitRequest(ctx, mod, i, name, target, outputs)
+		return request, nil, err
+	}
+
+	th, err := hr.preTarget(ctx, TargetInfo{
+		Name: name,
+		Args: target.Args,
+	})
+	if err != nil {
+		// Only the target of the hook fails, when it is solved, so the
+		// other targets are generated as usual.
+		return th.Request(&failedRequest{err: err}), th, nil
+	}
 
-		request, err := ret.Value().Request()
+	request, err := cg.emitRequest(withTargetHooks(ctx, th), mod, i, name, target, outputs)
+	if err != nil {
+		th.postTarget(ctx, err)
+		return nil, th, err
+	}
+	return th.Request(request), th, nil
+}
+
+// targetName returns the name of a target in a module with a prefix.
+func targetName(prefix string, target Target) string {
+	if prefix == "" {
+		return target.Name
+	}
+	return fmt.Sprintf("%s:%s", prefix, target.Name)
+}
+
+// emitRequest emits the i-th target of a module and returns its request. The
+// vertices of the target, including those of its exports, are grouped in
+// progress under its name.
+func (cg *CodeGen) emitRequest(ctx context.Context, mod *ast.Module, i int, name string, target Target, outputs *outputSequence) (solver.Request, error) {
+	ctx = WithGlobalSolveOpts(ctx, solver.WithProgressGroup(name, name))
+	val, err := cg.emitTarget(ctx, mod, i, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// String targets are written to their output when solved, which is after
+	// the strings of the targets before them.
+	if val.Kind() == ast.String {
+		str, err := val.String()
 		if err != nil {
 			return nil, err
 		}
+		return getMetrics(ctx).Target(name, outputs.Request(target.Name, str, target.Output)), nil
+	}
+
+	request, err := val.Request()
+	if err != nil {
+		return nil, err
+	}
+	return getMetrics(ctx).Target(name, solver.Grouped(name, name, request)), nil
+}
+
+// targetArgs returns registers with the args of a target parsed according to
+// the types of its parameters.
+func targetArgs(ctx context.Context, mod *ast.Module, target Target) ([]Register, error) {
+	fd, ok := mod.Scope.Objects[target.Name].Node.(*ast.FuncDecl)
+	if !ok {
+		if len(target.Args) > 0 {
+			return nil, fmt.Errorf("target %q does not take args", target.Name)
+		}
+		return nil, nil
+	}
 
-		requests = append(requests, request)
+	params := fd.Sig.Params.Fields()
+	if len(params) != len(target.Args) {
+		return nil, errdefs.WithTargetArgs(fd.Sig.Name, target.Name, len(params), len(target.Args))
 	}
 
-	return solver.Parallel(requests...), nil
+	var args []Register
+	for i, param := range params {
+		var (
+			arg = target.Args[i]
+			v   interface{}
+			err error
+		)
+		switch param.Kind() {
+		case ast.String:
+			v = arg
+		case ast.Int:
+			var n int64
+			n, err = strconv.ParseInt(arg, 0, 0)
+			v = int(n)
+		case ast.Bool:
+			v, err = strconv.ParseBool(arg)
+		default:
+			err = fmt.Errorf("%s params cannot be set from args", param.Kind())
+		}
+		if err != nil {
+			return nil, errdefs.WithInvalidTargetArg(err, param, target.Name, arg)
+		}
+
+		ret := NewRegister(ctx)
+		err = ret.Set(v)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, ret)
+	}
+	return args, nil
 }
 
 func (cg *CodeGen) EmitExpr(ctx context.Context, scope *ast.Scope, expr *ast.Expr, opts Option, b *ast.Binding, ret Register) error {
@@ -102,7 +589,7 @@ func (cg *CodeGen) EmitExpr(ctx context.Context, scope *ast.Scope, expr *ast.Exp
 			if expr.CallExpr.Breakpoint() {
 				var err error
 				if cg.dbgr != nil {
-					ctx = WithFrame(ctx, NewFrame(scope, expr.CallExpr.Name))
+					ctx := WithFrame(ctx, NewFrame(scope, expr.CallExpr.Name))
 					err = cg.dbgr.yield(ctx, scope, expr.CallExpr, val, nil, nil)
 				}
 				return val, err
@@ -135,7 +622,7 @@ func (cg *CodeGen) EmitBasicLit(ctx context.Context, scope *ast.Scope, lit *ast.
 	case lit.Numeric != nil:
 		return ret.Set(int(lit.Numeric.Value))
 	case lit.Bool != nil:
-		return ret.Set(*lit.Bool)
+		return ret.Set(bool(*lit.Bool))
 	case lit.Str != nil:
 		return cg.EmitStringLit(ctx, scope, lit.Str, ret)
 	case lit.RawString != nil:
@@ -288,11 +775,53 @@ func (cg *CodeGen) EmitIdentExpr(ctx context.Context, scope *ast.Scope, ie *ast.
 		})
 		return nil
 	case *ast.FuncDecl:
+		if m := getMemo(ctx); m != nil && cg.dbgr == nil && len(args) == 0 && (checker.IsMemoizable(n) || isSharedTarget(ctx, n)) {
+			ret.SetAsync(func(Value) (Value, error) {
+				return m.Do(memoizedKey(ctx, n, ""), func() (Value, error) {
+					mret := NewRegister(ctx)
+					err := cg.EmitFuncDecl(ctx, n, nil, nil, mret)
+					if err != nil {
+						return nil, err
+					}
+					return resolveValue(mret.Value())
+				})
+			})
+			return nil
+		}
 		return cg.EmitFuncDecl(ctx, n, args, nil, ret)
 	case *ast.BindClause:
-		return cg.EmitBinding(ctx, n.TargetBinding(lookup.Text), args, ret)
+		if bv, ok := obj.Data.(*boundValue); ok && len(args) == 0 {
+			ret.SetAsync(func(Value) (Value, error) {
+				return bv.Value()
+			})
+			return nil
+		}
+
+		binding := n.TargetBinding(lookup.Text)
+		// Every reference to a binding would otherwise evaluate its closure
+		// again, including side effects like localRun. Closures that depend on
+		// the value they are called on must still be evaluated per reference.
+		// Unlike functions, bindings stay memoized under the debugger so that
+		// stepping through a program doesn't repeat their side effects.
+		if m := getMemo(ctx); m != nil && len(args) == 0 && checker.IsIndependent(n.Closure) {
+			ret.SetAsync(func(Value) (Value, error) {
+				return m.Do(memoizedKey(ctx, n, lookup.Text), func() (Value, error) {
+					mret := NewRegister(ctx)
+					err := cg.EmitBinding(ctx, binding, nil, mret)
+					if err != nil {
+						return nil, err
+					}
+					return resolveValue(mret.Value())
+				})
+			})
+			return nil
+		}
+		return cg.EmitBinding(ctx, binding, args, ret)
 	case *ast.ImportDecl:
-		imod, ok := obj.Data.(*ast.Module)
+		imod, ok := cg.imports.get(n)
+		if !ok {
+			imod, ok = cg.modules.bound(obj)
+		}
 		if !ok {
 			return errdefs.WithInternalErrorf(ProgramCounter(ctx), "expected imported module to be resolved")
 		}
@@ -302,23 +831,9 @@ func (cg *CodeGen) EmitIdentExpr(ctx context.Context, scope *ast.Scope, ie *ast.
 		if !ok {
 			return errdefs.WithInternalErrorf(ProgramCounter(ctx), "expected register on field")
 		}
-		dval := dret.Value()
-
-		ret.SetAsync(func(val Value) (Value, error) {
-			if dval.Kind() != ast.Option || val.Kind() != ast.Option {
-				return dval, nil
-			}
-			retOpts, err := val.Option()
-			if err != nil {
-				return nil, err
-			}
-			valOpts, err := dval.Option()
-			if err != nil {
-				return nil, err
-			}
-			return NewValue(ctx, append(retOpts, valOpts...))
-		})
-		return nil
+		// Option fields referenced inside an option block are appended by the
+		// block's option collector, so the field always resolves to its value.
+		return ret.Set(dret.Value())
 	default:
 		return errdefs.WithInternalErrorf(n, "invalid resolved object")
 	}
@@ -335,68 +850,204 @@ func (cg *CodeGen) EmitImport(ctx context.Context, mod *ast.Module, id *ast.Impo
 	}
 	val := ret.Value()
 
-	var imod *ast.Module
+	// Dockerfile stages are imported as a module of their filesystems.
+	if stages, ok := dockerfileStagesOf(val); ok {
+		return stages.Module(ctx, mod, id)
+	}
+
+	var (
+		key      string
+		parse    func() (*ast.Module, error)
+		lintMode = cg.lintMode
+	)
 	switch val.Kind() {
 	case ast.Filesystem:
+		lintMode = cg.fsImportLintMode()
+
 		fs, err := val.Filesystem()
 		if err != nil {
 			return nil, err
 		}
 
-		filename := ModuleFilename
-		dir, err := cg.resolver.Resolve(ctx, id, fs)
+		dir, err := cg.resolveImport(ctx, id, fs)
 		if err != nil {
 			return nil, err
 		}
 
-		rc, err := dir.Open(filename)
+		key = fsImportKey(dir)
+		parse = func() (*ast.Module, error) {
+			rc, err := dir.Open(ModuleFilename)
+			if err != nil {
+				return nil, err
+			}
+
+			imod, err := parser.Parse(ctx, rc, filebuffer.WithEphemeral())
+			if err != nil {
+				return nil, err
+			}
+			imod.Directory = dir
+			imod.URI = "fs://" + dir.Path()
+			return imod, nil
+		}
+	case ast.String:
+		uri, err := val.String()
 		if err != nil {
 			return nil, err
 		}
 
-		imod, err = parser.Parse(ctx, rc, filebuffer.WithEphemeral())
+		key = fileImportKey(ctx, mod.Directory, uri)
+		parse = func() (*ast.Module, error) {
+			err := checkImportIgnored(ctx, mod.Directory, id, uri)
+			if err != nil {
+				return nil, err
+			}
+
+			imod, err := ParseModuleURI(ctx, cg.cln, mod.Directory, uri)
+			if err != nil {
+				if !errdefs.IsNotExist(err) {
+					return nil, err
+				}
+				return nil, errdefs.WithImportPathNotExist(err, importNode(id), uri)
+			}
+			return imod, nil
+		}
+	default:
+		return nil, errdefs.WithInternalErrorf(id, "unexpected import kind %s", val.Kind())
+	}
+
+	// Imported modules are shared by every module importing the same content,
+	// and only the importing module's references are checked against it.
+	cm, err := cg.modules.Do(key, func() (*cachedModule, error) {
+		imod, err := parse()
 		if err != nil {
 			return nil, err
 		}
-		imod.Directory = dir
-		imod.URI = "fs://" + dir.Path()
-	case ast.String:
-		uri, err := val.String()
+
+		err = checker.SemanticPass(imod)
 		if err != nil {
 			return nil, err
 		}
 
-		imod, err = ParseModuleURI(ctx, cg.cln, mod.Directory, uri)
+		// Linting rewrites deprecated syntax, so it must happen before checking.
+		cm := &cachedModule{
+			mod:      imod,
+			fb:       filebuffer.Buffers(ctx).Get(imod.Pos.Filename),
+			findings: linter.Findings(linter.Lint(ctx, imod)),
+		}
+
+		err = checker.Check(imod)
 		if err != nil {
-			if !errdefs.IsNotExist(err) {
-				return nil, err
-			}
-			if id.DeprecatedPath != nil {
-				return nil, errdefs.WithImportPathNotExist(err, id.DeprecatedPath, uri)
-			}
-			if id.Expr.FuncLit != nil {
-				return nil, errdefs.WithImportPathNotExist(err, id.Expr.FuncLit.Type, uri)
-			}
-			return nil, errdefs.WithImportPathNotExist(err, id.Expr, uri)
+			cg.lints.add(imod, lintMode, cm.findings)
+			return nil, err
 		}
+		return cm, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	imod := cm.mod
+
+	// The module may have been parsed by another build sharing the cache, so
+	// it is registered with this one.
+	ast.Modules(ctx).Set(imod.Pos.Filename, imod)
+	if cm.fb != nil {
+		filebuffer.Buffers(ctx).Set(imod.Pos.Filename, cm.fb)
+	}
+	if cg.lints.markLinted(imod) {
+		cg.lints.add(imod, lintMode, cm.findings)
 	}
 
-	err = checker.SemanticPass(imod)
+	if cg.requirePinnedFrontends {
+		err = checkPinnedFrontends(imod, cg.lockfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cg.sandbox.add(imod)
+	return imod, nil
+}
+
+// resolveImport resolves the filesystem of an import into a directory,
+// forwarding progress from resolvers that report it under a vertex named after
+// the import.
+func (cg *CodeGen) resolveImport(ctx context.Context, id *ast.ImportDecl, fs Filesystem) (ast.Directory, error) {
+	err := cg.importSem.Acquire(ctx, 1)
 	if err != nil {
 		return nil, err
 	}
+	defer cg.importSem.Release(1)
+
+	if cg.importTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cg.importTimeout)
+		defer cancel()
+	}
 
-	// Drop errors from linting.
-	_ = linter.Lint(ctx, imod)
+	var (
+		dir  ast.Directory
+		last string
+		mu   sync.Mutex
+	)
+	resolve := func(report func(status string)) (err error) {
+		getMetrics(ctx).ObserveResolve("module")
+		pr, ok := cg.resolver.(ProgressResolver)
+		if !ok {
+			dir, err = cg.resolver.Resolve(ctx, id, fs)
+			return err
+		}
+		dir, err = pr.ResolveProgress(ctx, id, fs, func(status string) {
+			mu.Lock()
+			last = status
+			mu.Unlock()
+			report(status)
+		})
+		return err
+	}
+
+	mw := MultiWriter(ctx)
+	if mw != nil {
+		pw := mw.WithPrefix("", false)
+		err = progress.Wrap(fmt.Sprintf("import %s", id.Name), pw.Write, func(l progress.SubLogger) error {
+			return resolve(func(status string) {
+				l.Log(1, []byte(status+"\n"))
+			})
+		})
+	} else {
+		err = resolve(func(string) {})
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			mu.Lock()
+			defer mu.Unlock()
+			return nil, errdefs.WithImportTimeout(importNode(id), cg.importTimeout, last)
+		}
+		return nil, err
+	}
+	return dir, nil
+}
 
-	return imod, checker.Check(imod)
+// importNode returns the node to position diagnostics about an import's
+// expression.
+func importNode(id *ast.ImportDecl) ast.Node {
+	switch {
+	case id.DeprecatedPath != nil:
+		return id.DeprecatedPath
+	case id.Expr.FuncLit != nil:
+		return id.Expr.FuncLit.Type
+	default:
+		return id.Expr
+	}
 }
 
 func (cg *CodeGen) EmitBuiltinDecl(ctx context.Context, scope *ast.Scope, bd *ast.BuiltinDecl, args []Register, opts Register, b *ast.Binding, val Value) (Value, error) {
 	var callable interface{}
 	if ReturnType(ctx) != ast.None {
 		callable = Callables[ReturnType(ctx)][bd.Name]
-	} else {
+	}
+	if callable == nil {
+		// Builtins of other kinds may be coerced, like bools interpolated into
+		// strings.
 		for _, kind := range bd.Kinds {
 			c, ok := Callables[kind][bd.Name]
 			if ok {
@@ -409,11 +1060,27 @@ func (cg *CodeGen) EmitBuiltinDecl(ctx context.Context, scope *ast.Scope, bd *as
 		return nil, errdefs.WithInternalErrorf(ProgramCounter(ctx), "unrecognized builtin `%s`", bd)
 	}
 
+	// Priming the cache only solves filesystems, so exports are skipped.
+	if isPrewarm(ctx) {
+		if _, ok := exportBuiltins[bd.Name]; ok {
+			return val, nil
+		}
+	}
+
 	// Pass binding if available.
 	if b != nil {
 		ctx = WithBinding(ctx, b)
 	}
 
+	// Host policies tell which module called the builtin by the module
+	// itself, since modules imported from different filesystems may have the
+	// same filename.
+	if ms := scope.ByLevel(ast.ModuleScope); ms != nil {
+		if mod, ok := ms.Node.(*ast.Module); ok {
+			ctx = withCallerModule(ctx, mod)
+		}
+	}
+
 	// Get value of options register.
 	var opt Option
 	if opts != nil {
@@ -503,12 +1170,17 @@ func (cg *CodeGen) EmitFuncDecl(ctx context.Context, fd *ast.FuncDecl, args []Re
 
 	ctx = WithProgramCounter(ctx, fd.Sig.Name)
 
+	name := fd.Sig.Name.Text
+	if b != nil {
+		name = b.Name.Text
+	}
+	ctx = withBindingName(ctx, name)
+	if fd.Kind() == ast.Pipeline {
+		ctx = withStageEnv(ctx, newStageEnvironment(getStageEnv(ctx)))
+	}
+
 	params := fd.Sig.Params.Fields()
 	if len(params) != len(args) {
-		name := fd.Sig.Name.Text
-		if b != nil {
-			name = b.Name.Text
-		}
 		return errdefs.WithInternalErrorf(ProgramCounter(ctx), "`%s` expected %d args, got %d", name, len(params), len(args))
 	}
 
@@ -543,6 +1215,33 @@ func (cg *CodeGen) EmitBinding(ctx context.Context, b *ast.Binding, args []Regis
 	return cg.EmitFuncDecl(ctx, b.Bind.Closure, args, b, ret)
 }
 
+// isThunkParam returns true if the i-th argument of a call is for a builtin
+// parameter of type Thunk.
+func isThunkParam(scope *ast.Scope, call ast.CallNode, i int) bool {
+	obj := scope.Lookup(call.Ident().Text)
+	if obj == nil {
+		return false
+	}
+	bd, ok := obj.Node.(*ast.BuiltinDecl)
+	if !ok {
+		return false
+	}
+
+	for _, kind := range bd.Kinds {
+		callable, ok := Callables[kind][bd.Name]
+		if !ok {
+			continue
+		}
+		c := reflect.ValueOf(callable).MethodByName("Call").Type()
+		n := len(PrototypeIn) + i
+		if c.IsVariadic() && n >= c.NumIn()-1 {
+			return c.In(c.NumIn()-1).Elem() == rThunk
+		}
+		return n < c.NumIn() && c.In(n) == rThunk
+	}
+	return false
+}
+
 func (cg *CodeGen) lookupCall(ctx context.Context, scope *ast.Scope, lookup *ast.Ident) error {
 	obj := scope.Lookup(lookup.Text)
 	if obj == nil {
@@ -551,25 +1250,35 @@ func (cg *CodeGen) lookupCall(ctx context.Context, scope *ast.Scope, lookup *ast
 
 	switch n := obj.Node.(type) {
 	case *ast.ImportDecl:
-		// De-duplicate import resolution using a flightcontrol group key'ed by the
-		// import decl's filename + line + column position, which is unique per
-		// import. FS de-duplication should be handled by codegen cache.
-		key := parser.FormatPos(n.Pos)
+		// De-duplicate import resolution using a singleflight group keyed by the
+		// import decl, which is unique per import even when modules generated
+		// together share filenames. FS de-duplication should be handled by
+		// codegen cache.
+		key := fmt.Sprintf("%p", n)
 		_, err, _ := cg.g.Do(key, func() (interface{}, error) {
-			_, ok := obj.Data.(*ast.Module)
-			if ok {
+			if _, ok := cg.imports.get(n); ok {
 				return nil, nil
 			}
 
 			mod := scope.ByLevel(ast.ModuleScope).Node.(*ast.Module)
+			if _, ok := cg.modules.bound(obj); ok && !cg.modules.has(mod) {
+				// Imports resolved before generating are bound already.
+				return nil, nil
+			}
+
 			imod, err := cg.EmitImport(ctx, mod, n)
 			if err != nil {
 				return nil, err
 			}
-			obj.Data = imod
 
-			err = checker.CheckReferences(mod, n.Name.Text)
-			return nil, err
+			err = cg.modules.bind(obj, imod, func() error {
+				return checker.CheckReferences(mod, n.Name.Text)
+			})
+			if err != nil {
+				return nil, err
+			}
+			cg.imports.set(n, imod)
+			return nil, nil
 		})
 		if err != nil {
 			return err
@@ -586,49 +1295,273 @@ func (cg *CodeGen) EmitBlock(ctx context.Context, scope *ast.Scope, block *ast.B
 	scope = ast.NewScope(scope, ast.BlockScope, block)
 
 	ctx = WithReturnType(ctx, block.Kind())
-	for _, stmt := range block.Stmts() {
-		stmt := stmt
-		var err error
-		switch {
-		case stmt.Call != nil:
-			ret.SetAsync(func(val Value) (Value, error) {
-				if stmt.Call.Breakpoint() {
-					var err error
-					if cg.dbgr != nil {
-						ctx = WithFrame(ctx, NewFrame(scope, stmt.Call.Name))
-						err = cg.dbgr.yield(ctx, scope, stmt.Call, val, nil, nil)
+
+	// Option blocks emit each statement into its own register and accumulate
+	// the results explicitly, so earlier options are never dropped regardless
+	// of what the return register holds when a statement is evaluated.
+	var oc *optionCollector
+	if block.Kind().Primary() == ast.Option {
+		oc = newOptionCollector(ctx, ret)
+	}
+
+	return cg.emitStmts(ctx, scope, block, block.Stmts(), b, oc, ret)
+}
+
+func (cg *CodeGen) emitStmts(ctx context.Context, scope *ast.Scope, block *ast.BlockStmt, stmts []*ast.Stmt, b *ast.Binding, oc *optionCollector, ret Register) error {
+	for i, stmt := range stmts {
+		stmtRet := ret
+		if oc != nil {
+			stmtRet = NewRegister(ctx)
+		}
+
+		// The statements of a closure after one that binds values use the
+		// value of the binding from this evaluation of the closure, instead
+		// of evaluating it again up to the binding.
+		if binds := stmtBinds(block, stmt); b == nil && len(binds) > 0 {
+			scope = cg.emitBindStmt(ctx, scope, stmt.Call, binds, stmtRet)
+		} else if nested := nestedBindBlock(stmt, b); nested != nil {
+			// A binding in a block nested in the statement is the value of
+			// that block at the statement that binds it.
+			nret := NewRegister(ctx)
+			err := cg.EmitBlock(ctx, scope, nested, b, nret)
+			if err != nil {
+				return err
+			}
+			err = stmtRet.Set(nret.Value())
+			if err != nil {
+				return err
+			}
+		} else {
+			err := cg.EmitStmt(ctx, scope, stmt, b, stmtRet)
+			if err != nil {
+				return err
+			}
+		}
+
+		if oc != nil {
+			oc.Collect(stmtRet)
+		}
+
+		// A partial solve stops emitting the block after its stop point, and
+		// the value after it is the value of the target. The statements of
+		// its callers after it are skipped like after an error, so that their
+		// exports are never solved. With a debugger, it stops there like a
+		// breakpoint, so that its state can be inspected.
+		if sp := getStopPoint(ctx); sp != nil && stmt == sp.stmt {
+			stmtRet.SetAsync(func(val Value) (Value, error) {
+				sp.capture(val)
+				if cg.dbgr != nil {
+					ctx := WithFrame(ctx, NewFrame(scope, stmt))
+					err := cg.dbgr.yield(ctx, scope, stmt, val, nil, nil)
+					if err != nil {
+						return nil, err
 					}
-					return val, err
 				}
+				return nil, errStopped
+			})
+			break
+		}
 
-				err := cg.lookupCall(ctx, scope, stmt.Call.Ident())
-				if err != nil {
-					return nil, err
-				}
+		// A binding is the value of its closure at the statement that binds it,
+		// so the statements after it are not evaluated. This matches the
+		// checker, which only allows those statements to use the binding.
+		if b != nil && block.Kind().Primary() != ast.Option && contains(stmt, b.Bind) {
+			break
+		}
 
+		// The arguments of later statements may read the values set by
+		// stageEnv, so they are only emitted once it has been called.
+		if rest := stmts[i+1:]; len(rest) > 0 && block.Kind() == ast.Pipeline && isStageEnv(scope, stmt) {
+			ret.SetAsync(func(val Value) (Value, error) {
 				ret := NewRegister(ctx)
 				ret.Set(val)
-				err = cg.EmitCallStmt(ctx, scope, stmt.Call, b, ret)
+				err := cg.emitStmts(ctx, scope, block, rest, b, nil, ret)
 				return ret.Value(), err
 			})
-		case stmt.Expr != nil:
-			err = cg.EmitExpr(ctx, scope, stmt.Expr.Expr, nil, b, ret)
-		default:
-			return errdefs.WithInternalErrorf(stmt, "invalid stmt")
+			break
+		}
+	}
+
+	return nil
+}
+
+// stmtBinds returns the bind clauses of a statement of a closure or a block
+// nested in it, on its call or in the with clause of the call. Statements of
+// option blocks are part of the call the options are for, which binds them.
+func stmtBinds(block *ast.BlockStmt, stmt *ast.Stmt) []*ast.BindClause {
+	if block.Kind().Primary() == ast.Option || stmt.Call == nil {
+		return nil
+	}
+
+	var binds []*ast.BindClause
+	if stmt.Call.BindClause != nil {
+		binds = append(binds, stmt.Call.BindClause)
+	}
+	if stmt.Call.WithClause != nil {
+		ast.Match(stmt.Call.WithClause, ast.MatchOpts{},
+			func(call *ast.CallStmt) {
+				if call.BindClause != nil {
+					binds = append(binds, call.BindClause)
+				}
+			},
+		)
+	}
+	return binds
+}
+
+// nestedBindBlock returns the outermost block nested in a statement that the
+// binding being evaluated is bound in, other than option blocks, or nil if
+// there is none.
+func nestedBindBlock(stmt *ast.Stmt, b *ast.Binding) *ast.BlockStmt {
+	if b == nil || !contains(stmt, b.Bind) {
+		return nil
+	}
+
+	var nested *ast.BlockStmt
+	ast.Match(stmt, ast.MatchOpts{},
+		func(block *ast.BlockStmt) {
+			if block.Kind().Primary() == ast.Option || !contains(block, b.Bind) {
+				return
+			}
+			if nested == nil || contains(block, nested) {
+				nested = block
+			}
+		},
+	)
+	return nested
+}
+
+// emitBindStmt emits a call statement of a closure that binds values, and
+// returns a scope with its bindings for the statements after it. A binding is
+// the call evaluated with it on the value before the statement, with the same
+// arguments, so side effects of the closure and its arguments aren't repeated.
+func (cg *CodeGen) emitBindStmt(ctx context.Context, scope *ast.Scope, call *ast.CallStmt, binds []*ast.BindClause, ret Register) *ast.Scope {
+	before := ret.Value()
+	opts, args := cg.EvaluateCallStmt(ctx, scope, call, nil)
+	cg.emitCall(ctx, scope, call, nil, opts, args, ret)
+
+	bound := ast.NewScope(scope, ast.BlockScope, call)
+	for _, bc := range binds {
+		for _, target := range bc.Targets() {
+			// Parameters shadow bindings within their closure.
+			if obj := scope.Lookup(target.Text); obj != nil {
+				if _, ok := obj.Node.(*ast.Field); ok {
+					continue
+				}
+			}
+
+			binding := bc.TargetBinding(target.Text)
+			ctx := withBindingName(ctx, target.Text)
+			bound.Insert(&ast.Object{
+				Kind:  binding.Field.Kind(),
+				Ident: target,
+				Node:  bc,
+				Data: &boundValue{eval: func() (Value, error) {
+					bret := NewRegister(ctx)
+					err := bret.Set(before)
+					if err != nil {
+						return nil, err
+					}
+					cg.emitCall(ctx, scope, call, binding, cg.evaluateOptions(ctx, scope, call, binding), args, bret)
+					return resolveValue(bret.Value())
+				}},
+			})
 		}
+	}
+	return bound
+}
+
+// boundValue is the value of a binding for the statements after it in its
+// closure, which is evaluated once when they first use it.
+type boundValue struct {
+	once sync.Once
+	eval func() (Value, error)
+	val  Value
+	err  error
+}
+
+func (bv *boundValue) Value() (Value, error) {
+	bv.once.Do(func() {
+		bv.val, bv.err = bv.eval()
+	})
+	return bv.val, bv.err
+}
+
+// contains returns true if the source of node is within the source of parent.
+func contains(parent, node ast.Node) bool {
+	return parent.Position().Offset <= node.Position().Offset &&
+		node.End().Offset <= parent.End().Offset
+}
+
+func (cg *CodeGen) EmitStmt(ctx context.Context, scope *ast.Scope, stmt *ast.Stmt, b *ast.Binding, ret Register) error {
+	switch {
+	case stmt.Call != nil:
+		if stmt.Call.Breakpoint() {
+			ret.SetAsync(func(val Value) (Value, error) {
+				var err error
+				if cg.dbgr != nil {
+					ctx := WithFrame(ctx, NewFrame(scope, stmt.Call.Name))
+					err = cg.dbgr.yield(ctx, scope, stmt.Call, val, nil, nil)
+				}
+				return val, err
+			})
+			return nil
+		}
+
+		// The options and arguments of a call don't depend on the value of
+		// the register, so they are evaluated while the statements before it
+		// are. Everything else waits for them.
+		opts, args := cg.EvaluateCallStmt(ctx, scope, stmt.Call, b)
+		cg.emitCall(ctx, scope, stmt.Call, b, opts, args, ret)
+		return nil
+	case stmt.From != nil:
+		// The expression is evaluated like an argument, so the block starts
+		// from its value instead of continuing from the value it is called on.
+		from := NewRegister(ctx)
+		err := cg.EmitExpr(ctx, scope, stmt.From.Expr, nil, b, from)
 		if err != nil {
 			return err
 		}
+		val := from.Value()
+		ret.SetAsync(func(Value) (Value, error) {
+			return unwrapLazy(val), nil
+		})
+		return nil
+	case stmt.Expr != nil:
+		return cg.EmitExpr(ctx, scope, stmt.Expr.Expr, nil, b, ret)
+	default:
+		return errdefs.WithInternalErrorf(stmt, "invalid stmt")
 	}
+}
 
-	return nil
+// emitCall sets the register to the value of a call statement with evaluated
+// options and arguments, once the value before it is computed.
+func (cg *CodeGen) emitCall(ctx context.Context, scope *ast.Scope, call *ast.CallStmt, b *ast.Binding, opts Register, args []Register, ret Register) {
+	ret.SetAsync(func(val Value) (Value, error) {
+		err := cg.lookupCall(ctx, scope, call.Ident())
+		if err != nil {
+			return nil, err
+		}
+
+		ret := NewRegister(ctx)
+		ret.Set(val)
+		err = cg.EmitCallStmt(ctx, scope, call, b, opts, args, ret)
+		return ret.Value(), err
+	})
 }
 
-func (cg *CodeGen) EmitCallStmt(ctx context.Context, scope *ast.Scope, call *ast.CallStmt, b *ast.Binding, ret Register) error {
+// EvaluateCallStmt evaluates the with clause and arguments of a call
+// statement.
+func (cg *CodeGen) EvaluateCallStmt(ctx context.Context, scope *ast.Scope, call *ast.CallStmt, b *ast.Binding) (opts Register, args []Register) {
+	return cg.evaluateOptions(ctx, scope, call, b), cg.Evaluate(ctx, scope, call, b)
+}
+
+// evaluateOptions evaluates the with clause of a call statement.
+func (cg *CodeGen) evaluateOptions(ctx context.Context, scope *ast.Scope, call *ast.CallStmt, b *ast.Binding) Register {
 	// Evaluate with block first.
 	opts := NewRegister(ctx)
 	if call.WithClause != nil {
-		scope, expr := scope, call.WithClause.Expr
+		ctx, scope, expr := ctx, scope, call.WithClause.Expr
 		opts.SetAsync(func(Value) (Value, error) {
 			// If with clause is a call expr, still wrap the scope as if it was a single
 			// element option block.
@@ -646,8 +1579,30 @@ func (cg *CodeGen) EmitCallStmt(ctx context.Context, scope *ast.Scope, call *ast
 		})
 	}
 
-	// Evaluate args second.
-	args := cg.Evaluate(ctx, scope, call, b)
+	// Runs start with the run defaults of their module, if any.
+	if fd := runDefaults(ctx, scope, call); fd != nil {
+		with := opts
+		opts = NewRegister(ctx)
+		opts.SetAsync(func(Value) (Value, error) {
+			defaults, err := cg.emitRunDefaults(ctx, fd)
+			if err != nil {
+				return nil, err
+			}
+
+			var opt Option
+			if call.WithClause != nil {
+				opt, err = with.Value().Option()
+				if err != nil {
+					return nil, err
+				}
+			}
+			return NewValue(ctx, mergeRunDefaults(defaults, opt))
+		})
+	}
+	return opts
+}
+
+func (cg *CodeGen) EmitCallStmt(ctx context.Context, scope *ast.Scope, call *ast.CallStmt, b *ast.Binding, opts Register, args []Register, ret Register) error {
 	for i, arg := range call.Arguments() {
 		ctx = WithArg(ctx, i, arg)
 	}
@@ -680,21 +1635,67 @@ func (cg *CodeGen) Evaluate(ctx context.Context, scope *ast.Scope, call ast.Call
 	for i, arg := range call.Arguments() {
 		i, arg := i, arg
 		ret := NewRegister(ctx)
-		ret.SetAsync(func(_ Value) (Value, error) {
+		eval := func(_ Value) (Value, error) {
 			err := cg.lookupCall(ctx, scope, call.Ident())
 			if err != nil {
 				return nil, err
 			}
 
-			ctx := WithProgramCounter(ctx, arg)
-			ctx = WithReturnType(ctx, call.Signature()[i])
+			kind := call.Signature()[i]
+			emit := func(ctx context.Context, val Value) (Value, error) {
+				ctx = WithProgramCounter(ctx, arg)
+				ctx = WithReturnType(ctx, kind)
 
-			ret := NewRegister(ctx)
-			err = cg.EmitExpr(ctx, scope, arg, nil, b, ret)
-			return ret.Value(), err
-		})
+				ret := NewRegister(ctx)
+				if val != nil {
+					err := ret.Set(val)
+					if err != nil {
+						return nil, err
+					}
+				}
+				err := cg.EmitExpr(ctx, scope, arg, nil, b, ret)
+				return ret.Value(), err
+			}
 
+			// Thunk parameters are left for the builtin to evaluate.
+			if isThunkParam(scope, call, i) {
+				return &thunkValue{&nilValue{}, emit}, nil
+			}
+			return emit(ctx, nil)
+		}
+
+		// Arguments of functions are only emitted if the function uses them,
+		// so that unused branches are never resolved.
+		if cg.isDeferredArg(scope, call, i, arg) {
+			_ = ret.Set(deferValue(func() (Value, error) {
+				return eval(nil)
+			}))
+		} else {
+			ret.SetAsync(eval)
+		}
 		rets = append(rets, ret)
 	}
 	return rets
 }
+
+// isDeferredArg returns true if the i-th argument of a call is emitted when
+// the callee first uses it. Only fs and string arguments of functions declared
+// in the module are deferred, and never while debugging, which steps through
+// arguments as they are passed.
+func (cg *CodeGen) isDeferredArg(scope *ast.Scope, call ast.CallNode, i int, arg *ast.Expr) bool {
+	if cg.dbgr != nil {
+		return false
+	}
+	obj := scope.Lookup(call.Ident().Text)
+	if obj == nil {
+		return false
+	}
+	if _, ok := obj.Node.(*ast.FuncDecl); !ok {
+		return false
+	}
+	switch call.Signature()[i] {
+	case ast.Filesystem, ast.String:
+		return checker.IsDeferrable(scope, arg)
+	}
+	return false
+}
@@ -1,19 +1,28 @@
 package codegen_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/lithammer/dedent"
+	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/solver/pb"
 	"github.com/moby/buildkit/util/entitlements"
+	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/openllb/hlb/builtin"
 	"github.com/openllb/hlb/checker"
@@ -26,6 +35,8 @@ import (
 	"github.com/openllb/hlb/pkg/filebuffer"
 	"github.com/openllb/hlb/pkg/llbutil"
 	"github.com/openllb/hlb/solver"
+	"github.com/openllb/hlb/solver/prommetrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"github.com/xlab/treeprint"
 )
@@ -130,6 +141,31 @@ func TestCodeGen(t *testing.T) {
 				llb.Chmod(os.FileMode(0x777)),
 				llb.Filename("myTest.out")))
 		},
+	}, {
+		"fetchArchive",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			fetchArchive "https://go.dev/dl/go1.16.linux-amd64.tar.gz" "sha256:4f858ddc9eb7302530d279eb1ad1468ea1253f45fd64fa3096e4ff5c0520b0f3" "/usr/local" with option {
+				chown "root"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			// The copy that unpacks reads from the http source, so it never runs
+			// when the checksum fails.
+			archive := llb.HTTP(
+				"https://go.dev/dl/go1.16.linux-amd64.tar.gz",
+				llb.Checksum("sha256:4f858ddc9eb7302530d279eb1ad1468ea1253f45fd64fa3096e4ff5c0520b0f3"),
+				llb.Filename("go1.16.linux-amd64.tar.gz"),
+			)
+			return Expect(t, llb.Image("alpine").File(llb.Copy(
+				archive, "go1.16.linux-amd64.tar.gz", "/usr/local",
+				&llb.CopyInfo{AttemptUnpack: true, CreateDestPath: true},
+				llb.WithUser("root"),
+			)))
+		},
 	}, {
 		"basic git",
 		[]string{"default"},
@@ -157,6 +193,39 @@ func TestCodeGen(t *testing.T) {
 				"master",
 				llb.KeepGitDir()))
 		},
+	}, {
+		"git with commit",
+		[]string{"default"},
+		`
+		fs default() {
+			git "https://github.com/openllb/hlb.git" "master" with option {
+				commit "0a44376e3b6f0e6a0c1c0d3c7b1b6bd1b3f1d2e4"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Git(
+				"https://github.com/openllb/hlb.git",
+				"0a44376e3b6f0e6a0c1c0d3c7b1b6bd1b3f1d2e4"))
+		},
+	}, {
+		"shallow git with commit keeping git dir",
+		[]string{"default"},
+		`
+		fs default() {
+			git "https://github.com/openllb/hlb.git" "master" with option {
+				depth 1
+				commit "0a44376e3b6f0e6a0c1c0d3c7b1b6bd1b3f1d2e4"
+				keepGitDir
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Git(
+				"https://github.com/openllb/hlb.git",
+				"0a44376e3b6f0e6a0c1c0d3c7b1b6bd1b3f1d2e4",
+				llb.KeepGitDir()))
+		},
 	}, {
 		"basic mkdir",
 		[]string{"default"},
@@ -232,6 +301,28 @@ func TestCodeGen(t *testing.T) {
 		func(ctx context.Context, t *testing.T) solver.Request {
 			return Expect(t, llb.Scratch().User("testUser").Run(llb.Shlex("echo Hello")).Root())
 		},
+	}, {
+		"run with workdirCreate",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			user "testUser"
+			run "echo Hello" with option {
+				shlex
+				dir "/src/app"
+				workdirCreate
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().User("testUser").File(
+				llb.Mkdir("/src/app", 0755, llb.WithParents(true), llb.WithUser("testUser")),
+			).Run(
+				llb.Shlex("echo Hello"),
+				llb.Dir("/src/app"),
+			).Root())
+		},
 	}, {
 		"basic mkfile",
 		[]string{"default"},
@@ -267,6 +358,91 @@ func TestCodeGen(t *testing.T) {
 				llb.WithUser("testUser"),
 				llb.WithCreatedTime(createdTime))))
 		},
+	}, {
+		"writeFile heredoc",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			writeFile "/etc/app/config.yaml" <<~EOF
+				debug: true
+			EOF
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(llb.Mkfile(
+				"/etc/app/config.yaml",
+				0o644,
+				[]byte("debug: true"),
+			)))
+		},
+	}, {
+		"writeFile templated with options",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			writeFile "/etc/app/config.yaml" "version: {{.version}}" with option {
+				mode 0o600
+				chown "app"
+				templated
+				field "version" "1.2.3"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(llb.Mkfile(
+				"/etc/app/config.yaml",
+				0o600,
+				[]byte("version: 1.2.3"),
+				llb.WithUser("app"),
+			)))
+		},
+	}, {
+		"writeFile appending to a file from the base image",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			dir "/etc"
+			writeFile "motd" "hello" with option {
+				append
+				mode 0o600
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			mode := os.FileMode(0o600)
+			st := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{"/bin/sh", "-c", codegen.AppendScript, "append", "/etc/motd", "false"}),
+				llb.AddMount(codegen.AppendContentMountpoint, llb.Scratch().File(
+					llb.Mkfile("/content", 0o644, []byte("hello")),
+				), llb.Readonly),
+				llb.AddMount(codegen.AppendMountpoint, llb.Image("alpine").Dir("/etc")),
+			).GetMount(codegen.AppendMountpoint)
+			return Expect(t, st.File(llb.Copy(st, "/etc/motd", "/etc/motd", &llb.CopyInfo{Mode: &mode})))
+		},
+	}, {
+		"writeFile appending to a missing file",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			writeFile "/log" "started" with option {
+				append
+				createIfMissing
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{"/bin/sh", "-c", codegen.AppendScript, "append", "/log", "true"}),
+				llb.AddMount(codegen.AppendContentMountpoint, llb.Scratch().File(
+					llb.Mkfile("/content", 0o644, []byte("started")),
+				), llb.Readonly),
+				llb.AddMount(codegen.AppendMountpoint, llb.Scratch()),
+			).GetMount(codegen.AppendMountpoint))
+		},
 	}, {
 		"basic rm",
 		[]string{"default"},
@@ -297,6 +473,82 @@ func TestCodeGen(t *testing.T) {
 				llb.WithAllowNotFound(true),
 				llb.WithAllowWildcard(true))))
 		},
+	}, {
+		"rm multiple paths",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			rm "/app/**/*.test" "/tmp/cache" with option {
+				allowNotFound
+				allowWildcard
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("alpine").File(
+				llb.Rm("/app/**/*.test", llb.WithAllowNotFound(true), llb.WithAllowWildcard(true)).
+					Rm("/tmp/cache", llb.WithAllowNotFound(true), llb.WithAllowWildcard(true)),
+			))
+		},
+	}, {
+		"rm with except",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			dir "/app"
+			rm "/app" with option {
+				except "/app/keep"
+				except "config/*.yaml"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			st := llb.Image("alpine").Dir("/app")
+			return Expect(t, st.File(
+				llb.Rm("/app").Copy(st, "/", "/", &llb.CopyInfo{
+					CopyDirContentsOnly: true,
+					IncludePatterns:     []string{"app/keep", "app/config/*.yaml"},
+				}),
+			))
+		},
+	}, {
+		"whiteout in a layer of its own",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			rm "/tmp/cache"
+			whiteout "/etc/motd" "/etc/issue"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("alpine").
+				File(llb.Rm("/tmp/cache")).
+				File(
+					llb.Rm("/etc/motd", llb.WithAllowNotFound(true)).
+						Rm("/etc/issue", llb.WithAllowNotFound(true)),
+				))
+		},
+	}, {
+		"copy with negated exclude patterns",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			copy image("alpine") "/app" "/app" with option {
+				excludePatterns "*.log" "!keep.log" "debug/keep.log"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Copy(llb.Image("alpine"), "/app", "/app", &llb.CopyInfo{
+					ExcludePatterns: []string{"*.log", "!keep.log", "debug/keep.log"},
+				}),
+			))
+		},
 	}, {
 		"basic copy",
 		[]string{"default"},
@@ -310,6 +562,86 @@ func TestCodeGen(t *testing.T) {
 			scratch := llb.Scratch()
 			return Expect(t, scratch.File(llb.Copy(scratch, "testSource", "testDest")))
 		},
+	}, {
+		"identical adjacent copies of contents are coalesced",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			alpineEtc
+			alpineEtc
+			copy image("alpine") "/etc" "/etc" with option {
+				contentsOnly
+				createDestPath
+			}
+			mkdir "/tmp" 0o755
+			alpineEtc
+		}
+
+		fs alpineEtc() {
+			copy image("alpine") "/etc" "/etc" with contentsOnly
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Copy(llb.Image("alpine"), "/etc", "/etc", &llb.CopyInfo{
+					CopyDirContentsOnly: true,
+				}),
+			).File(
+				llb.Copy(llb.Image("alpine"), "/etc", "/etc", &llb.CopyInfo{
+					CopyDirContentsOnly: true,
+					CreateDestPath:      true,
+				}),
+			).File(
+				llb.Mkdir("/tmp", 0o755),
+			).File(
+				llb.Copy(llb.Image("alpine"), "/etc", "/etc", &llb.CopyInfo{
+					CopyDirContentsOnly: true,
+				}),
+			))
+		},
+	}, {
+		"copying a directory twice nests it",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			copy image("alpine") "/etc" "/etc"
+			copy image("alpine") "/etc" "/etc"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Copy(llb.Image("alpine"), "/etc", "/etc"),
+			).File(
+				llb.Copy(llb.Image("alpine"), "/etc", "/etc"),
+			))
+		},
+	}, {
+		"function using every argument",
+		[]string{"default"},
+		`
+		fs default() {
+			assemble image("alpine") fs {
+				image "busybox"
+				run "make"
+			} "/opt"
+		}
+
+		fs assemble(fs base, fs build, string dest) {
+			base
+			copy build "/out" dest
+			copy build "/lib" dest
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			build := llb.Image("busybox").Run(llb.Args([]string{"/bin/sh", "-c", "make"})).Root()
+			return Expect(t, llb.Image("alpine").File(
+				llb.Copy(build, "/out", "/opt"),
+			).File(
+				llb.Copy(build, "/lib", "/opt"),
+			))
+		},
 	}, {
 		"copy with options",
 		[]string{"default"},
@@ -462,79 +794,260 @@ func TestCodeGen(t *testing.T) {
 			).AddMount("/out", llb.Scratch()))
 		},
 	}, {
-		"option builtin without func lit",
-		[]string{"default"},
+		"multiple bound mounts with source paths",
+		[]string{"bins", "libs", "out"},
 		`
-		fs default() {
+		fs build() {
 			image "alpine"
-			run "echo unchanged" with readonlyRootfs
+			run "make" with option {
+				mount image("src") "/bin" with option {
+					sourcePath "/usr/bin"
+				} as bins
+				mount image("src") "/lib" with option {
+					sourcePath "/usr/lib"
+				} as libs
+				mount scratch "/out" with option {
+					sourcePath "/"
+				} as out
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Image("alpine").Run(
-				llb.Shlex("echo unchanged"),
-				llb.ReadonlyRootFS(),
-			).Root())
+			run := llb.Image("alpine").Run(
+				llb.Args([]string{"/bin/sh", "-c", "make"}),
+				llb.AddMount("/bin", llb.Image("src"), llb.SourcePath("/usr/bin")),
+				llb.AddMount("/lib", llb.Image("src"), llb.SourcePath("/usr/lib")),
+				llb.AddMount("/out", llb.Scratch(), llb.SourcePath("/")),
+			)
+			selectPath := func(st llb.State, path string) llb.State {
+				return llb.Scratch().File(llb.Copy(st, path, "/", &llb.CopyInfo{
+					CopyDirContentsOnly: true,
+					FollowSymlinks:      true,
+				}))
+			}
+			return solver.Parallel(
+				Expect(t, selectPath(run.GetMount("/bin"), "/usr/bin")),
+				Expect(t, selectPath(run.GetMount("/lib"), "/usr/lib")),
+				Expect(t, run.GetMount("/out")),
+			)
 		},
 	}, {
-		"breakpoint",
-		[]string{"default"},
+		"same mount bound twice with different selectors",
+		[]string{"bins", "libs"},
 		`
-		fs default() {
+		fs build() {
 			image "alpine"
-			breakpoint
+			run "make" with option {
+				mount image("src") "/src" with option {
+					sourcePath "/usr/bin"
+				} as bins
+			}
+			run "make" with option {
+				mount image("src") "/src" with option {
+					sourcePath "/usr/lib"
+				} as libs
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Image("alpine"))
+			binsRun := llb.Image("alpine").Run(
+				llb.Args([]string{"/bin/sh", "-c", "make"}),
+				llb.AddMount("/src", llb.Image("src"), llb.SourcePath("/usr/bin")),
+			)
+			libsRun := binsRun.Root().Run(
+				llb.Args([]string{"/bin/sh", "-c", "make"}),
+				llb.AddMount("/src", llb.Image("src"), llb.SourcePath("/usr/lib")),
+			)
+			selectPath := func(st llb.State, path string) llb.State {
+				return llb.Scratch().File(llb.Copy(st, path, "/", &llb.CopyInfo{
+					CopyDirContentsOnly: true,
+					FollowSymlinks:      true,
+				}))
+			}
+			return solver.Parallel(
+				Expect(t, selectPath(binsRun.GetMount("/src"), "/usr/bin")),
+				Expect(t, selectPath(libsRun.GetMount("/src"), "/usr/lib")),
+			)
 		},
 	}, {
-		"empty pipeline",
-		[]string{"default"},
+		"binding used after the statement that binds it",
+		[]string{"default", "out"},
 		`
-		pipeline default() {}
+		fs default() {
+			image "alpine"
+			run "make" with option {
+				mount scratch "/out" as out
+			}
+			run "make clean"
+			copy out "/" "/usr/local"
+		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return solver.NilRequest()
+			run := llb.Image("alpine").Run(
+				llb.Args([]string{"/bin/sh", "-c", "make"}),
+				llb.AddMount("/out", llb.Scratch()),
+			)
+			clean := run.Root().Run(llb.Args([]string{"/bin/sh", "-c", "make clean"}))
+			return solver.Parallel(
+				Expect(t, clean.Root().File(llb.Copy(run.GetMount("/out"), "/", "/usr/local"))),
+				Expect(t, run.GetMount("/out")),
+			)
 		},
 	}, {
-		"sequential pipeline",
-		[]string{"default"},
+		"binding used in the nested block it is bound in",
+		[]string{"default", "out"},
 		`
-		pipeline default() {
-			stage fs { image "alpine"; }
-			stage fs { image "busybox"; }
+		fs default() {
+			image "alpine"
+			copy fs {
+				image "golang"
+				run "make" with option {
+					mount scratch "/out" as out
+				}
+				copy out "/" "/bin"
+			} "/bin" "/usr/local/bin"
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return solver.Sequential(
-				Expect(t, llb.Image("alpine")),
-				Expect(t, llb.Image("busybox")),
+			run := llb.Image("golang").Run(
+				llb.Args([]string{"/bin/sh", "-c", "make"}),
+				llb.AddMount("/out", llb.Scratch()),
+			)
+			built := run.Root().File(llb.Copy(run.GetMount("/out"), "/", "/bin"))
+			return solver.Parallel(
+				Expect(t, llb.Image("alpine").File(llb.Copy(built, "/bin", "/usr/local/bin"))),
+				Expect(t, run.GetMount("/out")),
 			)
 		},
 	}, {
-		"stage pipeline",
-		[]string{"default"},
+		"binding name interpolated into a run command",
+		[]string{"build", "amd64"},
 		`
-		pipeline default() {
-			stage fs {
-				image "alpine"
-			} fs {
-				image "busybox"
+		fs build() {
+			image "alpine"
+			run "echo ${bindingName}" with option {
+				mount scratch "/out" as amd64
 			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
+			run := func(name string) llb.ExecState {
+				return llb.Image("alpine").Run(
+					llb.Args([]string{"/bin/sh", "-c", "echo " + name}),
+					llb.AddMount("/out", llb.Scratch()),
+				)
+			}
 			return solver.Parallel(
-				Expect(t, llb.Image("alpine")),
-				Expect(t, llb.Image("busybox")),
+				Expect(t, run("build").Root()),
+				Expect(t, run("amd64").GetMount("/out")),
 			)
 		},
 	}, {
-		"stage and sequential pipelines",
-		[]string{"default"},
+		"captured run outputs used downstream",
+		[]string{"default", "coverage", "reports"},
 		`
-		pipeline default() {
+		fs default() {
+			image "golang"
+			dir "/src"
+			run "go test -coverprofile cover.out ./..." with option {
+				mount scratch "/reports"
+				capture "cover.out" as coverage
+				capture "/reports/junit" as reports
+			}
+			copy coverage "/" "/coverage"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			run := llb.Image("golang").Dir("/src").Run(
+				llb.Args([]string{"/bin/sh", "-c", "go test -coverprofile cover.out ./..."}),
+				llb.AddMount("/reports", llb.Scratch()),
+			)
+			capture := func(st llb.State, src, dest string) llb.State {
+				return llb.Scratch().File(llb.Copy(st, src, dest, &llb.CopyInfo{
+					FollowSymlinks: true,
+				}))
+			}
+			coverage := capture(run.Root(), "/src/cover.out", "/cover.out")
+			return solver.Parallel(
+				Expect(t, run.Root().File(llb.Copy(coverage, "/", "/coverage"))),
+				Expect(t, coverage),
+				Expect(t, capture(run.GetMount("/reports"), "/junit", "/junit")),
+			)
+		},
+	}, {
+		"option builtin without func lit",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			run "echo unchanged" with readonlyRootfs
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("alpine").Run(
+				llb.Shlex("echo unchanged"),
+				llb.ReadonlyRootFS(),
+			).Root())
+		},
+	}, {
+		"breakpoint",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			breakpoint
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("alpine"))
+		},
+	}, {
+		"empty pipeline",
+		[]string{"default"},
+		`
+		pipeline default() {}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return solver.NilRequest()
+		},
+	}, {
+		"sequential pipeline",
+		[]string{"default"},
+		`
+		pipeline default() {
+			stage fs { image "alpine"; }
+			stage fs { image "busybox"; }
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return solver.Sequential(
+				Expect(t, llb.Image("alpine")),
+				Expect(t, llb.Image("busybox")),
+			)
+		},
+	}, {
+		"stage pipeline",
+		[]string{"default"},
+		`
+		pipeline default() {
+			stage fs {
+				image "alpine"
+			} fs {
+				image "busybox"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return solver.Parallel(
+				Expect(t, llb.Image("alpine")),
+				Expect(t, llb.Image("busybox")),
+			)
+		},
+	}, {
+		"stage and sequential pipelines",
+		[]string{"default"},
+		`
+		pipeline default() {
 			stage fs { image "golang:alpine"; }
 			stage fs {
 				image "alpine"
@@ -596,6 +1109,57 @@ func TestCodeGen(t *testing.T) {
 				Expect(t, llb.Scratch().File(llb.Mkfile("foo", 0644, []byte("hello world")))),
 			)
 		},
+	}, {
+		"sequence pipeline",
+		[]string{"default"},
+		`
+		pipeline default() {
+			sequence fs {
+				image "alpine"
+			} fs {
+				run "echo hello > /greeting"
+			} addWorld fs {
+				mkfile "/done" 0o644 "done"
+			}
+		}
+
+		fs addWorld() {
+			run "cat /greeting; echo world >> /greeting"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("alpine").Run(
+				llb.Args([]string{"/bin/sh", "-c", "echo hello > /greeting"}),
+			).Run(
+				llb.Args([]string{"/bin/sh", "-c", "cat /greeting; echo world >> /greeting"}),
+			).File(
+				llb.Mkfile("/done", 0644, []byte("done")),
+			))
+		},
+	}, {
+		"sequence after stage",
+		[]string{"default"},
+		`
+		pipeline default() {
+			stage fs { image "busybox"; }
+			sequence fs {
+				scratch
+				mkfile "foo" 0o644 "hello"
+			} fs {
+				mkfile "bar" 0o644 "world"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return solver.Sequential(
+				Expect(t, llb.Image("busybox")),
+				Expect(t, llb.Scratch().File(
+					llb.Mkfile("foo", 0644, []byte("hello")),
+				).File(
+					llb.Mkfile("bar", 0644, []byte("world")),
+				)),
+			)
+		},
 	}, {
 		"here doc processing",
 		[]string{"default"},
@@ -651,345 +1215,4852 @@ func TestCodeGen(t *testing.T) {
 			).Root())
 		},
 	}, {
-		"heredoc folding",
-		[]string{"default"},
+		"per platform strings",
+		[]string{"default", "ordered"},
 		`
+		string arch() {
+			targetArch
+		}
+
+		string snippet() {
+			template "- platform: {{.os}}/{{.arch}}" with option {
+				stringField "os" targetOs
+				stringField "arch" arch
+			}
+		}
+
+		string arches() {
+			perPlatform string {
+				localRun format("if [ %s = amd64 ]; then sleep 0.2; fi; echo %s", targetArch, targetArch)
+			} "linux/amd64" "linux/arm64" with separator(",")
+		}
+
 		fs default() {
-			mkfile "foo" 0o644 <<~EOM
-		                Hello world
-		        EOM
+			mkfile "/manifest.yaml" 0o644 perPlatform(snippet, "linux/amd64", "linux/arm64/v8", "windows/amd64")
+		}
+
+		fs ordered() {
+			mkfile "/arches" 0o644 arches
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Scratch().File(
-				llb.Mkfile("foo", 0644, []byte("Hello world")),
-			))
+			return solver.Parallel(
+				Expect(t, llb.Scratch().File(
+					llb.Mkfile("/manifest.yaml", 0o644, []byte(strings.Join([]string{
+						"- platform: linux/amd64",
+						"- platform: linux/arm64",
+						"- platform: windows/amd64",
+					}, "\n"))),
+				)),
+				Expect(t, llb.Scratch().File(
+					llb.Mkfile("/arches", 0o644, []byte("amd64,arm64")),
+				)),
+			)
 		},
 	}, {
-		"string escape",
+		"run with stdin",
 		[]string{"default"},
 		`
 		fs default() {
-			mkfile "foo" 0o644 "Escape \${PATH} Escape \" Escape \n Escape \\"
+			image "alpine"
+			run "sh -s" with option {
+				stdin <<~SCRIPT
+				echo hello
+				SCRIPT
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Scratch().File(
-				llb.Mkfile("foo", 0644, []byte("Escape ${PATH} Escape \" Escape \n Escape \\")),
-			))
+			return Expect(t, llb.Image("alpine").Run(
+				llb.Args([]string{"/bin/sh", "-c", `exec "$@" < /run/hlb/stdin`, "stdin", "/bin/sh", "-c", "sh -s"}),
+				llb.AddMount(
+					codegen.StdinMountpoint,
+					llb.Scratch().File(llb.Mkfile("stdin", 0o644, []byte("echo hello"))),
+					llb.Readonly,
+					llb.SourcePath("stdin"),
+				),
+			).Root())
 		},
 	}, {
-		"heredoc escape",
+		"run with stdin file",
 		[]string{"default"},
 		`
 		fs default() {
-			mkfile "foo" 0o644 <<~EOM
-				Escape \${PATH}
-				Don't escape \"
-				Don't escape \n
-				Don't escape \\
-		        EOM
+			image "postgres"
+			run "psql" with option {
+				stdinFile fs {
+					mkfile "/schema.sql" 0o644 "CREATE TABLE foo ();"
+				} "/schema.sql"
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Scratch().File(
-				llb.Mkfile("foo", 0644, []byte(`Escape ${PATH} Don't escape \" Don't escape \n Don't escape \\`)),
-			))
+			return Expect(t, llb.Image("postgres").Run(
+				llb.Args([]string{"/bin/sh", "-c", `exec "$@" < /run/hlb/stdin`, "stdin", "/bin/sh", "-c", "psql"}),
+				llb.AddMount(
+					codegen.StdinMountpoint,
+					llb.Scratch().File(llb.Mkfile("/schema.sql", 0o644, []byte("CREATE TABLE foo ();"))),
+					llb.Readonly,
+					llb.SourcePath("/schema.sql"),
+				),
+			).Root())
 		},
 	}, {
-		"entitlements",
+		"run with stdin without a shell",
 		[]string{"default"},
 		`
 		fs default() {
-			image "busybox"
-			run "entitlements" with option {
-				network "host"
-				security "insecure"
-			}
+			image "gcr.io/distroless/python3"
+			run "python3" "-" with stdin("print('hello')")
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t,
-				llb.Image("busybox").Run(
-					llb.Args([]string{"/bin/sh", "-c", "entitlements"}),
-					llb.Network(pb.NetMode_HOST),
-					llb.Security(pb.SecurityMode_INSECURE),
-				).Root(),
-				solver.WithEntitlement(entitlements.EntitlementNetworkHost),
-				solver.WithEntitlement(entitlements.EntitlementSecurityInsecure),
-			)
+			return Expect(t, llb.Image("gcr.io/distroless/python3").Run(
+				llb.Args([]string{"/run/hlb/shim/bin/sh", "-c", `exec "$@" < /run/hlb/stdin`, "stdin", "python3", "-"}),
+				llb.AddMount(
+					codegen.StdinMountpoint,
+					llb.Scratch().File(llb.Mkfile("stdin", 0o644, []byte("print('hello')"))),
+					llb.Readonly,
+					llb.SourcePath("stdin"),
+				),
+				llb.AddMount(
+					codegen.StdinShimMountpoint,
+					llb.Image(codegen.StdinShimImage, llb.LinuxAmd64),
+					llb.Readonly,
+				),
+			).Root())
 		},
 	}, {
-		"mount over readonly",
+		"sources with fallbacks without a client",
 		[]string{"default"},
 		`
 		fs default() {
-			image "busybox"
-			run "find ." with option {
-				shlex
-				dir "/foo"
-				mount fs {
-					local "."
-				} "/foo" with readonly
-				mount scratch "/foo/bar"
-				secret "codegen_test.go" "/foo/secret/codegen_test.go"
+			http "https://example.com/app.tar.gz" with fallback("https://mirror.example.com/app.tar.gz")
+			copy src "/" "/src"
+		}
+
+		fs src() {
+			git "https://github.com/openllb/hlb.git" "master" with option {
+				fallback "https://mirror.example.com/openllb/hlb.git"
 			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			sid := llbutil.SecretID("codegen_test.go")
-			return Expect(t, llb.Image("busybox").Run(
-				llb.Shlex("find ."),
-				llb.Dir("/foo"),
-				llb.AddMount(
-					"/foo",
-					LocalState(ctx, t, ".").File(
-						// this Mkdir is made implicitly due to /foo/secret
-						// secret over readonly FS
-						llb.Mkdir("secret", 0755, llb.WithParents(true)),
-					).File(
-						// this Mkfile is made implicitly due to /foo/secret
-						// secret over readonly FS
-						llb.Mkfile("secret/codegen_test.go", 0644, []byte{}),
-					).File(
-						// this Mkdir is made implicitly due to /foo/bar
-						// mount over readonly FS
-						llb.Mkdir("bar", 0755, llb.WithParents(true)),
-					),
-					llb.Readonly,
-				),
-				llb.AddMount("/foo/bar", llb.Scratch()),
-				llb.AddSecret("/foo/secret/codegen_test.go", llb.SecretID(sid)),
-			).Root())
+			return Expect(t, llb.HTTP("https://example.com/app.tar.gz").File(
+				llb.Copy(llb.Git("https://github.com/openllb/hlb.git", "master"), "/", "/src"),
+			))
 		},
 	}, {
-		"merging user defined option::copy with func lit",
+		"run depending on another step",
 		[]string{"default"},
 		`
-		fs default() {
-			scratch
-			copy scratch "/" "/foo" with option {
-				createDestPath
-				myOpt
+		fs populate() {
+			image "alpine"
+			run "echo populated > /cache/log" with option {
+				mount scratch "/cache" with cache("shared", "shared")
 			}
 		}
 
-		option::copy myOpt() {
-			chown "1001:1001"
+		fs default() {
+			image "alpine"
+			run "cat /cache/log" with option {
+				mount scratch "/cache" with cache("shared", "shared")
+				dependsOn populate
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Scratch().File(
-				llb.Copy(llb.Scratch(), "/", "/foo", &llb.CopyInfo{
-					CreateDestPath: true,
-					ChownOpt: &llb.ChownOpt{
-						User:  &llb.UserOpt{UID: 1001},
-						Group: &llb.UserOpt{UID: 1001},
-					},
-				}),
-			))
+			populate := llb.Image("alpine").Run(
+				llb.Shlex("/bin/sh -c 'echo populated > /cache/log'"),
+				llb.AddMount("/cache", llb.Scratch(), llb.AsPersistentCacheDir("shared", llb.CacheMountShared)),
+			).Root()
+			return Expect(t, llb.Image("alpine").Run(
+				llb.Shlex("/bin/sh -c 'cat /cache/log'"),
+				llb.AddMount("/cache", llb.Scratch(), llb.AsPersistentCacheDir("shared", llb.CacheMountShared)),
+				llb.AddMount(codegen.BarrierMountpoint, llbutil.Barrier(populate), llb.Readonly),
+			).Root())
 		},
 	}, {
-		"localRun",
+		"run defaults apply to every run in the module",
 		[]string{"default"},
 		`
+		option::run runDefaults() {
+			mount scratch "/root/.cache/go-build" with option {
+				cache "go-build" "shared"
+			}
+			env "GOFLAGS" "-mod=vendor"
+		}
+
+		fs deps() {
+			image "golang"
+			run "go mod download"
+		}
+
 		fs default() {
-			mkfile "./just-stdout" 0o644 string {
-				localRun "echo stdout; echo stderr >&2"
+			deps
+			run "go build"
+			run "go test" with option {
+				mount scratch "/root/.cache/go-build" with option {
+					cache "go-test" "private"
+				}
 			}
-			mkfile "./just-stderr" 0o644 string {
-				localRun "echo stdout; echo stderr >&2" with onlyStderr
-			}
-			mkfile "./stdio" 0o644 string {
-				localRun "echo stdout; echo stderr >&2" with includeStderr
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			goBuildCache := llb.AddMount("/root/.cache/go-build", llb.Scratch(), llb.AsPersistentCacheDir("go-build", llb.CacheMountShared))
+			return Expect(t, llb.Image("golang").Run(
+				llb.Shlex("/bin/sh -c 'go mod download'"),
+				goBuildCache,
+				llb.AddEnv("GOFLAGS", "-mod=vendor"),
+			).Root().Run(
+				llb.Shlex("/bin/sh -c 'go build'"),
+				goBuildCache,
+				llb.AddEnv("GOFLAGS", "-mod=vendor"),
+			).Root().Run(
+				llb.Shlex("/bin/sh -c 'go test'"),
+				llb.AddEnv("GOFLAGS", "-mod=vendor"),
+				llb.AddMount("/root/.cache/go-build", llb.Scratch(), llb.AsPersistentCacheDir("go-test", llb.CacheMountPrivate)),
+			).Root())
+		},
+	}, {
+		"run defaults are scoped to their module",
+		[]string{"default"},
+		`
+		import other from "./other.hlb"
+
+		option::run runDefaults() {
+			env "FROM" "main"
+		}
+
+		fs default() {
+			other.build
+			run "make install"
+		}
+		`,
+		`
+		export build
+
+		option::run runDefaults() {
+			env "FROM" "other"
+		}
+
+		fs build() {
+			image "alpine"
+			run "make"
+		}
+		`,
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("alpine").Run(
+				llb.Shlex("/bin/sh -c make"),
+				llb.AddEnv("FROM", "other"),
+			).Root().Run(
+				llb.Shlex("/bin/sh -c 'make install'"),
+				llb.AddEnv("FROM", "main"),
+			).Root())
+		},
+	}, {
+		"strip with default helper",
+		[]string{"default"},
+		`
+		fs default() {
+			image "golang"
+			strip "/go/bin/app" "usr/local/bin/tool"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			helper := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Shlex("apk add --no-cache binutils"),
+			).Root()
+			return Expect(t, helper.Run(
+				llb.Args([]string{"/bin/sh", "-c", codegen.StripScript, "strip", "/go/bin/app", "/usr/local/bin/tool"}),
+				llb.AddMount(codegen.StripMountpoint, llb.Image("golang")),
+			).GetMount(codegen.StripMountpoint))
+		},
+	}, {
+		"strip with helper",
+		[]string{"default"},
+		`
+		fs default() {
+			image "golang"
+			strip "/go/bin/app" with option {
+				helper image("binutils")
 			}
-			mkfile "./goterror" 0o644 string {
-				localRun "echo stdout; exit 1" with ignoreError
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("binutils").Run(
+				llb.Args([]string{"/bin/sh", "-c", codegen.StripScript, "strip", "/go/bin/app"}),
+				llb.AddMount(codegen.StripMountpoint, llb.Image("golang")),
+			).GetMount(codegen.StripMountpoint))
+		},
+	}, {
+		"copy with substitutions",
+		[]string{"default"},
+		`
+		fs default() {
+			copy image("app") "/etc/app" "/etc/app" with option {
+				substitute "{{VERSION}}" "1.2.3"
+				substitute "{{ENV}}" "prod"
 			}
-			# this will write evaluate the $HOME env var because run as ["/bin/sh", "-c", "echo $HOME"]
-			mkfile "./noshlex" 0o644 string {
-				localRun "echo $HOME"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			input := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.SubstituteScript, "substitute",
+					codegen.SubstituteMountpoint + "/etc/app", "false",
+					"{{VERSION}}", "1.2.3",
+					"{{ENV}}", "prod",
+				}),
+				llb.AddMount(codegen.SubstituteMountpoint, llb.Image("app")),
+			).GetMount(codegen.SubstituteMountpoint)
+			return Expect(t, llb.Scratch().File(
+				llb.Copy(input, "/etc/app", "/etc/app"),
+			))
+		},
+	}, {
+		"copy with file and dir modes",
+		[]string{"default"},
+		`
+		fs default() {
+			copy image("app") "/srv" "/srv" with option {
+				fileMode 0o644
+				dirMode 0o755
 			}
-			# this will write the literal string "$HOME" because run as ["/bin/echo", "$HOME"]
-			mkfile "./shlex" 0o644 string {
-				localRun "echo $HOME" with shlex
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			input := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.ChmodScript, "chmod",
+					codegen.ChmodMountpoint + "/srv", "false", "644", "755",
+				}),
+				llb.AddMount(codegen.ChmodMountpoint, llb.Image("app")),
+			).GetMount(codegen.ChmodMountpoint)
+			return Expect(t, llb.Scratch().File(
+				llb.Copy(input, "/srv", "/srv"),
+			))
+		},
+	}, {
+		"copy wildcard with substitutions",
+		[]string{"default"},
+		`
+		fs default() {
+			copy image("app") "/etc/*.conf" "/etc" with option {
+				allowWildcard
+				substitute "{{VERSION}}" "1.2.3"
 			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
+			input := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.SubstituteScript, "substitute",
+					codegen.SubstituteMountpoint + "/etc/*.conf", "true",
+					"{{VERSION}}", "1.2.3",
+				}),
+				llb.AddMount(codegen.SubstituteMountpoint, llb.Image("app")),
+			).GetMount(codegen.SubstituteMountpoint)
 			return Expect(t, llb.Scratch().File(
-				llb.Mkfile("just-stdout", os.FileMode(0644), []byte("stdout")),
-			).File(
-				llb.Mkfile("just-stderr", os.FileMode(0644), []byte("stderr")),
-			).File(
-				llb.Mkfile("stdio", os.FileMode(0644), []byte("stdout\nstderr")),
-			).File(
-				llb.Mkfile("goterror", os.FileMode(0644), []byte("stdout")),
-			).File(
-				llb.Mkfile("noshlex", os.FileMode(0644), []byte(os.Getenv("HOME"))),
+				llb.Copy(input, "/etc/*.conf", "/etc", llbutil.WithAllowWildcard(true)),
+			))
+		},
+	}, {
+		"copy with manifest",
+		[]string{"default"},
+		`
+		fs default() {
+			dir "/srv"
+			copy image("app") "/etc/app" "app" with option {
+				manifest "app.manifest"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			copied := llb.Scratch().Dir("/srv").File(
+				llb.Copy(llb.Image("app"), "/etc/app", "app"),
+			)
+			manifest := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.ManifestScript, "manifest",
+					codegen.ManifestMountpoint,
+					codegen.ManifestOutputMountpoint + "/srv/app.manifest",
+				}),
+				llb.AddMount(codegen.ManifestMountpoint, copied, llb.Readonly),
+				llb.AddMount(codegen.ManifestOutputMountpoint, llb.Scratch()),
+			).GetMount(codegen.ManifestOutputMountpoint)
+			return Expect(t, llb.Scratch().Dir("/srv").File(
+				llb.Copy(llb.Image("app"), "/etc/app", "app"),
 			).File(
-				llb.Mkfile("shlex", os.FileMode(0644), []byte("$HOME")),
+				llb.Copy(manifest, "/srv/app.manifest", "/srv/app.manifest", llbutil.WithCreateDestPath(true)),
 			))
 		},
 	}, {
-		"dockerfile meta",
+		"copy with manifest into an existing directory",
 		[]string{"default"},
 		`
 		fs default() {
-			image "busybox"
-			env "myenv1" "value1"
-			env "myenv2" "value2"
-			env "myenv1" "value3"
-			dir "myworkdir"
-			entrypoint "my" "entrypoint"
-			cmd "my" "cmd"
-			label "mylabel1" "value1"
-			label "mylabel2" "value2"
-			label "mylabel1" "value3"
-			expose "8080/tcp" "9001/udp"
-			volumes "/var/log" "/var/db"
-			stopSignal "SIGKILL"
+			image "base"
+			copy image("app") "/etc/app" "/srv" with option {
+				manifest "/app.manifest"
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Image("busybox"))
+			// The manifest records the files where the copy put them, which
+			// is inside /srv if it is a directory of the base image.
+			copied := llb.Image("base").File(
+				llb.Copy(llb.Image("app"), "/etc/app", "/srv"),
+			)
+			manifest := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.ManifestScript, "manifest",
+					codegen.ManifestMountpoint,
+					codegen.ManifestOutputMountpoint + "/app.manifest",
+				}),
+				llb.AddMount(codegen.ManifestMountpoint, llb.Diff(llb.Image("base"), copied), llb.Readonly),
+				llb.AddMount(codegen.ManifestOutputMountpoint, llb.Scratch()),
+			).GetMount(codegen.ManifestOutputMountpoint)
+			return Expect(t, copied.File(
+				llb.Copy(manifest, "/app.manifest", "/app.manifest", llbutil.WithCreateDestPath(true)),
+			))
 		},
 	}, {
-		"calling a func with an imported func",
+		"copy with bound manifest",
+		[]string{"appManifest"},
+		`
+		fs default() {
+			copy image("app") "/etc/app" "/etc/app" with option {
+				manifest "/app.manifest" as appManifest
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			copied := llb.Scratch().File(
+				llb.Copy(llb.Image("app"), "/etc/app", "/etc/app"),
+			)
+			return Expect(t, llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.ManifestScript, "manifest",
+					codegen.ManifestMountpoint,
+					codegen.ManifestOutputMountpoint + "/app.manifest",
+				}),
+				llb.AddMount(codegen.ManifestMountpoint, copied, llb.Readonly),
+				llb.AddMount(codegen.ManifestOutputMountpoint, llb.Scratch()),
+			).GetMount(codegen.ManifestOutputMountpoint))
+		},
+	}, {
+		"heredoc folding",
 		[]string{"default"},
 		`
-		import other from "./other.hlb"
-
 		fs default() {
-			scratch
-			run "echo Hello" with other.runOpts
+			mkfile "foo" 0o644 <<~EOM
+		                Hello world
+		        EOM
 		}
-		`,
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Mkfile("foo", 0644, []byte("Hello world")),
+			))
+		},
+	}, {
+		"string escape",
+		[]string{"default"},
 		`
-		export runOpts
-
-		option::run runOpts() {
-			dir "/etc"
-			shlex
+		fs default() {
+			mkfile "foo" 0o644 "Escape \${PATH} Escape \" Escape \n Escape \\"
 		}
-		`,
+		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Scratch().Run(
-				llb.Shlex("echo Hello"),
-				llb.Dir("/etc"),
-			).Root())
+			return Expect(t, llb.Scratch().File(
+				llb.Mkfile("foo", 0644, []byte("Escape ${PATH} Escape \" Escape \n Escape \\")),
+			))
 		},
 	}, {
-		"merge op",
+		"heredoc escape",
 		[]string{"default"},
 		`
 		fs default() {
-			image "alpine"
-			merge image("root1") image("root2")
+			mkfile "foo" 0o644 <<~EOM
+				Escape \${PATH}
+				Don't escape \"
+				Don't escape \n
+				Don't escape \\
+		        EOM
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Merge([]llb.State{
-				llb.Image("alpine"),
-				llb.Image("root1"),
-				llb.Image("root2"),
-			}))
+			return Expect(t, llb.Scratch().File(
+				llb.Mkfile("foo", 0644, []byte(`Escape ${PATH} Don't escape \" Don't escape \n Don't escape \\`)),
+			))
 		},
 	}, {
-		"diff op",
+		"entitlements",
 		[]string{"default"},
 		`
 		fs default() {
-			image "alpine"
-			diff image("root1")
+			image "busybox"
+			run "entitlements" with option {
+				network "host"
+				security "insecure"
+			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			return Expect(t, llb.Diff(llb.Image("root1"), llb.Image("alpine")))
+			return Expect(t,
+				llb.Image("busybox").Run(
+					llb.Args([]string{"/bin/sh", "-c", "entitlements"}),
+					llb.Network(pb.NetMode_HOST),
+					llb.Security(pb.SecurityMode_INSECURE),
+				).Root(),
+				solver.WithEntitlement(entitlements.EntitlementNetworkHost),
+				solver.WithEntitlement(entitlements.EntitlementSecurityInsecure),
+			)
 		},
 	}, {
-		"multiple platforms",
+		"mount over readonly",
 		[]string{"default"},
 		`
 		fs default() {
-			image "alpine" with platform("linux", "amd64")
-			run "echo Amd" with option {
+			image "busybox"
+			run "find ." with option {
 				shlex
+				dir "/foo"
 				mount fs {
-					image "alpine" with platform("linux", "arm64")
-					run "echo Arm" with shlex
-				} "/foobar"
+					local "."
+				} "/foo" with readonly
+				mount scratch "/foo/bar"
+				secret "codegen_test.go" "/foo/secret/codegen_test.go"
 			}
 		}
 		`, "",
 		func(ctx context.Context, t *testing.T) solver.Request {
-			st := llb.Image("alpine", llb.Platform(specs.Platform{
-				OS:           "linux",
-				Architecture: "amd64",
-			}))
-
-			mnt := llb.Image("alpine", llb.Platform(specs.Platform{
-				OS:           "linux",
-				Architecture: "arm64",
-			})).Run(
-				llb.Shlex("echo Arm"),
-			).Root()
-
-			return Expect(t, st.Run(
-				llb.Shlex("echo Amd"),
-				llb.AddMount("/foobar", mnt),
-			).Root())
-		},
-	}} {
-		tc := tc
-		t.Run(tc.name, func(t *testing.T) {
-			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
-			ctx = ast.WithModules(ctx, builtin.Modules())
-
-			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.hlb)))
-			require.NoError(t, err, tc.name)
-
-			err = checker.SemanticPass(mod)
-			require.NoError(t, err, tc.name)
-
-			err = checker.Check(mod)
-			require.NoError(t, err, tc.name)
-
-			if tc.hlbImport != "" {
-				obj := mod.Scope.Lookup("other")
-				if obj == nil {
-					t.Fatal(`"other" should be imported by the test module`)
+			sid := llbutil.SecretID("codegen_test.go")
+			return Expect(t, llb.Image("busybox").Run(
+				llb.Shlex("find ."),
+				llb.Dir("/foo"),
+				llb.AddMount(
+					"/foo",
+					LocalState(ctx, t, ".").File(
+						// this Mkdir is made implicitly due to /foo/secret
+						// secret over readonly FS
+						llb.Mkdir("secret", 0755, llb.WithParents(true)),
+					).File(
+						// this Mkfile is made implicitly due to /foo/secret
+						// secret over readonly FS
+						llb.Mkfile("secret/codegen_test.go", 0644, []byte{}),
+					).File(
+						// this Mkdir is made implicitly due to /foo/bar
+						// mount over readonly FS
+						llb.Mkdir("bar", 0755, llb.WithParents(true)),
+					),
+					llb.Readonly,
+				),
+				llb.AddMount("/foo/bar", llb.Scratch()),
+				llb.AddSecret("/foo/secret/codegen_test.go", llb.SecretID(sid)),
+			).Root())
+		},
+	}, {
+		"merging user defined option::copy with func lit",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			copy scratch "/" "/foo" with option {
+				createDestPath
+				myOpt
+			}
+		}
+
+		option::copy myOpt() {
+			chown "1001:1001"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Copy(llb.Scratch(), "/", "/foo", &llb.CopyInfo{
+					CreateDestPath: true,
+					ChownOpt: &llb.ChownOpt{
+						User:  &llb.UserOpt{UID: 1001},
+						Group: &llb.UserOpt{UID: 1001},
+					},
+				}),
+			))
+		},
+	}, {
+		"localRun",
+		[]string{"default"},
+		`
+		fs default() {
+			mkfile "./just-stdout" 0o644 string {
+				localRun "echo stdout; echo stderr >&2"
+			}
+			mkfile "./just-stderr" 0o644 string {
+				localRun "echo stdout; echo stderr >&2" with onlyStderr
+			}
+			mkfile "./stdio" 0o644 string {
+				localRun "echo stdout; echo stderr >&2" with includeStderr
+			}
+			mkfile "./goterror" 0o644 string {
+				localRun "echo stdout; exit 1" with ignoreError
+			}
+			# this will write evaluate the $HOME env var because run as ["/bin/sh", "-c", "echo $HOME"]
+			mkfile "./noshlex" 0o644 string {
+				localRun "echo $HOME"
+			}
+			# this will write the literal string "$HOME" because run as ["/bin/echo", "$HOME"]
+			mkfile "./shlex" 0o644 string {
+				localRun "echo $HOME" with shlex
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Mkfile("just-stdout", os.FileMode(0644), []byte("stdout")),
+			).File(
+				llb.Mkfile("just-stderr", os.FileMode(0644), []byte("stderr")),
+			).File(
+				llb.Mkfile("stdio", os.FileMode(0644), []byte("stdout\nstderr")),
+			).File(
+				llb.Mkfile("goterror", os.FileMode(0644), []byte("stdout")),
+			).File(
+				llb.Mkfile("noshlex", os.FileMode(0644), []byte(os.Getenv("HOME"))),
+			).File(
+				llb.Mkfile("shlex", os.FileMode(0644), []byte("$HOME")),
+			))
+		},
+	}, {
+		"dockerfile meta",
+		[]string{"default"},
+		`
+		fs default() {
+			image "busybox"
+			env "myenv1" "value1"
+			env "myenv2" "value2"
+			env "myenv1" "value3"
+			dir "myworkdir"
+			entrypoint "my" "entrypoint"
+			cmd "my" "cmd"
+			label "mylabel1" "value1"
+			label "mylabel2" "value2"
+			label "mylabel1" "value3"
+			expose "8080/tcp" "9001/udp"
+			volumes "/var/log" "/var/db"
+			stopSignal "SIGKILL"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Image("busybox"))
+		},
+	}, {
+		"calling a func with an imported func",
+		[]string{"default"},
+		`
+		import other from "./other.hlb"
+
+		fs default() {
+			scratch
+			run "echo Hello" with other.runOpts
+		}
+		`,
+		`
+		export runOpts
+
+		option::run runOpts() {
+			dir "/etc"
+			shlex
+		}
+		`,
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().Run(
+				llb.Shlex("echo Hello"),
+				llb.Dir("/etc"),
+			).Root())
+		},
+	}, {
+		"nested option functions preserve order",
+		[]string{"default"},
+		`
+		fs default() {
+			scratch
+			run "echo Hello" with option {
+				outerOpts
+				env "D" "4"
+			}
+		}
+
+		option::run outerOpts() {
+			env "A" "1"
+			innerOpts
+			env "C" "3"
+		}
+
+		option::run innerOpts() {
+			env "B" "2"
+			dir "/inner"
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().Run(
+				llb.Args([]string{"/bin/sh", "-c", "echo Hello"}),
+				llb.AddEnv("A", "1"),
+				llb.AddEnv("B", "2"),
+				llb.Dir("/inner"),
+				llb.AddEnv("C", "3"),
+				llb.AddEnv("D", "4"),
+			).Root())
+		},
+	}, {
+		"imported options appended in order",
+		[]string{"default"},
+		`
+		import other from "./other.hlb"
+
+		fs default() {
+			scratch
+			run "echo Hello" with option {
+				env "A" "1"
+				other.runOpts
+				env "D" "4"
+			}
+		}
+		`,
+		`
+		export runOpts
+
+		option::run runOpts() {
+			env "B" "2"
+			nestedOpts
+		}
+
+		option::run nestedOpts() {
+			env "C" "3"
+		}
+		`,
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().Run(
+				llb.Args([]string{"/bin/sh", "-c", "echo Hello"}),
+				llb.AddEnv("A", "1"),
+				llb.AddEnv("B", "2"),
+				llb.AddEnv("C", "3"),
+				llb.AddEnv("D", "4"),
+			).Root())
+		},
+	}, {
+		"with block mixing fields and calls",
+		[]string{"default"},
+		`
+		fs default() {
+			build option::run {
+				env "A" "1"
+			} option::run {
+				env "C" "3"
+			}
+		}
+
+		fs build(option::run first, option::run second) {
+			scratch
+			run "echo Hello" with option {
+				first
+				env "B" "2"
+				second
+				dir "/last"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().Run(
+				llb.Args([]string{"/bin/sh", "-c", "echo Hello"}),
+				llb.AddEnv("A", "1"),
+				llb.AddEnv("B", "2"),
+				llb.AddEnv("C", "3"),
+				llb.Dir("/last"),
+			).Root())
+		},
+	}, {
+		"heredoc interpolation with nested calls",
+		[]string{"default"},
+		`
+		import other from "./other.hlb"
+
+		fs default() {
+			scratch
+			mkfile "config" 0o644 <<-EOF
+				name=${format("%s-%s", other.prefix("app"), format("%s", "v1"))}
+				tag=${other.prefix(format("%s", "latest"))}
+			EOF
+		}
+		`,
+		`
+		export prefix
+
+		string prefix(string name) {
+			format "hlb-%s" name
+		}
+		`,
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Mkfile("config", 0644, []byte("name=hlb-app-v1\ntag=hlb-latest")),
+			))
+		},
+	}, {
+		"format values of any string-like kind",
+		[]string{"default"},
+		`
+		int port() { 8080; }
+
+		fs default() {
+			scratch
+			mkfile "config" 0o644 format("%[1]s:%05[2]d %[1]q %[3]t %x", "host", port, true, 255)
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Scratch().File(
+				llb.Mkfile("config", 0644, []byte(`host:08080 "host" true ff`)),
+			))
+		},
+	}, {
+		"merge op",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			merge image("root1") image("root2")
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Merge([]llb.State{
+				llb.Image("alpine"),
+				llb.Image("root1"),
+				llb.Image("root2"),
+			}))
+		},
+	}, {
+		"combine stages",
+		[]string{"default", "first"},
+		`
+		fs default() {
+			combine image("root1") image("root2") image("root3")
+		}
+
+		fs first() {
+			combine image("root1") image("root2") image("root3") with conflict("first")
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return solver.Parallel(
+				Expect(t, llb.Merge([]llb.State{
+					llb.Image("root1"),
+					llb.Image("root2"),
+					llb.Image("root3"),
+				})),
+				Expect(t, llb.Merge([]llb.State{
+					llb.Image("root3"),
+					llb.Image("root2"),
+					llb.Image("root1"),
+				})),
+			)
+		},
+	}, {
+		"combine stages failing on conflicts",
+		[]string{"default"},
+		`
+		fs default() {
+			combine image("root1") image("root2") with conflict("error")
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			es := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+				llb.AddMount(codegen.CombineMountpoint+"/0", llb.Image("root1"), llb.Readonly),
+				llb.AddMount(codegen.CombineMountpoint+"/1", llb.Image("root2"), llb.Readonly),
+				llb.Args([]string{
+					"/bin/sh", "-c", codegen.CombineScript, "combine",
+					codegen.CombineMountpoint + "/0",
+					codegen.CombineMountpoint + "/1",
+				}),
+			)
+			return Expect(t, llb.Merge([]llb.State{
+				llb.Image("root1"),
+				llb.Image("root2"),
+				es.AddMount(codegen.CombineMountpoint+"/out", llb.Scratch()),
+			}))
+		},
+	}, {
+		"diff op",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine"
+			diff image("root1")
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			return Expect(t, llb.Diff(llb.Image("root1"), llb.Image("alpine")))
+		},
+	}, {
+		"multiple platforms",
+		[]string{"default"},
+		`
+		fs default() {
+			image "alpine" with platform("linux", "amd64")
+			run "echo Amd" with option {
+				shlex
+				mount fs {
+					image "alpine" with platform("linux", "arm64")
+					run "echo Arm" with shlex
+				} "/foobar"
+			}
+		}
+		`, "",
+		func(ctx context.Context, t *testing.T) solver.Request {
+			st := llb.Image("alpine", llb.Platform(specs.Platform{
+				OS:           "linux",
+				Architecture: "amd64",
+			}))
+
+			mnt := llb.Image("alpine", llb.Platform(specs.Platform{
+				OS:           "linux",
+				Architecture: "arm64",
+			})).Run(
+				llb.Shlex("echo Arm"),
+			).Root()
+
+			return Expect(t, st.Run(
+				llb.Shlex("echo Amd"),
+				llb.AddMount("/foobar", mnt),
+			).Root())
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.hlb)))
+			require.NoError(t, err, tc.name)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			if tc.hlbImport != "" {
+				obj := mod.Scope.Lookup("other")
+				if obj == nil {
+					t.Fatal(`"other" should be imported by the test module`)
+				}
+
+				imod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.hlbImport)))
+				require.NoError(t, err, tc.name)
+
+				err = checker.SemanticPass(imod)
+				require.NoError(t, err, tc.name)
+
+				err = checker.Check(imod)
+				require.NoError(t, err, tc.name)
+
+				obj.Data = imod
+
+				err = checker.CheckReferences(mod, "other")
+				require.NoError(t, err, tc.name)
+			}
+
+			var targets []codegen.Target
+			for _, target := range tc.targets {
+				targets = append(targets, codegen.Target{Name: target})
+			}
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			request, err := cg.Generate(ctx, mod, targets)
+			require.NoError(t, err, tc.name)
+
+			testRequest := tc.fn(ctx, t)
+
+			expected := treeprint.New()
+			err = testRequest.Tree(expected)
+			require.NoError(t, err, tc.name)
+			t.Logf("expected: %s", expected)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err, tc.name)
+			t.Logf("actual: %s", actual)
+
+			// Compare trees.
+			require.Equal(t, expected.String(), actual.String(), tc.name)
+		})
+	}
+}
+
+func TestCodegenError(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name    string
+		targets []string
+		input   string
+		fn      func(*ast.Module) error
+	}
+
+	for _, tc := range []testCase{
+		{
+			"invalid downloadDockerTarball ref",
+			[]string{"default"},
+			`
+			fs default() {
+				downloadDockerTarball "image.tar" "#"
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidImageRef(
+					errors.New("invalid reference format"),
+					ast.Search(mod, `"#"`),
+					"#",
+				)
+			},
+		},
+		{
+			"invalid image ref in an arg used by a function",
+			[]string{"default"},
+			`
+			fs default() {
+				pass image("#")
+			}
+
+			fs pass(fs input) {
+				input
+				run "make"
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidImageRef(
+					errors.New("invalid reference format"),
+					ast.Search(mod, `"#"`),
+					"#",
+				)
+			},
+		},
+		{
+			"negated except pattern",
+			[]string{"default"},
+			`
+			fs default() {
+				image "alpine"
+				rm "/app" with option {
+					except "!/app/keep"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidPattern(
+					ast.Search(mod, `"!/app/keep"`),
+					"!/app/keep",
+					errors.New("except patterns cannot be negated"),
+				)
+			},
+		},
+		{
+			"invalid exclude pattern",
+			[]string{"default"},
+			`
+			fs default() {
+				copy image("alpine") "/app" "/app" with option {
+					excludePatterns "*.log" "!"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidPattern(
+					ast.Search(mod, `"!"`),
+					"!",
+					errors.New("illegal exclusion pattern: \"!\""),
+				)
+			},
+		},
+		{
+			"missing ignore file",
+			[]string{"default"},
+			`
+			fs default() {
+				local "." with option {
+					ignoreFile "does-not-exist.ignore"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				_, err := os.Open("does-not-exist.ignore")
+				return errdefs.WithIgnoreFileNotExist(
+					err,
+					ast.Search(mod, `"does-not-exist.ignore"`),
+					"does-not-exist.ignore",
+				)
+			},
+		},
+		{
+			"unsupported git depth",
+			[]string{"default"},
+			`
+			fs default() {
+				git "https://github.com/openllb/hlb.git" "master" with option {
+					depth 50
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithUnsupportedGitDepth(
+					ast.Search(mod, "50"),
+					50,
+				)
+			},
+		},
+		{
+			"invalid expose port from expression",
+			[]string{"default"},
+			`
+			fs default() {
+				image "nginx"
+				expose "8080" format("%s/quic", "443")
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidPortSpec(
+					ast.Search(mod, `format("%s/quic", "443")`),
+					"443/quic",
+					errors.New("unsupported protocol `quic`, expected tcp, udp or sctp"),
+				)
+			},
+		},
+		{
+			"max size when copying from an image",
+			[]string{"default"},
+			`
+			fs default() {
+				copy image("alpine") "/usr/lib" "/lib" with option {
+					maxSize 1024
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithUnsupportedMaxSize(
+					ast.Search(mod, "copy"),
+				)
+			},
+		},
+		{
+			"export ignore when copying from an image",
+			[]string{"default"},
+			`
+			fs default() {
+				copy image("alpine") "/" "/src" with option {
+					exportIgnore
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithUnsupportedExportIgnore(
+					ast.Search(mod, "exportIgnore"),
+				)
+			},
+		},
+		{
+			"invalid per platform platform",
+			[]string{"default"},
+			`
+			fs default() {
+				mkfile "/os" 0o644 perPlatform(targetOs, "linux/amd64", "linux/not/a/platform")
+			}
+			`,
+			func(mod *ast.Module) error {
+				_, err := platforms.Parse("linux/not/a/platform")
+				return errdefs.WithInvalidPlatform(
+					err,
+					ast.Search(mod, `"linux/not/a/platform"`),
+					"linux/not/a/platform",
+				)
+			},
+		},
+		{
+			"stat path pattern",
+			[]string{"default"},
+			`
+			fs default() {
+				mkfile "/exists" 0o644 "${exists(scratch, format("/etc/%s", "*"))}"
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithStatPattern(
+					ast.Search(mod, `format("/etc/%s", "*")`),
+					"/etc/*",
+				)
+			},
+		},
+		{
+			"empty substitute placeholder",
+			[]string{"default"},
+			`
+			fs default() {
+				copy image("alpine") "/etc" "/etc" with option {
+					substitute "" "value"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithEmptyPlaceholder(
+					ast.Search(mod, `""`),
+				)
+			},
+		},
+		{
+			"chmod with fileMode",
+			[]string{"default"},
+			`
+			fs default() {
+				copy image("alpine") "/etc" "/etc" with option {
+					chmod 0o600
+					fileMode 0o644
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithConflictingCopyModes(
+					ast.Search(mod, "copy"),
+				)
+			},
+		},
+		{
+			"unsupported git shallowSince",
+			[]string{"default"},
+			`
+			fs default() {
+				git "https://github.com/openllb/hlb.git" "master" with option {
+					shallowSince "2020-01-01"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithUnsupportedGitOption(
+					ast.Search(mod, "shallowSince"),
+					"shallowSince",
+				)
+			},
+		},
+		{
+			"failed assertion",
+			[]string{"default"},
+			`
+			fs default() {
+				assert false "should not fail"
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithAssertFailed(
+					ast.Search(mod, "false"),
+					"should not fail",
+				)
+			},
+		},
+		{
+			"fail",
+			[]string{"default"},
+			`
+			fs default() {
+				image "alpine"
+				fail "unsupported platform"
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithFailed(
+					ast.Search(mod, "fail"),
+					"unsupported platform",
+				)
+			},
+		},
+		{
+			"failed equality assertion",
+			[]string{"default"},
+			`
+			fs default() {
+				assertEq "actual" "expected"
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithAssertNotEqual(
+					ast.Search(mod, `"actual"`),
+					ast.Search(mod, `"expected"`),
+					"actual", "expected",
+				)
+			},
+		},
+		{
+			"healthcheck without a command",
+			[]string{"default"},
+			`
+			fs default() {
+				scratch
+				imageConfig with option {
+					healthcheck "CMD"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidHealthcheck(
+					ast.Search(mod, `"CMD"`),
+					"CMD requires a command",
+				)
+			},
+		},
+		{
+			"selectPlatform without the target platform",
+			[]string{"default"},
+			`
+			fs default() {
+				selectPlatform with option {
+					when "linux/arm64" image("arm64v8/alpine")
+					when "linux/arm/v7" image("arm32v7/alpine")
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithUnmappedPlatform(
+					ast.Search(mod, "selectPlatform"),
+					"linux/amd64", []string{"linux/arm64", "linux/arm/v7"},
+				)
+			},
+		},
+		{
+			"capture from a cache mount",
+			[]string{"gocache"},
+			`
+			fs build() {
+				image "golang"
+				run "go build ./..." with option {
+					mount scratch "/root/.cache" with cache("go", "shared")
+					capture "/root/.cache/go-build" as gocache
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithCaptureNoOutput(
+					ast.Search(mod, `"/root/.cache/go-build"`),
+					"/root/.cache/go-build", "/root/.cache",
+				)
+			},
+		},
+		{
+			"format string that is not a literal",
+			[]string{"default"},
+			`
+			string layout() { "%d"; }
+
+			fs default() {
+				mkfile "tag" 0o644 format(layout, "v1")
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithInvalidFormat(
+					ast.Search(mod, "format"),
+					errors.New("%d cannot format string"),
+				)
+			},
+		},
+		{
+			"runtimeSpec publish on an exposed port",
+			[]string{"default"},
+			`
+			string default() {
+				runtimeSpec fs {
+					scratch
+					expose "80" "8080"
+				} "app" with option {
+					publish 8080 "80"
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithPublishExposedConflict(
+					ast.Search(mod, "8080", ast.WithSkip(1)),
+					"8080/tcp",
+				)
+			},
+		},
+		{
+			"runtimeSpec relative container path from expression",
+			[]string{"default"},
+			`
+			string default() {
+				runtimeSpec scratch "app" with option {
+					bind "./data" format("%s", "data")
+				}
+			}
+			`,
+			func(mod *ast.Module) error {
+				return errdefs.WithRelativeContainerPath(
+					ast.Search(mod, `format("%s", "data")`),
+					"data",
+				)
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(tc.input))
+			require.NoError(t, err, "unexpected parse error")
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			var targets []codegen.Target
+			for _, target := range tc.targets {
+				targets = append(targets, codegen.Target{Name: target})
+			}
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			_, err = cg.Generate(ctx, mod, targets)
+			var expected error
+			if tc.fn != nil {
+				expected = tc.fn(mod)
+			}
+			validateError(t, ctx, expected, err, tc.name)
+		})
+	}
+
+}
+
+// TestErrorCategories drives failures that are detected before a build is
+// solved, from parsing to generating its targets. Failures of solves are
+// covered by the tests of the solver.
+func TestErrorCategories(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		input    string
+		target   string
+		category errdefs.Category
+		fn       func(t *testing.T, mod *ast.Module, err error)
+	}
+
+	for _, tc := range []testCase{{
+		name: "bad syntax",
+		input: `
+		fs default() {
+			image "alpine"
+		`,
+		category: errdefs.SyntaxError,
+	}, {
+		name: "undefined identifier",
+		input: `
+		fs default() {
+			imag "alpine"
+		}
+		`,
+		category: errdefs.CheckError,
+	}, {
+		name: "undefined target",
+		input: `
+		fs default() {
+			image "alpine"
+		}
+		`,
+		target:   "release",
+		category: errdefs.UndefinedTarget,
+		fn: func(t *testing.T, mod *ast.Module, err error) {
+			var ute *errdefs.ErrUndefinedTarget
+			require.True(t, errors.As(err, &ute))
+			require.Equal(t, "release", ute.Target)
+		},
+	}, {
+		name: "failing localRun",
+		input: `
+		string default() {
+			localRun "sh" "-c" "exit 3"
+		}
+		`,
+		category: errdefs.ExecError,
+		fn: func(t *testing.T, mod *ast.Module, err error) {
+			var ee *errdefs.ErrExec
+			require.True(t, errors.As(err, &ee))
+			require.Equal(t, 3, ee.ExitCode)
+			require.Equal(t, ast.Search(mod, "localRun").Position(), ee.Pos)
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			if err == nil {
+				err = checker.SemanticPass(mod)
+			}
+			if err == nil {
+				err = checker.Check(mod)
+			}
+			if err == nil {
+				target := tc.target
+				if target == "" {
+					target = "default"
+				}
+				var request solver.Request
+				request, err = codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: target}})
+				if err == nil {
+					err = request.Solve(ctx, nil, nil)
+				}
+			}
+			require.Error(t, err)
+			require.Equal(t, tc.category, errdefs.Classify(err), "%s", err)
+			if tc.fn != nil {
+				tc.fn(t, mod, err)
+			}
+		})
+	}
+}
+
+type countingResolver struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (r *countingResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[ref]++
+	return digest.FromString(ref), []byte("{}"), nil
+}
+
+func TestCodeGenGitMetadata(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"checkout", "-q", "-b", "feature"},
+		{"-c", "user.name=hlb", "-c", "user.email=hlb@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+	localCommit := strings.TrimSpace(string(out))
+
+	type testCase struct {
+		name     string
+		input    string
+		expected string
+	}
+
+	for _, tc := range []testCase{{
+		"commit of git source pinned to a commit",
+		`
+		fs repo() {
+			git "https://github.com/openllb/hlb.git" "master" with option {
+				commit "0a44376e3b6f0e6a0c1c0d3c7b1b6bd1b3f1d2e4"
+			}
+		}
+
+		fs default() {
+			mkfile "meta" 0o644 gitCommit(repo)
+		}
+		`,
+		"0a44376e3b6f0e6a0c1c0d3c7b1b6bd1b3f1d2e4",
+	}, {
+		"branch of git source",
+		`
+		fs default() {
+			mkfile "meta" 0o644 gitBranch(git("https://github.com/openllb/hlb.git", "refs/heads/release"))
+		}
+		`,
+		"release",
+	}, {
+		"commit of local repository",
+		`
+		fs default() {
+			mkfile "meta" 0o644 gitCommit(local("."))
+		}
+		`,
+		localCommit,
+	}, {
+		"branch of local repository",
+		`
+		fs default() {
+			mkfile "meta" 0o644 gitBranch(local("."))
+		}
+		`,
+		"feature",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx, err := local.WithCwd(ctx, dir)
+			require.NoError(t, err)
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
+			mod.Directory = parser.NewLocalDirectory(dir, "")
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			require.NoError(t, err, tc.name)
+
+			expected := treeprint.New()
+			err = Expect(t, llb.Scratch().File(
+				llb.Mkfile("meta", 0o644, []byte(tc.expected)),
+			)).Tree(expected)
+			require.NoError(t, err, tc.name)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err, tc.name)
+			require.Equal(t, expected.String(), actual.String(), tc.name)
+		})
+	}
+}
+
+func TestCodeGenCopyFilters(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for filename, size := range map[string]int{
+		"small.txt":       16,
+		"large.bin":       2048,
+		"lib/libfoo.a":    16,
+		"lib/libbar.so":   4096,
+		"share/man/ls.1":  16,
+		"share/big[1].gz": 1025,
+	} {
+		path := filepath.Join(dir, filename)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(path, make([]byte, size), 0o644)
+		require.NoError(t, err)
+	}
+
+	type testCase struct {
+		name  string
+		input string
+		fn    func(ctx context.Context, t *testing.T) llb.State
+	}
+
+	for _, tc := range []testCase{{
+		"files larger than max size are skipped",
+		`
+		fs default() {
+			copy local(".") "/" "/out" with option {
+				maxSize 1024
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return llb.Scratch().File(llb.Copy(
+				LocalState(ctx, t, "."), "/", "/out",
+				llbutil.WithExcludePatterns([]string{"large.bin", "lib/libbar.so", `share/big\[1].gz`}),
+			))
+		},
+	}, {
+		"max size with excluded extensions",
+		`
+		fs default() {
+			copy local(".") "lib" "/usr/lib" with option {
+				excludeExtensions "a" ".la"
+				maxSize 1024
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return llb.Scratch().File(llb.Copy(
+				LocalState(ctx, t, "."), "lib", "/usr/lib",
+				llbutil.WithExcludePatterns([]string{"**/*.a", "**/*.la"}),
+				llbutil.WithExcludePatterns([]string{"libbar.so"}),
+			))
+		},
+	}, {
+		"file larger than max size is not copied",
+		`
+		fs default() {
+			mkdir "/out" 0o755
+			copy local(".") "large.bin" "/out/" with option {
+				maxSize 1024
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return llb.Scratch().File(llb.Mkdir("/out", 0o755))
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx, err := local.WithCwd(ctx, dir)
+			require.NoError(t, err)
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
+			mod.Directory = parser.NewLocalDirectory(dir, "")
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			require.NoError(t, err, tc.name)
+
+			expected := treeprint.New()
+			err = Expect(t, tc.fn(ctx, t)).Tree(expected)
+			require.NoError(t, err, tc.name)
+			t.Logf("expected: %s", expected)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err, tc.name)
+			t.Logf("actual: %s", actual)
+
+			require.Equal(t, expected.String(), actual.String(), tc.name)
+		})
+	}
+}
+
+func TestCodeGenLocalIgnoreFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for filename, content := range map[string]string{
+		".dockerignore":     "# build outputs\n/build\n*.log\n!keep.log\n\n.dockerignore\n*.hlb\n",
+		"custom.ignore":     "vendor/\n",
+		"sub/.hlbignore":    "node_modules\n",
+		"sub/.dockerignore": "dist\n",
+		"empty/main.go":     "",
+		"bad.ignore":        "*.log\n!\n",
+	} {
+		path := filepath.Join(dir, filename)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(path, []byte(content), 0o644)
+		require.NoError(t, err)
+	}
+
+	generate := func(ctx context.Context, t *testing.T, input string) (*ast.Module, solver.Request, error) {
+		mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+		require.NoError(t, err)
+		mod.Directory = parser.NewLocalDirectory(dir, "")
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		cg := codegen.New(nil, nil)
+		request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+		return mod, request, err
+	}
+
+	newContext := func(t *testing.T) context.Context {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx, err := local.WithCwd(ctx, dir)
+		require.NoError(t, err)
+		return codegen.WithSessionID(ctx, identity.NewID())
+	}
+
+	type testCase struct {
+		name  string
+		input string
+		fn    func(ctx context.Context, t *testing.T) llb.State
+	}
+
+	for _, tc := range []testCase{{
+		"default ignore file",
+		`
+		fs default() {
+			local "." with option {
+				useIgnoreFile
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{"build", "*.log", "!keep.log", ".dockerignore", "*.hlb"}),
+			)
+		},
+	}, {
+		"explicit exclude patterns come last",
+		`
+		fs default() {
+			local "." with option {
+				excludePatterns "keep.log"
+				ignoreFile "custom.ignore"
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{"vendor", "keep.log"}),
+			)
+		},
+	}, {
+		"hlbignore takes precedence",
+		`
+		fs default() {
+			local "sub" with option {
+				useIgnoreFile
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, "sub",
+				llbutil.WithExcludePatterns([]string{"node_modules"}),
+			)
+		},
+	}, {
+		"missing default ignore file",
+		`
+		fs default() {
+			local "empty" with option {
+				useIgnoreFile
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, "empty")
+		},
+	}, {
+		"ignore file of a local file",
+		`
+		fs default() {
+			local "custom.ignore" with option {
+				ignoreFile "does-not-exist.ignore"
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, "custom.ignore",
+				llb.IncludePatterns([]string{"custom.ignore"}),
+			)
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newContext(t)
+			_, request, err := generate(ctx, t, tc.input)
+			require.NoError(t, err)
+
+			expected := treeprint.New()
+			err = Expect(t, tc.fn(ctx, t)).Tree(expected)
+			require.NoError(t, err)
+			t.Logf("expected: %s", expected)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err)
+			t.Logf("actual: %s", actual)
+
+			require.Equal(t, expected.String(), actual.String())
+		})
+	}
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		ctx := newContext(t)
+		mod, _, err := generate(ctx, t, `
+		fs default() {
+			local "." with option {
+				ignoreFile "bad.ignore"
+			}
+		}
+		`)
+		validateError(t, ctx, errdefs.WithInvalidPattern(
+			ast.Search(mod, `"bad.ignore"`),
+			"!",
+			errors.New("illegal exclusion pattern: \"!\""),
+		), err, "invalid pattern")
+	})
+
+	t.Run("changes to the ignore file change the source", func(t *testing.T) {
+		dir := filepath.Join(dir, "changed")
+		err := os.MkdirAll(dir, 0o755)
+		require.NoError(t, err)
+
+		input := `
+		fs default() {
+			local "changed" with option {
+				useIgnoreFile
+			}
+		}
+		`
+		ctx := newContext(t)
+		digestOf := func() digest.Digest {
+			_, request, err := generate(ctx, t, input)
+			require.NoError(t, err)
+
+			tree := treeprint.New()
+			err = request.Tree(tree)
+			require.NoError(t, err)
+			return digest.FromString(tree.String())
+		}
+
+		err = os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0o644)
+		require.NoError(t, err)
+		before := digestOf()
+		require.Equal(t, before, digestOf())
+
+		err = os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n!keep.log\n"), 0o644)
+		require.NoError(t, err)
+		require.NotEqual(t, before, digestOf())
+	})
+}
+
+func TestCodeGenModuleIgnoreFile(t *testing.T) {
+	t.Parallel()
+
+	newDir := func(t *testing.T, files map[string]string) string {
+		dir := t.TempDir()
+		for filename, content := range files {
+			path := filepath.Join(dir, filename)
+			err := os.MkdirAll(filepath.Dir(path), 0o755)
+			require.NoError(t, err)
+			err = os.WriteFile(path, []byte(content), 0o644)
+			require.NoError(t, err)
+		}
+		return dir
+	}
+
+	dir := newDir(t, map[string]string{
+		".hlbignore":            "*.log\n!keep.log\napp/node_modules\n**/tmp\nprivate/\n",
+		"app/main.go":           "",
+		"app/node_modules/a.js": "",
+		"private/lib.hlb":       "export default\n\nfs default() { scratch; }\n",
+		"public/lib.hlb":        "export default\n\nfs default() { scratch; }\n",
+	})
+
+	generate := func(ctx context.Context, t *testing.T, dir, input string) (*ast.Module, solver.Request, error) {
+		mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+		require.NoError(t, err)
+		mod.Directory = parser.NewLocalDirectory(dir, "")
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		cg := codegen.New(nil, nil)
+		request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+		return mod, request, err
+	}
+
+	newContext := func(t *testing.T, dir string) context.Context {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx, err := local.WithCwd(ctx, dir)
+		require.NoError(t, err)
+		return codegen.WithSessionID(ctx, identity.NewID())
+	}
+
+	type testCase struct {
+		name  string
+		input string
+		fn    func(ctx context.Context, t *testing.T) llb.State
+	}
+
+	for _, tc := range []testCase{{
+		"local without options",
+		`
+		fs default() {
+			local "."
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{"*.log", "!keep.log", "app/node_modules", "**/tmp", "private"}),
+			)
+		},
+	}, {
+		"local of a subdirectory",
+		`
+		fs default() {
+			local "app"
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, "app",
+				llbutil.WithExcludePatterns([]string{"node_modules", "**/tmp"}),
+			)
+		},
+	}, {
+		"explicit exclude patterns come last",
+		`
+		fs default() {
+			local "." with option {
+				excludePatterns "keep.log"
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{"*.log", "!keep.log", "app/node_modules", "**/tmp", "private", "keep.log"}),
+			)
+		},
+	}, {
+		"local of a file",
+		`
+		fs default() {
+			local "app/main.go"
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, "app/main.go",
+				llb.IncludePatterns([]string{"main.go"}),
+			)
+		},
+	}, {
+		"import of a path that is not ignored",
+		`
+		import lib from "public/lib.hlb"
+
+		fs default() {
+			lib.default
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return llb.Scratch()
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newContext(t, dir)
+			_, request, err := generate(ctx, t, dir, tc.input)
+			require.NoError(t, err)
+
+			expected := treeprint.New()
+			err = Expect(t, tc.fn(ctx, t)).Tree(expected)
+			require.NoError(t, err)
+			t.Logf("expected: %s", expected)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err)
+			t.Logf("actual: %s", actual)
+
+			require.Equal(t, expected.String(), actual.String())
+		})
+	}
+
+	t.Run("import of an ignored path", func(t *testing.T) {
+		ctx := newContext(t, dir)
+		mod, _, err := generate(ctx, t, dir, `
+		import lib from "private/lib.hlb"
+
+		fs default() {
+			lib.default
+		}
+		`)
+		validateError(t, ctx, errdefs.WithImportPathIgnored(
+			ast.Search(mod, `"private/lib.hlb"`),
+			"private/lib.hlb",
+			".hlbignore",
+		), err, "import of an ignored path")
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		dir := newDir(t, map[string]string{
+			".hlbignore": "*.log\n!\n",
+		})
+		ctx := newContext(t, dir)
+		_, _, err := generate(ctx, t, dir, `
+		fs default() {
+			local "."
+		}
+		`)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `invalid pattern "!" in .hlbignore`)
+	})
+}
+
+func TestCodeGenLocalGit(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for filename, content := range map[string]string{
+		".gitignore":            "*.log\n",
+		"README.md":             "",
+		"node_modules/dep/a.js": "",
+		"src/main.go":           "",
+		"src/debug.log":         "",
+		"src/untracked.go":      "",
+	} {
+		path := filepath.Join(dir, filename)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(path, []byte(content), 0o644)
+		require.NoError(t, err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", ".gitignore", "README.md", "src/main.go"},
+		{"-c", "user.name=hlb", "-c", "user.email=hlb@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	// Modified files are synced as they are in the worktree without being
+	// staged.
+	err := os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main"), 0o644)
+	require.NoError(t, err)
+
+	generate := func(ctx context.Context, t *testing.T, input string) (*ast.Module, solver.Request, error) {
+		mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+		require.NoError(t, err)
+		mod.Directory = parser.NewLocalDirectory(dir, "")
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		cg := codegen.New(nil, nil)
+		request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+		return mod, request, err
+	}
+
+	newContext := func(t *testing.T, cwd string) context.Context {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx, err := local.WithCwd(ctx, cwd)
+		require.NoError(t, err)
+		return codegen.WithSessionID(ctx, identity.NewID())
+	}
+
+	type testCase struct {
+		name  string
+		input string
+		fn    func(ctx context.Context, t *testing.T) llb.State
+	}
+
+	for _, tc := range []testCase{{
+		"tracked files",
+		`
+		fs default() {
+			localGit "."
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{".git", "node_modules", "src/debug.log", "src/untracked.go"}),
+			)
+		},
+	}, {
+		"root of the repository of a path",
+		`
+		fs default() {
+			localGit "src/main.go"
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{".git", "node_modules", "src/debug.log", "src/untracked.go"}),
+			)
+		},
+	}, {
+		"untracked files that are not ignored",
+		`
+		fs default() {
+			localGit "." with option {
+				includeUntracked
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.WithExcludePatterns([]string{".git", "src/debug.log"}),
+			)
+		},
+	}, {
+		"subdir",
+		`
+		fs default() {
+			localGit "." with option {
+				subdir "src"
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, "src",
+				llbutil.WithExcludePatterns([]string{"debug.log", "untracked.go"}),
+			)
+		},
+	}, {
+		"subdir relative to the repository",
+		`
+		fs default() {
+			localGit "." with option {
+				subdir "src"
+				repoRelative
+			}
+		}
+		`,
+		func(ctx context.Context, t *testing.T) llb.State {
+			return LocalState(ctx, t, ".",
+				llbutil.IncludePatterns([]string{"src"}),
+				llbutil.WithExcludePatterns([]string{"src/debug.log", "src/untracked.go"}),
+			)
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := newContext(t, dir)
+			_, request, err := generate(ctx, t, tc.input)
+			require.NoError(t, err)
+
+			expected := treeprint.New()
+			err = Expect(t, tc.fn(ctx, t)).Tree(expected)
+			require.NoError(t, err)
+			t.Logf("expected: %s", expected)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err)
+			t.Logf("actual: %s", actual)
+
+			require.Equal(t, expected.String(), actual.String())
+		})
+	}
+
+	t.Run("not a repository", func(t *testing.T) {
+		ctx := newContext(t, t.TempDir())
+		mod, _, err := generate(ctx, t, `
+		fs default() {
+			localGit "."
+		}
+		`)
+		validateError(t, ctx, errdefs.WithNotRepository(
+			ast.Search(mod, `"."`),
+			".",
+		), err, "not a repository")
+	})
+
+	t.Run("subdir outside the repository", func(t *testing.T) {
+		ctx := newContext(t, dir)
+		mod, _, err := generate(ctx, t, `
+		fs default() {
+			localGit "." with option {
+				subdir "../src"
+			}
+		}
+		`)
+		validateError(t, ctx, errdefs.WithInvalidSubdir(
+			ast.Search(mod, `"../src"`),
+			"../src",
+			"must be relative to the root of the repository",
+		), err, "subdir outside the repository")
+	})
+}
+
+func TestCodeGenLocalManifest(t *testing.T) {
+	t.Parallel()
+
+	// setup writes a local directory and its manifest, which does not record
+	// the build outputs.
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		for filename, content := range map[string]string{
+			"src/a.txt":           "a",
+			"src/sub/b.txt":       "b",
+			"src/build/out.log":   "out",
+			"src/empty/.keep.txt": "",
+		} {
+			path := filepath.Join(dir, filename)
+			err := os.MkdirAll(filepath.Dir(path), 0o755)
+			require.NoError(t, err)
+			err = os.WriteFile(path, []byte(content), 0o644)
+			require.NoError(t, err)
+		}
+		err := os.Symlink("a.txt", filepath.Join(dir, "src", "link"))
+		require.NoError(t, err)
+
+		var manifest bytes.Buffer
+		err = codegen.WriteLocalManifest(filepath.Join(dir, "src"), &manifest, "build")
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(dir, "src.manifest"), manifest.Bytes(), 0o644)
+		require.NoError(t, err)
+		return dir
+	}
+
+	// generate returns the manifest the files of the default target are
+	// verified against in the build.
+	generate := func(t *testing.T, dir, input string) (context.Context, *ast.Module, string, error) {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx, err := local.WithCwd(ctx, dir)
+		require.NoError(t, err)
+		ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+		mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+		require.NoError(t, err)
+		mod.Directory = parser.NewLocalDirectory(dir, "")
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		v, err := codegen.New(nil, nil).EmitTarget(ctx, mod, codegen.Target{Name: "default"})
+		if err != nil {
+			return ctx, mod, "", err
+		}
+		fs, err := v.Filesystem()
+		if err != nil {
+			return ctx, mod, "", err
+		}
+
+		def, err := fs.State.Marshal(ctx, llb.LinuxAmd64)
+		require.NoError(t, err)
+
+		var (
+			manifest string
+			verified bool
+		)
+		for _, dt := range def.Def {
+			var op pb.Op
+			require.NoError(t, op.Unmarshal(dt))
+			if exec := op.GetExec(); exec != nil && len(exec.Meta.Args) > 2 && exec.Meta.Args[2] == codegen.VerifyManifestScript {
+				verified = true
+			}
+			if file := op.GetFile(); file != nil {
+				for _, action := range file.Actions {
+					if mkfile := action.GetMkfile(); mkfile != nil && mkfile.Path == "/manifest" {
+						manifest = string(mkfile.Data)
+					}
+				}
+			}
+		}
+		require.True(t, verified)
+		return ctx, mod, manifest, nil
+	}
+
+	const excluded = `
+	fs default() {
+		local "src" with option {
+			excludePatterns "build"
+			verifyManifest "src.manifest"
+		}
+	}
+	`
+
+	t.Run("manifest entries", func(t *testing.T) {
+		dir := setup(t)
+		f, err := os.Open(filepath.Join(dir, "src.manifest"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		entries, err := codegen.ReadLocalManifest(f)
+		require.NoError(t, err)
+
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		require.Equal(t, []string{"a.txt", "empty/.keep.txt", "link", "sub/b.txt"}, paths)
+		require.Equal(t, digest.FromString("a"), entries[0].Digest)
+		require.Equal(t, digest.FromString("a.txt"), entries[2].Digest)
+
+		dt, err := os.ReadFile(filepath.Join(dir, "src.manifest"))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("a.txt 1 %s\n", digest.FromString("a")), strings.SplitAfter(string(dt), "\n")[0])
+	})
+
+	t.Run("synced files are verified in the build", func(t *testing.T) {
+		dir := setup(t)
+		_, _, manifest, err := generate(t, dir, excluded)
+		require.NoError(t, err)
+		require.Equal(t, strings.Join([]string{
+			fmt.Sprintf("1 a.txt 1 %s", digest.FromString("a")),
+			fmt.Sprintf("2 empty/.keep.txt 0 %s", digest.FromString("")),
+			fmt.Sprintf("3 link 5 %s", digest.FromString("a.txt")),
+			fmt.Sprintf("4 sub/b.txt 1 %s", digest.FromString("b")),
+			"",
+		}, "\n"), manifest)
+	})
+
+	t.Run("excluded files", func(t *testing.T) {
+		dir := setup(t)
+
+		// Files excluded from the sync are not required by the manifest.
+		_, _, manifest, err := generate(t, dir, `
+		fs default() {
+			local "src" with option {
+				excludePatterns "build" "sub"
+				verifyManifest "src.manifest"
+			}
+		}
+		`)
+		require.NoError(t, err)
+		require.NotContains(t, manifest, "sub/b.txt")
+		require.Contains(t, manifest, "a.txt")
+
+		_, _, manifest, err = generate(t, dir, `
+		fs default() {
+			local "src" with option {
+				includePatterns "sub"
+				verifyManifest "src.manifest"
+			}
+		}
+		`)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("4 sub/b.txt 1 %s\n", digest.FromString("b")), manifest)
+	})
+
+	t.Run("missing manifest", func(t *testing.T) {
+		dir := setup(t)
+		ctx, mod, _, err := generate(t, dir, `
+		fs default() {
+			local "src" with option {
+				verifyManifest "does-not-exist.manifest"
+			}
+		}
+		`)
+		_, openErr := os.Open(filepath.Join(dir, "does-not-exist.manifest"))
+		validateError(t, ctx, errdefs.WithManifestNotExist(
+			openErr,
+			ast.Search(mod, `"does-not-exist.manifest"`),
+			"does-not-exist.manifest",
+		), err, "missing manifest")
+	})
+}
+
+func TestCodeGenLargeFileThreshold(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "src", "small.txt"), []byte("small"), 0o644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "src", "weights.bin"), []byte("weights"), 0o644)
+	require.NoError(t, err)
+	mtime := time.Unix(1600000000, 123456789)
+	err = os.Chtimes(filepath.Join(dir, "src", "weights.bin"), mtime, mtime)
+	require.NoError(t, err)
+
+	emit := func(t *testing.T, input string) (context.Context, *ast.Module, codegen.Filesystem, error) {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx, err := local.WithCwd(ctx, dir)
+		require.NoError(t, err)
+		ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+		mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+		require.NoError(t, err)
+		mod.Directory = parser.NewLocalDirectory(dir, "")
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		v, err := codegen.New(nil, nil).EmitTarget(ctx, mod, codegen.Target{Name: "default"})
+		if err != nil {
+			return ctx, mod, codegen.Filesystem{}, err
+		}
+		fs, err := v.Filesystem()
+		return ctx, mod, fs, err
+	}
+
+	largeFiles := func(t *testing.T, fs codegen.Filesystem) []*solver.LargeFiles {
+		info := &solver.SolveInfo{}
+		for _, opt := range fs.SolveOpts {
+			require.NoError(t, opt(info))
+		}
+		return info.LargeFiles
+	}
+
+	t.Run("threshold", func(t *testing.T) {
+		ctx, _, fs, err := emit(t, `
+		fs default() {
+			local "src" with option {
+				largeFileThreshold 6
+			}
+		}
+		`)
+		require.NoError(t, err)
+		require.Len(t, largeFiles(t, fs), 1)
+
+		// The build checks the digests of the large files and restores their
+		// modification times on the host.
+		def, err := fs.State.Marshal(ctx, llb.LinuxAmd64)
+		require.NoError(t, err)
+
+		var (
+			sums   string
+			copies []*pb.FileActionCopy
+		)
+		for _, dt := range def.Def {
+			var op pb.Op
+			require.NoError(t, op.Unmarshal(dt))
+			if file := op.GetFile(); file != nil {
+				for _, action := range file.Actions {
+					if mkfile := action.GetMkfile(); mkfile != nil && mkfile.Path == "/sha256sums" {
+						sums = string(mkfile.Data)
+					}
+					if cp := action.GetCopy(); cp != nil {
+						copies = append(copies, cp)
+					}
+				}
+			}
+		}
+		require.Equal(t, digest.FromString("weights").Encoded()+"  weights.bin\n", sums)
+		require.Len(t, copies, 1)
+		require.Equal(t, "/weights.bin", copies[0].Src)
+		require.Equal(t, "/weights.bin", copies[0].Dest)
+		require.Equal(t, mtime.UnixNano(), copies[0].Timestamp)
+
+		// Without a threshold, the local source is transferred as usual.
+		_, _, fs, err = emit(t, `
+		fs default() {
+			local "src"
+		}
+		`)
+		require.NoError(t, err)
+		require.Empty(t, largeFiles(t, fs))
+	})
+
+	t.Run("invalid threshold", func(t *testing.T) {
+		ctx, mod, _, err := emit(t, `
+		fs default() {
+			local "src" with option {
+				largeFileThreshold 0
+			}
+		}
+		`)
+		validateError(t, ctx, errdefs.WithInvalidLargeFileThreshold(
+			ast.Search(mod, `0`),
+			0,
+		), err, "invalid threshold")
+	})
+}
+
+func TestGenerateResult(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs app() binds (fs out) {
+		image "alpine"
+		run "make" with option {
+			mount scratch "/out" as out
+		}
+	}
+
+	string version() {
+		"1.0"
+	}
+
+	pipeline all() {
+		stage app
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	result, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{
+		{Name: "version", Output: io.Discard},
+		{Name: "app"},
+		{Name: "all"},
+	})
+	require.NoError(t, err)
+
+	// Targets are described in the order they were given.
+	var kinds []ast.Kind
+	for _, target := range result.Targets {
+		kinds = append(kinds, target.Kind)
+	}
+	require.Equal(t, []ast.Kind{ast.String, ast.Filesystem, ast.Pipeline}, kinds)
+
+	app, ok := result.Target("app")
+	require.True(t, ok)
+	require.Len(t, app.Effects, 1)
+	require.Equal(t, "out", app.Effects[0].Name.Text)
+	require.Equal(t, ast.Filesystem, app.Effects[0].Kind())
+
+	version, ok := result.Target("version")
+	require.True(t, ok)
+	require.Empty(t, version.Effects)
+
+	_, ok = result.Target("missing")
+	require.False(t, ok)
+}
+
+func TestGenerateAll(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"lib.hlb": `
+		export base
+
+		string name() {
+			"lib"
+		}
+
+		fs base() {
+			image "acme/base:1.2"
+			mkfile "lib" 0o644 name
+		}
+		`,
+		"a.hlb": `
+		import lib from "./lib.hlb"
+
+		string name() {
+			"a"
+		}
+
+		fs default() {
+			lib.base
+			mkfile "name" 0o644 name
+		}
+		`,
+		"b.hlb": `
+		import lib from "./lib.hlb"
+
+		string name() {
+			"b"
+		}
+
+		fs default() {
+			lib.base
+			mkfile "name" 0o644 name
+		}
+		`,
+	}
+	for filename, content := range files {
+		err := os.WriteFile(filepath.Join(dir, filename), []byte(dedent.Dedent(content)), 0o644)
+		require.NoError(t, err)
+	}
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	var specs []codegen.ModuleTargets
+	for _, filename := range []string{"a.hlb", "b.hlb"} {
+		mod := parseModuleFile(ctx, t, dir, filename)
+		specs = append(specs, codegen.ModuleTargets{
+			Module:  mod,
+			Targets: []codegen.Target{{Name: "default"}},
+		})
+	}
+
+	resolver := &countingResolver{calls: make(map[string]int)}
+	ctx = codegen.WithImageResolver(ctx, resolver)
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	request, err := codegen.GenerateAll(ctx, nil, nil, specs)
+	require.NoError(t, err)
+
+	tree := treeprint.New()
+	err = request.Tree(tree)
+	require.NoError(t, err)
+	t.Logf("actual: %s", tree)
+
+	// Each module is named after its module and target, and each keeps its
+	// own scope despite importing the same library.
+	actual := tree.String()
+	require.Contains(t, actual, "[named]  a.hlb:default")
+	require.Contains(t, actual, "[named]  b.hlb:default")
+	for _, content := range []string{"lib", "a", "b"} {
+		require.Contains(t, actual, fmt.Sprintf(`data:"%s"`, content))
+	}
+
+	// The library is parsed and checked once, and its image resolved once.
+	libA := specs[0].Module.Scope.Lookup("lib").Data
+	libB := specs[1].Module.Scope.Lookup("lib").Data
+	require.NotNil(t, libA)
+	require.Same(t, libA, libB)
+	require.Equal(t, map[string]int{"docker.io/acme/base:1.2": 1}, resolver.calls)
+}
+
+func TestCodeGenMemoImportsWithSameFilename(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"a/module.hlb": `
+		export base
+
+		fs base() {
+			image "acme/a"
+		}
+		`,
+		"b/module.hlb": `
+		export base
+
+		fs base() {
+			image "acme/b"
+		}
+		`,
+		"build.hlb": `
+		import a from fs {
+			local "a"
+		}
+		import b from fs {
+			local "b"
+		}
+
+		fs default() {
+			a.base
+		}
+
+		fs other() {
+			b.base
+		}
+		`,
+	}
+	for filename, content := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, filename)), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(filepath.Join(dir, filename), []byte(dedent.Dedent(content)), 0o644)
+		require.NoError(t, err)
+	}
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx, err := local.WithCwd(ctx, dir)
+	require.NoError(t, err)
+	mod := parseModuleFile(ctx, t, dir, "build.hlb")
+
+	resolver := &countingResolver{calls: make(map[string]int)}
+	ctx = codegen.WithImageResolver(ctx, resolver)
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	// The functions of both imports are declared at the same position of a
+	// module.hlb, but each is memoized separately.
+	cg := codegen.New(nil, &importNameResolver{dirs: map[string]ast.Directory{
+		"a": &unrootedDirectory{parser.NewLocalDirectory(filepath.Join(dir, "a"), "")},
+		"b": &unrootedDirectory{parser.NewLocalDirectory(filepath.Join(dir, "b"), "")},
+	}})
+	_, err = cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}, {Name: "other"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"docker.io/acme/a:latest": 1,
+		"docker.io/acme/b:latest": 1,
+	}, resolver.calls)
+}
+
+// openCounter counts the times a module directory's module file is opened,
+// which is once for each time the module is parsed.
+type openCounter struct {
+	ast.Directory
+	mu    sync.Mutex
+	opens int
+}
+
+func (d *openCounter) Open(filename string) (io.ReadCloser, error) {
+	if filepath.Base(filename) == codegen.ModuleFilename {
+		d.mu.Lock()
+		d.opens++
+		d.mu.Unlock()
+	}
+	return d.Directory.Open(filename)
+}
+
+func (d *openCounter) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.opens
+}
+
+// importNameResolver resolves imports to directories by the name they are
+// imported as.
+type importNameResolver struct {
+	dirs map[string]ast.Directory
+}
+
+func (r *importNameResolver) Resolve(ctx context.Context, id *ast.ImportDecl, fs codegen.Filesystem) (ast.Directory, error) {
+	return r.dirs[id.Name.Text], nil
+}
+
+// unrootedDirectory names the files it opens without its path, like remote
+// directories of filesystem imports rooted at the root of the filesystem.
+type unrootedDirectory struct {
+	ast.Directory
+}
+
+func (d *unrootedDirectory) Open(filename string) (io.ReadCloser, error) {
+	rc, err := d.Directory.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	dt, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &parser.NamedReader{Reader: bytes.NewReader(dt), Value: filename}, nil
+}
+
+type directoryResolver struct {
+	dir ast.Directory
+}
+
+func (r *directoryResolver) Resolve(ctx context.Context, id *ast.ImportDecl, fs codegen.Filesystem) (ast.Directory, error) {
+	return r.dir, nil
+}
+
+func TestModuleCache(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		codegen.ModuleFilename: `
+		import util "./util.hlb"
+
+		export build
+
+		fs build() {
+			util.base
+			mkfile "lib" 0o644 "lib"
+		}
+		`,
+		"util.hlb": `
+		export base
+
+		fs base() {
+			mkfile "util" 0o644 "v1"
+		}
+		`,
+	}
+	for filename, content := range files {
+		err := os.WriteFile(filepath.Join(dir, filename), []byte(dedent.Dedent(content)), 0o644)
+		require.NoError(t, err)
+	}
+
+	// The import is pinned, so its content is identified by its digest.
+	lib := &openCounter{
+		Directory: parser.NewLocalDirectory(dir+string(filepath.Separator), digest.FromString("lib")),
+	}
+	resolver := &directoryResolver{dir: lib}
+
+	generate := func(opts ...codegen.CodeGenOption) (*ast.Module, string, string) {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+		mod, err := parser.Parse(ctx, strings.NewReader(cleanup(`
+		import lib from fs {
+			scratch
+		}
+
+		fs default() {
+			lib.build
+		}
+		`)))
+		require.NoError(t, err)
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		var diagnostics bytes.Buffer
+		opts = append(opts, codegen.WithLintMode(codegen.LintWarn), codegen.WithDiagnosticWriter(&diagnostics))
+		request, err := codegen.New(nil, resolver, opts...).Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+		require.NoError(t, err)
+
+		tree := treeprint.New()
+		err = request.Tree(tree)
+		require.NoError(t, err)
+
+		imod, ok := mod.Scope.Lookup("lib").Data.(*ast.Module)
+		require.True(t, ok)
+		return imod, tree.String(), diagnostics.String()
+	}
+
+	modules := codegen.NewModuleCache()
+	first, tree, diagnostics := generate(codegen.WithModuleCache(modules))
+	require.Equal(t, 1, lib.count())
+	require.Contains(t, tree, `data:"v1"`)
+	require.Contains(t, diagnostics, "deprecated")
+
+	// Nested file imports aren't pinned, so they are keyed by their content
+	// and edits to them are picked up by the next build.
+	err := os.WriteFile(filepath.Join(dir, "util.hlb"), []byte(dedent.Dedent(`
+	export base
+
+	fs base() {
+		mkfile "util" 0o644 "v2"
+	}
+	`)), 0o644)
+	require.NoError(t, err)
+
+	// The pinned import is parsed once and reused, but its lint findings are
+	// still reported to every build.
+	second, tree, diagnostics := generate(codegen.WithModuleCache(modules))
+	require.Equal(t, 1, lib.count())
+	require.Same(t, first, second)
+	require.Contains(t, tree, `data:"v2"`)
+	require.Contains(t, diagnostics, "deprecated")
+
+	// Without a shared cache, each build parses its own imports.
+	third, _, _ := generate()
+	require.Equal(t, 2, lib.count())
+	require.NotSame(t, first, third)
+}
+
+func BenchmarkGenerateAll(b *testing.B) {
+	const numModules = 40
+
+	dir := b.TempDir()
+	libs := []string{"golang", "node"}
+	for _, lib := range libs {
+		content := fmt.Sprintf(`
+		export base
+
+		fs base() {
+			image "acme/%s:1.0"
+			run "make" with option {
+				dir "/src"
+				env "LIB" "%s"
+			}
+		}
+		`, lib, lib)
+		err := os.WriteFile(filepath.Join(dir, lib+".hlb"), []byte(dedent.Dedent(content)), 0o644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var filenames []string
+	for i := 0; i < numModules; i++ {
+		filename := fmt.Sprintf("service%d.hlb", i)
+		content := fmt.Sprintf(`
+		import golang from "./golang.hlb"
+		import node from "./node.hlb"
+
+		fs default() {
+			golang.base
+			copy node.base "/dist" "/dist"
+			mkfile "service" 0o644 "%d"
+		}
+		`, i)
+		err := os.WriteFile(filepath.Join(dir, filename), []byte(dedent.Dedent(content)), 0o644)
+		if err != nil {
+			b.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		var specs []codegen.ModuleTargets
+		for _, filename := range filenames {
+			specs = append(specs, codegen.ModuleTargets{
+				Module:  parseModuleFile(ctx, b, dir, filename),
+				Targets: []codegen.Target{{Name: "default"}},
+			})
+		}
+		ctx := codegen.WithImageResolver(ctx, &countingResolver{calls: make(map[string]int)})
+		b.StartTimer()
+
+		_, err := codegen.GenerateAll(ctx, nil, nil, specs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func parseModuleFile(ctx context.Context, t testing.TB, dir, filename string) *ast.Module {
+	f, err := os.Open(filepath.Join(dir, filename))
+	require.NoError(t, err)
+	defer f.Close()
+
+	mod, err := parser.Parse(ctx, &parser.NamedReader{Reader: f, Value: filename})
+	require.NoError(t, err)
+	mod.Directory = parser.NewLocalDirectory(dir, "")
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+	return mod
+}
+
+type configResolver struct {
+	config []byte
+}
+
+func (r *configResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	return digest.FromString(ref), r.config, nil
+}
+
+func TestCodeGenExpose(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs nginx() {
+		image "nginx"
+	}
+
+	fs base() {
+		nginx
+		dockerPush "acme/base"
+	}
+
+	fs web() {
+		nginx
+		expose "8080" "80" "9000-9002/udp"
+		dockerPush "acme/web"
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	ctx = codegen.WithImageResolver(ctx, &configResolver{
+		config: []byte(`{"config":{"ExposedPorts":{"80/tcp":{}}}}`),
+	})
+
+	// Pushing with the docker engine keeps the image config in the request.
+	ctx = codegen.WithDockerAPI(ctx, nil, nil, nil, true)
+
+	var diagnostics bytes.Buffer
+	cg := codegen.New(nil, nil,
+		codegen.WithLintMode(codegen.LintWarn),
+		codegen.WithDiagnosticWriter(&diagnostics),
+	)
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	for _, tc := range []struct {
+		target   string
+		expected string
+		warning  string
+	}{{
+		"base",
+		`"ExposedPorts":{"80/tcp":{}}`,
+		"",
+	}, {
+		"web",
+		`"ExposedPorts":{"80/tcp":{},"8080/tcp":{},"9000/udp":{},"9001/udp":{},"9002/udp":{}}`,
+		"port `80/tcp` is already exposed by the base image",
+	}} {
+		diagnostics.Reset()
+		request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: tc.target}})
+		require.NoError(t, err, tc.target)
+
+		tree := treeprint.New()
+		err = request.Tree(tree)
+		require.NoError(t, err, tc.target)
+		require.Contains(t, tree.String(), tc.expected, tc.target)
+
+		// Ports of the base image exposed again are warned about with the
+		// image that exposes them.
+		if tc.warning == "" {
+			require.NotContains(t, diagnostics.String(), "exposed by the base image", tc.target)
+			continue
+		}
+		require.Contains(t, diagnostics.String(), tc.warning, tc.target)
+		require.Contains(t, diagnostics.String(), "base image exposes `80/tcp`", tc.target)
+		require.Equal(t, 1, strings.Count(diagnostics.String(), tc.warning), tc.target)
+	}
+}
+
+func TestCodeGenImageConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs nginx() {
+		image "nginx"
+	}
+
+	fs base() {
+		nginx
+		dockerPush "acme/base"
+	}
+
+	fs web() {
+		nginx
+		imageConfig with option {
+			removeLabel "maintainer"
+			label "version" "1.0"
+			user "app"
+			workdir "srv"
+			exposed "8080"
+			healthcheck "CMD" "curl" "-f" "http://localhost" with option {
+				interval "30s"
+				retries 3
+			}
+		}
+		label "release" "stable"
+		user "root"
+		dockerPush "acme/web"
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	ctx = codegen.WithImageResolver(ctx, &configResolver{
+		config: []byte(`{"config":{"User":"nginx","Cmd":["nginx"],"WorkingDir":"/usr","Labels":{"keep":"yes","maintainer":"nginx"},"StopSignal":"SIGQUIT"}}`),
+	})
+
+	// Pushing with the docker engine keeps the image config in the request.
+	ctx = codegen.WithDockerAPI(ctx, nil, nil, nil, true)
+
+	cg := codegen.New(nil, nil)
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	for _, tc := range []struct {
+		target   string
+		expected []string
+		absent   []string
+	}{{
+		"base",
+		[]string{`"User":"nginx"`, `"Labels":{"keep":"yes","maintainer":"nginx"}`},
+		[]string{`"Healthcheck"`},
+	}, {
+		"web",
+		[]string{
+			// Later calls override the block in statement order.
+			`"User":"root"`,
+			`"WorkingDir":"/usr/srv"`,
+			`"ExposedPorts":{"8080/tcp":{}}`,
+			`"Labels":{"keep":"yes","release":"stable","version":"1.0"}`,
+			// Fields that are not set are kept from the base image.
+			`"Cmd":["nginx"]`,
+			`"StopSignal":"SIGQUIT"`,
+			`"Healthcheck":{"Test":["CMD","curl","-f","http://localhost"],"Interval":30000000000,"Retries":3}`,
+		},
+		[]string{`maintainer`},
+	}} {
+		request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: tc.target}})
+		require.NoError(t, err, tc.target)
+
+		tree := treeprint.New()
+		err = request.Tree(tree)
+		require.NoError(t, err, tc.target)
+		for _, expected := range tc.expected {
+			require.Contains(t, tree.String(), expected, tc.target)
+		}
+		for _, absent := range tc.absent {
+			require.NotContains(t, tree.String(), absent, tc.target)
+		}
+	}
+}
+
+func TestCodeGenImageConfigDiff(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs nginx() {
+		image "nginx"
+	}
+
+	fs web() {
+		nginx
+		env "PORT" "8080"
+		env "PATH" "/app/bin:/usr/bin"
+		imageConfig with option {
+			removeLabel "maintainer"
+			label "version" "1.0"
+			exposed "8080"
+			entrypoint "/app/web"
+		}
+	}
+
+	string changed() {
+		imageConfigDiff web
+	}
+
+	string unchanged() {
+		imageConfigDiff nginx
+	}
+
+	string scratchDiff() {
+		imageConfigDiff fs {
+			scratch
+			env "PORT" "8080"
+		}
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	ctx = codegen.WithImageResolver(ctx, &configResolver{
+		config: []byte(`{"config":{"Env":["PATH=/usr/bin","NGINX_VERSION=1.21"],"Labels":{"keep":"yes","maintainer":"nginx"},"ExposedPorts":{"80/tcp":{}},"Cmd":["nginx"]}}`),
+	})
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+	base := fmt.Sprintf("docker.io/library/nginx@%s", digest.FromString("docker.io/library/nginx:latest"))
+
+	for _, tc := range []struct {
+		target   string
+		expected string
+	}{{
+		"changed",
+		fmt.Sprintf(`{
+		  "base": %q,
+		  "env": {
+		    "added": {
+		      "PORT": "8080"
+		    },
+		    "changed": {
+		      "PATH": {
+		        "base": "/usr/bin",
+		        "final": "/app/bin:/usr/bin"
+		      }
+		    }
+		  },
+		  "labels": {
+		    "added": {
+		      "version": "1.0"
+		    },
+		    "removed": {
+		      "maintainer": "nginx"
+		    }
+		  },
+		  "exposedPorts": {
+		    "added": [
+		      "8080/tcp"
+		    ]
+		  },
+		  "entrypoint": {
+		    "base": null,
+		    "final": [
+		      "/app/web"
+		    ]
+		  }
+		}`, base),
+	}, {
+		"unchanged",
+		fmt.Sprintf(`{
+		  "base": %q
+		}`, base),
+	}, {
+		"scratchDiff",
+		`{
+		  "env": {
+		    "added": {
+		      "PORT": "8080"
+		    }
+		  }
+		}`,
+	}} {
+		var buf bytes.Buffer
+		request, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: tc.target, Output: &buf}})
+		require.NoError(t, err, tc.target)
+
+		err = request.Solve(ctx, nil, nil)
+		require.NoError(t, err, tc.target)
+		require.Equal(t, strings.ReplaceAll(tc.expected, "\n\t\t", "\n"), buf.String(), tc.target)
+	}
+}
+
+func TestCodeGenRuntimeSpec(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs web() {
+		image "nginx"
+		expose "8443" "53/udp"
+	}
+
+	string docker() {
+		runtimeSpec web "registry.example.com/team/web:dev" with option {
+			publish 8080 "80"
+			bind "./html" "/usr/share/nginx/html"
+			env "GREETING" "hello world"
+		}
+	}
+
+	string compose() {
+		runtimeSpec web "registry.example.com/team/web:dev" with option {
+			format "compose"
+			publish 8080 "80"
+			bind "./html" "/usr/share/nginx/html"
+			env "GREETING" "hello world"
+			commandOverride "nginx-debug" "-g" "daemon off;"
+		}
+	}
+
+	string scratchSpec() {
+		runtimeSpec scratch "app"
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	// Image configs written by other tools may expose a port without its
+	// protocol, like 80.
+	ctx = codegen.WithImageResolver(ctx, &configResolver{
+		config: []byte(`{"config":{"Entrypoint":["/docker-entrypoint.sh"],"Cmd":["nginx","-g","daemon off;"],"ExposedPorts":{"80":{},"443/tcp":{}}}}`),
+	})
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	for _, tc := range []struct {
+		target   string
+		expected string
+	}{{
+		"docker",
+		// The exposed port 80 is published on 8080 instead, and the
+		// other exposed ports are published on the same ports.
+		`docker run --rm \
+		  -p 8080:80 \
+		  -p 53:53/udp \
+		  -p 443:443 \
+		  -p 8443:8443 \
+		  -v ./html:/usr/share/nginx/html \
+		  -e 'GREETING=hello world' \
+		  --entrypoint /docker-entrypoint.sh \
+		  registry.example.com/team/web:dev nginx -g 'daemon off;'
+		`,
+	}, {
+		"compose",
+		`services:
+		  "web":
+		    image: "registry.example.com/team/web:dev"
+		    entrypoint: ["/docker-entrypoint.sh"]
+		    command: ["nginx-debug", "-g", "daemon off;"]
+		    ports:
+		      - "8080:80"
+		      - "53:53/udp"
+		      - "443:443"
+		      - "8443:8443"
+		    volumes:
+		      - "./html:/usr/share/nginx/html"
+		    environment:
+		      "GREETING": "hello world"
+		`,
+	}, {
+		"scratchSpec",
+		"docker run --rm \\\n  app\n",
+	}} {
+		var buf bytes.Buffer
+		request, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: tc.target, Output: &buf}})
+		require.NoError(t, err, tc.target)
+
+		err = request.Solve(ctx, nil, nil)
+		require.NoError(t, err, tc.target)
+		require.Equal(t, strings.ReplaceAll(tc.expected, "\n\t\t", "\n"), buf.String(), tc.target)
+	}
+}
+
+type fakeScanner struct {
+	report *codegen.ScanReport
+	err    error
+}
+
+func (fs *fakeScanner) Scan(ctx context.Context, cln *client.Client, input codegen.Filesystem) (*codegen.ScanReport, error) {
+	return fs.report, fs.err
+}
+
+func TestCodeGenScan(t *testing.T) {
+	t.Parallel()
+
+	report := &codegen.ScanReport{Findings: []codegen.ScanFinding{
+		{ID: "CVE-1", Package: "zlib", Version: "1.2", Severity: "HIGH"},
+		{ID: "CVE-2", Package: "openssl", Version: "1.1", Severity: "CRITICAL"},
+		{ID: "GPL-3.0", Package: "readline", Severity: "LOW"},
+	}}
+
+	type testCase struct {
+		name     string
+		input    string
+		err      error
+		expected []string
+		errMsg   string
+		failed   bool
+		reported string
+	}
+
+	for _, tc := range []testCase{{
+		name: "findings below the threshold",
+		input: `
+		fs default() {
+			image "alpine"
+			scan with option {
+				severityThreshold "CRITICAL"
+				ignore "CVE-2"
+				reportPath "reports/scan.json"
+			}
+		}
+		`,
+		expected: []string{"/reports/scan.json", "GPL-3.0"},
+	}, {
+		name: "findings at or above the threshold prevent the push",
+		input: `
+		fs default() {
+			image "alpine"
+			scan with option {
+				ignore "GPL-3.0"
+			}
+			dockerPush "acme/app"
+		}
+		`,
+		errMsg: "scan found 2 findings at or above HIGH (1 CRITICAL, 1 HIGH): CVE-2 in openssl 1.1 (CRITICAL), CVE-1 in zlib 1.2 (HIGH)",
+		failed: true,
+	}, {
+		name: "failed scan writes the report to the working directory",
+		input: `
+		fs default() {
+			image "alpine"
+			scan with option {
+				reportPath "reports/scan.json"
+			}
+		}
+		`,
+		errMsg:   "scan found 2 findings at or above HIGH",
+		failed:   true,
+		reported: "reports/scan.json",
+	}, {
+		name: "scanner error",
+		input: `
+		fs default() {
+			image "alpine"
+			scan
+		}
+		`,
+		err:    fmt.Errorf("scanner unavailable"),
+		errMsg: "scanner unavailable",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			cwd := t.TempDir()
+			ctx, err = local.WithCwd(ctx, cwd)
+			require.NoError(t, err, tc.name)
+
+			cg := codegen.New(nil, nil, codegen.WithScanner(&fakeScanner{report: report, err: tc.err}))
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			if tc.errMsg != "" {
+				require.Error(t, err, tc.name)
+				require.Contains(t, err.Error(), tc.errMsg, tc.name)
+
+				// The full report is kept in the error of a failed scan.
+				var se *codegen.ScanError
+				require.Equal(t, tc.failed, errors.As(err, &se), tc.name)
+				if tc.failed {
+					require.Equal(t, report, se.Report, tc.name)
+				}
+
+				_, err = os.Stat(filepath.Join(cwd, "reports/scan.json"))
+				if tc.reported == "" {
+					require.True(t, os.IsNotExist(err), tc.name)
+					return
+				}
+				dt, err := os.ReadFile(filepath.Join(cwd, tc.reported))
+				require.NoError(t, err, tc.name)
+				var written codegen.ScanReport
+				require.NoError(t, json.Unmarshal(dt, &written), tc.name)
+				require.Equal(t, report, &written, tc.name)
+				return
+			}
+			require.NoError(t, err, tc.name)
+
+			tree := treeprint.New()
+			err = request.Tree(tree)
+			require.NoError(t, err, tc.name)
+			for _, expected := range tc.expected {
+				require.Contains(t, tree.String(), expected, tc.name)
+			}
+		})
+	}
+}
+
+func TestCodeGenMemo(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		targets  []string
+		input    string
+		expected map[string]int
+	}
+
+	for _, tc := range []testCase{{
+		"constant resolved once across call sites and targets",
+		[]string{"build", "test", "all"},
+		`
+		fs baseImage() {
+			image "acme/base:1.2"
+		}
+		fs build() {
+			baseImage
+			run "make"
+		}
+		fs test() {
+			baseImage
+			run "make test" with option {
+				mount baseImage "/base"
+			}
+		}
+		fs all() {
+			scratch
+			copy baseImage "/" "/base"
+			copy build "/" "/build"
+		}
+		`,
+		map[string]int{"docker.io/acme/base:1.2": 1},
+	}, {
+		"target referenced by other targets is built once",
+		[]string{"build", "test", "package"},
+		`
+		fs build() {
+			image "acme/base:1.2"
+			env "TAG" localEnv("HLB_MEMO_TEST_TAG")
+			run "make"
+		}
+		fs test() {
+			image "acme/test:1.0"
+			run "make test" with option {
+				mount build "/src" with readonly
+			}
+		}
+		fs package() {
+			scratch
+			copy build "/out" "/"
+		}
+		`,
+		map[string]int{"docker.io/acme/base:1.2": 1, "docker.io/acme/test:1.0": 1},
+	}, {
+		"impure stage copied from by name is built once",
+		[]string{"release"},
+		`
+		fs builder() {
+			image "acme/base:1.2"
+			env "TAG" localEnv("HLB_MEMO_TEST_TAG")
+			run "make"
+		}
+		fs release() {
+			image "acme/runtime:1.0"
+			copy from builder "/out/app" "/usr/bin/app"
+			copy from builder "/out/lib" "/usr/lib/app"
+			run "app --version" with option {
+				mount builder "/src" with readonly
+			}
+		}
+		`,
+		map[string]int{"docker.io/acme/base:1.2": 1, "docker.io/acme/runtime:1.0": 1},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			var targets []codegen.Target
+			for _, target := range tc.targets {
+				targets = append(targets, codegen.Target{Name: target})
+			}
+
+			resolver := &countingResolver{calls: make(map[string]int)}
+			ctx = codegen.WithImageResolver(ctx, resolver)
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			request, err := cg.Generate(ctx, mod, targets)
+			require.NoError(t, err, tc.name)
+
+			err = request.Tree(treeprint.New())
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.expected, resolver.calls, tc.name)
+		})
+	}
+}
+
+// pickInput is a module whose default target passes five fs args to a
+// function that uses one of them.
+const pickInput = `
+fs default() {
+	pick image("acme/a:1.0") image("acme/b:1.0") image("acme/c:1.0") fs {
+		image "acme/d:1.0"
+		run "make"
+	} fs {
+		image "acme/e:1.0"
+		run "make test"
+	}
+}
+
+fs pick(fs a, fs b, fs c, fs d, fs e) {
+	a
+	run "make"
+}
+`
+
+func TestCodeGenDeferredArgs(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		input    string
+		expected map[string]int
+	}
+
+	for _, tc := range []testCase{{
+		"unused args are not emitted",
+		pickInput,
+		map[string]int{"docker.io/acme/a:1.0": 1},
+	}, {
+		"args used more than once are emitted once",
+		`
+		fs default() {
+			twice image("acme/a:1.0") "acme/b:1.0"
+		}
+
+		fs twice(fs input, string ref) {
+			image ref
+			copy input "/out" "/a"
+			copy input "/out" "/b"
+		}
+		`,
+		map[string]int{"docker.io/acme/a:1.0": 1, "docker.io/acme/b:1.0": 1},
+	}, {
+		"args used by nested calls are emitted",
+		`
+		fs default() {
+			outer image("acme/a:1.0") image("acme/b:1.0")
+		}
+
+		fs outer(fs a, fs b) {
+			inner a b
+		}
+
+		fs inner(fs a, fs b) {
+			b
+		}
+		`,
+		map[string]int{"docker.io/acme/b:1.0": 1},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			resolver := &countingResolver{calls: make(map[string]int)}
+			ctx = codegen.WithImageResolver(ctx, resolver)
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			require.NoError(t, err, tc.name)
+
+			err = request.Tree(treeprint.New())
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.expected, resolver.calls, tc.name)
+		})
+	}
+}
+
+func BenchmarkDeferredArgs(b *testing.B) {
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(pickInput))
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = checker.SemanticPass(mod)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = checker.Check(mod)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	resolver := &countingResolver{calls: make(map[string]int)}
+	ctx = codegen.WithImageResolver(ctx, resolver)
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = request.Tree(treeprint.New())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	// Only the image of the arg that is used is resolved.
+	var resolved int
+	for _, n := range resolver.calls {
+		resolved += n
+	}
+	b.ReportMetric(float64(resolved)/float64(b.N), "resolves/op")
+}
+
+func TestCachedImageResolver(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		input    string
+		expected map[string]int
+	}
+
+	for _, tc := range []testCase{{
+		"copies from the same image resolve once",
+		`
+		fs default() {
+			scratch
+			copy image("busybox") "/bin/busybox" "/bin/"
+			copy image("busybox") "/bin/sh" "/bin/"
+			copy image("busybox") "/etc/passwd" "/etc/"
+			copy fs {
+				image "busybox"
+			} "/etc/group" "/etc/"
+		}
+		`,
+		map[string]int{"docker.io/library/busybox:latest": 1},
+	}, {
+		"copies from different platforms resolve separately",
+		`
+		fs default() {
+			scratch
+			copy image("busybox") "/bin/busybox" "/amd64/"
+			copy busyboxArm64 "/bin/busybox" "/arm64/"
+			copy busyboxArm64 "/bin/sh" "/arm64/"
+		}
+
+		# hlb:nomemo
+		fs busyboxArm64() {
+			image "busybox" with option {
+				platform "linux" "arm64"
+			}
+		}
+		`,
+		map[string]int{"docker.io/library/busybox:latest": 2},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			resolver := &countingResolver{calls: make(map[string]int)}
+			ctx = codegen.WithImageResolver(ctx, codegen.CacheImageResolver(resolver))
+
+			cg := codegen.New(nil, nil)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			require.NoError(t, err, tc.name)
+
+			err = request.Tree(treeprint.New())
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.expected, resolver.calls, tc.name)
+		})
+	}
+}
+
+type slowResolver struct {
+	root      string
+	delay     time.Duration
+	only      string
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (r *slowResolver) Resolve(ctx context.Context, id *ast.ImportDecl, fs codegen.Filesystem) (ast.Directory, error) {
+	return r.ResolveProgress(ctx, id, fs, func(string) {})
+}
+
+func (r *slowResolver) ResolveProgress(ctx context.Context, id *ast.ImportDecl, fs codegen.Filesystem, report func(string)) (ast.Directory, error) {
+	r.mu.Lock()
+	r.active++
+	if r.active > r.maxActive {
+		r.maxActive = r.active
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.active--
+		r.mu.Unlock()
+	}()
+
+	delay := r.delay
+	if r.only != "" && r.only != id.Name.Text {
+		delay = 0
+	}
+
+	report(fmt.Sprintf("fetching %s", id.Name))
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return parser.NewLocalDirectory(filepath.Join(r.root, id.Name.Text), ""), nil
+}
+
+func TestCodeGenImportResolver(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name      string
+		delay     time.Duration
+		only      string
+		opts      []codegen.CodeGenOption
+		cancel    time.Duration
+		maxActive int
+		fn        func(*ast.Module) error
+	}
+
+	for _, tc := range []testCase{{
+		name:      "resolves distinct imports concurrently",
+		delay:     100 * time.Millisecond,
+		maxActive: 3,
+	}, {
+		name:      "bounds concurrent import resolution",
+		delay:     10 * time.Millisecond,
+		opts:      []codegen.CodeGenOption{codegen.WithImportConcurrency(1)},
+		maxActive: 1,
+	}, {
+		name:  "times out slow import resolution",
+		delay: time.Minute,
+		only:  "beta",
+		opts:  []codegen.CodeGenOption{codegen.WithImportTimeout(50 * time.Millisecond)},
+		fn: func(mod *ast.Module) error {
+			return errdefs.WithImportTimeout(
+				ast.Search(mod, "fs", ast.WithSkip(1)),
+				50*time.Millisecond,
+				"fetching beta",
+			)
+		},
+	}, {
+		name:   "cancels import resolution",
+		delay:  time.Minute,
+		cancel: 50 * time.Millisecond,
+		fn: func(mod *ast.Module) error {
+			return context.Canceled
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, name := range []string{"alpha", "beta", "gamma"} {
+				err := os.MkdirAll(filepath.Join(root, name), 0o755)
+				require.NoError(t, err)
+
+				err = os.WriteFile(filepath.Join(root, name, codegen.ModuleFilename), []byte(cleanup(`
+				export build
+				fs build() {
+					scratch
+				}
+				`)), 0o644)
+				require.NoError(t, err)
+			}
+
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(cleanup(`
+			import alpha from fs {
+				scratch
+			}
+			import beta from fs {
+				scratch
+			}
+			import gamma from fs {
+				scratch
+			}
+
+			fs default() {
+				scratch
+				copy alpha.build "/" "/alpha"
+				copy beta.build "/" "/beta"
+				copy gamma.build "/" "/gamma"
+			}
+			`)))
+			require.NoError(t, err)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err)
+
+			err = checker.Check(mod)
+			require.NoError(t, err)
+
+			if tc.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(tc.cancel, cancel)
+				defer cancel()
+			}
+
+			resolver := &slowResolver{root: root, delay: tc.delay, only: tc.only}
+			cg := codegen.New(nil, resolver, tc.opts...)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			_, err = cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			if tc.fn == nil {
+				require.NoError(t, err)
+				require.Equal(t, tc.maxActive, resolver.maxActive)
+				return
+			}
+
+			expected := tc.fn(mod)
+			if errors.Is(expected, context.Canceled) {
+				require.ErrorIs(t, err, context.Canceled)
+				return
+			}
+			validateError(t, ctx, expected, err, tc.name)
+		})
+	}
+}
+
+type testFile struct {
+	filename string
+	content  string
+}
+
+func TestCodeGenImport(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name  string
+		files []testFile
+		fn    func(*ast.Module) error
+	}
+
+	for _, tc := range []testCase{{
+		"can call defined reference",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				other.foo
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			fs foo()
+			`,
+		}},
+		nil,
+	}, {
+		"cannot call undefined reference",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				other.bar
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			fs foo()
+			`,
+		}},
+		func(mod *ast.Module) error {
+			return errdefs.WithUndefinedIdent(
+				ast.Search(mod, "bar"),
+				nil,
+				errdefs.Imported(ast.Search(mod, "other")),
+			)
+		},
+	}, {
+		"unable to call unexported function",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				other.foo
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			fs foo()
+			`,
+		}},
+		func(mod *ast.Module) error {
+			return errdefs.WithCallUnexported(
+				ast.Search(mod, "foo"),
+				errdefs.Imported(ast.Search(mod, "other")),
+			)
+		},
+	}, {
+		"able to use valid reference as mount input",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				run "xyz" with option {
+					mount other.foo "/in"
+				}
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			fs foo()
+			`,
+		}},
+		nil,
+	}, {
+		"able to use pass function field as argument to reference",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				baz "hello"
+			}
+
+			fs baz(string bar) {
+				other.foo bar
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			fs foo(string bar)
+			`,
+		}},
+		nil,
+	}, {
+		"able to use imported function in arg",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				image other.foo("alpine")
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			string foo(string name) {
+				name
+			}
+			`,
+		}},
+		nil,
+	}, {
+		"able to use imported option",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				image "busybox" with other.foo
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			option::image foo()
+			`,
+		}},
+		nil,
+	}, {
+		"able to append option",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+
+			fs default() {
+				image "busybox" with option {
+					other.foo
+				}
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export foo
+			option::image foo()
+			`,
+		}},
+		nil,
+	}, {
+		"able to use shared option library",
+		[]testFile{{
+			"build.hlb",
+			`
+			import sharedOpts from "./sharedOpts.hlb"
+
+			fs default() {
+				image "busybox"
+				run "echo foo" with sharedOpts.base
+				run "echo bar" with option {
+					sharedOpts.base
+					sharedOpts.withEnv "bar"
+					dir "/bar"
+				}
+			}
+			`,
+		}, {
+			"sharedOpts.hlb",
+			`
+			export base
+			export withEnv
+
+			option::run base() {
+				dir "/src"
+				withEnv "base"
+			}
+
+			option::run withEnv(string value) {
+				env "SHARED" value
+			}
+			`,
+		}},
+		nil,
+	}, {
+		"unable to use shared option of wrong kind",
+		[]testFile{{
+			"build.hlb",
+			`
+			import sharedOpts from "./sharedOpts.hlb"
+
+			fs default() {
+				image "busybox"
+				run "echo foo" with sharedOpts.base
+			}
+			`,
+		}, {
+			"sharedOpts.hlb",
+			`
+			export base
+
+			option::image base() {
+				resolve
+			}
+			`,
+		}},
+		func(mod *ast.Module) error {
+			imod := mod.Scope.Lookup("sharedOpts").Data.(*ast.Module)
+			return errdefs.WithWrongType(
+				ast.Search(mod, "base"),
+				[]ast.Kind{"option::run"},
+				"option::image",
+				errdefs.Imported(ast.Search(mod, "sharedOpts")),
+				errdefs.Defined(ast.Search(imod, "base", ast.WithSkip(1))),
+			)
+		},
+	}, {
+		"able to import within import",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./other.hlb"
+			import other2 from other.wrap("./other2.hlb")
+
+			fs default() {
+				other2.build
+			}
+			`,
+		}, {
+			"other.hlb",
+			`
+			export wrap
+			string wrap(string path) {
+				path
+			}
+			`,
+		}, {
+			"other2.hlb",
+			`
+			export build
+			fs build()
+			`,
+		}},
+		nil,
+	}, {
+		"imports respect module dir",
+		[]testFile{{
+			"build.hlb",
+			`
+			import other from "./sub/other.hlb"
+
+			fs default() {
+				other.build
+			}
+			`,
+		}, {
+			"./sub/other.hlb",
+			`
+			import other2 from "../other2.hlb"
+			export build
+			fs build() {
+				other2.build
+			}
+			`,
+		}, {
+			"other2.hlb",
+			`
+			export build
+			fs build()
+			`,
+		}},
+		nil,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, actual := parseTestFile(t, ctx, tc.files, tc.files[0])
+			if tc.fn != nil {
+				expected := tc.fn(mod)
+				validateError(t, ctx, expected, actual, tc.name)
+			} else {
+				cg := codegen.New(nil, nil)
+				_, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+				validateError(t, ctx, nil, err, tc.name)
+			}
+		})
+	}
+}
+
+func TestCodeGenImportedBase(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	// Any call returning a filesystem can start a block, so an imported
+	// function is a base like image is.
+	files := []testFile{{
+		"build.hlb",
+		`
+		import base from "./base.hlb"
+
+		fs default() {
+			base.golang "1.16"
+			run "go build"
+			mkfile "/done" 0o644 ""
+		}
+		`,
+	}, {
+		"base.hlb",
+		`
+		export golang
+		fs golang(string version) {
+			image string {
+				format "golang:%s" version
+			}
+			dir "/src"
+		}
+		`,
+	}}
+	mod, err := parseTestFile(t, ctx, files, files[0])
+	require.NoError(t, err)
+
+	cg := codegen.New(nil, nil)
+	request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+	require.NoError(t, err)
+
+	expected := treeprint.New()
+	err = Expect(t, llb.Image("golang:1.16").Dir("/src").Run(
+		llb.Args([]string{"/bin/sh", "-c", "go build"}),
+	).Root().File(llb.Mkfile("/done", 0o644, []byte("")))).Tree(expected)
+	require.NoError(t, err)
+
+	actual := treeprint.New()
+	err = request.Tree(actual)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), actual.String())
+}
+
+func TestCodeGenFrom(t *testing.T) {
+	t.Parallel()
+
+	sh := func(script string) llb.RunOption {
+		return llb.Args([]string{"/bin/sh", "-c", script})
+	}
+
+	type testCase struct {
+		name     string
+		files    []testFile
+		expected llb.State
+	}
+
+	for _, tc := range []testCase{{
+		name: "from a parameter",
+		files: []testFile{{
+			"build.hlb",
+			`
+			fs default() {
+				build image("alpine")
+			}
+
+			fs build(fs base) {
+				from base
+				run "make"
+			}
+			`,
+		}},
+		expected: llb.Image("alpine").Run(sh("make")).Root(),
+	}, {
+		name: "from an import member",
+		files: []testFile{{
+			"build.hlb",
+			`
+			import lib from "./lib.hlb"
+
+			fs default() {
+				from lib.golang
+				run "go build"
+			}
+			`,
+		}, {
+			"lib.hlb",
+			`
+			export golang
+			fs golang() {
+				image "golang"
+				dir "/src"
+			}
+			`,
+		}},
+		expected: llb.Image("golang").Dir("/src").Run(sh("go build")).Root(),
+	}, {
+		name: "from an inline fs literal",
+		files: []testFile{{
+			"build.hlb",
+			`
+			fs default() {
+				from fs {
+					image "alpine"
+					run "apk add make"
 				}
+				run "make"
+			}
+			`,
+		}},
+		expected: llb.Image("alpine").Run(sh("apk add make")).Root().Run(sh("make")).Root(),
+	}, {
+		name: "from ignores the value it is called on",
+		files: []testFile{{
+			"build.hlb",
+			`
+			fs default() {
+				image "alpine"
+				rebased
+			}
+
+			fs rebased() {
+				from continued
+				run "make"
+			}
+
+			fs continued() {
+				run "ls"
+			}
+			`,
+		}},
+		expected: llb.Scratch().Run(sh("ls")).Root().Run(sh("make")).Root(),
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
 
-				imod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.hlbImport)))
-				require.NoError(t, err, tc.name)
+			mod, err := parseTestFile(t, ctx, tc.files, tc.files[0])
+			require.NoError(t, err, tc.name)
 
-				err = checker.SemanticPass(imod)
-				require.NoError(t, err, tc.name)
+			request, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			require.NoError(t, err, tc.name)
 
-				err = checker.Check(imod)
-				require.NoError(t, err, tc.name)
+			expected := treeprint.New()
+			err = Expect(t, tc.expected).Tree(expected)
+			require.NoError(t, err, tc.name)
 
-				obj.Data = imod
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err, tc.name)
+			require.Equal(t, expected.String(), actual.String(), tc.name)
+		})
+	}
+}
 
-				err = checker.CheckReferences(mod, "other")
-				require.NoError(t, err, tc.name)
+func TestSelectPlatform(t *testing.T) {
+	t.Parallel()
+
+	input := `
+	fs default() {
+		selectPlatform with option {
+			when "linux/arm64" image("arm64v8/alpine")
+			when "linux/amd64" image("alpine")
+			when "linux/amd64" image("unused")
+		}
+		run "uname -m"
+	}
+	`
+
+	for _, tc := range []struct {
+		platform   specs.Platform
+		expected   string
+		unexpected string
+	}{{
+		specs.Platform{OS: "linux", Architecture: "amd64"},
+		"docker.io/library/alpine:latest",
+		"arm64v8",
+	}, {
+		specs.Platform{OS: "linux", Architecture: "arm64"},
+		"docker.io/arm64v8/alpine:latest",
+		"library/alpine",
+	}} {
+		ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+		ctx = ast.WithModules(ctx, builtin.Modules())
+		ctx = codegen.WithDefaultPlatform(ctx, tc.platform)
+
+		mod, err := parser.Parse(ctx, strings.NewReader(cleanup(input)))
+		require.NoError(t, err)
+
+		err = checker.SemanticPass(mod)
+		require.NoError(t, err)
+
+		err = checker.Check(mod)
+		require.NoError(t, err)
+
+		request, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+		require.NoError(t, err)
+
+		tree := treeprint.New()
+		err = request.Tree(tree)
+		require.NoError(t, err)
+		require.Contains(t, tree.String(), tc.expected, platforms.Format(tc.platform))
+		require.NotContains(t, tree.String(), tc.unexpected)
+		require.NotContains(t, tree.String(), "unused")
+	}
+}
+
+func TestHelperPlatform(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	arm64 := specs.Platform{OS: "linux", Architecture: "arm64"}
+	ctx = codegen.WithDefaultPlatform(ctx, arm64)
+	ctx = codegen.WithBuildPlatform(ctx, specs.Platform{OS: "linux", Architecture: "amd64"})
+
+	mod, err := parser.Parse(ctx, strings.NewReader(cleanup(`
+	fs default() {
+		image "alpine"
+		writeFile "/log" "started" with option {
+			append
+			createIfMissing
+		}
+		strip "/bin/app"
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	request, err := codegen.New(nil, nil).Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+	require.NoError(t, err)
+
+	// Appending only changes files, so its helper runs on the build platform,
+	// but strip runs on the platform of the binaries it strips.
+	appended := llb.Image(codegen.HelperImage, llb.LinuxAmd64).Run(
+		llb.Args([]string{"/bin/sh", "-c", codegen.AppendScript, "append", "/log", "true"}),
+		llb.AddMount(codegen.AppendContentMountpoint, llb.Scratch().Platform(arm64).File(
+			llb.Mkfile("/content", 0o644, []byte("started")),
+		), llb.Readonly),
+		llb.AddMount(codegen.AppendMountpoint, llb.Image("alpine", llb.Platform(arm64))),
+	).GetMount(codegen.AppendMountpoint)
+	helper := llb.Image(codegen.HelperImage, llb.Platform(arm64)).Run(
+		llb.Shlex("apk add --no-cache binutils"),
+	).Root()
+	stripped := helper.Run(
+		llb.Args([]string{"/bin/sh", "-c", codegen.StripScript, "strip", "/bin/app"}),
+		llb.AddMount(codegen.StripMountpoint, appended),
+	).GetMount(codegen.StripMountpoint)
+
+	expected := treeprint.New()
+	err = Expect(t, stripped).Tree(expected)
+	require.NoError(t, err)
+
+	actual := treeprint.New()
+	err = request.Tree(actual)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), actual.String())
+}
+
+func parseTestFile(t *testing.T, ctx context.Context, files []testFile, f testFile) (*ast.Module, error) {
+	r := &parser.NamedReader{
+		Reader: strings.NewReader(cleanup(f.content)),
+		Value:  f.filename,
+	}
+
+	mod, err := parser.Parse(ctx, r)
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	var actual error
+	ast.Match(mod, ast.MatchOpts{},
+		func(id *ast.ImportDecl) {
+			obj := mod.Scope.Lookup(id.Name.Text)
+			require.NotNil(t, obj)
+
+			var (
+				ifile testFile
+				found bool
+			)
+			for _, f := range files {
+				if strings.Contains(f.filename, id.Name.Text) {
+					ifile = f
+					found = true
+					break
+				}
 			}
+			require.True(t, found)
 
-			var targets []codegen.Target
-			for _, target := range tc.targets {
-				targets = append(targets, codegen.Target{Name: target})
+			obj.Data, err = parseTestFile(t, ctx, files, ifile)
+			if err != nil {
+				actual = err
+				return
 			}
 
-			cg := codegen.New(nil, nil)
-			ctx = codegen.WithSessionID(ctx, identity.NewID())
-			request, err := cg.Generate(ctx, mod, targets)
+			err = checker.CheckReferences(mod, id.Name.Text)
+			if err != nil {
+				actual = err
+			}
+		},
+	)
+
+	return mod, actual
+}
+
+func validateError(t *testing.T, ctx context.Context, expected, actual error, name string) {
+	switch {
+	case expected == nil:
+		if actual != nil {
+			for _, span := range diagnostic.Spans(actual) {
+				t.Logf("[Actual]\n%s", span.Pretty(ctx))
+			}
+		}
+		require.NoError(t, actual, name)
+	case actual == nil:
+		if expected != nil {
+			for _, span := range diagnostic.Spans(expected) {
+				t.Logf("[Expected]\n%s", span.Pretty(ctx))
+			}
+		}
+		require.NotNil(t, actual, name)
+	default:
+		espans := diagnostic.Spans(expected)
+		aspans := diagnostic.Spans(actual)
+		require.Equal(t, len(espans), len(aspans))
+
+		for i := 0; i < len(espans); i++ {
+			epretty := espans[i].Pretty(ctx)
+			t.Logf("[Expected]\n%s", epretty)
+			apretty := aspans[i].Pretty(ctx)
+			t.Logf("[Actual]\n%s", apretty)
+			require.Equal(t, epretty, apretty, name)
+		}
+	}
+}
+
+func TestCodeGenLocalSecrets(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, filename := range []string{
+		"token",
+		"keys/a.pem",
+		"keys/b.pem",
+		"keys/nested/c.pem",
+		"certs/x/ca.pem",
+		"certs/y/ca.pem",
+	} {
+		path := filepath.Join(dir, filename)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(path, []byte(filename), 0o600)
+		require.NoError(t, err)
+	}
+
+	type testCase struct {
+		name   string
+		input  string
+		policy codegen.HostPolicy
+		fn     func(t *testing.T) llb.State
+		errMsg string
+	}
+
+	for _, tc := range []testCase{{
+		name: "secret file",
+		input: `
+		fs default() {
+			image "alpine"
+			run "cat /run/secrets/token" with option {
+				secretFile "token" "/run/secrets/token"
+			}
+		}
+		`,
+		fn: func(t *testing.T) llb.State {
+			return llb.Image("alpine").Run(
+				llb.AddSecret("/run/secrets/token", llb.SecretID(llbutil.SecretID(filepath.Join(dir, "token")))),
+				llb.Args([]string{"/bin/sh", "-c", "cat /run/secrets/token"}),
+			).Root()
+		},
+	}, {
+		name: "secret dir expands glob",
+		input: `
+		fs default() {
+			image "alpine"
+			run "ls /etc/keys" with option {
+				secretDir "keys/*.pem" "/etc/keys" with option {
+					mode 0o444
+				}
+			}
+		}
+		`,
+		fn: func(t *testing.T) llb.State {
+			return llb.Image("alpine").Run(
+				llb.AddSecret("/etc/keys/a.pem", llb.SecretFileOpt(0, 0, 0o444), llb.SecretID(llbutil.SecretID(filepath.Join(dir, "keys/a.pem")))),
+				llb.AddSecret("/etc/keys/b.pem", llb.SecretFileOpt(0, 0, 0o444), llb.SecretID(llbutil.SecretID(filepath.Join(dir, "keys/b.pem")))),
+				llb.Args([]string{"/bin/sh", "-c", "ls /etc/keys"}),
+			).Root()
+		},
+	}, {
+		name: "optional secrets that are missing",
+		input: `
+		fs default() {
+			image "alpine"
+			run "true" with option {
+				secretFile "missing" "/run/secrets/missing" with optional
+				secretDir "missing/*" "/etc/missing" with optional
+			}
+		}
+		`,
+		fn: func(t *testing.T) llb.State {
+			return llb.Image("alpine").Run(
+				llb.Args([]string{"/bin/sh", "-c", "true"}),
+			).Root()
+		},
+	}, {
+		name: "missing secret file",
+		input: `
+		fs default() {
+			image "alpine"
+			run "true" with option {
+				secretFile "missing" "/run/secrets/missing"
+			}
+		}
+		`,
+		errMsg: fmt.Sprintf("secret %s does not exist", filepath.Join(dir, "missing")),
+	}, {
+		name: "secret dir rejects nested directories",
+		input: `
+		fs default() {
+			image "alpine"
+			run "true" with option {
+				secretDir "keys/*" "/etc/keys"
+			}
+		}
+		`,
+		errMsg: fmt.Sprintf("secret %s is a directory", filepath.Join(dir, "keys/nested")),
+	}, {
+		name: "secret dir with colliding basenames",
+		input: `
+		fs default() {
+			image "alpine"
+			run "true" with option {
+				secretDir "certs/*/ca.pem" "/etc/certs"
+			}
+		}
+		`,
+		errMsg: fmt.Sprintf("secret target /etc/certs/ca.pem is attached from both %s and %s",
+			filepath.Join(dir, "certs/x/ca.pem"), filepath.Join(dir, "certs/y/ca.pem")),
+	}, {
+		name: "secrets with colliding targets",
+		input: `
+		fs default() {
+			image "alpine"
+			run "true" with option {
+				secretFile "certs/x/ca.pem" "/etc/keys/a.pem"
+				secretDir "keys/*.pem" "/etc/keys"
+			}
+		}
+		`,
+		errMsg: fmt.Sprintf("secret target /etc/keys/a.pem is attached from both %s and %s",
+			filepath.Join(dir, "certs/x/ca.pem"), filepath.Join(dir, "keys/a.pem")),
+	}, {
+		name: "host policy vetoes secret",
+		input: `
+		fs default() {
+			image "alpine"
+			run "true" with option {
+				secretFile "token" "/run/secrets/token"
+			}
+		}
+		`,
+		policy: func(ctx context.Context, access codegen.HostAccess) error {
+			return fmt.Errorf("%s is not allowed", access.Builtin)
+		},
+		errMsg: fmt.Sprintf("reading %s from the host was denied: secretFile is not allowed", filepath.Join(dir, "token")),
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
 			require.NoError(t, err, tc.name)
 
-			testRequest := tc.fn(ctx, t)
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			cg := codegen.New(nil, nil, codegen.WithSecretRoot(dir), codegen.WithHostPolicy(tc.policy))
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			if tc.errMsg != "" {
+				require.Error(t, err, tc.name)
+				require.Contains(t, err.Error(), tc.errMsg, tc.name)
+				return
+			}
+			require.NoError(t, err, tc.name)
 
 			expected := treeprint.New()
-			err = testRequest.Tree(expected)
+			err = Expect(t, tc.fn(t)).Tree(expected)
 			require.NoError(t, err, tc.name)
 			t.Logf("expected: %s", expected)
 
@@ -998,47 +6069,98 @@ func TestCodeGen(t *testing.T) {
 			require.NoError(t, err, tc.name)
 			t.Logf("actual: %s", actual)
 
-			// Compare trees.
 			require.Equal(t, expected.String(), actual.String(), tc.name)
 		})
 	}
 }
 
-func TestCodegenError(t *testing.T) {
+func TestCodeGenLocalAllowList(t *testing.T) {
 	t.Parallel()
 
 	type testCase struct {
-		name    string
-		targets []string
-		input   string
-		fn      func(*ast.Module) error
+		name     string
+		input    string
+		commands []string
+		keys     []string
+		policy   codegen.HostPolicy
+		expected string
+		errMsg   string
 	}
 
-	for _, tc := range []testCase{
-		{
-			"invalid downloadDockerTarball ref",
-			[]string{"default"},
-			`
-			fs default() {
-				downloadDockerTarball "image.tar" "#"
-			}
-			`,
-			func(mod *ast.Module) error {
-				return errdefs.WithInvalidImageRef(
-					errors.New("invalid reference format"),
-					ast.Search(mod, `"#"`),
-					"#",
-				)
-			},
+	for _, tc := range []testCase{{
+		name: "allowed command",
+		input: `
+		fs default() {
+			image string { localRun "echo alpine" with shlex; }
+		}
+		`,
+		commands: []string{"echo"},
+		expected: "alpine",
+	}, {
+		name: "disallowed command",
+		input: `
+		fs default() {
+			image string { localRun "uname" with shlex; }
+		}
+		`,
+		commands: []string{"echo"},
+		errMsg:   "running uname on the host was denied: uname is not in the allowed commands",
+	}, {
+		name: "scripts are run by a shell",
+		input: `
+		fs default() {
+			image localRun("echo alpine")
+		}
+		`,
+		commands: []string{"echo"},
+		errMsg:   "running /bin/sh -c echo alpine on the host was denied: /bin/sh is not in the allowed commands",
+	}, {
+		name: "allowed environment variable",
+		input: `
+		fs default() {
+			image localEnv("BASE")
+		}
+		`,
+		keys:     []string{"BASE"},
+		expected: "busybox",
+	}, {
+		name: "disallowed environment variable",
+		input: `
+		fs default() {
+			image localEnv("HOME")
+		}
+		`,
+		keys:   []string{"BASE"},
+		errMsg: "reading environment variable HOME from the host was denied: HOME is not in the allowed environment variables",
+	}, {
+		name: "empty lists disable localRun",
+		input: `
+		fs default() {
+			image string { localRun "echo alpine" with shlex; }
+		}
+		`,
+		errMsg: "echo is not in the allowed commands",
+	}, {
+		name: "composes with host policy",
+		input: `
+		fs default() {
+			image string { localRun "echo alpine" with shlex; }
+		}
+		`,
+		commands: []string{"echo"},
+		policy: func(ctx context.Context, access codegen.HostAccess) error {
+			return fmt.Errorf("%s is not allowed", access.Builtin)
 		},
-	} {
+		errMsg: "running echo alpine on the host was denied: localRun is not allowed",
+	}} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
 			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx = local.WithEnviron(ctx, []string{"BASE=busybox", "HOME=/root"})
 
-			mod, err := parser.Parse(ctx, strings.NewReader(tc.input))
-			require.NoError(t, err, "unexpected parse error")
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(tc.input)))
+			require.NoError(t, err, tc.name)
 
 			err = checker.SemanticPass(mod)
 			require.NoError(t, err, tc.name)
@@ -1046,362 +6168,467 @@ func TestCodegenError(t *testing.T) {
 			err = checker.Check(mod)
 			require.NoError(t, err, tc.name)
 
-			var targets []codegen.Target
-			for _, target := range tc.targets {
-				targets = append(targets, codegen.Target{Name: target})
+			cg := codegen.New(nil, nil,
+				codegen.WithLocalAllowList(tc.commands, tc.keys),
+				codegen.WithHostPolicy(tc.policy),
+			)
+			request, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			if tc.errMsg != "" {
+				require.Error(t, err, tc.name)
+				require.Contains(t, err.Error(), tc.errMsg, tc.name)
+				require.Len(t, diagnostic.Spans(err), 1, tc.name)
+				return
 			}
+			require.NoError(t, err, tc.name)
 
-			cg := codegen.New(nil, nil)
-			ctx = codegen.WithSessionID(ctx, identity.NewID())
-			_, err = cg.Generate(ctx, mod, targets)
-			var expected error
-			if tc.fn != nil {
-				expected = tc.fn(mod)
-			}
-			validateError(t, ctx, expected, err, tc.name)
+			expected := treeprint.New()
+			err = Expect(t, llb.Image(tc.expected)).Tree(expected)
+			require.NoError(t, err, tc.name)
+
+			actual := treeprint.New()
+			err = request.Tree(actual)
+			require.NoError(t, err, tc.name)
+			require.Equal(t, expected.String(), actual.String(), tc.name)
 		})
 	}
-
-}
-
-type testFile struct {
-	filename string
-	content  string
 }
 
-func TestCodeGenImport(t *testing.T) {
+func TestCodeGenImportSandbox(t *testing.T) {
 	t.Parallel()
 
-	type testCase struct {
-		name  string
-		files []testFile
-		fn    func(*ast.Module) error
-	}
-
-	for _, tc := range []testCase{{
-		"can call defined reference",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	for filename, content := range map[string]string{
+		"root/lib/lib.hlb": `
+		export inside
+		export escape
+		export absolute
+		export symlink
+		export command
+		export scanned
+		export tarball
+		export commitOf
+		export secrets
+		export keys
+		export agent
+		export agentSocket
+		export socket
+		export address
 
-			fs default() {
-				other.foo
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			fs foo()
-			`,
-		}},
-		nil,
-	}, {
-		"cannot call undefined reference",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		fs inside() {
+			local "data"
+		}
 
-			fs default() {
-				other.bar
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			fs foo()
-			`,
-		}},
-		func(mod *ast.Module) error {
-			return errdefs.WithUndefinedIdent(
-				ast.Search(mod, "bar"),
-				nil,
-				errdefs.Imported(ast.Search(mod, "other")),
-			)
-		},
-	}, {
-		"unable to call unexported function",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		fs escape() {
+			local "../../outside"
+		}
 
-			fs default() {
-				other.foo
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			fs foo()
-			`,
-		}},
-		func(mod *ast.Module) error {
-			return errdefs.WithCallUnexported(
-				ast.Search(mod, "foo"),
-				errdefs.Imported(ast.Search(mod, "other")),
-			)
-		},
-	}, {
-		"able to use valid reference as mount input",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		fs absolute() {
+			local "` + filepath.Join(tmp, "outside") + `"
+		}
 
-			fs default() {
-				run "xyz" with option {
-					mount other.foo "/in"
-				}
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			fs foo()
-			`,
-		}},
-		nil,
-	}, {
-		"able to use pass function field as argument to reference",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		fs symlink() {
+			local "link"
+		}
 
-			fs default() {
-				baz "hello"
-			}
+		fs command() {
+			image string { localRun "echo alpine" with shlex; }
+		}
 
-			fs baz(string bar) {
-				other.foo bar
+		fs scanned() {
+			image "alpine"
+			scan with option {
+				reportPath "scan.json"
 			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			fs foo(string bar)
-			`,
-		}},
-		nil,
-	}, {
-		"able to use imported function in arg",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		}
 
-			fs default() {
-				image other.foo("alpine")
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			string foo(string name) {
-				name
-			}
-			`,
-		}},
-		nil,
-	}, {
-		"able to use imported option",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		fs tarball() {
+			tarContext "../../outside.tar.gz"
+		}
 
-			fs default() {
-				image "busybox" with other.foo
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			option::image foo()
-			`,
-		}},
-		nil,
-	}, {
-		"able to append option",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
+		string commitOf(fs repo) {
+			gitCommit repo
+		}
 
-			fs default() {
-				image "busybox" with option {
-					other.foo
-				}
+		fs secrets() {
+			image "alpine"
+			run "true" with option {
+				secret "../../outside" "/run/secrets"
 			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export foo
-			option::image foo()
-			`,
-		}},
-		nil,
-	}, {
-		"able to import within import",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./other.hlb"
-			import other2 from other.wrap("./other2.hlb")
+		}
 
-			fs default() {
-				other2.build
-			}
-			`,
-		}, {
-			"other.hlb",
-			`
-			export wrap
-			string wrap(string path) {
-				path
+		fs keys() {
+			image "alpine"
+			run "true" with option {
+				secretDir "` + filepath.Join(root, "lib", "keys", "*.pem") + `" "/etc/keys"
 			}
-			`,
-		}, {
-			"other2.hlb",
-			`
-			export build
-			fs build()
-			`,
-		}},
-		nil,
-	}, {
-		"imports respect module dir",
-		[]testFile{{
-			"build.hlb",
-			`
-			import other from "./sub/other.hlb"
+		}
 
-			fs default() {
-				other.build
+		fs agent() {
+			image "alpine"
+			run "true" with ssh
+		}
+
+		fs agentSocket() {
+			image "alpine"
+			run "true" with option {
+				ssh with option {
+					localPaths "../../outside/agent.sock"
+				}
 			}
-			`,
-		}, {
-			"./sub/other.hlb",
-			`
-			import other2 from "../other2.hlb"
-			export build
-			fs build() {
-				other2.build
+		}
+
+		fs socket() {
+			image "alpine"
+			run "true" with option {
+				forward "unix://` + filepath.Join(tmp, "outside", "docker.sock") + `" "/run/docker.sock"
 			}
-			`,
-		}, {
-			"other2.hlb",
-			`
-			export build
-			fs build()
-			`,
-		}},
-		nil,
+		}
+
+		fs address() {
+			image "alpine"
+			run "true" with option {
+				forward "tcp://localhost:2375" "/run/docker.sock"
+			}
+		}
+		`,
+		"root/lib/data/file":       "",
+		"root/lib/keys/inside.pem": "",
+		"outside/file":             "",
+	} {
+		path := filepath.Join(tmp, filename)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		require.NoError(t, err)
+		err = os.WriteFile(path, []byte(dedent.Dedent(content)), 0o644)
+		require.NoError(t, err)
+	}
+	err := os.Symlink(filepath.Join(tmp, "outside"), filepath.Join(root, "lib", "link"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(tmp, "outside", "file"), filepath.Join(root, "lib", "keys", "outside.pem"))
+	require.NoError(t, err)
+
+	type testCase struct {
+		name   string
+		input  string
+		errMsg string
+	}
+
+	for _, tc := range []testCase{{
+		name: "imported module reads under the root",
+		input: `
+		fs default() {
+			lib.inside
+		}
+		`,
+	}, {
+		name: "root module is not sandboxed",
+		input: `
+		fs default() {
+			local "../outside"
+		}
+		`,
+	}, {
+		name: "imported module escapes the root",
+		input: `
+		fs default() {
+			lib.escape
+		}
+		`,
+		errMsg: "reading ../outside from the host was denied: imported modules can only read local files under",
+	}, {
+		name: "imported module reads an absolute path",
+		input: `
+		fs default() {
+			lib.absolute
+		}
+		`,
+		errMsg: "imported modules can only read local files under",
+	}, {
+		name: "imported module follows a symlink out of the root",
+		input: `
+		fs default() {
+			lib.symlink
+		}
+		`,
+		errMsg: "imported modules can only read local files under",
+	}, {
+		name: "imported module runs a command",
+		input: `
+		fs default() {
+			lib.command
+		}
+		`,
+		errMsg: "running echo alpine on the host was denied: imported modules cannot run commands on the host",
+	}, {
+		name: "imported module writes the report of a failed scan",
+		input: `
+		fs default() {
+			lib.scanned
+		}
+		`,
+		errMsg: "imported modules cannot write files on the host",
+	}, {
+		name: "imported module unpacks a tarball outside of the root",
+		input: `
+		fs default() {
+			lib.tarball
+		}
+		`,
+		errMsg: "reading ../outside.tar.gz from the host was denied: imported modules can only read local files under",
+	}, {
+		name: "imported module runs git in a directory outside of the root",
+		input: `
+		fs default() {
+			image "alpine"
+			mkfile "commit" 0o644 lib.commitOf(local("../outside"))
+		}
+		`,
+		errMsg: "imported modules can only read local files under",
+	}, {
+		name: "imported module attaches secrets outside of the root",
+		input: `
+		fs default() {
+			lib.secrets
+		}
+		`,
+		errMsg: "imported modules can only read local files under",
+	}, {
+		name: "imported module attaches a secret symlinked out of the root",
+		input: `
+		fs default() {
+			lib.keys
+		}
+		`,
+		errMsg: "outside.pem from the host was denied: imported modules can only read local files under",
+	}, {
+		name: "imported module forwards the ssh agent of the host",
+		input: `
+		fs default() {
+			lib.agent
+		}
+		`,
+		errMsg: "reading the ssh agent from the host was denied: imported modules cannot forward the ssh agent of the host",
+	}, {
+		name: "imported module forwards an ssh agent outside of the root",
+		input: `
+		fs default() {
+			lib.agentSocket
+		}
+		`,
+		errMsg: "imported modules can only read local files under",
+	}, {
+		name: "imported module forwards a socket outside of the root",
+		input: `
+		fs default() {
+			lib.socket
+		}
+		`,
+		errMsg: "imported modules can only read local files under",
+	}, {
+		name: "imported module forwards a network address",
+		input: `
+		fs default() {
+			lib.address
+		}
+		`,
+		errMsg: "reading tcp://localhost:2375 from the host was denied: imported modules cannot forward network addresses from the host",
 	}} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
 			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			ctx, err := local.WithCwd(ctx, root)
+			require.NoError(t, err)
 
-			mod, actual := parseTestFile(t, ctx, tc.files, tc.files[0])
-			if tc.fn != nil {
-				expected := tc.fn(mod)
-				validateError(t, ctx, expected, actual, tc.name)
-			} else {
-				cg := codegen.New(nil, nil)
-				_, err := cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
-				validateError(t, ctx, nil, err, tc.name)
+			input := `import lib from "./lib/lib.hlb"` + "\n" + tc.input
+			mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+			require.NoError(t, err, tc.name)
+			mod.Directory = parser.NewLocalDirectory(root+string(filepath.Separator), "")
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err, tc.name)
+
+			err = checker.Check(mod)
+			require.NoError(t, err, tc.name)
+
+			cg := codegen.New(nil, nil,
+				codegen.WithImportSandbox(root),
+				codegen.WithScanner(&fakeScanner{report: &codegen.ScanReport{Findings: []codegen.ScanFinding{
+					{ID: "CVE-1", Severity: "CRITICAL"},
+				}}}),
+			)
+			_, err = cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+			if tc.errMsg != "" {
+				require.Error(t, err, tc.name)
+				require.Contains(t, err.Error(), tc.errMsg, tc.name)
+				require.Len(t, diagnostic.Spans(err), 1, tc.name)
+				return
 			}
+			require.NoError(t, err, tc.name)
 		})
 	}
 }
 
-func parseTestFile(t *testing.T, ctx context.Context, files []testFile, f testFile) (*ast.Module, error) {
-	r := &parser.NamedReader{
-		Reader: strings.NewReader(cleanup(f.content)),
-		Value:  f.filename,
-	}
+func TestRequiredSecrets(t *testing.T) {
+	t.Parallel()
 
-	mod, err := parser.Parse(ctx, r)
-	require.NoError(t, err)
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
 
-	err = checker.SemanticPass(mod)
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs default() {
+		image "alpine"
+		run "true" with option {
+			secretFile "token" "/run/secrets/token"
+			secretDir "keys/*.pem" "/etc/keys" with optional
+			secretFile localEnv("TOKEN") "/run/secrets/env"
+		}
+	}
+	`)))
 	require.NoError(t, err)
 
-	err = checker.Check(mod)
-	require.NoError(t, err)
+	var actual []codegen.RequiredSecret
+	for _, secret := range codegen.RequiredSecrets(mod) {
+		secret.Node = nil
+		actual = append(actual, secret)
+	}
+	require.Equal(t, []codegen.RequiredSecret{{
+		Builtin:   "secretFile",
+		LocalPath: "token",
+		Target:    "/run/secrets/token",
+	}, {
+		Builtin:   "secretDir",
+		LocalPath: "keys/*.pem",
+		Target:    "/etc/keys",
+		Optional:  true,
+	}}, actual)
+}
 
-	var actual error
-	ast.Match(mod, ast.MatchOpts{},
-		func(id *ast.ImportDecl) {
-			obj := mod.Scope.Lookup(id.Name.Text)
-			require.NotNil(t, obj)
+func TestCodeGenLint(t *testing.T) {
+	t.Parallel()
 
-			var (
-				ifile testFile
-				found bool
-			)
-			for _, f := range files {
-				if strings.Contains(f.filename, id.Name.Text) {
-					ifile = f
-					found = true
-					break
+	type testCase struct {
+		name     string
+		opts     []codegen.CodeGenOption
+		warnings []string
+		errors   []string
+	}
+
+	for _, tc := range []testCase{{
+		name: "lint off by default",
+	}, {
+		name:     "lint warn",
+		opts:     []codegen.CodeGenOption{codegen.WithLintMode(codegen.LintWarn)},
+		warnings: []string{`"80"`, `"443"`},
+	}, {
+		name:     "lint error only fails on root module",
+		opts:     []codegen.CodeGenOption{codegen.WithLintMode(codegen.LintError)},
+		warnings: []string{`"443"`},
+		errors:   []string{`"80"`},
+	}, {
+		name: "lint error on imports",
+		opts: []codegen.CodeGenOption{
+			codegen.WithLintMode(codegen.LintError),
+			codegen.WithImportLintMode(codegen.LintError),
+		},
+		errors: []string{`"80"`, `"443"`},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			err := os.MkdirAll(filepath.Join(root, "vendor"), 0o755)
+			require.NoError(t, err)
+
+			err = os.WriteFile(filepath.Join(root, "vendor", codegen.ModuleFilename), []byte(cleanup(`
+			export build
+			fs build() {
+				scratch
+				expose "443" "443"
+			}
+			`)), 0o644)
+			require.NoError(t, err)
+
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+
+			mod, err := parser.Parse(ctx, &parser.NamedReader{
+				Reader: strings.NewReader(cleanup(`
+				import vendor from fs {
+					scratch
+				}
+
+				fs default() {
+					vendor.build
+					expose "80" "80"
+				}
+				`)),
+				Value: "build.hlb",
+			})
+			require.NoError(t, err)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err)
+
+			err = checker.Check(mod)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			opts := append([]codegen.CodeGenOption{codegen.WithDiagnosticWriter(&buf)}, tc.opts...)
+			cg := codegen.New(nil, &slowResolver{root: root}, opts...)
+			ctx = codegen.WithSessionID(ctx, identity.NewID())
+			_, err = cg.Generate(ctx, mod, []codegen.Target{{Name: "default"}})
+
+			var warned []string
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if strings.Contains(line, "is exposed more than once") {
+					warned = append(warned, line)
 				}
 			}
-			require.True(t, found)
+			require.Len(t, warned, len(tc.warnings), buf.String())
+			for _, port := range tc.warnings {
+				require.Contains(t, buf.String(), fmt.Sprintf("port `%s/tcp` is exposed more than once", strings.Trim(port, `"`)))
+			}
 
-			obj.Data, err = parseTestFile(t, ctx, files, ifile)
-			if err != nil {
-				actual = err
+			if len(tc.errors) == 0 {
+				require.NoError(t, err)
 				return
 			}
-
-			err = checker.CheckReferences(mod, id.Name.Text)
-			if err != nil {
-				actual = err
+			require.Error(t, err)
+			require.Len(t, diagnostic.Spans(err), len(tc.errors))
+			for _, port := range tc.errors {
+				require.Contains(t, err.Error(), fmt.Sprintf("port `%s/tcp` is exposed more than once", strings.Trim(port, `"`)))
 			}
-		},
-	)
-
-	return mod, actual
+		})
+	}
 }
 
-func validateError(t *testing.T, ctx context.Context, expected, actual error, name string) {
-	switch {
-	case expected == nil:
-		if actual != nil {
-			for _, span := range diagnostic.Spans(actual) {
-				t.Logf("[Actual]\n%s", span.Pretty(ctx))
-			}
+func TestParseModuleMetrics(t *testing.T) {
+	t.Parallel()
+
+	preg := prometheus.NewRegistry()
+	ctx := codegen.WithGlobalSolveOpts(context.Background(), solver.WithMetrics(prommetrics.NewRegistry(preg)))
+
+	_, err := codegen.ParseModule(ctx, strings.NewReader("fs default() {\n\tscratch\n}\n"))
+	require.NoError(t, err)
+	_, err = codegen.ParseModule(ctx, strings.NewReader("fs default( {"))
+	require.Error(t, err)
+
+	families, err := preg.Gather()
+	require.NoError(t, err)
+
+	var parseErrors float64
+	for _, mf := range families {
+		if mf.GetName() != solver.MetricErrors {
+			continue
 		}
-		require.NoError(t, actual, name)
-	case actual == nil:
-		if expected != nil {
-			for _, span := range diagnostic.Spans(expected) {
-				t.Logf("[Expected]\n%s", span.Pretty(ctx))
+		for _, metric := range mf.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() == string(solver.ErrorParse) {
+					parseErrors += metric.GetCounter().GetValue()
+				}
 			}
 		}
-		require.NotNil(t, actual, name)
-	default:
-		espans := diagnostic.Spans(expected)
-		aspans := diagnostic.Spans(actual)
-		require.Equal(t, len(espans), len(aspans))
-
-		for i := 0; i < len(espans); i++ {
-			epretty := espans[i].Pretty(ctx)
-			t.Logf("[Expected]\n%s", epretty)
-			apretty := aspans[i].Pretty(ctx)
-			t.Logf("[Actual]\n%s", apretty)
-			require.Equal(t, epretty, apretty, name)
-		}
 	}
+	require.Equal(t, float64(1), parseErrors)
 }
@@ -17,6 +17,7 @@ import (
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/filebuffer"
 	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/pkg/redact"
 	"github.com/openllb/hlb/solver"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -27,15 +28,42 @@ type (
 	returnTypeKey      struct{}
 	argKey             struct{ n int }
 	bindingKey         struct{}
+	bindingNameKey     struct{}
 	sessionIDKey       struct{}
 	multiwriterKey     struct{}
 	imageResolverKey   struct{}
 	backtraceKey       struct{}
 	progressKey        struct{}
 	platformKey        struct{}
+	buildPlatformKey   struct{}
 	dockerAPIKey       struct{}
 	debuggerKey        struct{}
 	globalSolveOptsKey struct{}
+	memoKey            struct{}
+	statCacheKey       struct{}
+	secretRootKey      struct{}
+	hostPolicyKey      struct{}
+	scannerKey         struct{}
+	metadataFileKey    struct{}
+	gatePolicyKey      struct{}
+	lockfileKey        struct{}
+	stageEnvKey        struct{}
+	registerHookKey    struct{}
+	evalPoolKey        struct{}
+	prewarmKey         struct{}
+	targetsKey         struct{}
+	hookRunKey         struct{}
+	targetHooksKey     struct{}
+	runHooksKey        struct{}
+	stopPointKey       struct{}
+	redactionsKey      struct{}
+	sensitiveEnvKey    struct{}
+	transferCacheKey   struct{}
+	sourceDedupKey     struct{}
+	preflightKey       struct{}
+	metricsKey         struct{}
+	lintWarnerKey      struct{}
+	callerModuleKey    struct{}
 )
 
 func WithProgramCounter(ctx context.Context, node ast.Node) context.Context {
@@ -90,6 +118,18 @@ func Binding(ctx context.Context) *ast.Binding {
 	return binding
 }
 
+// withBindingName sets the name the function being evaluated was called by.
+func withBindingName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, bindingNameKey{}, name)
+}
+
+// getBindingName returns the name the function being evaluated was called by,
+// which is the name of its binding if it is evaluated through one.
+func getBindingName(ctx context.Context) string {
+	name, _ := ctx.Value(bindingNameKey{}).(string)
+	return name
+}
+
 func WithArg(ctx context.Context, n int, arg ast.Node) context.Context {
 	return context.WithValue(ctx, argKey{n}, arg)
 }
@@ -135,6 +175,282 @@ func ImageResolver(ctx context.Context) llb.ImageMetaResolver {
 	return resolver
 }
 
+func withMemo(ctx context.Context, m *memo) context.Context {
+	return context.WithValue(ctx, memoKey{}, m)
+}
+
+func getMemo(ctx context.Context) *memo {
+	m, _ := ctx.Value(memoKey{}).(*memo)
+	return m
+}
+
+func withStatCache(ctx context.Context, c *statCache) context.Context {
+	return context.WithValue(ctx, statCacheKey{}, c)
+}
+
+func getStatCache(ctx context.Context) *statCache {
+	c, _ := ctx.Value(statCacheKey{}).(*statCache)
+	return c
+}
+
+func withSourceDedup(ctx context.Context, sd *sourceDedup) context.Context {
+	return context.WithValue(ctx, sourceDedupKey{}, sd)
+}
+
+func getSourceDedup(ctx context.Context) *sourceDedup {
+	sd, _ := ctx.Value(sourceDedupKey{}).(*sourceDedup)
+	return sd
+}
+
+func withPreflight(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, preflightKey{}, enabled)
+}
+
+func getPreflight(ctx context.Context) bool {
+	enabled, _ := ctx.Value(preflightKey{}).(bool)
+	return enabled
+}
+
+func withLintWarner(ctx context.Context, lw *lintWarner) context.Context {
+	return context.WithValue(ctx, lintWarnerKey{}, lw)
+}
+
+// getLintWarner returns the warner of findings while generating, or nil if
+// findings aren't reported.
+func getLintWarner(ctx context.Context) *lintWarner {
+	lw, _ := ctx.Value(lintWarnerKey{}).(*lintWarner)
+	return lw
+}
+
+func withMetrics(ctx context.Context, m *solver.Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+func getMetrics(ctx context.Context) *solver.Metrics {
+	m, _ := ctx.Value(metricsKey{}).(*solver.Metrics)
+	return m
+}
+
+func withTargets(ctx context.Context, targets map[*ast.FuncDecl]struct{}) context.Context {
+	return context.WithValue(ctx, targetsKey{}, targets)
+}
+
+// isSharedTarget returns true if fd is a target being generated or a stage
+// copied from by name, whose result is shared with all of its call sites.
+func isSharedTarget(ctx context.Context, fd *ast.FuncDecl) bool {
+	targets, _ := ctx.Value(targetsKey{}).(map[*ast.FuncDecl]struct{})
+	_, ok := targets[fd]
+	return ok
+}
+
+func withSecretRoot(ctx context.Context, root string) context.Context {
+	return context.WithValue(ctx, secretRootKey{}, root)
+}
+
+// SecretRoot returns the directory that local secret paths are relative to,
+// which defaults to the directory of the module being compiled.
+func SecretRoot(ctx context.Context) string {
+	root, _ := ctx.Value(secretRootKey{}).(string)
+	if root == "" {
+		return ModuleDir(ctx)
+	}
+	return root
+}
+
+// withCallerModule sets the module of the builtin being called.
+func withCallerModule(ctx context.Context, mod *ast.Module) context.Context {
+	return context.WithValue(ctx, callerModuleKey{}, mod)
+}
+
+// callerModule returns the module of the builtin being called, or nil outside
+// of a builtin.
+func callerModule(ctx context.Context) *ast.Module {
+	mod, _ := ctx.Value(callerModuleKey{}).(*ast.Module)
+	return mod
+}
+
+func withHostPolicy(ctx context.Context, policy HostPolicy) context.Context {
+	return context.WithValue(ctx, hostPolicyKey{}, policy)
+}
+
+// CheckHostAccess consults the host policy, if there is one, before a builtin
+// reads the host.
+func CheckHostAccess(ctx context.Context, access HostAccess) error {
+	policy, _ := ctx.Value(hostPolicyKey{}).(HostPolicy)
+	if policy == nil {
+		return nil
+	}
+	return policy(ctx, access)
+}
+
+func withLockfile(ctx context.Context, lf *Lockfile) context.Context {
+	return context.WithValue(ctx, lockfileKey{}, lf)
+}
+
+// getLockfile returns the lockfile that frontend refs are verified against,
+// or nil if there is none.
+func getLockfile(ctx context.Context) *Lockfile {
+	lf, _ := ctx.Value(lockfileKey{}).(*Lockfile)
+	return lf
+}
+
+func withGatePolicy(ctx context.Context, policy gatePolicy) context.Context {
+	return context.WithValue(ctx, gatePolicyKey{}, policy)
+}
+
+func getGatePolicy(ctx context.Context) gatePolicy {
+	policy, _ := ctx.Value(gatePolicyKey{}).(gatePolicy)
+	return policy
+}
+
+func withStageEnv(ctx context.Context, env *stageEnvironment) context.Context {
+	return context.WithValue(ctx, stageEnvKey{}, env)
+}
+
+// getStageEnv returns the environment of the innermost pipeline being
+// emitted, or nil outside of pipelines.
+func getStageEnv(ctx context.Context) *stageEnvironment {
+	env, _ := ctx.Value(stageEnvKey{}).(*stageEnvironment)
+	return env
+}
+
+func withMetadataFile(ctx context.Context, mf *metadataFile) context.Context {
+	return context.WithValue(ctx, metadataFileKey{}, mf)
+}
+
+// getMetadataFile returns the metadata file that pushed images are recorded
+// in, or nil if there is none.
+func getMetadataFile(ctx context.Context) *metadataFile {
+	mf, _ := ctx.Value(metadataFileKey{}).(*metadataFile)
+	return mf
+}
+
+func withHookRun(ctx context.Context, hr *hookRun) context.Context {
+	return context.WithValue(ctx, hookRunKey{}, hr)
+}
+
+// getHookRun returns the hooks of the current Generate, or nil if there are
+// none.
+func getHookRun(ctx context.Context) *hookRun {
+	hr, _ := ctx.Value(hookRunKey{}).(*hookRun)
+	return hr
+}
+
+func withTargetHooks(ctx context.Context, th *targetHooks) context.Context {
+	return context.WithValue(ctx, targetHooksKey{}, th)
+}
+
+// getTargetHooks returns the hooks of the target being generated, or nil if
+// there are none.
+func getTargetHooks(ctx context.Context) *targetHooks {
+	th, _ := ctx.Value(targetHooksKey{}).(*targetHooks)
+	return th
+}
+
+func withRunHooks(ctx context.Context, hooks *RunHooks) context.Context {
+	return context.WithValue(ctx, runHooksKey{}, hooks)
+}
+
+// getRunHooks returns the hooks of every run, or nil if there are none.
+func getRunHooks(ctx context.Context) *RunHooks {
+	hooks, _ := ctx.Value(runHooksKey{}).(*RunHooks)
+	return hooks
+}
+
+func withStopPoint(ctx context.Context, sp *stopPoint) context.Context {
+	return context.WithValue(ctx, stopPointKey{}, sp)
+}
+
+// getStopPoint returns the stop point of the target being emitted, or nil if
+// it is emitted in full.
+func getStopPoint(ctx context.Context) *stopPoint {
+	sp, _ := ctx.Value(stopPointKey{}).(*stopPoint)
+	return sp
+}
+
+func withRedactions(ctx context.Context, set *redact.Set) context.Context {
+	return context.WithValue(ctx, redactionsKey{}, set)
+}
+
+// Redactions returns the sensitive values redacted from the build, or nil if
+// nothing is redacted.
+func Redactions(ctx context.Context) *redact.Set {
+	set, _ := ctx.Value(redactionsKey{}).(*redact.Set)
+	return set
+}
+
+func withSensitiveEnv(ctx context.Context, patterns []string) context.Context {
+	return context.WithValue(ctx, sensitiveEnvKey{}, patterns)
+}
+
+// getSensitiveEnv returns the patterns of the names of environment variables
+// whose values are redacted.
+func getSensitiveEnv(ctx context.Context) []string {
+	patterns, ok := ctx.Value(sensitiveEnvKey{}).([]string)
+	if !ok || patterns == nil {
+		return DefaultSensitiveEnv
+	}
+	return patterns
+}
+
+func withScanner(ctx context.Context, scanner Scanner) context.Context {
+	return context.WithValue(ctx, scannerKey{}, scanner)
+}
+
+// getScanner returns the scanner used by scan, which defaults to a
+// TrivyScanner.
+func getScanner(ctx context.Context) Scanner {
+	scanner, _ := ctx.Value(scannerKey{}).(Scanner)
+	if scanner == nil {
+		return &TrivyScanner{}
+	}
+	return scanner
+}
+
+// withRegisterHook calls hook before every value set asynchronously on the
+// registers created with the context is computed.
+func withRegisterHook(ctx context.Context, hook func()) context.Context {
+	return context.WithValue(ctx, registerHookKey{}, hook)
+}
+
+func registerHook(ctx context.Context) func() {
+	hook, _ := ctx.Value(registerHookKey{}).(func())
+	return hook
+}
+
+func withEvalPool(ctx context.Context, pool *evalPool) context.Context {
+	return context.WithValue(ctx, evalPoolKey{}, pool)
+}
+
+func getEvalPool(ctx context.Context) *evalPool {
+	pool, _ := ctx.Value(evalPoolKey{}).(*evalPool)
+	return pool
+}
+
+func withTransferCache(ctx context.Context, cache *solver.TransferCache) context.Context {
+	return context.WithValue(ctx, transferCacheKey{}, cache)
+}
+
+// TransferCache returns the cache of the large files synced up by local
+// sources, which is only kept in memory if none was set.
+func TransferCache(ctx context.Context) *solver.TransferCache {
+	cache, _ := ctx.Value(transferCacheKey{}).(*solver.TransferCache)
+	if cache == nil {
+		return solver.NewTransferCache()
+	}
+	return cache
+}
+
+// withPrewarm marks the context as priming the cache for GeneratePrewarm.
+func withPrewarm(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prewarmKey{}, true)
+}
+
+func isPrewarm(ctx context.Context) bool {
+	prewarm, _ := ctx.Value(prewarmKey{}).(bool)
+	return prewarm
+}
+
 type Frame struct {
 	ast.Node
 	Name string
@@ -229,6 +545,22 @@ func DefaultPlatform(ctx context.Context) specs.Platform {
 	return platform
 }
 
+// WithBuildPlatform sets the platform of the BuildKit workers, which may not
+// be the platform being built for.
+func WithBuildPlatform(ctx context.Context, platform specs.Platform) context.Context {
+	return context.WithValue(ctx, buildPlatformKey{}, platform)
+}
+
+// BuildPlatform returns the platform of the BuildKit workers, which defaults
+// to linux on the architecture of the client.
+func BuildPlatform(ctx context.Context) specs.Platform {
+	platform, ok := ctx.Value(buildPlatformKey{}).(specs.Platform)
+	if !ok {
+		return specs.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	}
+	return platform
+}
+
 type DockerAPIClient struct {
 	dockerclient.APIClient
 	Auth imagetools.Auth
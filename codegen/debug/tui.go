@@ -209,6 +209,18 @@ func TUIFrontend(ctx context.Context, dbgr codegen.Debugger, is *steer.InputStee
 			goto prompt
 		case "next", "n":
 			s, serr = dbgr.Next(direction)
+		case "print", "p":
+			err = handlePrint(stdout, dbgr, args)
+			if err != nil {
+				printError(stderr, s, err)
+			}
+			goto prompt
+		case "op":
+			err = handleOp(stdout, s, dbgr, args)
+			if err != nil {
+				printError(stderr, s, err)
+			}
+			goto prompt
 		case "pwd":
 			err = handlePwd(stdout, s)
 			if err != nil {
@@ -268,8 +280,10 @@ func handleArgs(w io.Writer, s *codegen.State) error {
 		if err != nil {
 			value = fmt.Sprintf("<%s>", obj.Kind)
 		} else if obj.Kind == ast.String {
+			// Sensitive values are redacted, like in the progress of the
+			// build.
 			value, _ = val.String()
-			value = strconv.Quote(value)
+			value = strconv.Quote(codegen.RedactString(s.Ctx, value))
 		} else {
 			value = fmt.Sprintf("<%s>", obj.Kind)
 		}
@@ -278,6 +292,45 @@ func handleArgs(w io.Writer, s *codegen.State) error {
 	return nil
 }
 
+func handlePrint(w io.Writer, dbgr codegen.Debugger, args []string) error {
+	var opts []codegen.FormatOption
+	switch {
+	case len(args) == 1 && args[0] == "all":
+		opts = append(opts, codegen.WithMaxOps(0), codegen.WithMaxLength(0))
+	case len(args) > 0:
+		return errors.New("requires only 0 args or all")
+	}
+
+	out, err := dbgr.Inspect(opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, out)
+	return nil
+}
+
+func handleOp(w io.Writer, s *codegen.State, dbgr codegen.Debugger, args []string) error {
+	if len(args) != 1 {
+		return requiredArgs("op", 1)
+	}
+
+	i, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return err
+	}
+
+	node, err := dbgr.OpSource(i)
+	if err != nil {
+		return err
+	}
+
+	err = node.WithError(nil, node.Spanf(diagnostic.Primary, ""))
+	for _, span := range diagnostic.Spans(err) {
+		fmt.Fprintln(w, span.Pretty(s.Ctx, diagnostic.WithNumContext(2)))
+	}
+	return nil
+}
+
 func handleBacktrace(w io.Writer, s *codegen.State, dbgr codegen.Debugger) error {
 	frames, err := dbgr.Backtrace()
 	if err != nil {
@@ -444,6 +497,8 @@ func handleHelp(ctx context.Context, w io.Writer) {
 	printSection(ctx, w, "Viewing program variables and functions")
 	printCommand(ctx, w, "args", "", nil, "print function arguments")
 	printCommand(ctx, w, "funcs", "", nil, "print functions in this module")
+	printCommand(ctx, w, "print", "p", []string{"all"}, "print the value and options at this step, all shows every op and character")
+	printCommand(ctx, w, "op", "", []string{"op-index"}, "print the source of an op printed by print")
 	fmt.Println("")
 
 	printSection(ctx, w, "Viewing the call stack and selecting frames")
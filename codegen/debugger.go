@@ -11,6 +11,7 @@ import (
 	"github.com/moby/buildkit/solver/errdefs"
 	"github.com/openllb/hlb/diagnostic"
 	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
 	"github.com/pkg/errors"
 )
 
@@ -60,6 +61,14 @@ type Debugger interface {
 
 	// Exec starts a process in the current debugging state.
 	Exec(ctx context.Context, stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) error
+
+	// Inspect renders the value in the current debugging state, followed by
+	// the options of the call it is stopped at.
+	Inspect(opts ...FormatOption) (string, error)
+
+	// OpSource returns the node that emitted an op, numbered as rendered by
+	// the last Inspect.
+	OpSource(i int) (ast.Node, error)
 }
 
 // DebugMode is a mode of the debugger that affects control flow.
@@ -104,9 +113,13 @@ type State struct {
 
 type debugger struct {
 	cln *client.Client
-	err error
 	mu  sync.Mutex
 
+	// err is guarded by its own lock, because mu is held by the compiler
+	// while it runs, and Terminate is called while it does.
+	err   error
+	errMu sync.Mutex
+
 	cursor    *State
 	direction Direction
 	mode      DebugMode
@@ -115,9 +128,17 @@ type debugger struct {
 	done chan struct{}
 	wg   sync.WaitGroup
 
+	// terminated is closed when the debugging session ends, canceling the
+	// contexts of solves and execs started during it.
+	terminated    chan struct{}
+	terminateOnce sync.Once
+
 	recording      []*State
 	recordingIndex int
 
+	// inspected are the ops rendered by the last Inspect.
+	inspected []*Op
+
 	loadedSourceDefinedBreakpoints bool
 	sourceDefinedBreakpoints       []*Breakpoint
 	breakpoints                    []*Breakpoint
@@ -141,6 +162,7 @@ func NewDebugger(cln *client.Client, opts ...DebuggerOption) Debugger {
 		cln:           cln,
 		mode:          DebugStartStop,
 		done:          make(chan struct{}),
+		terminated:    make(chan struct{}),
 		control:       make(chan DebugMode),
 		breakpointIDs: make(map[string]struct{}),
 	}
@@ -154,8 +176,8 @@ func NewDebugger(cln *client.Client, opts ...DebuggerOption) Debugger {
 func (d *debugger) GetState() (*State, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if d.err != nil {
-		return nil, d.err
+	if err := d.getErr(); err != nil {
+		return nil, err
 	}
 	return d.recording[d.recordingIndex], nil
 }
@@ -233,17 +255,57 @@ func (d *debugger) ClearBreakpoint(bp *Breakpoint) error {
 
 func (d *debugger) Terminate() error {
 	// Set debugger error so that next yield it exits early.
-	d.err = ErrDebugExit
+	d.setErr(ErrDebugExit)
+	// Cancel in-flight solves and execs before waiting on control, as they may
+	// be what the debugger is blocked on.
+	d.terminate()
 	d.sendControl(DebugTerminate, NoneDirection)
 	return nil
 }
 
+func (d *debugger) terminate() {
+	d.terminateOnce.Do(func() {
+		close(d.terminated)
+	})
+}
+
+// withTerminate returns a context that is also canceled when the debugging
+// session ends, so that solves and execs started during it are not left
+// running in BuildKit. The session stops being watched when the returned
+// function is called, or when ctx is done.
+func (d *debugger) withTerminate(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-d.terminated:
+		}
+	}()
+	return ctx, cancel
+}
+
+// terminateRequest stops watching for the end of the debugging session once
+// its request is solved.
+type terminateRequest struct {
+	solver.Request
+	stop context.CancelFunc
+}
+
+func (r *terminateRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	defer r.stop()
+	return r.Request.Solve(ctx, cln, mw, opts...)
+}
+
 func (d *debugger) Exec(ctx context.Context, stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) error {
 	s, err := d.GetState()
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := d.withTerminate(ctx)
+	defer cancel()
+
 	var se *errdefs.SolveError
 	if errors.As(s.Err, &se) {
 		var ge *gatewayError
@@ -269,6 +331,66 @@ func (d *debugger) Exec(ctx context.Context, stdin io.ReadCloser, stdout, stderr
 	return ExecWithFS(ctx, d.cln, fs, s.Options, stdin, stdout, stderr, args...)
 }
 
+func (d *debugger) Inspect(opts ...FormatOption) (string, error) {
+	s, err := d.GetState()
+	if err != nil {
+		return "", err
+	}
+	d.inspected = nil
+	if s.Value == nil {
+		return "", errors.New("no value to inspect")
+	}
+
+	opts = append([]FormatOption{WithOrigin(s.Node)}, opts...)
+	out, err := FormatValue(s.Ctx, s.Value, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if s.Value.Kind() == ast.Filesystem {
+		fs, err := s.Value.Filesystem()
+		if err != nil {
+			return "", err
+		}
+		op, err := FilesystemOp(s.Ctx, fs)
+		if err != nil {
+			return "", err
+		}
+		d.inspected = FormatOps(op, newFormatInfo(opts).MaxOps)
+	}
+
+	call, ok := s.Node.(*ast.CallStmt)
+	if ok && call.WithClause != nil && len(s.Options) > 0 {
+		with, err := FormatValue(s.Ctx, &optValue{&nilValue{}, s.Options}, append(opts, WithOptionSource(call))...)
+		if err != nil {
+			return "", err
+		}
+		out = fmt.Sprintf("%s\nwith option\n  %s", out, strings.ReplaceAll(with, "\n", "\n  "))
+	}
+	return out, nil
+}
+
+func (d *debugger) OpSource(i int) (ast.Node, error) {
+	s, err := d.GetState()
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(d.inspected) {
+		return nil, fmt.Errorf("no op #%d, inspect a filesystem first", i)
+	}
+
+	pos := d.inspected[i].Position
+	mod := ast.Modules(s.Ctx).Get(pos.Filename)
+	if mod == nil {
+		return nil, fmt.Errorf("no source for op #%d", i)
+	}
+	node := ast.Find(mod, pos.Line, pos.Column, ast.StopNodeFilter)
+	if node == nil {
+		return nil, fmt.Errorf("no source for op #%d at %s", i, formatPosition(pos))
+	}
+	return node, nil
+}
+
 func (d *debugger) sendControl(control DebugMode, direction Direction) {
 	// Prevent control being sent in parallel.
 	d.mu.Lock()
@@ -294,9 +416,11 @@ func (d *debugger) sendControl(control DebugMode, direction Direction) {
 
 func (d *debugger) Close() error {
 	// Set the debugger exit err.
-	d.err = ErrDebugExit
+	d.setErr(ErrDebugExit)
 	// Cancel incoming control signals.
 	close(d.done)
+	// Cancel in-flight solves and execs.
+	d.terminate()
 	// Wait for clients to exit gracefully.
 	d.wg.Wait()
 	// Close control signal channel.
@@ -308,8 +432,8 @@ func (d *debugger) Close() error {
 
 func (d *debugger) yield(ctx context.Context, scope *ast.Scope, node ast.Node, val Value, opts Option, yieldErr error) error {
 	// If debugger has an error, continue to exit.
-	if d.err != nil {
-		return d.err
+	if err := d.getErr(); err != nil {
+		return err
 	}
 
 	if yieldErr == nil && d.cln != nil {
@@ -344,12 +468,24 @@ func (d *debugger) yield(ctx context.Context, scope *ast.Scope, node ast.Node, v
 
 	last := d.recording[len(d.recording)-1]
 	if last.Err != nil {
-		d.err = ErrDebugExit
-		return d.err
+		d.setErr(ErrDebugExit)
+		return ErrDebugExit
 	}
 	return nil
 }
 
+func (d *debugger) getErr() error {
+	d.errMu.Lock()
+	defer d.errMu.Unlock()
+	return d.err
+}
+
+func (d *debugger) setErr(err error) {
+	d.errMu.Lock()
+	defer d.errMu.Unlock()
+	d.err = err
+}
+
 func (d *debugger) playback(s *State) error {
 	mod, ok := s.Node.(*ast.Module)
 	if ok && !d.loadedSourceDefinedBreakpoints {
@@ -387,6 +523,11 @@ func (d *debugger) stopReason(s *State) string {
 		return "exception"
 	}
 
+	// The stop point of a partial solve is always stopped at.
+	if sp := getStopPoint(s.Ctx); sp != nil && s.Node == ast.Node(sp.stmt) {
+		return "stop point"
+	}
+
 	switch d.mode {
 	case DebugStartStop, DebugRestart, DebugStep:
 		return "step"
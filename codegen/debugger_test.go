@@ -1,7 +1,18 @@
 package codegen
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
 )
 
 func TestDebugger(t *testing.T) {
@@ -9,3 +20,82 @@ func TestDebugger(t *testing.T) {
 		return NewDebugger(nil)
 	})
 }
+
+func TestDebuggerTerminateCancels(t *testing.T) {
+	t.Parallel()
+
+	input := `
+	fs default() {
+		image "alpine"
+	}
+	`
+
+	controlDebugger(t, NewDebugger(nil), input, func(t *testing.T, d Debugger, mod *ast.Module) {
+		s, err := d.GetState()
+		require.NoError(t, err)
+		require.NoError(t, s.Ctx.Err())
+
+		err = d.Terminate()
+		require.NoError(t, err)
+
+		// Solves started at the breakpoint use the state's context.
+		select {
+		case <-time.After(3 * time.Second):
+			t.Fatal("terminating the debugger should cancel its context")
+		case <-s.Ctx.Done():
+		}
+	})
+}
+
+// solvedRequest is a request whose solve returns immediately.
+type solvedRequest struct{}
+
+func (r solvedRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	return nil
+}
+
+func (r solvedRequest) Tree(tree treeprint.Tree) error {
+	return nil
+}
+
+func TestDebuggerTerminateStopsAfterSolve(t *testing.T) {
+	t.Parallel()
+
+	d := NewDebugger(nil).(*debugger)
+	ctx, stop := d.withTerminate(context.Background())
+	req := &terminateRequest{Request: solvedRequest{}, stop: stop}
+	require.NoError(t, req.Solve(ctx, nil, nil))
+
+	// The session stops being watched once the request is solved, even if
+	// the debugger is never terminated.
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("solving the request should stop watching the debugger")
+	case <-ctx.Done():
+	}
+}
+
+func TestDebuggerBindingEvaluatedOnce(t *testing.T) {
+	t.Parallel()
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	input := fmt.Sprintf(`
+	fs default() {
+		image "alpine"
+		run localRun("echo run >> %s; echo true") with option {
+			mount scratch "/out" as artifacts
+		}
+		copy artifacts "/" "/a"
+		copy artifacts "/" "/b"
+	}
+	`, runs)
+
+	controlDebugger(t, NewDebugger(nil), input, func(t *testing.T, d Debugger, mod *ast.Module) {
+		_, err := d.Continue(ForwardDirection)
+		require.ErrorIs(t, err, ErrDebugExit)
+	})
+
+	dt, err := os.ReadFile(runs)
+	require.NoError(t, err)
+	require.Equal(t, "run\n", string(dt))
+}
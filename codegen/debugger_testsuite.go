@@ -111,7 +111,7 @@ func stepout(direction Direction) movement {
 func SubtestDebuggerMovement(t *testing.T, d Debugger) {
 	input := `
 	fs default() {
-		build
+		_build
 	}
 
 	fs src() {
@@ -135,7 +135,7 @@ func SubtestDebuggerMovement(t *testing.T, d Debugger) {
 
 	controlDebugger(t, d, input, func(t *testing.T, d Debugger, mod *ast.Module) {
 		line1 := ast.Search(mod, `fs default()`)
-		line2 := ast.Search(mod, `build`)
+		line2 := ast.Search(mod, `_build`)
 		line5 := ast.Search(mod, `fs src()`)
 		line6 := ast.Search(mod, `local "."`)
 		line7 := ast.Search(mod, `breakpoint`)
@@ -592,7 +592,7 @@ func generate(t *testing.T, ctx context.Context, input string) {
 	require.NoError(t, err)
 
 	cg := New(nil, nil)
-	_, err = cg.Generate(ctx, mod, []Target{{"default"}})
+	_, err = cg.Generate(ctx, mod, []Target{{Name: "default"}})
 	if err != nil {
 		require.ErrorIs(t, err, ErrDebugExit)
 	}
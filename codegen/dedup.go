@@ -0,0 +1,283 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+	"golang.org/x/sync/singleflight"
+)
+
+// sourceDedup shares the sources emitted by the targets of a single Generate,
+// since each target is emitted independently even when they start from the
+// same image or local directory. It is created per Generate rather than per
+// CodeGen, so that a source is never shared with a later build that may see
+// a different registry or filesystem.
+//
+// Only the work that is the same for every call site is shared: images share
+// the resolution of their config, local sources share their registration in
+// the session, http and git sources share their state, whose source op is
+// keyed by all of its attributes, and sources with fallback urls share the url
+// that was fetched.
+type sourceDedup struct {
+	images    dedupCache
+	locals    dedupCache
+	https     dedupCache
+	gits      dedupCache
+	fallbacks dedupCache
+}
+
+func newSourceDedup() *sourceDedup {
+	return &sourceDedup{}
+}
+
+// dedupStats counts the sources that were shared rather than emitted again.
+type dedupStats struct {
+	Images int64
+	Locals int64
+	HTTPs  int64
+	Gits   int64
+}
+
+func (s dedupStats) total() int64 {
+	return s.Images + s.Locals + s.HTTPs + s.Gits
+}
+
+func (s dedupStats) String() string {
+	return fmt.Sprintf("%s, %s, %s, %s",
+		plural(s.Images, "image resolution"),
+		plural(s.Locals, "local source"),
+		plural(s.HTTPs, "http source"),
+		plural(s.Gits, "git source"),
+	)
+}
+
+func plural(n int64, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func (sd *sourceDedup) stats() dedupStats {
+	if sd == nil {
+		return dedupStats{}
+	}
+	return dedupStats{
+		Images: sd.images.hitCount(),
+		Locals: sd.locals.hitCount(),
+		HTTPs:  sd.https.hitCount(),
+		Gits:   sd.gits.hitCount(),
+	}
+}
+
+// resolveImageConfig resolves the config of an image once per ref, platform
+// and resolve mode.
+func (sd *sourceDedup) resolveImageConfig(ctx context.Context, resolver llb.ImageMetaResolver, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	if sd == nil {
+		getMetrics(ctx).ObserveResolve("image")
+		return resolver.ResolveImageConfig(ctx, ref, opt)
+	}
+
+	v, err := sd.images.Do(fmt.Sprintf("%+v", newCacheKey(ref, opt)), func() (interface{}, error) {
+		getMetrics(ctx).ObserveResolve("image")
+		dgst, config, err := resolver.ResolveImageConfig(ctx, ref, opt)
+		if err != nil {
+			return nil, err
+		}
+		return &imageConfig{dgst, config}, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	cfg := v.(*imageConfig)
+	return cfg.dgst, cfg.config, nil
+}
+
+// localRegistration is the registration of a local source in the session,
+// and the solve options and large files that go with it.
+type localRegistration struct {
+	sessionOpts []llbutil.SessionOption
+	solveOpts   []solver.SolveOption
+	largeFiles  []solver.LargeFile
+}
+
+// registerLocal registers a local source once per id, which is derived from
+// its path and options, name and synced directory.
+func (sd *sourceDedup) registerLocal(id, name, dir string, fn func() (*localRegistration, error)) (*localRegistration, error) {
+	if sd == nil {
+		return fn()
+	}
+
+	v, err := sd.locals.Do(strings.Join([]string{id, name, dir}, "\x00"), func() (interface{}, error) {
+		return fn()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*localRegistration), nil
+}
+
+// httpSource returns the first state emitted with the same source op as st.
+func (sd *sourceDedup) httpSource(ctx context.Context, st llb.State) (llb.State, error) {
+	if sd == nil {
+		return st, nil
+	}
+	return sd.https.source(ctx, st)
+}
+
+// gitSource returns the first state emitted with the same source op as st.
+func (sd *sourceDedup) gitSource(ctx context.Context, st llb.State) (llb.State, error) {
+	if sd == nil {
+		return st, nil
+	}
+	return sd.gits.source(ctx, st)
+}
+
+// fallback returns the url that fn picks from urls once per list of sources,
+// which are keyed like the sources they are shared with.
+func (sd *sourceDedup) fallback(ctx context.Context, urls []string, source func(url string) llb.State, fn func() (string, error)) (string, error) {
+	if sd == nil {
+		return fn()
+	}
+
+	keys := make([]string, 0, len(urls))
+	for _, url := range urls {
+		key, err := sourceKey(ctx, source(url))
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, key)
+	}
+
+	v, err := sd.fallbacks.Do(strings.Join(keys, "\x00\x00"), func() (interface{}, error) {
+		return fn()
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// sourceKey returns the identifier and attributes of the source op of st, or
+// an empty string if st is not a source.
+func sourceKey(ctx context.Context, st llb.State) (string, error) {
+	src, err := llbutil.SourceOp(ctx, st)
+	if err != nil || src == nil {
+		return "", err
+	}
+	attrs, err := json.Marshal(src.Attrs)
+	if err != nil {
+		return "", err
+	}
+	return src.Identifier + "\x00" + string(attrs), nil
+}
+
+// dedupCache holds the results of a category of sources, keyed by everything
+// that makes them differ, and counts the calls that were shared.
+type dedupCache struct {
+	g       singleflight.Group
+	mu      sync.Mutex
+	results map[string]interface{}
+	hits    int64
+}
+
+// Do returns the cached result for key, invoking fn at most once even when
+// called concurrently. Errors are not cached, but are shared by concurrent
+// calls.
+func (c *dedupCache) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	v, ok := c.results[key]
+	c.mu.Unlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+		return v, nil
+	}
+
+	var called bool
+	v, err, _ := c.g.Do(key, func() (interface{}, error) {
+		called = true
+		v, err := fn()
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		if c.results == nil {
+			c.results = make(map[string]interface{})
+		}
+		c.results[key] = v
+		c.mu.Unlock()
+		return v, nil
+	})
+	if err == nil && !called {
+		atomic.AddInt64(&c.hits, 1)
+	}
+	return v, err
+}
+
+func (c *dedupCache) hitCount() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// source returns the first state emitted with the same source op as st. The
+// source op is keyed by its identifier and attributes, which excludes the
+// source map, so the shared state keeps the source map of its first call.
+func (c *dedupCache) source(ctx context.Context, st llb.State) (llb.State, error) {
+	key, err := sourceKey(ctx, st)
+	if err != nil || key == "" {
+		return st, err
+	}
+
+	v, err := c.Do(key, func() (interface{}, error) {
+		return st, nil
+	})
+	if err != nil {
+		return st, err
+	}
+	return v.(llb.State), nil
+}
+
+// dedupRequest solves the request of a Generate and writes how many sources
+// its targets shared to the diagnostic writer.
+type dedupRequest struct {
+	w   io.Writer
+	sd  *sourceDedup
+	req solver.Request
+}
+
+func (r *dedupRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	err := r.req.Solve(ctx, cln, mw, opts...)
+	if err != nil {
+		return err
+	}
+
+	stats := r.sd.stats()
+	if r.w == nil || stats.total() == 0 {
+		return nil
+	}
+
+	// Wait for the progress of the solve to be written before the summary.
+	if p := Progress(ctx); p != nil {
+		err := p.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(r.w, "deduplicated sources: %s\n", stats)
+	return nil
+}
+
+func (r *dedupRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
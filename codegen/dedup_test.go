@@ -0,0 +1,277 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+type countingResolver struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (r *countingResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[fmt.Sprintf("%s %s/%s", ref, opt.Platform.OS, opt.Platform.Architecture)]++
+	return digest.FromString(ref), []byte("{}"), nil
+}
+
+func TestSourceDedup(t *testing.T) {
+	t.Parallel()
+
+	const n = 12
+	var (
+		src     strings.Builder
+		targets []Target
+	)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("target%d", i)
+		fmt.Fprintf(&src, `
+	fs %s() {
+		image "golang:1.22"
+		run "echo %d"
+	}
+	`, name, i)
+		targets = append(targets, Target{Name: name})
+	}
+
+	ctx, mod := parseTestModule(t, src.String())
+	resolver := &countingResolver{calls: make(map[string]int)}
+	ctx = WithImageResolver(ctx, resolver)
+
+	req, err := New(nil, nil).Generate(ctx, mod, targets)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"docker.io/library/golang:1.22 linux/amd64": 1,
+	}, resolver.calls)
+
+	dr, ok := req.Request.(*dedupRequest)
+	require.True(t, ok)
+	require.Equal(t, dedupStats{Images: n - 1}, dr.sd.stats())
+
+	// Each Generate has its own cache, so the image is resolved again.
+	_, err = New(nil, nil).Generate(ctx, mod, targets[:1])
+	require.NoError(t, err)
+	require.Equal(t, 2, resolver.calls["docker.io/library/golang:1.22 linux/amd64"])
+}
+
+func TestSourceDedupAttrs(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	fs image1() {
+		image "alpine"
+	}
+	fs image2() {
+		image "alpine"
+	}
+	fs imageArm() {
+		image "alpine" with platform("linux", "arm64")
+	}
+	fs http1() {
+		http "https://example.com/file"
+	}
+	fs http2() {
+		http "https://example.com/file"
+	}
+	fs httpChecksum() {
+		http "https://example.com/file" with checksum("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	}
+	fs git1() {
+		git "https://github.com/openllb/hlb.git" "main"
+	}
+	fs git2() {
+		git "https://github.com/openllb/hlb.git" "main"
+	}
+	fs gitKeepDir() {
+		git "https://github.com/openllb/hlb.git" "main" with keepGitDir
+	}
+	fs local1() {
+		local "."
+	}
+	fs local2() {
+		local "."
+	}
+	fs localIncludes() {
+		local "." with includePatterns("*.go")
+	}
+	`)
+	resolver := &countingResolver{calls: make(map[string]int)}
+	ctx = WithImageResolver(ctx, resolver)
+
+	var targets []Target
+	for _, name := range []string{
+		"image1", "image2", "imageArm",
+		"http1", "http2", "httpChecksum",
+		"git1", "git2", "gitKeepDir",
+		"local1", "local2", "localIncludes",
+	} {
+		targets = append(targets, Target{Name: name})
+	}
+
+	req, err := New(nil, nil).Generate(ctx, mod, targets)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"docker.io/library/alpine:latest linux/amd64": 1,
+		"docker.io/library/alpine:latest linux/arm64": 1,
+	}, resolver.calls)
+
+	// Only the sources without differing attributes are shared.
+	dr, ok := req.Request.(*dedupRequest)
+	require.True(t, ok)
+	require.Equal(t, dedupStats{Images: 1, Locals: 1, HTTPs: 1, Gits: 1}, dr.sd.stats())
+}
+
+// TestSourceDedupMemo checks that sharing image resolutions does not change
+// which functions are memoized, by counting the evaluations of images as the
+// resolutions plus the resolutions that were shared.
+func TestSourceDedupMemo(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name        string
+		targets     []string
+		input       string
+		evaluations map[string]int
+	}
+
+	for _, tc := range []testCase{{
+		"nomemo pragma is evaluated at every call site",
+		[]string{"build", "test"},
+		`
+		# hlb:nomemo
+		fs baseImage() {
+			image "acme/base:1.2"
+		}
+		fs build() {
+			baseImage
+			run "make"
+		}
+		fs test() {
+			baseImage
+			run "make test"
+		}
+		`,
+		map[string]int{"docker.io/acme/base:1.2": 2},
+	}, {
+		"impure constant is evaluated at every call site",
+		[]string{"build", "test"},
+		`
+		string tag() {
+			localEnv "HLB_MEMO_TEST_TAG"
+		}
+		fs baseImage() {
+			image "acme/base:1.2${tag}"
+		}
+		fs build() {
+			baseImage
+			run "make"
+		}
+		fs test() {
+			baseImage
+			run "make test"
+		}
+		`,
+		map[string]int{"docker.io/acme/base:1.2": 2},
+	}, {
+		"impure function that is not a target is evaluated at every call site",
+		[]string{"test"},
+		`
+		fs build() {
+			image "acme/base:1.2"
+			env "TAG" localEnv("HLB_MEMO_TEST_TAG")
+			run "make"
+		}
+		fs test() {
+			image "acme/test:1.0"
+			run "make test" with option {
+				mount build "/src" with readonly
+				mount build "/src2" with readonly
+			}
+		}
+		`,
+		map[string]int{"docker.io/acme/base:1.2": 2, "docker.io/acme/test:1.0": 1},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, mod := parseTestModule(t, tc.input)
+			resolver := &countingResolver{calls: make(map[string]int)}
+			ctx = WithImageResolver(ctx, resolver)
+
+			var targets []Target
+			for _, target := range tc.targets {
+				targets = append(targets, Target{Name: target})
+			}
+			req, err := New(nil, nil).Generate(ctx, mod, targets)
+			require.NoError(t, err)
+
+			// Each image is only resolved once per Generate.
+			var evaluations int
+			for ref, n := range tc.evaluations {
+				require.Equal(t, 1, resolver.calls[ref+" linux/amd64"], ref)
+				evaluations += n
+			}
+			require.Len(t, resolver.calls, len(tc.evaluations))
+
+			dr, ok := req.Request.(*dedupRequest)
+			require.True(t, ok)
+			require.Equal(t, int64(evaluations-len(tc.evaluations)), dr.sd.stats().Images)
+		})
+	}
+}
+
+func TestDedupStats(t *testing.T) {
+	t.Parallel()
+
+	stats := dedupStats{Images: 11, Locals: 1, Gits: 2}
+	require.Equal(t, int64(14), stats.total())
+	require.Equal(t, "11 image resolutions, 1 local source, 0 http sources, 2 git sources", stats.String())
+}
+
+func TestSourceDedupFallback(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx     = context.Background()
+		sd      = newSourceDedup()
+		mirrors = []string{"https://example.com/app.tar.gz", "https://mirror.example.com/app.tar.gz"}
+		probes  int
+	)
+	probe := func() (string, error) {
+		probes++
+		return mirrors[1], nil
+	}
+	source := func(opts ...llb.HTTPOption) func(url string) llb.State {
+		return func(url string) llb.State {
+			return llb.HTTP(url, opts...)
+		}
+	}
+
+	// The urls of the same sources are only probed once.
+	for i := 0; i < 3; i++ {
+		url, err := sd.fallback(ctx, mirrors, source(), probe)
+		require.NoError(t, err)
+		require.Equal(t, mirrors[1], url)
+	}
+	require.Equal(t, 1, probes)
+
+	// Sources with other attributes may fail differently, so they are
+	// probed again.
+	_, err := sd.fallback(ctx, mirrors, source(llb.Filename("app.tgz")), probe)
+	require.NoError(t, err)
+	require.Equal(t, 2, probes)
+
+	_, err = sd.fallback(ctx, mirrors[1:], source(), probe)
+	require.NoError(t, err)
+	require.Equal(t, 3, probes)
+}
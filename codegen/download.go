@@ -0,0 +1,194 @@
+package codegen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/errdefs"
+)
+
+// contentFilenameTemplate keeps the name of a downloaded file, and adds the
+// extension of its content type when it has none.
+var contentFilenameTemplate = template.Must(template.New("contentFilename").Parse("{{.Base}}{{.Ext}}"))
+
+// downloadFile is the data of the filename template of a downloaded file.
+type downloadFile struct {
+	path string
+
+	// Name is the name of the file in the filesystem, and Base is the name
+	// without its extension Ext.
+	Name string
+	Base string
+	Ext  string
+}
+
+// Digest returns the hex encoded sha256 digest of the file, which is only
+// computed when a template refers to it.
+func (df *downloadFile) Digest() (string, error) {
+	f, err := os.Open(df.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dgst, err := digest.FromReader(f)
+	if err != nil {
+		return "", err
+	}
+	return dgst.Encoded(), nil
+}
+
+// moveDownload moves the single file downloaded to dir into localPath, with
+// the name given by the filename template.
+func moveDownload(dir, localPath string, df *DownloadFilename) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || !entries[0].Type().IsRegular() {
+		var names []string
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		return errdefs.WithDownloadNotSingleFile(df.Node, names)
+	}
+
+	name, err := downloadName(filepath.Join(dir, entries[0].Name()), df.Template)
+	if err != nil {
+		return df.Node.WithError(err)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return errdefs.WithInvalidDownloadName(df.Node, name)
+	}
+	return os.Rename(filepath.Join(dir, entries[0].Name()), filepath.Join(localPath, name))
+}
+
+// downloadName executes a filename template for the file at path.
+func downloadName(path string, tmpl *template.Template) (string, error) {
+	name := filepath.Base(path)
+	base, ext := splitExt(name)
+	if ext == "" {
+		var err error
+		ext, err = contentExt(path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, &downloadFile{
+		path: path,
+		Name: name,
+		Base: base,
+		Ext:  ext,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// splitExt splits a name into its base and extension, keeping the ".tar" of
+// compressed tarballs in the extension.
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	if ext == name {
+		// Names of hidden files like ".bashrc" have no extension.
+		return name, ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	if tarExt := filepath.Ext(base); strings.EqualFold(tarExt, ".tar") && tarExt != base {
+		base, ext = strings.TrimSuffix(base, tarExt), tarExt+ext
+	}
+	return base, ext
+}
+
+// contentExts are the extensions of the content types detected by
+// http.DetectContentType. Text types are left out, as text files like scripts
+// are usually named without an extension on purpose.
+var contentExts = map[string]string{
+	"application/pdf":              ".pdf",
+	"application/wasm":             ".wasm",
+	"application/x-gzip":           ".gz",
+	"application/x-rar-compressed": ".rar",
+	"application/zip":              ".zip",
+	"image/gif":                    ".gif",
+	"image/jpeg":                   ".jpg",
+	"image/png":                    ".png",
+	"image/webp":                   ".webp",
+}
+
+// magicExts are the extensions of archive formats that
+// http.DetectContentType does not detect, by their magic numbers.
+var magicExts = []struct {
+	magic []byte
+	ext   string
+}{
+	{[]byte("BZh"), ".bz2"},
+	{[]byte("\xfd7zXZ\x00"), ".xz"},
+	{[]byte("\x28\xb5\x2f\xfd"), ".zst"},
+}
+
+// contentExt returns the extension of the content type of the file at path,
+// or an empty string if it is not known.
+func contentExt(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	if isTar(head) {
+		return ".tar", nil
+	}
+	for _, me := range magicExts {
+		if bytes.HasPrefix(head, me.magic) {
+			return me.ext, nil
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "", nil
+	}
+	ext := contentExts[mediaType]
+	if ext == ".gz" {
+		// Gzipped tarballs are recognized by the header of the tarball.
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+		zr, err := gzip.NewReader(f)
+		if err == nil {
+			n, _ := io.ReadFull(zr, head[:cap(head)])
+			if isTar(head[:n]) {
+				ext = ".tar.gz"
+			}
+		}
+	}
+	return ext, nil
+}
+
+// isTar returns whether the head of a file is the header of a tarball.
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
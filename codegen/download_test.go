@@ -0,0 +1,146 @@
+package codegen
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func tarball(t *testing.T, compress bool) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.Writer = &buf
+		zw  *gzip.Writer
+	)
+	if compress {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	err := tw.WriteHeader(&tar.Header{Name: "bin/app", Mode: 0o755, Size: 4})
+	require.NoError(t, err)
+	_, err = tw.Write([]byte("#!/s"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	if compress {
+		require.NoError(t, zw.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestMoveDownload(t *testing.T) {
+	t.Parallel()
+
+	mod, err := parser.Parse(context.Background(), strings.NewReader(`
+fs default() {
+	http "https://example.com/download"
+	download "." with contentFilename
+}
+`))
+	require.NoError(t, err)
+	node := ast.Search(mod, "contentFilename")
+	require.NotNil(t, node)
+
+	tgz := tarball(t, true)
+	for _, tc := range []struct {
+		name     string
+		files    map[string][]byte
+		template string
+		expected string
+		err      string
+	}{{
+		name:     "keeps extension",
+		files:    map[string][]byte{"app.tar.gz": []byte("not gzip")},
+		template: "{{.Base}}{{.Ext}}",
+		expected: "app.tar.gz",
+	}, {
+		name:     "gzipped tarball",
+		files:    map[string][]byte{"index": tgz},
+		template: "{{.Base}}{{.Ext}}",
+		expected: "index.tar.gz",
+	}, {
+		name:     "tarball",
+		files:    map[string][]byte{"download": tarball(t, false)},
+		template: "{{.Base}}{{.Ext}}",
+		expected: "download.tar",
+	}, {
+		name:     "zip",
+		files:    map[string][]byte{"release": []byte("PK\x03\x04rest")},
+		template: "{{.Base}}{{.Ext}}",
+		expected: "release.zip",
+	}, {
+		name:     "text is not renamed",
+		files:    map[string][]byte{"install": []byte("#!/bin/sh\necho hello\n")},
+		template: "{{.Base}}{{.Ext}}",
+		expected: "install",
+	}, {
+		name:     "hidden file",
+		files:    map[string][]byte{".bashrc": []byte("alias ll='ls -l'\n")},
+		template: "{{.Base}}{{.Ext}}",
+		expected: ".bashrc",
+	}, {
+		name:     "digest",
+		files:    map[string][]byte{"index": tgz},
+		template: "app-{{printf \"%.12s\" .Digest}}{{.Ext}}",
+		expected: "app-" + digest.FromBytes(tgz).Encoded()[:12] + ".tar.gz",
+	}, {
+		name:     "path separator",
+		files:    map[string][]byte{"index": tgz},
+		template: "../{{.Name}}",
+		err:      `invalid download filename "../index"`,
+	}, {
+		name:     "several files",
+		files:    map[string][]byte{"a": nil, "b": nil},
+		template: "{{.Name}}",
+		err:      "cannot name a download of 2 files: a, b",
+	}, {
+		name:     "empty",
+		template: "{{.Name}}",
+		err:      "cannot name a download of an empty filesystem",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			localPath := t.TempDir()
+			err := os.WriteFile(filepath.Join(localPath, "existing"), nil, 0o644)
+			require.NoError(t, err)
+
+			dir, err := os.MkdirTemp(localPath, ".download-")
+			require.NoError(t, err)
+			for name, dt := range tc.files {
+				err = os.WriteFile(filepath.Join(dir, name), dt, 0o644)
+				require.NoError(t, err)
+			}
+
+			err = moveDownload(dir, localPath, &DownloadFilename{
+				Template: template.Must(template.New("").Option("missingkey=error").Parse(tc.template)),
+				Node:     node,
+			})
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+
+			dt, err := os.ReadFile(filepath.Join(localPath, tc.expected))
+			require.NoError(t, err)
+			for _, expected := range tc.files {
+				require.Equal(t, expected, dt)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package codegen
+
+import "sync"
+
+// WithRegisterConcurrency bounds the number of goroutines that compute values
+// set asynchronously on registers, so that generating a large module does not
+// spawn a goroutine for every statement and argument. A value that is read
+// before a worker picks it up is computed by the goroutine reading it. By
+// default, every value is computed in its own goroutine.
+func WithRegisterConcurrency(n int) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.evalPool = newEvalPool(n)
+	}
+}
+
+// evalPool is a bounded pool of workers computing register values in the
+// order they were set.
+//
+// Values wait on the values set before them and on the values they read, so
+// workers blocked on a pending value would starve the pool. Instead, a value
+// is computed by whichever goroutine reaches it first, a worker or a reader,
+// and it is only computed once.
+type evalPool struct {
+	sem chan struct{}
+
+	mu    sync.Mutex
+	queue []*lazyValue
+}
+
+func newEvalPool(n int) *evalPool {
+	if n <= 0 {
+		return nil
+	}
+	return &evalPool{sem: make(chan struct{}, n)}
+}
+
+// submit queues a value to be computed, and starts a worker if the pool is
+// not full.
+func (p *evalPool) submit(lazy *lazyValue) {
+	p.mu.Lock()
+	p.queue = append(p.queue, lazy)
+	p.mu.Unlock()
+
+	select {
+	case p.sem <- struct{}{}:
+		go p.work()
+	default:
+	}
+}
+
+// work computes queued values until the queue is empty. The worker releases
+// its slot while holding the lock, so a value submitted after it checked the
+// queue always finds a free slot.
+func (p *evalPool) work() {
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			<-p.sem
+			p.mu.Unlock()
+			return
+		}
+		lazy := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		lazy.wait()
+	}
+}
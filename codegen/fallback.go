@@ -0,0 +1,88 @@
+package codegen
+
+import (
+	"context"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/openllb/hlb/errdefs"
+)
+
+// Fallback is a list of alternate urls of a http or git source, like mirrors,
+// that are tried in order when the urls before them fail.
+type Fallback struct {
+	URLs []string
+}
+
+func (f Fallback) Call(ctx context.Context, cln *client.Client, val Value, opts Option, urls ...string) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+	return NewValue(ctx, append(retOpts, &Fallback{URLs: urls}))
+}
+
+// fallbackSource returns the source of the first of urls that can be fetched.
+// Each url is fetched in a build of its own until one succeeds, which leaves
+// it in the cache for the build of the source. The build has the session and
+// solve options the source is solved with, so a url is fetched the way its
+// source would be. Without a client, nothing can be fetched, so the source of
+// the first url is returned.
+//
+// Targets often share a source, so the urls are only tried once per Generate
+// for the same sources.
+func fallbackSource(ctx context.Context, cln *client.Client, urls []string, source func(url string) llb.State) (llb.State, error) {
+	if len(urls) == 1 || cln == nil {
+		return source(urls[0]), nil
+	}
+
+	url, err := getSourceDedup(ctx).fallback(ctx, urls, source, func() (string, error) {
+		return firstAvailable(ctx, urls, func(ctx context.Context, url string) error {
+			v, err := NewValue(ctx, source(url))
+			if err != nil {
+				return err
+			}
+			fs, err := v.Filesystem()
+			if err != nil {
+				return err
+			}
+			return fetchSource(ctx, cln, fs)
+		})
+	})
+	if err != nil {
+		return llb.State{}, err
+	}
+	return source(url), nil
+}
+
+// firstAvailable returns the first of urls that is fetched without error. If
+// every url fails, their errors are returned together.
+func firstAvailable(ctx context.Context, urls []string, fetch func(ctx context.Context, url string) error) (string, error) {
+	var errs []error
+	for _, url := range urls {
+		err := fetch(ctx, url)
+		if err == nil {
+			return url, nil
+		}
+		if ctx.Err() != nil {
+			return "", err
+		}
+		errs = append(errs, err)
+	}
+	return "", errdefs.WithSourcesFailed(ProgramCounter(ctx), urls, errs)
+}
+
+// fetchSource builds a source, which fails if it cannot be fetched.
+func fetchSource(ctx context.Context, cln *client.Client, fs Filesystem) error {
+	def, err := fs.State.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+	return gatewayBuild(ctx, cln, fs.SolveOpts, fs.SessionOpts, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		return c.Solve(ctx, gateway.SolveRequest{
+			Definition: def.ToPB(),
+			Evaluate:   true,
+		})
+	})
+}
@@ -0,0 +1,66 @@
+package codegen
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirstAvailable(t *testing.T) {
+	t.Parallel()
+
+	var (
+		call = &ast.Ident{Text: "http"}
+		ctx  = WithProgramCounter(context.Background(), call)
+		urls = []string{
+			"https://example.com/app.tar.gz",
+			"https://mirror-a.example.com/app.tar.gz",
+			"https://mirror-b.example.com/app.tar.gz",
+		}
+	)
+
+	t.Run("primary fails", func(t *testing.T) {
+		var tried []string
+		url, err := firstAvailable(ctx, urls, func(ctx context.Context, url string) error {
+			tried = append(tried, url)
+			if url == urls[0] {
+				return errors.New("502 Bad Gateway")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, urls[1], url)
+		require.Equal(t, urls[:2], tried)
+	})
+
+	t.Run("every url fails", func(t *testing.T) {
+		errs := []error{
+			errors.New("502 Bad Gateway"),
+			errors.New("dial tcp: i/o timeout"),
+			errors.New("404 Not Found"),
+		}
+		var i int
+		_, err := firstAvailable(ctx, urls, func(ctx context.Context, url string) error {
+			i++
+			return errs[i-1]
+		})
+		require.EqualError(t, err, errdefs.WithSourcesFailed(call, urls, errs).Error())
+		require.Contains(t, err.Error(), "https://mirror-a.example.com/app.tar.gz: dial tcp: i/o timeout")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		var tried int
+		_, err := firstAvailable(ctx, urls, func(ctx context.Context, url string) error {
+			tried++
+			cancel()
+			return ctx.Err()
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 1, tried)
+	})
+}
@@ -0,0 +1,464 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+const (
+	// DefaultFormatMaxOps is the number of most recent ops of a filesystem, and
+	// of each filesystem it uses, that are formatted by default.
+	DefaultFormatMaxOps = 5
+
+	// DefaultFormatMaxLength is the number of characters of a string that are
+	// formatted by default.
+	DefaultFormatMaxLength = 64
+
+	// Redacted replaces the arguments of options that refer to secrets.
+	Redacted = "<redacted>"
+)
+
+// RedactedOptions are the options whose first argument is redacted when
+// formatted, because it refers to a secret.
+var RedactedOptions = map[string]bool{
+	"secret":     true,
+	"secretFile": true,
+	"secretDir":  true,
+}
+
+// FormatInfo is the configuration of FormatValue.
+type FormatInfo struct {
+	// MaxOps is the number of most recent ops of each filesystem to format, or
+	// zero to format all of them.
+	MaxOps int
+
+	// MaxLength is the number of characters of a string to format, or zero to
+	// format all of it.
+	MaxLength int
+
+	// Origin is the node that the value came from.
+	Origin ast.Node
+
+	// Source is the node whose options are formatted for option values, like
+	// a call statement with a with clause.
+	Source ast.Node
+}
+
+// FormatOption is optional configuration for FormatValue.
+type FormatOption func(*FormatInfo)
+
+func newFormatInfo(opts []FormatOption) FormatInfo {
+	info := FormatInfo{
+		MaxOps:    DefaultFormatMaxOps,
+		MaxLength: DefaultFormatMaxLength,
+	}
+	for _, opt := range opts {
+		opt(&info)
+	}
+	return info
+}
+
+// WithMaxOps sets the number of most recent ops of each filesystem to format.
+// Zero formats all of them.
+func WithMaxOps(n int) FormatOption {
+	return func(info *FormatInfo) {
+		info.MaxOps = n
+	}
+}
+
+// WithMaxLength sets the number of characters of a string to format. Zero
+// formats all of it.
+func WithMaxLength(n int) FormatOption {
+	return func(info *FormatInfo) {
+		info.MaxLength = n
+	}
+}
+
+// WithOrigin sets the node that the value came from, which is formatted with
+// ints and bools.
+func WithOrigin(node ast.Node) FormatOption {
+	return func(info *FormatInfo) {
+		info.Origin = node
+	}
+}
+
+// WithOptionSource sets the node whose options are formatted for option
+// values. Evaluated options don't keep the names they were set by, so they
+// are formatted from their source.
+func WithOptionSource(node ast.Node) FormatOption {
+	return func(info *FormatInfo) {
+		info.Source = node
+	}
+}
+
+// FormatValue renders a value for inspection. Filesystems are rendered as the
+// chain of ops emitted so far, most recent first, with the ops of the
+// filesystems they use indented below them. Ops are numbered in the order
+// returned by FormatOps.
+func FormatValue(ctx context.Context, v Value, opts ...FormatOption) (string, error) {
+	info := newFormatInfo(opts)
+
+	switch v.Kind() {
+	case ast.Filesystem:
+		fs, err := v.Filesystem()
+		if err != nil {
+			return "", err
+		}
+		op, err := FilesystemOp(ctx, fs)
+		if err != nil {
+			return "", err
+		}
+		return formatOps(op, info.MaxOps), nil
+	case ast.String:
+		s, err := v.String()
+		if err != nil {
+			return "", err
+		}
+		return formatString(s, info.MaxLength), nil
+	case ast.Int:
+		i, err := v.Int()
+		if err != nil {
+			return "", err
+		}
+		return withOrigin(strconv.Itoa(i), info.Origin), nil
+	case ast.Bool:
+		s, err := v.String()
+		if err != nil {
+			return "", err
+		}
+		return withOrigin(s, info.Origin), nil
+	}
+
+	if v.Kind().Primary() == ast.Option {
+		opt, err := v.Option()
+		if err != nil {
+			return "", err
+		}
+		if info.Source == nil {
+			return fmt.Sprintf("<%d options>", len(opt)), nil
+		}
+		var sb strings.Builder
+		formatOptions(&sb, info.Source, "")
+		return strings.TrimSuffix(sb.String(), "\n"), nil
+	}
+	return fmt.Sprintf("<%s>", v.Kind()), nil
+}
+
+// Op is an operation emitted for a filesystem.
+type Op struct {
+	Digest digest.Digest
+
+	// Name describes the op, like "run make".
+	Name string
+
+	// Position is the source of the call that emitted the op, if known.
+	Position lexer.Position
+
+	// Parent is the op that this op is applied to, or nil if it is applied to
+	// scratch.
+	Parent *Op
+
+	// Stages are the most recent ops of other filesystems this op uses, like
+	// the source of a copy or the mounts of a run.
+	Stages []*Op
+}
+
+// FilesystemOp returns the most recent op of a filesystem, or nil if it is
+// scratch.
+func FilesystemOp(ctx context.Context, fs Filesystem) (*Op, error) {
+	if fs.State.Output() == nil {
+		return nil, nil
+	}
+
+	def, err := fs.State.Marshal(ctx, llb.Platform(fs.Platform))
+	if err != nil {
+		return nil, err
+	}
+
+	pbOps := make(map[digest.Digest]*pb.Op)
+	var dgst digest.Digest
+	for _, dt := range def.Def {
+		var pbOp pb.Op
+		err = pbOp.Unmarshal(dt)
+		if err != nil {
+			return nil, err
+		}
+		dgst = digest.FromBytes(dt)
+		pbOps[dgst] = &pbOp
+	}
+
+	terminal := pbOps[dgst]
+	if terminal == nil || len(terminal.Inputs) == 0 {
+		return nil, nil
+	}
+
+	b := &opBuilder{
+		pbOps:  pbOps,
+		source: def.Source,
+		ops:    make(map[digest.Digest]*Op),
+	}
+	return b.op(terminal.Inputs[0].Digest), nil
+}
+
+// FormatOps returns the ops formatted by FormatValue with maxOps, in the order
+// they are numbered.
+func FormatOps(op *Op, maxOps int) []*Op {
+	var ops []*Op
+	walkOps(op, maxOps, "", func(op *Op, _ string) {
+		ops = append(ops, op)
+	}, func(int, string) {})
+	return ops
+}
+
+func formatOps(op *Op, maxOps int) string {
+	if op == nil {
+		return "fs scratch"
+	}
+
+	var (
+		sb strings.Builder
+		i  int
+	)
+	sb.WriteString("fs")
+	walkOps(op, maxOps, "", func(op *Op, indent string) {
+		fmt.Fprintf(&sb, "\n%s#%d %s", indent, i, op.Name)
+		if op.Position.Filename != "" {
+			fmt.Fprintf(&sb, " (%s)", formatPosition(op.Position))
+		}
+		i++
+	}, func(more int, indent string) {
+		fmt.Fprintf(&sb, "\n%s... %d more", indent, more)
+	})
+	return sb.String()
+}
+
+// walkOps visits up to maxOps of the chain of ops ending with op, and the
+// stages of each visited op indented below it.
+func walkOps(op *Op, maxOps int, indent string, visit func(op *Op, indent string), truncated func(more int, indent string)) {
+	n := 0
+	for ; op != nil; op = op.Parent {
+		if maxOps > 0 && n == maxOps {
+			more := 0
+			for ; op != nil; op = op.Parent {
+				more++
+			}
+			truncated(more, indent)
+			return
+		}
+		visit(op, indent)
+		for _, stage := range op.Stages {
+			walkOps(stage, maxOps, indent+"   ", visit, truncated)
+		}
+		n++
+	}
+}
+
+type opBuilder struct {
+	pbOps  map[digest.Digest]*pb.Op
+	source *pb.Source
+	ops    map[digest.Digest]*Op
+}
+
+func (b *opBuilder) op(dgst digest.Digest) *Op {
+	if op, ok := b.ops[dgst]; ok {
+		return op
+	}
+	pbOp, ok := b.pbOps[dgst]
+	if !ok {
+		return nil
+	}
+
+	op := &Op{
+		Digest:   dgst,
+		Position: b.position(dgst),
+	}
+	b.ops[dgst] = op
+
+	parent := -1
+	var stages []int
+	switch v := pbOp.Op.(type) {
+	case *pb.Op_Source:
+		op.Name = sourceName(v.Source.Identifier)
+	case *pb.Op_Exec:
+		op.Name = "run " + shellquote.Join(v.Exec.Meta.Args...)
+		for _, m := range v.Exec.Mounts {
+			if m.Input < 0 {
+				continue
+			}
+			if m.Dest == "/" {
+				parent = int(m.Input)
+			} else {
+				stages = append(stages, int(m.Input))
+			}
+		}
+	case *pb.Op_File:
+		var names []string
+		for i, action := range v.File.Actions {
+			names = append(names, fileActionName(action))
+			if int(action.Input) >= 0 && int(action.Input) < len(pbOp.Inputs) {
+				if i == 0 {
+					parent = int(action.Input)
+				} else {
+					stages = append(stages, int(action.Input))
+				}
+			}
+			if int(action.SecondaryInput) >= 0 && int(action.SecondaryInput) < len(pbOp.Inputs) {
+				stages = append(stages, int(action.SecondaryInput))
+			}
+		}
+		op.Name = strings.Join(names, "; ")
+	default:
+		op.Name = strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", v), "*pb.Op_"))
+		for i := range pbOp.Inputs {
+			if i == 0 {
+				parent = i
+			} else {
+				stages = append(stages, i)
+			}
+		}
+	}
+
+	if parent >= 0 {
+		op.Parent = b.op(pbOp.Inputs[parent].Digest)
+	}
+	for _, i := range stages {
+		if stage := b.op(pbOp.Inputs[i].Digest); stage != nil {
+			op.Stages = append(op.Stages, stage)
+		}
+	}
+	return op
+}
+
+// position returns the innermost source location of an op, which is the
+// call that emitted it.
+func (b *opBuilder) position(dgst digest.Digest) lexer.Position {
+	if b.source == nil {
+		return lexer.Position{}
+	}
+	locs, ok := b.source.Locations[dgst.String()]
+	if !ok || len(locs.Locations) == 0 {
+		return lexer.Position{}
+	}
+	loc := locs.Locations[0]
+	if int(loc.SourceIndex) >= len(b.source.Infos) || len(loc.Ranges) == 0 {
+		return lexer.Position{}
+	}
+	return lexer.Position{
+		Filename: b.source.Infos[loc.SourceIndex].Filename,
+		Line:     int(loc.Ranges[0].Start.Line),
+		Column:   int(loc.Ranges[0].Start.Character),
+	}
+}
+
+func sourceName(identifier string) string {
+	scheme, ref := identifier, ""
+	if i := strings.Index(identifier, "://"); i >= 0 {
+		scheme, ref = identifier[:i], identifier[i+len("://"):]
+	}
+	switch scheme {
+	case "docker-image":
+		return "image " + ref
+	case "local", "git":
+		return scheme + " " + ref
+	case "http", "https":
+		return "http " + identifier
+	default:
+		return identifier
+	}
+}
+
+func fileActionName(action *pb.FileAction) string {
+	switch a := action.Action.(type) {
+	case *pb.FileAction_Copy:
+		return fmt.Sprintf("copy %s %s", a.Copy.Src, a.Copy.Dest)
+	case *pb.FileAction_Mkfile:
+		return fmt.Sprintf("mkfile %s %#o", a.Mkfile.Path, a.Mkfile.Mode)
+	case *pb.FileAction_Mkdir:
+		return fmt.Sprintf("mkdir %s %#o", a.Mkdir.Path, a.Mkdir.Mode)
+	case *pb.FileAction_Rm:
+		return fmt.Sprintf("rm %s", a.Rm.Path)
+	default:
+		return "file"
+	}
+}
+
+func formatString(s string, maxLength int) string {
+	if maxLength <= 0 || utf8.RuneCountInString(s) <= maxLength {
+		return strconv.Quote(s)
+	}
+	preview := []rune(s)[:maxLength]
+	return fmt.Sprintf("%s... (%d bytes)", strconv.Quote(string(preview)), len(s))
+}
+
+func withOrigin(s string, origin ast.Node) string {
+	if origin == nil {
+		return s
+	}
+	return fmt.Sprintf("%s (%s)", s, formatPosition(origin.Position()))
+}
+
+func formatPosition(pos lexer.Position) string {
+	return fmt.Sprintf("%s:%d:%d", pos.Filename, pos.Line, pos.Column)
+}
+
+// formatOptions writes the options set by the source of an option value, one
+// per line with their literal arguments, and the options of their with
+// clauses indented below them.
+func formatOptions(sb *strings.Builder, node ast.Node, indent string) {
+	switch n := node.(type) {
+	case *ast.CallStmt:
+		if n.WithClause != nil {
+			formatOptions(sb, n.WithClause.Expr, indent)
+		}
+	case *ast.WithClause:
+		formatOptions(sb, n.Expr, indent)
+	case *ast.FuncDecl:
+		formatOptions(sb, n.Body, indent)
+	case *ast.Expr:
+		switch {
+		case n.FuncLit != nil:
+			formatOptions(sb, n.FuncLit.Body, indent)
+		case n.CallExpr != nil:
+			formatOption(sb, n.CallExpr.Name, n.CallExpr.Arguments(), indent)
+		default:
+			fmt.Fprintf(sb, "%s%s\n", indent, n)
+		}
+	case *ast.BlockStmt:
+		if n == nil {
+			return
+		}
+		for _, stmt := range n.Stmts() {
+			switch {
+			case stmt.Call != nil:
+				formatOption(sb, stmt.Call.Name, stmt.Call.Args, indent)
+				if stmt.Call.WithClause != nil {
+					formatOptions(sb, stmt.Call.WithClause.Expr, indent+"  ")
+				}
+			case stmt.Expr != nil:
+				formatOptions(sb, stmt.Expr.Expr, indent)
+			}
+		}
+	}
+}
+
+func formatOption(sb *strings.Builder, name *ast.IdentExpr, args []*ast.Expr, indent string) {
+	fields := []string{name.String()}
+	for i, arg := range args {
+		if i == 0 && name.Reference == nil && RedactedOptions[name.Ident.Text] {
+			fields = append(fields, Redacted)
+			continue
+		}
+		fields = append(fields, arg.String())
+	}
+	fmt.Fprintf(sb, "%s%s\n", indent, strings.Join(fields, " "))
+}
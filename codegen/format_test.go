@@ -0,0 +1,128 @@
+package codegen
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	t.Parallel()
+
+	input := `
+	fs build() {
+		image "golang"
+		run "go build -o /out/app"
+	}
+
+	fs default() {
+		image "alpine"
+		copy build "/out/app" "/usr/bin/app"
+		mkfile "/etc/app.conf" 0o644 "debug=true"
+		breakpoint
+		run "app" with option {
+			secret "./format_test.go" "/run/secrets/token"
+			env "DEBUG" "true"
+			mount scratch "/cache" with option {
+				cache "app" "shared"
+			}
+		}
+	}
+	`
+
+	controlDebugger(t, NewDebugger(nil), input, func(t *testing.T, d Debugger, mod *ast.Module) {
+		_, err := d.Continue(ForwardDirection)
+		require.NoError(t, err)
+		_, err = d.Next(ForwardDirection)
+		require.NoError(t, err)
+
+		out, err := d.Inspect()
+		require.NoError(t, err)
+		require.Equal(t, strings.Join([]string{
+			"fs",
+			"#0 mkfile /etc/app.conf 0644 (build.hlb:9:2)",
+			"#1 copy /out/app /usr/bin/app (build.hlb:8:2)",
+			"   #2 run /bin/sh -c 'go build -o /out/app' (build.hlb:3:2)",
+			"   #3 image docker.io/library/golang:latest (build.hlb:2:2)",
+			"#4 image docker.io/library/alpine:latest (build.hlb:7:2)",
+			"with option",
+			`  secret <redacted> "/run/secrets/token"`,
+			`  env "DEBUG" "true"`,
+			`  mount scratch "/cache"`,
+			`    cache "app" "shared"`,
+		}, "\n"), out)
+		require.NotContains(t, out, "format_test.go")
+
+		// Ops are navigable by the numbers they are printed with.
+		node, err := d.OpSource(2)
+		require.NoError(t, err)
+		require.Equal(t, ast.Search(mod, `run "go build -o /out/app"`).Position(), node.Position())
+
+		out, err = d.Inspect(WithMaxOps(1))
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(out, strings.Join([]string{
+			"fs",
+			"#0 mkfile /etc/app.conf 0644 (build.hlb:9:2)",
+			"... 2 more",
+			"with option",
+		}, "\n")), out)
+
+		_, err = d.OpSource(1)
+		require.Error(t, err)
+	})
+}
+
+func TestFormatValue(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name     string
+		value    interface{}
+		opts     []FormatOption
+		expected string
+	}{{
+		"short string",
+		"hello\nworld",
+		nil,
+		`"hello\nworld"`,
+	}, {
+		"long string is truncated",
+		strings.Repeat("ab", 50),
+		[]FormatOption{WithMaxLength(4)},
+		`"abab"... (100 bytes)`,
+	}, {
+		"long string shown in full",
+		strings.Repeat("ab", 50),
+		[]FormatOption{WithMaxLength(0)},
+		`"` + strings.Repeat("ab", 50) + `"`,
+	}, {
+		"int",
+		42,
+		nil,
+		"42",
+	}, {
+		"bool",
+		true,
+		nil,
+		"true",
+	}, {
+		"options without source",
+		Option{1, 2},
+		nil,
+		"<2 options>",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := NewValue(ctx, tc.value)
+			require.NoError(t, err)
+
+			out, err := FormatValue(ctx, v, tc.opts...)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, out)
+		})
+	}
+}
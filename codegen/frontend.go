@@ -0,0 +1,259 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// LockfileName is the name of the lockfile that pins the remote executable
+// code of a module, which is committed next to it.
+const LockfileName = "hlb.lock"
+
+// Lockfile pins the refs of frontends to the digests they resolved to when
+// they were locked, so that a tag moved to other code fails the build instead
+// of running it.
+type Lockfile struct {
+	mu sync.Mutex
+
+	// Frontends maps the normalized refs of frontends to their digests.
+	Frontends map[string]digest.Digest `json:"frontends"`
+}
+
+// NewLockfile returns an empty lockfile.
+func NewLockfile() *Lockfile {
+	return &Lockfile{Frontends: make(map[string]digest.Digest)}
+}
+
+// ReadLockfile reads the lockfile at path.
+func ReadLockfile(path string) (*Lockfile, error) {
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lf := NewLockfile()
+	err = json.Unmarshal(dt, lf)
+	if err != nil {
+		return nil, err
+	}
+	if lf.Frontends == nil {
+		lf.Frontends = make(map[string]digest.Digest)
+	}
+	return lf, nil
+}
+
+// WriteFile writes the lockfile to path.
+func (lf *Lockfile) WriteFile(path string) error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	dt, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(dt, '\n'), 0o644)
+}
+
+// Frontend returns the digest a frontend ref is locked to.
+func (lf *Lockfile) Frontend(ref string) (digest.Digest, bool) {
+	if lf == nil {
+		return "", false
+	}
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	dgst, ok := lf.Frontends[ref]
+	return dgst, ok
+}
+
+// LockFrontend locks a frontend ref to a digest.
+func (lf *Lockfile) LockFrontend(ref string, dgst digest.Digest) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	lf.Frontends[ref] = dgst
+}
+
+// WithLockfile sets the lockfile that frontend refs are verified against.
+func WithLockfile(lf *Lockfile) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.lockfile = lf
+	}
+}
+
+// WithRequirePinnedFrontends makes every frontend whose ref is not pinned by
+// a digest, a digest option or the lockfile an error before generating.
+func WithRequirePinnedFrontends() CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.requirePinnedFrontends = true
+	}
+}
+
+// FrontendRef is a call to frontend found in a module.
+type FrontendRef struct {
+	// Node is the source argument of the call.
+	Node ast.Node
+
+	// Ref is the normalized ref of the frontend, or empty if the source is
+	// only known at runtime.
+	Ref string
+
+	// Pinned is true if the ref has a digest or the call has a digest option.
+	Pinned bool
+}
+
+// FrontendRefs returns the calls to frontend in a module.
+func FrontendRefs(mod *ast.Module) []FrontendRef {
+	var refs []FrontendRef
+	add := func(name *ast.IdentExpr, args []*ast.Expr, with *ast.WithClause) {
+		if name == nil || name.Reference != nil || name.Ident.Text != "frontend" || len(args) != 1 {
+			return
+		}
+
+		fr := FrontendRef{Node: args[0]}
+		if args[0].BasicLit != nil {
+			source, ok := args[0].BasicLit.StringValue()
+			if ok {
+				named, err := reference.ParseNormalizedNamed(source)
+				if err == nil {
+					_, fr.Pinned = named.(reference.Canonical)
+					fr.Ref = reference.TagNameOnly(named).String()
+				}
+			}
+		}
+		if with != nil {
+			ast.Match(with, ast.MatchOpts{},
+				func(ie *ast.IdentExpr) {
+					if ie.Reference == nil && ie.Ident.Text == "digest" {
+						fr.Pinned = true
+					}
+				},
+			)
+		}
+		refs = append(refs, fr)
+	}
+
+	ast.Match(mod, ast.MatchOpts{},
+		func(call *ast.CallStmt) {
+			add(call.Name, call.Args, call.WithClause)
+		},
+		func(call *ast.CallExpr) {
+			add(call.Name, call.Arguments(), nil)
+		},
+	)
+	return refs
+}
+
+// checkPinnedFrontends returns an error for every frontend in a module whose
+// ref is not pinned.
+func checkPinnedFrontends(mod *ast.Module, lf *Lockfile) error {
+	var errs []error
+	for _, fr := range FrontendRefs(mod) {
+		if fr.Pinned {
+			continue
+		}
+		if _, ok := lf.Frontend(fr.Ref); ok {
+			continue
+		}
+		errs = append(errs, errdefs.WithUnpinnedFrontend(fr.Node))
+	}
+	if len(errs) > 0 {
+		return &diagnostic.Error{Diagnostics: errs}
+	}
+	return nil
+}
+
+// PinnedDigest is the digest a frontend ref must resolve to.
+type PinnedDigest struct {
+	Digest digest.Digest
+	Node   ast.Node
+}
+
+// pinFrontend returns the frontend ref pinned to the digest it resolves to,
+// so that the gateway runs the same frontend that was verified. A ref must
+// resolve to the digest of its digest option, and to the digest it is locked
+// to, otherwise its tag was moved.
+func pinFrontend(ctx context.Context, named reference.Named, expected *PinnedDigest) (string, error) {
+	if canonical, ok := named.(reference.Canonical); ok {
+		if expected != nil && canonical.Digest() != expected.Digest {
+			return "", errdefs.WithFrontendDigestMismatch(expected.Node, named.String(), expected.Digest, canonical.Digest())
+		}
+		return named.String(), nil
+	}
+
+	ref := reference.TagNameOnly(named).String()
+	locked, ok := getLockfile(ctx).Frontend(ref)
+
+	resolver := ImageResolver(ctx)
+	if resolver == nil {
+		if expected == nil && !ok {
+			return ref, nil
+		}
+		return "", Arg(ctx, 0).WithError(fmt.Errorf("no image resolver to verify frontend %s", ref))
+	}
+
+	// Resolve the ref once, and run the frontend by the digest it resolved to.
+	dgst, _, err := resolver.ResolveImageConfig(ctx, ref, llb.ResolveImageConfigOpt{
+		ResolveMode: llb.ResolveModeForcePull.String(),
+	})
+	if err != nil {
+		return "", Arg(ctx, 0).WithError(err)
+	}
+
+	if expected != nil && dgst != expected.Digest {
+		return "", errdefs.WithFrontendDigestMismatch(expected.Node, ref, expected.Digest, dgst)
+	}
+	if ok && dgst != locked {
+		return "", errdefs.WithFrontendLockMismatch(Arg(ctx, 0), ref, LockfileName, locked, dgst)
+	}
+
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), dgst)
+	if err != nil {
+		return "", Arg(ctx, 0).WithError(err)
+	}
+	return canonical.String(), nil
+}
+
+// LockFrontends resolves the literal frontend refs of modules that are not
+// pinned by a digest and locks them to the digests they resolve to.
+func LockFrontends(ctx context.Context, lf *Lockfile, mods ...*ast.Module) error {
+	resolver := ImageResolver(ctx)
+	if resolver == nil {
+		return fmt.Errorf("no image resolver to lock frontends")
+	}
+
+	refs := make(map[string]struct{})
+	for _, mod := range mods {
+		for _, fr := range FrontendRefs(mod) {
+			if fr.Ref != "" && !fr.Pinned {
+				refs[fr.Ref] = struct{}{}
+			}
+		}
+	}
+
+	var sorted []string
+	for ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Strings(sorted)
+
+	for _, ref := range sorted {
+		dgst, _, err := resolver.ResolveImageConfig(ctx, ref, llb.ResolveImageConfigOpt{
+			ResolveMode: llb.ResolveModeForcePull.String(),
+		})
+		if err != nil {
+			return err
+		}
+		lf.LockFrontend(ref, dgst)
+	}
+	return nil
+}
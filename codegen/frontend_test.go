@@ -0,0 +1,240 @@
+package codegen
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+// tagResolver resolves tags to the digests they currently point to.
+type tagResolver struct {
+	mu    sync.Mutex
+	tags  map[string]digest.Digest
+	calls map[string]int
+}
+
+func (r *tagResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[ref]++
+	return r.tags[ref], []byte("{}"), nil
+}
+
+func TestPinFrontend(t *testing.T) {
+	t.Parallel()
+
+	const ref = "docker.io/docker/dockerfile:1"
+	var (
+		v1 = digest.FromString("v1")
+		v2 = digest.FromString("v2")
+	)
+
+	type testCase struct {
+		name     string
+		source   string
+		expected digest.Digest
+		locked   digest.Digest
+		pinned   string
+		errMsg   string
+	}
+
+	for _, tc := range []testCase{{
+		name:   "unpinned tag is run by its digest",
+		source: "docker/dockerfile:1",
+		pinned: "docker.io/docker/dockerfile@" + v2.String(),
+	}, {
+		name:     "digest option matches",
+		source:   "docker/dockerfile:1",
+		expected: v2,
+		pinned:   "docker.io/docker/dockerfile@" + v2.String(),
+	}, {
+		name:     "tag moved from digest option",
+		source:   "docker/dockerfile:1",
+		expected: v1,
+		errMsg:   "frontend docker.io/docker/dockerfile:1 resolved to " + v2.String() + ", expected " + v1.String(),
+	}, {
+		name:   "tag moved from lockfile",
+		source: "docker/dockerfile:1",
+		locked: v1,
+		errMsg: "frontend docker.io/docker/dockerfile:1 resolved to " + v2.String() + ", but is locked to " + v1.String() + " in hlb.lock",
+	}, {
+		name:   "digest ref is run as is",
+		source: "docker/dockerfile@" + v1.String(),
+		pinned: "docker.io/docker/dockerfile@" + v1.String(),
+	}, {
+		name:     "digest ref mismatches digest option",
+		source:   "docker/dockerfile@" + v1.String(),
+		expected: v2,
+		errMsg:   "resolved to " + v1.String() + ", expected " + v2.String(),
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := &tagResolver{
+				tags:  map[string]digest.Digest{ref: v2},
+				calls: make(map[string]int),
+			}
+			ctx := WithImageResolver(context.Background(), resolver)
+
+			lf := NewLockfile()
+			if tc.locked != "" {
+				lf.LockFrontend(ref, tc.locked)
+			}
+			ctx = withLockfile(ctx, lf)
+
+			mod, err := parser.Parse(ctx, strings.NewReader(`fs default() { frontend "x"; }`))
+			require.NoError(t, err)
+			node := ast.Search(mod, `"x"`)
+			ctx = WithArg(ctx, 0, node)
+
+			var expected *PinnedDigest
+			if tc.expected != "" {
+				expected = &PinnedDigest{Digest: tc.expected, Node: node}
+			}
+
+			named, err := reference.ParseNormalizedNamed(tc.source)
+			require.NoError(t, err)
+
+			pinned, err := pinFrontend(ctx, named, expected)
+			if tc.errMsg != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.errMsg)
+				require.Len(t, diagnostic.Spans(err), 1)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.pinned, pinned)
+
+			// Refs are resolved at most once, so the gateway runs the digest
+			// that was verified.
+			require.LessOrEqual(t, resolver.calls[ref], 1)
+		})
+	}
+}
+
+func TestFrontendTagMoved(t *testing.T) {
+	t.Parallel()
+
+	var (
+		v1 = digest.FromString("v1")
+		v2 = digest.FromString("v2")
+	)
+	ctx, mod := parseTestModule(t, `
+	fs default() {
+		frontend "docker/dockerfile:1" with option {
+			digest "`+v1.String()+`"
+		}
+	}
+	`)
+	ctx = WithImageResolver(ctx, &tagResolver{
+		tags:  map[string]digest.Digest{"docker.io/docker/dockerfile:1": v2},
+		calls: make(map[string]int),
+	})
+
+	// The frontend fails before it is run.
+	_, err := New(nil, nil).Generate(ctx, mod, []Target{{Name: "default"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "resolved to "+v2.String()+", expected "+v1.String())
+
+	spans := diagnostic.Spans(err)
+	require.Len(t, spans, 1)
+	require.Equal(t, 4, spans[0].Pos.Line)
+}
+
+func TestRequirePinnedFrontends(t *testing.T) {
+	t.Parallel()
+
+	dgst := digest.FromString("v1")
+	ctx, mod := parseTestModule(t, `
+	fs default() {
+		frontend "docker/dockerfile:1"
+	}
+
+	fs pinned() {
+		frontend "docker/dockerfile@`+dgst.String()+`"
+	}
+
+	fs option() {
+		frontend "docker/dockerfile:1" with digest("`+dgst.String()+`")
+	}
+
+	fs locked() {
+		frontend "example.com/frontend:v2"
+	}
+
+	fs dynamic() {
+		frontend localEnv("FRONTEND")
+	}
+	`)
+
+	lf := NewLockfile()
+	lf.LockFrontend("example.com/frontend:v2", dgst)
+
+	_, err := New(nil, nil, WithLockfile(lf), WithRequirePinnedFrontends()).Generate(ctx, mod, []Target{{Name: "pinned"}})
+	require.Error(t, err)
+
+	var lines []int
+	for _, span := range diagnostic.Spans(err) {
+		require.Contains(t, span.Error(), "frontend is not pinned")
+		lines = append(lines, span.Pos.Line)
+	}
+	require.Equal(t, []int{3, 19}, lines)
+}
+
+func TestLockFrontends(t *testing.T) {
+	t.Parallel()
+
+	dgst := digest.FromString("v1")
+	ctx, mod := parseTestModule(t, `
+	fs a() {
+		frontend "docker/dockerfile:1"
+	}
+
+	fs b() {
+		frontend "docker/dockerfile:1"
+	}
+
+	fs c() {
+		frontend "docker/dockerfile@`+dgst.String()+`"
+	}
+	`)
+	_, imod := parseTestModule(t, `
+	fs d() {
+		frontend "example.com/frontend"
+	}
+	`)
+
+	resolver := &tagResolver{
+		tags: map[string]digest.Digest{
+			"docker.io/docker/dockerfile:1": digest.FromString("dockerfile"),
+			"example.com/frontend:latest":   digest.FromString("frontend"),
+		},
+		calls: make(map[string]int),
+	}
+	ctx = WithImageResolver(ctx, resolver)
+
+	lf := NewLockfile()
+	err := LockFrontends(ctx, lf, mod, imod)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), LockfileName)
+	err = lf.WriteFile(path)
+	require.NoError(t, err)
+
+	actual, err := ReadLockfile(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]digest.Digest{
+		"docker.io/docker/dockerfile:1": digest.FromString("dockerfile"),
+		"example.com/frontend:latest":   digest.FromString("frontend"),
+	}, actual.Frontends)
+	require.Equal(t, 1, resolver.calls["docker.io/docker/dockerfile:1"])
+}
@@ -0,0 +1,94 @@
+package codegen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+)
+
+// ErrNoGateHandler is the reason a gate fails when there is no handler to
+// approve it.
+var ErrNoGateHandler = errors.New("no gate handler to approve it")
+
+// GateHandler is called with the message of a gate when a pipeline reaches
+// it. Returning nil approves the gate, otherwise the error is why it was
+// rejected. The context is canceled when the gate times out or the pipeline
+// is canceled, after which the result is ignored.
+type GateHandler func(ctx context.Context, msg string) error
+
+// WithGateHandler sets the handler that approves the gates of pipelines, like
+// a prompt on the terminal or an approval from a CI system. Without a handler,
+// every gate is rejected.
+func WithGateHandler(handler GateHandler) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.gates.handler = handler
+	}
+}
+
+// WithGateTimeout bounds how long a gate waits for its handler. A timeout of
+// zero waits indefinitely.
+func WithGateTimeout(d time.Duration) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.gates.timeout = d
+	}
+}
+
+type gatePolicy struct {
+	handler GateHandler
+	timeout time.Duration
+}
+
+// gateRequest waits for the approval of a gate when solved.
+type gateRequest struct {
+	policy  gatePolicy
+	node    ast.Node
+	message string
+}
+
+func (r *gateRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	if r.policy.handler == nil {
+		return errdefs.WithGateRejected(ErrNoGateHandler, r.node, r.message)
+	}
+
+	// The handler is abandoned if it doesn't return once its context is
+	// canceled, when the gate times out or the pipeline is canceled.
+	hctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.policy.handler(hctx, r.message)
+	}()
+
+	var timeout <-chan time.Time
+	if r.policy.timeout > 0 {
+		timer := time.NewTimer(r.policy.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		err := fmt.Errorf("timed out after %s", r.policy.timeout)
+		return errdefs.WithGateRejected(err, r.node, r.message)
+	case err := <-done:
+		if err != nil {
+			return errdefs.WithGateRejected(err, r.node, r.message)
+		}
+		return nil
+	}
+}
+
+func (r *gateRequest) Tree(tree treeprint.Tree) error {
+	tree.AddMetaNode("gate", r.message)
+	return nil
+}
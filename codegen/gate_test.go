@@ -0,0 +1,175 @@
+package codegen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+func TestPipelineGates(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	pipeline release(string first, string second) {
+		promote first
+		promote second
+		gate "announce release?"
+	}
+
+	pipeline promote(string env) {
+		stageEnv "ENV" env
+		gate string {
+			format "promote to %s?" string { localEnv "ENV"; }
+		}
+	}
+	`)
+
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	handler := func(_ context.Context, msg string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, msg)
+		if len(messages) > 1 {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+
+	cg := New(nil, nil, WithGateHandler(handler))
+	request, err := cg.Generate(ctx, mod, []Target{{
+		Name: "release",
+		Args: []string{"staging", "production"},
+	}})
+	require.NoError(t, err)
+
+	tree := treeprint.New()
+	err = request.Tree(tree)
+	require.NoError(t, err)
+	require.Contains(t, tree.String(), "[gate]  promote to staging?")
+	require.Contains(t, tree.String(), "[gate]  promote to production?")
+
+	// The first gate is approved and the second is rejected, so the pipeline
+	// stops before its last gate.
+	err = request.Solve(ctx, nil, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"promote to staging?", "promote to production?"}, messages)
+	require.Contains(t, err.Error(), `gate "promote to production?" was not approved: rejected`)
+
+	spans := diagnostic.Spans(err)
+	require.Len(t, spans, 1)
+	require.Equal(t, 10, spans[0].Pos.Line)
+}
+
+func TestPipelineGateTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	pipeline default() {
+		gate "approve?"
+	}
+	`)
+
+	canceled := make(chan struct{})
+	cg := New(nil, nil,
+		WithGateHandler(func(ctx context.Context, _ string) error {
+			<-ctx.Done()
+			close(canceled)
+			return ctx.Err()
+		}),
+		WithGateTimeout(10*time.Millisecond),
+	)
+	request, err := cg.Generate(ctx, mod, []Target{{Name: "default"}})
+	require.NoError(t, err)
+
+	err = request.Solve(ctx, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `gate "approve?" was not approved: timed out after 10ms`)
+	require.Len(t, diagnostic.Spans(err), 1)
+
+	// The handler is told to stop once the gate times out.
+	<-canceled
+
+	// Without a handler, gates are rejected.
+	request, err = New(nil, nil).Generate(ctx, mod, []Target{{Name: "default"}})
+	require.NoError(t, err)
+
+	err = request.Solve(ctx, nil, nil)
+	require.True(t, errors.Is(err, ErrNoGateHandler))
+}
+
+func TestTargetArgs(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	pipeline deploy(string version, int mode, bool canary) {
+		stage build(version) fs {
+			scratch
+			mkfile "/version" mode version
+		}
+	}
+
+	fs build(string version) {
+		image string { format "app:%s" version; }
+	}
+
+	pipeline fromFs(fs base) {
+		stage base
+	}
+	`)
+
+	request, err := New(nil, nil).Generate(ctx, mod, []Target{{
+		Name: "deploy",
+		Args: []string{"v1", "0o644", "false"},
+	}})
+	require.NoError(t, err)
+
+	expect := func(st llb.State) solver.Request {
+		def, err := st.Marshal(ctx, llb.LinuxAmd64)
+		require.NoError(t, err)
+		return solver.Single(&solver.Params{Def: def})
+	}
+
+	expected := treeprint.New()
+	err = solver.Parallel(
+		expect(llb.Image("app:v1")),
+		expect(llb.Scratch().File(
+			llb.Mkfile("/version", 0o644, []byte("v1")),
+		)),
+	).Tree(expected)
+	require.NoError(t, err)
+
+	actual := treeprint.New()
+	err = request.Tree(actual)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), actual.String())
+
+	for _, tc := range []struct {
+		target Target
+		errMsg string
+	}{{
+		Target{Name: "deploy", Args: []string{"v1"}},
+		"target deploy expects 3 args but got 1",
+	}, {
+		Target{Name: "deploy", Args: []string{"v1", "three", "false"}},
+		`invalid arg "three" for target deploy`,
+	}, {
+		Target{Name: "fromFs", Args: []string{"alpine"}},
+		"fs params cannot be set from args",
+	}} {
+		_, err := New(nil, nil).Generate(ctx, mod, []Target{tc.target})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), tc.errMsg)
+		require.Len(t, diagnostic.Spans(err), 1)
+	}
+}
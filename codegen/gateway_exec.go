@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"syscall"
+	"time"
 
 	"github.com/docker/buildx/util/progress"
 	"github.com/moby/buildkit/client"
@@ -202,7 +204,7 @@ func ExecWithFS(ctx context.Context, cln *client.Client, fs Filesystem, opts Opt
 			if err != nil {
 				return
 			}
-			defer ctr.Release(ctx)
+			defer releaseContainer(ctr)
 
 			p := Progress(ctx)
 			if p != nil {
@@ -237,7 +239,7 @@ func ExecWithFS(ctx context.Context, cln *client.Client, fs Filesystem, opts Opt
 				defer cleanup()
 			}
 
-			return res, proc.Wait()
+			return res, waitProcess(ctx, proc)
 		}, fs.SolveOpts...)
 	})
 
@@ -277,7 +279,7 @@ func ExecWithSolveErr(ctx context.Context, c gateway.Client, se *solvererrdefs.S
 	if err != nil {
 		return err
 	}
-	defer ctr.Release(ctx)
+	defer releaseContainer(ctr)
 
 	err = Progress(ctx).Sync()
 	if err != nil {
@@ -309,7 +311,47 @@ func ExecWithSolveErr(ctx context.Context, c gateway.Client, se *solvererrdefs.S
 		defer cleanup()
 	}
 
-	return proc.Wait()
+	return waitProcess(ctx, proc)
+}
+
+// processKillTimeout is how long to wait for a process to exit after it is
+// killed.
+const processKillTimeout = 10 * time.Second
+
+// waitProcess waits for a process to exit. The gateway client keeps waiting
+// for the process even after its context is canceled, so if ctx is canceled
+// first then the process is killed instead of being left running.
+func waitProcess(ctx context.Context, proc gateway.ContainerProcess) error {
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- proc.Wait()
+	}()
+
+	select {
+	case err := <-waitErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	kctx, cancel := context.WithTimeout(context.Background(), processKillTimeout)
+	defer cancel()
+
+	// The signal is best effort, if the build has also been canceled then
+	// BuildKit kills the process when it releases the build's containers.
+	_ = proc.Signal(kctx, syscall.SIGKILL)
+	select {
+	case <-waitErr:
+	case <-kctx.Done():
+	}
+	return ctx.Err()
+}
+
+// releaseContainer releases a container even if the context it was created
+// with has been canceled.
+func releaseContainer(ctr gateway.Container) error {
+	ctx, cancel := context.WithTimeout(context.Background(), processKillTimeout)
+	defer cancel()
+	return ctr.Release(ctx)
 }
 
 func NopWriteCloser(w io.Writer) io.WriteCloser {
@@ -0,0 +1,48 @@
+package codegen
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProcess is a process that runs until it is signaled.
+type fakeProcess struct {
+	sig    syscall.Signal
+	exited chan struct{}
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exited
+	return nil
+}
+
+func (p *fakeProcess) Resize(ctx context.Context, size gateway.WinSize) error {
+	return nil
+}
+
+func (p *fakeProcess) Signal(ctx context.Context, sig syscall.Signal) error {
+	p.sig = sig
+	close(p.exited)
+	return nil
+}
+
+func TestWaitProcess(t *testing.T) {
+	t.Parallel()
+
+	proc := &fakeProcess{exited: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	err := waitProcess(ctx, proc)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, syscall.SIGKILL, proc.sig)
+}
@@ -0,0 +1,85 @@
+package codegen
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/ignorefile"
+	"github.com/openllb/hlb/pkg/llbutil"
+)
+
+// moduleIgnore returns the patterns of the .hlbignore file in the directory
+// of the module being emitted, which apply to its local sources and file
+// imports without any options. Modules without one ignore nothing.
+func moduleIgnore(ctx context.Context, dir ast.Directory) ([]string, error) {
+	if dir == nil {
+		return nil, nil
+	}
+
+	filename := filepath.Join(ModuleDir(ctx), ignorefile.ModuleName)
+	rc, err := dir.Open(filename)
+	if err != nil {
+		if errdefs.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, ProgramCounter(ctx).WithError(err)
+	}
+	defer rc.Close()
+
+	patterns, err := ignorefile.Parse(rc)
+	if err != nil {
+		var ipe *ignorefile.InvalidPatternError
+		if errors.As(err, &ipe) {
+			return nil, errdefs.WithInvalidModuleIgnorePattern(ProgramCounter(ctx), filename, ipe.Pattern, ipe.Err)
+		}
+		return nil, ProgramCounter(ctx).WithError(err)
+	}
+	return patterns, nil
+}
+
+// moduleRelative returns path relative to the directory of the module being
+// emitted, or false if it is outside of it.
+func moduleRelative(ctx context.Context, path string) (string, bool) {
+	rel, err := filepath.Rel(ModuleDir(ctx), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// checkImportIgnored returns an error if uri is a file import of a path that
+// is excluded by the .hlbignore file of the importing module.
+func checkImportIgnored(ctx context.Context, dir ast.Directory, id *ast.ImportDecl, uri string) error {
+	// Invalid uris are reported when the module is parsed.
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "" && u.Scheme != "file") {
+		return nil
+	}
+	filename, err := parser.ResolvePath(ModuleDir(ctx), u.Host+u.Path)
+	if err != nil {
+		return nil
+	}
+	rel, ok := moduleRelative(ctx, filename)
+	if !ok {
+		return nil
+	}
+
+	patterns, err := moduleIgnore(ctx, dir)
+	if err != nil {
+		return err
+	}
+	ignored, err := llbutil.MatchesPatterns(filepath.ToSlash(rel), patterns)
+	if err != nil {
+		return err
+	}
+	if ignored {
+		return errdefs.WithImportPathIgnored(importNode(id), uri, ignorefile.ModuleName)
+	}
+	return nil
+}
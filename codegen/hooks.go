@@ -0,0 +1,326 @@
+package codegen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+)
+
+// Hooks are called as the targets of a build are generated and solved, like
+// to notify a deployment system of the images a build pushed. Every hook is
+// optional, and may be called concurrently for different targets.
+type Hooks struct {
+	// PreTarget is called before a target is generated. An error fails the
+	// target when it is solved instead of generating it, like any other
+	// failure of a single target.
+	PreTarget func(ctx context.Context, info TargetInfo) error
+
+	// PostTarget is called once for every target PreTarget was called for,
+	// after it is solved, fails or is canceled.
+	PostTarget func(ctx context.Context, result TargetResult) error
+
+	// PostExport is called once for every export of a target, like an image
+	// pushed by dockerPush or a file written by download, after it is
+	// solved.
+	PostExport func(ctx context.Context, info ExportInfo) error
+}
+
+// WithHooks sets hooks that are called before and after every target and
+// after every export. Errors of PostTarget and PostExport do not fail the
+// target or cancel the others, but are returned with the error of the build.
+func WithHooks(hooks Hooks) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.hooks = &hooks
+	}
+}
+
+// TargetInfo describes a target passed to hooks.
+type TargetInfo struct {
+	// Name is the name of the target in progress and errors. Targets of
+	// GenerateAll are named after their module and target.
+	Name string
+
+	// Args are the arguments of the target's parameters.
+	Args []string
+}
+
+// TargetStatus is how a target finished.
+type TargetStatus string
+
+const (
+	TargetSucceeded TargetStatus = "succeeded"
+	TargetFailed    TargetStatus = "failed"
+
+	// TargetCanceled is the status of a target canceled by the failure of
+	// another target.
+	TargetCanceled TargetStatus = "canceled"
+)
+
+// TargetResult describes a target that finished.
+type TargetResult struct {
+	TargetInfo
+
+	Status TargetStatus
+
+	// Err is the error of a target that failed or was canceled.
+	Err error
+
+	// Duration is the time since PreTarget was called for the target.
+	Duration time.Duration
+
+	// Exports are the exports of the target that were solved, in the order
+	// they finished.
+	Exports []ExportInfo
+}
+
+// ExportKind is the builtin that exported a filesystem.
+type ExportKind string
+
+const (
+	ExportDockerPush            ExportKind = "dockerPush"
+	ExportDockerLoad            ExportKind = "dockerLoad"
+	ExportDownload              ExportKind = "download"
+	ExportDownloadTarball       ExportKind = "downloadTarball"
+	ExportDownloadOCITarball    ExportKind = "downloadOCITarball"
+	ExportDownloadDockerTarball ExportKind = "downloadDockerTarball"
+)
+
+// ExportInfo describes an export of a target.
+type ExportInfo struct {
+	// Target is the name of the target the export was generated for. An
+	// export shared by several targets is only reported for the first.
+	Target string
+
+	Kind ExportKind
+
+	// Ref is the image reference of dockerPush, dockerLoad and
+	// downloadDockerTarball.
+	Ref string
+
+	// Path is the local path of download and the tarball downloads.
+	Path string
+
+	// Digest is the digest of the exported image, if the exporter reported
+	// one.
+	Digest digest.Digest
+}
+
+// hookRun calls the hooks of a single Generate, and collects the errors of
+// the hooks that do not fail their target.
+type hookRun struct {
+	hooks Hooks
+	mu    sync.Mutex
+	errs  []error
+}
+
+func newHookRun(hooks *Hooks) *hookRun {
+	if hooks == nil {
+		return nil
+	}
+	return &hookRun{hooks: *hooks}
+}
+
+func (hr *hookRun) addError(err error) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.errs = append(hr.errs, err)
+}
+
+// Err returns the errors of PostTarget and PostExport hooks, in the order
+// they were returned.
+func (hr *hookRun) Err() error {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	switch len(hr.errs) {
+	case 0:
+		return nil
+	case 1:
+		return hr.errs[0]
+	}
+	msgs := make([]string, len(hr.errs))
+	for i, err := range hr.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%d hooks failed: %s", len(hr.errs), strings.Join(msgs, "; "))
+}
+
+// withErr adds the hook errors to the error of a build.
+func (hr *hookRun) withErr(err error) error {
+	herr := hr.Err()
+	switch {
+	case herr == nil:
+		return err
+	case err == nil:
+		return herr
+	}
+	return fmt.Errorf("%w (hooks also failed: %s)", err, herr)
+}
+
+// Request returns a request that solves req and then returns the hook errors
+// with its error.
+func (hr *hookRun) Request(req solver.Request) solver.Request {
+	return &hookRunRequest{hr: hr, req: req}
+}
+
+// preTarget calls the PreTarget hook of a target, and returns the hooks of the
+// target to attribute its exports and result to.
+func (hr *hookRun) preTarget(ctx context.Context, info TargetInfo) (*targetHooks, error) {
+	th := &targetHooks{hr: hr, info: info, start: time.Now()}
+	if hr.hooks.PreTarget == nil {
+		return th, nil
+	}
+	err := hr.hooks.PreTarget(ctx, info)
+	if err != nil {
+		return th, fmt.Errorf("pre-target hook for %s: %w", info.Name, err)
+	}
+	return th, nil
+}
+
+type hookRunRequest struct {
+	hr  *hookRun
+	req solver.Request
+}
+
+func (r *hookRunRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	return r.hr.withErr(r.req.Solve(ctx, cln, mw, opts...))
+}
+
+func (r *hookRunRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
+
+// failedRequest is the request of a target that failed before it was
+// generated.
+type failedRequest struct {
+	err error
+}
+
+func (r *failedRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	return r.err
+}
+
+func (r *failedRequest) Tree(tree treeprint.Tree) error {
+	tree.AddNode(r.err.Error())
+	return nil
+}
+
+// targetHooks calls the hooks of a single target.
+type targetHooks struct {
+	hr    *hookRun
+	info  TargetInfo
+	start time.Time
+
+	mu      sync.Mutex
+	exports []ExportInfo
+	done    bool
+}
+
+// postTarget calls the PostTarget hook of the target with how it finished.
+// It is only called the first time, so that a target is never reported twice.
+func (th *targetHooks) postTarget(ctx context.Context, err error) {
+	th.mu.Lock()
+	if th.done {
+		th.mu.Unlock()
+		return
+	}
+	th.done = true
+	result := TargetResult{
+		TargetInfo: th.info,
+		Status:     TargetSucceeded,
+		Err:        err,
+		Duration:   time.Since(th.start),
+		Exports:    append([]ExportInfo(nil), th.exports...),
+	}
+	th.mu.Unlock()
+
+	switch {
+	case err == nil:
+	case ctx.Err() != nil, errors.Is(err, context.Canceled):
+		result.Status = TargetCanceled
+	default:
+		result.Status = TargetFailed
+	}
+
+	if th.hr.hooks.PostTarget == nil {
+		return
+	}
+	herr := th.hr.hooks.PostTarget(ctx, result)
+	if herr != nil {
+		th.hr.addError(fmt.Errorf("post-target hook for %s: %w", th.info.Name, herr))
+	}
+}
+
+// postExport records an export of the target and calls the PostExport hook.
+func (th *targetHooks) postExport(ctx context.Context, info ExportInfo) {
+	info.Target = th.info.Name
+	th.mu.Lock()
+	th.exports = append(th.exports, info)
+	th.mu.Unlock()
+
+	if th.hr.hooks.PostExport == nil {
+		return
+	}
+	err := th.hr.hooks.PostExport(ctx, info)
+	if err != nil {
+		th.hr.addError(fmt.Errorf("post-export hook for %s of %s: %w", info.Kind, info.Target, err))
+	}
+}
+
+// Request returns a request that solves req and then calls the PostTarget
+// hook.
+func (th *targetHooks) Request(req solver.Request) solver.Request {
+	return &targetHooksRequest{th: th, req: req}
+}
+
+type targetHooksRequest struct {
+	th  *targetHooks
+	req solver.Request
+}
+
+func (r *targetHooksRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	err := r.req.Solve(ctx, cln, mw, opts...)
+	r.th.postTarget(ctx, err)
+	return err
+}
+
+func (r *targetHooksRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
+
+// withExportHook adds a callback to the solve options of an export that calls
+// the PostExport hook of the target it is generated for. Hook errors are
+// collected instead of failing the export.
+func withExportHook(ctx context.Context, fs *Filesystem, kind ExportKind, ref, localPath string) {
+	if getTargetHooks(ctx) == nil {
+		return
+	}
+	fs.SolveOpts = append(fs.SolveOpts,
+		solver.WithCallback(func(_ context.Context, resp *client.SolveResponse) error {
+			info := ExportInfo{Kind: kind, Ref: ref, Path: localPath}
+			if resp != nil {
+				info.Digest = digest.Digest(resp.ExporterResponse[llbutil.KeyContainerImageDigest])
+			}
+			postExport(ctx, info)
+			return nil
+		}),
+	)
+}
+
+// postExport calls the PostExport hook of the target an export is generated
+// for, for exports that are not done when their solve is.
+func postExport(ctx context.Context, info ExportInfo) {
+	th := getTargetHooks(ctx)
+	if th == nil {
+		return
+	}
+	th.postExport(ctx, info)
+}
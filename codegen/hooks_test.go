@@ -0,0 +1,300 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+)
+
+// hookRecorder records the invocations of hooks, and fails the hooks of the
+// targets in errs.
+type hookRecorder struct {
+	errs    map[string]error
+	mu      sync.Mutex
+	pre     []string
+	results map[string][]TargetResult
+	exports []ExportInfo
+}
+
+func newHookRecorder(errs map[string]error) *hookRecorder {
+	return &hookRecorder{
+		errs:    errs,
+		results: make(map[string][]TargetResult),
+	}
+}
+
+func (hr *hookRecorder) Hooks() Hooks {
+	return Hooks{
+		PreTarget: func(ctx context.Context, info TargetInfo) error {
+			hr.mu.Lock()
+			defer hr.mu.Unlock()
+			hr.pre = append(hr.pre, info.Name)
+			return hr.errs["pre:"+info.Name]
+		},
+		PostTarget: func(ctx context.Context, result TargetResult) error {
+			hr.mu.Lock()
+			defer hr.mu.Unlock()
+			hr.results[result.Name] = append(hr.results[result.Name], result)
+			return hr.errs["post:"+result.Name]
+		},
+		PostExport: func(ctx context.Context, info ExportInfo) error {
+			hr.mu.Lock()
+			defer hr.mu.Unlock()
+			hr.exports = append(hr.exports, info)
+			return hr.errs["export:"+info.Target]
+		},
+	}
+}
+
+// statuses returns the status of every target PostTarget was called for,
+// failing if it was called more than once for a target.
+func (hr *hookRecorder) statuses(t *testing.T) map[string]TargetStatus {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	statuses := make(map[string]TargetStatus)
+	for name, results := range hr.results {
+		require.Len(t, results, 1, name)
+		statuses[name] = results[0].Status
+	}
+	return statuses
+}
+
+func (hr *hookRecorder) preTargets() []string {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	pre := append([]string(nil), hr.pre...)
+	sort.Strings(pre)
+	return pre
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	string a() {
+		"a"
+	}
+
+	string b() {
+		"b"
+	}
+	`)
+
+	var buf bytes.Buffer
+	rec := newHookRecorder(map[string]error{
+		"post:a": errors.New("notify failed"),
+	})
+	req, err := New(nil, nil, WithHooks(rec.Hooks())).Generate(ctx, mod, []Target{
+		{Name: "a", Output: &buf},
+		{Name: "b", Output: failingWriter{}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, rec.preTargets())
+
+	// The failure of a PostTarget hook is returned with the failure of the
+	// build, but does not fail its target.
+	err = req.Solve(ctx, nil, nil)
+	require.EqualError(t, err, "write failed (hooks also failed: post-target hook for a: notify failed)")
+	require.Equal(t, "a", buf.String())
+	require.Equal(t, map[string]TargetStatus{
+		"a": TargetSucceeded,
+		"b": TargetFailed,
+	}, rec.statuses(t))
+}
+
+func TestHooksPreTarget(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	string a() {
+		"a"
+	}
+
+	string b() {
+		"b"
+	}
+	`)
+
+	var buf bytes.Buffer
+	rec := newHookRecorder(map[string]error{
+		"pre:a": errors.New("denied"),
+	})
+	req, err := New(nil, nil, WithHooks(rec.Hooks())).Generate(ctx, mod, []Target{
+		{Name: "a", Output: &buf},
+		{Name: "b", Output: &buf},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, rec.preTargets())
+
+	// Only the target of the hook fails, and the targets after it are still
+	// generated.
+	err = req.Solve(ctx, nil, nil)
+	require.EqualError(t, err, "pre-target hook for a: denied")
+	require.NotContains(t, buf.String(), "a")
+
+	statuses := rec.statuses(t)
+	require.Equal(t, TargetFailed, statuses["a"])
+	require.Contains(t, []TargetStatus{TargetSucceeded, TargetCanceled}, statuses["b"])
+}
+
+func TestHooksTestMode(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	string testPass() {
+		"pass"
+	}
+
+	fs testFail() {
+		assertEq "a" "b"
+	}
+
+	string testSolveFail() {
+		"solve"
+	}
+
+	string testDenied() {
+		"denied"
+	}
+	`)
+
+	var buf, diag bytes.Buffer
+	rec := newHookRecorder(map[string]error{
+		"pre:testDenied":  errors.New("denied"),
+		"post:testPass":   errors.New("notify failed"),
+		"post:testDenied": errors.New("notify failed"),
+	})
+	req, err := New(nil, nil, WithTestMode(), WithDiagnosticWriter(&diag), WithHooks(rec.Hooks())).Generate(ctx, mod, []Target{
+		{Name: "testPass", Output: &buf},
+		{Name: "testFail", Output: &buf},
+		{Name: "testSolveFail", Output: failingWriter{}},
+		{Name: "testDenied", Output: &buf},
+	})
+	require.NoError(t, err)
+
+	// Every test is reported once, even though failed tests do not cancel
+	// the others.
+	err = req.Solve(ctx, nil, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "3 of 4 tests failed (hooks also failed: 2 hooks failed: ")
+	require.Contains(t, err.Error(), "post-target hook for testPass: notify failed")
+	require.Contains(t, err.Error(), "post-target hook for testDenied: notify failed")
+	require.Contains(t, diag.String(), "pre-target hook for testDenied: denied")
+	require.Equal(t, "pass", buf.String())
+	require.Equal(t, []string{"testDenied", "testFail", "testPass", "testSolveFail"}, rec.preTargets())
+	require.Equal(t, map[string]TargetStatus{
+		"testPass":      TargetSucceeded,
+		"testFail":      TargetFailed,
+		"testSolveFail": TargetFailed,
+		"testDenied":    TargetFailed,
+	}, rec.statuses(t))
+}
+
+func TestHooksGenerateAll(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	string a() {
+		"a"
+	}
+
+	string b() {
+		"b"
+	}
+	`)
+
+	var buf bytes.Buffer
+	rec := newHookRecorder(nil)
+	req, err := GenerateAll(ctx, nil, nil, []ModuleTargets{{
+		Module: mod,
+		Targets: []Target{
+			{Name: "a", Output: &buf},
+			{Name: "b", Output: failingWriter{}},
+		},
+	}}, WithHooks(rec.Hooks()))
+	require.NoError(t, err)
+
+	// Hooks are given the same names as the errors of the targets.
+	a := fmt.Sprintf("%s:a", mod.Pos.Filename)
+	b := fmt.Sprintf("%s:b", mod.Pos.Filename)
+	err = req.Solve(ctx, nil, nil)
+	require.EqualError(t, err, b+": write failed")
+	require.Equal(t, []string{a, b}, rec.preTargets())
+
+	statuses := rec.statuses(t)
+	require.Equal(t, TargetSucceeded, statuses[a])
+	require.Equal(t, TargetFailed, statuses[b])
+}
+
+func TestHooksPostExport(t *testing.T) {
+	t.Parallel()
+
+	rec := newHookRecorder(map[string]error{
+		"export:app": errors.New("deploy failed"),
+	})
+	hr := newHookRun(&Hooks{
+		PostTarget: rec.Hooks().PostTarget,
+		PostExport: rec.Hooks().PostExport,
+	})
+	ctx := context.Background()
+	th, err := hr.preTarget(ctx, TargetInfo{Name: "app"})
+	require.NoError(t, err)
+
+	var fs Filesystem
+	withExportHook(withTargetHooks(ctx, th), &fs, ExportDockerPush, "docker.io/library/app:latest", "")
+	withExportHook(withTargetHooks(ctx, th), &fs, ExportDownload, "", "/tmp/out")
+
+	// Exports are reported when their solve is done.
+	info := &solver.SolveInfo{}
+	for _, opt := range fs.SolveOpts {
+		require.NoError(t, opt(info))
+	}
+	require.Len(t, info.Callbacks, 2)
+	resp := &client.SolveResponse{
+		ExporterResponse: map[string]string{
+			llbutil.KeyContainerImageDigest: "sha256:abc",
+		},
+	}
+	for _, cb := range info.Callbacks {
+		require.NoError(t, cb(ctx, resp))
+	}
+
+	err = th.Request(&fakeRequest{}).Solve(ctx, nil, nil)
+	require.NoError(t, err)
+
+	expected := []ExportInfo{{
+		Target: "app",
+		Kind:   ExportDockerPush,
+		Ref:    "docker.io/library/app:latest",
+		Digest: "sha256:abc",
+	}, {
+		Target: "app",
+		Kind:   ExportDownload,
+		Path:   "/tmp/out",
+		Digest: "sha256:abc",
+	}}
+	require.Equal(t, expected, rec.exports)
+	require.Len(t, rec.results["app"], 1)
+	require.Equal(t, expected, rec.results["app"][0].Exports)
+	require.EqualError(t, hr.Err(), "2 hooks failed: post-export hook for dockerPush of app: deploy failed; post-export hook for download of app: deploy failed")
+
+	// Exports are not generated with hooks outside of a target.
+	fs = Filesystem{}
+	withExportHook(ctx, &fs, ExportDownload, "", "/tmp/out")
+	require.Empty(t, fs.SolveOpts)
+}
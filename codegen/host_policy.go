@@ -0,0 +1,47 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+)
+
+// WithLocalAllowList restricts localRun to the commands and localEnv to the
+// environment variables of an allow-list, so that untrusted modules can be
+// built without running arbitrary commands on the host. Empty lists disable
+// localRun and localEnv entirely.
+func WithLocalAllowList(commands, keys []string) CodeGenOption {
+	return WithHostPolicy(AllowLocal(commands, keys))
+}
+
+// AllowLocal returns a host policy that only allows localRun to run the
+// commands, and localEnv to read the environment variables, in its lists.
+// Commands match the name or path the command is run by exactly, so allowing
+// "git" doesn't allow "./git". Scripts that are not shlexed are run by
+// /bin/sh, which must be allowed for them and lets them run any command.
+func AllowLocal(commands, keys []string) HostPolicy {
+	allowedCommands := make(map[string]struct{})
+	for _, command := range commands {
+		allowedCommands[command] = struct{}{}
+	}
+	allowedKeys := make(map[string]struct{})
+	for _, key := range keys {
+		allowedKeys[key] = struct{}{}
+	}
+
+	return func(ctx context.Context, access HostAccess) error {
+		switch access.Builtin {
+		case "localRun":
+			if len(access.Command) == 0 {
+				return nil
+			}
+			if _, ok := allowedCommands[access.Command[0]]; !ok {
+				return fmt.Errorf("%s is not in the allowed commands", access.Command[0])
+			}
+		case "localEnv":
+			if _, ok := allowedKeys[access.Key]; !ok {
+				return fmt.Errorf("%s is not in the allowed environment variables", access.Key)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,212 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/linter"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// LintMode is how lint findings are handled when generating.
+type LintMode int
+
+const (
+	// LintOff discards lint findings.
+	LintOff LintMode = iota
+
+	// LintWarn writes lint findings to the diagnostic writer.
+	LintWarn
+
+	// LintError writes lint findings to the diagnostic writer, and fails
+	// before solving if there are any. Warnings are treated as errors.
+	LintError
+)
+
+func (m LintMode) String() string {
+	switch m {
+	case LintOff:
+		return "off"
+	case LintWarn:
+		return "warn"
+	case LintError:
+		return "error"
+	default:
+		return fmt.Sprintf("LintMode(%d)", int(m))
+	}
+}
+
+// ParseLintMode parses a lint mode from one of "off", "warn" or "error".
+func ParseLintMode(s string) (LintMode, error) {
+	for _, mode := range []LintMode{LintOff, LintWarn, LintError} {
+		if mode.String() == s {
+			return mode, nil
+		}
+	}
+	return LintOff, fmt.Errorf("invalid lint mode %q, expected one of off, warn or error", s)
+}
+
+// WithLintMode sets how lint findings of the root module and its imports are
+// handled. By default, lint findings are discarded.
+func WithLintMode(mode LintMode) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.lintMode = mode
+	}
+}
+
+// WithImportLintMode sets the strictest lint mode for modules imported from a
+// filesystem, which are usually maintained by someone else. By default, their
+// lint findings are at most warnings.
+func WithImportLintMode(mode LintMode) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.importLintMode = mode
+	}
+}
+
+// WithDiagnosticWriter sets the writer that lint findings are written to.
+func WithDiagnosticWriter(w io.Writer) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.diagnosticWriter = w
+	}
+}
+
+// lintResults are the lint findings of modules that have not been reported
+// yet.
+type lintResults struct {
+	mu       sync.Mutex
+	linted   map[*ast.Module]struct{}
+	findings map[*ast.Module][]*linter.Finding
+}
+
+func newLintResults() *lintResults {
+	return &lintResults{
+		linted:   make(map[*ast.Module]struct{}),
+		findings: make(map[*ast.Module][]*linter.Finding),
+	}
+}
+
+// Lint lints a module with the lint mode of the code generator, and holds
+// onto its findings until they are reported at the end of Generate. Linting
+// rewrites deprecated syntax, so a root module must be linted before it is
+// checked. Generate lints the root module if it hasn't been already. Bindings
+// built as one of the targets are not reported as unused.
+func (cg *CodeGen) Lint(ctx context.Context, mod *ast.Module, targets ...Target) {
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	cg.lint(ctx, mod, cg.lintMode, linter.WithTargets(names...))
+}
+
+func (cg *CodeGen) lint(ctx context.Context, mod *ast.Module, mode LintMode, opts ...linter.LintOption) {
+	if !cg.lints.markLinted(mod) {
+		return
+	}
+	cg.lints.add(mod, mode, linter.Findings(linter.Lint(ctx, mod, opts...)))
+}
+
+// markLinted marks a module as linted, and returns false if it already was.
+func (lr *lintResults) markLinted(mod *ast.Module) bool {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	_, ok := lr.linted[mod]
+	lr.linted[mod] = struct{}{}
+	return !ok
+}
+
+// add holds onto the findings of a module until they are reported, at error
+// severity if the lint mode fails on them.
+func (lr *lintResults) add(mod *ast.Module, mode LintMode, findings []*linter.Finding) {
+	if mode == LintOff || len(findings) == 0 {
+		return
+	}
+
+	if mode == LintError {
+		errFindings := make([]*linter.Finding, len(findings))
+		for i, f := range findings {
+			errFindings[i] = &linter.Finding{
+				Err:      f.Err,
+				Severity: linter.SeverityError,
+				Fix:      f.Fix,
+			}
+		}
+		findings = errFindings
+	}
+
+	lr.mu.Lock()
+	lr.findings[mod] = append(lr.findings[mod], findings...)
+	lr.mu.Unlock()
+}
+
+// lintWarner adds warnings found while generating a module to its lint
+// findings, for problems that are only known once values are evaluated.
+type lintWarner struct {
+	lr   *lintResults
+	mode LintMode
+}
+
+// warn adds a warning to the lint findings of a module, which is reported
+// with the rest of them at the end of Generate.
+func (lw *lintWarner) warn(mod *ast.Module, err error) {
+	if lw == nil || mod == nil {
+		return
+	}
+	lw.lr.add(mod, lw.mode, []*linter.Finding{{
+		Err:      err,
+		Severity: linter.SeverityWarning,
+	}})
+}
+
+// fsImportLintMode returns the lint mode for a module imported from a
+// filesystem.
+func (cg *CodeGen) fsImportLintMode() LintMode {
+	if cg.importLintMode < cg.lintMode {
+		return cg.importLintMode
+	}
+	return cg.lintMode
+}
+
+// reportLint writes the lint findings that haven't been reported yet to the
+// diagnostic writer grouped by file, and returns the findings at error
+// severity.
+func (cg *CodeGen) reportLint(ctx context.Context) error {
+	cg.lints.mu.Lock()
+	var mods []*ast.Module
+	for mod := range cg.lints.findings {
+		mods = append(mods, mod)
+	}
+	findings := cg.lints.findings
+	cg.lints.findings = make(map[*ast.Module][]*linter.Finding)
+	cg.lints.mu.Unlock()
+
+	sort.Slice(mods, func(i, j int) bool {
+		if mods[i].Pos.Filename != mods[j].Pos.Filename {
+			return mods[i].Pos.Filename < mods[j].Pos.Filename
+		}
+		return mods[i].URI < mods[j].URI
+	})
+
+	var errs []error
+	for _, mod := range mods {
+		for _, f := range findings[mod] {
+			if f.Severity == linter.SeverityError {
+				errs = append(errs, f)
+				continue
+			}
+			if cg.diagnosticWriter == nil {
+				continue
+			}
+			for _, span := range diagnostic.Spans(f) {
+				fmt.Fprintln(cg.diagnosticWriter, span.Pretty(ctx))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &diagnostic.Error{Diagnostics: errs}
+	}
+	return nil
+}
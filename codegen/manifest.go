@@ -0,0 +1,334 @@
+package codegen
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// maxManifestDiscrepancies is the number of discrepancies listed when local
+// files do not match their manifest.
+const maxManifestDiscrepancies = 10
+
+// ManifestEntry is a file recorded in a local manifest.
+type ManifestEntry struct {
+	Path   string
+	Size   int64
+	Digest digest.Digest
+
+	// Line is the line of the manifest the entry was read from.
+	Line int
+}
+
+// WriteLocalManifest writes a manifest of the files in dir that are not
+// matched by the exclude patterns, for verifyManifest to verify a local
+// source against.
+//
+// Each line of a manifest is the slash separated path of a file relative to
+// dir, its size and its sha256 digest, sorted by path. The size and digest
+// come last so that the path may contain spaces. Only regular files and
+// symlinks are recorded: a symlink is recorded by its target rather than the
+// file it points to, since it is synced as a symlink. Directories are not
+// recorded, so empty directories are ignored, and neither are file modes,
+// which differ between checkouts.
+func WriteLocalManifest(dir string, w io.Writer, excludePatterns ...string) error {
+	entries, err := walkManifest(context.Background(), dir, nil, excludePatterns)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		if strings.ContainsAny(entry.Path, "\r\n") {
+			return errors.Errorf("cannot write manifest entry for path with a newline %q", entry.Path)
+		}
+		_, err = fmt.Fprintf(bw, "%s %d %s\n", entry.Path, entry.Size, entry.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadLocalManifest reads the entries of a manifest written by
+// WriteLocalManifest. Blank lines and lines starting with "#" are ignored.
+func ReadLocalManifest(r io.Reader) ([]ManifestEntry, error) {
+	var (
+		entries []ManifestEntry
+		seen    = make(map[string]int)
+		line    int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// The path may contain spaces, so the fields are split from the end.
+		var fields [3]string
+		for i := 2; i > 0; i-- {
+			n := strings.LastIndex(text, " ")
+			if n < 0 {
+				break
+			}
+			fields[i], text = text[n+1:], text[:n]
+		}
+		fields[0] = text
+		if fields[0] == "" || fields[1] == "" || fields[2] == "" {
+			return nil, errors.Errorf("line %d: expected a path, size and digest", line)
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.Errorf("line %d: invalid size %q", line, fields[1])
+		}
+
+		dgst, err := digest.Parse(fields[2])
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if dgst.Algorithm() != digest.SHA256 {
+			return nil, errors.Errorf("line %d: expected a sha256 digest, got %s", line, dgst.Algorithm())
+		}
+
+		path := filepath.ToSlash(filepath.Clean(fields[0]))
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			return nil, errors.Errorf("line %d: path %q is not relative to the local directory", line, fields[0])
+		}
+		if prev, ok := seen[path]; ok {
+			return nil, errors.Errorf("line %d: path %q is already recorded on line %d", line, path, prev)
+		}
+		seen[path] = line
+
+		entries = append(entries, ManifestEntry{
+			Path:   path,
+			Size:   size,
+			Digest: dgst,
+			Line:   line,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// syncedEntries returns the entries of a manifest for the files that are
+// synced up with the include and exclude patterns, the same way as the files
+// of a local source are walked. Files that are never synced aren't required
+// by the manifest.
+func syncedEntries(entries []ManifestEntry, includePatterns, excludePatterns []string) ([]ManifestEntry, error) {
+	var include, exclude *fileutils.PatternMatcher
+	if len(includePatterns) > 0 {
+		var err error
+		include, err = fileutils.NewPatternMatcher(includePatterns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(excludePatterns) > 0 {
+		var err error
+		exclude, err = fileutils.NewPatternMatcher(excludePatterns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var synced []ManifestEntry
+	for _, entry := range entries {
+		ok, err := syncedPath(entry.Path, include, exclude)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			synced = append(synced, entry)
+		}
+	}
+	return synced, nil
+}
+
+// syncedPath returns true if a file is synced up with the include and exclude
+// matchers, which are matched against each of its parent directories first.
+func syncedPath(path string, include, exclude *fileutils.PatternMatcher) (bool, error) {
+	var (
+		parts       = strings.Split(path, "/")
+		included    = include == nil
+		excluded    bool
+		includeInfo fileutils.MatchInfo
+		excludeInfo fileutils.MatchInfo
+		err         error
+	)
+	for i := range parts {
+		p := filepath.FromSlash(strings.Join(parts[:i+1], "/"))
+		if include != nil {
+			included, includeInfo, err = include.MatchesUsingParentResults(p, includeInfo)
+			if err != nil {
+				return false, err
+			}
+		}
+		if exclude != nil {
+			excluded, excludeInfo, err = exclude.MatchesUsingParentResults(p, excludeInfo)
+			if err != nil {
+				return false, err
+			}
+			// An excluded directory is skipped unless a pattern may
+			// re-include files under it.
+			if excluded && i < len(parts)-1 && !exclude.Exclusions() {
+				return false, nil
+			}
+		}
+	}
+	return included && !excluded, nil
+}
+
+const (
+	// VerifyManifestMountpoint is where the synced files of a local source
+	// are mounted in the helper for verifyManifest.
+	VerifyManifestMountpoint = "/run/hlb/verify"
+
+	// VerifyManifestInputMountpoint is where the manifest is mounted in the
+	// helper for verifyManifest.
+	VerifyManifestInputMountpoint = "/run/hlb/verify-manifest"
+)
+
+// VerifyManifestScript verifies the files under the path given as the first
+// argument against the manifest given as the second. Each line of the
+// manifest is the line of the entry in the original manifest, followed by the
+// entry. Files not in the manifest are allowed if the third argument is
+// "true". The first discrepancies, up to the fourth argument, are printed with
+// the name of the original manifest, given as the fifth argument, and the
+// script fails if there are any.
+const VerifyManifestScript = `set -e
+actual="$(mktemp)"
+cd "$1"
+find . \( -type f -o -type l \) | LC_ALL=C sort | while IFS= read -r file; do
+	if [ -L "$file" ]; then
+		target="$(readlink "$file")"
+		size=$(( $(printf '%s' "$target" | wc -c) ))
+		sum="$(printf '%s' "$target" | sha256sum)"
+	else
+		size=$(( $(wc -c < "$file") ))
+		sum="$(sha256sum < "$file")"
+	fi
+	printf '%s %s sha256:%s\n' "${file#./}" "$size" "${sum%% *}"
+done > "$actual"
+awk -v allowExtra="$3" -v max="$4" -v manifest="$5" '
+function entry(line, numbered) {
+	if (numbered) sub(/^[^ ]* /, "", line)
+	return substr(line, 1, length(line) - length($NF) - length($(NF-1)) - 2)
+}
+function report(msg) {
+	if (++count == 1) print "local files do not match manifest " manifest
+	if (count <= max) print "  " msg
+}
+FILENAME == ARGV[1] {
+	path = entry($0, 1)
+	order[++n] = path
+	where[path] = manifest ":" $1
+	size[path] = $(NF-1)
+	sum[path] = $NF
+	next
+}
+{
+	path = entry($0, 0)
+	if (path in size) {
+		gotSize[path] = $(NF-1)
+		gotSum[path] = $NF
+	} else if (allowExtra != "true") {
+		extra[++e] = path
+	}
+}
+END {
+	for (i = 1; i <= n; i++) {
+		p = order[i]
+		if (!(p in gotSize)) {
+			report("missing " p " (" where[p] ")")
+		} else if (gotSize[p] != size[p]) {
+			report("modified " p " (" where[p] "): expected " size[p] " bytes, got " gotSize[p] " bytes")
+		} else if (gotSum[p] != sum[p]) {
+			report("modified " p " (" where[p] "): expected " sum[p] ", got " gotSum[p])
+		}
+	}
+	for (i = 1; i <= e; i++) {
+		report("extra " extra[i])
+	}
+	if (count > max) print "  and " count - max " more"
+	exit count > 0
+}
+' "$2" "$actual"
+`
+
+// verifyManifestInput returns the manifest given to VerifyManifestScript.
+func verifyManifestInput(entries []ManifestEntry) []byte {
+	var sb strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&sb, "%d %s %d %s\n", entry.Line, entry.Path, entry.Size, entry.Digest)
+	}
+	return []byte(sb.String())
+}
+
+// walkManifest returns the manifest entries of the files in dir that are
+// synced up with the include and exclude patterns.
+func walkManifest(ctx context.Context, dir string, includePatterns, excludePatterns []string) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := fsutil.Walk(ctx, dir, &fsutil.WalkOpt{
+		IncludePatterns: includePatterns,
+		ExcludePatterns: excludePatterns,
+	}, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		var h io.Reader
+		switch {
+		case fi.Mode().IsRegular():
+			f, err := os.Open(filepath.Join(dir, path))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			h = f
+		case fi.Mode()&os.ModeSymlink != 0:
+			stat, ok := fi.Sys().(*fstypes.Stat)
+			if !ok {
+				return errors.Errorf("invalid symlink %s", path)
+			}
+			h = strings.NewReader(stat.Linkname)
+		default:
+			return nil
+		}
+
+		digester := sha256.New()
+		size, err := io.Copy(digester, h)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, ManifestEntry{
+			Path:   filepath.ToSlash(path),
+			Size:   size,
+			Digest: digest.NewDigest(digest.SHA256, digester),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
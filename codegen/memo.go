@@ -0,0 +1,82 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/openllb/hlb/parser/ast"
+	"golang.org/x/sync/singleflight"
+)
+
+// memo holds the values of memoizable function declarations for a single
+// Generate so that every call site shares one evaluation.
+type memo struct {
+	g      singleflight.Group
+	mu     sync.Mutex
+	values map[string]memoResult
+}
+
+type memoResult struct {
+	val Value
+	err error
+}
+
+func newMemo() *memo {
+	return &memo{values: make(map[string]memoResult)}
+}
+
+// Do returns the memoized value for key, invoking fn at most once even when
+// called concurrently from multiple targets.
+func (m *memo) Do(key string, fn func() (Value, error)) (Value, error) {
+	m.mu.Lock()
+	res, ok := m.values[key]
+	m.mu.Unlock()
+	if ok {
+		return res.val, res.err
+	}
+
+	v, _, _ := m.g.Do(key, func() (interface{}, error) {
+		m.mu.Lock()
+		res, ok := m.values[key]
+		m.mu.Unlock()
+		if ok {
+			return res, nil
+		}
+
+		val, err := fn()
+		res = memoResult{val, err}
+
+		m.mu.Lock()
+		m.values[key] = res
+		m.mu.Unlock()
+		return res, nil
+	})
+	res = v.(memoResult)
+	return res.val, res.err
+}
+
+// memoizedKey returns the key of a memoized declaration or binding, which is
+// identified by its node because modules with the same filename declare nodes
+// at the same positions. A target with a stop point changes the values of the
+// statements after it, so its values aren't shared with other targets.
+func memoizedKey(ctx context.Context, n ast.Node, name string) string {
+	key := fmt.Sprintf("%p %s", n, name)
+	if sp := getStopPoint(ctx); sp != nil {
+		key = fmt.Sprintf("%s %p", key, sp)
+	}
+	return key
+}
+
+// resolveValue waits for a lazily evaluated value so that it can be shared
+// between goroutines, returning any error encountered while evaluating it.
+func resolveValue(val Value) (Value, error) {
+	var err error
+	switch val.Kind() {
+	case ast.Filesystem:
+		_, err = val.Filesystem()
+	case ast.String, ast.Bool:
+		_, err = val.String()
+	}
+	return val, err
+}
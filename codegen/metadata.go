@@ -0,0 +1,125 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openllb/hlb/pkg/imageutil"
+)
+
+// Metadata is the build metadata written to the metadata file.
+type Metadata struct {
+	// Images are the images pushed by dockerPush, sorted by name.
+	Images []ImageMetadata `json:"images"`
+}
+
+// ImageMetadata describes an image pushed to a registry.
+type ImageMetadata struct {
+	// Name is the reference the image was pushed to.
+	Name string `json:"name"`
+
+	// Digest is the digest of the image's manifest, or of its manifest list
+	// for multi-platform images, in the registry.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the image's config and compressed layers in the
+	// registry, the same as measured by maxImageSize.
+	Size int64 `json:"size"`
+}
+
+// WithMetadataFile sets a host path that the metadata of pushed images is
+// written to as JSON, like the digests to deploy them by. The file is
+// rewritten after every push, so it has every image pushed so far.
+func WithMetadataFile(path string) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.metadata = newMetadataFile(path)
+	}
+}
+
+type metadataFile struct {
+	path   string
+	mu     sync.Mutex
+	images map[string]ImageMetadata
+}
+
+func newMetadataFile(path string) *metadataFile {
+	return &metadataFile{
+		path:   path,
+		images: make(map[string]ImageMetadata),
+	}
+}
+
+// Record adds an image pushed to name to the metadata file. The digest is
+// reported by the exporter when pushed by BuildKit, otherwise it is resolved
+// from the registry.
+func (mf *metadataFile) Record(ctx context.Context, resolver remotes.Resolver, platform specs.Platform, name string, dgst digest.Digest) error {
+	if dgst == "" {
+		_, desc, err := resolver.Resolve(ctx, name)
+		if err != nil {
+			return err
+		}
+		dgst = desc.Digest
+	}
+
+	size, err := imageutil.ImageSize(ctx, resolver, platforms.Only(platform), fmt.Sprintf("%s@%s", name, dgst))
+	if err != nil {
+		return err
+	}
+
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.images[name] = ImageMetadata{
+		Name:   name,
+		Digest: dgst,
+		Size:   size,
+	}
+	return mf.write()
+}
+
+// write replaces the metadata file, so that readers never see a partially
+// written file.
+func (mf *metadataFile) write() error {
+	var md Metadata
+	for _, img := range mf.images {
+		md.Images = append(md.Images, img)
+	}
+	sort.Slice(md.Images, func(i, j int) bool {
+		return md.Images[i].Name < md.Images[j].Name
+	})
+
+	dt, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(mf.path), filepath.Base(mf.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(append(dt, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), mf.path)
+}
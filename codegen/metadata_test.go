@@ -0,0 +1,60 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataFile(t *testing.T) {
+	t.Parallel()
+
+	dt, err := json.Marshal(specs.Manifest{
+		Config: specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Size: 500},
+		Layers: []specs.Descriptor{
+			{MediaType: specs.MediaTypeImageLayerGzip, Size: 1500},
+		},
+	})
+	require.NoError(t, err)
+
+	resolver := &manifestResolver{
+		desc: specs.Descriptor{
+			MediaType: specs.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(dt),
+			Size:      int64(len(dt)),
+		},
+		dt: dt,
+	}
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	mf := newMetadataFile(path)
+	platform := specs.Platform{OS: "linux", Architecture: "amd64"}
+
+	// Pushed by BuildKit, which reports the digest.
+	pushed := digest.FromString("pushed")
+	err = mf.Record(context.Background(), resolver, platform, "docker.io/library/b:latest", pushed)
+	require.NoError(t, err)
+
+	// Pushed by the docker engine, so the digest is resolved.
+	err = mf.Record(context.Background(), resolver, platform, "docker.io/library/a:latest", "")
+	require.NoError(t, err)
+
+	actual, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var md Metadata
+	err = json.Unmarshal(actual, &md)
+	require.NoError(t, err)
+	require.Equal(t, Metadata{
+		Images: []ImageMetadata{
+			{Name: "docker.io/library/a:latest", Digest: digest.FromBytes(dt), Size: 2000},
+			{Name: "docker.io/library/b:latest", Digest: pushed, Size: 2000},
+		},
+	}, md)
+}
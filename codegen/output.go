@@ -0,0 +1,102 @@
+package codegen
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+)
+
+// DefaultOutputDelimiter is written between string targets that are written
+// to the same writer, unless overridden with WithOutputDelimiter.
+const DefaultOutputDelimiter = "\n"
+
+// WithOutputDelimiter sets the delimiter written between string targets that
+// are written to the same writer.
+func WithOutputDelimiter(delim string) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.outputDelim = delim
+	}
+}
+
+// outputSequence writes the values of string targets in the order of their
+// targets, even though their requests are solved in parallel.
+type outputSequence struct {
+	delim   string
+	last    chan struct{}
+	written map[io.Writer]bool
+}
+
+func newOutputSequence(delim string) *outputSequence {
+	last := make(chan struct{})
+	close(last)
+	return &outputSequence{
+		delim:   delim,
+		last:    last,
+		written: make(map[io.Writer]bool),
+	}
+}
+
+// Request returns a request that writes value to w after the values of the
+// requests returned before it have been written.
+func (seq *outputSequence) Request(name, value string, w io.Writer) solver.Request {
+	r := &outputRequest{
+		seq:   seq,
+		name:  name,
+		value: value,
+		w:     w,
+		prev:  seq.last,
+		done:  make(chan struct{}),
+	}
+	seq.last = r.done
+	return r
+}
+
+// outputRequest writes the value of a string target to its writer.
+type outputRequest struct {
+	seq   *outputSequence
+	name  string
+	value string
+	w     io.Writer
+	prev  chan struct{}
+	done  chan struct{}
+
+	// once closes done when the request is first solved, since it may be
+	// solved again.
+	once sync.Once
+}
+
+func (r *outputRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.prev:
+	}
+	defer r.once.Do(func() {
+		close(r.done)
+	})
+
+	w := r.w
+	if w == nil {
+		w = os.Stdout
+	}
+	if r.seq.written[w] {
+		_, err := io.WriteString(w, r.seq.delim)
+		if err != nil {
+			return err
+		}
+	}
+	r.seq.written[w] = true
+
+	_, err := io.WriteString(w, r.value)
+	return err
+}
+
+func (r *outputRequest) Tree(tree treeprint.Tree) error {
+	tree.AddMetaNode("output", r.name)
+	return nil
+}
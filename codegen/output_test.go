@@ -0,0 +1,83 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/lithammer/dedent"
+	"github.com/moby/buildkit/identity"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestGenerateStringTargets(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx = WithSessionID(ctx, identity.NewID())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	string tag() {
+		format "app:%s" version
+	}
+
+	string version() {
+		localRun "sleep 0.1; printf v1"
+	}
+
+	string deployManifest() {
+		format "image: %s" tag
+	}
+
+	fs build() {
+		image "alpine"
+		env "TAG" tag
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	var stdout, other bytes.Buffer
+	reqs, err := New(nil, nil, WithOutputDelimiter("---")).generate(ctx, mod, "", []Target{
+		{Name: "deployManifest", Output: &stdout},
+		{Name: "build", Output: &stdout},
+		{Name: "version", Output: &other},
+		{Name: "tag", Output: &stdout},
+	})
+	require.NoError(t, err)
+	require.Len(t, reqs, 4)
+
+	// Filesystem targets are solved as usual.
+	_, ok := reqs[1].(*outputRequest)
+	require.False(t, ok)
+
+	// String targets are written in the order of their targets, no matter
+	// which is solved first.
+	g, gctx := errgroup.WithContext(ctx)
+	for _, i := range []int{3, 2, 0} {
+		req := reqs[i]
+		g.Go(func() error {
+			return req.Solve(gctx, nil, nil)
+		})
+	}
+	require.NoError(t, g.Wait())
+	require.Equal(t, "image: app:v1---app:v1", stdout.String())
+	require.Equal(t, "v1", other.String())
+
+	// A request solved again writes its value again.
+	require.NoError(t, reqs[0].Solve(ctx, nil, nil))
+	require.Equal(t, "image: app:v1---app:v1---image: app:v1", stdout.String())
+}
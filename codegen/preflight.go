@@ -0,0 +1,228 @@
+package codegen
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// WithoutPreflight skips checking that the working directory and user of a
+// run exist in its filesystem just before the exec, which solves the
+// filesystem before the exec is sent. A missing working directory or user
+// then fails in the container instead.
+func WithoutPreflight() CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.noPreflight = true
+	}
+}
+
+type WorkdirCreate struct{}
+
+func (wc WorkdirCreate) Call(ctx context.Context, cln *client.Client, val Value, opts Option) (Value, error) {
+	retOpts, err := val.Option()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValue(ctx, append(retOpts, &WorkdirCreate{}))
+}
+
+// workdirArg and userArg are the arguments of the dir and user options of a
+// run, which follow them so that preflight errors point at where they were
+// set rather than at the run.
+type (
+	workdirArg struct{ node ast.Node }
+	userArg    struct{ node ast.Node }
+)
+
+// runPreflight is the working directory and user a run execs with, which are
+// checked against its input filesystem before the exec.
+type runPreflight struct {
+	run ast.Node
+
+	// dir is the absolute working directory, and user is the user[:group] of
+	// the run.
+	dir  string
+	user string
+
+	// workdirArg and userArg are the arguments that set the working directory
+	// and user, or nil if they were not set by a module or are not checked.
+	workdirArg ast.Node
+	userArg    ast.Node
+
+	// create creates the working directory when it does not exist.
+	create bool
+}
+
+// newRunPreflight returns the preflight of a run with opts on fs. The options
+// of the run override the working directory and user of the filesystem.
+func newRunPreflight(ctx context.Context, fs Filesystem, opts Option) (*runPreflight, error) {
+	dir, err := fs.State.GetDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &runPreflight{
+		run:        ProgramCounter(ctx),
+		dir:        path.Join("/", dir),
+		user:       fs.Image.Config.User,
+		workdirArg: fs.workdirArg,
+		userArg:    fs.userArg,
+	}
+
+	var mounts []string
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case llbutil.DirOption:
+			if path.IsAbs(o.Dir) {
+				pf.dir = path.Clean(o.Dir)
+			} else {
+				pf.dir = path.Join(pf.dir, o.Dir)
+			}
+			pf.workdirArg = nil
+		case *workdirArg:
+			pf.workdirArg = o.node
+		case llbutil.UserOption:
+			pf.user = o.User
+			pf.userArg = nil
+		case *userArg:
+			pf.userArg = o.node
+		case *llbutil.MountRunOption:
+			mounts = append(mounts, path.Clean(o.Target))
+		case *WorkdirCreate:
+			pf.create = true
+		}
+	}
+
+	// A working directory in a mount is not in the input filesystem, and
+	// BuildKit creates the mountpoint anyway.
+	for _, target := range mounts {
+		if target != "/" && (pf.dir == target || strings.HasPrefix(pf.dir, target+"/")) {
+			pf.workdirArg = nil
+			pf.create = false
+		}
+	}
+	return pf, nil
+}
+
+// needed returns whether the preflight reads any files. A working directory
+// that is created is not checked.
+func (pf *runPreflight) needed() bool {
+	if !pf.create && pf.workdirArg != nil {
+		return true
+	}
+	return pf.userArg != nil && !isNumericUser(pf.user)
+}
+
+// check checks the working directory and user with the files of the input
+// filesystem.
+func (pf *runPreflight) check(stat func(p string) (*fstypes.Stat, error), read func(p string) ([]byte, error)) error {
+	if !pf.create && pf.workdirArg != nil {
+		_, err := stat(pf.dir)
+		switch {
+		case err == nil:
+		case errdefs.IsNotExist(err):
+			return errdefs.WithWorkdirNotExist(pf.workdirArg, pf.run, pf.dir)
+		default:
+			return err
+		}
+	}
+
+	if pf.userArg == nil || isNumericUser(pf.user) {
+		return nil
+	}
+
+	files := make(map[string][]byte)
+	cachedRead := func(p string) ([]byte, error) {
+		dt, ok := files[p]
+		if ok {
+			return dt, nil
+		}
+		dt, err := read(p)
+		if err != nil {
+			return nil, err
+		}
+		files[p] = dt
+		return dt, nil
+	}
+
+	dt, err := cachedRead(PasswdPath)
+	if err != nil && !errdefs.IsNotExist(err) {
+		return err
+	}
+	users := parsePasswd(dt)
+	name := strings.SplitN(pf.user, ":", 2)[0]
+	if _, ok := users[name]; !ok {
+		var names []string
+		for name := range users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return errdefs.WithRunUserNotExist(pf.userArg, pf.run, name, PasswdPath, names)
+	}
+
+	// The group is resolved like the owners of chown, which has already
+	// found the user.
+	_, err = resolveOwner(pf.userArg, pf.user, cachedRead)
+	return err
+}
+
+// isNumericUser returns whether the user of a user[:group] is a uid, which
+// needs no entry in the passwd file.
+func isNumericUser(user string) bool {
+	_, err := strconv.Atoi(strings.SplitN(user, ":", 2)[0])
+	return err == nil
+}
+
+// preflightRun checks the working directory and user of a run with opts on
+// fs when it is solved, just before the exec, and creates the working
+// directory before the exec if the run has workdirCreate. With
+// WithoutPreflight, the files are never read.
+func preflightRun(ctx context.Context, fs Filesystem, opts Option) (Filesystem, error) {
+	pf, err := newRunPreflight(ctx, fs, opts)
+	if err != nil {
+		return fs, err
+	}
+
+	if getPreflight(ctx) && pf.needed() {
+		// The input of the exec is solved once for both the working
+		// directory and the user, and BuildKit reuses it for the exec.
+		def, err := fs.State.Marshal(ctx, llb.Platform(fs.Platform))
+		if err != nil {
+			return fs, err
+		}
+		fs.SolveOpts = append(fs.SolveOpts, solver.WithPreflight(solver.Preflight{
+			Def: def,
+			Check: func(ctx context.Context, ref gateway.Reference) error {
+				return pf.check(func(p string) (*fstypes.Stat, error) {
+					return statRef(ctx, ref, p, true)
+				}, func(p string) ([]byte, error) {
+					return readRef(ctx, ref, p)
+				})
+			},
+		}))
+	}
+
+	if pf.create {
+		mkdirOpts := []llb.MkdirOption{llb.WithParents(true)}
+		if pf.user != "" {
+			mkdirOpts = append(mkdirOpts, llb.WithUser(pf.user))
+		}
+		fs.State = fs.State.File(
+			llb.Mkdir(pf.dir, 0o755, mkdirOpts...),
+			SourceMap(ctx)...,
+		)
+	}
+	return fs, nil
+}
@@ -0,0 +1,226 @@
+package codegen
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+func TestRunPreflight(t *testing.T) {
+	t.Parallel()
+
+	dirs := map[string]bool{"/": true, "/src": true}
+	stat := func(p string) (*fstypes.Stat, error) {
+		if !dirs[p] {
+			return nil, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+		}
+		return &fstypes.Stat{Path: p, Mode: uint32(os.ModeDir | 0755)}, nil
+	}
+	files := map[string]string{
+		PasswdPath: "root:x:0:0:root:/root:/bin/sh\nappuser:x:1000:1000::/home/appuser:/bin/sh\n",
+		GroupPath:  "root:x:0:\nstaff:x:50:appuser\n",
+	}
+	read := func(p string) ([]byte, error) {
+		dt, ok := files[p]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+		return []byte(dt), nil
+	}
+
+	var (
+		run  = &ast.Ident{Text: "run"}
+		dir  = &ast.Ident{Text: "dir"}
+		user = &ast.Ident{Text: "user"}
+	)
+	for _, tc := range []struct {
+		name string
+		pf   runPreflight
+		err  error
+	}{{
+		"existing workdir",
+		runPreflight{run: run, dir: "/src", workdirArg: dir},
+		nil,
+	}, {
+		"missing workdir with workdirCreate",
+		runPreflight{run: run, dir: "/src/app", workdirArg: dir, create: true},
+		nil,
+	}, {
+		"missing workdir",
+		runPreflight{run: run, dir: "/src/app", workdirArg: dir},
+		errdefs.WithWorkdirNotExist(dir, run, "/src/app"),
+	}, {
+		"missing workdir not set by a module",
+		runPreflight{run: run, dir: "/src/app"},
+		nil,
+	}, {
+		"user",
+		runPreflight{run: run, dir: "/", user: "appuser", userArg: user},
+		nil,
+	}, {
+		"user and group",
+		runPreflight{run: run, dir: "/", user: "appuser:staff", userArg: user},
+		nil,
+	}, {
+		"missing user",
+		runPreflight{run: run, dir: "/", user: "nobody", userArg: user},
+		errdefs.WithRunUserNotExist(user, run, "nobody", PasswdPath, []string{"appuser", "root"}),
+	}, {
+		"missing group",
+		runPreflight{run: run, dir: "/", user: "appuser:wheel", userArg: user},
+		errdefs.WithUnknownOwner(user, "group", "wheel", GroupPath),
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.pf.check(stat, read)
+			if tc.err != nil {
+				require.EqualError(t, err, tc.err.Error())
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("numeric uid", func(t *testing.T) {
+		pf := runPreflight{run: run, dir: "/", user: "1000:1000", userArg: user}
+		require.False(t, pf.needed())
+
+		err := pf.check(stat, func(p string) ([]byte, error) {
+			t.Fatalf("unexpected read of %s", p)
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("workdirCreate", func(t *testing.T) {
+		// A working directory that is created is not read.
+		pf := runPreflight{run: run, dir: "/src/app", workdirArg: dir, create: true}
+		require.False(t, pf.needed())
+	})
+}
+
+// preflightRef is a solved reference with files that can be read.
+type preflightRef struct {
+	*fakeRef
+	contents map[string]string
+}
+
+func (r *preflightRef) ReadFile(ctx context.Context, req gateway.ReadRequest) ([]byte, error) {
+	dt, ok := r.contents[req.Filename]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: req.Filename, Err: os.ErrNotExist}
+	}
+	return []byte(dt), nil
+}
+
+func TestPreflightRun(t *testing.T) {
+	t.Parallel()
+
+	// The input of the runs is an image with an app user and a source
+	// directory.
+	ref := &preflightRef{
+		fakeRef: &fakeRef{files: map[string]*fstypes.Stat{
+			"/":          {Mode: uint32(os.ModeDir | 0755)},
+			"/etc":       {Mode: uint32(os.ModeDir | 0755)},
+			"/etc/group": {Mode: 0644},
+			"/src":       {Mode: uint32(os.ModeDir | 0755)},
+		}},
+		contents: map[string]string{
+			PasswdPath: "root:x:0:0:root:/root:/bin/sh\nappuser:x:1000:1000::/home/appuser:/bin/sh\n",
+			GroupPath:  "root:x:0:\n",
+		},
+	}
+
+	// preflights returns the preflights of the default target, checking
+	// them with ref.
+	preflights := func(t *testing.T, ctx context.Context, mod *ast.Module, opts ...CodeGenOption) []error {
+		v, err := New(nil, nil, opts...).EmitTarget(ctx, mod, Target{Name: "default"})
+		require.NoError(t, err)
+		fs, err := v.Filesystem()
+		require.NoError(t, err)
+
+		info := &solver.SolveInfo{}
+		for _, opt := range fs.SolveOpts {
+			require.NoError(t, opt(info))
+		}
+		var errs []error
+		for _, pf := range info.Preflights {
+			require.NotNil(t, pf.Def)
+			errs = append(errs, pf.Check(ctx, ref))
+		}
+		return errs
+	}
+
+	t.Run("missing workdir", func(t *testing.T) {
+		t.Parallel()
+
+		// The working directory is set by another function, so the error
+		// points at where it was set.
+		ctx, mod := parseTestModule(t, `
+		fs base() {
+			scratch
+			dir "/nonexistent"
+		}
+
+		fs default() {
+			base
+			run "true"
+		}
+		`)
+		errs := preflights(t, ctx, mod)
+		require.Len(t, errs, 1)
+		require.EqualError(t, errs[0], errdefs.WithWorkdirNotExist(
+			ast.Search(mod, `"/nonexistent"`),
+			ast.Search(mod, `run "true"`),
+			"/nonexistent",
+		).Error())
+		spans := diagnostic.Spans(errs[0])
+		require.Len(t, spans, 1)
+
+		// Without preflight, the run fails in the container instead.
+		require.Empty(t, preflights(t, ctx, mod, WithoutPreflight()))
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, mod := parseTestModule(t, `
+		fs default() {
+			scratch
+			user "deploy"
+			run "true"
+		}
+		`)
+		errs := preflights(t, ctx, mod)
+		require.Len(t, errs, 1)
+		require.EqualError(t, errs[0], errdefs.WithRunUserNotExist(
+			ast.Search(mod, `"deploy"`),
+			ast.Search(mod, `run "true"`),
+			"deploy", PasswdPath, []string{"appuser", "root"},
+		).Error())
+	})
+
+	t.Run("existing workdir and user", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, mod := parseTestModule(t, `
+		fs default() {
+			scratch
+			user "appuser"
+			run "true" with option {
+				dir "/src"
+			}
+		}
+		`)
+		errs := preflights(t, ctx, mod)
+		require.Equal(t, []error{nil}, errs)
+	})
+}
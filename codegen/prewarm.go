@@ -0,0 +1,301 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+)
+
+// PrewarmGroup is the progress group of the vertices solved by
+// GeneratePrewarm.
+const PrewarmGroup = "prewarm"
+
+// WithPrewarmAllImages makes GeneratePrewarm also pull every image found in
+// the module by ImageRefs, not only the images of its prewarm functions.
+func WithPrewarmAllImages() CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.prewarmAllImages = true
+	}
+}
+
+// Prewarms returns the functions of a module marked with `# hlb:prewarm` in
+// the order they are declared.
+func Prewarms(mod *ast.Module) []Target {
+	var targets []Target
+	for _, decl := range mod.Decls {
+		fd := decl.Func
+		if fd == nil || fd.Sig.Name == nil || !fd.Doc.HasPragma(checker.PrewarmPragma) {
+			continue
+		}
+		targets = append(targets, Target{Name: fd.Sig.Name.Text})
+	}
+	return targets
+}
+
+// ImageRef is a call to image found in a module.
+type ImageRef struct {
+	// Node is the ref argument of the call.
+	Node ast.Node
+
+	// Ref is the normalized ref of the image, or empty if the ref is only
+	// known at runtime.
+	Ref string
+}
+
+// ImageRefs returns the calls to image in a module.
+func ImageRefs(mod *ast.Module) []ImageRef {
+	var refs []ImageRef
+	add := func(name *ast.IdentExpr, args []*ast.Expr) {
+		if name == nil || name.Reference != nil || name.Ident.Text != "image" || len(args) != 1 {
+			return
+		}
+
+		ir := ImageRef{Node: args[0]}
+		if args[0].BasicLit != nil {
+			source, ok := args[0].BasicLit.StringValue()
+			if ok {
+				named, err := reference.ParseNormalizedNamed(source)
+				if err == nil {
+					ir.Ref = reference.TagNameOnly(named).String()
+				}
+			}
+		}
+		refs = append(refs, ir)
+	}
+
+	ast.Match(mod, ast.MatchOpts{},
+		func(call *ast.CallStmt) {
+			add(call.Name, call.Args)
+		},
+		func(call *ast.CallExpr) {
+			add(call.Name, call.Arguments())
+		},
+	)
+	return refs
+}
+
+// exportBuiltins are the builtins that export a filesystem, which are skipped
+// when priming the cache.
+var exportBuiltins = map[string]struct{}{
+	string(ExportDockerPush):            {},
+	string(ExportDockerLoad):            {},
+	string(ExportDownload):              {},
+	string(ExportDownloadTarball):       {},
+	string(ExportDownloadOCITarball):    {},
+	string(ExportDownloadDockerTarball): {},
+}
+
+// GeneratePrewarm returns a request that primes the cache of BuildKit ahead
+// of a build, like pulling base images and populating cache mounts before a
+// nightly build. It solves the functions of a module marked with
+// `# hlb:prewarm` without any of their exports, and pulls the images found
+// in the module if WithPrewarmAllImages is set. When solved, a summary of the
+// sources that were pulled and that were already cached is written to the
+// diagnostic writer.
+func (cg *CodeGen) GeneratePrewarm(ctx context.Context, mod *ast.Module) (solver.Request, error) {
+	targets := Prewarms(mod)
+	ctx, err := cg.generateContext(ctx, mod, targets)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withPrewarm(ctx)
+
+	var requests []solver.Request
+	for i, target := range targets {
+		val, err := cg.emitTarget(ctx, mod, i, target)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := val.Request()
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, solver.Named("prewarm "+target.Name, request))
+	}
+
+	if cg.prewarmAllImages {
+		seen := make(map[string]struct{})
+		for _, ir := range ImageRefs(mod) {
+			if ir.Ref == "" {
+				continue
+			}
+			if _, ok := seen[ir.Ref]; ok {
+				continue
+			}
+			seen[ir.Ref] = struct{}{}
+
+			val, err := Image{}.Call(WithArg(ctx, 0, ir.Node), cg.cln, ZeroValue(ctx), nil, ir.Ref)
+			if err != nil {
+				return nil, err
+			}
+
+			request, err := val.Request()
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, solver.Named("prewarm "+ir.Ref, request))
+		}
+	}
+
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("nothing to prewarm in %s, mark fs functions with `# hlb:%s`", mod.Pos.Filename, checker.PrewarmPragma)
+	}
+	return &prewarmRequest{
+		w:   cg.diagnosticWriter,
+		req: redactedRequest(ctx, solver.Grouped(PrewarmGroup, PrewarmGroup, solver.Parallel(requests...))),
+	}, nil
+}
+
+// prewarmRequest solves the requests of GeneratePrewarm and reports the
+// sources they pulled.
+type prewarmRequest struct {
+	w   io.Writer
+	req solver.Request
+}
+
+func (r *prewarmRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	stats := newPrewarmStats()
+	opts = append(opts[:len(opts):len(opts)], solver.WithStatusObserver(stats.observe))
+	err := r.req.Solve(ctx, cln, mw, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the progress of the solve to be written before the summary.
+	if p := Progress(ctx); p != nil {
+		err := p.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if r.w != nil {
+		stats.report(r.w)
+	}
+	return nil
+}
+
+func (r *prewarmRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
+
+// sourceSchemes are the prefixes of the names BuildKit gives the vertices of
+// sources.
+var sourceSchemes = []string{
+	"docker-image://",
+	"oci-layout://",
+	"git://",
+	"https://",
+	"http://",
+	"local://",
+}
+
+func isSourceVertex(name string) bool {
+	for _, scheme := range sourceSchemes {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// prewarmStats records the sources of a solve, whether they were cached and
+// how many bytes were pulled for them, from the statuses BuildKit reports.
+type prewarmStats struct {
+	mu      sync.Mutex
+	names   map[digest.Digest]string
+	sources map[string]*prewarmSource
+}
+
+type prewarmSource struct {
+	cached bool
+
+	// pulled is the number of bytes pulled by each status of the source,
+	// like the layers of an image.
+	pulled map[string]int64
+}
+
+func newPrewarmStats() *prewarmStats {
+	return &prewarmStats{
+		names:   make(map[digest.Digest]string),
+		sources: make(map[string]*prewarmSource),
+	}
+}
+
+func (s *prewarmStats) observe(status *client.SolveStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range status.Vertexes {
+		if !isSourceVertex(v.Name) {
+			continue
+		}
+		s.names[v.Digest] = v.Name
+		src, ok := s.sources[v.Name]
+		if !ok {
+			src = &prewarmSource{pulled: make(map[string]int64)}
+			s.sources[v.Name] = src
+		}
+		if v.Cached {
+			src.cached = true
+		}
+	}
+	for _, vs := range status.Statuses {
+		name, ok := s.names[vs.Vertex]
+		if !ok {
+			continue
+		}
+		src := s.sources[name]
+		n := vs.Current
+		if vs.Completed != nil && vs.Total > n {
+			n = vs.Total
+		}
+		if n > src.pulled[vs.ID] {
+			src.pulled[vs.ID] = n
+		}
+	}
+}
+
+// report writes the sources that were pulled and that were already cached.
+// A source is cached if BuildKit did not pull anything for it.
+func (s *prewarmStats) report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.sources))
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		total          int64
+		pulled, cached int
+	)
+	for _, name := range names {
+		src := s.sources[name]
+		var n int64
+		for _, bytes := range src.pulled {
+			n += bytes
+		}
+		if n == 0 && src.cached {
+			cached++
+			fmt.Fprintf(w, "--- CACHED: %s\n", name)
+			continue
+		}
+		pulled++
+		total += n
+		fmt.Fprintf(w, "--- PULLED: %s (%d bytes)\n", name, n)
+	}
+	fmt.Fprintf(w, "prewarm: pulled %d bytes for %d sources, %d already cached\n", total, pulled, cached)
+}
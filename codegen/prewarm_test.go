@@ -0,0 +1,145 @@
+package codegen
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+const prewarmModule = `
+# hlb:prewarm
+fs toolchain() {
+	image "golang:1.17"
+	run "go mod download" with option {
+		mount scratch "/go/pkg/mod" with cache("gomod", "shared")
+	}
+	dockerPush "example.com/toolchain"
+	download "toolchain"
+}
+
+fs default() {
+	image "alpine"
+	dockerPush "example.com/app"
+}
+
+fs tools() {
+	image "busybox"
+}
+`
+
+func TestGeneratePrewarm(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		opts     []CodeGenOption
+		resolved []string
+	}
+
+	for _, tc := range []testCase{{
+		"prewarm functions",
+		nil,
+		[]string{
+			"docker.io/library/golang:1.17",
+		},
+	}, {
+		"all images",
+		[]CodeGenOption{WithPrewarmAllImages()},
+		[]string{
+			"docker.io/library/alpine:latest",
+			"docker.io/library/busybox:latest",
+			"docker.io/library/golang:1.17",
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, mod := parseTestModule(t, prewarmModule)
+			resolver := &tagResolver{
+				tags: map[string]digest.Digest{
+					"docker.io/library/golang:1.17":    digest.FromString("golang"),
+					"docker.io/library/alpine:latest":  digest.FromString("alpine"),
+					"docker.io/library/busybox:latest": digest.FromString("busybox"),
+				},
+				calls: make(map[string]int),
+			}
+			ctx = WithImageResolver(ctx, resolver)
+
+			req, err := New(nil, nil, tc.opts...).GeneratePrewarm(ctx, mod)
+			require.NoError(t, err)
+
+			// Only the sources of prewarm functions, and the images found in
+			// the module if asked for, are resolved.
+			var resolved []string
+			for ref := range resolver.calls {
+				resolved = append(resolved, ref)
+			}
+			sort.Strings(resolved)
+			require.Equal(t, tc.resolved, resolved)
+
+			// Nothing is exported, neither while generating, when exports
+			// would be solved with the nil client, nor by the request.
+			tree := treeprint.New()
+			err = req.Tree(tree)
+			require.NoError(t, err)
+			require.Contains(t, tree.String(), "go mod download")
+			require.NotContains(t, tree.String(), "pushImage")
+		})
+	}
+}
+
+func TestGeneratePrewarmNothing(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	fs default() {
+		image "alpine"
+	}
+	`)
+	_, err := New(nil, nil).GeneratePrewarm(ctx, mod)
+	require.EqualError(t, err, "nothing to prewarm in "+mod.Pos.Filename+", mark fs functions with `# hlb:prewarm`")
+}
+
+func TestPrewarmStats(t *testing.T) {
+	t.Parallel()
+
+	var (
+		now     = time.Now()
+		golang  = digest.FromString("golang")
+		alpine  = digest.FromString("alpine")
+		exec    = digest.FromString("exec")
+		stats   = newPrewarmStats()
+		summary bytes.Buffer
+	)
+	stats.observe(&client.SolveStatus{
+		Vertexes: []*client.Vertex{
+			{Digest: golang, Name: "docker-image://docker.io/library/golang:1.17"},
+			{Digest: alpine, Name: "docker-image://docker.io/library/alpine:latest", Cached: true},
+			{Digest: exec, Name: "/bin/sh -c go mod download"},
+		},
+		Statuses: []*client.VertexStatus{
+			{ID: "sha256:a", Vertex: golang, Current: 10, Total: 100},
+			{ID: "sha256:b", Vertex: golang, Current: 50, Total: 50, Completed: &now},
+			{ID: "sha256:c", Vertex: exec, Current: 1000},
+		},
+	})
+	stats.observe(&client.SolveStatus{
+		Statuses: []*client.VertexStatus{
+			{ID: "sha256:a", Vertex: golang, Current: 100, Total: 100, Completed: &now},
+		},
+	})
+
+	stats.report(&summary)
+	require.Equal(t, ""+
+		"--- CACHED: docker-image://docker.io/library/alpine:latest\n"+
+		"--- PULLED: docker-image://docker.io/library/golang:1.17 (150 bytes)\n"+
+		"prewarm: pulled 150 bytes for 1 sources, 1 already cached\n",
+		summary.String())
+}
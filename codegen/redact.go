@@ -0,0 +1,112 @@
+package codegen
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/pkg/redact"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+)
+
+// DefaultSensitiveEnv are the patterns of the names of environment variables
+// whose values are redacted when read with localEnv.
+var DefaultSensitiveEnv = []string{"TOKEN", "PASSWORD", "KEY", "SECRET"}
+
+// maxRedactedSecretSize is the size of the largest secret file whose contents
+// are redacted. Larger files, like archives of credentials, are not printed
+// by builds as a whole.
+const maxRedactedSecretSize = 64 * 1024
+
+// WithRedaction sets the set of sensitive values that are redacted from the
+// progress, logs and errors of the build, so that the invoker can redact its
+// own output with it too. Otherwise each Generate has its own set.
+func WithRedaction(set *redact.Set) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.redactions = set
+	}
+}
+
+// WithSensitiveEnv sets the patterns of the names of environment variables
+// whose values are redacted when read with localEnv, instead of
+// DefaultSensitiveEnv. Patterns match any part of a name, ignoring case.
+func WithSensitiveEnv(patterns []string) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.sensitiveEnv = patterns
+	}
+}
+
+// isSensitiveEnv returns true if the value of an environment variable is
+// redacted.
+func isSensitiveEnv(ctx context.Context, key string) bool {
+	key = strings.ToUpper(key)
+	for _, pattern := range getSensitiveEnv(ctx) {
+		if strings.Contains(key, strings.ToUpper(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecretFile registers the contents of a local file attached as a
+// secret, with and without surrounding whitespace, like the newline at the
+// end of a token file.
+func redactSecretFile(ctx context.Context, localPath string) {
+	set := Redactions(ctx)
+	if set == nil {
+		return
+	}
+
+	fi, err := os.Stat(localPath)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > maxRedactedSecretSize {
+		return
+	}
+	dt, err := os.ReadFile(localPath)
+	if err != nil {
+		return
+	}
+
+	name := filepath.Base(localPath)
+	set.Add(name, string(dt))
+	set.Add(name, strings.TrimSpace(string(dt)))
+}
+
+// RedactString returns str with the sensitive values of the build redacted,
+// like to show the arguments of a function being debugged.
+func RedactString(ctx context.Context, str string) string {
+	return Redactions(ctx).Redact(str)
+}
+
+type Sensitive struct{}
+
+func (s Sensitive) Call(ctx context.Context, cln *client.Client, val Value, opts Option, value string) (Value, error) {
+	Redactions(ctx).Add("sensitive", value)
+	return NewValue(ctx, value)
+}
+
+// redactedRequest returns a request that is solved with the sensitive values
+// of ctx redacted from its solves, which is how the requests of a Generate are
+// redacted.
+func redactedRequest(ctx context.Context, req solver.Request) solver.Request {
+	set := solver.RedactionSet(ctx)
+	if set == nil {
+		return req
+	}
+	return &redactRequest{set: set, req: req}
+}
+
+type redactRequest struct {
+	set *redact.Set
+	req solver.Request
+}
+
+func (r *redactRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	return r.req.Solve(solver.WithRedactionSet(ctx, r.set), cln, mw, opts...)
+}
+
+func (r *redactRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
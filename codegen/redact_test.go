@@ -0,0 +1,118 @@
+package codegen
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/pkg/redact"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+)
+
+const redactModule = `
+fs default() {
+	image "alpine"
+	run "env" with option {
+		env "GITHUB_TOKEN" localEnv("GITHUB_TOKEN")
+		env "HOME" localEnv("HOME")
+		env "DSN" sensitive("postgres://admin:hunter2@db")
+		secretFile "token.txt" "/run/secrets/token"
+	}
+}
+`
+
+func TestRedaction(t *testing.T) {
+	t.Parallel()
+
+	const (
+		token = "ghp_0123456789abcdef"
+		dsn   = "postgres://admin:hunter2@db"
+		file  = "file-s3cr3t-value"
+	)
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "token.txt"), []byte(file+"\n"), 0600)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name      string
+		opts      []CodeGenOption
+		redacted  []string
+		unchanged []string
+	}{{
+		"default sensitive env",
+		nil,
+		[]string{token, dsn, file, file + "\n"},
+		[]string{"/home/user"},
+	}, {
+		"custom sensitive env",
+		[]CodeGenOption{WithSensitiveEnv([]string{"home"})},
+		[]string{"/home/user", dsn, file},
+		[]string{token},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, mod := parseTestModule(t, redactModule)
+			ctx = local.WithEnviron(ctx, []string{"GITHUB_TOKEN=" + token, "HOME=/home/user"})
+
+			set := redact.NewSet()
+			opts := append(tc.opts, WithRedaction(set), WithSecretRoot(dir), WithoutPreflight())
+			v, err := New(nil, nil, opts...).EmitTarget(ctx, mod, Target{Name: "default"})
+			require.NoError(t, err)
+			fs, err := v.Filesystem()
+			require.NoError(t, err)
+
+			// The set is passed to the solves of the target by the context
+			// they are solved with, not by the solve options of its values.
+			require.Empty(t, fs.SolveOpts)
+
+			for _, value := range tc.redacted {
+				for _, encoded := range []string{
+					value,
+					base64.StdEncoding.EncodeToString([]byte(value)),
+					url.QueryEscape(value),
+				} {
+					require.NotContains(t, set.Redact("value="+encoded), encoded)
+				}
+			}
+			for _, value := range tc.unchanged {
+				require.Equal(t, value, set.Redact(value))
+			}
+			require.Equal(t, "token [redacted:sensitive]", set.Redact("token "+dsn))
+		})
+	}
+}
+
+// redactionRequest records the set its solves are redacted with.
+type redactionRequest struct {
+	fakeRequest
+	set *redact.Set
+}
+
+func (r *redactionRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	r.set = solver.RedactionSet(ctx)
+	return nil
+}
+
+func TestRedactedRequest(t *testing.T) {
+	t.Parallel()
+
+	req := &redactionRequest{}
+	require.Equal(t, req, redactedRequest(context.Background(), req))
+
+	// Requests are solved with the context of their caller, so the set of
+	// the context they were generated with is passed along.
+	set := redact.NewSet()
+	ctx := solver.WithRedactionSet(context.Background(), set)
+	err := redactedRequest(ctx, req).Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, set, req.set)
+}
@@ -0,0 +1,110 @@
+package codegen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/openllb/hlb/pkg/imageutil"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+)
+
+// ErrNotReproducible is returned by VerifyReproducible when the two builds of
+// a filesystem produce different images.
+var ErrNotReproducible = errors.New("build is not reproducible")
+
+// ReproducibilityReport is the result of building a filesystem twice.
+type ReproducibilityReport struct {
+	// Images are the images of each build, with the timestamps of their files
+	// rewritten.
+	Images [2]*imageutil.ArchiveImage
+
+	// Divergence is where the images first differ, or nil if they are the
+	// same.
+	Divergence *imageutil.Divergence
+}
+
+// VerifyReproducible builds a filesystem twice without the cache and checks
+// that both builds produce the same image. The timestamps of the files in the
+// images are rewritten to the Unix epoch before they are compared, since files
+// written by runs have the time they were written, and the image config
+// already has no creation time.
+//
+// If the images differ, the report has the first layer that differs and the
+// error wraps ErrNotReproducible.
+func VerifyReproducible(ctx context.Context, cln *client.Client, fs Filesystem) (*ReproducibilityReport, error) {
+	// Ignoring the cache makes the second build run every op again, rather
+	// than return the result of the first.
+	def, err := fs.State.Marshal(ctx, llb.Platform(fs.Platform), llb.IgnoreCache)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := json.Marshal(fs.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReproducibilityReport{}
+	for i := range report.Images {
+		report.Images[i], err = buildArchiveImage(ctx, cln, fs, def, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.Divergence = imageutil.Diverge(report.Images[0], report.Images[1])
+	if report.Divergence != nil {
+		return report, fmt.Errorf("%w: %s", ErrNotReproducible, report.Divergence)
+	}
+	return report, nil
+}
+
+// buildArchiveImage builds a definition and reads the image exported as an
+// OCI archive, without writing the archive anywhere.
+func buildArchiveImage(ctx context.Context, cln *client.Client, fs Filesystem, def *llb.Definition, config []byte) (*imageutil.ArchiveImage, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	var (
+		img     *imageutil.ArchiveImage
+		readErr error
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		img, readErr = imageutil.ReadArchive(pr, time.Unix(0, 0).UTC())
+		// Drain the rest of the archive so that the export is not blocked
+		// when it fails to be read.
+		_, _ = io.Copy(ioutil.Discard, pr)
+	}()
+
+	solveOpts := append(fs.SolveOpts[:len(fs.SolveOpts):len(fs.SolveOpts)], solver.WithDownloadOCITarball())
+	sessionOpts := append(fs.SessionOpts[:len(fs.SessionOpts):len(fs.SessionOpts)], llbutil.WithSyncTarget(llbutil.OutputFromWriter(pw)))
+
+	err := gatewayBuild(ctx, cln, solveOpts, sessionOpts, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		res, err := c.Solve(ctx, gateway.SolveRequest{
+			Definition: def.ToPB(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.AddMeta(exptypes.ExporterImageConfigKey, config)
+		return res, nil
+	})
+	pw.CloseWithError(err)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	return img, readErr
+}
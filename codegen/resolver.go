@@ -2,6 +2,7 @@ package codegen
 
 import (
 	"context"
+	"fmt"
 	"sync"
 
 	"github.com/docker/buildx/util/progress"
@@ -13,6 +14,7 @@ import (
 	"github.com/openllb/hlb/pkg/llbutil"
 	"github.com/openllb/hlb/solver"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -27,23 +29,52 @@ type Resolver interface {
 	Resolve(ctx context.Context, id *ast.ImportDecl, fs Filesystem) (ast.Directory, error)
 }
 
+// ProgressResolver is an optional interface for resolvers that report progress
+// while resolving an import. Each status reported is forwarded into the
+// progress stream under a vertex named after the import.
+type ProgressResolver interface {
+	Resolver
+
+	// ResolveProgress is like Resolve but reports its progress.
+	ResolveProgress(ctx context.Context, id *ast.ImportDecl, fs Filesystem, report func(status string)) (ast.Directory, error)
+}
+
 func NewCachedImageResolver(cln *client.Client) llb.ImageMetaResolver {
+	return CacheImageResolver(&clientImageResolver{cln: cln})
+}
+
+// CacheImageResolver returns an image resolver that resolves each image
+// config at most once, even when the same ref is resolved concurrently.
+func CacheImageResolver(resolver llb.ImageMetaResolver) llb.ImageMetaResolver {
 	return &cachedImageResolver{
-		cln:   cln,
-		cache: make(map[cacheKey]*imageConfig),
+		resolver: resolver,
+		cache:    make(map[cacheKey]*imageConfig),
 	}
 }
 
 type cacheKey struct {
-	ref  string
-	os   string
-	arch string
+	ref         string
+	os          string
+	arch        string
+	variant     string
+	resolveMode string
+}
+
+func newCacheKey(ref string, opt llb.ResolveImageConfigOpt) cacheKey {
+	key := cacheKey{ref: ref, resolveMode: opt.ResolveMode}
+	if opt.Platform != nil {
+		key.os = opt.Platform.OS
+		key.arch = opt.Platform.Architecture
+		key.variant = opt.Platform.Variant
+	}
+	return key
 }
 
 type cachedImageResolver struct {
-	cln   *client.Client
-	cache map[cacheKey]*imageConfig
-	mu    sync.RWMutex
+	resolver llb.ImageMetaResolver
+	cache    map[cacheKey]*imageConfig
+	mu       sync.RWMutex
+	g        singleflight.Group
 }
 
 type imageConfig struct {
@@ -51,12 +82,8 @@ type imageConfig struct {
 	config []byte
 }
 
-func (r *cachedImageResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (dgst digest.Digest, config []byte, err error) {
-	key := cacheKey{ref: ref}
-	if opt.Platform != nil {
-		key.os = opt.Platform.OS
-		key.arch = opt.Platform.Architecture
-	}
+func (r *cachedImageResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (digest.Digest, []byte, error) {
+	key := newCacheKey(ref, opt)
 	r.mu.RLock()
 	cfg, ok := r.cache[key]
 	r.mu.RUnlock()
@@ -64,6 +91,37 @@ func (r *cachedImageResolver) ResolveImageConfig(ctx context.Context, ref string
 		return cfg.dgst, cfg.config, nil
 	}
 
+	v, err, _ := r.g.Do(fmt.Sprintf("%+v", key), func() (interface{}, error) {
+		r.mu.RLock()
+		cfg, ok := r.cache[key]
+		r.mu.RUnlock()
+		if ok {
+			return cfg, nil
+		}
+
+		dgst, config, err := r.resolver.ResolveImageConfig(ctx, ref, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg = &imageConfig{dgst, config}
+		r.mu.Lock()
+		r.cache[key] = cfg
+		r.mu.Unlock()
+		return cfg, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	cfg = v.(*imageConfig)
+	return cfg.dgst, cfg.config, nil
+}
+
+type clientImageResolver struct {
+	cln *client.Client
+}
+
+func (r *clientImageResolver) ResolveImageConfig(ctx context.Context, ref string, opt llb.ResolveImageConfigOpt) (dgst digest.Digest, config []byte, err error) {
 	s, err := llbutil.NewSession(ctx)
 	if err != nil {
 		return
@@ -90,12 +148,5 @@ func (r *cachedImageResolver) ResolveImageConfig(ctx context.Context, ref string
 	})
 
 	err = g.Wait()
-	if err != nil {
-		return
-	}
-
-	r.mu.Lock()
-	r.cache[key] = &imageConfig{dgst, config}
-	r.mu.Unlock()
 	return
 }
@@ -0,0 +1,60 @@
+package codegen
+
+import (
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
+)
+
+// Result is the request of the targets of a Generate, with what a driver needs
+// to know to handle the output of each target.
+type Result struct {
+	solver.Request
+
+	// Targets describe the targets of the request in the order they were
+	// given.
+	Targets []GeneratedTarget
+}
+
+// GeneratedTarget describes a target of a Generate.
+type GeneratedTarget struct {
+	Name string
+
+	// Kind is the kind of the target's value. Filesystem and pipeline targets
+	// are solved, and the values of string targets are written to their
+	// output.
+	Kind ast.Kind
+
+	// Effects are the side effects declared by the binds clause of the
+	// target's function, which are only bound by callers of the function.
+	Effects []*ast.Field
+}
+
+// Target returns the description of a target by name.
+func (r *Result) Target(name string) (GeneratedTarget, bool) {
+	for _, target := range r.Targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return GeneratedTarget{}, false
+}
+
+// generatedTargets describes the targets of a module.
+func generatedTargets(mod *ast.Module, targets []Target) []GeneratedTarget {
+	var generated []GeneratedTarget
+	for _, target := range targets {
+		gt := GeneratedTarget{Name: target.Name}
+		obj, ok := mod.Scope.Objects[target.Name]
+		if ok {
+			gt.Kind = obj.Kind
+			if fd, ok := obj.Node.(*ast.FuncDecl); ok {
+				gt.Kind = fd.Kind()
+				if fd.Sig.Effects != nil && fd.Sig.Effects.Effects != nil {
+					gt.Effects = fd.Sig.Effects.Effects.Fields()
+				}
+			}
+		}
+		generated = append(generated, gt)
+	}
+	return generated
+}
@@ -0,0 +1,98 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/llbutil"
+)
+
+type runDefaultsKey struct{}
+
+// runDefaults returns the run defaults of the module that call is in, or nil
+// if call is not a run or the module doesn't declare any. Runs evaluated for
+// the run defaults themselves have no defaults, so that they don't depend on
+// themselves.
+func runDefaults(ctx context.Context, scope *ast.Scope, call *ast.CallStmt) *ast.FuncDecl {
+	if ctx.Value(runDefaultsKey{}) != nil || call.Name == nil || call.Name.Reference != nil {
+		return nil
+	}
+
+	obj := scope.Lookup(call.Name.Ident.Text)
+	if obj == nil {
+		return nil
+	}
+	bd, ok := obj.Node.(*ast.BuiltinDecl)
+	if !ok || bd.Name != "run" {
+		return nil
+	}
+
+	// Only the module's own declaration applies, run defaults are not
+	// inherited from imports or by importers.
+	mscope := scope.ByLevel(ast.ModuleScope)
+	if mscope == nil {
+		return nil
+	}
+	obj, ok = mscope.Objects[checker.RunDefaults]
+	if !ok {
+		return nil
+	}
+	fd, ok := obj.Node.(*ast.FuncDecl)
+	if !ok || fd.Sig.Type == nil || fd.Sig.Type.Kind != ast.Kind("option::run") {
+		return nil
+	}
+	return fd
+}
+
+// emitRunDefaults returns the options of the run defaults, which are
+// evaluated once per Generate and shared by every run in the module.
+func (cg *CodeGen) emitRunDefaults(ctx context.Context, fd *ast.FuncDecl) (Option, error) {
+	ctx = context.WithValue(ctx, runDefaultsKey{}, fd)
+	emit := func() (Value, error) {
+		ret := NewRegister(ctx)
+		err := cg.EmitFuncDecl(ctx, fd, nil, nil, ret)
+		if err != nil {
+			return nil, err
+		}
+		return ret.Value(), nil
+	}
+
+	var (
+		val Value
+		err error
+	)
+	if m := getMemo(ctx); m != nil && cg.dbgr == nil {
+		// Keyed by the declaration since modules generated together may share
+		// filenames.
+		val, err = m.Do(fmt.Sprintf("%s %p", checker.RunDefaults, fd), emit)
+	} else {
+		val, err = emit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return val.Option()
+}
+
+// mergeRunDefaults returns the run defaults followed by the options of a run,
+// so the options of the run take precedence. Default mounts are left out
+// when the run mounts the same mountpoint itself.
+func mergeRunDefaults(defaults, opts Option) Option {
+	mounted := make(map[string]bool)
+	for _, opt := range opts {
+		if mount, ok := opt.(*llbutil.MountRunOption); ok {
+			mounted[mount.Target] = true
+		}
+	}
+
+	var merged Option
+	for _, opt := range defaults {
+		if mount, ok := opt.(*llbutil.MountRunOption); ok && mounted[mount.Target] {
+			continue
+		}
+		merged = append(merged, opt)
+	}
+	return append(merged, opts...)
+}
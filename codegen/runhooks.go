@@ -0,0 +1,70 @@
+package codegen
+
+import (
+	"path"
+	"strings"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openllb/hlb/pkg/llbutil"
+)
+
+// RunHooks are commands that are run before and after the command of every
+// run, like to record timings or clean caches. Hooks run in the container of
+// the run, with its environment, working directory, user and mounts, so they
+// only change the filesystem of the run if they write to it. Their output is
+// written to stderr, so that it is never captured as the output of a run.
+//
+// Hooks are part of the exec of every run, so a run that is cached does not
+// run its hooks again, and changing the hooks changes the cache key of every
+// run.
+type RunHooks struct {
+	// Pre are commands that are run in order before the command of a run.
+	// A command that fails fails the run without running its command.
+	Pre [][]string
+
+	// Post are commands that are run in order after the command of a run,
+	// even if it failed. A command that fails fails the run, which otherwise
+	// fails with the exit code of its command.
+	Post [][]string
+}
+
+// WithRunHooks sets commands that are run before and after the command of
+// every run. Hooks are run with the shell of StdinShimImage, so that images
+// without a shell can be run with hooks.
+func WithRunHooks(hooks RunHooks) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.runHooks = &hooks
+	}
+}
+
+// Wrap wraps args with a shell that runs the hooks around them, and returns
+// the options that mount the shell. Args that already run in the shell of
+// StdinShimImage, like args wrapped to redirect stdin, reuse its mount.
+func (rh *RunHooks) Wrap(args []string, platform specs.Platform) ([]string, []llb.RunOption) {
+	if len(rh.Pre) == 0 && len(rh.Post) == 0 {
+		return args, nil
+	}
+
+	var script []string
+	for _, hook := range rh.Pre {
+		script = append(script, shellquote.Join(hook...)+" >&2 || exit")
+	}
+	script = append(script, `"$@"`, "status=$?")
+	for _, hook := range rh.Post {
+		script = append(script, shellquote.Join(hook...)+" >&2 || exit")
+	}
+	script = append(script, "exit $status")
+
+	var runOpts []llb.RunOption
+	shell := path.Join(StdinShimMountpoint, "bin/sh")
+	if len(args) == 0 || args[0] != shell {
+		runOpts = append(runOpts, &llbutil.MountRunOption{
+			Source: llb.Image(StdinShimImage, llb.Platform(platform)),
+			Target: StdinShimMountpoint,
+			Opts:   []interface{}{llbutil.WithReadonlyMount()},
+		})
+	}
+	return append([]string{shell, "-c", strings.Join(script, "; "), "hooks"}, args...), runOpts
+}
@@ -0,0 +1,88 @@
+package codegen
+
+import (
+	"context"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/stretchr/testify/require"
+)
+
+const runHooksModule = `
+fs default() {
+	image "alpine"
+	run "apk add curl"
+	run "cat" with stdin("hello")
+	run "ls" with option {
+		mount scratch "/out" as output
+	}
+	copy output "/" "/out"
+}
+`
+
+// execs returns the ops of the definition of the default target, and its execs
+// in the order they are run.
+func execs(ctx context.Context, t *testing.T, opts ...CodeGenOption) (map[string]struct{}, []*pb.ExecOp) {
+	ctx, mod := parseTestModule(t, runHooksModule)
+	v, err := New(nil, nil, opts...).EmitTarget(ctx, mod, Target{Name: "default"})
+	require.NoError(t, err)
+	fs, err := v.Filesystem()
+	require.NoError(t, err)
+
+	def, err := fs.State.Marshal(ctx, llb.LinuxAmd64)
+	require.NoError(t, err)
+
+	ops := make(map[string]struct{})
+	var execs []*pb.ExecOp
+	for _, dt := range def.Def {
+		var op pb.Op
+		require.NoError(t, op.Unmarshal(dt))
+		if exec := op.GetExec(); exec != nil {
+			execs = append(execs, exec)
+		}
+		ops[string(dt)] = struct{}{}
+	}
+	return ops, execs
+}
+
+func TestRunHooks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	hooks := RunHooks{
+		Pre:  [][]string{{"date", "+%s"}},
+		Post: [][]string{{"rm", "-rf", "/var/cache/apk"}, {"date", "+%s"}},
+	}
+	ops, hooked := execs(ctx, t, WithRunHooks(hooks))
+	_, plain := execs(ctx, t)
+	require.Len(t, hooked, 3)
+	require.Len(t, plain, 3)
+
+	script := `date +%s >&2 || exit; "$@"; status=$?; rm -rf /var/cache/apk >&2 || exit; date +%s >&2 || exit; exit $status`
+	for i, exec := range hooked {
+		// Every run is wrapped with the hooks, and runs its command as
+		// it would without them.
+		require.Equal(t, []string{"/run/hlb/shim/bin/sh", "-c", script, "hooks"}, exec.Meta.Args[:4])
+		require.Equal(t, plain[i].Meta.Args, exec.Meta.Args[4:])
+
+		// The shell is mounted unless the run already runs in it, like a
+		// run wrapped to redirect stdin.
+		mounts := len(plain[i].Mounts) + 1
+		if plain[i].Meta.Args[0] == "/run/hlb/shim/bin/sh" {
+			mounts--
+		}
+		require.Len(t, exec.Mounts, mounts)
+	}
+
+	// The definition is the same every time, so runs with hooks are cached
+	// like any other run.
+	again, _ := execs(ctx, t, WithRunHooks(hooks))
+	require.Equal(t, ops, again)
+
+	// Without any commands, runs are not wrapped.
+	_, empty := execs(ctx, t, WithRunHooks(RunHooks{}))
+	for i, exec := range empty {
+		require.Equal(t, plain[i].Meta.Args, exec.Meta.Args)
+	}
+}
@@ -0,0 +1,141 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// WithImportSandbox sandboxes imported modules, so that modules from
+// untrusted sources cannot read the host outside of a directory or run
+// commands on it. Imported modules may only read local files and secrets,
+// and forward ssh agents and sockets, under root. They cannot use localRun,
+// forward the ssh agent of the host or forward network addresses. An empty
+// root denies imported modules every local file. The root module is not
+// sandboxed.
+func WithImportSandbox(root string) CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.sandbox = newImportSandbox(root)
+		cg.addHostPolicy(cg.sandbox.policy)
+	}
+}
+
+// importSandbox records the modules that were imported, which are the modules
+// its policy is consulted for.
+type importSandbox struct {
+	root string
+
+	mu   sync.Mutex
+	mods map[*ast.Module]struct{}
+}
+
+func newImportSandbox(root string) *importSandbox {
+	if root != "" {
+		root = evalPath(root)
+	}
+	return &importSandbox{
+		root: root,
+		mods: make(map[*ast.Module]struct{}),
+	}
+}
+
+// add sandboxes an imported module. It is a no-op if imports aren't
+// sandboxed.
+func (s *importSandbox) add(mod *ast.Module) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mods[mod] = struct{}{}
+}
+
+// imported returns true if the builtin being called is in an imported module.
+func (s *importSandbox) imported(ctx context.Context) bool {
+	mod := callerModule(ctx)
+	if mod == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.mods[mod]
+	return ok
+}
+
+func (s *importSandbox) policy(ctx context.Context, access HostAccess) error {
+	if !s.imported(ctx) {
+		return nil
+	}
+
+	switch access.Builtin {
+	case "localRun":
+		return fmt.Errorf("imported modules cannot run commands on the host")
+	case "scan":
+		return fmt.Errorf("imported modules cannot write files on the host")
+	case "local", "localGit", "tarContext", "secret", "secretFile", "secretDir":
+		return s.within(ctx, access.Path)
+	case "ssh":
+		if access.Path == "" {
+			return fmt.Errorf("imported modules cannot forward the ssh agent of the host")
+		}
+		return s.within(ctx, access.Path)
+	case "forward":
+		if access.Address != "" {
+			return fmt.Errorf("imported modules cannot forward network addresses from the host")
+		}
+		return s.within(ctx, access.Path)
+	}
+	return nil
+}
+
+// within vetoes local paths that are not under the root. Relative paths are
+// relative to the working directory of the build.
+func (s *importSandbox) within(ctx context.Context, path string) error {
+	if s.root == "" {
+		return fmt.Errorf("imported modules cannot read local files")
+	}
+	if !filepath.IsAbs(path) {
+		cwd, err := local.Cwd(ctx)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cwd, path)
+	}
+	if !withinRoot(s.root, evalPath(path)) {
+		return fmt.Errorf("imported modules can only read local files under %s", s.root)
+	}
+	return nil
+}
+
+// evalPath returns the absolute path with symlinks evaluated, so that a
+// symlink under the root cannot point outside of it. Paths that do not exist,
+// such as sockets that are yet to be created, have the symlinks of their
+// directory evaluated.
+func evalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	eval, err := filepath.EvalSymlinks(abs)
+	if err == nil {
+		return eval
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs
+	}
+	return filepath.Join(dir, filepath.Base(abs))
+}
+
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
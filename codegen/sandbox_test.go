@@ -0,0 +1,32 @@
+package codegen
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportSandboxModules(t *testing.T) {
+	t.Parallel()
+
+	// Modules imported from different filesystems may have the same
+	// filename, so only the module that was imported is sandboxed.
+	imported, other := &ast.Module{}, &ast.Module{}
+	imported.Pos.Filename = "module.hlb"
+	other.Pos.Filename = "module.hlb"
+
+	s := newImportSandbox("")
+	s.add(imported)
+
+	ctx := context.Background()
+	require.False(t, s.imported(ctx))
+	require.True(t, s.imported(withCallerModule(ctx, imported)))
+	require.False(t, s.imported(withCallerModule(ctx, other)))
+
+	err := s.policy(withCallerModule(ctx, other), HostAccess{Builtin: "localRun"})
+	require.NoError(t, err)
+	err = s.policy(withCallerModule(ctx, imported), HostAccess{Builtin: "localRun"})
+	require.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package codegen
+
+import (
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// RequiredSecret is a local secret that a module declares with secretFile or
+// secretDir.
+type RequiredSecret struct {
+	// Builtin is either "secretFile" or "secretDir".
+	Builtin string
+
+	// LocalPath is the local path as declared, which is a glob for secretDir.
+	// Relative paths are resolved against the secret root.
+	LocalPath string
+
+	// Target is the filepath of the secret for secretFile, or the directory
+	// of the secrets for secretDir.
+	Target string
+
+	// Optional is true if the local files may be absent.
+	Optional bool
+
+	// Node is the declaring call.
+	Node ast.Node
+}
+
+// RequiredSecrets returns the local secrets declared in a module, so that an
+// invoker can tell which files a module reads from the host without compiling
+// it. Only declarations with string literal arguments are returned.
+func RequiredSecrets(mod *ast.Module) []RequiredSecret {
+	var secrets []RequiredSecret
+	ast.Match(mod, ast.MatchOpts{},
+		func(call *ast.CallStmt) {
+			if call.Name == nil || call.Name.Reference != nil || len(call.Args) != 2 {
+				return
+			}
+
+			name := call.Name.Ident.Text
+			if name != "secretFile" && name != "secretDir" {
+				return
+			}
+			if mod.Scope != nil && mod.Scope.Objects[name] != nil {
+				return
+			}
+
+			var args []string
+			for _, arg := range call.Args {
+				if arg.BasicLit == nil {
+					return
+				}
+				s, ok := arg.BasicLit.StringValue()
+				if !ok {
+					return
+				}
+				args = append(args, s)
+			}
+
+			secrets = append(secrets, RequiredSecret{
+				Builtin:   name,
+				LocalPath: args[0],
+				Target:    args[1],
+				Optional:  hasOption(call, "optional"),
+				Node:      call,
+			})
+		},
+	)
+	return secrets
+}
+
+// hasOption returns whether a call has a builtin option with the given name.
+func hasOption(call *ast.CallStmt, name string) bool {
+	if call.WithClause == nil {
+		return false
+	}
+
+	var opts []*ast.IdentExpr
+	switch expr := call.WithClause.Expr; {
+	case expr.CallExpr != nil:
+		opts = append(opts, expr.CallExpr.Name)
+	case expr.FuncLit != nil:
+		for _, stmt := range expr.FuncLit.Body.Stmts() {
+			if stmt.Call != nil {
+				opts = append(opts, stmt.Call.Name)
+			}
+		}
+	}
+
+	for _, opt := range opts {
+		if opt != nil && opt.Ident != nil && opt.Reference == nil && opt.Ident.Text == name {
+			return true
+		}
+	}
+	return false
+}
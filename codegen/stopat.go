@@ -0,0 +1,161 @@
+package codegen
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// errStopped is the error of the statements after a stop point, which are
+// skipped.
+var errStopped = errors.New("stopped at stop point")
+
+// stopPoint is the statement where a partial solve of a target stops. The
+// block of the statement stops emitting after it, and the value after it is
+// the value of the target instead.
+type stopPoint struct {
+	stmt *ast.Stmt
+
+	mu       sync.Mutex
+	captured Value
+}
+
+// capture records the value after the statement of the stop point. The
+// statement may be emitted more than once, like when its function is called
+// twice, in which case the first value is kept.
+func (sp *stopPoint) capture(val Value) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.captured == nil {
+		sp.captured = val
+	}
+}
+
+// value returns the value after the statement of the stop point, or nil if
+// it was never reached.
+func (sp *stopPoint) value() Value {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.captured
+}
+
+// resolveStopAt returns the statement of a module where a target stops,
+// given as either `file.hlb:LINE` or `funcName#N`, where N is the 1-based
+// index of a statement in the body of the function. A line within a
+// statement, like a line of its with clause, stops at the statement.
+//
+// Only the top-level statements of the functions of the module are stop
+// points. Stop points inside imported modules are not supported.
+func resolveStopAt(mod *ast.Module, spec string) (*ast.Stmt, error) {
+	if i := strings.LastIndex(spec, "#"); i >= 0 {
+		name, n := spec[:i], spec[i+1:]
+		if strings.Contains(name, ".") {
+			return nil, fmt.Errorf("invalid stop point %q: stop points inside imported functions are not supported", spec)
+		}
+		fd, err := stopAtFunc(mod, spec, name)
+		if err != nil {
+			return nil, err
+		}
+
+		stmts := fd.Body.Stmts()
+		index, err := strconv.Atoi(n)
+		if err != nil || index < 1 || index > len(stmts) {
+			return nil, fmt.Errorf("invalid stop point %q: %s has stop points %s#1 to %s#%d", spec, name, name, name, len(stmts))
+		}
+		return stmts[index-1], nil
+	}
+
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid stop point %q: expected file.hlb:LINE or funcName#N", spec)
+	}
+	filename, n := spec[:i], spec[i+1:]
+	line, err := strconv.Atoi(n)
+	if err != nil || line < 1 {
+		return nil, fmt.Errorf("invalid stop point %q: invalid line %q", spec, n)
+	}
+	if filepath.Base(filename) != filepath.Base(mod.Pos.Filename) {
+		return nil, fmt.Errorf("invalid stop point %q: stop points inside imported modules are not supported, only in %s", spec, mod.Pos.Filename)
+	}
+
+	var (
+		nearest  []string
+		distance = -1
+	)
+	for _, fd := range stopAtFuncs(mod) {
+		for j, stmt := range fd.Body.Stmts() {
+			start, end := stmtLines(stmt)
+			if start <= line && line <= end {
+				return stmt, nil
+			}
+
+			// Suggest the stop points closest to the line.
+			d := start - line
+			if d < 0 {
+				d = line - end
+			}
+			point := fmt.Sprintf("%s:%d (%s#%d)", filename, start, fd.Sig.Name, j+1)
+			switch {
+			case distance < 0 || d < distance:
+				distance, nearest = d, []string{point}
+			case d == distance:
+				nearest = append(nearest, point)
+			}
+		}
+	}
+	if len(nearest) == 0 {
+		return nil, fmt.Errorf("invalid stop point %q: %s has no statements to stop at", spec, mod.Pos.Filename)
+	}
+	return nil, fmt.Errorf("invalid stop point %q: no statement at line %d, nearest stop points are %s", spec, line, strings.Join(nearest, ", "))
+}
+
+// stmtLines returns the first and last lines of a statement. The end of a
+// statement is after its newline, so it is on the line after it.
+func stmtLines(stmt *ast.Stmt) (start, end int) {
+	start, end = stmt.Position().Line, stmt.End().Line
+	if stmt.End().Column == 1 && end > start {
+		end--
+	}
+	return start, end
+}
+
+// stopAtFunc returns the function of a module with stop points by name.
+func stopAtFunc(mod *ast.Module, spec, name string) (*ast.FuncDecl, error) {
+	var names []string
+	for _, fd := range stopAtFuncs(mod) {
+		if fd.Sig.Name.Text == name {
+			return fd, nil
+		}
+		names = append(names, fd.Sig.Name.Text)
+	}
+
+	if _, ok := mod.Scope.Objects[name]; ok {
+		return nil, fmt.Errorf("invalid stop point %q: %s has no statements to stop at", spec, name)
+	}
+	var suggestion string
+	if s := diagnostic.Suggestion(name, names); s != "" {
+		suggestion = fmt.Sprintf(", did you mean `%s`?", s)
+	}
+	return nil, fmt.Errorf("invalid stop point %q: function %s is not defined in %s%s", spec, name, mod.Pos.Filename, suggestion)
+}
+
+// stopAtFuncs returns the functions of a module whose statements are stop
+// points. Option functions are not, because they don't produce a value to
+// solve.
+func stopAtFuncs(mod *ast.Module) []*ast.FuncDecl {
+	var fds []*ast.FuncDecl
+	for _, decl := range mod.Decls {
+		fd := decl.Func
+		if fd == nil || fd.Body == nil || fd.Kind().Primary() == ast.Option {
+			continue
+		}
+		fds = append(fds, fd)
+	}
+	return fds
+}
@@ -0,0 +1,194 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+const stopAtModule = `
+fs base() {
+	image "alpine"
+}
+
+fs default() {
+	base
+	run "apk add curl"
+	run "make" with option {
+		env "GOOS" "linux"
+		env "CGO_ENABLED" "0"
+	}
+	run "make install"
+	download "."
+}
+`
+
+// stopAt emits the default target of stopAtModule stopped at spec, and
+// returns its filesystem and its execs in the order they are run.
+func stopAt(t *testing.T, spec string) (Filesystem, []*pb.ExecOp) {
+	ctx, mod := parseTestModule(t, stopAtModule)
+	fs, err := emitStopAt(ctx, mod, Target{Name: "default", StopAt: spec})
+	require.NoError(t, err)
+
+	def, err := fs.State.Marshal(ctx, llb.LinuxAmd64)
+	require.NoError(t, err)
+
+	var execs []*pb.ExecOp
+	for _, dt := range def.Def {
+		var op pb.Op
+		require.NoError(t, op.Unmarshal(dt))
+		if exec := op.GetExec(); exec != nil {
+			execs = append(execs, exec)
+		}
+	}
+	return fs, execs
+}
+
+func emitStopAt(ctx context.Context, mod *ast.Module, target Target) (Filesystem, error) {
+	v, err := New(nil, nil).EmitTarget(ctx, mod, target)
+	if err != nil {
+		return Filesystem{}, err
+	}
+	return v.Filesystem()
+}
+
+func TestStopAt(t *testing.T) {
+	t.Parallel()
+
+	_, mod := parseTestModule(t, stopAtModule)
+	filename := mod.Pos.Filename
+
+	// A statement with a with clause is stopped at by its index, or by any
+	// line of it.
+	fs, execs := stopAt(t, "default#3")
+	require.Len(t, execs, 2)
+	require.Contains(t, execs[1].Meta.Env, "GOOS=linux")
+
+	for _, line := range []int{9, 10, 12} {
+		_, same := stopAt(t, fmt.Sprintf("%s:%d", filename, line))
+		require.Equal(t, execs, same)
+	}
+
+	// Exports declared after the stop point are skipped.
+	require.Empty(t, fs.SolveOpts)
+
+	// Statements of the functions a target calls are stop points too.
+	_, execs = stopAt(t, "base#1")
+	require.Empty(t, execs)
+}
+
+func TestStopAtDownload(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, stopAtModule)
+	fs, err := emitStopAt(ctx, mod, Target{
+		Name:         "default",
+		StopAt:       "default#2",
+		StopDownload: t.TempDir(),
+	})
+	require.NoError(t, err)
+	require.Len(t, fs.SolveOpts, 1)
+	require.Len(t, fs.SessionOpts, 1)
+}
+
+func TestStopAtError(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, stopAtModule)
+	filename := mod.Pos.Filename
+
+	for _, tc := range []struct {
+		name   string
+		stopAt string
+		errMsg string
+	}{{
+		"imported function",
+		"util.build#1",
+		"stop points inside imported functions are not supported",
+	}, {
+		"imported module",
+		"util.hlb:3",
+		"stop points inside imported modules are not supported",
+	}, {
+		"between functions",
+		fmt.Sprintf("%s:5", filename),
+		fmt.Sprintf("no statement at line 5, nearest stop points are %[1]s:3 (base#1), %[1]s:7 (default#1)", filename),
+	}, {
+		"after the last statement",
+		"default#6",
+		"default has stop points default#1 to default#5",
+	}, {
+		"undefined function",
+		"defualt#1",
+		"function defualt is not defined",
+	}, {
+		"invalid format",
+		"default",
+		"expected file.hlb:LINE or funcName#N",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := emitStopAt(ctx, mod, Target{Name: "default", StopAt: tc.stopAt})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+}
+
+func TestStopAtMemoized(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	fs base() {
+		image "alpine"
+		run "apk add curl"
+		run "make"
+	}
+
+	fs a() {
+		base
+		run "make a"
+	}
+
+	fs b() {
+		base
+		run "make b"
+	}
+	`)
+
+	for _, targets := range [][]Target{
+		{{Name: "a", StopAt: "base#2"}, {Name: "b"}},
+		{{Name: "b"}, {Name: "a", StopAt: "base#2"}},
+		{{Name: "a", StopAt: "base#2"}, {Name: "b", StopAt: "base#3"}},
+	} {
+		// Each target stops at its own stop point, or runs to its end,
+		// regardless of the other target memoizing base.
+		requests, err := New(nil, nil).generate(ctx, mod, "", targets)
+		require.NoError(t, err)
+		require.Len(t, requests, 2)
+
+		for i, target := range targets {
+			tree := treeprint.New()
+			require.NoError(t, requests[i].Tree(tree))
+
+			actual := tree.String()
+			require.Contains(t, actual, "apk add curl")
+			switch target.StopAt {
+			case "base#2":
+				require.NotContains(t, actual, "make")
+			case "base#3":
+				require.Contains(t, actual, "make")
+				require.NotContains(t, actual, "make "+target.Name)
+			default:
+				require.Contains(t, actual, "make "+target.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/solver"
+	"github.com/xlab/treeprint"
+)
+
+// TestPrefix is the prefix of the names of test targets.
+const TestPrefix = "test"
+
+// WithTestMode generates the tests of a module instead of its targets. Every
+// test is built even if others fail, and a summary of the tests that passed
+// and failed is written to the diagnostic writer. If targets are given to
+// Generate, only those tests are built.
+func WithTestMode() CodeGenOption {
+	return func(cg *CodeGen) {
+		cg.testMode = true
+	}
+}
+
+// Tests returns the tests of a module in the order they are declared. Tests
+// are functions without parameters whose names start with TestPrefix.
+func Tests(mod *ast.Module) []Target {
+	var targets []Target
+	for _, decl := range mod.Decls {
+		fd := decl.Func
+		if fd == nil || fd.Sig.Name == nil || !strings.HasPrefix(fd.Sig.Name.Text, TestPrefix) {
+			continue
+		}
+		if fd.Sig.Params != nil && len(fd.Sig.Params.Fields()) > 0 {
+			continue
+		}
+		targets = append(targets, Target{Name: fd.Sig.Name.Text})
+	}
+	return targets
+}
+
+// generateTests generates each test separately, so that a test that fails to
+// generate, like one with a failed assertion, is reported as a failed test
+// instead of failing the others.
+func (cg *CodeGen) generateTests(ctx context.Context, mod *ast.Module, targets []Target) (solver.Request, error) {
+	if len(targets) == 0 {
+		targets = Tests(mod)
+	}
+
+	r := &testRequest{w: cg.diagnosticWriter}
+	for _, target := range targets {
+		if _, ok := mod.Scope.Objects[target.Name]; !ok {
+			return nil, errdefs.WithUndefinedTarget(fmt.Errorf("target %q is not defined in %s", target.Name, mod.Pos.Filename), target.Name)
+		}
+
+		t := testResult{name: target.Name}
+		reqs, err := cg.generate(ctx, mod, "", []Target{target})
+		if err != nil {
+			t.err = err
+		} else {
+			t.req = solver.Named(target.Name, solver.Parallel(reqs...))
+		}
+		r.tests = append(r.tests, t)
+	}
+	return r, nil
+}
+
+type testResult struct {
+	name string
+	req  solver.Request
+	err  error
+}
+
+// testRequest solves tests in parallel without canceling the other tests when
+// one fails, and reports which tests passed and failed.
+type testRequest struct {
+	w     io.Writer
+	tests []testResult
+}
+
+func (r *testRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	errs := make([]error, len(r.tests))
+	var reqs []solver.Request
+	for i, t := range r.tests {
+		if t.err != nil {
+			errs[i] = t.err
+			continue
+		}
+
+		// A failed test is recorded instead of canceling the others.
+		i := i
+		reqs = append(reqs, solver.OnFailure(t.req, func(err error) error {
+			errs[i] = err
+			return nil
+		}))
+	}
+	err := solver.Parallel(reqs...).Solve(ctx, cln, mw, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the progress of the tests to be written before the summary.
+	if p := Progress(ctx); p != nil {
+		err := p.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return r.report(ctx, errs)
+}
+
+// report writes whether each test passed or failed, and returns an error if
+// any of them failed.
+func (r *testRequest) report(ctx context.Context, errs []error) error {
+	var failed int
+	for i, t := range r.tests {
+		err := errs[i]
+		if err == nil {
+			r.printf("--- PASS: %s\n", t.name)
+			continue
+		}
+
+		failed++
+		r.printf("--- FAIL: %s\n", t.name)
+		spans := diagnostic.Spans(err)
+		if len(spans) == 0 {
+			r.printf("%s\n", err)
+		}
+		for _, span := range spans {
+			r.printf("%s\n", span.Pretty(ctx))
+		}
+	}
+
+	if failed > 0 {
+		r.printf("FAIL\n")
+		return fmt.Errorf("%d of %d tests failed", failed, len(r.tests))
+	}
+	r.printf("ok %d tests passed\n", len(r.tests))
+	return nil
+}
+
+func (r *testRequest) printf(format string, a ...interface{}) {
+	if r.w != nil {
+		fmt.Fprintf(r.w, format, a...)
+	}
+}
+
+func (r *testRequest) Tree(tree treeprint.Tree) error {
+	branch := tree.AddMetaBranch("tests", len(r.tests))
+	for _, t := range r.tests {
+		if t.err != nil {
+			branch.AddMetaNode("failed", t.name)
+			continue
+		}
+		err := t.req.Tree(branch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lithammer/dedent"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/openllb/hlb/solver"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+type fakeRequest struct {
+	err error
+}
+
+func (r *fakeRequest) Solve(ctx context.Context, cln *client.Client, mw *solver.MultiWriter, opts ...solver.SolveOption) error {
+	return r.err
+}
+
+func (r *fakeRequest) Tree(tree treeprint.Tree) error {
+	return nil
+}
+
+func parseTestModule(t *testing.T, input string) (context.Context, *ast.Module) {
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx = WithSessionID(ctx, identity.NewID())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(input)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+	return ctx, mod
+}
+
+func TestTests(t *testing.T) {
+	t.Parallel()
+
+	_, mod := parseTestModule(t, `
+	fs testB() {
+		scratch
+	}
+
+	fs default() {
+		scratch
+	}
+
+	fs testWithParam(string name) {
+		scratch
+	}
+
+	fs testA() {
+		scratch
+	}
+	`)
+	require.Equal(t, []Target{{Name: "testB"}, {Name: "testA"}}, Tests(mod))
+}
+
+func TestGenerateTests(t *testing.T) {
+	t.Parallel()
+
+	ctx, mod := parseTestModule(t, `
+	fs testPass() {
+		scratch
+		assertEq "a" "a"
+	}
+
+	fs testFail() {
+		scratch
+		assertEq "a" "b"
+	}
+	`)
+
+	var buf bytes.Buffer
+	req, err := New(nil, nil, WithTestMode(), WithDiagnosticWriter(&buf)).Generate(ctx, mod, nil)
+	require.NoError(t, err)
+
+	r, ok := req.Request.(*testRequest)
+	require.True(t, ok)
+	require.Len(t, r.tests, 2)
+	require.Equal(t, "testPass", r.tests[0].name)
+	require.NoError(t, r.tests[0].err)
+	require.Equal(t, "testFail", r.tests[1].name)
+	require.Error(t, r.tests[1].err)
+
+	_, err = New(nil, nil, WithTestMode()).Generate(ctx, mod, []Target{{Name: "testMissing"}})
+	require.Error(t, err)
+}
+
+func TestTestRequest(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	r := &testRequest{
+		w: &buf,
+		tests: []testResult{
+			{name: "testA", req: &fakeRequest{}},
+			{name: "testB", req: &fakeRequest{err: errors.New("solve failed")}},
+			{name: "testC", err: errors.New("generate failed")},
+			{name: "testD", req: &fakeRequest{}},
+		},
+	}
+	err := r.Solve(context.Background(), nil, nil)
+	require.EqualError(t, err, "2 of 4 tests failed")
+	require.Equal(t, strings.Join([]string{
+		"--- PASS: testA",
+		"--- FAIL: testB",
+		"solve failed",
+		"--- FAIL: testC",
+		"generate failed",
+		"--- PASS: testD",
+		"FAIL",
+		"",
+	}, "\n"), buf.String())
+
+	buf.Reset()
+	r.tests = []testResult{{name: "testA", req: &fakeRequest{}}}
+	err = r.Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "--- PASS: testA\nok 1 tests passed\n", buf.String())
+}
+
+func TestReadRef(t *testing.T) {
+	t.Parallel()
+
+	_, err := readRef(context.Background(), nil, "file")
+	require.True(t, errdefs.IsNotExist(err))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"os"
@@ -49,6 +50,17 @@ func ParseModuleURI(ctx context.Context, cln *client.Client, dir ast.Directory,
 	}
 }
 
+// ParseModule parses a module to be built. Its parse errors are counted by the
+// metrics of the global solve options.
+func ParseModule(ctx context.Context, r io.Reader, opts ...filebuffer.Option) (*ast.Module, error) {
+	mod, err := parser.Parse(ctx, r, opts...)
+	if err != nil {
+		solver.MetricsFromOptions(GlobalSolveOpts(ctx)...).ObserveError(solver.ErrorParse)
+		return nil, err
+	}
+	return mod, nil
+}
+
 func parseModuleFileURI(ctx context.Context, cln *client.Client, dir ast.Directory, u *url.URL) (*ast.Module, error) {
 	filename, err := parser.ResolvePath(ModuleDir(ctx), u.Host+u.Path)
 	if err != nil {
@@ -61,7 +73,7 @@ func parseModuleFileURI(ctx context.Context, cln *client.Client, dir ast.Directo
 	}
 	defer rc.Close()
 
-	mod, err := parser.Parse(ctx, rc)
+	mod, err := ParseModule(ctx, rc)
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +182,7 @@ func parseModuleGitURI(ctx context.Context, cln *client.Client, uri string) (*as
 	}
 	defer rc.Close()
 
-	mod, err := parser.Parse(ctx, rc, filebuffer.WithEphemeral())
+	mod, err := ParseModule(ctx, rc, filebuffer.WithEphemeral())
 	if err != nil {
 		return nil, err
 	}
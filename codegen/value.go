@@ -2,13 +2,17 @@ package codegen
 
 import (
 	"context"
+	"encoding/csv"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
@@ -33,22 +37,46 @@ func (p Prototype) Call(ctx context.Context, cln *client.Client, v Value, opts O
 
 type Option []interface{}
 
+// Register holds the value of an expression as it is emitted.
+//
+// Values set on a register are ordered. A function passed to SetAsync is only
+// called once every value set before it has been computed, and it is passed
+// the computed value instead of a pending one. So a statement in a block
+// observes the value produced by all of the statements before it, and none of
+// its side effects, like yielding to the debugger or accumulating options,
+// happen before theirs. If an earlier value failed, the later functions are
+// not called and the register holds the earlier error.
 type Register interface {
 	Value() Value
 	Set(interface{}) error
 	SetAsync(func(Value) (Value, error))
 }
 
+// register holds the value of an expression. Values set asynchronously are
+// chained onto the previous value and computed at most once, so reading a
+// register repeatedly or from multiple goroutines never re-evaluates it.
 type register struct {
 	debug bool
+	ctor  func(iface interface{}) (Value, error)
+
+	// hook is called before each value set asynchronously is computed,
+	// which tests use to delay values.
+	hook func()
+
+	// pool computes the values set asynchronously, if their concurrency is
+	// bounded.
+	pool *evalPool
+
+	mu    sync.Mutex
 	value Value
 	last  Value
-	ctor  func(iface interface{}) (Value, error)
 }
 
 func NewRegister(ctx context.Context) Register {
 	return &register{
 		debug: GetDebugger(ctx) != nil,
+		hook:  registerHook(ctx),
+		pool:  getEvalPool(ctx),
 		value: ZeroValue(ctx),
 		ctor: func(iface interface{}) (Value, error) {
 			return NewValue(ctx, iface)
@@ -59,12 +87,15 @@ func NewRegister(ctx context.Context) Register {
 func (r *register) Set(iface interface{}) error {
 	// If there are no async queued up, fast path towards setting the register.
 	val, err := r.ctor(iface)
+	r.mu.Lock()
 	if r.last == nil {
 		if err == nil {
 			r.value = val
 		}
+		r.mu.Unlock()
 		return err
 	}
+	r.mu.Unlock()
 	r.SetAsync(func(Value) (Value, error) {
 		return val, err
 	})
@@ -72,6 +103,7 @@ func (r *register) Set(iface interface{}) error {
 }
 
 func (r *register) SetAsync(f func(Value) (Value, error)) {
+	r.mu.Lock()
 	var prev Value
 	if r.last == nil {
 		prev = r.value
@@ -79,23 +111,55 @@ func (r *register) SetAsync(f func(Value) (Value, error)) {
 		prev = r.last
 	}
 
-	valCh := make(chan Value)
-	r.last = &lazyValue{valCh: valCh}
+	lazy := &lazyValue{valCh: make(chan Value, 1)}
+	r.last = lazy
+	r.mu.Unlock()
+
+	compute := func() {
+		if r.hook != nil {
+			r.hook()
+		}
+
+		prev = unwrapLazy(prev)
+		if _, ok := prev.(*errorValue); ok {
+			lazy.valCh <- prev
+			return
+		}
 
-	go func() {
 		next, err := f(prev)
 		if err != nil {
 			next = &errorValue{err}
 		}
-		valCh <- next
-	}()
+		lazy.valCh <- next
+	}
+
+	if r.pool != nil {
+		lazy.start = compute
+		r.pool.submit(lazy)
+	} else {
+		go compute()
+	}
 
 	if r.debug {
-		r.last.(*lazyValue).wait()
+		lazy.wait()
+	}
+}
+
+// unwrapLazy waits for a value that is being computed asynchronously.
+func unwrapLazy(val Value) Value {
+	for {
+		lazy, ok := val.(*lazyValue)
+		if !ok {
+			return val
+		}
+		lazy.wait()
+		val = lazy.val
 	}
 }
 
 func (r *register) Value() Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.last != nil {
 		r.value = r.last
 		r.last = nil
@@ -103,6 +167,39 @@ func (r *register) Value() Value {
 	return r.value
 }
 
+// optionCollector accumulates the options emitted by the statements of an
+// option block into the block's return register in statement order.
+type optionCollector struct {
+	ctx context.Context
+	ret Register
+}
+
+func newOptionCollector(ctx context.Context, ret Register) *optionCollector {
+	return &optionCollector{ctx: ctx, ret: ret}
+}
+
+// Collect appends the options held by stmtRet after the options collected so
+// far. The statement's value is captured immediately so that the collector
+// preserves source order even though the statements are evaluated lazily.
+func (oc *optionCollector) Collect(stmtRet Register) {
+	stmtVal := stmtRet.Value()
+	oc.ret.SetAsync(func(val Value) (Value, error) {
+		retOpts, err := val.Option()
+		if err != nil {
+			return nil, err
+		}
+
+		stmtOpts, err := stmtVal.Option()
+		if err != nil {
+			return nil, err
+		}
+
+		opts := make(Option, 0, len(retOpts)+len(stmtOpts))
+		opts = append(opts, retOpts...)
+		return NewValue(oc.ctx, append(opts, stmtOpts...))
+	})
+}
+
 type Value interface {
 	Kind() ast.Kind
 	Filesystem() (Filesystem, error)
@@ -132,6 +229,8 @@ func NewValue(ctx context.Context, iface interface{}) (Value, error) {
 		return &stringValue{&nilValue{}, v}, nil
 	case int:
 		return &intValue{&nilValue{}, v}, nil
+	case bool:
+		return &boolValue{&nilValue{}, v}, nil
 	case Option:
 		return &optValue{&nilValue{}, v}, nil
 	case solver.Request:
@@ -212,17 +311,39 @@ func (v *errorValue) Reflect(t reflect.Type) (reflect.Value, error) {
 	return reflect.Value{}, v.err
 }
 
+// lazyValue is a value that is being computed asynchronously. The value is
+// received once and cached for every subsequent read.
 type lazyValue struct {
 	valCh chan Value
+	once  sync.Once
 	val   Value
+
+	// start begins computing a deferred value on its first read.
+	start func()
 }
 
-func (v *lazyValue) wait() {
-	val, ok := <-v.valCh
-	if ok {
-		v.val = val
-		close(v.valCh)
+// deferValue returns a value that is computed by f the first time it is read,
+// in the goroutine reading it. Unlike a value set asynchronously on a
+// register, f is never called if the value is never read.
+func deferValue(f func() (Value, error)) Value {
+	lazy := &lazyValue{valCh: make(chan Value, 1)}
+	lazy.start = func() {
+		val, err := f()
+		if err != nil {
+			val = &errorValue{err}
+		}
+		lazy.valCh <- val
 	}
+	return lazy
+}
+
+func (v *lazyValue) wait() {
+	v.once.Do(func() {
+		if v.start != nil {
+			v.start()
+		}
+		v.val = <-v.valCh
+	})
 }
 
 func (v *lazyValue) Kind() ast.Kind {
@@ -307,6 +428,23 @@ type Filesystem struct {
 	SolveOpts   []solver.SolveOption
 	SessionOpts []llbutil.SessionOption
 	Platform    specs.Platform
+
+	// Base is the image config of the image the filesystem started from, which
+	// Image is changed from, or nil if it did not start from an image.
+	Base *solver.ImageSpec
+
+	// baseArg is the argument of the image the filesystem started from, so
+	// that config changes can point at the image they conflict with.
+	baseArg ast.Node
+
+	// lastCopy is the last copy onto the filesystem, which only produced it
+	// while its output is still the output of the state.
+	lastCopy *copyAction
+
+	// workdirArg and userArg are the arguments that set the working directory
+	// and user, so that runs can check that they exist before the exec.
+	workdirArg ast.Node
+	userArg    ast.Node
 }
 
 func (fs Filesystem) Digest(ctx context.Context) (digest.Digest, error) {
@@ -342,9 +480,14 @@ func (v *fsValue) Filesystem() (Filesystem, error) {
 	fs := Filesystem{
 		State:       v.fs.State,
 		Image:       &image,
+		Base:        v.fs.Base,
+		baseArg:     v.fs.baseArg,
+		workdirArg:  v.fs.workdirArg,
+		userArg:     v.fs.userArg,
 		SolveOpts:   make([]solver.SolveOption, len(v.fs.SolveOpts)),
 		SessionOpts: make([]llbutil.SessionOption, len(v.fs.SessionOpts)),
 		Platform:    v.fs.Platform,
+		lastCopy:    v.fs.lastCopy,
 	}
 	copy(fs.SolveOpts, v.fs.SolveOpts)
 	copy(fs.SessionOpts, v.fs.SessionOpts)
@@ -368,6 +511,21 @@ func (v *fsValue) Reflect(t reflect.Type) (reflect.Value, error) {
 	return ReflectTo(v, t)
 }
 
+// Thunk is an argument of a builtin that is evaluated each time it is called,
+// instead of once before the builtin is called, so that the builtin can
+// evaluate it with different contexts. If val is not nil, the argument is
+// evaluated starting from val, like a call statement within a block.
+type Thunk func(ctx context.Context, val Value) (Value, error)
+
+type thunkValue struct {
+	Value
+	thunk Thunk
+}
+
+func (v *thunkValue) Reflect(t reflect.Type) (reflect.Value, error) {
+	return ReflectTo(v, t)
+}
+
 type stringValue struct {
 	Value
 	str string
@@ -414,6 +572,27 @@ func (v *intValue) Reflect(t reflect.Type) (reflect.Value, error) {
 	return ReflectTo(v, t)
 }
 
+type boolValue struct {
+	Value
+	b bool
+}
+
+func (v *boolValue) Kind() ast.Kind {
+	return ast.Bool
+}
+
+func (v *boolValue) Bool() (bool, error) {
+	return v.b, nil
+}
+
+func (v *boolValue) String() (string, error) {
+	return strconv.FormatBool(v.b), nil
+}
+
+func (v *boolValue) Reflect(t reflect.Type) (reflect.Value, error) {
+	return ReflectTo(v, t)
+}
+
 type optValue struct {
 	Value
 	opt Option
@@ -449,15 +628,25 @@ var (
 	rFilesystem = reflect.TypeOf(Filesystem{})
 	rString     = reflect.TypeOf("")
 	rInt        = reflect.TypeOf(0)
+	rBool       = reflect.TypeOf(false)
 	rOption     = reflect.TypeOf((Option)([]interface{}{}))
 	rRequest    = reflect.TypeOf((*solver.Request)(nil)).Elem()
 	rFileMode   = reflect.TypeOf(os.FileMode(0))
 	rDigest     = reflect.TypeOf(digest.Digest(""))
 	rTime       = reflect.TypeOf(time.Time{})
+	rDuration   = reflect.TypeOf(time.Duration(0))
 	rIP         = reflect.TypeOf(net.IP(nil))
 	rURL        = reflect.TypeOf(&url.URL{})
+	rThunk      = reflect.TypeOf(Thunk(nil))
+	rEnum       = reflect.TypeOf((*Enum)(nil)).Elem()
 )
 
+// Enum is implemented by named string types of builtin parameters that only
+// accept a fixed set of values.
+type Enum interface {
+	Values() []string
+}
+
 func ReflectTo(v Value, t reflect.Type) (reflect.Value, error) {
 	var (
 		iface interface{}
@@ -473,6 +662,14 @@ func ReflectTo(v Value, t reflect.Type) (reflect.Value, error) {
 		iface, err = v.String()
 	case rInt:
 		iface, err = v.Int()
+	case rBool:
+		var str string
+		str, err = v.String()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		iface, err = strconv.ParseBool(str)
 	case rOption:
 		iface, err = v.Option()
 	case rRequest:
@@ -501,6 +698,14 @@ func ReflectTo(v Value, t reflect.Type) (reflect.Value, error) {
 		}
 
 		iface, err = time.Parse(time.RFC3339, str)
+	case rDuration:
+		var str string
+		str, err = v.String()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+
+		iface, err = time.ParseDuration(str)
 	case rIP:
 		var str string
 		str, err = v.String()
@@ -521,9 +726,109 @@ func ReflectTo(v Value, t reflect.Type) (reflect.Value, error) {
 		}
 
 		iface, err = url.Parse(str)
+	case rThunk:
+		for {
+			lv, ok := v.(*lazyValue)
+			if !ok {
+				break
+			}
+			lv.wait()
+			v = lv.val
+		}
+
+		tv, ok := v.(*thunkValue)
+		if !ok {
+			return reflect.ValueOf(Thunk(func(context.Context, Value) (Value, error) {
+				return v, nil
+			})), nil
+		}
+		iface = tv.thunk
 	default:
+		switch t.Kind() {
+		case reflect.String:
+			return reflectEnum(v, t)
+		case reflect.Struct:
+			return reflectStruct(v, t)
+		}
 		return reflect.Value{}, fmt.Errorf("unrecognized type %s", t)
 	}
 
 	return reflect.ValueOf(iface), err
 }
+
+// reflectEnum reflects a string to a named string type. If the type is an
+// Enum, the string must be one of its values.
+func reflectEnum(v Value, t reflect.Type) (reflect.Value, error) {
+	str, err := v.String()
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	rval := reflect.New(t).Elem()
+	rval.SetString(str)
+	if enum, ok := rval.Interface().(Enum); ok {
+		values := enum.Values()
+		for _, value := range values {
+			if str == value {
+				return rval, nil
+			}
+		}
+		return reflect.Value{}, fmt.Errorf("invalid %s %q, expected one of %s", t.Name(), str, strings.Join(values, ", "))
+	}
+	return rval, nil
+}
+
+// reflectStruct reflects a comma-separated list of key=value pairs to a
+// struct. Keys are the name of the struct field with its first letter in
+// lowercase, or its `hlb` tag, and each value is reflected to the type of its
+// field.
+func reflectStruct(v Value, t reflect.Type) (reflect.Value, error) {
+	str, err := v.String()
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		key := field.Tag.Get("hlb")
+		if key == "" {
+			runes := []rune(field.Name)
+			runes[0] = unicode.ToLower(runes[0])
+			key = string(runes)
+		}
+		fields[key] = i
+	}
+
+	rval := reflect.New(t).Elem()
+	if str == "" {
+		return rval, nil
+	}
+
+	pairs, err := csv.NewReader(strings.NewReader(str)).Read()
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid %s %q: %w", t.Name(), str, err)
+	}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return reflect.Value{}, fmt.Errorf("invalid %s field %q, expected key=value", t.Name(), pair)
+		}
+
+		i, ok := fields[parts[0]]
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("unknown %s field %q", t.Name(), parts[0])
+		}
+
+		fv, err := ReflectTo(&stringValue{&nilValue{}, parts[1]}, t.Field(i).Type)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid %s field %q: %w", t.Name(), parts[0], err)
+		}
+		rval.Field(i).Set(fv)
+	}
+	return rval, nil
+}
@@ -0,0 +1,373 @@
+package codegen
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/moby/buildkit/identity"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+func TestRegisterValue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	r := NewRegister(ctx)
+	r.SetAsync(func(Value) (Value, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return NewValue(ctx, "value")
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			str, err := r.Value().String()
+			require.NoError(t, err)
+			require.Equal(t, "value", str)
+		}()
+	}
+	wg.Wait()
+
+	str, err := r.Value().String()
+	require.NoError(t, err)
+	require.Equal(t, "value", str)
+	require.Equal(t, 1, calls)
+}
+
+func TestRegisterOrder(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// The first value is slow, so the second is only computed after it if
+	// values are computed in order.
+	var order []string
+	r := NewRegister(ctx)
+	r.SetAsync(func(Value) (Value, error) {
+		time.Sleep(10 * time.Millisecond)
+		order = append(order, "first")
+		return NewValue(ctx, "first")
+	})
+	r.SetAsync(func(val Value) (Value, error) {
+		_, ok := val.(*lazyValue)
+		require.False(t, ok, "expected a computed value")
+		order = append(order, "second")
+		return val, nil
+	})
+	str, err := r.Value().String()
+	require.NoError(t, err)
+	require.Equal(t, "first", str)
+	require.Equal(t, []string{"first", "second"}, order)
+
+	// Values after an error are not computed.
+	r = NewRegister(ctx)
+	r.SetAsync(func(Value) (Value, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	r.SetAsync(func(Value) (Value, error) {
+		t.Error("computed a value after an error")
+		return NewValue(ctx, "ignored")
+	})
+	_, err = r.Value().String()
+	require.EqualError(t, err, "failed")
+}
+
+func TestEmitBlockOrder(t *testing.T) {
+	t.Parallel()
+
+	// Every statement depends on the environment set by the statements
+	// before it, and all of their values are computed asynchronously.
+	var sb strings.Builder
+	sb.WriteString("string value(string s) {\n\tformat \"v-%s\" s\n}\n\nfs default() {\n\timage \"alpine\"\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&sb, "\tenv \"K%d\" value(\"%d\")\n", i, i)
+		fmt.Fprintf(&sb, "\trun \"echo $K%d\" with option {\n\t\tenv \"OPT\" value(\"o%d\")\n\t\tdir value(\"/d%d\")\n\t}\n", i, i, i)
+	}
+	sb.WriteString("}\n")
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx = WithSessionID(ctx, identity.NewID())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(sb.String()))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = checker.Check(mod)
+	require.NoError(t, err)
+
+	generate := func(ctx context.Context) string {
+		request, err := New(nil, nil).Generate(ctx, mod, []Target{{Name: "default"}})
+		require.NoError(t, err)
+
+		tree := treeprint.New()
+		err = request.Tree(tree)
+		require.NoError(t, err)
+		return tree.String()
+	}
+
+	expected := generate(ctx)
+	require.Contains(t, expected, "K99=v-99")
+
+	// Delay every value by a random amount, so that values computed out of
+	// order would change the definition.
+	ctx = withRegisterHook(ctx, func() {
+		if rand.Intn(8) == 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(50 * time.Microsecond))))
+		} else {
+			runtime.Gosched()
+		}
+	})
+	for i := 0; i < 10; i++ {
+		require.Equal(t, expected, generate(ctx), "run %d", i)
+	}
+}
+
+func TestRegisterConcurrency(t *testing.T) {
+	t.Parallel()
+
+	// Every statement and argument is a value set asynchronously.
+	var sb strings.Builder
+	sb.WriteString("string value(string s) {\n\tformat \"v-%s\" s\n}\n\nfs default() {\n\timage \"alpine\"\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "\tenv \"K%d\" value(\"%d\")\n", i, i)
+	}
+	sb.WriteString("\trun \"env\"\n}\n")
+	ctx, mod := parseTestModule(t, sb.String())
+
+	generate := func(ctx context.Context, opts ...CodeGenOption) string {
+		request, err := New(nil, nil, opts...).Generate(ctx, mod, []Target{{Name: "default"}})
+		require.NoError(t, err)
+
+		tree := treeprint.New()
+		err = request.Tree(tree)
+		require.NoError(t, err)
+		return tree.String()
+	}
+
+	expected := generate(ctx)
+	require.Contains(t, expected, "K999=v-999")
+
+	var (
+		mu           sync.Mutex
+		active, peak int
+		computed     int
+	)
+	ctx = withRegisterHook(ctx, func() {
+		mu.Lock()
+		active++
+		computed++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		runtime.Gosched()
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+
+	const n = 4
+	require.Equal(t, expected, generate(ctx, WithRegisterConcurrency(n)))
+	require.Greater(t, computed, 2000)
+
+	// Besides the workers, only the goroutine generating the module computes
+	// values, when it reads one no worker has picked up yet.
+	require.LessOrEqual(t, peak, n+1)
+}
+
+func TestLocalRunEvaluatedOnce(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name  string
+		input string
+	}
+
+	for _, tc := range []testCase{{
+		"argument read twice",
+		`
+		fs default() {
+			build localRun("echo run >> %[1]s; echo v1")
+		}
+
+		fs build(string version) {
+			image "alpine"
+			env "VERSION" version
+			env "TAG" "app:${version}"
+		}
+		`,
+	}, {
+		"binding read twice",
+		`
+		fs default() {
+			image "alpine"
+			run localRun("echo run >> %[1]s; echo true") with option {
+				mount scratch "/out" as artifacts
+			}
+			copy artifacts "/" "/a"
+			copy artifacts "/" "/b"
+		}
+		`,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+			ctx = ast.WithModules(ctx, builtin.Modules())
+			ctx = WithSessionID(ctx, identity.NewID())
+
+			runs := filepath.Join(t.TempDir(), "runs")
+			input := fmt.Sprintf(dedent.Dedent(tc.input), runs)
+			mod, err := parser.Parse(ctx, strings.NewReader(input))
+			require.NoError(t, err)
+
+			err = checker.SemanticPass(mod)
+			require.NoError(t, err)
+
+			err = checker.Check(mod)
+			require.NoError(t, err)
+
+			_, err = New(nil, nil).Generate(ctx, mod, []Target{{Name: "default"}})
+			require.NoError(t, err)
+
+			dt, err := os.ReadFile(runs)
+			require.NoError(t, err)
+			require.Equal(t, "run\n", string(dt))
+		})
+	}
+}
+
+type testCompression string
+
+func (c testCompression) Values() []string {
+	return []string{"gzip", "zstd"}
+}
+
+type testLabel string
+
+type testExport struct {
+	Compression testCompression
+	Level       int
+	Timeout     time.Duration `hlb:"timeout-after"`
+	Force       bool
+
+	ignored string
+}
+
+func TestReflectTo(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	type testCase struct {
+		name     string
+		value    interface{}
+		typ      reflect.Type
+		expected interface{}
+		err      string
+	}
+
+	for _, tc := range []testCase{{
+		"duration",
+		"1m30s",
+		reflect.TypeOf(time.Duration(0)),
+		90 * time.Second,
+		"",
+	}, {
+		"invalid duration",
+		"soon",
+		reflect.TypeOf(time.Duration(0)),
+		nil,
+		`time: invalid duration "soon"`,
+	}, {
+		"named string",
+		"app",
+		reflect.TypeOf(testLabel("")),
+		testLabel("app"),
+		"",
+	}, {
+		"enum",
+		"zstd",
+		reflect.TypeOf(testCompression("")),
+		testCompression("zstd"),
+		"",
+	}, {
+		"invalid enum",
+		"lz4",
+		reflect.TypeOf(testCompression("")),
+		nil,
+		`invalid testCompression "lz4", expected one of gzip, zstd`,
+	}, {
+		"struct",
+		"compression=gzip,level=9,timeout-after=5s,force=true",
+		reflect.TypeOf(testExport{}),
+		testExport{Compression: "gzip", Level: 9, Timeout: 5 * time.Second, Force: true},
+		"",
+	}, {
+		"empty struct",
+		"",
+		reflect.TypeOf(testExport{}),
+		testExport{},
+		"",
+	}, {
+		"struct with unknown field",
+		"ignored=true",
+		reflect.TypeOf(testExport{}),
+		nil,
+		`unknown testExport field "ignored"`,
+	}, {
+		"struct with invalid field",
+		"compression=lz4",
+		reflect.TypeOf(testExport{}),
+		nil,
+		`invalid testExport field "compression": invalid testCompression "lz4", expected one of gzip, zstd`,
+	}, {
+		"struct without value",
+		"force",
+		reflect.TypeOf(testExport{}),
+		nil,
+		`invalid testExport field "force", expected key=value`,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			v, err := NewValue(ctx, tc.value)
+			require.NoError(t, err)
+
+			rval, err := v.Reflect(tc.typ)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, rval.Interface())
+		})
+	}
+}
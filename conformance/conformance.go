@@ -0,0 +1,221 @@
+// Package conformance runs a corpus of HLB modules against the expected
+// diagnostics and emissions of the parser, checker, linter and code generator,
+// so that builds extending HLB can check that they still conform to it.
+//
+// A corpus is a directory of cases, where each case is a module named
+// <case>.hlb alongside its expectations:
+//
+//	<case>.diagnostics.json  the diagnostics reported by parsing, linting
+//	                         and checking the module
+//	<case>.emit.json         a summary of the LLB emitted by every fs
+//	                         function of the module without parameters
+//
+// A missing expectation file expects nothing, so a module that parses and
+// checks cleanly without any fs targets only needs its .hlb file. Running the
+// tests with -update rewrites the expectations from the actual results.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/codegen"
+	"github.com/openllb/hlb/linter"
+	"github.com/openllb/hlb/local"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	diagnosticsExt = ".diagnostics.json"
+	emitExt        = ".emit.json"
+)
+
+func init() {
+	// Test binaries that import this package share its -update flag rather
+	// than defining their own.
+	if flag.Lookup("update") == nil {
+		flag.Bool("update", false, "update the expectations of conformance cases")
+	}
+}
+
+// Option configures how a corpus is run.
+type Option func(*Runner)
+
+// Runner runs the cases of a corpus.
+type Runner struct {
+	setups   []func(context.Context) (context.Context, error)
+	resolver codegen.Resolver
+	cgOpts   []codegen.CodeGenOption
+	update   bool
+}
+
+// WithSetup adds a function that is called with the context of every case
+// before it is parsed, so that extensions can register their builtins and
+// any other state they look up from the context.
+func WithSetup(setup func(context.Context) (context.Context, error)) Option {
+	return func(r *Runner) {
+		r.setups = append(r.setups, setup)
+	}
+}
+
+// WithResolver sets the resolver used to emit the targets of every case.
+func WithResolver(resolver codegen.Resolver) Option {
+	return func(r *Runner) {
+		r.resolver = resolver
+	}
+}
+
+// WithCodeGenOptions adds options to the code generator used to emit the
+// targets of every case.
+func WithCodeGenOptions(opts ...codegen.CodeGenOption) Option {
+	return func(r *Runner) {
+		r.cgOpts = append(r.cgOpts, opts...)
+	}
+}
+
+// WithUpdate rewrites the expectations of every case from the actual results
+// instead of comparing them, as if the tests were run with -update.
+func WithUpdate() Option {
+	return func(r *Runner) {
+		r.update = true
+	}
+}
+
+// Run runs every case of the corpus in dir as a subtest of t.
+func Run(t *testing.T, dir string, opts ...Option) {
+	t.Helper()
+
+	r := &Runner{update: updateFlag()}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.hlb"))
+	require.NoError(t, err)
+	if len(filenames) == 0 {
+		t.Fatalf("no conformance cases in %s", dir)
+	}
+
+	for _, filename := range filenames {
+		filename := filename
+		name := strings.TrimSuffix(filepath.Base(filename), ".hlb")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			diagnostics, emissions := r.runCase(t, dir, filename)
+
+			base := strings.TrimSuffix(filename, ".hlb")
+			r.compare(t, base+diagnosticsExt, diagnostics, len(diagnostics) == 0)
+			r.compare(t, base+emitExt, emissions, len(emissions) == 0)
+		})
+	}
+}
+
+// runCase parses, lints and checks a case, and emits its targets if it has no
+// errors.
+func (r *Runner) runCase(t *testing.T, dir, filename string) ([]Diagnostic, map[string]Emission) {
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+	ctx = codegen.WithSessionID(ctx, "conformance")
+
+	// Cases are emitted for the same platform wherever they are run.
+	ctx = local.WithOs(ctx, "linux")
+	ctx = local.WithArch(ctx, "amd64")
+
+	absDir, err := filepath.Abs(dir)
+	require.NoError(t, err)
+	ctx, err = local.WithCwd(ctx, absDir)
+	require.NoError(t, err)
+
+	for _, setup := range r.setups {
+		ctx, err = setup(ctx)
+		require.NoError(t, err)
+	}
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Modules are named by their base name so that the positions of their
+	// diagnostics do not depend on where the corpus is.
+	mod, err := parser.Parse(ctx, &parser.NamedReader{
+		Reader: f,
+		Value:  filepath.Base(filename),
+	})
+	if err != nil {
+		return Diagnostics(PhaseParse, err), nil
+	}
+	mod.Directory = parser.NewLocalDirectory(dir, "")
+
+	err = checker.SemanticPass(mod)
+	if err != nil {
+		return Diagnostics(PhaseCheck, err), nil
+	}
+
+	// Linting rewrites deprecated syntax, so it must happen before checking.
+	diagnostics := Diagnostics(PhaseLint, linter.Lint(ctx, mod))
+
+	err = checker.Check(mod)
+	if err != nil {
+		return append(diagnostics, Diagnostics(PhaseCheck, err)...), nil
+	}
+	return diagnostics, r.emit(ctx, mod)
+}
+
+// compare compares the actual results of a case with the expectations in
+// filename, or rewrites them when updating.
+func (r *Runner) compare(t *testing.T, filename string, v interface{}, empty bool) {
+	t.Helper()
+
+	var actual string
+	if !empty {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		require.NoError(t, enc.Encode(v))
+		actual = buf.String()
+	}
+
+	if r.update {
+		if empty {
+			err := os.Remove(filename)
+			if err != nil && !os.IsNotExist(err) {
+				require.NoError(t, err)
+			}
+			return
+		}
+		require.NoError(t, ioutil.WriteFile(filename, []byte(actual), 0o644))
+		return
+	}
+
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		require.NoError(t, err)
+	}
+	require.Equal(t, string(expected), actual, "%s does not match, run with -update to rewrite it", filepath.Base(filename))
+}
+
+func updateFlag() bool {
+	f := flag.Lookup("update")
+	if f == nil {
+		return false
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	update, _ := getter.Get().(bool)
+	return update
+}
@@ -0,0 +1,8 @@
+package conformance
+
+import "testing"
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+	Run(t, "testdata")
+}
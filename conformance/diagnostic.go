@@ -0,0 +1,128 @@
+package conformance
+
+import (
+	"errors"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/linter"
+)
+
+// Phase is the phase of a case that reported a diagnostic.
+type Phase string
+
+const (
+	PhaseParse Phase = "parse"
+	PhaseCheck Phase = "check"
+	PhaseLint  Phase = "lint"
+)
+
+// Diagnostic is the structured form of a diagnostic, which is how the
+// expected diagnostics of a case are written.
+type Diagnostic struct {
+	Phase    Phase    `json:"phase"`
+	Severity string   `json:"severity"`
+	Message  string   `json:"message"`
+	Pos      Position `json:"pos"`
+	End      Position `json:"end"`
+	Spans    []Span   `json:"spans,omitempty"`
+
+	// Fix is the message of the fix suggested by a lint finding.
+	Fix string `json:"fix,omitempty"`
+}
+
+// Span is an annotated range of source of a diagnostic.
+type Span struct {
+	Type    string   `json:"type"`
+	Message string   `json:"message"`
+	Start   Position `json:"start"`
+	End     Position `json:"end"`
+}
+
+// Position is a position in a module. Positions in the builtin module only
+// have a filename, since they move whenever a builtin is added.
+type Position struct {
+	Filename string `json:"filename"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// Diagnostics returns the structured diagnostics of an error reported by a
+// phase. Errors without spans are a single diagnostic with their message.
+func Diagnostics(phase Phase, err error) []Diagnostic {
+	if err == nil {
+		return nil
+	}
+
+	var diagnostics []Diagnostic
+	for _, f := range linter.Findings(err) {
+		for _, se := range diagnostic.Spans(f) {
+			d := newDiagnostic(phase, f.Severity.String(), se)
+			if f.Fix != nil {
+				d.Fix = f.Fix.Message
+			}
+			diagnostics = append(diagnostics, d)
+		}
+	}
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+
+	for _, se := range diagnostic.Spans(err) {
+		diagnostics = append(diagnostics, newDiagnostic(phase, "error", se))
+	}
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+
+	d := Diagnostic{
+		Phase:    phase,
+		Severity: "error",
+		Message:  err.Error(),
+	}
+	var perr participle.Error
+	if errors.As(err, &perr) {
+		d.Message = perr.Message()
+		d.Pos = newPosition(perr.Position())
+		d.End = d.Pos
+	}
+	return []Diagnostic{d}
+}
+
+func newDiagnostic(phase Phase, severity string, se *diagnostic.SpanError) Diagnostic {
+	d := Diagnostic{
+		Phase:    phase,
+		Severity: severity,
+		Pos:      newPosition(se.Pos),
+		End:      newPosition(se.End),
+	}
+	if se.Err != nil {
+		d.Message = se.Err.Error()
+	}
+	for _, span := range se.Spans {
+		typ := "primary"
+		if span.Type == diagnostic.Secondary {
+			typ = "secondary"
+		}
+		d.Spans = append(d.Spans, Span{
+			Type:    typ,
+			Message: span.Message,
+			Start:   newPosition(span.Start),
+			End:     newPosition(span.End),
+		})
+	}
+	return d
+}
+
+func newPosition(pos lexer.Position) Position {
+	if pos.Filename == builtin.FileBuffer.Filename() {
+		return Position{Filename: pos.Filename}
+	}
+	return Position{
+		Filename: pos.Filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+	}
+}
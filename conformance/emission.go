@@ -0,0 +1,122 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/codegen"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// Emission is a summary of the LLB emitted by a target, which is how the
+// expected emissions of a case are written.
+type Emission struct {
+	// Digest is the digest of the target's LLB with the attributes of local
+	// sources that depend on the host removed.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Ops is the number of ops of each type in the target's LLB.
+	Ops map[string]int `json:"ops,omitempty"`
+
+	// Error is the error emitting the target, for targets that cannot be
+	// emitted without a BuildKit daemon.
+	Error string `json:"error,omitempty"`
+}
+
+// emit emits every fs function of a module without parameters.
+func (r *Runner) emit(ctx context.Context, mod *ast.Module) map[string]Emission {
+	var targets []string
+	for _, decl := range mod.Decls {
+		fd := decl.Func
+		if fd == nil || fd.Body == nil || fd.Kind() != ast.Filesystem || fd.Sig.Params.NumFields() > 0 {
+			continue
+		}
+		targets = append(targets, fd.Sig.Name.Text)
+	}
+	sort.Strings(targets)
+
+	emissions := make(map[string]Emission)
+	for _, target := range targets {
+		emission, err := r.emitTarget(ctx, mod, target)
+		if err != nil {
+			emission = Emission{Error: err.Error()}
+		}
+		emissions[target] = emission
+	}
+	return emissions
+}
+
+func (r *Runner) emitTarget(ctx context.Context, mod *ast.Module, target string) (Emission, error) {
+	cg := codegen.New(nil, r.resolver, r.cgOpts...)
+	v, err := cg.EmitTarget(ctx, mod, codegen.Target{Name: target})
+	if err != nil {
+		return Emission{}, err
+	}
+	fs, err := v.Filesystem()
+	if err != nil {
+		return Emission{}, err
+	}
+	def, err := fs.State.Marshal(ctx, llb.Platform(fs.Platform))
+	if err != nil {
+		return Emission{}, err
+	}
+	return summarize(def)
+}
+
+// summarize returns the digest and op counts of a definition. The attributes
+// of local sources that depend on the host or session are removed, and the
+// digests of the ops that depend on them are recomputed.
+func summarize(def *llb.Definition) (Emission, error) {
+	var (
+		emission = Emission{Ops: make(map[string]int)}
+		digests  = make(map[digest.Digest]digest.Digest)
+	)
+	for _, dt := range def.Def {
+		var op pb.Op
+		err := op.Unmarshal(dt)
+		if err != nil {
+			return emission, err
+		}
+
+		switch o := op.Op.(type) {
+		case *pb.Op_Source:
+			emission.Ops["source"]++
+			if strings.HasPrefix(o.Source.Identifier, "local://") {
+				delete(o.Source.Attrs, pb.AttrSharedKeyHint)
+				delete(o.Source.Attrs, pb.AttrLocalSessionID)
+				delete(o.Source.Attrs, pb.AttrLocalUniqueID)
+			}
+		case *pb.Op_Exec:
+			emission.Ops["exec"]++
+		case *pb.Op_File:
+			emission.Ops["file"]++
+		case *pb.Op_Build:
+			emission.Ops["build"]++
+		case *pb.Op_Merge:
+			emission.Ops["merge"]++
+		case *pb.Op_Diff:
+			emission.Ops["diff"]++
+		case nil:
+			// The last op of a definition only points at its result.
+		default:
+			return emission, fmt.Errorf("unknown op %T", o)
+		}
+
+		// Definitions are sorted so that the inputs of an op come before it.
+		for _, input := range op.Inputs {
+			input.Digest = digests[input.Digest]
+		}
+		ndt, err := op.Marshal()
+		if err != nil {
+			return emission, err
+		}
+		emission.Digest = digest.FromBytes(ndt)
+		digests[digest.FromBytes(dt)] = emission.Digest
+	}
+	return emission, nil
+}
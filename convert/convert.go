@@ -0,0 +1,39 @@
+// Package convert converts the build definitions of other tools into HLB
+// modules, so that projects can migrate to HLB without rewriting them by hand.
+//
+// Conversions are best effort. Constructs without an equivalent in HLB are
+// written as comments starting with "convert:" where they would have been
+// converted, and are reported as warnings with the line they came from.
+package convert
+
+import "fmt"
+
+// Warning is a construct that was not converted, or converted with a
+// difference in behavior.
+type Warning struct {
+	// Line is the line of the construct in the converted source, starting
+	// at 1.
+	Line int
+
+	// Instruction is the instruction of the construct, like "ONBUILD".
+	Instruction string
+
+	// Message describes what was not converted.
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+// Option is an option of a conversion.
+type Option func(*converter)
+
+// WithContextPath sets the path of the build context, relative to the
+// converted module. By default, the build context is the directory of the
+// module.
+func WithContextPath(path string) Option {
+	return func(c *converter) {
+		c.contextPath = path
+	}
+}
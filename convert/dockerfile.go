@@ -0,0 +1,1046 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/containerd/containerd/platforms"
+	shellquote "github.com/kballard/go-shellquote"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/parser/astbuild"
+)
+
+var (
+	// defaultShell is the shell of RUN, CMD and ENTRYPOINT in shell form,
+	// which is also the shell run wraps a single argument with.
+	defaultShell = []string{"/bin/sh", "-c"}
+
+	// automaticArgs are the build args set by BuildKit, which FROM may refer
+	// to without declaring them.
+	automaticArgs = map[string]struct{}{
+		"BUILDPLATFORM":  {},
+		"BUILDOS":        {},
+		"BUILDARCH":      {},
+		"BUILDVARIANT":   {},
+		"TARGETPLATFORM": {},
+		"TARGETOS":       {},
+		"TARGETARCH":     {},
+		"TARGETVARIANT":  {},
+	}
+
+	// targetPlatformArgs are the expressions of the automatic build args of
+	// the platform being built for, which BuildKit sets from the platform of
+	// the build.
+	targetPlatformArgs = map[string]astbuild.Expr{
+		"TARGETPLATFORM": astbuild.StrOf(
+			astbuild.Interp(astbuild.Ident("targetOs")),
+			astbuild.Text("/"),
+			astbuild.Interp(astbuild.Ident("targetArch")),
+		),
+		"TARGETOS":   astbuild.Ident("targetOs"),
+		"TARGETARCH": astbuild.Ident("targetArch"),
+	}
+
+	// reserved are the names that functions and parameters cannot have, in
+	// addition to the names of builtins.
+	reserved = map[string]struct{}{
+		"import":   {},
+		"export":   {},
+		"from":     {},
+		"with":     {},
+		"as":       {},
+		"binds":    {},
+		"variadic": {},
+		"true":     {},
+		"false":    {},
+		"string":   {},
+		"int":      {},
+		"bool":     {},
+		"fs":       {},
+		"option":   {},
+		"pipeline": {},
+	}
+
+	andRegexp = regexp.MustCompile(`\s*&&\s*`)
+)
+
+// foldWidth is the length of the longest shell command written on a single
+// line. Longer chains of commands are folded over lines, one per command.
+const foldWidth = 80
+
+// Dockerfile converts a Dockerfile into a module with a filesystem function
+// for every stage, named after its alias. Build args are parameters of the
+// stages that declare them and of the stages that depend on those. The last
+// stage is exported, or called with the defaults of its build args by an
+// exported default function.
+func Dockerfile(src []byte, opts ...Option) (*ast.Module, []Warning, error) {
+	res, err := parser.Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stages, metaArgs, err := instructions.Parse(res.AST)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stages) == 0 {
+		return nil, nil, errors.New("dockerfile has no stages")
+	}
+
+	c := &converter{
+		contextPath: ".",
+		escape:      res.EscapeToken,
+		lex:         shell.NewLex(res.EscapeToken),
+		b:           astbuild.Module(),
+		meta:        &scope{args: make(map[string]*buildArg)},
+		args:        make(map[string]*buildArg),
+		defaults:    make(map[string]string),
+		names:       make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for _, w := range res.Warnings {
+		var line int
+		if w.Location != nil {
+			line = w.Location.Start.Line
+		}
+		c.warnings = append(c.warnings, Warning{Line: line, Message: w.Short})
+	}
+
+	mod, err := c.convert(stages, metaArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(c.warnings, func(i, j int) bool {
+		return c.warnings[i].Line < c.warnings[j].Line
+	})
+	return mod, c.warnings, nil
+}
+
+type converter struct {
+	contextPath string
+	escape      rune
+	lex         *shell.Lex
+	b           *astbuild.ModuleBuilder
+
+	stages []*stage
+
+	// meta is the scope of FROM, which only has the global build args.
+	meta *scope
+
+	// args are the build args of the Dockerfile by their names, in the order
+	// they are declared.
+	args     map[string]*buildArg
+	argOrder []*buildArg
+
+	// defaults are the defaults of the global build args, to expand the
+	// defaults of build args declared after them.
+	defaults map[string]string
+
+	// names are the names declared in the module.
+	names map[string]struct{}
+
+	// interps are the expressions of placeholders.
+	interps []astbuild.Expr
+
+	// context and copyOptions are the names of the functions of the build
+	// context and of the options of COPY, declared when they are used.
+	context     string
+	copyOptions string
+
+	warnings []Warning
+
+	// pending are the comments of warnings about the next statement.
+	pending []string
+}
+
+type stage struct {
+	instructions.Stage
+	index int
+	line  int
+
+	// fn is the name of the function of the stage.
+	fn string
+
+	// base is the stage the stage is built from, if any.
+	base *stage
+
+	// deps are the stages the stage is built from or copies from.
+	deps []*stage
+
+	// args are the build args the stage declares or its FROM refers to, and
+	// params are those of the stage and of its dependencies.
+	args   []*buildArg
+	params []*buildArg
+
+	// env, shell and user are the state of the stage as it is converted,
+	// which a stage built from it starts with.
+	env   map[string]string
+	shell []string
+	user  string
+
+	scratch bool
+	cmdSet  bool
+}
+
+type buildArg struct {
+	name  string
+	line  int
+	order int
+
+	// param is the name of the parameter of the build arg, and value is its
+	// placeholder.
+	param string
+	value string
+
+	def       *string
+	automatic bool
+}
+
+func (c *converter) convert(stages []instructions.Stage, metaArgs []instructions.ArgCommand) (*ast.Module, error) {
+	for _, cmd := range metaArgs {
+		line := lineOf(cmd.Location())
+		for _, kv := range cmd.Args {
+			arg := c.arg(kv.Key, line)
+			if kv.Value != nil {
+				def := c.setDefault(arg, *kv.Value, line)
+				c.defaults[kv.Key] = def
+			}
+			c.meta.args[kv.Key] = arg
+		}
+	}
+
+	for i := range stages {
+		err := c.analyze(stages[i], i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, st := range c.stages {
+		if st.Name != "" {
+			st.fn = c.declare(identName(st.Name), "Stage")
+		}
+	}
+	last := c.stages[len(c.stages)-1]
+	for _, st := range c.stages {
+		if st.Name != "" {
+			continue
+		}
+		name := fmt.Sprintf("stage%d", st.index)
+		if st == last && len(st.params) == 0 {
+			name = "default"
+		}
+		st.fn = c.declare(name, "Stage")
+	}
+	for _, arg := range c.argOrder {
+		arg.param = c.declare(identName(arg.name), "Arg")
+		arg.value = c.placeholder(astbuild.Ident(arg.param))
+	}
+
+	entry := last.fn
+	if len(last.params) > 0 {
+		entry = c.declare("default", "Stage")
+	}
+	c.b.Export(entry)
+
+	for _, st := range c.stages {
+		c.stage(st)
+	}
+	if entry != last.fn {
+		c.entry(entry, last)
+	}
+
+	if c.context != "" {
+		f := c.b.Func(ast.Filesystem, c.context).Doc("The build context of the Dockerfile.")
+		f.Call("local", astbuild.Str(c.contextPath)).With(astbuild.Ident("useIgnoreFile"))
+	}
+	if c.copyOptions != "" {
+		f := c.b.Func(ast.Kind("option::copy"), c.copyOptions).Doc("Copies like COPY and ADD do.")
+		f.Call("followSymlinks")
+		f.Call("contentsOnly")
+		f.Call("createDestPath")
+	}
+
+	mod, err := c.b.Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build converted module: %w", err)
+	}
+	return mod, nil
+}
+
+// analyze finds the dependencies and build args of a stage, which are needed
+// to declare the parameters of the stages before any of them is converted.
+func (c *converter) analyze(s instructions.Stage, index int) error {
+	st := &stage{
+		Stage: s,
+		index: index,
+		line:  lineOf(s.Location),
+	}
+	c.stages = append(c.stages, st)
+
+	if base, ok := c.stageRef(st.BaseName, index); ok {
+		st.base = base
+		st.deps = append(st.deps, base)
+	}
+	for _, names := range refs(st.BaseName, c.escape) {
+		name := names[0]
+		arg, ok := c.meta.args[name]
+		if !ok {
+			if _, ok := automaticArgs[name]; !ok {
+				continue
+			}
+			arg = c.arg(name, st.line)
+			arg.automatic = true
+			c.meta.args[name] = arg
+		}
+		st.addArg(arg)
+	}
+
+	for _, cmd := range st.Commands {
+		var froms []string
+		switch cmd := cmd.(type) {
+		case *instructions.ArgCommand:
+			line := lineOf(cmd.Location())
+			for _, kv := range cmd.Args {
+				arg := c.arg(kv.Key, line)
+				if _, ok := automaticArgs[kv.Key]; ok {
+					arg.automatic = true
+				}
+				if kv.Value != nil {
+					c.setDefault(arg, *kv.Value, line)
+				}
+				st.addArg(arg)
+			}
+		case *instructions.CopyCommand:
+			froms = append(froms, cmd.From)
+		case *instructions.RunCommand:
+			// Flags of mounts without values are only parsed when the
+			// mounts are expanded, which is done when they are converted.
+			err := cmd.Expand(func(word string) (string, error) {
+				return word, nil
+			})
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineOf(cmd.Location()), err)
+			}
+			for _, m := range instructions.GetMounts(cmd) {
+				froms = append(froms, m.From)
+			}
+		}
+		for _, from := range froms {
+			if dep, ok := c.stageRef(from, index); ok {
+				st.deps = append(st.deps, dep)
+			}
+		}
+	}
+
+	seen := make(map[*buildArg]struct{})
+	for _, arg := range st.args {
+		seen[arg] = struct{}{}
+		st.params = append(st.params, arg)
+	}
+	for _, dep := range st.deps {
+		for _, arg := range dep.params {
+			if _, ok := seen[arg]; !ok {
+				seen[arg] = struct{}{}
+				st.params = append(st.params, arg)
+			}
+		}
+	}
+	sort.Slice(st.params, func(i, j int) bool {
+		return st.params[i].order < st.params[j].order
+	})
+	return nil
+}
+
+func (st *stage) addArg(arg *buildArg) {
+	for _, a := range st.args {
+		if a == arg {
+			return
+		}
+	}
+	st.args = append(st.args, arg)
+}
+
+// arg returns the build arg of a name, declaring it if it is not.
+func (c *converter) arg(name string, line int) *buildArg {
+	arg, ok := c.args[name]
+	if !ok {
+		arg = &buildArg{name: name, line: line, order: len(c.argOrder)}
+		c.args[name] = arg
+		c.argOrder = append(c.argOrder, arg)
+	}
+	return arg
+}
+
+// setDefault sets the default of a build arg, which is the first default it
+// is declared with.
+func (c *converter) setDefault(arg *buildArg, value string, line int) string {
+	def, err := c.lex.ProcessWordWithMap(value, c.defaults)
+	if err != nil {
+		def = value
+	}
+	switch {
+	case arg.def == nil:
+		arg.def = &def
+	case *arg.def != def:
+		c.warn(line, "ARG", "%s is declared with different defaults, %q is used", arg.name, *arg.def)
+	}
+	return def
+}
+
+// stageRef returns the stage that a FROM, COPY --from or mount refers to by
+// its name or index, which must be before the stage referring to it.
+func (c *converter) stageRef(ref string, before int) (*stage, bool) {
+	if ref == "" || strings.Contains(ref, "$") {
+		return nil, false
+	}
+	name := strings.ToLower(ref)
+	for _, st := range c.stages[:before] {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	if i, err := strconv.Atoi(ref); err == nil && i >= 0 && i < before {
+		return c.stages[i], true
+	}
+	return nil, false
+}
+
+// declare declares a name in the module, adding a suffix to it if the name is
+// taken.
+func (c *converter) declare(name, suffix string) string {
+	candidate := name
+	for i := 1; c.taken(candidate); i++ {
+		candidate = name + suffix
+		if i > 1 {
+			candidate += strconv.Itoa(i)
+		}
+	}
+	c.names[candidate] = struct{}{}
+	return candidate
+}
+
+func (c *converter) taken(name string) bool {
+	if _, ok := reserved[name]; ok {
+		return true
+	}
+	if _, ok := c.names[name]; ok {
+		return true
+	}
+	for _, lookup := range builtin.Lookup.ByKind {
+		if _, ok := lookup.Func[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// identName returns a camel case identifier for a name of the Dockerfile, like
+// goVersion for GO_VERSION.
+func identName(name string) string {
+	fields := strings.FieldsFunc(name, func(r rune) bool {
+		return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	var b strings.Builder
+	for i, field := range fields {
+		if strings.ToUpper(field) == field {
+			field = strings.ToLower(field)
+		}
+		if i == 0 {
+			field = strings.ToLower(field[:1]) + field[1:]
+		} else {
+			field = strings.ToUpper(field[:1]) + field[1:]
+		}
+		b.WriteString(field)
+	}
+	ident := b.String()
+	if ident == "" || unicode.IsDigit(rune(ident[0])) {
+		ident = "_" + ident
+	}
+	return ident
+}
+
+// stage converts a stage into a filesystem function.
+func (c *converter) stage(st *stage) {
+	doc := fmt.Sprintf("Converted from stage %d on line %d.", st.index, st.line)
+	if st.Name != "" {
+		doc = fmt.Sprintf("Converted from stage %q on line %d.", st.Name, st.line)
+	}
+	f := c.b.Func(ast.Filesystem, st.fn).Doc(doc)
+	for _, arg := range st.params {
+		f.Param(ast.String, arg.param)
+	}
+
+	sc := &scope{
+		env:  make(map[string]string),
+		args: make(map[string]*buildArg),
+	}
+	st.shell = defaultShell
+	if st.base != nil {
+		for k, v := range st.base.env {
+			sc.env[k] = v
+		}
+		st.shell = st.base.shell
+		st.user = st.base.user
+		st.scratch = st.base.scratch
+	}
+	st.env = sc.env
+
+	c.from(f.BlockBuilder, st)
+	for i, cmd := range st.Commands {
+		c.command(f.BlockBuilder, st, sc, cmd, st.Commands[i+1:])
+	}
+	c.flush(f.BlockBuilder)
+}
+
+func (c *converter) from(bb *astbuild.BlockBuilder, st *stage) {
+	switch {
+	case st.base != nil:
+		c.call(bb, st.base.fn, paramIdents(st.base)...)
+	case strings.EqualFold(st.BaseName, "scratch"):
+		st.scratch = true
+		c.call(bb, "scratch")
+	default:
+		ref := c.expand(st.line, "FROM", st.BaseName, c.meta)
+		var opts []option
+		switch {
+		case st.Platform == "":
+		case strings.Contains(st.Platform, "$"):
+			c.warn(st.line, "FROM", "--platform=%s is not converted, the image is resolved for the default platform", st.Platform)
+		default:
+			p, err := platforms.Parse(st.Platform)
+			if err != nil {
+				c.warn(st.line, "FROM", "--platform=%s is not converted: %s", st.Platform, err)
+				break
+			}
+			if p.Variant != "" {
+				c.warn(st.line, "FROM", "the variant of --platform=%s is not converted", st.Platform)
+			}
+			opts = append(opts, option{
+				name: "platform",
+				args: []astbuild.Expr{astbuild.Str(p.OS), astbuild.Str(p.Architecture)},
+			})
+		}
+		withOptions(c.call(bb, "image", c.str(ref)), opts)
+	}
+}
+
+func (c *converter) command(bb *astbuild.BlockBuilder, st *stage, sc *scope, cmd instructions.Command, rest []instructions.Command) {
+	line := lineOf(cmd.Location())
+	name := strings.ToUpper(cmd.Name())
+	switch cmd := cmd.(type) {
+	case *instructions.ArgCommand:
+		for _, kv := range cmd.Args {
+			sc.args[kv.Key] = c.args[kv.Key]
+		}
+	case *instructions.EnvCommand:
+		// Every value is expanded with the environment before the
+		// instruction.
+		values := make([]string, len(cmd.Env))
+		for i, kv := range cmd.Env {
+			values[i] = c.expand(line, name, kv.Value, sc)
+		}
+		for i, kv := range cmd.Env {
+			c.call(bb, "env", astbuild.Str(kv.Key), c.str(values[i]))
+			sc.env[kv.Key] = values[i]
+		}
+	case *instructions.LabelCommand:
+		for _, kv := range cmd.Labels {
+			key := c.expand(line, name, kv.Key, sc)
+			value := c.expand(line, name, kv.Value, sc)
+			c.call(bb, "label", c.str(key), c.str(value))
+		}
+	case *instructions.MaintainerCommand:
+		c.warn(line, name, "MAINTAINER is deprecated, it is converted to a maintainer label")
+		c.call(bb, "label", astbuild.Str("maintainer"), astbuild.Str(cmd.Maintainer))
+	case *instructions.WorkdirCommand:
+		// Like WORKDIR, the directory is created if it does not exist.
+		dir := c.expand(line, name, cmd.Path, sc)
+		opts := []option{{name: "createParents"}}
+		if st.user != "" {
+			opts = append(opts, option{name: "chown", args: []astbuild.Expr{c.str(st.user)}})
+		}
+		withOptions(c.call(bb, "mkdir", c.str(dir), astbuild.Numeric(0o755, 8)), opts)
+		c.call(bb, "dir", c.str(dir))
+	case *instructions.UserCommand:
+		st.user = c.expand(line, name, cmd.User, sc)
+		c.call(bb, "user", c.str(st.user))
+	case *instructions.ExposeCommand:
+		c.call(bb, "expose", c.strs(line, name, cmd.Ports, sc)...)
+	case *instructions.VolumeCommand:
+		c.call(bb, "volumes", c.strs(line, name, cmd.Volumes, sc)...)
+	case *instructions.StopSignalCommand:
+		c.call(bb, "stopSignal", c.str(c.expand(line, name, cmd.Signal, sc)))
+	case *instructions.ShellCommand:
+		st.shell = cmd.Shell
+	case *instructions.CmdCommand:
+		st.cmdSet = true
+		c.call(bb, "cmd", strs(st.cmdline(cmd.ShellDependantCmdLine))...)
+	case *instructions.EntrypointCommand:
+		c.call(bb, "entrypoint", strs(st.cmdline(cmd.ShellDependantCmdLine))...)
+		if !st.cmdSet && !st.scratch && !hasCmd(rest) {
+			bb.Comment("ENTRYPOINT resets the command of the base image.")
+			bb.Call("cmd")
+		}
+	case *instructions.HealthCheckCommand:
+		c.healthcheck(bb, cmd)
+	case *instructions.RunCommand:
+		c.run(bb, st, sc, line, cmd)
+	case *instructions.CopyCommand:
+		c.copy(bb, st, sc, line, name, cmd.String(), cmd.SourcesAndDest, cmd.From, cmd.Chown, cmd.Chmod)
+	case *instructions.AddCommand:
+		c.copy(bb, st, sc, line, name, cmd.String(), cmd.SourcesAndDest, "", cmd.Chown, cmd.Chmod)
+	case *instructions.OnbuildCommand:
+		c.unsupported(bb, line, name, cmd.String(), "ONBUILD is not supported, as modules are not built from")
+	default:
+		code := name
+		if s, ok := cmd.(fmt.Stringer); ok {
+			code = s.String()
+		}
+		c.unsupported(bb, line, name, code, "%s is not supported", name)
+	}
+}
+
+func hasCmd(cmds []instructions.Command) bool {
+	for _, cmd := range cmds {
+		if _, ok := cmd.(*instructions.CmdCommand); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdline returns the arguments of a command line, prefixed with the shell of
+// the stage in shell form.
+func (st *stage) cmdline(cl instructions.ShellDependantCmdLine) []string {
+	if !cl.PrependShell {
+		return cl.CmdLine
+	}
+	args := append([]string{}, st.shell...)
+	return append(args, strings.Join(cl.CmdLine, " "))
+}
+
+func (c *converter) run(bb *astbuild.BlockBuilder, st *stage, sc *scope, line int, cmd *instructions.RunCommand) {
+	if len(cmd.Files) > 0 {
+		c.unsupported(bb, line, "RUN", cmd.String(), "heredocs of RUN are not supported")
+		return
+	}
+
+	// Like RUN, the build args of the stage are set in the environment of the
+	// command, unless ENV sets them.
+	var opts []option
+	for _, arg := range c.argOrder {
+		if _, ok := sc.args[arg.name]; !ok {
+			continue
+		}
+		if _, ok := sc.env[arg.name]; ok {
+			continue
+		}
+		opts = append(opts, option{
+			name: "env",
+			args: []astbuild.Expr{astbuild.Str(arg.name), astbuild.Ident(arg.param)},
+		})
+	}
+	opts = append(opts, c.mounts(st, sc, line, cmd)...)
+	switch network := instructions.GetNetwork(cmd); network {
+	case "none", "host":
+		opts = append(opts, option{name: "network", args: []astbuild.Expr{astbuild.Str(network)}})
+	}
+
+	var (
+		args []astbuild.Expr
+		text = strings.Join(cmd.CmdLine, " ")
+	)
+	switch {
+	case !cmd.PrependShell && len(cmd.CmdLine) == 1:
+		// A single argument is run with a shell, unless it is split.
+		args = []astbuild.Expr{astbuild.Str(shellquote.Join(cmd.CmdLine[0]))}
+		opts = append(opts, option{name: "shlex"})
+	case !cmd.PrependShell:
+		args = strs(cmd.CmdLine)
+	case equal(st.shell, defaultShell):
+		args = []astbuild.Expr{script(text)}
+	default:
+		args = append(strs(st.shell), astbuild.Str(text))
+	}
+	withOptions(c.call(bb, "run", args...), opts)
+}
+
+// script returns the script of a shell, with long chains of commands folded
+// over lines.
+func script(text string) astbuild.Expr {
+	cmds := andRegexp.Split(strings.TrimSpace(text), -1)
+	if len(text) <= foldWidth || len(cmds) < 2 || strings.Contains(text, `\`) {
+		return astbuild.Str(text)
+	}
+	for _, cmd := range cmds {
+		if cmd == "" {
+			return astbuild.Str(text)
+		}
+	}
+	// Folded lines are trimmed, so they are indented like a block.
+	return astbuild.Heredoc(astbuild.HeredocFold, astbuild.Text("\t\t"+strings.Join(cmds, " &&\n\t\t")))
+}
+
+func (c *converter) mounts(st *stage, sc *scope, line int, cmd *instructions.RunCommand) []option {
+	var opts []option
+	for _, m := range instructions.GetMounts(cmd) {
+		target := c.expand(line, "RUN", m.Target, sc)
+		switch m.Type {
+		case instructions.MountTypeCache:
+			id := target
+			if m.CacheID != "" {
+				id = c.expand(line, "RUN", m.CacheID, sc)
+			}
+			sharing := m.CacheSharing
+			if sharing == "" {
+				sharing = instructions.MountSharingShared
+			}
+			if m.From != "" || m.Source != "" {
+				c.warn(line, "RUN", "the source of the cache mounted at %s is not converted", m.Target)
+			}
+			if m.UID != nil || m.GID != nil || m.Mode != nil {
+				c.warn(line, "RUN", "the owner and mode of the cache mounted at %s are not converted", m.Target)
+			}
+			opts = append(opts, option{
+				name: "mount",
+				args: []astbuild.Expr{astbuild.Ident("scratch"), c.str(target)},
+				opts: []option{{
+					name: "cache",
+					args: []astbuild.Expr{c.str(id), astbuild.Str(sharing)},
+				}},
+			})
+		case instructions.MountTypeTmpfs:
+			opts = append(opts, option{
+				name: "mount",
+				args: []astbuild.Expr{astbuild.Ident("scratch"), c.str(target)},
+				opts: []option{{name: "tmpfs"}},
+			})
+		case instructions.MountTypeBind:
+			var mopts []option
+			if src := path.Clean(m.Source); src != "/" && src != "." {
+				mopts = append(mopts, option{
+					name: "sourcePath",
+					args: []astbuild.Expr{c.str(c.expand(line, "RUN", m.Source, sc))},
+				})
+			}
+			if m.ReadOnly {
+				mopts = append(mopts, option{name: "readonly"})
+			}
+			opts = append(opts, option{
+				name: "mount",
+				args: []astbuild.Expr{c.input(st, sc, line, m.From).expr(), c.str(target)},
+				opts: mopts,
+			})
+		case instructions.MountTypeSecret:
+			id := m.CacheID
+			if id == "" {
+				id = path.Base(m.Target)
+			}
+			if target == "" {
+				target = path.Join("/run/secrets", id)
+			}
+			c.warn(line, "RUN", "the secret %s is read from the file %s relative to the module, change it to where the secret is", id, id)
+			opts = append(opts, option{
+				name: "secret",
+				args: []astbuild.Expr{astbuild.Str(id), c.str(target)},
+			})
+		case instructions.MountTypeSSH:
+			if m.CacheID != "" && m.CacheID != "default" {
+				c.warn(line, "RUN", "the ssh agent %s is not converted, the default agent is forwarded", m.CacheID)
+			}
+			var sopts []option
+			if target != "" {
+				sopts = append(sopts, option{name: "target", args: []astbuild.Expr{c.str(target)}})
+			}
+			opts = append(opts, option{name: "ssh", opts: sopts})
+		}
+	}
+	return opts
+}
+
+func (c *converter) healthcheck(bb *astbuild.BlockBuilder, cmd *instructions.HealthCheckCommand) {
+	h := cmd.Health
+	var opts []option
+	for _, d := range []struct {
+		name  string
+		value fmt.Stringer
+		set   bool
+	}{
+		{"interval", h.Interval, h.Interval != 0},
+		{"timeout", h.Timeout, h.Timeout != 0},
+		{"startPeriod", h.StartPeriod, h.StartPeriod != 0},
+	} {
+		if d.set {
+			opts = append(opts, option{name: d.name, args: []astbuild.Expr{astbuild.Str(d.value.String())}})
+		}
+	}
+	if h.Retries != 0 {
+		opts = append(opts, option{name: "retries", args: []astbuild.Expr{astbuild.Int(h.Retries)}})
+	}
+	withOptions(c.call(bb, "imageConfig"), []option{{
+		name: "healthcheck",
+		args: strs(h.Test),
+		opts: opts,
+	}})
+}
+
+// copy converts a COPY or an ADD into a copy for every source.
+func (c *converter) copy(bb *astbuild.BlockBuilder, st *stage, sc *scope, line int, name, code string, sd instructions.SourcesAndDest, from, chown, chmod string) {
+	if len(sd.SourceContents) > 0 {
+		c.unsupported(bb, line, name, code, "heredocs of %s are not supported", name)
+		return
+	}
+
+	var opts []option
+	if chown != "" {
+		opts = append(opts, option{name: "chown", args: []astbuild.Expr{c.str(c.expand(line, name, chown, sc))}})
+	}
+	if chmod != "" {
+		mode, err := strconv.ParseUint(chmod, 8, 32)
+		if err != nil {
+			c.warn(line, name, "--chmod=%s is not converted, it is not an octal mode", chmod)
+		} else {
+			opts = append(opts, option{name: "chmod", args: []astbuild.Expr{astbuild.Numeric(int64(mode), 8)}})
+		}
+	}
+
+	dest := c.str(c.expand(line, name, sd.DestPath, sc))
+	for _, src := range sd.SourcePaths {
+		src = c.expand(line, name, src, sc)
+		copyOpts := append([]option{{name: c.copyOpts()}}, opts...)
+		if name == "ADD" {
+			switch {
+			case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+				c.addURL(bb, line, src, dest, copyOpts)
+				continue
+			case strings.HasPrefix(src, "git@") || strings.HasSuffix(src, ".git"):
+				c.unsupported(bb, line, name, code, "git sources of ADD are not supported")
+				continue
+			}
+			// ADD unpacks local archives.
+			copyOpts = append(copyOpts, option{name: "unpack"})
+		}
+		if strings.ContainsAny(src, "*?[") {
+			copyOpts = append(copyOpts, option{name: "allowWildcard"}, option{name: "allowEmptyWildcard"})
+		}
+
+		var cb *astbuild.CallBuilder
+		input := c.input(st, sc, line, from)
+		if input.isStage() {
+			c.flush(bb)
+			cb = bb.CopyFrom(input.fn, c.str(src), dest)
+		} else {
+			cb = c.call(bb, "copy", input.expr(), c.str(src), dest)
+		}
+		withOptions(cb, copyOpts)
+	}
+}
+
+// addURL converts the download of a file by ADD, which is named after the path
+// of its url.
+func (c *converter) addURL(bb *astbuild.BlockBuilder, line int, src string, dest astbuild.Expr, opts []option) {
+	filename := "index"
+	if u, err := url.Parse(src); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		filename = path.Base(u.Path)
+	} else {
+		c.warn(line, "ADD", "the name of the file downloaded from %s is not known, it is named %s", src, filename)
+	}
+	http := astbuild.FuncLit(ast.Filesystem)
+	http.Call("http", c.str(src)).With(astbuild.Call("filename", c.str(filename)))
+	withOptions(c.call(bb, "copy", http, c.str(filename), dest), opts)
+}
+
+// input is the filesystem a COPY or a mount refers to, either a function of
+// the module with arguments or an expression.
+type input struct {
+	fn   string
+	args []astbuild.Expr
+	e    astbuild.Expr
+}
+
+// isStage returns whether the input can be copied from as a stage.
+func (in input) isStage() bool {
+	return in.e == nil && len(in.args) == 0
+}
+
+func (in input) expr() astbuild.Expr {
+	switch {
+	case in.e != nil:
+		return in.e
+	case len(in.args) == 0:
+		return astbuild.Ident(in.fn)
+	default:
+		return astbuild.Call(in.fn, in.args...)
+	}
+}
+
+// input returns the filesystem that a COPY or a mount refers to with --from,
+// which is the build context by default.
+func (c *converter) input(st *stage, sc *scope, line int, from string) input {
+	if from == "" {
+		if c.context == "" {
+			c.context = c.declare("context", "Dir")
+		}
+		return input{e: astbuild.Ident(c.context)}
+	}
+	if dep, ok := c.stageRef(from, st.index); ok {
+		return input{fn: dep.fn, args: paramIdents(dep)}
+	}
+	ref := c.expand(line, "COPY", from, sc)
+	return input{e: astbuild.Call("image", c.str(ref))}
+}
+
+// copyOpts returns the name of the option function with the options COPY and
+// ADD always copy with.
+func (c *converter) copyOpts() string {
+	if c.copyOptions == "" {
+		c.copyOptions = c.declare("dockerCopy", "Options")
+	}
+	return c.copyOptions
+}
+
+// entry converts the entrypoint of the module, which builds the last stage
+// with the defaults of its build args, and the target platform for the build
+// args BuildKit sets from it.
+func (c *converter) entry(name string, last *stage) {
+	f := c.b.Func(ast.Filesystem, name).Doc(fmt.Sprintf("Builds %s with the defaults of its build args.", last.fn))
+	var args []astbuild.Expr
+	for _, arg := range last.params {
+		var def string
+		switch {
+		case arg.automatic && arg.def == nil:
+			if e, ok := targetPlatformArgs[arg.name]; ok {
+				args = append(args, e)
+				continue
+			}
+			c.warn(arg.line, "ARG", "%s is set by BuildKit, an empty string is passed to %s", arg.name, last.fn)
+		case arg.def == nil:
+			c.warn(arg.line, "ARG", "%s has no default, an empty string is passed to %s", arg.name, last.fn)
+		default:
+			def = *arg.def
+		}
+		args = append(args, astbuild.Str(def))
+	}
+	c.call(f.BlockBuilder, last.fn, args...)
+}
+
+// option is an option of a call, which may have options of its own.
+type option struct {
+	name string
+	args []astbuild.Expr
+	opts []option
+}
+
+// withOptions adds options to a call, as a single option if it is one without
+// options of its own, like `with readonly`, or as an option block.
+func withOptions(cb *astbuild.CallBuilder, opts []option) {
+	switch {
+	case len(opts) == 0:
+	case len(opts) == 1 && len(opts[0].opts) == 0:
+		o := opts[0]
+		if len(o.args) == 0 {
+			cb.With(astbuild.Ident(o.name))
+		} else {
+			cb.With(astbuild.Call(o.name, o.args...))
+		}
+	default:
+		block := astbuild.Option()
+		for _, o := range opts {
+			withOptions(block.Call(o.name, o.args...), o.opts)
+		}
+		cb.With(block)
+	}
+}
+
+// call adds a call after the comments of pending warnings.
+func (c *converter) call(bb *astbuild.BlockBuilder, name string, args ...astbuild.Expr) *astbuild.CallBuilder {
+	c.flush(bb)
+	return bb.Call(name, args...)
+}
+
+// warn adds a warning, which is written as a comment before the next
+// statement.
+func (c *converter) warn(line int, instruction, format string, a ...interface{}) {
+	w := Warning{
+		Line:        line,
+		Instruction: instruction,
+		Message:     fmt.Sprintf(format, a...),
+	}
+	c.warnings = append(c.warnings, w)
+	c.pending = append(c.pending, "convert: "+w.String())
+}
+
+// unsupported adds a warning about an instruction that is not converted, which
+// is written as a comment with its code.
+func (c *converter) unsupported(bb *astbuild.BlockBuilder, line int, instruction, code, format string, a ...interface{}) {
+	c.warn(line, instruction, format, a...)
+	c.pending = append(c.pending, code)
+	c.flush(bb)
+}
+
+func (c *converter) flush(bb *astbuild.BlockBuilder) {
+	bb.Comment(c.pending...)
+	c.pending = nil
+}
+
+// strs returns string literals of expanded words.
+func (c *converter) strs(line int, instruction string, words []string, sc *scope) []astbuild.Expr {
+	var exprs []astbuild.Expr
+	for _, word := range words {
+		exprs = append(exprs, c.str(c.expand(line, instruction, word, sc)))
+	}
+	return exprs
+}
+
+// strs returns string literals of words that are not expanded.
+func strs(words []string) []astbuild.Expr {
+	exprs := make([]astbuild.Expr, len(words))
+	for i, word := range words {
+		exprs[i] = astbuild.Str(word)
+	}
+	return exprs
+}
+
+// paramIdents returns the arguments of a call to a stage, which are the
+// parameters of its caller of the same names.
+func paramIdents(st *stage) []astbuild.Expr {
+	args := make([]astbuild.Expr, len(st.params))
+	for i, arg := range st.params {
+		args[i] = astbuild.Ident(arg.param)
+	}
+	return args
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func lineOf(ranges []parser.Range) int {
+	if len(ranges) == 0 {
+		return 0
+	}
+	return ranges[0].Start.Line
+}
@@ -0,0 +1,156 @@
+package convert
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files of converted modules")
+
+// roundTrip renders a converted module, and checks that parsing the source
+// gives a module that passes the checker and renders the same source.
+func roundTrip(t *testing.T, mod *ast.Module) string {
+	src := mod.String()
+	parsed, err := parser.Parse(context.Background(), strings.NewReader(src))
+	require.NoError(t, err, src)
+	require.Equal(t, src, parsed.String())
+	require.NoError(t, checker.SemanticPass(parsed))
+	require.NoError(t, checker.Check(parsed))
+	return src
+}
+
+func TestDockerfile(t *testing.T) {
+	t.Parallel()
+
+	matches, err := filepath.Glob(filepath.Join("testdata", "*.Dockerfile"))
+	require.NoError(t, err)
+	require.NotEmpty(t, matches)
+
+	for _, match := range matches {
+		match := match
+		name := strings.TrimSuffix(filepath.Base(match), ".Dockerfile")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dt, err := os.ReadFile(match)
+			require.NoError(t, err)
+
+			mod, warnings, err := Dockerfile(dt)
+			require.NoError(t, err)
+			src := roundTrip(t, mod)
+
+			// Every warning is written where it applies.
+			for _, w := range warnings {
+				require.Contains(t, src, "# convert: "+w.String())
+			}
+
+			golden := filepath.Join("testdata", name+".hlb")
+			if *update {
+				err = os.WriteFile(golden, []byte(src), 0o644)
+				require.NoError(t, err)
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			require.Equal(t, string(expected), src)
+		})
+	}
+}
+
+func TestDockerfileWarnings(t *testing.T) {
+	t.Parallel()
+
+	dt, err := os.ReadFile(filepath.Join("testdata", "legacy.Dockerfile"))
+	require.NoError(t, err)
+
+	_, warnings, err := Dockerfile(dt)
+	require.NoError(t, err)
+	require.Equal(t, []Warning{{
+		Line:        2,
+		Instruction: "MAINTAINER",
+		Message:     "MAINTAINER is deprecated, it is converted to a maintainer label",
+	}, {
+		Line:        5,
+		Instruction: "ARG",
+		Message:     "APP_VERSION has no default, an empty string is passed to stage0",
+	}, {
+		Line:        6,
+		Instruction: "LABEL",
+		Message:     "${APP_VERSION:-...} is converted as if APP_VERSION is set and not empty",
+	}, {
+		Line:        14,
+		Instruction: "WORKDIR",
+		Message:     "$APP_HOME is not defined, it is expanded to an empty string",
+	}, {
+		Line:        16,
+		Instruction: "ONBUILD",
+		Message:     "ONBUILD is not supported, as modules are not built from",
+	}, {
+		Line:        17,
+		Instruction: "RUN",
+		Message:     "the secret netrc is read from the file netrc relative to the module, change it to where the secret is",
+	}}, warnings)
+}
+
+func TestDockerfileOptions(t *testing.T) {
+	t.Parallel()
+
+	mod, _, err := Dockerfile([]byte("FROM scratch\nCOPY . /\n"), WithContextPath("../app"))
+	require.NoError(t, err)
+	require.Contains(t, roundTrip(t, mod), `local "../app" with useIgnoreFile`)
+}
+
+func TestDockerfileTargetPlatform(t *testing.T) {
+	t.Parallel()
+
+	mod, warnings, err := Dockerfile([]byte("FROM alpine\nARG TARGETPLATFORM\nARG TARGETVARIANT\nRUN echo $TARGETPLATFORM$TARGETVARIANT\n"))
+	require.NoError(t, err)
+
+	// The args of the platform being built for are passed from the target
+	// platform, except its variant, which HLB doesn't have.
+	require.Contains(t, roundTrip(t, mod), `stage0 "${targetOs}/${targetArch}" ""`)
+	require.Equal(t, []Warning{{
+		Line:        3,
+		Instruction: "ARG",
+		Message:     "TARGETVARIANT is set by BuildKit, an empty string is passed to stage0",
+	}}, warnings)
+}
+
+func TestDockerfileErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, dt := range []string{
+		"",
+		"RUN make\n",
+		"FROM alpine\nRUN --mount=type=unknown make\n",
+	} {
+		_, _, err := Dockerfile([]byte(dt))
+		require.Error(t, err, dt)
+	}
+}
+
+func TestIdentName(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]string{
+		"GO_VERSION":    "goVersion",
+		"build-env":     "buildEnv",
+		"myStage":       "myStage",
+		"http_proxy":    "httpProxy",
+		"1st":           "_1st",
+		"node.js":       "nodeJs",
+		"TARGETARCH":    "targetarch",
+		"__":            "_",
+		"Build_Release": "buildRelease",
+	} {
+		require.Equal(t, expected, identName(name), name)
+	}
+}
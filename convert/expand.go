@@ -0,0 +1,130 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/openllb/hlb/parser/astbuild"
+)
+
+// Words of a Dockerfile are expanded by the shell lexer of its frontend,
+// which only knows values as text. Build args are only known when the module
+// is built, so they are expanded to placeholders that are interpolated after
+// the lexer is done. Placeholders are private use characters, which do not
+// appear in Dockerfiles, around an index of the interpolated expressions.
+const (
+	placeholderStart = '\uE000'
+	placeholderEnd   = '\uE001'
+)
+
+var (
+	placeholderRegexp = regexp.MustCompile("\uE000([0-9]+)\uE001")
+
+	// varRegexp matches the variables referenced by a word, and the modifier
+	// of braced variables, like the ":-" of ${name:-default}.
+	varRegexp = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)(:?[-+?])?|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// scope is what the variables of an instruction refer to.
+type scope struct {
+	// env are the values of the environment variables set with ENV, which
+	// may contain placeholders.
+	env map[string]string
+
+	// args are the build args declared before the instruction.
+	args map[string]*buildArg
+}
+
+// placeholder returns a placeholder for an expression.
+func (c *converter) placeholder(e astbuild.Expr) string {
+	c.interps = append(c.interps, e)
+	return fmt.Sprintf("%c%d%c", placeholderStart, len(c.interps)-1, placeholderEnd)
+}
+
+// expand expands the variables of a word like the frontend does, and removes
+// its quotes. Variables that are not defined are expanded to empty strings,
+// and warned about unless the word gives them a default.
+func (c *converter) expand(line int, instruction, word string, sc *scope) string {
+	vars := make(map[string]string, len(sc.args)+len(sc.env))
+	for name, arg := range sc.args {
+		vars[name] = arg.value
+	}
+	// Environment variables take precedence over build args.
+	for name, value := range sc.env {
+		vars[name] = value
+	}
+
+	for _, names := range refs(word, c.escape) {
+		name, modifier := names[0], names[1]
+		value, ok := vars[name]
+		switch {
+		case !ok && modifier == "":
+			c.warn(line, instruction, "$%s is not defined, it is expanded to an empty string", name)
+		case modifier != "" && strings.ContainsRune(value, placeholderStart):
+			c.warn(line, instruction, "${%s%s...} is converted as if %s is set and not empty", name, modifier, name)
+		}
+	}
+
+	expanded, err := c.lex.ProcessWordWithMap(word, vars)
+	if err != nil {
+		c.warn(line, instruction, "%s, it is not expanded", err)
+		return word
+	}
+	return expanded
+}
+
+// refs returns the names of the variables referenced by a word with their
+// modifiers, skipping escaped dollar signs.
+func refs(word string, escape rune) [][2]string {
+	var names [][2]string
+	for _, m := range varRegexp.FindAllStringSubmatchIndex(word, -1) {
+		if m[0] > 0 && rune(word[m[0]-1]) == escape {
+			continue
+		}
+		switch {
+		case m[2] >= 0:
+			var modifier string
+			if m[4] >= 0 {
+				modifier = word[m[4]:m[5]]
+			}
+			names = append(names, [2]string{word[m[2]:m[3]], modifier})
+		default:
+			names = append(names, [2]string{word[m[6]:m[7]], ""})
+		}
+	}
+	return names
+}
+
+// pieces returns the pieces of an expanded word, with its placeholders
+// replaced by the expressions they stand for.
+func (c *converter) pieces(s string) []astbuild.Piece {
+	var pieces []astbuild.Piece
+	for {
+		m := placeholderRegexp.FindStringSubmatchIndex(s)
+		if m == nil {
+			break
+		}
+		if m[0] > 0 {
+			pieces = append(pieces, astbuild.Text(s[:m[0]]))
+		}
+		i, _ := strconv.Atoi(s[m[2]:m[3]])
+		pieces = append(pieces, astbuild.Interp(c.interps[i]))
+		s = s[m[1]:]
+	}
+	if s != "" || len(pieces) == 0 {
+		pieces = append(pieces, astbuild.Text(s))
+	}
+	return pieces
+}
+
+// str returns a string literal of an expanded word.
+func (c *converter) str(s string) astbuild.Expr {
+	return astbuild.StrOf(c.pieces(s)...)
+}
+
+// isText returns whether an expanded word is only text.
+func isText(s string) bool {
+	return !strings.ContainsRune(s, placeholderStart)
+}
@@ -0,0 +1,362 @@
+package errdefs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/moby/buildkit/util/grpcerrors"
+	"google.golang.org/grpc/codes"
+)
+
+// Category classifies a failure by its cause, so that embedders can decide
+// whether to retry a build, report the failure to the user or to an operator.
+type Category int
+
+const (
+	// Uncategorized is the category of failures that are not classified.
+	Uncategorized Category = iota
+
+	// SyntaxError is the category of modules that failed to parse.
+	SyntaxError
+
+	// CheckError is the category of modules that failed the checker.
+	CheckError
+
+	// UndefinedTarget is the category of targets that are not defined by
+	// the module being built.
+	UndefinedTarget
+
+	// SourceFetchError is the category of sources, like images, git
+	// repositories and http resources, that failed to be fetched.
+	SourceFetchError
+
+	// ExecError is the category of commands that failed, like a run that
+	// exited with a non-zero exit code.
+	ExecError
+
+	// ExportError is the category of results that were built but failed to
+	// be exported, like an image that failed to be pushed.
+	ExportError
+
+	// DaemonUnavailable is the category of builds that lost or never had
+	// their connection to BuildKit.
+	DaemonUnavailable
+
+	// Cancelled is the category of builds that were cancelled.
+	Cancelled
+)
+
+func (c Category) String() string {
+	switch c {
+	case SyntaxError:
+		return "syntax"
+	case CheckError:
+		return "check"
+	case UndefinedTarget:
+		return "undefined-target"
+	case SourceFetchError:
+		return "source-fetch"
+	case ExecError:
+		return "exec"
+	case ExportError:
+		return "export"
+	case DaemonUnavailable:
+		return "daemon-unavailable"
+	case Cancelled:
+		return "cancelled"
+	default:
+		return "uncategorized"
+	}
+}
+
+// categorized is implemented by the errors of a category.
+type categorized interface {
+	error
+	Category() Category
+}
+
+// Classify returns the category of an error. Errors are categorized where
+// they are detected, and the category of the outermost categorized error is
+// returned. Errors that were not categorized, like the errors of a solve that
+// lost its connection to BuildKit, are classified by their cause.
+func Classify(err error) Category {
+	if err == nil {
+		return Uncategorized
+	}
+
+	var ce categorized
+	if errors.As(err, &ce) {
+		return ce.Category()
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled), grpcerrors.Code(err) == codes.Canceled:
+		return Cancelled
+	case grpcerrors.Code(err) == codes.Unavailable:
+		return DaemonUnavailable
+	}
+	return Uncategorized
+}
+
+// isCategorized returns whether err already has a category, which is kept so
+// that errors are categorized where they are first detected. A source that
+// failed to be fetched because the build was cancelled is still cancelled.
+func isCategorized(err error) bool {
+	return Classify(err) != Uncategorized
+}
+
+// ErrSyntax is an error of a module that failed to parse.
+type ErrSyntax struct {
+	Err error
+}
+
+func (e *ErrSyntax) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrSyntax) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrSyntax) Category() Category {
+	return SyntaxError
+}
+
+func WithSyntaxError(err error) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrSyntax{Err: err}
+}
+
+// ErrCheck is an error of a module that failed the checker.
+type ErrCheck struct {
+	Err error
+}
+
+func (e *ErrCheck) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrCheck) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrCheck) Category() Category {
+	return CheckError
+}
+
+func WithCheckError(err error) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrCheck{Err: err}
+}
+
+// ErrUndefinedTarget is an error of a target that is not defined.
+type ErrUndefinedTarget struct {
+	Target string
+	Err    error
+}
+
+func (e *ErrUndefinedTarget) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrUndefinedTarget) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrUndefinedTarget) Category() Category {
+	return UndefinedTarget
+}
+
+func WithUndefinedTarget(err error, target string) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrUndefinedTarget{Target: target, Err: err}
+}
+
+// ErrSourceFetch is an error of a source that failed to be fetched.
+type ErrSourceFetch struct {
+	Err       error
+	transient bool
+}
+
+func (e *ErrSourceFetch) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrSourceFetch) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrSourceFetch) Category() Category {
+	return SourceFetchError
+}
+
+// Transient returns whether the source may be fetched if it is tried again,
+// like after a timeout or a server error, as opposed to a source that does
+// not exist or is not authorized.
+func (e *ErrSourceFetch) Transient() bool {
+	return e.transient
+}
+
+func WithSourceFetchError(err error) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrSourceFetch{Err: err, transient: IsTransient(err)}
+}
+
+// ErrExec is an error of a command that failed.
+type ErrExec struct {
+	// ExitCode is the exit code of the command, or -1 if it did not exit,
+	// like when it failed to start.
+	ExitCode int
+
+	// Pos is the position of the statement that ran the command, if it is
+	// known.
+	Pos lexer.Position
+
+	Err error
+}
+
+func (e *ErrExec) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrExec) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrExec) Category() Category {
+	return ExecError
+}
+
+func WithExecError(err error, exitCode int, pos lexer.Position) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrExec{ExitCode: exitCode, Pos: pos, Err: err}
+}
+
+// ErrExport is an error of a result that failed to be exported.
+type ErrExport struct {
+	Err error
+}
+
+func (e *ErrExport) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrExport) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrExport) Category() Category {
+	return ExportError
+}
+
+func WithExportError(err error) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrExport{Err: err}
+}
+
+// ErrDaemonUnavailable is an error of a build that could not reach BuildKit.
+type ErrDaemonUnavailable struct {
+	Err error
+}
+
+func (e *ErrDaemonUnavailable) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrDaemonUnavailable) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrDaemonUnavailable) Category() Category {
+	return DaemonUnavailable
+}
+
+func WithDaemonUnavailable(err error) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrDaemonUnavailable{Err: err}
+}
+
+// ErrCancelled is an error of a build that was cancelled.
+type ErrCancelled struct {
+	Err error
+}
+
+func (e *ErrCancelled) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrCancelled) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrCancelled) Category() Category {
+	return Cancelled
+}
+
+func WithCancelled(err error) error {
+	if err == nil || isCategorized(err) {
+		return err
+	}
+	return &ErrCancelled{Err: err}
+}
+
+// transientMessages are parts of the messages of failures that may succeed
+// if they are tried again. Errors from BuildKit only keep their messages, so
+// they cannot be told apart otherwise.
+var transientMessages = []string{
+	"timeout",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"temporary failure",
+	"too many requests",
+	"toomanyrequests",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+}
+
+// IsTransient returns whether err is a failure that may succeed if it is
+// tried again, like a timeout or an error of a server.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	switch grpcerrors.Code(err) {
+	case codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/openllb/hlb/diagnostic"
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/pkg/errors"
@@ -79,6 +81,13 @@ func WithWrongType(expr ast.Node, expected []ast.Kind, actual ast.Kind, opts ...
 	)
 }
 
+func WithEmptyInterpolation(interp ast.Node) error {
+	return interp.WithError(
+		fmt.Errorf("interpolation has no expression"),
+		interp.Spanf(diagnostic.Primary, "expected an expression between ${ and }"),
+	)
+}
+
 func WithCallImport(ident ast.Node, decl ast.Node) error {
 	return ident.WithError(
 		fmt.Errorf("cannot call an imported module"),
@@ -94,6 +103,17 @@ func WithImportPathNotExist(err error, expr ast.Node, filename string) error {
 	)
 }
 
+func WithImportTimeout(expr ast.Node, timeout time.Duration, status string) error {
+	span := fmt.Sprintf("import did not resolve within %s", timeout)
+	if status != "" {
+		span = fmt.Sprintf("%s\nlast reported: %s", span, status)
+	}
+	return expr.WithError(
+		fmt.Errorf("timed out after %s resolving import", timeout),
+		expr.Spanf(diagnostic.Primary, "%s", span),
+	)
+}
+
 func WithUndefinedIdent(ident ast.Node, suggested *ast.Object, opts ...diagnostic.Option) error {
 	opts = append(opts, ident.Spanf(diagnostic.Primary, "undefined or not in scope"))
 	if suggested != nil {
@@ -190,6 +210,45 @@ func WithUndefinedBindTarget(callee, target ast.Node) error {
 	)
 }
 
+func WithBindUsedBeforeBound(ident, target ast.Node) error {
+	return ident.WithError(
+		fmt.Errorf("`%s` is used before it is bound", ident),
+		target.Spanf(diagnostic.Secondary, "bound here, so it is only visible to the statements after this one"),
+		ident.Spanf(diagnostic.Primary, "used before it is bound"),
+	)
+}
+
+func WithBindOutOfScope(ident, target, closure ast.Node) error {
+	return ident.WithError(
+		fmt.Errorf("`%s` is bound in `%s` and is not visible here", ident, closure),
+		target.Spanf(diagnostic.Secondary, "bound here, so it is only visible to the statements of `%s` after this one", closure),
+		ident.Spanf(diagnostic.Primary, "used outside of `%s`", closure),
+	)
+}
+
+func WithBindOutOfBlock(ident, target ast.Node) error {
+	return ident.WithError(
+		fmt.Errorf("`%s` is bound in a nested block and is not visible here", ident),
+		target.Spanf(diagnostic.Secondary, "bound here, so it is only visible to the statements of its block after this one"),
+		ident.Spanf(diagnostic.Primary, "used outside of the block it is bound in"),
+	)
+}
+
+func WithBindShadowsParam(mod *ast.Module, target, param ast.Node) error {
+	return target.WithError(
+		&ErrModule{mod, fmt.Errorf("binding `%s` shadows a parameter", target)},
+		param.Spanf(diagnostic.Secondary, "parameter declared here"),
+		target.Spanf(diagnostic.Primary, "`%s` refers to the parameter within this function", target),
+	)
+}
+
+func WithUnusedBinding(mod *ast.Module, target ast.Node) error {
+	return target.WithError(
+		&ErrModule{mod, fmt.Errorf("binding `%s` is never used", target)},
+		target.Spanf(diagnostic.Primary, "reference, export or remove this binding"),
+	)
+}
+
 func WithInvalidImageRef(err error, arg ast.Node, ref string) error {
 	return arg.WithError(
 		errors.Wrapf(err, "failed to parse `%s`", ref),
@@ -197,6 +256,20 @@ func WithInvalidImageRef(err error, arg ast.Node, ref string) error {
 	)
 }
 
+func WithInvalidPlatform(err error, arg ast.Node, platform string) error {
+	return arg.WithError(
+		errors.Wrapf(err, "failed to parse platform `%s`", platform),
+		arg.Spanf(diagnostic.Primary, "failed to parse platform `%s`\n%s", platform, err),
+	)
+}
+
+func WithUnmappedPlatform(decl ast.Node, platform string, mapped []string) error {
+	return decl.WithError(
+		fmt.Errorf("no filesystem selected for platform `%s`", platform),
+		decl.Spanf(diagnostic.Primary, "only selects for %s", strings.Join(mapped, ", ")),
+	)
+}
+
 func WithInvalidNetworkMode(arg ast.Node, mode string, modes []string) error {
 	suggestion := diagnostic.Suggestion(mode, modes)
 	if suggestion != "" {
@@ -208,6 +281,17 @@ func WithInvalidNetworkMode(arg ast.Node, mode string, modes []string) error {
 	)
 }
 
+func WithInvalidConflictPolicy(arg ast.Node, policy string, policies []string) error {
+	suggestion := diagnostic.Suggestion(policy, policies)
+	if suggestion != "" {
+		suggestion = fmt.Sprintf("\ndid you mean `%s`?", suggestion)
+	}
+	return arg.WithError(
+		fmt.Errorf("invalid conflict policy `%s`", policy),
+		arg.Spanf(diagnostic.Primary, "invalid conflict policy `%s`%s", policy, suggestion),
+	)
+}
+
 func WithInvalidSecurityMode(arg ast.Node, mode string, modes []string) error {
 	suggestion := diagnostic.Suggestion(mode, modes)
 	if suggestion != "" {
@@ -230,14 +314,614 @@ func WithInvalidSharingMode(arg ast.Node, mode string, modes []string) error {
 	)
 }
 
+func WithInvalidCommitSHA(arg ast.Node, sha string) error {
+	return arg.WithError(
+		fmt.Errorf("invalid commit sha `%s`", sha),
+		arg.Spanf(diagnostic.Primary, "expected a full 40 character lowercase hexadecimal commit sha"),
+	)
+}
+
+func WithUnsupportedGitDepth(arg ast.Node, depth int) error {
+	return arg.WithError(
+		fmt.Errorf("unsupported git depth %d", depth),
+		arg.Spanf(diagnostic.Primary, "buildkit git sources are always fetched with a depth of 1"),
+	)
+}
+
+func WithUnsupportedGitOption(decl ast.Node, name string) error {
+	return decl.WithError(
+		fmt.Errorf("`%s` is not supported by buildkit git sources", name),
+		decl.Spanf(diagnostic.Primary, "buildkit git sources only support a depth of 1, use `depth 1` or `commit` instead"),
+	)
+}
+
+func WithSourcesFailed(decl ast.Node, urls []string, errs []error) error {
+	var lines []string
+	for i, url := range urls {
+		lines = append(lines, fmt.Sprintf("%s: %s", url, errs[i]))
+	}
+	transient := true
+	for _, err := range errs {
+		transient = transient && IsTransient(err)
+	}
+	return decl.WithError(
+		&ErrSourceFetch{
+			Err:       fmt.Errorf("failed to fetch from any of %d urls:\n%s", len(urls), strings.Join(lines, "\n")),
+			transient: transient,
+		},
+		decl.Spanf(diagnostic.Primary, "every url and fallback failed"),
+	)
+}
+
+func WithInvalidMaxSize(arg ast.Node, bytes int) error {
+	return arg.WithError(
+		fmt.Errorf("invalid max size %d", bytes),
+		arg.Spanf(diagnostic.Primary, "expected a size in bytes of at least 0"),
+	)
+}
+
+func WithInvalidLargeFileThreshold(arg ast.Node, bytes int) error {
+	return arg.WithError(
+		fmt.Errorf("invalid large file threshold %d", bytes),
+		arg.Spanf(diagnostic.Primary, "expected a size in bytes of at least 1"),
+	)
+}
+
+func WithEmptyPlaceholder(arg ast.Node) error {
+	return arg.WithError(
+		fmt.Errorf("empty placeholder"),
+		arg.Spanf(diagnostic.Primary, "expected a non-empty placeholder to substitute"),
+	)
+}
+
+func WithUnsupportedMaxSize(decl ast.Node) error {
+	return decl.WithError(
+		fmt.Errorf("maxSize is only supported when copying from a local source"),
+		decl.Spanf(diagnostic.Primary, "file sizes of this source are not known before the build"),
+	)
+}
+
+func WithConflictingCopyModes(decl ast.Node) error {
+	return decl.WithError(
+		fmt.Errorf("chmod cannot be combined with fileMode or dirMode"),
+		decl.Spanf(diagnostic.Primary, "chmod sets the permissions of files and directories alike"),
+	)
+}
+
+func WithUnsupportedExportIgnore(decl ast.Node) error {
+	return decl.WithError(
+		fmt.Errorf("exportIgnore is only supported when copying from a git source"),
+		decl.Spanf(diagnostic.Primary, "only git sources have export-ignore attributes"),
+	)
+}
+
+func WithInvalidPattern(arg ast.Node, pattern string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("invalid pattern %q", pattern),
+		arg.Spanf(diagnostic.Primary, "%s", err),
+	)
+}
+
+func WithInvalidModuleIgnorePattern(node ast.Node, filename, pattern string, err error) error {
+	return node.WithError(
+		fmt.Errorf("invalid pattern %q in %s", pattern, filename),
+		node.Spanf(diagnostic.Primary, "%s", err),
+	)
+}
+
+func WithImportPathIgnored(expr ast.Node, filename, ignoreFilename string) error {
+	return expr.WithError(
+		fmt.Errorf("import path %q is excluded by %s", filename, ignoreFilename),
+		expr.Spanf(diagnostic.Primary, "excluded by %s", ignoreFilename),
+	)
+}
+
+func WithIgnoreFileNotExist(err error, arg ast.Node, filename string) error {
+	return arg.WithError(
+		err,
+		arg.Spanf(diagnostic.Primary, "no such ignore file %q", filename),
+	)
+}
+
+func WithManifestNotExist(err error, arg ast.Node, filename string) error {
+	return arg.WithError(
+		err,
+		arg.Spanf(diagnostic.Primary, "no such manifest %q", filename),
+	)
+}
+
+func WithInvalidManifest(err error, arg ast.Node, filename string) error {
+	return arg.WithError(
+		fmt.Errorf("invalid manifest %s: %w", filename, err),
+		arg.Spanf(diagnostic.Primary, "expected a manifest of paths, sizes and digests"),
+	)
+}
+
+func WithUnsupportedVerifyManifest(decl ast.Node) error {
+	return decl.WithError(
+		fmt.Errorf("verifyManifest is only supported for local files on the host"),
+		decl.Spanf(diagnostic.Primary, "files of modules imported from a filesystem are not synced from the host"),
+	)
+}
+
+func WithLocalGitImported(decl ast.Node) error {
+	return decl.WithError(
+		fmt.Errorf("localGit is only supported for repositories on the host"),
+		decl.Spanf(diagnostic.Primary, "files of modules imported from a filesystem are not synced from the host"),
+	)
+}
+
+func WithNotRepository(arg ast.Node, path string) error {
+	return arg.WithError(
+		fmt.Errorf("%s is not in a git repository", path),
+		arg.Spanf(diagnostic.Primary, "not a git repository"),
+	)
+}
+
+func WithInvalidSubdir(arg ast.Node, subdir, reason string) error {
+	return arg.WithError(
+		fmt.Errorf("invalid subdir %s", subdir),
+		arg.Spanf(diagnostic.Primary, "%s", reason),
+	)
+}
+
+func WithRmExceptAll(mod *ast.Module, rm, except ast.Node) error {
+	return rm.WithError(
+		&ErrModule{mod, fmt.Errorf("rm has no effect")},
+		rm.Spanf(diagnostic.Primary, "every path removed is protected"),
+		except.Spanf(diagnostic.Secondary, "protected by this pattern"),
+	)
+}
+
+func WithSecretInStdin(mod *ast.Module, stdin, interpolated ast.Node, name string) error {
+	return interpolated.WithError(
+		&ErrModule{mod, fmt.Errorf("`%s` looks like a secret piped into stdin", name)},
+		interpolated.Spanf(diagnostic.Primary, "stored in the build's cache with the rest of stdin"),
+		stdin.Spanf(diagnostic.Secondary, "use the `secret` option to mount secrets instead"),
+	)
+}
+
+func WithImageSizeExceeded(node ast.Node, ref string, size, budget int64) error {
+	return node.WithError(
+		fmt.Errorf("image %s is %d bytes, exceeding its size budget of %d bytes", ref, size, budget),
+		node.Spanf(diagnostic.Primary, "allowed at most %d bytes, but the image is %d bytes", budget, size),
+	)
+}
+
+func WithInvalidFilenameTemplate(err error, arg ast.Node) error {
+	return arg.WithError(
+		fmt.Errorf("invalid filename template: %w", err),
+		arg.Spanf(diagnostic.Primary, "expected a Go text template"),
+	)
+}
+
+func WithInvalidDownloadName(node ast.Node, name string) error {
+	return node.WithError(
+		fmt.Errorf("invalid download filename %q", name),
+		node.Spanf(diagnostic.Primary, "expected a file name without a path separator"),
+	)
+}
+
+func WithDownloadNotSingleFile(node ast.Node, names []string) error {
+	err := fmt.Errorf("cannot name a download of an empty filesystem")
+	if len(names) > 0 {
+		err = fmt.Errorf("cannot name a download of %d files: %s", len(names), strings.Join(names, ", "))
+	}
+	return node.WithError(
+		err,
+		node.Spanf(diagnostic.Primary, "only a filesystem with a single file can be named"),
+	)
+}
+
+func WithGateRejected(err error, gate ast.Node, message string) error {
+	return gate.WithError(
+		fmt.Errorf("gate %q was not approved: %w", message, err),
+		gate.Spanf(diagnostic.Primary, "pipeline stopped at this gate"),
+	)
+}
+
+func WithTargetArgs(sig ast.Node, target string, expected, actual int) error {
+	return sig.WithError(
+		fmt.Errorf("target %s expects %d args but got %d", target, expected, actual),
+		sig.Spanf(diagnostic.Primary, "declared with %d params", expected),
+	)
+}
+
+func WithInvalidTargetArg(err error, param *ast.Field, target, arg string) error {
+	return param.WithError(
+		fmt.Errorf("invalid arg %q for target %s: %w", arg, target, err),
+		param.Spanf(diagnostic.Primary, "expected %s", param.Kind()),
+	)
+}
+
+func WithUnpinnedFrontend(source ast.Node) error {
+	return source.WithError(
+		fmt.Errorf("frontend is not pinned"),
+		source.Spanf(diagnostic.Primary, "pin with a digest ref, a digest option or by locking it in hlb.lock"),
+	)
+}
+
+func WithFrontendDigestMismatch(node ast.Node, ref string, expected, actual digest.Digest) error {
+	return node.WithError(
+		fmt.Errorf("frontend %s resolved to %s, expected %s", ref, actual, expected),
+		node.Spanf(diagnostic.Primary, "expected %s", expected),
+	)
+}
+
+func WithFrontendLockMismatch(source ast.Node, ref, lockfile string, locked, actual digest.Digest) error {
+	return source.WithError(
+		fmt.Errorf("frontend %s resolved to %s, but is locked to %s in %s", ref, actual, locked, lockfile),
+		source.Spanf(diagnostic.Primary, "locked to %s", locked),
+	)
+}
+
+func WithSecretNotFound(arg ast.Node, path string) error {
+	return arg.WithError(
+		fmt.Errorf("secret %s does not exist", path),
+		arg.Spanf(diagnostic.Primary, "declared here, set optional if it may be absent"),
+	)
+}
+
+func WithSecretDirectory(arg ast.Node, path string) error {
+	return arg.WithError(
+		fmt.Errorf("secret %s is a directory", path),
+		arg.Spanf(diagnostic.Primary, "only files can be attached, nested directories are not flattened"),
+	)
+}
+
+func WithDuplicateSecretTarget(target, firstPath, dupPath string, first, dup ast.Node) error {
+	err := fmt.Errorf("secret target %s is attached from both %s and %s", target, firstPath, dupPath)
+	if first == dup {
+		return dup.WithError(err, dup.Spanf(diagnostic.Primary, "both attached here"))
+	}
+	return dup.WithError(
+		err,
+		first.Spanf(diagnostic.Secondary, "first attached here"),
+		dup.Spanf(diagnostic.Primary, "attached again here"),
+	)
+}
+
+func WithHostAccessDenied(arg ast.Node, path string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("reading %s from the host was denied: %s", path, err),
+		arg.Spanf(diagnostic.Primary, "denied by the host policy"),
+	)
+}
+
+func WithHostWriteDenied(arg ast.Node, path string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("writing %s to the host was denied: %s", path, err),
+		arg.Spanf(diagnostic.Primary, "denied by the host policy"),
+	)
+}
+
+func WithHostCommandDenied(arg ast.Node, command string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("running %s on the host was denied: %s", command, err),
+		arg.Spanf(diagnostic.Primary, "denied by the host policy"),
+	)
+}
+
+func WithNotGitRepository(arg ast.Node) error {
+	return arg.WithError(
+		fmt.Errorf("not a git repository"),
+		arg.Spanf(diagnostic.Primary, "expected a filesystem from a git source or a local directory"),
+	)
+}
+
+func WithInvalidPortSpec(arg ast.Node, spec string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("invalid port `%s`: %w", spec, err),
+		arg.Spanf(diagnostic.Primary, "expected a port or port range with an optional protocol, like 8080/tcp or 9000-9005/udp"),
+	)
+}
+
+func WithDuplicatePort(mod *ast.Module, port string, first, dup ast.Node) error {
+	return dup.WithError(
+		&ErrModule{mod, fmt.Errorf("port `%s` is exposed more than once", port)},
+		first.Spanf(diagnostic.Secondary, "first exposed here"),
+		dup.Spanf(diagnostic.Primary, "duplicate"),
+	)
+}
+
+func WithBasePortExposed(mod *ast.Module, port string, image, dup ast.Node) error {
+	return dup.WithError(
+		&ErrModule{mod, fmt.Errorf("port `%s` is already exposed by the base image", port)},
+		image.Spanf(diagnostic.Secondary, "base image exposes `%s`", port),
+		dup.Spanf(diagnostic.Primary, "duplicate"),
+	)
+}
+
+func WithInvalidPublishPort(arg ast.Node, spec string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("invalid published port `%s`: %w", spec, err),
+		arg.Spanf(diagnostic.Primary, "expected a port with an optional protocol, like 8080 or 53/udp"),
+	)
+}
+
+func WithPublishConflict(port string, first, dup ast.Node) error {
+	return dup.WithError(
+		fmt.Errorf("host port `%s` is published more than once", port),
+		first.Spanf(diagnostic.Secondary, "first published here"),
+		dup.Spanf(diagnostic.Primary, "duplicate"),
+	)
+}
+
+func WithPublishExposedConflict(arg ast.Node, port string) error {
+	return arg.WithError(
+		fmt.Errorf("host port `%s` is also published for the exposed port `%s`", port, port),
+		arg.Spanf(diagnostic.Primary, "exposed ports are published on the same port of the host\npublish port `%s` on another port of the host", port),
+	)
+}
+
+func WithRelativeContainerPath(arg ast.Node, path string) error {
+	return arg.WithError(
+		fmt.Errorf("container path `%s` is not absolute", path),
+		arg.Spanf(diagnostic.Primary, "expected an absolute path in the container"),
+	)
+}
+
+func WithInvalidRuntimeSpecFormat(arg ast.Node, format string, formats []string) error {
+	suggestion := diagnostic.Suggestion(format, formats)
+	if suggestion != "" {
+		suggestion = fmt.Sprintf("\ndid you mean `%s`?", suggestion)
+	}
+	return arg.WithError(
+		fmt.Errorf("invalid runtime spec format `%s`", format),
+		arg.Spanf(diagnostic.Primary, "invalid runtime spec format `%s`%s", format, suggestion),
+	)
+}
+
+func WithStatPattern(arg ast.Node, path string) error {
+	return arg.WithError(
+		fmt.Errorf("path `%s` is a pattern", path),
+		arg.Spanf(diagnostic.Primary, "paths are matched literally, so wildcards like * are not supported"),
+	)
+}
+
+func WithStatNotExist(err error, path, fs ast.Node, p string) error {
+	return path.WithError(
+		err,
+		path.Spanf(diagnostic.Primary, "no such file or directory `%s`", p),
+		fs.Spanf(diagnostic.Secondary, "in the filesystem from here"),
+	)
+}
+
+func WithAssertFailed(condition ast.Node, message string) error {
+	return condition.WithError(
+		fmt.Errorf("assertion failed: %s", message),
+		condition.Spanf(diagnostic.Primary, "assertion failed: %s", message),
+	)
+}
+
+func WithFailed(call ast.Node, message string) error {
+	return call.WithError(
+		fmt.Errorf("failed: %s", message),
+		call.Spanf(diagnostic.Primary, "failed: %s", message),
+	)
+}
+
+func WithUnreachable(mod *ast.Module, stmt, terminal ast.Node) error {
+	return stmt.WithError(
+		&ErrModule{mod, fmt.Errorf("unreachable statement")},
+		stmt.Spanf(diagnostic.Primary, "never run"),
+		terminal.Spanf(diagnostic.Secondary, "the build always fails here"),
+	)
+}
+
+func WithAssertNotEqual(actual, expected ast.Node, a, e string) error {
+	return actual.WithError(
+		fmt.Errorf("assertion failed: expected %q, got %q", e, a),
+		expected.Spanf(diagnostic.Secondary, "expected %q", e),
+		actual.Spanf(diagnostic.Primary, "got %q", a),
+	)
+}
+
+func WithAssertNotExist(path, fs ast.Node, p string) error {
+	return path.WithError(
+		fmt.Errorf("assertion failed: `%s` does not exist", p),
+		fs.Spanf(diagnostic.Secondary, "in the filesystem from here"),
+		path.Spanf(diagnostic.Primary, "no such file or directory `%s`", p),
+	)
+}
+
+func WithAssertNotContains(substring, path ast.Node, p, s string) error {
+	return substring.WithError(
+		fmt.Errorf("assertion failed: `%s` does not contain %q", p, s),
+		path.Spanf(diagnostic.Secondary, "in the file read from here"),
+		substring.Spanf(diagnostic.Primary, "not found in `%s`", p),
+	)
+}
+
+func WithUnknownOwner(fs ast.Node, kind, name, file string) error {
+	return fs.WithError(
+		fmt.Errorf("%s `%s` not found in %s", kind, name, file),
+		fs.Spanf(diagnostic.Primary, "no %s `%s` in the %s of this filesystem", kind, name, file),
+	)
+}
+
+func WithWorkdirNotExist(arg, run ast.Node, dir string) error {
+	return arg.WithError(
+		fmt.Errorf("working directory `%s` does not exist", dir),
+		arg.Spanf(diagnostic.Primary, "no such directory `%s` in the filesystem\nuse `workdirCreate` to create it", dir),
+		run.Spanf(diagnostic.Secondary, "runs in this working directory"),
+	)
+}
+
+func WithRunUserNotExist(arg, run ast.Node, name, file string, users []string) error {
+	found := fmt.Sprintf("no users in %s", file)
+	if len(users) > 0 {
+		found = fmt.Sprintf("found users `%s`", strings.Join(users, "`, `"))
+	}
+	return arg.WithError(
+		fmt.Errorf("user `%s` not found in %s", name, file),
+		arg.Spanf(diagnostic.Primary, "%s", found),
+		run.Spanf(diagnostic.Secondary, "runs as this user"),
+	)
+}
+
+func WithInvalidHealthcheck(arg ast.Node, reason string) error {
+	return arg.WithError(
+		fmt.Errorf("invalid healthcheck: %s", reason),
+		arg.Spanf(diagnostic.Primary, "%s", reason),
+	)
+}
+
+func WithScanFailed(err error, scan ast.Node, threshold string) error {
+	return scan.WithError(
+		err,
+		scan.Spanf(diagnostic.Primary, "found vulnerabilities or license violations at or above %s", threshold),
+	)
+}
+
+func WithInvalidSeverity(arg ast.Node, severity string, severities []string) error {
+	suggestion := diagnostic.Suggestion(severity, severities)
+	if suggestion != "" {
+		suggestion = fmt.Sprintf("\ndid you mean `%s`?", suggestion)
+	}
+	return arg.WithError(
+		fmt.Errorf("invalid severity `%s`", severity),
+		arg.Spanf(diagnostic.Primary, "invalid severity `%s`%s", severity, suggestion),
+	)
+}
+
+func WithUnknownDockerfileStage(ref, id ast.Node, stage string, stages []string) error {
+	found := "no named stages"
+	if len(stages) > 0 {
+		found = fmt.Sprintf("found stages `%s`", strings.Join(stages, "`, `"))
+	}
+	return ref.WithError(
+		fmt.Errorf("stage `%s` is not defined in the Dockerfile", stage),
+		ref.Spanf(diagnostic.Primary, "%s", found),
+		id.Spanf(diagnostic.Secondary, "imported here"),
+	)
+}
+
 func WithBindCacheMount(as, cache ast.Node) error {
 	return as.WithError(
 		fmt.Errorf("cannot bind a cache mount"),
-		as.Spanf(diagnostic.Primary, "cannot bind a cache mount"),
+		as.Spanf(diagnostic.Primary, "cache mounts persist outside the build graph so they have no contents to bind"),
 		cache.Spanf(diagnostic.Secondary, "cache mode enabled here"),
 	)
 }
 
+func WithBindReadonlyMount(as, readonly ast.Node) error {
+	return as.WithError(
+		fmt.Errorf("cannot bind a readonly mount"),
+		as.Spanf(diagnostic.Primary, "readonly mounts are never modified so bind the mount input instead"),
+		readonly.Spanf(diagnostic.Secondary, "readonly mode enabled here"),
+	)
+}
+
+func WithFromNotFirst(from, first ast.Node) error {
+	return from.WithError(
+		fmt.Errorf("from must be the first statement of a block"),
+		from.Spanf(diagnostic.Primary, "move this to the start of the block, or use a new block"),
+		first.Spanf(diagnostic.Secondary, "block starts here"),
+	)
+}
+
+func WithFromNotFilesystem(from ast.Node, kind ast.Kind) error {
+	return from.WithError(
+		fmt.Errorf("from is only allowed in %s blocks", ast.Filesystem),
+		from.Spanf(diagnostic.Primary, "not allowed in a %s block", kind),
+	)
+}
+
+func WithFromNotCopy(from, name ast.Node) error {
+	return from.WithError(
+		fmt.Errorf("from is only allowed after copy"),
+		from.Spanf(diagnostic.Primary, "not allowed after `%s`", name),
+	)
+}
+
+func WithInvalidStage(arg ast.Node, reason string, opts ...diagnostic.Option) error {
+	opts = append([]diagnostic.Option{arg.Spanf(diagnostic.Primary, "%s", reason)}, opts...)
+	return arg.WithError(
+		fmt.Errorf("invalid stage `%s`", arg),
+		opts...,
+	)
+}
+
+func WithSuggestFrom(mod *ast.Module, call ast.Node) error {
+	return call.WithError(
+		&ErrModule{mod, fmt.Errorf("block starts from `%s` implicitly", call)},
+		call.Spanf(diagnostic.Primary, "use `from %s` to make the starting filesystem explicit", call),
+	)
+}
+
+func WithCaptureNoOutput(arg ast.Node, p, mountpoint string) error {
+	return arg.WithError(
+		fmt.Errorf("cannot capture %s from the mount at %s", p, mountpoint),
+		arg.Spanf(diagnostic.Primary, "readonly, cache and tmpfs mounts have no output to capture from"),
+	)
+}
+
+func WithNotTarball(arg ast.Node, p string, err error) error {
+	return arg.WithError(
+		fmt.Errorf("%s is not a tarball: %w", p, err),
+		arg.Spanf(diagnostic.Primary, "expected a tarball, optionally compressed with gzip, bzip2, xz or zstd"),
+	)
+}
+
+func WithTarPathTraversal(arg ast.Node, p, entry string) error {
+	return arg.WithError(
+		fmt.Errorf("tarball %s has entry %q outside of the filesystem", p, entry),
+		arg.Spanf(diagnostic.Primary, "entries cannot be unpacked outside of the filesystem"),
+	)
+}
+
+func WithTarChecksumMismatch(arg ast.Node, p string, expected, actual digest.Digest) error {
+	return arg.WithError(
+		fmt.Errorf("tarball %s has checksum %s, expected %s", p, actual, expected),
+		arg.Spanf(diagnostic.Primary, "expected %s", expected),
+	)
+}
+
+func WithUnsupportedTarChecksum(checksum, input ast.Node) error {
+	return checksum.WithError(
+		fmt.Errorf("checksum is only supported for tarballs on the host"),
+		checksum.Spanf(diagnostic.Primary, "contents of a filesystem are not known before the build"),
+		input.Spanf(diagnostic.Secondary, "tarball read from a filesystem here"),
+	)
+}
+
+func WithInvalidStripComponents(arg ast.Node, n int) error {
+	return arg.WithError(
+		fmt.Errorf("invalid stripComponents %d", n),
+		arg.Spanf(diagnostic.Primary, "must not be negative"),
+	)
+}
+
+func WithInvalidFileMode(arg ast.Node, mode int64) error {
+	return arg.WithError(
+		fmt.Errorf("invalid file mode %#o", mode),
+		arg.Spanf(diagnostic.Primary, "expected permissions from 0 to 0o7777"),
+	)
+}
+
+func WithAppendCreatedTime(createdTime, appendOpt ast.Node) error {
+	return createdTime.WithError(
+		fmt.Errorf("cannot set the created time of an appended file"),
+		createdTime.Spanf(diagnostic.Primary, "the created time of an existing file is kept"),
+		appendOpt.Spanf(diagnostic.Secondary, "append enabled here"),
+	)
+}
+
+func WithInvalidRunDefaults(sig ast.Node, name string) error {
+	return sig.WithError(
+		fmt.Errorf("invalid run defaults"),
+		sig.Spanf(diagnostic.Primary, "must be declared as `option::run %s()`", name),
+	)
+}
+
+func WithInvalidPrewarm(sig ast.Node, name string) error {
+	return sig.WithError(
+		fmt.Errorf("invalid prewarm function"),
+		sig.Spanf(diagnostic.Primary, "must be declared as `fs %s()`", name),
+	)
+}
+
 func WithDockerEngineUnsupported(decl ast.Node) error {
 	err := fmt.Errorf("not supported by buildkit embedded in docker engine, use standalone buildkit")
 	if decl == nil {
@@ -249,6 +933,24 @@ func WithDockerEngineUnsupported(decl ast.Node) error {
 	)
 }
 
+func WithInvalidFormat(verb ast.Node, err error, opts ...diagnostic.Option) error {
+	opts = append([]diagnostic.Option{verb.Spanf(diagnostic.Primary, "%s", err)}, opts...)
+	return verb.WithError(fmt.Errorf("invalid format string: %w", err), opts...)
+}
+
+func WithUnformattedArg(arg, format ast.Node, err error) error {
+	return arg.WithError(
+		fmt.Errorf("invalid format string: %w", err),
+		arg.Spanf(diagnostic.Primary, "not formatted"),
+		format.Spanf(diagnostic.Secondary, "format string"),
+	)
+}
+
+// FormatArg returns a diagnostic for the value formatted by an invalid verb.
+func FormatArg(arg ast.Node, kind ast.Kind) diagnostic.Option {
+	return arg.Spanf(diagnostic.Secondary, "%s value", kind)
+}
+
 func OneOfKinds(kinds []ast.Kind) string {
 	if len(kinds) == 1 {
 		return fmt.Sprintf("type %s", kinds[0])
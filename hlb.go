@@ -2,7 +2,6 @@ package hlb
 
 import (
 	"context"
-	"fmt"
 	"io"
 
 	"github.com/moby/buildkit/client"
@@ -10,8 +9,6 @@ import (
 	"github.com/openllb/hlb/builtin"
 	"github.com/openllb/hlb/checker"
 	"github.com/openllb/hlb/codegen"
-	"github.com/openllb/hlb/diagnostic"
-	"github.com/openllb/hlb/linter"
 	"github.com/openllb/hlb/module"
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/filebuffer"
@@ -31,31 +28,38 @@ func WithDefaultContext(ctx context.Context, cln *client.Client) context.Context
 	return ctx
 }
 
-// Compile compiles targets in a module and returns a solver.Request.
-func Compile(ctx context.Context, cln *client.Client, w io.Writer, mod *ast.Module, targets []codegen.Target) (solver.Request, error) {
+// Compile compiles targets in a module and returns the request of the
+// targets, with the kind of each target. Lint findings are written to w as
+// warnings unless the options set another lint mode. Check errors are counted
+// by the metrics of the global solve options.
+func Compile(ctx context.Context, cln *client.Client, w io.Writer, mod *ast.Module, targets []codegen.Target, opts ...codegen.CodeGenOption) (*codegen.Result, error) {
+	metrics := solver.MetricsFromOptions(codegen.GlobalSolveOpts(ctx)...)
 	err := checker.SemanticPass(mod)
 	if err != nil {
+		metrics.ObserveError(solver.ErrorCheck)
 		return nil, err
 	}
 
-	err = linter.Lint(ctx, mod)
-	if err != nil {
-		for _, span := range diagnostic.Spans(err) {
-			fmt.Fprintln(w, span.Pretty(ctx))
-		}
-	}
-
-	err = checker.Check(mod)
+	resolver, err := module.NewResolver(cln)
 	if err != nil {
 		return nil, err
 	}
 
-	resolver, err := module.NewResolver(cln)
+	opts = append([]codegen.CodeGenOption{
+		codegen.WithLintMode(codegen.LintWarn),
+		codegen.WithDiagnosticWriter(w),
+	}, opts...)
+	cg := codegen.New(cln, resolver, opts...)
+
+	// Linting rewrites deprecated syntax, so it must happen before checking.
+	cg.Lint(ctx, mod, targets...)
+
+	err = checker.Check(mod)
 	if err != nil {
+		metrics.ObserveError(solver.ErrorCheck)
 		return nil, err
 	}
 
-	cg := codegen.New(cln, resolver)
 	ctx = codegen.WithSessionID(ctx, identity.NewID())
 	if solver.ConcurrencyLimiter(ctx) == nil {
 		ctx = solver.WithConcurrencyLimiter(ctx, semaphore.NewWeighted(defaultMaxConcurrency))
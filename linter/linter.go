@@ -2,38 +2,156 @@ package linter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/openllb/hlb/checker"
 	"github.com/openllb/hlb/diagnostic"
 	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/imageutil"
+	"github.com/openllb/hlb/pkg/llbutil"
 )
 
+// Severity is how severe a lint finding is.
+type Severity int
+
+const (
+	// SeverityWarning is for findings that do not prevent a build.
+	SeverityWarning Severity = iota
+
+	// SeverityError is for findings that fail a build when linting is
+	// enforced.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// Edit replaces the source text between two positions of a module.
+type Edit struct {
+	Pos     lexer.Position
+	EndPos  lexer.Position
+	NewText string
+}
+
+// Fix is a suggested fix for a finding.
+type Fix struct {
+	Message string
+	Edits   []Edit
+}
+
+// Finding is a lint error found in a module, optionally with a suggested fix.
+type Finding struct {
+	Err      error
+	Severity Severity
+	Fix      *Fix
+}
+
+func (f *Finding) Error() string {
+	return f.Err.Error()
+}
+
+func (f *Finding) Unwrap() error {
+	return f.Err
+}
+
 type Linter struct {
-	errs []error
+	targets  []string
+	findings []*Finding
 }
 
 type LintOption func(*Linter)
 
+// WithTargets sets the names of the targets being built, so that bindings
+// built as targets are not reported as unused.
+func WithTargets(targets ...string) LintOption {
+	return func(l *Linter) {
+		l.targets = append(l.targets, targets...)
+	}
+}
+
+// Lint lints a module and rewrites any deprecated syntax it finds, returning
+// a *diagnostic.Error whose diagnostics are *Finding.
 func Lint(ctx context.Context, mod *ast.Module, opts ...LintOption) error {
 	l := Linter{}
 	for _, opt := range opts {
 		opt(&l)
 	}
 	l.Lint(ctx, mod)
-	if len(l.errs) > 0 {
-		return &diagnostic.Error{Diagnostics: l.errs}
+	if len(l.findings) > 0 {
+		var errs []error
+		for _, f := range l.findings {
+			errs = append(errs, f)
+		}
+		return &diagnostic.Error{Diagnostics: errs}
 	}
 	return nil
 }
 
+// Findings returns the findings of an error returned by Lint.
+func Findings(err error) []*Finding {
+	var (
+		findings []*Finding
+		derr     *diagnostic.Error
+	)
+	if errors.As(err, &derr) {
+		for _, err := range derr.Diagnostics {
+			var f *Finding
+			if errors.As(err, &f) {
+				findings = append(findings, f)
+			}
+		}
+	}
+	return findings
+}
+
+func (l *Linter) warn(err error, fix *Fix) {
+	l.findings = append(l.findings, &Finding{
+		Err:      err,
+		Severity: SeverityWarning,
+		Fix:      fix,
+	})
+}
+
+// replace returns a fix that replaces the source text of a node.
+func replace(message string, node ast.Node, newText string) *Fix {
+	return &Fix{
+		Message: message,
+		Edits: []Edit{{
+			Pos:     node.Position(),
+			EndPos:  node.End(),
+			NewText: newText,
+		}},
+	}
+}
+
 func (l *Linter) Lint(ctx context.Context, mod *ast.Module) {
 	ast.Match(mod, ast.MatchOpts{},
 		func(id *ast.ImportDecl) {
 			if id.DeprecatedPath != nil {
-				l.errs = append(l.errs, errdefs.WithDeprecated(
+				l.warn(errdefs.WithDeprecated(
 					mod, id.DeprecatedPath,
 					`import path without keyword "from" is deprecated`,
-				))
+				), &Fix{
+					Message: `insert keyword "from"`,
+					Edits: []Edit{{
+						Pos:     id.DeprecatedPath.Pos,
+						EndPos:  id.DeprecatedPath.Pos,
+						NewText: "from ",
+					}},
+				})
 				id.From = &ast.From{Text: "from"}
 				id.Expr = &ast.Expr{
 					BasicLit: &ast.BasicLit{
@@ -44,21 +162,402 @@ func (l *Linter) Lint(ctx context.Context, mod *ast.Module) {
 		},
 		func(t *ast.Type) {
 			if string(t.Kind) == "group" {
-				l.errs = append(l.errs, errdefs.WithDeprecated(
+				l.warn(errdefs.WithDeprecated(
 					mod, t,
 					"type `group` is deprecated, use `pipeline` instead",
-				))
+				), replace("replace with `pipeline`", t, string(ast.Pipeline)))
 				t.Kind = ast.Pipeline
 			}
 		},
+		func(fd *ast.FuncDecl) {
+			l.lintBindShadows(mod, fd)
+		},
+		func(block *ast.BlockStmt) {
+			l.lintExpose(mod, block)
+			l.lintImplicitFrom(mod, block)
+			l.lintUnreachable(mod, block)
+		},
 		func(call *ast.CallStmt) {
+			l.lintRmExcept(mod, call)
+			l.lintStdinSecrets(mod, call)
 			if call.Name != nil && call.Name.Ident.Text == "parallel" {
-				l.errs = append(l.errs, errdefs.WithDeprecated(
+				l.warn(errdefs.WithDeprecated(
 					mod, call.Name,
 					"function `parallel` is deprecated, use `stage` instead",
-				))
+				), replace("replace with `stage`", call.Name.Ident, "stage"))
 				call.Name.Ident.Text = "stage"
 			}
 		},
 	)
+	l.lintUnusedBinds(mod)
+}
+
+// ApplyFixes applies the suggested fixes of findings to the source of the
+// module they were found in. Fixes with overlapping edits are rejected.
+func ApplyFixes(src []byte, findings []*Finding) ([]byte, error) {
+	var edits []Edit
+	for _, f := range findings {
+		if f.Fix != nil {
+			edits = append(edits, f.Fix.Edits...)
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].Pos.Offset < edits[j].Pos.Offset
+	})
+
+	var (
+		dst    []byte
+		offset int
+	)
+	for i, edit := range edits {
+		start, end := edit.Pos.Offset, edit.EndPos.Offset
+		if start < offset || end < start || end > len(src) || (i > 0 && start == edits[i-1].Pos.Offset) {
+			return nil, fmt.Errorf("%s fix overlaps with another fix or is out of range", diagnostic.FormatPos(edit.Pos))
+		}
+		dst = append(dst, src[offset:start]...)
+		dst = append(dst, edit.NewText...)
+		offset = end
+	}
+	return append(dst, src[offset:]...), nil
+}
+
+// lintExpose warns about literal ports exposed more than once in a block,
+// including ports within ranges.
+func (l *Linter) lintExpose(mod *ast.Module, block *ast.BlockStmt) {
+	exposed := make(map[string]ast.Node)
+	for _, stmt := range block.Stmts() {
+		call := stmt.Call
+		if call == nil || call.Name == nil || call.Name.Reference != nil || call.Name.Ident.Text != "expose" {
+			continue
+		}
+		for _, arg := range call.Args {
+			if arg.BasicLit == nil {
+				continue
+			}
+			spec, ok := arg.BasicLit.StringValue()
+			if !ok {
+				continue
+			}
+			ports, err := imageutil.ParsePortSpec(spec)
+			if err != nil {
+				continue
+			}
+			for _, port := range ports {
+				if first, ok := exposed[port]; ok {
+					l.warn(errdefs.WithDuplicatePort(mod, port, first, arg), nil)
+					break
+				}
+				exposed[port] = arg
+			}
+		}
+	}
+}
+
+// lintImplicitFrom suggests from for a filesystem block that starts with a
+// lone call of a parameter or of a function that ignores the value it is
+// called on, which is where the block starts from either way.
+func (l *Linter) lintImplicitFrom(mod *ast.Module, block *ast.BlockStmt) {
+	if block.Kind() != ast.Filesystem || block.Scope == nil {
+		return
+	}
+	stmts := block.Stmts()
+	if len(stmts) == 0 {
+		return
+	}
+
+	call := stmts[0].Call
+	if call == nil || call.Name == nil || call.Name.Reference != nil {
+		return
+	}
+	if len(call.Args) > 0 || call.WithClause != nil || call.BindClause != nil {
+		return
+	}
+
+	obj := block.Scope.Lookup(call.Name.Ident.Text)
+	if obj == nil || obj.Kind != ast.Filesystem {
+		return
+	}
+	switch n := obj.Node.(type) {
+	case *ast.Field:
+	case *ast.FuncDecl:
+		if !checker.IsIndependent(n) {
+			return
+		}
+	default:
+		return
+	}
+
+	l.warn(errdefs.WithSuggestFrom(mod, call.Name), &Fix{
+		Message: `insert keyword "from"`,
+		Edits: []Edit{{
+			Pos:     call.Pos,
+			EndPos:  call.Pos,
+			NewText: "from ",
+		}},
+	})
+}
+
+// lintUnreachable warns about the statements of a filesystem block after one
+// that always fails the build, because they are never run.
+func (l *Linter) lintUnreachable(mod *ast.Module, block *ast.BlockStmt) {
+	if block.Kind() != ast.Filesystem || block.Scope == nil {
+		return
+	}
+
+	stmts := block.Stmts()
+	for i := 0; i+1 < len(stmts); i++ {
+		stmt := stmts[i]
+		if alwaysFails(block.Scope, stmt.Call) {
+			l.warn(errdefs.WithUnreachable(mod, stmtNode(stmts[i+1]), stmt.Call.Name), nil)
+			return
+		}
+	}
+}
+
+// stmtNode returns the node to report a statement at, because the span of a
+// statement runs on to the next line.
+func stmtNode(stmt *ast.Stmt) ast.Node {
+	switch {
+	case stmt.Call != nil:
+		return stmt.Call.Name
+	case stmt.Expr != nil:
+		return stmt.Expr.Expr
+	default:
+		return stmt.From.From
+	}
+}
+
+// alwaysFails returns true if a call is of the builtin fail, or of the builtin
+// assert with a false literal condition.
+func alwaysFails(scope *ast.Scope, call *ast.CallStmt) bool {
+	if call == nil || call.Name == nil || call.Name.Reference != nil {
+		return false
+	}
+	obj := scope.Lookup(call.Name.Ident.Text)
+	if obj == nil {
+		return false
+	}
+	if _, ok := obj.Node.(*ast.BuiltinDecl); !ok {
+		return false
+	}
+
+	switch call.Name.Ident.Text {
+	case "fail":
+		return true
+	case "assert":
+		if len(call.Args) == 0 || call.Args[0].BasicLit == nil {
+			return false
+		}
+		cond := call.Args[0].BasicLit.Bool
+		return cond != nil && !bool(*cond)
+	}
+	return false
+}
+
+// lintBindShadows warns about bindings named after a parameter of their
+// closure, because the name refers to the parameter within the closure.
+func (l *Linter) lintBindShadows(mod *ast.Module, fd *ast.FuncDecl) {
+	if fd.Sig.Params == nil || fd.Body == nil {
+		return
+	}
+
+	params := make(map[string]*ast.Field)
+	for _, param := range fd.Sig.Params.Fields() {
+		params[param.Name.Text] = param
+	}
+
+	ast.Match(fd.Body, ast.MatchOpts{},
+		func(binds *ast.BindClause) {
+			for _, target := range binds.Targets() {
+				if param, ok := params[target.Text]; ok {
+					l.warn(errdefs.WithBindShadowsParam(mod, target, param.Name), nil)
+				}
+			}
+		},
+	)
+}
+
+// lintUnusedBinds warns about bindings that are never referenced, exported or
+// built as a target. References are resolved through their scope, so an
+// identifier referring to something else with the same name is not a use.
+func (l *Linter) lintUnusedBinds(mod *ast.Module) {
+	used := make(map[*ast.Ident]struct{})
+	use := func(scope *ast.Scope, name string) {
+		if scope == nil {
+			return
+		}
+		obj := scope.Lookup(name)
+		if obj == nil {
+			return
+		}
+		if _, ok := obj.Node.(*ast.BindClause); ok {
+			used[obj.Ident] = struct{}{}
+		}
+	}
+	for _, target := range l.targets {
+		use(mod.Scope, target)
+	}
+
+	var targets []*ast.Ident
+	ast.Match(mod, ast.MatchOpts{},
+		func(_ *ast.ImportDecl, ie *ast.IdentExpr) {
+			if ie.Reference == nil {
+				use(mod.Scope, ie.Ident.Text)
+			}
+		},
+		func(fd *ast.FuncDecl, ie *ast.IdentExpr) {
+			if ie.Reference == nil {
+				use(fd.Scope, ie.Ident.Text)
+			}
+		},
+		func(ed *ast.ExportDecl) {
+			if ed.Name != nil {
+				use(mod.Scope, ed.Name.Text)
+			}
+		},
+		func(binds *ast.BindClause) {
+			targets = append(targets, binds.Targets()...)
+		},
+	)
+
+	for _, target := range targets {
+		if _, ok := used[target]; !ok {
+			l.warn(errdefs.WithUnusedBinding(mod, target), nil)
+		}
+	}
+}
+
+// lintRmExcept warns about an rm whose literal paths are all protected by its
+// literal except patterns, which removes nothing.
+func (l *Linter) lintRmExcept(mod *ast.Module, call *ast.CallStmt) {
+	if call.Name == nil || call.Name.Reference != nil || call.Name.Ident.Text != "rm" {
+		return
+	}
+	if call.WithClause == nil || len(call.Args) == 0 {
+		return
+	}
+
+	for _, opt := range withOptions(call) {
+		if opt.name == nil || opt.name.Reference != nil || opt.name.Ident.Text != "except" {
+			continue
+		}
+		if len(opt.args) != 1 || opt.args[0].BasicLit == nil {
+			continue
+		}
+		pattern, ok := opt.args[0].BasicLit.StringValue()
+		if !ok {
+			continue
+		}
+
+		protected := true
+		for _, arg := range call.Args {
+			if arg.BasicLit == nil {
+				protected = false
+				break
+			}
+			p, ok := arg.BasicLit.StringValue()
+			if !ok {
+				protected = false
+				break
+			}
+			matched, err := llbutil.MatchesPatterns(p, []string{pattern})
+			if err != nil || !matched {
+				protected = false
+				break
+			}
+		}
+		if protected {
+			l.warn(errdefs.WithRmExceptAll(mod, call.Name, opt.args[0]), nil)
+			return
+		}
+	}
+}
+
+type option struct {
+	name *ast.IdentExpr
+	args []*ast.Expr
+}
+
+// withOptions returns the options of a call's with clause that are called
+// directly or in an option block.
+func withOptions(call *ast.CallStmt) []option {
+	if call.WithClause == nil {
+		return nil
+	}
+
+	var opts []option
+	switch expr := call.WithClause.Expr; {
+	case expr.CallExpr != nil:
+		opts = append(opts, option{expr.CallExpr.Name, expr.CallExpr.Arguments()})
+	case expr.FuncLit != nil:
+		for _, stmt := range expr.FuncLit.Body.Stmts() {
+			if stmt.Call != nil {
+				opts = append(opts, option{stmt.Call.Name, stmt.Call.Args})
+			}
+		}
+	}
+	return opts
+}
+
+// secretWords are the words in the names of values that are likely secrets.
+var secretWords = []string{"secret", "token", "password", "passwd", "credential", "apikey", "api_key", "private"}
+
+// lintStdinSecrets warns about stdin of a run interpolating values whose names
+// look like secrets, because stdin is part of the cache key of the run.
+func (l *Linter) lintStdinSecrets(mod *ast.Module, call *ast.CallStmt) {
+	if call.Name == nil || call.Name.Reference != nil {
+		return
+	}
+	if name := call.Name.Ident.Text; name != "run" && name != "tryRun" {
+		return
+	}
+
+	for _, opt := range withOptions(call) {
+		if opt.name == nil || opt.name.Reference != nil || opt.name.Ident.Text != "stdin" {
+			continue
+		}
+		if len(opt.args) != 1 {
+			continue
+		}
+		ast.Match(opt.args[0], ast.MatchOpts{},
+			func(interp *ast.Interpolated) {
+				if name, ok := secretName(interp.Expr); ok {
+					l.warn(errdefs.WithSecretInStdin(mod, opt.name, interp, name), nil)
+				}
+			},
+		)
+	}
+}
+
+// secretName returns the name of an interpolated value if it looks like a
+// secret, which is the variable of localEnv or the name of the call.
+func secretName(expr *ast.Expr) (string, bool) {
+	if expr == nil || expr.CallExpr == nil || expr.CallExpr.Name == nil {
+		return "", false
+	}
+
+	ce := expr.CallExpr
+	name := ce.Name.Ident.Text
+	if ce.Name.Reference != nil {
+		name = ce.Name.Reference.Ident.Text
+	}
+	if name == "localEnv" && ce.Name.Reference == nil {
+		args := ce.Arguments()
+		if len(args) != 1 || args[0].BasicLit == nil {
+			return "", false
+		}
+		key, ok := args[0].BasicLit.StringValue()
+		if !ok {
+			return "", false
+		}
+		name = key
+	}
+
+	lower := strings.ToLower(name)
+	for _, word := range secretWords {
+		if strings.Contains(lower, word) {
+			return name, true
+		}
+	}
+	return "", false
 }
@@ -60,6 +60,180 @@ func TestLinter_Lint(t *testing.T) {
 				},
 			}
 		},
+	}, {
+		"duplicate expose ports",
+		`
+		fs default() {
+			image "nginx"
+			expose "8080" "9000-9005/udp"
+			expose "8080/tcp" "9003/udp" "9003/tcp"
+		}
+		`,
+		func(mod *ast.Module) error {
+			return &diagnostic.Error{
+				Diagnostics: []error{
+					errdefs.WithDuplicatePort(
+						mod, "8080/tcp",
+						ast.Search(mod, `"8080"`),
+						ast.Search(mod, `"8080/tcp"`),
+					),
+					errdefs.WithDuplicatePort(
+						mod, "9003/udp",
+						ast.Search(mod, `"9000-9005/udp"`),
+						ast.Search(mod, `"9003/udp"`),
+					),
+				},
+			}
+		},
+	}, {
+		"rm except protecting every path",
+		`
+		fs default() {
+			image "alpine"
+			rm "/app/cache" "/app/tmp/*" with option {
+				allowWildcard
+				except "/app/keep"
+				except "/app"
+			}
+			rm "/app/cache" with option {
+				except "/app/cache/keep"
+			}
+			rm "/app/logs" with except("/**")
+		}
+		`,
+		func(mod *ast.Module) error {
+			return &diagnostic.Error{
+				Diagnostics: []error{
+					errdefs.WithRmExceptAll(
+						mod, ast.Search(mod, "rm"),
+						ast.Search(mod, `"/app"`),
+					),
+					errdefs.WithRmExceptAll(
+						mod, ast.Search(mod, "rm", ast.WithSkip(2)),
+						ast.Search(mod, `"/**"`),
+					),
+				},
+			}
+		},
+	}, {
+		"secret piped into stdin",
+		`
+		fs default() {
+			image "postgres"
+			run "psql" with option {
+				stdin <<~SQL
+				ALTER USER app PASSWORD '${localEnv("DB_PASSWORD")}';
+				SELECT '${localEnv("APP_NAME")}';
+				SQL
+			}
+			run "kubectl apply -f -" with stdin(format("token: %s", apiToken))
+			run "sh" with stdin("${apiToken}")
+		}
+
+		string apiToken() {
+			localEnv "API_TOKEN"
+		}
+		`,
+		func(mod *ast.Module) error {
+			return &diagnostic.Error{
+				Diagnostics: []error{
+					errdefs.WithSecretInStdin(
+						mod, ast.Search(mod, "stdin"),
+						ast.Search(mod, `${localEnv("DB_PASSWORD")}`),
+						"DB_PASSWORD",
+					),
+					errdefs.WithSecretInStdin(
+						mod, ast.Search(mod, "stdin", ast.WithSkip(2)),
+						ast.Search(mod, "${apiToken}"),
+						"apiToken",
+					),
+				},
+			}
+		},
+	}, {
+		"binding shadows a parameter",
+		`
+		fs default(fs out) {
+			image "alpine"
+			run "make" with option {
+				mount scratch "/out" as out
+			}
+			copy out "/" "/usr/local"
+		}
+		`,
+		func(mod *ast.Module) error {
+			// The copy uses the parameter, so the binding is never used.
+			binding := ast.Search(mod, "out", ast.WithSkip(1))
+			return &diagnostic.Error{
+				Diagnostics: []error{
+					errdefs.WithBindShadowsParam(mod, binding, ast.Search(mod, "out")),
+					errdefs.WithUnusedBinding(mod, binding),
+				},
+			}
+		},
+	}, {
+		"unused bindings",
+		`
+		export exported
+
+		fs default() {
+			image "alpine"
+			run "make" with option {
+				mount scratch "/out" as unused
+				mount scratch "/lib" as exported
+				mount scratch "/bin" as used
+			}
+			copy used "/" "/usr/local/bin"
+			dockerPush "some/ref" as (digest pushed)
+		}
+		`,
+		func(mod *ast.Module) error {
+			return &diagnostic.Error{
+				Diagnostics: []error{
+					errdefs.WithUnusedBinding(mod, ast.Search(mod, "unused")),
+					errdefs.WithUnusedBinding(mod, ast.Search(mod, "pushed")),
+				},
+			}
+		},
+	}, {
+		"unreachable after fail",
+		`
+		fs default() {
+			image "alpine"
+			fail "x"
+			run "echo unreachable"
+			run "echo also unreachable"
+		}
+
+		fs falseAssert() {
+			assert false "never"
+			image "alpine"
+		}
+
+		fs trueAssert() {
+			assert true "always"
+			image "alpine"
+		}
+
+		fs failLast() {
+			image "alpine"
+			fail "last"
+		}
+		`,
+		func(mod *ast.Module) error {
+			return &diagnostic.Error{
+				Diagnostics: []error{
+					errdefs.WithUnreachable(
+						mod, ast.Search(mod, "run"),
+						ast.Search(mod, "fail"),
+					),
+					errdefs.WithUnreachable(
+						mod, ast.Search(mod, "image", ast.WithSkip(1)),
+						ast.Search(mod, "assert"),
+					),
+				},
+			}
+		},
 	}} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -103,3 +277,164 @@ func validateError(t *testing.T, ctx context.Context, expected, actual error, na
 		}
 	}
 }
+
+func TestLinter_LintTargets(t *testing.T) {
+	t.Parallel()
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	mod, err := parser.Parse(ctx, strings.NewReader(dedent.Dedent(`
+	fs npmInstall() {
+		image "node:alpine"
+		run "npm install" with option {
+			mount scratch "/src/node_modules" as nodeModules
+		}
+	}
+	`)))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	err = Lint(ctx, mod, WithTargets("nodeModules"))
+	require.NoError(t, err)
+}
+
+func TestLinter_LintImplicitFrom(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	src := dedent.Dedent(`
+	fs default(fs base) {
+		base
+		run "make"
+	}
+
+	fs rebased() {
+		golang
+		run "go build"
+	}
+
+	fs golang() {
+		image "golang"
+	}
+
+	fs continued() {
+		noSource
+		run "make"
+	}
+
+	fs noSource() {
+		run "ls"
+	}
+
+	fs explicit() {
+		from golang
+	}
+	`)
+	mod, err := parser.Parse(ctx, strings.NewReader(src))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	// Calls that continue from the value they are called on, and builtins,
+	// are not suggested.
+	err = Lint(ctx, mod)
+	validateError(t, ctx, &diagnostic.Error{
+		Diagnostics: []error{
+			errdefs.WithSuggestFrom(mod, ast.Search(mod, "base", ast.WithSkip(1))),
+			errdefs.WithSuggestFrom(mod, ast.Search(mod, "golang")),
+		},
+	}, err, "implicit from")
+
+	dt, err := ApplyFixes([]byte(src), Findings(err))
+	require.NoError(t, err)
+	require.Equal(t, dedent.Dedent(`
+	fs default(fs base) {
+		from base
+		run "make"
+	}
+
+	fs rebased() {
+		from golang
+		run "go build"
+	}
+
+	fs golang() {
+		image "golang"
+	}
+
+	fs continued() {
+		noSource
+		run "make"
+	}
+
+	fs noSource() {
+		run "ls"
+	}
+
+	fs explicit() {
+		from golang
+	}
+	`), string(dt))
+}
+
+func TestApplyFixes(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	src := dedent.Dedent(`
+	import foo "./foo.hlb"
+
+	# A group of builds.
+	group default() {
+		parallel foo.build bar
+	}
+
+	fs bar() {
+		image "nginx"
+		expose "80" "80"
+	}
+	`)
+	mod, err := parser.Parse(ctx, strings.NewReader(src))
+	require.NoError(t, err)
+
+	err = checker.SemanticPass(mod)
+	require.NoError(t, err)
+
+	findings := Findings(Lint(ctx, mod))
+	require.Len(t, findings, 4)
+
+	var fixed int
+	for _, f := range findings {
+		require.Equal(t, SeverityWarning, f.Severity)
+		if f.Fix != nil {
+			fixed++
+		}
+	}
+	require.Equal(t, 3, fixed)
+
+	dt, err := ApplyFixes([]byte(src), findings)
+	require.NoError(t, err)
+	require.Equal(t, dedent.Dedent(`
+	import foo from "./foo.hlb"
+
+	# A group of builds.
+	pipeline default() {
+		stage foo.build bar
+	}
+
+	fs bar() {
+		image "nginx"
+		expose "80" "80"
+	}
+	`), string(dt))
+
+	_, err = ApplyFixes([]byte(src), append(findings, findings[0]))
+	require.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package module
+
+import (
+	"context"
+	"os"
+
+	"github.com/openllb/hlb/codegen"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// LockfilePath is the lockfile of the current working directory, which pins
+// the frontends of its modules.
+var LockfilePath = codegen.LockfileName
+
+// ReadLockfile returns the lockfile of the current working directory, or nil
+// if there is none.
+func ReadLockfile() (*codegen.Lockfile, error) {
+	lf, err := codegen.ReadLockfile(LockfilePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return lf, err
+}
+
+// LockFrontends locks the frontends of modules in the lockfile of the current
+// working directory. Frontends that are already locked are resolved again,
+// and in tidy mode the frontends of other modules are removed.
+func LockFrontends(ctx context.Context, tidy bool, mods ...*ast.Module) error {
+	lf, err := ReadLockfile()
+	if err != nil {
+		return err
+	}
+	if lf == nil || tidy {
+		lf = codegen.NewLockfile()
+	}
+
+	err = codegen.LockFrontends(ctx, lf, mods...)
+	if err != nil {
+		return err
+	}
+
+	// Modules without frontends don't need a lockfile.
+	if len(lf.Frontends) == 0 {
+		_, err = os.Stat(LockfilePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return lf.WriteFile(LockfilePath)
+}
@@ -241,6 +241,11 @@ func resolveGraph(ctx context.Context, info *resolveGraphInfo, mod *ast.Module)
 					return err
 				}
 
+				// Dockerfile stages are not modules, so there is nothing to visit.
+				if imod.Directory == nil {
+					return nil
+				}
+
 				if info.visitor != nil {
 					filename := strings.TrimPrefix(imod.Pos.Filename, imod.Directory.Path())
 					err = info.visitor(VisitInfo{
@@ -13,7 +13,8 @@ import (
 )
 
 // Vendor resolves the import graph and writes the contents into the modules
-// directory of the current working directory.
+// directory of the current working directory. The frontends of the modules in
+// the graph are locked in its lockfile.
 //
 // If tidy mode is enabled, vertices with digests that already exist in the
 // modules directory are skipped, and unused modules are pruned.
@@ -22,6 +23,7 @@ func Vendor(ctx context.Context, cln *client.Client, mod *ast.Module, targets []
 
 	var mu sync.Mutex
 	markedPaths := make(map[string]struct{})
+	mods := []*ast.Module{mod}
 
 	var resolver codegen.Resolver
 	if tidy {
@@ -42,6 +44,10 @@ func Vendor(ctx context.Context, cln *client.Client, mod *ast.Module, targets []
 
 	ready := make(chan struct{})
 	err := ResolveGraph(ctx, cln, resolver, mod, func(info VisitInfo) error {
+		mu.Lock()
+		mods = append(mods, info.Import)
+		mu.Unlock()
+
 		g.Go(func() error {
 			<-ready
 
@@ -113,6 +119,11 @@ func Vendor(ctx context.Context, cln *client.Client, mod *ast.Module, targets []
 		return err
 	}
 
+	err = LockFrontends(ctx, tidy, mods...)
+	if err != nil {
+		return err
+	}
+
 	if tidy {
 		matches, err := filepath.Glob(filepath.Join(ModulesPath, "*/*/*"))
 		if err != nil {
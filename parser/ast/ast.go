@@ -31,12 +31,24 @@ var (
 			{"Ident", `[\w:]+`, lexer.Push("Reference")},
 			{"Operator", `;`, nil},
 			{"Newline", `\n`, nil},
-			{"Comment", `#[^\n]*\n`, nil},
+			{"Comment", `(#|//)[^\n]*\n`, nil},
+			{"BlockComment", `/\*`, lexer.Push("BlockComment")},
 			{"Whitespace", `[\r\t ]+`, nil},
 		},
+		"BlockComment": {
+			{"BlockCommentEnd", `\*/[\r\t ]*\n?`, lexer.Pop()},
+			{"NestedBlockComment", `/\*`, lexer.Push("BlockComment")},
+			{"BlockCommentText", `[^*/]+|\*|/`, nil},
+		},
 		"Reference": {
-			{"Dot", `\.`, nil},
-			{"Ident", `[\w:]+`, nil},
+			{"Dot", `\.`, lexer.Push("Member")},
+			lexer.Return(),
+		},
+		// Members of an import may be quoted when their names are not valid
+		// identifiers, like the stages of a Dockerfile.
+		"Member": {
+			{"Ident", `[\w:]+`, lexer.Pop()},
+			{"QuotedIdent", `"[^"\n]*"`, lexer.Pop()},
 			lexer.Return(),
 		},
 		"String": {
@@ -81,6 +93,7 @@ var (
 		&Module{},
 		participle.Lexer(Lexer),
 		participle.Elide("Whitespace"),
+		participle.Unquote("QuotedIdent"),
 	)
 )
 
@@ -439,7 +452,7 @@ func (bs *BlockStmt) Stmts() []*Stmt {
 	}
 	var stmts []*Stmt
 	for _, stmt := range bs.List {
-		if stmt.Call != nil || stmt.Expr != nil {
+		if stmt.From != nil || stmt.Call != nil || stmt.Expr != nil {
 			stmts = append(stmts, stmt)
 		}
 	}
@@ -449,19 +462,31 @@ func (bs *BlockStmt) Stmts() []*Stmt {
 // Stmt represents a statement node.
 type Stmt struct {
 	Mixin
-	Call     *CallStmt     `parser:"( @@"`
+	From     *FromStmt     `parser:"( @@"`
+	Call     *CallStmt     `parser:"| @@"`
 	Expr     *ExprStmt     `parser:"| @@"`
 	Newline  *Newline      `parser:"| @@"`
 	Comments *CommentGroup `parser:"| @@ )"`
 }
 
+// FromStmt represents the first statement of a filesystem block that starts
+// it from the value of an expression.
+type FromStmt struct {
+	Mixin
+	From      *From    `parser:"@@"`
+	Expr      *Expr    `parser:"@@"`
+	Terminate *StmtEnd `parser:"@@?"`
+}
+
 // CallStmt represents an function name followed by an argument list, and an
-// optional WithClause.
+// optional WithClause. A "from" keyword before the arguments names the stage
+// a copy is from.
 type CallStmt struct {
 	Mixin
 	Doc        *CommentGroup
 	Sig        []Kind
 	Name       *IdentExpr  `parser:"@@"`
+	From       *From       `parser:"@@?"`
 	Args       []*Expr     `parser:"@@*"`
 	WithClause *WithClause `parser:"@@?"`
 	BindClause *BindClause `parser:"@@?"`
@@ -560,6 +585,20 @@ func (bc *BindClause) TargetBinding(target string) *Binding {
 	return nil
 }
 
+// Targets returns the identifiers that the side effects are bound to.
+func (bc *BindClause) Targets() []*Ident {
+	if bc.Ident != nil {
+		return []*Ident{bc.Ident}
+	}
+	var targets []*Ident
+	if bc.Binds != nil {
+		for _, b := range bc.Binds.Binds() {
+			targets = append(targets, b.Target)
+		}
+	}
+	return targets
+}
+
 // Binding is a value type that represents the call site where a single side effect is bound.
 type Binding struct {
 	Name  *Ident
@@ -682,7 +721,7 @@ type BasicLit struct {
 	Mixin
 	Decimal    *int          `parser:"( @Decimal"`
 	Numeric    *NumericLit   `parser:"| @Numeric"`
-	Bool       *bool         `parser:"| @Bool"`
+	Bool       *BoolLit      `parser:"| @Bool"`
 	Str        *StringLit    `parser:"| @@"`
 	RawString  *RawStringLit `parser:"| @@"`
 	Heredoc    *Heredoc      `parser:"| @@"`
@@ -702,6 +741,24 @@ func (bl *BasicLit) Kind() Kind {
 	return None
 }
 
+// StringValue returns the value of a string or raw string literal. It returns
+// false if the literal is not a string or if its value is only known at
+// runtime because it is interpolated.
+func (bl *BasicLit) StringValue() (string, bool) {
+	switch {
+	case bl.Str != nil:
+		for _, f := range bl.Str.Fragments {
+			if f.Interpolated != nil {
+				return "", false
+			}
+		}
+		return bl.Str.Unquoted(), true
+	case bl.RawString != nil:
+		return bl.RawString.Text, true
+	}
+	return "", false
+}
+
 // NumericLit represents a number literal with a non-decimal base.
 type NumericLit struct {
 	Mixin
@@ -733,6 +790,16 @@ func (nl *NumericLit) Capture(tokens []string) error {
 	return err
 }
 
+// BoolLit represents a bool literal. Its token is captured explicitly,
+// because a captured bool is otherwise set to true for either literal.
+type BoolLit bool
+
+func (bl *BoolLit) Capture(tokens []string) error {
+	v, err := strconv.ParseBool(tokens[0])
+	*bl = BoolLit(v)
+	return err
+}
+
 // StringLit represents a string literal that can contain escaped characters,
 // interpolated expressions and regular string characters.
 type StringLit struct {
@@ -852,9 +919,10 @@ func NewNumericExpr(v int64, base int) *Expr {
 }
 
 func NewBoolExpr(v bool) *Expr {
+	lit := BoolLit(v)
 	return &Expr{
 		BasicLit: &BasicLit{
-			Bool: &v,
+			Bool: &lit,
 		},
 	}
 }
@@ -942,7 +1010,7 @@ func NewIdentExpr(name string) *IdentExpr {
 // Ident represents an identifier.
 type Ident struct {
 	Mixin
-	Text string `parser:"@Ident"`
+	Text string `parser:"@( Ident | QuotedIdent )"`
 }
 
 func NewIdent(name string) *Ident {
@@ -964,10 +1032,66 @@ func (g *CommentGroup) NumComments() int {
 	return len(g.List)
 }
 
-// Comment represents a single comment.
+// HasPragma returns true if the comment group contains a `# hlb:<name>`
+// directive on a line of its own.
+func (g *CommentGroup) HasPragma(name string) bool {
+	if g == nil {
+		return false
+	}
+	for _, c := range g.List {
+		for _, line := range c.Lines() {
+			if strings.TrimSpace(line) == "hlb:"+name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Comment represents a single comment, which is either a line comment
+// beginning with "#" or "//", or a block comment between "/*" and "*/".
 type Comment struct {
 	Mixin
-	Text string `parser:"@Comment"`
+	Text string `parser:"( @Comment | @( BlockComment BlockCommentText* BlockCommentEnd ) )"`
+}
+
+// Lines returns the lines of text in the comment without its comment markers.
+// Block comments whose lines are all decorated with a leading "*" have the
+// decoration removed.
+func (c *Comment) Lines() []string {
+	text := strings.TrimRight(c.Text, "\r\n")
+	switch {
+	case strings.HasPrefix(text, "#"):
+		return []string{strings.TrimPrefix(text, "#")}
+	case strings.HasPrefix(text, "//"):
+		return []string{strings.TrimPrefix(text, "//")}
+	}
+
+	text = strings.TrimPrefix(text, "/*")
+	text = strings.TrimRight(text, "\r\t ")
+	text = strings.TrimSuffix(text, "*/")
+	lines := strings.Split(text, "\n")
+	if len(lines) > 1 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	if len(lines) > 1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	decorated := len(lines) > 1
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "*") {
+			decorated = false
+			break
+		}
+	}
+	if decorated {
+		for i, line := range lines {
+			line = strings.TrimPrefix(strings.TrimSpace(line), "*")
+			lines[i] = strings.TrimPrefix(line, " ")
+		}
+	}
+	return lines
 }
 
 // Newline represents the "\n" newline.
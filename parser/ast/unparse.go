@@ -2,6 +2,7 @@ package ast
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -63,7 +64,7 @@ func (m *Module) Unparse(opts ...UnparseOption) string {
 
 		if len(prevDecl) > 0 && prevDecl[len(prevDecl)-1] != '\n' {
 			switch {
-			case strings.HasPrefix(str, "#"):
+			case isComment(str):
 				str = fmt.Sprintf(" %s", str)
 			case len(str) == 1:
 				str = fmt.Sprintf("\n%s", str)
@@ -292,8 +293,15 @@ func (bs *BlockStmt) Unparse(opts ...UnparseOption) string {
 		stmts = append(stmts, str)
 	}
 
-	if len(stmts) > 0 && strings.HasPrefix(stmts[0], "#") {
+	switch {
+	case len(stmts) == 0:
+	case isComment(stmts[0]):
 		stmts[0] = fmt.Sprintf(" %s", stmts[0])
+	case len(stmts[0]) > 0:
+		// Blocks that were not parsed, like the blocks built by astbuild, do
+		// not begin with a newline, so their first statement is moved off the
+		// line of the opening brace.
+		stmts = append([]string{""}, stmts...)
 	}
 
 	for i := 1; i < len(stmts); i++ {
@@ -309,6 +317,8 @@ func (s *Stmt) String() string { return s.Unparse() }
 
 func (s *Stmt) Unparse(opts ...UnparseOption) string {
 	switch {
+	case s.From != nil:
+		return s.From.Unparse(opts...)
 	case s.Call != nil:
 		return s.Call.Unparse(opts...)
 	case s.Expr != nil:
@@ -321,6 +331,16 @@ func (s *Stmt) Unparse(opts ...UnparseOption) string {
 	return ""
 }
 
+func (fs *FromStmt) String() string { return fs.Unparse() }
+
+func (fs *FromStmt) Unparse(opts ...UnparseOption) string {
+	end := ""
+	if fs.Terminate != nil {
+		end = fs.Terminate.Unparse(opts...)
+	}
+	return fmt.Sprintf("%s %s%s", fs.From.Unparse(opts...), fs.Expr.Unparse(opts...), end)
+}
+
 func (cs *CallStmt) String() string { return cs.Unparse() }
 
 func (cs *CallStmt) Unparse(opts ...UnparseOption) string {
@@ -332,6 +352,9 @@ func (cs *CallStmt) Unparse(opts ...UnparseOption) string {
 		}
 		args = fmt.Sprintf(" %s", strings.Join(exprs, " "))
 	}
+	if cs.From != nil {
+		args = fmt.Sprintf(" %s%s", cs.From.Unparse(opts...), args)
+	}
 
 	withClause := ""
 	if cs.WithClause != nil && cs.WithClause.Expr != nil {
@@ -450,7 +473,7 @@ func (bl *BasicLit) Unparse(opts ...UnparseOption) string {
 	case bl.Numeric != nil:
 		return bl.Numeric.String()
 	case bl.Bool != nil:
-		return strconv.FormatBool(*bl.Bool)
+		return strconv.FormatBool(bool(*bl.Bool))
 	case bl.Str != nil:
 		return bl.Str.Unparse(opts...)
 	case bl.RawString != nil:
@@ -580,6 +603,9 @@ func (he *HeredocEnd) Unparse(opts ...UnparseOption) string {
 func (i *Interpolated) String() string { return i.Unparse() }
 
 func (i *Interpolated) Unparse(opts ...UnparseOption) string {
+	if i.Expr == nil {
+		return "${}"
+	}
 	return fmt.Sprintf("${%s}", i.Expr.Unparse(opts...))
 }
 
@@ -638,9 +664,15 @@ func (i *Ident) Unparse(opts ...UnparseOption) string {
 	return i.Text
 }
 
+// identRegexp matches the text of identifiers that don't need to be quoted.
+var identRegexp = regexp.MustCompile(`^[\w:]+$`)
+
 func (r *Reference) String() string { return r.Unparse() }
 
 func (r *Reference) Unparse(opts ...UnparseOption) string {
+	if !identRegexp.MatchString(r.Ident.Text) {
+		return fmt.Sprintf(".%q", r.Ident.Text)
+	}
 	return fmt.Sprintf(".%s", r.Ident)
 }
 
@@ -710,11 +742,6 @@ func unparseList(list []Node, opts ...UnparseOption) string {
 	hasNewline := false
 	if !info.NoNewline {
 		for _, stmt := range list {
-			if stmt.Position() == (lexer.Position{}) {
-				hasNewline = true
-				break
-			}
-
 			str := stmt.Unparse(opts...)
 			if len(str) > 0 && str[len(str)-1] == '\n' {
 				hasNewline = true
@@ -746,7 +773,7 @@ func unparseList(list []Node, opts ...UnparseOption) string {
 			}
 			stmts = append(stmts, str)
 			skipNewlines = true
-		} else if strings.HasPrefix(str, "#") {
+		} else if isComment(str) {
 			if skipNewlines {
 				stmts = append(stmts, fmt.Sprintf("%s%s", indent, str))
 			} else {
@@ -778,3 +805,9 @@ func unparseList(list []Node, opts ...UnparseOption) string {
 
 	return fmt.Sprintf("(\n%s\n%s)", strings.Join(stmts, ""), strings.Repeat("\t", info.Indent))
 }
+
+// isComment returns true if an unparsed node is a comment in any of the
+// supported comment styles.
+func isComment(str string) bool {
+	return strings.HasPrefix(str, "#") || strings.HasPrefix(str, "//") || strings.HasPrefix(str, "/*")
+}
@@ -34,6 +34,37 @@ func TestUnparse(t *testing.T) {
 			fs foo() { scratch }
 			`,
 		},
+		{
+			"from",
+			`
+			fs foo(fs base) {
+				from   base
+				run "make"
+			}
+			fs bar() { from fs { image "alpine"; }; run "make"; }
+			`,
+			`
+			fs foo(fs base) {
+				from base
+				run "make"
+			}
+
+			fs bar() { from fs { image "alpine" }; run "make" }
+			`,
+		},
+		{
+			"copy from",
+			`
+			fs foo() {
+				copy   from  bar "/out"   "/"
+			}
+			`,
+			`
+			fs foo() {
+				copy from bar "/out" "/"
+			}
+			`,
+		},
 		{
 			"no space",
 			`
@@ -474,6 +505,31 @@ func TestUnparse(t *testing.T) {
 			fs bar() { scratch }
 			`,
 		},
+		{
+			"comment styles preserved",
+			`
+			// line comment
+			/* block comment */
+			fs foo() { // trailing
+				/*
+				 * decorated
+				 */
+				image "alpine" # hash
+				run "echo hi" /* trailing block */
+			}
+			`,
+			`
+			// line comment
+			/* block comment */
+			fs foo() { // trailing
+				/*
+				 * decorated
+				 */
+				image "alpine" # hash
+				run "echo hi" /* trailing block */
+			}
+			`,
+		},
 		{
 			`heredoc`,
 			`
@@ -628,6 +684,21 @@ func TestUnparse(t *testing.T) {
 			}
 			`,
 		},
+		{
+			`nested call interpolations`,
+			`
+			fs build(string tag) {
+				image "alpine:${format( "%s-%s", tag,format("%s", localArch) )}"
+				mkfile "empty" 0o644 "${}"
+			}
+			`,
+			`
+			fs build(string tag) {
+				image "alpine:${format("%s-%s", tag, format("%s", localArch))}"
+				mkfile "empty" 0o644 "${}"
+			}
+			`,
+		},
 		{
 			`raw strings`,
 			`
@@ -653,6 +724,21 @@ func TestUnparse(t *testing.T) {
 			}
 			`,
 		},
+		{
+			"quoted references",
+			`
+			fs build() {
+				stages."runtime-deps"
+				copy stages.builder "/out" "/"
+			}
+			`,
+			`
+			fs build() {
+				stages."runtime-deps"
+				copy stages.builder "/out" "/"
+			}
+			`,
+		},
 	} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -133,6 +133,8 @@ func (w *walker) walk(node Node, v Visitor) {
 		w.walkStmtList(n.List, v)
 	case *Stmt:
 		switch {
+		case n.From != nil:
+			w.walk(n.From, v)
 		case n.Call != nil:
 			w.walk(n.Call, v)
 		case n.Expr != nil:
@@ -140,10 +142,23 @@ func (w *walker) walk(node Node, v Visitor) {
 		case n.Comments != nil:
 			w.walk(n.Comments, v)
 		}
+	case *FromStmt:
+		if n.From != nil {
+			w.walk(n.From, v)
+		}
+		if n.Expr != nil {
+			w.walk(n.Expr, v)
+		}
+		if n.Terminate != nil {
+			w.walk(n.Terminate, v)
+		}
 	case *CallStmt:
 		if n.Name != nil {
 			w.walk(n.Name, v)
 		}
+		if n.From != nil {
+			w.walk(n.From, v)
+		}
 		w.walkExprList(n.Args, v)
 		if n.WithClause != nil {
 			w.walk(n.WithClause, v)
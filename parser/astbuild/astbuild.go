@@ -0,0 +1,429 @@
+// Package astbuild builds modules programmatically, for tools that generate
+// HLB from structured data instead of templating its source.
+//
+// Builders validate what they build. A module either builds into an AST that
+// passes the checker, or fails with an error naming the invalid construct.
+// Built modules are rendered to source by their String method, like parsed
+// modules are by the formatter.
+package astbuild
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// ModuleBuilder builds a module from its declarations, in the order they are
+// added.
+type ModuleBuilder struct {
+	decls []*moduleDecl
+}
+
+type moduleDecl struct {
+	comment []string
+	imp     *importDecl
+	export  string
+	fun     *FuncBuilder
+}
+
+type importDecl struct {
+	name string
+	from Expr
+}
+
+// Module returns a builder of an empty module.
+func Module() *ModuleBuilder {
+	return &ModuleBuilder{}
+}
+
+// Comment adds a comment between declarations. Every line is written after a
+// "#".
+func (b *ModuleBuilder) Comment(lines ...string) *ModuleBuilder {
+	if len(lines) > 0 {
+		b.decls = append(b.decls, &moduleDecl{comment: lines})
+	}
+	return b
+}
+
+// Import imports a module as name from an expression, like the path of a
+// module or a filesystem containing it.
+func (b *ModuleBuilder) Import(name string, from Expr) *ModuleBuilder {
+	b.decls = append(b.decls, &moduleDecl{imp: &importDecl{name, from}})
+	return b
+}
+
+// Export exports a function or an import of the module.
+func (b *ModuleBuilder) Export(name string) *ModuleBuilder {
+	b.decls = append(b.decls, &moduleDecl{export: name})
+	return b
+}
+
+// Func adds a function declaration and returns its builder.
+func (b *ModuleBuilder) Func(kind ast.Kind, name string) *FuncBuilder {
+	f := &FuncBuilder{
+		BlockBuilder: &BlockBuilder{kind: kind, fun: name},
+		name:         name,
+	}
+	b.decls = append(b.decls, &moduleDecl{fun: f})
+	return f
+}
+
+// Build builds the module and checks it. The module is returned like the
+// parser returns modules, before the checker fills in its semantic data, so
+// that it renders as it was built and is compiled like a parsed module.
+// References to imported modules are not checked, as imports are only
+// resolved when the module is.
+func (b *ModuleBuilder) Build() (*ast.Module, error) {
+	mod, err := b.build()
+	if err != nil {
+		return nil, err
+	}
+
+	// The checker changes the module, so a second build is checked.
+	checked, err := b.build()
+	if err != nil {
+		return nil, err
+	}
+	err = checker.SemanticPass(checked)
+	if err == nil {
+		err = checker.Check(checked)
+	}
+	if err != nil {
+		return nil, checkError(err)
+	}
+	return mod, nil
+}
+
+func (b *ModuleBuilder) build() (*ast.Module, error) {
+	g := &generator{names: make(map[string]ast.Kind)}
+
+	// Functions may be called before they are declared, so every name is
+	// known before any body is built.
+	for _, d := range b.decls {
+		var name string
+		kind := ast.None
+		switch {
+		case d.imp != nil:
+			name = d.imp.name
+		case d.fun != nil:
+			name, kind = d.fun.name, d.fun.kind
+		default:
+			continue
+		}
+		err := checkIdent(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := g.names[name]; ok {
+			return nil, fmt.Errorf("%s is declared more than once", name)
+		}
+		g.names[name] = kind
+	}
+
+	mod := &ast.Module{}
+	for _, d := range b.decls {
+		switch {
+		case d.comment != nil:
+			mod.Decls = appendComment(mod.Decls, d.comment)
+		case d.imp != nil:
+			decl, err := d.imp.decl(g)
+			if err != nil {
+				return nil, fmt.Errorf("import %s: %w", d.imp.name, err)
+			}
+			mod.Decls = appendDecl(mod.Decls, &ast.Decl{Import: decl})
+		case d.export != "":
+			if _, ok := g.names[d.export]; !ok {
+				return nil, fmt.Errorf("export %s: %s is not declared", d.export, d.export)
+			}
+			mod.Decls = appendDecl(mod.Decls, &ast.Decl{
+				Export: &ast.ExportDecl{
+					Export: &ast.Export{Text: "export"},
+					Name:   ast.NewIdent(d.export),
+				},
+			})
+		case d.fun != nil:
+			fd, err := d.fun.decl(g)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", d.fun.kind, d.fun.name, err)
+			}
+			if len(d.fun.doc) > 0 {
+				mod.Decls = appendComment(mod.Decls, d.fun.doc)
+				fd.Doc = mod.Decls[len(mod.Decls)-1].Comments
+			}
+			mod.Decls = appendDecl(mod.Decls, &ast.Decl{Func: fd})
+		}
+	}
+	return mod, nil
+}
+
+// appendComment appends a comment declaration, separated by an empty line
+// from the declaration before it.
+func appendComment(decls []*ast.Decl, lines []string) []*ast.Decl {
+	if n := len(decls); n > 0 && decls[n-1].Newline == nil {
+		decls = append(decls, newlineDecl())
+	}
+	return append(decls, &ast.Decl{Comments: comments(lines)})
+}
+
+// appendDecl appends a declaration. A comment before it is separated by an
+// empty line, unless it is the doc of a function.
+func appendDecl(decls []*ast.Decl, decl *ast.Decl) []*ast.Decl {
+	if n := len(decls); n > 0 && decls[n-1].Comments != nil {
+		if decl.Func == nil || decl.Func.Doc != decls[n-1].Comments {
+			decls = append(decls, newlineDecl())
+		}
+	}
+	return append(decls, decl)
+}
+
+func newlineDecl() *ast.Decl {
+	return &ast.Decl{Newline: &ast.Newline{Text: "\n"}}
+}
+
+func (id *importDecl) decl(g *generator) (*ast.ImportDecl, error) {
+	if id.from == nil {
+		return nil, errors.New("missing module to import")
+	}
+	expr, err := id.from.build(g)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.ImportDecl{
+		Import: &ast.Import{Text: "import"},
+		Name:   ast.NewIdent(id.name),
+		From:   &ast.From{Text: "from"},
+		Expr:   expr,
+	}, nil
+}
+
+// FuncBuilder builds a function declaration. Statements are added to its body
+// with the methods of its BlockBuilder.
+type FuncBuilder struct {
+	*BlockBuilder
+	name    string
+	doc     []string
+	params  []field
+	effects []field
+}
+
+type field struct {
+	kind     ast.Kind
+	name     string
+	variadic bool
+}
+
+// Doc sets the doc comment of the function, which is also where pragmas like
+// "hlb:prewarm" are written.
+func (f *FuncBuilder) Doc(lines ...string) *FuncBuilder {
+	f.doc = lines
+	return f
+}
+
+// Param adds a parameter to the function.
+func (f *FuncBuilder) Param(kind ast.Kind, name string) *FuncBuilder {
+	f.params = append(f.params, field{kind: kind, name: name})
+	return f
+}
+
+// Variadic adds a variadic parameter to the function, which must be its last.
+func (f *FuncBuilder) Variadic(kind ast.Kind, name string) *FuncBuilder {
+	f.params = append(f.params, field{kind: kind, name: name, variadic: true})
+	return f
+}
+
+// Binds adds a side effect to the function, that calls in its body can bind
+// to with CallBuilder.As and CallBuilder.Bind.
+func (f *FuncBuilder) Binds(kind ast.Kind, name string) *FuncBuilder {
+	f.effects = append(f.effects, field{kind: kind, name: name})
+	return f
+}
+
+func (f *FuncBuilder) decl(g *generator) (*ast.FuncDecl, error) {
+	err := checkKind(f.kind)
+	if err != nil {
+		return nil, err
+	}
+
+	g.locals = make(map[string]struct{})
+	params, err := g.fields("parameter", f.params)
+	if err != nil {
+		return nil, err
+	}
+	for i, param := range f.params {
+		if param.variadic && i != len(f.params)-1 {
+			return nil, fmt.Errorf("variadic parameter %s must be the last", param.name)
+		}
+	}
+	effects, err := g.fields("side effect", f.effects)
+	if err != nil {
+		return nil, err
+	}
+	f.bindTargets(g.locals)
+
+	body, err := f.block(g, f.kind)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &ast.FuncSignature{
+		Type:   ast.NewType(f.kind),
+		Name:   ast.NewIdent(f.name),
+		Params: ast.NewFieldList(params...),
+	}
+	if len(effects) > 0 {
+		sig.Effects = ast.NewEffectsClause(effects...)
+	}
+	return &ast.FuncDecl{Sig: sig, Body: body}, nil
+}
+
+// generator holds what is known about a module while it is built.
+type generator struct {
+	// names are the kinds of the functions of the module, and of its imports
+	// with the kind none.
+	names map[string]ast.Kind
+
+	// locals are the names of the function being built that may shadow the
+	// functions of the module and builtins.
+	locals map[string]struct{}
+}
+
+// fields builds the parameters or side effects of a function, which share
+// their scope.
+func (g *generator) fields(what string, fields []field) ([]*ast.Field, error) {
+	var afs []*ast.Field
+	for _, f := range fields {
+		err := checkIdent(f.name)
+		if err != nil {
+			return nil, err
+		}
+		err = checkKind(f.kind)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", what, f.name, err)
+		}
+		if _, ok := g.locals[f.name]; ok {
+			return nil, fmt.Errorf("duplicate %s %s", what, f.name)
+		}
+		g.locals[f.name] = struct{}{}
+		afs = append(afs, ast.NewField(f.kind, f.name, f.variadic))
+	}
+	return afs, nil
+}
+
+// checkCall checks that a call can be a statement of a block of a kind, when
+// it calls a function of the module or a builtin. Other calls are left to the
+// checker.
+func (g *generator) checkCall(name string, kind ast.Kind) error {
+	if strings.Contains(name, ".") {
+		return nil
+	}
+	if _, ok := g.locals[name]; ok {
+		return nil
+	}
+	if fk, ok := g.names[name]; ok {
+		if fk != ast.None && fk != kind {
+			return fmt.Errorf("cannot call %s function %s in %s block", fk, name, kind)
+		}
+		return nil
+	}
+
+	// The kind of an option block is only known when it is used with a call.
+	if kind == ast.Option {
+		return nil
+	}
+	if _, ok := builtin.Lookup.ByKind[kind].Func[name]; ok {
+		return nil
+	}
+	for _, lookup := range builtin.Lookup.ByKind {
+		if _, ok := lookup.Func[name]; ok {
+			return fmt.Errorf("%s is not a %s builtin", name, kind)
+		}
+	}
+	return nil
+}
+
+var (
+	// identRegexp matches names that can be written as identifiers.
+	identRegexp = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+	keywords = map[string]struct{}{
+		"import":   {},
+		"export":   {},
+		"from":     {},
+		"with":     {},
+		"as":       {},
+		"binds":    {},
+		"variadic": {},
+		"true":     {},
+		"false":    {},
+	}
+
+	kinds = map[ast.Kind]struct{}{
+		ast.String:     {},
+		ast.Int:        {},
+		ast.Bool:       {},
+		ast.Filesystem: {},
+		ast.Pipeline:   {},
+		ast.Option:     {},
+	}
+)
+
+func checkIdent(name string) error {
+	if !identRegexp.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	if _, ok := keywords[name]; ok {
+		return fmt.Errorf("invalid name %q, it is a keyword", name)
+	}
+	return nil
+}
+
+// checkKind checks that a kind is a type of the language. Only options have a
+// secondary kind, like `option::run`.
+func checkKind(kind ast.Kind) error {
+	if _, ok := kinds[kind.Primary()]; !ok {
+		return fmt.Errorf("invalid kind %q", kind)
+	}
+	secondary := kind.Secondary()
+	if secondary == ast.None {
+		return nil
+	}
+	if kind.Primary() != ast.Option || !identRegexp.MatchString(string(secondary)) || kind != ast.Kind(fmt.Sprintf("%s::%s", ast.Option, secondary)) {
+		return fmt.Errorf("invalid kind %q", kind)
+	}
+	return nil
+}
+
+// comments returns a comment group with a line comment for every line.
+func comments(lines []string) *ast.CommentGroup {
+	cg := &ast.CommentGroup{}
+	for _, line := range lines {
+		for _, l := range strings.Split(line, "\n") {
+			text := "#\n"
+			if l != "" {
+				text = fmt.Sprintf("# %s\n", l)
+			}
+			cg.List = append(cg.List, &ast.Comment{Text: text})
+		}
+	}
+	return cg
+}
+
+// checkError returns the errors of the checker without their positions, which
+// are meaningless for modules that were not parsed.
+func checkError(err error) error {
+	spans := diagnostic.Spans(err)
+	if len(spans) == 0 {
+		return err
+	}
+	msgs := make([]string, len(spans))
+	for i, span := range spans {
+		msgs[i] = span.Err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,375 @@
+package astbuild
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files of built modules")
+
+// roundTrip renders a built module, and checks that parsing the source gives
+// a module that passes the checker and renders the same source.
+func roundTrip(t *testing.T, mod *ast.Module) string {
+	src := mod.String()
+	parsed, err := parser.Parse(context.Background(), strings.NewReader(src))
+	require.NoError(t, err, src)
+	require.Equal(t, src, parsed.String())
+	require.NoError(t, checker.SemanticPass(parsed))
+	require.NoError(t, checker.Check(parsed))
+	return src
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name  string
+		build func() *ModuleBuilder
+	}
+
+	for _, tc := range []testCase{{
+		"funcs",
+		func() *ModuleBuilder {
+			b := Module()
+			b.Comment("Generated by a test.")
+			f := b.Func(ast.Filesystem, "app").Doc("app builds the app.", "hlb:prewarm")
+			f.Call("image", Str("alpine"))
+			f.Call("run", Str("apk add -U git")).With(Option().Call("ignoreCache"))
+			f.Call("mkfile", Str("/mode"), Numeric(0o644, 8), Call("version", Int(3), Bool(true)))
+			f = b.Func(ast.String, "version").Param(ast.Int, "major").Param(ast.Bool, "stable")
+			f.Call("format", Str("v%d.0 %t"), Ident("major"), Ident("stable"))
+			f = b.Func(ast.Filesystem, "dist").Variadic(ast.String, "paths")
+			f.From(Ident("app"))
+			f.Comment("Copy the app from its stage.")
+			f.CopyFrom("app", Str("/app"), Str("/dist"))
+			return b.Export("app").Export("dist")
+		},
+	}, {
+		"imports",
+		func() *ModuleBuilder {
+			b := Module()
+			b.Import("go", Str("./go.hlb"))
+			b.Import("tools", FuncLit(ast.Filesystem).Call("image", Str("openllb/tools")))
+			f := b.Func(ast.Filesystem, "build")
+			f.Call("go.build", Ident("tools.src"))
+			f.Call("copy", Ident("tools.build stage"), Str("/"), Str("/tools"))
+			return b.Export("go")
+		},
+	}, {
+		"strings",
+		func() *ModuleBuilder {
+			b := Module()
+			b.Func(ast.String, "escaped").Value(Str("a \"quoted\" \\ ${not} $HOME\n\ttab"))
+			b.Func(ast.String, "raw").Value(RawStr(`C:\path "${raw}"`))
+			b.Func(ast.String, "interpolated").Param(ast.String, "name").
+				Value(StrOf(Text("${"), Interp(Ident("name")), Text(":"), Text("$"), Interp(Call("localEnv", Str("TAG"))))).
+				Call("format", Str("%s!"), Ident("name"))
+			return b
+		},
+	}, {
+		"heredocs",
+		func() *ModuleBuilder {
+			b := Module()
+			f := b.Func(ast.Filesystem, "app").Param(ast.String, "pkg")
+			f.Call("image", Str("alpine"))
+			f.Call("run", Heredoc(HeredocFold,
+				Text("apk add -U\n"),
+				Interp(Ident("pkg")),
+				Text(" ${literal}\nEOF EOF1"),
+			))
+			f.Call("mkfile", Str("/script.sh"), Numeric(0o755, 8), Heredoc(HeredocLiteral,
+				Text("#!/bin/sh\ncat <<EOF\n  $HOME \\n\nEOF"),
+			))
+			f.Call("mkfile", Str("/raw"), Numeric(0o644, 8), RawHeredoc(HeredocDedent, "\t${not} `EOF`\n\t\\$ EOF1EOF2"))
+			return b
+		},
+	}, {
+		"binds",
+		func() *ModuleBuilder {
+			b := Module()
+			f := b.Func(ast.Filesystem, "app").Binds(ast.String, "digest").Binds(ast.Filesystem, "out")
+			f.Call("image", Str("alpine"))
+			f.Call("run", Str("make")).With(Option().
+				Call("mount", Call("scratch"), Str("/out")).As("out"),
+			)
+			f.Call("dockerPush", Str("example.com/app")).Bind("digest", "appDigest")
+			f.Call("env", Str("DIGEST"), Ident("appDigest"))
+			return b
+		},
+	}, {
+		"comments",
+		func() *ModuleBuilder {
+			b := Module()
+			f := b.Func(ast.Filesystem, "app")
+			f.Comment("The base image.")
+			f.Call("image", Str("alpine"))
+			f.Call("run", Str("make")).With(Option().
+				Comment("Builds are cached.").
+				Call("mount", Call("scratch"), Str("/root/.cache")),
+			)
+			return b
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mod, err := tc.build().Build()
+			require.NoError(t, err)
+			src := roundTrip(t, mod)
+
+			golden := filepath.Join("testdata", tc.name+".hlb")
+			if *update {
+				err = os.WriteFile(golden, []byte(src), 0o644)
+				require.NoError(t, err)
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			require.Equal(t, string(expected), src)
+		})
+	}
+}
+
+func TestBuildHeredocValue(t *testing.T) {
+	t.Parallel()
+
+	// The terminator of a heredoc is never in its text, and a backslash
+	// before a $ cannot be written.
+	b := Module()
+	b.Func(ast.String, "s").Value(Heredoc(HeredocLiteral, Text("EOF\nEOF1")))
+	mod, err := b.Build()
+	require.NoError(t, err)
+	lit := mod.Decls[0].Func.Body.List[0].Expr.Expr.BasicLit.Heredoc
+	require.Equal(t, "<<EOF2", lit.Start)
+	require.Equal(t, "EOF2", lit.Terminate.Text)
+
+	b = Module()
+	b.Func(ast.String, "s").Value(Heredoc(HeredocLiteral, Text(`\`), Interp(Str("x"))))
+	_, err = b.Build()
+	require.EqualError(t, err, "string s: heredoc text cannot contain a backslash before $, use RawHeredoc")
+}
+
+func TestBuildErrors(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name     string
+		build    func(b *ModuleBuilder)
+		expected string
+	}
+
+	for _, tc := range []testCase{{
+		"duplicate param",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Param(ast.String, "a").Param(ast.Int, "a").Call("scratch")
+		},
+		"fs app: duplicate parameter a",
+	}, {
+		"duplicate side effect",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Param(ast.String, "a").Binds(ast.String, "a").Call("scratch")
+		},
+		"fs app: duplicate side effect a",
+	}, {
+		"variadic not last",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Variadic(ast.String, "a").Param(ast.Int, "b").Call("scratch")
+		},
+		"fs app: variadic parameter a must be the last",
+	}, {
+		"duplicate func",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Call("scratch")
+			b.Func(ast.String, "app").Value(Str("app"))
+		},
+		"app is declared more than once",
+	}, {
+		"invalid name",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "my-app").Call("scratch")
+		},
+		`invalid name "my-app"`,
+	}, {
+		"keyword",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Param(ast.String, "from").Call("scratch")
+		},
+		`fs app: invalid name "from", it is a keyword`,
+	}, {
+		"invalid kind",
+		func(b *ModuleBuilder) {
+			b.Func("file", "app")
+		},
+		`file app: invalid kind "file"`,
+	}, {
+		"builtin of another kind",
+		func(b *ModuleBuilder) {
+			b.Func(ast.String, "s").Call("run", Str("make"))
+		},
+		"string s: run: run is not a string builtin",
+	}, {
+		"option of another call",
+		func(b *ModuleBuilder) {
+			opts := Option()
+			opts.Call("resolve")
+			opts.Call("dir", Str("/"))
+			b.Func(ast.Filesystem, "app").Call("image", Str("alpine")).With(opts)
+		},
+		"fs app: image: with: option::image block: dir: dir is not a option::image builtin",
+	}, {
+		"func of another kind",
+		func(b *ModuleBuilder) {
+			b.Func(ast.String, "s").Value(Str("s"))
+			b.Func(ast.Filesystem, "app").Call("s")
+		},
+		"fs app: s: cannot call string function s in fs block",
+	}, {
+		"value of another kind",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Value(Str("alpine"))
+		},
+		"fs app: cannot use string value in fs block",
+	}, {
+		"from in string block",
+		func(b *ModuleBuilder) {
+			b.Func(ast.String, "s").From(Call("scratch"))
+		},
+		"string s: from cannot be used in string block",
+	}, {
+		"from not first",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Call("scratch").From(Call("scratch"))
+		},
+		"fs app: from must be the first statement of its block",
+	}, {
+		"copy from string",
+		func(b *ModuleBuilder) {
+			b.Func(ast.String, "s").Value(Str("s"))
+			b.Func(ast.Filesystem, "app").CopyFrom("s", Str("/"), Str("/"))
+		},
+		"fs app: copy: stage s is not a fs function of the module",
+	}, {
+		"as and bind",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Call("scratch").As("a").Bind("b", "c")
+		},
+		"fs app: scratch: cannot bind both the default side effect and a list of side effects",
+	}, {
+		"raw string",
+		func(b *ModuleBuilder) {
+			b.Func(ast.String, "s").Value(RawStr("`"))
+		},
+		"string s: invalid raw string \"`\", it contains a backtick",
+	}, {
+		"negative int",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Int, "i").Value(Int(-1))
+		},
+		"int i: invalid int literal -1, it is negative",
+	}, {
+		"func as expression",
+		func(b *ModuleBuilder) {
+			app := b.Func(ast.Filesystem, "app")
+			app.Call("scratch")
+			b.Func(ast.Filesystem, "copy").Call("copy", app, Str("/"), Str("/"))
+		},
+		`fs copy: copy: function app cannot be used as an expression, use Ident("app")`,
+	}, {
+		"export undeclared",
+		func(b *ModuleBuilder) {
+			b.Export("app")
+		},
+		"export app: app is not declared",
+	}, {
+		"checker",
+		func(b *ModuleBuilder) {
+			b.Func(ast.Filesystem, "app").Call("image")
+		},
+		"`image` expected 1 args, found 0",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := Module()
+			tc.build(b)
+			_, err := b.Build()
+			require.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+type service struct {
+	Name    string
+	Image   string
+	Port    int
+	Env     map[string]string
+	Deps    []string
+	Command string
+}
+
+// TestBuildServices builds a module for fifty services from structured data,
+// like a tool generating the build of a monorepo would.
+func TestBuildServices(t *testing.T) {
+	t.Parallel()
+
+	var services []service
+	for i := 0; i < 50; i++ {
+		svc := service{
+			Name:    fmt.Sprintf("service%02d", i),
+			Image:   "golang:1.17-alpine",
+			Port:    8000 + i,
+			Env:     map[string]string{"GOFLAGS": "-mod=mod"},
+			Command: fmt.Sprintf("go build -o /out/service%02d ./cmd/service%02d", i, i),
+		}
+		if i > 0 {
+			svc.Deps = []string{services[i-1].Name}
+		}
+		services = append(services, svc)
+	}
+
+	b := Module()
+	b.Comment("Code generated from services; DO NOT EDIT.")
+	for _, svc := range services {
+		f := b.Func(ast.Filesystem, svc.Name).Doc(fmt.Sprintf("%s listens on port %d.", svc.Name, svc.Port))
+		f.Call("image", Str(svc.Image))
+		for k, v := range svc.Env {
+			f.Call("env", Str(k), Str(v))
+		}
+		for _, dep := range svc.Deps {
+			f.CopyFrom(dep, Str("/out"), Str("/out"))
+		}
+		cache := Option()
+		cache.Call("cache", Str("go-build"), Str("shared"))
+		opts := Option()
+		opts.Call("dir", Str("/src"))
+		opts.Call("mount", Call("local", Str(".")), Str("/src"))
+		opts.Call("mount", Call("scratch"), Str("/root/.cache/go-build")).With(cache)
+		f.Call("run", Str(svc.Command)).With(opts)
+		f.Call("expose", StrOf(Interp(Call("format", Str("%d"), Int(svc.Port))), Text("/tcp")))
+		b.Export(svc.Name)
+	}
+
+	mod, err := b.Build()
+	require.NoError(t, err)
+	roundTrip(t, mod)
+
+	var funcs int
+	for _, decl := range mod.Decls {
+		if decl.Func != nil {
+			require.Equal(t, fmt.Sprintf("%s listens on port %d.", decl.Func.Sig.Name, services[funcs].Port), strings.TrimSpace(decl.Func.Doc.List[0].Text[1:]))
+			funcs++
+		}
+	}
+	require.Equal(t, len(services), funcs)
+}
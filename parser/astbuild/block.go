@@ -0,0 +1,337 @@
+package astbuild
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// BlockBuilder builds the statements of a function body or of a function
+// literal.
+type BlockBuilder struct {
+	kind  ast.Kind
+	stmts []*stmt
+
+	// fun is the name of the function whose body is built, if any.
+	fun string
+}
+
+type stmt struct {
+	from    Expr
+	call    *CallBuilder
+	value   Expr
+	comment []string
+}
+
+// FuncLit returns a builder of a function literal of a kind, like the
+// `fs { ... }` argument of a call.
+func FuncLit(kind ast.Kind) *BlockBuilder {
+	return &BlockBuilder{kind: kind}
+}
+
+// Option returns a builder of an option block. Used with CallBuilder.With, its
+// kind is the kind of the options of the call, like `option::run`.
+func Option() *BlockBuilder {
+	return FuncLit(ast.Option)
+}
+
+// From starts a filesystem block from the value of an expression. It must be
+// the first statement of the block.
+func (bb *BlockBuilder) From(e Expr) *BlockBuilder {
+	bb.stmts = append(bb.stmts, &stmt{from: e})
+	return bb
+}
+
+// Call adds a call statement and returns its builder, which also adds
+// statements to the block after it. Names of the form "name.member" call the
+// members of imported modules.
+func (bb *BlockBuilder) Call(name string, args ...Expr) *CallBuilder {
+	cb := &CallBuilder{BlockBuilder: bb, name: name, args: args}
+	bb.stmts = append(bb.stmts, &stmt{call: cb})
+	return cb
+}
+
+// CopyFrom adds a copy from the stage of a filesystem function of the module,
+// like `copy from build "/out" "/"`.
+func (bb *BlockBuilder) CopyFrom(stage string, args ...Expr) *CallBuilder {
+	cb := &CallBuilder{
+		BlockBuilder: bb,
+		name:         "copy",
+		stage:        stage,
+		args:         args,
+	}
+	bb.stmts = append(bb.stmts, &stmt{call: cb})
+	return cb
+}
+
+// Value adds an expression statement, like the string literal that is the
+// value of a string function.
+func (bb *BlockBuilder) Value(e Expr) *BlockBuilder {
+	bb.stmts = append(bb.stmts, &stmt{value: e})
+	return bb
+}
+
+// Comment adds a comment. A comment right before a call is its doc.
+func (bb *BlockBuilder) Comment(lines ...string) *BlockBuilder {
+	if len(lines) > 0 {
+		bb.stmts = append(bb.stmts, &stmt{comment: lines})
+	}
+	return bb
+}
+
+func (bb *BlockBuilder) build(g *generator) (*ast.Expr, error) {
+	if bb.fun != "" {
+		return nil, fmt.Errorf("function %s cannot be used as an expression, use Ident(%q)", bb.fun, bb.fun)
+	}
+	return bb.lit(g, bb.kind)
+}
+
+// asBlock returns the block of an expression built by FuncLit or Option,
+// including after adding a call to it.
+func asBlock(e Expr) (*BlockBuilder, bool) {
+	switch b := e.(type) {
+	case *BlockBuilder:
+		return b, true
+	case *CallBuilder:
+		return b.BlockBuilder, true
+	}
+	return nil, false
+}
+
+// lit builds the block as a function literal whose statements are of a kind,
+// which is inferred from its call for option blocks.
+func (bb *BlockBuilder) lit(g *generator, kind ast.Kind) (*ast.Expr, error) {
+	err := checkKind(bb.kind)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bb.block(g, kind)
+	if err != nil {
+		return nil, fmt.Errorf("%s block: %w", kind, err)
+	}
+	return &ast.Expr{
+		FuncLit: &ast.FuncLit{
+			Type: ast.NewType(bb.kind),
+			Body: body,
+		},
+	}, nil
+}
+
+func (bb *BlockBuilder) block(g *generator, kind ast.Kind) (*ast.BlockStmt, error) {
+	var (
+		block = &ast.BlockStmt{}
+		doc   *ast.CommentGroup
+		first = true
+	)
+	for _, s := range bb.stmts {
+		var as *ast.Stmt
+		switch {
+		case s.comment != nil:
+			// Like the parser, a comment on the first line of a block is
+			// after a newline, so that it is not written after the brace.
+			if len(block.List) == 0 {
+				block.List = append(block.List, &ast.Stmt{Newline: &ast.Newline{Text: "\n"}})
+			}
+			doc = comments(s.comment)
+			block.List = append(block.List, &ast.Stmt{Comments: doc})
+			continue
+		case s.from != nil:
+			if kind.Primary() != ast.Filesystem {
+				return nil, fmt.Errorf("from cannot be used in %s block", kind)
+			}
+			if !first {
+				return nil, errors.New("from must be the first statement of its block")
+			}
+			expr, err := s.from.build(g)
+			if err != nil {
+				return nil, fmt.Errorf("from: %w", err)
+			}
+			as = &ast.Stmt{
+				From: &ast.FromStmt{
+					From: &ast.From{Text: "from"},
+					Expr: expr,
+				},
+			}
+		case s.call != nil:
+			call, err := s.call.stmt(g, kind)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", s.call.name, err)
+			}
+			call.Doc = doc
+			as = &ast.Stmt{Call: call}
+		case s.value != nil:
+			expr, err := s.value.build(g)
+			if err != nil {
+				return nil, err
+			}
+			if k := expr.Kind(); k != ast.None && k.Primary() != kind.Primary() {
+				return nil, fmt.Errorf("cannot use %s value in %s block", k, kind)
+			}
+
+			// An identifier is parsed as a call without arguments, and a
+			// call with a list of arguments cannot be a statement.
+			if ce := expr.CallExpr; ce != nil {
+				if ce.List != nil {
+					return nil, fmt.Errorf("cannot use call expression %s as a statement, use Call", ce.Name)
+				}
+				name := ce.Name.String()
+				err = g.checkCall(name, kind)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				as = &ast.Stmt{Call: &ast.CallStmt{Doc: doc, Name: ce.Name}}
+				break
+			}
+			as = &ast.Stmt{
+				Expr: &ast.ExprStmt{
+					Expr:      expr,
+					Terminate: &ast.StmtEnd{Newline: &ast.Newline{Text: "\n"}},
+				},
+			}
+		}
+		block.List = append(block.List, as)
+		doc, first = nil, false
+	}
+	return block, nil
+}
+
+// bindTargets adds the targets bound by the calls of the block to targets.
+func (bb *BlockBuilder) bindTargets(targets map[string]struct{}) {
+	for _, s := range bb.stmts {
+		if s.call == nil {
+			continue
+		}
+		if s.call.as != "" {
+			targets[s.call.as] = struct{}{}
+		}
+		for _, b := range s.call.binds {
+			targets[b.target] = struct{}{}
+		}
+		if lit, ok := asBlock(s.call.with); ok {
+			lit.bindTargets(targets)
+		}
+	}
+}
+
+// CallBuilder builds a call statement. Statements added with the methods of
+// its BlockBuilder are added to the block of the call, after it, and the call
+// is an expression for the block, so that an option block is built in a
+// single expression like `Option().Call("dir", Str("/src")).Call("ignoreCache")`.
+type CallBuilder struct {
+	*BlockBuilder
+	name  string
+	stage string
+	args  []Expr
+	with  Expr
+	as    string
+	binds []bind
+}
+
+type bind struct {
+	source, target string
+}
+
+// With sets the with clause of the call, usually an option block.
+func (cb *CallBuilder) With(e Expr) *CallBuilder {
+	cb.with = e
+	return cb
+}
+
+// As binds the default side effect of the call to target.
+func (cb *CallBuilder) As(target string) *CallBuilder {
+	cb.as = target
+	return cb
+}
+
+// Bind binds the side effect source of the call to target. A call either binds
+// its default side effect with As, or a list of side effects with Bind.
+func (cb *CallBuilder) Bind(source, target string) *CallBuilder {
+	cb.binds = append(cb.binds, bind{source, target})
+	return cb
+}
+
+func (cb *CallBuilder) stmt(g *generator, kind ast.Kind) (*ast.CallStmt, error) {
+	ie, err := identExpr(cb.name)
+	if err != nil {
+		return nil, err
+	}
+	err = g.checkCall(cb.name, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	call := &ast.CallStmt{Name: ie}
+	if cb.stage != "" {
+		err = checkIdent(cb.stage)
+		if err != nil {
+			return nil, err
+		}
+		if fk, ok := g.names[cb.stage]; !ok || fk != ast.Filesystem {
+			return nil, fmt.Errorf("stage %s is not a fs function of the module", cb.stage)
+		}
+		call.From = &ast.From{Text: "from"}
+		call.Args = append(call.Args, identCallExpr(ast.NewIdentExpr(cb.stage), nil))
+	}
+	for _, arg := range cb.args {
+		if arg == nil {
+			return nil, errors.New("missing argument")
+		}
+		expr, err := arg.build(g)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, expr)
+	}
+
+	if cb.with != nil {
+		var expr *ast.Expr
+		if lit, ok := asBlock(cb.with); ok && lit.kind == ast.Option {
+			expr, err = lit.lit(g, ast.Kind(fmt.Sprintf("%s::%s", ast.Option, ie.Ident)))
+		} else {
+			expr, err = cb.with.build(g)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("with: %w", err)
+		}
+		call.WithClause = &ast.WithClause{
+			With: &ast.With{Text: "with"},
+			Expr: expr,
+		}
+	}
+
+	switch {
+	case cb.as != "" && len(cb.binds) > 0:
+		return nil, errors.New("cannot bind both the default side effect and a list of side effects")
+	case cb.as != "":
+		err = checkIdent(cb.as)
+		if err != nil {
+			return nil, err
+		}
+		call.BindClause = &ast.BindClause{
+			As:    &ast.As{Text: "as"},
+			Ident: ast.NewIdent(cb.as),
+		}
+	case len(cb.binds) > 0:
+		list := &ast.BindList{}
+		for _, b := range cb.binds {
+			for _, name := range []string{b.source, b.target} {
+				err = checkIdent(name)
+				if err != nil {
+					return nil, err
+				}
+			}
+			list.Stmts = append(list.Stmts, &ast.BindStmt{
+				Bind: &ast.Bind{
+					Source: ast.NewIdent(b.source),
+					Target: ast.NewIdent(b.target),
+				},
+			})
+		}
+		call.BindClause = &ast.BindClause{
+			As:    &ast.As{Text: "as"},
+			Binds: list,
+		}
+	}
+	return call, nil
+}
@@ -0,0 +1,420 @@
+package astbuild
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/openllb/hlb/parser/ast"
+)
+
+// Expr is an expression built by this package, like the argument of a call.
+// Function literals built by FuncLit and Option are expressions too.
+type Expr interface {
+	build(g *generator) (*ast.Expr, error)
+}
+
+type exprFunc func(g *generator) (*ast.Expr, error)
+
+func (fn exprFunc) build(g *generator) (*ast.Expr, error) {
+	return fn(g)
+}
+
+func basicLit(lit *ast.BasicLit) Expr {
+	return exprFunc(func(*generator) (*ast.Expr, error) {
+		// Every use of an expression is its own node.
+		l := *lit
+		return &ast.Expr{BasicLit: &l}, nil
+	})
+}
+
+func errExpr(err error) Expr {
+	return exprFunc(func(*generator) (*ast.Expr, error) {
+		return nil, err
+	})
+}
+
+// Int returns an int literal. Negative ints cannot be written as literals.
+func Int(v int) Expr {
+	if v < 0 {
+		return errExpr(fmt.Errorf("invalid int literal %d, it is negative", v))
+	}
+	return basicLit(&ast.BasicLit{Decimal: &v})
+}
+
+// Numeric returns an int literal written in base 2, 8 or 16, like the 0o755
+// mode of a file.
+func Numeric(v int64, base int) Expr {
+	switch {
+	case v < 0:
+		return errExpr(fmt.Errorf("invalid int literal %d, it is negative", v))
+	case base != 2 && base != 8 && base != 16:
+		return errExpr(fmt.Errorf("invalid base %d of int literal, expected 2, 8 or 16", base))
+	}
+	return basicLit(&ast.BasicLit{
+		Numeric: &ast.NumericLit{Value: v, Base: base},
+	})
+}
+
+// Bool returns a bool literal.
+func Bool(v bool) Expr {
+	lit := ast.BoolLit(v)
+	return basicLit(&ast.BasicLit{Bool: &lit})
+}
+
+// Ident returns an identifier, like a parameter or a function of the module
+// without arguments. Names of the form "name.member" refer to the members of
+// imported modules.
+func Ident(name string) Expr {
+	return exprFunc(func(*generator) (*ast.Expr, error) {
+		ie, err := identExpr(name)
+		if err != nil {
+			return nil, err
+		}
+		return identCallExpr(ie, nil), nil
+	})
+}
+
+// Call returns a call expression, like `localEnv("HOME")`.
+func Call(name string, args ...Expr) Expr {
+	return exprFunc(func(g *generator) (*ast.Expr, error) {
+		ie, err := identExpr(name)
+		if err != nil {
+			return nil, err
+		}
+		list := &ast.ExprList{}
+		for _, arg := range args {
+			if arg == nil {
+				return nil, fmt.Errorf("%s: missing argument", name)
+			}
+			expr, err := arg.build(g)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			list.Fields = append(list.Fields, &ast.ExprField{Expr: expr})
+		}
+		return identCallExpr(ie, list), nil
+	})
+}
+
+func identCallExpr(ie *ast.IdentExpr, list *ast.ExprList) *ast.Expr {
+	return &ast.Expr{
+		CallExpr: &ast.CallExpr{
+			Name: ie,
+			List: list,
+		},
+	}
+}
+
+// identExpr returns the identifier of a name, which may refer to the member of
+// an imported module. Members are quoted when they are not identifiers, like
+// the stages of a Dockerfile.
+func identExpr(name string) (*ast.IdentExpr, error) {
+	ident, member := name, ""
+	dot := strings.Index(name, ".")
+	if dot >= 0 {
+		ident, member = name[:dot], name[dot+1:]
+	}
+	err := checkIdent(ident)
+	if err != nil {
+		return nil, err
+	}
+	ie := ast.NewIdentExpr(ident)
+	if dot >= 0 {
+		if member == "" || strings.ContainsAny(member, "\"\n") {
+			return nil, fmt.Errorf("invalid member %q of %s", member, ident)
+		}
+		ie.Reference = &ast.Reference{
+			Dot:   ".",
+			Ident: ast.NewIdent(member),
+		}
+	}
+	return ie, nil
+}
+
+// Piece is a piece of an interpolated string or heredoc, either text or an
+// interpolated expression.
+type Piece struct {
+	text string
+	expr Expr
+}
+
+// Text returns a piece of text, which is escaped as needed.
+func Text(s string) Piece {
+	return Piece{text: s}
+}
+
+// Interp returns an interpolated expression, like `${name}`.
+func Interp(e Expr) Piece {
+	return Piece{expr: e}
+}
+
+// mergeText merges consecutive pieces of text, so that they are escaped
+// together.
+func mergeText(pieces []Piece) []Piece {
+	var merged []Piece
+	for _, p := range pieces {
+		n := len(merged)
+		if p.expr == nil && n > 0 && merged[n-1].expr == nil {
+			merged[n-1].text += p.text
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+func interpolated(g *generator, e Expr) (*ast.Interpolated, error) {
+	if e == nil {
+		return nil, errors.New("missing interpolated expression")
+	}
+	expr, err := e.build(g)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.Interpolated{
+		Start:     &ast.OpenInterpolated{Text: "${"},
+		Expr:      expr,
+		Terminate: &ast.CloseBrace{Text: "}"},
+	}, nil
+}
+
+// Str returns a string literal.
+func Str(s string) Expr {
+	return StrOf(Text(s))
+}
+
+// StrOf returns a string literal interpolating expressions between pieces of
+// text, like `"${name}:latest"`.
+func StrOf(pieces ...Piece) Expr {
+	return exprFunc(func(g *generator) (*ast.Expr, error) {
+		var fragments []*ast.StringFragment
+		for _, p := range mergeText(pieces) {
+			if p.expr == nil {
+				fragments = append(fragments, stringFragments(p.text)...)
+				continue
+			}
+			interp, err := interpolated(g, p.expr)
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, &ast.StringFragment{Interpolated: interp})
+		}
+		return &ast.Expr{
+			BasicLit: &ast.BasicLit{
+				Str: &ast.StringLit{
+					Start:     &ast.Quote{Text: `"`},
+					Fragments: fragments,
+					Terminate: &ast.Quote{Text: `"`},
+				},
+			},
+		}, nil
+	})
+}
+
+// stringFragments returns the fragments of text in a string literal, escaping
+// quotes, backslashes, control characters and interpolations.
+func stringFragments(s string) []*ast.StringFragment {
+	var (
+		fragments []*ast.StringFragment
+		text      strings.Builder
+	)
+	flush := func() {
+		if text.Len() > 0 {
+			t := text.String()
+			fragments = append(fragments, &ast.StringFragment{Text: &t})
+			text.Reset()
+		}
+	}
+	escape := func(escaped string) {
+		flush()
+		fragments = append(fragments, &ast.StringFragment{Escaped: &escaped})
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			escape(`\"`)
+		case c == '\\':
+			escape(`\\`)
+		case c == '\n':
+			escape(`\n`)
+		case c == '\r':
+			escape(`\r`)
+		case c == '\t':
+			escape(`\t`)
+		case c == '$' && i+1 < len(s) && s[i+1] == '{':
+			escape(`\$`)
+		default:
+			text.WriteByte(c)
+		}
+	}
+	flush()
+	return fragments
+}
+
+// RawStr returns a raw string literal, whose text is not escaped or
+// interpolated. It cannot be empty or contain backticks.
+func RawStr(s string) Expr {
+	switch {
+	case s == "":
+		return errExpr(errors.New("invalid raw string, it is empty"))
+	case strings.Contains(s, "`"):
+		return errExpr(fmt.Errorf("invalid raw string %q, it contains a backtick", s))
+	}
+	return basicLit(&ast.BasicLit{
+		RawString: &ast.RawStringLit{
+			Start:     &ast.Backtick{Text: "`"},
+			Text:      s,
+			Terminate: &ast.Backtick{Text: "`"},
+		},
+	})
+}
+
+// HeredocStyle is how the lines of a heredoc make up its value.
+type HeredocStyle string
+
+const (
+	// HeredocLiteral keeps the lines of the heredoc as they are.
+	HeredocLiteral HeredocStyle = "<<"
+
+	// HeredocDedent removes the whitespace common to the start of every line.
+	HeredocDedent HeredocStyle = "<<-"
+
+	// HeredocFold joins the lines with spaces after trimming them.
+	HeredocFold HeredocStyle = "<<~"
+)
+
+// Heredoc returns a heredoc interpolating expressions between pieces of text.
+// The text is written on its own lines, and its terminator is chosen to not
+// appear in it. Like heredocs written by hand, leading newlines and trailing
+// newlines and tabs are not part of its value.
+//
+// Interpolations are escaped, but backslashes are not, so text cannot contain
+// a backslash before a `$`. RawHeredoc writes any text.
+func Heredoc(style HeredocStyle, pieces ...Piece) Expr {
+	return exprFunc(func(g *generator) (*ast.Expr, error) {
+		err := checkHeredocStyle(style)
+		if err != nil {
+			return nil, err
+		}
+
+		merged := mergeText(pieces)
+		fragments := heredocFragments(nil, "\n", false)
+		for i, p := range merged {
+			if p.expr == nil {
+				if strings.Contains(p.text, `\$`) || (strings.HasSuffix(p.text, `\`) && i+1 < len(merged)) {
+					return nil, errors.New("heredoc text cannot contain a backslash before $, use RawHeredoc")
+				}
+				fragments = heredocFragments(fragments, p.text, true)
+				continue
+			}
+			interp, err := interpolated(g, p.expr)
+			if err != nil {
+				return nil, err
+			}
+			fragments = append(fragments, &ast.HeredocFragment{Interpolated: interp})
+		}
+		fragments = heredocFragments(fragments, "\n", false)
+
+		term := terminator(fragments)
+		return &ast.Expr{
+			BasicLit: &ast.BasicLit{
+				Heredoc: &ast.Heredoc{
+					Start:     string(style) + term,
+					Fragments: fragments,
+					Terminate: &ast.HeredocEnd{Text: term},
+				},
+			},
+		}, nil
+	})
+}
+
+// RawHeredoc returns a heredoc whose text is not escaped or interpolated. Its
+// text is written on its own lines, and its terminator is chosen to not appear
+// in it.
+func RawHeredoc(style HeredocStyle, s string) Expr {
+	return exprFunc(func(*generator) (*ast.Expr, error) {
+		err := checkHeredocStyle(style)
+		if err != nil {
+			return nil, err
+		}
+
+		fragments := heredocFragments(nil, "\n"+s+"\n", false)
+		term := terminator(fragments)
+		return &ast.Expr{
+			BasicLit: &ast.BasicLit{
+				RawHeredoc: &ast.RawHeredoc{
+					Start:     fmt.Sprintf("%s`%s`", style, term),
+					Fragments: fragments,
+					Terminate: &ast.HeredocEnd{Text: term},
+				},
+			},
+		}, nil
+	})
+}
+
+func checkHeredocStyle(style HeredocStyle) error {
+	switch style {
+	case HeredocLiteral, HeredocDedent, HeredocFold:
+		return nil
+	}
+	return fmt.Errorf("invalid heredoc style %q", style)
+}
+
+// heredocFragments appends the fragments of text in a heredoc, split into
+// whitespace and text like the lexer does. Whitespace is merged with the
+// whitespace fragment before it, and interpolations are escaped if asked.
+func heredocFragments(fragments []*ast.HeredocFragment, s string, escape bool) []*ast.HeredocFragment {
+	for len(s) > 0 {
+		if escape && strings.HasPrefix(s, "${") {
+			escaped := `\$`
+			fragments = append(fragments, &ast.HeredocFragment{Escaped: &escaped})
+			s = s[1:]
+			continue
+		}
+
+		n := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsSpace(r) })
+		if n != 0 {
+			if n < 0 {
+				n = len(s)
+			}
+			spaces := s[:n]
+			if last := len(fragments) - 1; last >= 0 && fragments[last].Spaces != nil {
+				spaces = *fragments[last].Spaces + spaces
+				fragments = fragments[:last]
+			}
+			fragments = append(fragments, &ast.HeredocFragment{Spaces: &spaces})
+			s = s[n:]
+			continue
+		}
+
+		n = strings.IndexFunc(s, unicode.IsSpace)
+		if n < 0 {
+			n = len(s)
+		}
+		if escape {
+			if i := strings.Index(s[:n], "${"); i > 0 {
+				n = i
+			}
+		}
+		text := s[:n]
+		fragments = append(fragments, &ast.HeredocFragment{Text: &text})
+		s = s[n:]
+	}
+	return fragments
+}
+
+// terminator returns a terminator for a heredoc that does not appear in its
+// fragments, so that the heredoc does not end early.
+func terminator(fragments []*ast.HeredocFragment) string {
+	var body strings.Builder
+	for _, f := range fragments {
+		body.WriteString(f.Unparse())
+	}
+	term := "EOF"
+	for i := 1; strings.Contains(body.String(), term); i++ {
+		term = fmt.Sprintf("EOF%d", i)
+	}
+	return term
+}
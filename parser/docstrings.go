@@ -16,7 +16,7 @@ func AssignDocStrings(mod *ast.Module) {
 			}
 		},
 		func(fun *ast.FuncDecl) {
-			if lastCG != nil && lastCG.End().Line == fun.Pos.Line-1 {
+			if isDocFor(lastCG, fun.Pos.Line) {
 				fun.Doc = lastCG
 			}
 
@@ -26,7 +26,7 @@ func AssignDocStrings(mod *ast.Module) {
 						lastCG = cg
 					},
 					func(call *ast.CallStmt) {
-						if lastCG != nil && lastCG.End().Line == call.Pos.Line-1 {
+						if isDocFor(lastCG, call.Pos.Line) {
 							call.Doc = lastCG
 						}
 					},
@@ -35,3 +35,14 @@ func AssignDocStrings(mod *ast.Module) {
 		},
 	)
 }
+
+// isDocFor returns true if the comment group ends on the line immediately
+// before line. Comments include their trailing newline, so the group's end
+// position is already on the following line. The end position is used rather
+// than the start so that block comments spanning many lines are handled.
+func isDocFor(cg *ast.CommentGroup, line int) bool {
+	if cg == nil || len(cg.List) == 0 {
+		return false
+	}
+	return cg.List[len(cg.List)-1].EndPos.Line == line
+}
@@ -5,12 +5,18 @@ import (
 	"errors"
 	"io"
 
+	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/openllb/hlb/errdefs"
 	"github.com/openllb/hlb/parser/ast"
 	"github.com/openllb/hlb/pkg/filebuffer"
 	"golang.org/x/sync/errgroup"
 )
 
+// nestedBlockComment is the token type of a block comment opened within
+// another block comment.
+var nestedBlockComment = ast.Lexer.Symbols()["NestedBlockComment"]
+
 func Parse(ctx context.Context, r io.Reader, opts ...filebuffer.Option) (*ast.Module, error) {
 	mod := &ast.Module{}
 	defer AssignDocStrings(mod)
@@ -31,6 +37,14 @@ func Parse(ctx context.Context, r io.Reader, opts ...filebuffer.Option) (*ast.Mo
 
 	err := ast.Parser.Parse(name, r, mod)
 	if err != nil {
+		var uerr participle.UnexpectedTokenError
+		if errors.As(err, &uerr) && uerr.Unexpected.Type == nestedBlockComment {
+			return nil, errdefs.WithSyntaxError(participle.Errorf(uerr.Position(), "nested block comments are not supported"))
+		}
+		var perr participle.Error
+		if errors.As(err, &perr) {
+			return nil, errdefs.WithSyntaxError(err)
+		}
 		return nil, err
 	}
 	mod.Directory = NewLocalDirectory(".", "")
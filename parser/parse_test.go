@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/openllb/hlb/parser/ast"
 	"github.com/stretchr/testify/require"
 )
 
@@ -113,3 +114,63 @@ func TestParse(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, file)
 }
+
+func TestParseComments(t *testing.T) {
+	t.Parallel()
+	mod, err := Parse(context.Background(), strings.NewReader(`
+# hash comment
+fs hash() { scratch; }
+
+// line comment
+// hlb:nomemo
+fs line() { scratch; }
+
+/*
+ * block comment
+ * spanning lines
+ */
+fs block() {
+	/* inline */ scratch // trailing
+}
+
+string literals() {
+	value "http://example.com/*"
+	value <<~EOM
+	// not a comment
+	/* nor this
+	EOM
+}
+`))
+	require.NoError(t, err)
+
+	docs := make(map[string][]string)
+	for _, decl := range mod.Decls {
+		if decl.Func == nil {
+			continue
+		}
+		var lines []string
+		if decl.Func.Doc != nil {
+			for _, c := range decl.Func.Doc.List {
+				lines = append(lines, c.Lines()...)
+			}
+		}
+		docs[decl.Func.Sig.Name.Text] = lines
+	}
+	require.Equal(t, []string{" hash comment"}, docs["hash"])
+	require.Equal(t, []string{" line comment", " hlb:nomemo"}, docs["line"])
+	require.Equal(t, []string{"block comment", "spanning lines"}, docs["block"])
+	require.Empty(t, docs["literals"])
+
+	var fd *ast.FuncDecl
+	for _, decl := range mod.Decls {
+		if decl.Func != nil && decl.Func.Sig.Name.Text == "line" {
+			fd = decl.Func
+		}
+	}
+	require.True(t, fd.Doc.HasPragma("nomemo"))
+
+	lit := ast.Search(mod, `"http://example.com/*"`)
+	require.NotNil(t, lit)
+	heredoc := ast.Search(mod, "// not a comment")
+	require.NotNil(t, heredoc)
+}
@@ -0,0 +1,125 @@
+// Package gitattributes reads the export-ignore attributes of a
+// .gitattributes file into the exclude patterns of a copy.
+package gitattributes
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/openllb/hlb/pkg/llbutil"
+)
+
+// Filename is the name of the attributes file read from the root of a git
+// repository.
+const Filename = ".gitattributes"
+
+// ExportIgnore reads a .gitattributes file and returns exclude patterns for
+// the paths with the export-ignore attribute, so that a copy of dir from the
+// repository leaves out the same files as git archive.
+//
+// Like git, a pattern without a slash matches at any depth, other patterns
+// are relative to the root of the repository, and the last line that sets or
+// unsets the attribute for a path wins. Unsetting the attribute is returned
+// as a pattern prefixed with "!". A pattern with a trailing slash matches the
+// directory and everything in it. Patterns anchored outside of dir cannot
+// match anything copied, so they are dropped.
+func ExportIgnore(r io.Reader, dir string) ([]string, error) {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[attr]") {
+			continue
+		}
+
+		pattern, attrs := splitPattern(line)
+		// Negative patterns are not allowed in attributes files, so git
+		// ignores them too.
+		if pattern == "" || strings.HasPrefix(pattern, "!") {
+			continue
+		}
+
+		var set, unset bool
+		for _, attr := range attrs {
+			switch attr {
+			case "export-ignore":
+				set, unset = true, false
+			case "-export-ignore", "!export-ignore":
+				set, unset = false, true
+			default:
+				if strings.HasPrefix(attr, "export-ignore=") {
+					set, unset = false, true
+				}
+			}
+		}
+		if !set && !unset {
+			continue
+		}
+
+		pattern, ok := rebase(pattern, dir)
+		if !ok {
+			continue
+		}
+		if unset {
+			// Nothing is excluded before the first export-ignore, so there
+			// is nothing to re-include.
+			if len(patterns) == 0 {
+				continue
+			}
+			pattern = "!" + pattern
+		}
+
+		err := llbutil.ValidatePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// splitPattern splits a line into its pattern and attributes. Patterns may be
+// quoted like C strings to contain spaces.
+func splitPattern(line string) (string, []string) {
+	if strings.HasPrefix(line, `"`) {
+		for i := 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				pattern, err := strconv.Unquote(line[:i+1])
+				if err != nil {
+					return "", nil
+				}
+				return pattern, strings.Fields(line[i+1:])
+			}
+		}
+		return "", nil
+	}
+
+	fields := strings.Fields(line)
+	return fields[0], fields[1:]
+}
+
+// rebase returns a pattern relative to the root of the repository as a
+// pattern relative to dir.
+func rebase(pattern, dir string) (string, bool) {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		return "**/" + pattern, true
+	}
+
+	pattern = strings.TrimPrefix(path.Clean("/"+pattern), "/")
+	if dir == "" {
+		return pattern, true
+	}
+	if !strings.HasPrefix(pattern, dir+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(pattern, dir+"/"), true
+}
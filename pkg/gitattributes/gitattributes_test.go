@@ -0,0 +1,109 @@
+package gitattributes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportIgnore(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		content  string
+		dir      string
+		expected []string
+	}{{
+		"empty",
+		"",
+		"/",
+		nil,
+	}, {
+		"other attributes",
+		"# line endings\n* text=auto\n*.png binary\n[attr]bin -text -diff\n",
+		"/",
+		nil,
+	}, {
+		"patterns without a slash match at any depth",
+		".gitattributes export-ignore\n*.test export-ignore\n",
+		"/",
+		[]string{"**/.gitattributes", "**/*.test"},
+	}, {
+		"patterns with a slash are anchored",
+		"/testdata/ export-ignore\ndocs/internal export-ignore\n",
+		"/",
+		[]string{"testdata", "docs/internal"},
+	}, {
+		"unset attributes re-include",
+		"*.md export-ignore\nREADME.md -export-ignore\nCHANGELOG.md !export-ignore\nLICENSE -export-ignore\n",
+		"/",
+		[]string{"**/*.md", "!**/README.md", "!**/CHANGELOG.md", "!**/LICENSE"},
+	}, {
+		"nothing to re-include",
+		"LICENSE -export-ignore\n*.md export-ignore\n",
+		"/",
+		[]string{"**/*.md"},
+	}, {
+		"last attribute wins",
+		"a export-ignore -export-ignore\nb -export-ignore export-ignore\n",
+		"/",
+		[]string{"**/b"},
+	}, {
+		"quoted patterns",
+		"\"with space\" export-ignore\n\"bad export-ignore\n",
+		"/",
+		[]string{"**/with space"},
+	}, {
+		"negative patterns are ignored",
+		"!vendor export-ignore\n",
+		"/",
+		nil,
+	}, {
+		"patterns relative to the copied directory",
+		"/src/testdata export-ignore\n/docs export-ignore\n*.test export-ignore\n",
+		"src",
+		[]string{"testdata", "**/*.test"},
+	}, {
+		"byte order mark and crlf",
+		"\ufefftestdata export-ignore\r\n",
+		"/",
+		[]string{"**/testdata"},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			patterns, err := ExportIgnore(strings.NewReader(tc.content), tc.dir)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, patterns)
+		})
+	}
+}
+
+func TestExportIgnoreFixtures(t *testing.T) {
+	t.Parallel()
+
+	patterns, err := ExportIgnore(strings.NewReader(strings.Join([]string{
+		"/.gitattributes export-ignore",
+		"/testdata/fixtures/ export-ignore",
+		"*_test.go export-ignore",
+		"keep_test.go -export-ignore",
+	}, "\n")), "/")
+	require.NoError(t, err)
+
+	// The copy is excluded with the same patterns as git archive would.
+	for filename, excluded := range map[string]bool{
+		".gitattributes":                true,
+		"testdata/fixtures":             true,
+		"testdata/fixtures/a/input.txt": true,
+		"testdata/golden.txt":           false,
+		"main.go":                       false,
+		"pkg/main_test.go":              true,
+		"pkg/keep_test.go":              false,
+	} {
+		matched, err := llbutil.MatchesPatterns(filename, patterns)
+		require.NoError(t, err)
+		require.Equal(t, excluded, matched, filename)
+	}
+}
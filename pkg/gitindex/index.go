@@ -0,0 +1,152 @@
+// Package gitindex enumerates the files of a git worktree that git tracks by
+// reading its index, so that a local source can leave out everything else
+// without running git.
+package gitindex
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Modes of index entries.
+const (
+	ModeRegular = 0100644
+	ModeExec    = 0100755
+	ModeSymlink = 0120000
+	ModeGitlink = 0160000
+	ModeDir     = 0040000
+)
+
+// Entry is a path recorded in the index.
+type Entry struct {
+	// Path is the slash separated path of the entry relative to the root of
+	// the worktree.
+	Path string
+
+	// Mode is the mode git records for the entry, which is ModeGitlink for
+	// submodules and ModeDir for directories collapsed by a sparse index.
+	Mode uint32
+}
+
+// IsSubmodule returns true if the entry is the commit of a submodule.
+func (e Entry) IsSubmodule() bool {
+	return e.Mode == ModeGitlink
+}
+
+// ReadIndex reads the entries of a git index of version 2, 3 or 4. Entries
+// that are in conflict are only returned once, and extensions are ignored.
+func ReadIndex(r io.Reader) ([]Entry, error) {
+	br := bufio.NewReader(r)
+
+	var header struct {
+		Signature [4]byte
+		Version   uint32
+		Count     uint32
+	}
+	err := binary.Read(br, binary.BigEndian, &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index header: %w", err)
+	}
+	if string(header.Signature[:]) != "DIRC" {
+		return nil, fmt.Errorf("invalid index signature %q", header.Signature[:])
+	}
+	if header.Version < 2 || header.Version > 4 {
+		return nil, fmt.Errorf("unsupported index version %d", header.Version)
+	}
+
+	var (
+		entries []Entry
+		prev    string
+	)
+	for i := uint32(0); i < header.Count; i++ {
+		// Stat data, the object id and flags come before the path.
+		var fixed struct {
+			_     [6]uint32
+			Mode  uint32
+			_     [3]uint32
+			_     [20]byte
+			Flags uint16
+		}
+		err = binary.Read(br, binary.BigEndian, &fixed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index entry %d: %w", i, err)
+		}
+		size := 62
+
+		if fixed.Flags&0x4000 != 0 {
+			if header.Version < 3 {
+				return nil, fmt.Errorf("invalid index entry %d: extended flags in version %d", i, header.Version)
+			}
+			_, err = br.Discard(2)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index entry %d: %w", i, err)
+			}
+			size += 2
+		}
+
+		var path string
+		if header.Version == 4 {
+			// Paths are compressed by the number of bytes to remove from the
+			// end of the previous path, followed by the suffix to append.
+			strip, err := readOffset(br)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index entry %d: %w", i, err)
+			}
+			if strip > uint64(len(prev)) {
+				return nil, fmt.Errorf("invalid index entry %d: invalid path compression", i)
+			}
+			suffix, err := br.ReadString(0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index entry %d: %w", i, err)
+			}
+			path = prev[:uint64(len(prev))-strip] + suffix[:len(suffix)-1]
+		} else {
+			name, err := br.ReadBytes(0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index entry %d: %w", i, err)
+			}
+			path = string(name[:len(name)-1])
+
+			// Entries are padded with 1 to 8 nul bytes to a multiple of 8
+			// bytes, one of which terminates the path.
+			size += len(name)
+			_, err = br.Discard((8 - size%8) % 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index entry %d: %w", i, err)
+			}
+		}
+		prev = path
+
+		if path == "" {
+			return nil, fmt.Errorf("invalid index entry %d: empty path", i)
+		}
+
+		// Conflicts have an entry for each stage of the same path, which are
+		// sorted together.
+		if len(entries) > 0 && entries[len(entries)-1].Path == path {
+			continue
+		}
+		entries = append(entries, Entry{Path: path, Mode: fixed.Mode})
+	}
+	return entries, nil
+}
+
+// readOffset reads the variable length integer git uses to compress paths,
+// where each continuation adds one so that every value has one encoding.
+func readOffset(br *bufio.Reader) (uint64, error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	val := uint64(c & 0x7f)
+	for c&0x80 != 0 {
+		c, err = br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		val = ((val + 1) << 7) | uint64(c&0x7f)
+	}
+	return val, nil
+}
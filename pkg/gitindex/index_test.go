@@ -0,0 +1,202 @@
+package gitindex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// indexEntry is an entry to encode in a test index, with the stage of a
+// conflict and whether it has extended flags.
+type indexEntry struct {
+	path     string
+	mode     uint32
+	stage    uint16
+	extended bool
+}
+
+// encodeIndex encodes entries as a git index of a version, with zeroed stat
+// data and object ids.
+func encodeIndex(t *testing.T, version uint32, entries []indexEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("DIRC")
+	write := func(v interface{}) {
+		require.NoError(t, binary.Write(&buf, binary.BigEndian, v))
+	}
+	write(version)
+	write(uint32(len(entries)))
+
+	prev := ""
+	for _, e := range entries {
+		start := buf.Len()
+		write([6]uint32{})
+		write(e.mode)
+		write([3]uint32{})
+		write([20]byte{})
+
+		flags := e.stage<<12 | uint16(len(e.path))
+		if e.extended {
+			flags |= 0x4000
+		}
+		write(flags)
+		if e.extended {
+			write(uint16(0x2000))
+		}
+
+		if version == 4 {
+			common := 0
+			for common < len(prev) && common < len(e.path) && prev[common] == e.path[common] {
+				common++
+			}
+			buf.Write(encodeOffset(uint64(len(prev) - common)))
+			buf.WriteString(e.path[common:])
+			buf.WriteByte(0)
+			prev = e.path
+			continue
+		}
+
+		buf.WriteString(e.path)
+		buf.WriteByte(0)
+		for (buf.Len()-start)%8 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	// Extensions and the checksum follow the entries.
+	buf.WriteString("TREE")
+	write(uint32(0))
+	buf.Write(make([]byte, 20))
+	return buf.Bytes()
+}
+
+func encodeOffset(val uint64) []byte {
+	out := []byte{byte(val & 0x7f)}
+	for val >>= 7; val > 0; val >>= 7 {
+		val--
+		out = append([]byte{0x80 | byte(val&0x7f)}, out...)
+	}
+	return out
+}
+
+func TestReadIndex(t *testing.T) {
+	t.Parallel()
+
+	entries := []indexEntry{
+		{path: ".gitignore", mode: ModeRegular},
+		{path: "build.sh", mode: ModeExec},
+		{path: "docs/link", mode: ModeSymlink},
+		{path: "src/a-very-long-file-name-that-shares-a-prefix.go", mode: ModeRegular},
+		{path: "src/a-very-long-file-name-that-shares-a-prefix_test.go", mode: ModeRegular},
+		{path: "vendor/lib", mode: ModeGitlink},
+	}
+	expected := []Entry{
+		{Path: ".gitignore", Mode: ModeRegular},
+		{Path: "build.sh", Mode: ModeExec},
+		{Path: "docs/link", Mode: ModeSymlink},
+		{Path: "src/a-very-long-file-name-that-shares-a-prefix.go", Mode: ModeRegular},
+		{Path: "src/a-very-long-file-name-that-shares-a-prefix_test.go", Mode: ModeRegular},
+		{Path: "vendor/lib", Mode: ModeGitlink},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		version  uint32
+		entries  []indexEntry
+		expected []Entry
+		err      string
+	}{{
+		"version 2",
+		2,
+		entries,
+		expected,
+		"",
+	}, {
+		"version 3 with extended flags",
+		3,
+		[]indexEntry{
+			{path: "added", mode: ModeRegular, extended: true},
+			{path: "tracked", mode: ModeRegular},
+		},
+		[]Entry{
+			{Path: "added", Mode: ModeRegular},
+			{Path: "tracked", Mode: ModeRegular},
+		},
+		"",
+	}, {
+		"version 4",
+		4,
+		entries,
+		expected,
+		"",
+	}, {
+		"conflicts are returned once",
+		2,
+		[]indexEntry{
+			{path: "a", mode: ModeRegular},
+			{path: "b", mode: ModeRegular, stage: 1},
+			{path: "b", mode: ModeRegular, stage: 2},
+			{path: "b", mode: ModeRegular, stage: 3},
+			{path: "c", mode: ModeRegular},
+		},
+		[]Entry{
+			{Path: "a", Mode: ModeRegular},
+			{Path: "b", Mode: ModeRegular},
+			{Path: "c", Mode: ModeRegular},
+		},
+		"",
+	}, {
+		"extended flags in version 2",
+		2,
+		[]indexEntry{{path: "a", mode: ModeRegular, extended: true}},
+		nil,
+		"invalid index entry 0: extended flags in version 2",
+	}, {
+		"unsupported version",
+		5,
+		nil,
+		nil,
+		"unsupported index version 5",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ReadIndex(bytes.NewReader(encodeIndex(t, tc.version, tc.entries)))
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestReadIndexInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := ReadIndex(bytes.NewReader([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")))
+	require.EqualError(t, err, `invalid index signature "PACK"`)
+
+	dt := encodeIndex(t, 2, []indexEntry{{path: "truncated", mode: ModeRegular}})
+	_, err = ReadIndex(bytes.NewReader(dt[:70]))
+	require.Error(t, err)
+}
+
+func TestReadOffset(t *testing.T) {
+	t.Parallel()
+
+	for _, val := range []uint64{0, 1, 127, 128, 255, 16383, 16511, 1 << 20} {
+		var buf bytes.Buffer
+		buf.Write(encodeOffset(val))
+		buf.WriteString("rest")
+
+		actual, err := readOffset(bufio.NewReader(&buf))
+		require.NoError(t, err)
+		require.Equal(t, val, actual)
+	}
+
+	// 128 is encoded as 0x80 0x00 rather than 0x81 0x00.
+	require.Equal(t, []byte{0x80, 0x00}, encodeOffset(128))
+}
@@ -0,0 +1,437 @@
+package gitindex
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ErrNotRepository is returned when a directory is not in a git worktree.
+var ErrNotRepository = errors.New("not a git repository")
+
+// FindRoot returns the root of the worktree that a file or directory is in.
+func FindRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	for {
+		_, err := os.Lstat(filepath.Join(dir, ".git"))
+		if err == nil {
+			return dir, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNotRepository
+		}
+		dir = parent
+	}
+}
+
+// gitDir returns the git directory of a worktree, following the .git files
+// of submodules and linked worktrees to the directory they point at.
+func gitDir(root string) (string, error) {
+	dotgit := filepath.Join(root, ".git")
+	fi, err := os.Stat(dotgit)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return dotgit, nil
+	}
+
+	dt, err := os.ReadFile(dotgit)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(dt))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", fmt.Errorf("invalid .git file %s", dotgit)
+	}
+	dir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return dir, nil
+}
+
+// commonDir returns the directory shared by the linked worktrees of a git
+// directory, which has the repository's info/exclude file.
+func commonDir(gitdir string) string {
+	dt, err := os.ReadFile(filepath.Join(gitdir, "commondir"))
+	if err != nil {
+		return gitdir
+	}
+	dir := strings.TrimSpace(string(dt))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(gitdir, dir)
+	}
+	return dir
+}
+
+// Options configure which files of a worktree are kept besides the files git
+// tracks.
+type Options struct {
+	// Untracked keeps the files that are not tracked unless they are ignored
+	// by .gitignore files or the repository's info/exclude file.
+	Untracked bool
+
+	// Submodules keeps the tracked files of submodules that are checked out.
+	// Otherwise submodules are left out entirely.
+	Submodules bool
+}
+
+// ExcludePatterns returns exclude patterns that leave out the files of dir in
+// the worktree at root that are not kept, which are the files git does not
+// track unless configured otherwise. Tracked files are kept as they are in the
+// worktree, with their unstaged modifications, and .git is always left out.
+//
+// dir is a slash separated path relative to root, and the patterns are
+// relative to dir. A directory without any files kept is left out by a single
+// pattern, so there are only as many patterns as there are untracked paths
+// next to tracked ones, however many files are in untracked directories. The
+// patterns are sorted for the same worktree, so they make stable cache keys.
+func ExcludePatterns(root, dir string, opts Options) ([]string, error) {
+	w := &walker{
+		root:       root,
+		opts:       opts,
+		tracked:    make(map[string]bool),
+		dirs:       make(map[string]bool),
+		submodules: make(map[string]bool),
+	}
+	err := w.readIndex("", root)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []rule
+	if opts.Untracked {
+		gitdir, err := gitDir(root)
+		if err != nil {
+			return nil, err
+		}
+		rules, err = readRules(filepath.Join(commonDir(gitdir), "info", "exclude"), "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dir = strings.Trim(path.Clean("/"+filepath.ToSlash(dir)), "/")
+	if dir != "" {
+		// The .gitignore files of the directories above dir apply to it too.
+		parts := strings.Split(dir, "/")
+		for i := range parts {
+			rules, err = w.dirRules(rules, strings.Join(parts[:i], "/"))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = w.walk(dir, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make([]string, 0, len(w.excludes))
+	for _, p := range w.excludes {
+		if dir != "" {
+			p = strings.TrimPrefix(p, dir+"/")
+		}
+		patterns = append(patterns, EscapePattern(p))
+	}
+	return patterns, nil
+}
+
+type walker struct {
+	root string
+	opts Options
+
+	// tracked are the paths of tracked files, and of directories that are
+	// tracked entirely by a sparse index.
+	tracked map[string]bool
+
+	// dirs are the directories that have tracked files.
+	dirs map[string]bool
+
+	// submodules are the paths of submodules.
+	submodules map[string]bool
+
+	excludes []string
+}
+
+// readIndex reads the index of the worktree at dir, whose paths are prefixed
+// by prefix relative to the root.
+func (w *walker) readIndex(prefix, dir string) error {
+	gitdir, err := gitDir(dir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(gitdir, "index"))
+	if err != nil {
+		// A repository has no index until something is added to it.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	entries, err := ReadIndex(f)
+	if err != nil {
+		return fmt.Errorf("failed to read index of %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		p := path.Join(prefix, entry.Path)
+		if entry.IsSubmodule() {
+			w.submodules[p] = true
+			if !w.opts.Submodules {
+				continue
+			}
+
+			sub := filepath.Join(w.root, filepath.FromSlash(p))
+			_, err := os.Lstat(filepath.Join(sub, ".git"))
+			if err != nil {
+				// Submodules that are not checked out have nothing to keep.
+				continue
+			}
+			err = w.readIndex(p, sub)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		w.tracked[p] = true
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			w.dirs[d] = true
+		}
+	}
+	return nil
+}
+
+// walk adds the exclude patterns of the paths in dir that are not kept.
+func (w *walker) walk(dir string, rules []rule) error {
+	rules, err := w.dirRules(rules, dir)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(w.root, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		switch {
+		case entry.Name() == ".git":
+			w.excludes = append(w.excludes, p)
+		case w.tracked[p]:
+		case entry.IsDir():
+			switch {
+			case w.submodules[p] && !w.opts.Submodules:
+				w.excludes = append(w.excludes, p)
+			case w.dirs[p]:
+				err = w.walk(p, rules)
+			case w.opts.Untracked && !ignored(rules, p, true):
+				err = w.walk(p, rules)
+			default:
+				w.excludes = append(w.excludes, p)
+			}
+			if err != nil {
+				return err
+			}
+		case w.opts.Untracked && !ignored(rules, p, false):
+		default:
+			w.excludes = append(w.excludes, p)
+		}
+	}
+	return nil
+}
+
+// dirRules returns rules with the rules of the .gitignore file in dir, which
+// are only read if untracked files are kept.
+func (w *walker) dirRules(rules []rule, dir string) ([]rule, error) {
+	if !w.opts.Untracked {
+		return rules, nil
+	}
+	dirRules, err := readRules(filepath.Join(w.root, filepath.FromSlash(dir), ".gitignore"), dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules[:len(rules):len(rules)], dirRules...), nil
+}
+
+// rule is a pattern of a .gitignore file.
+type rule struct {
+	// base is the directory of the file the rule is from, which anchored
+	// patterns are relative to.
+	base     string
+	re       *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func (r rule) match(p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		p = strings.TrimPrefix(p, r.base+"/")
+	}
+	if !r.anchored {
+		p = path.Base(p)
+	}
+	return r.re.MatchString(p)
+}
+
+// ignored returns true if the last rule that matches p ignores it. Rules of
+// deeper .gitignore files come later, so they take precedence.
+func ignored(rules []rule, p string, isDir bool) bool {
+	ignore := false
+	for _, r := range rules {
+		if r.match(p, isDir) {
+			ignore = !r.negate
+		}
+	}
+	return ignore
+}
+
+// readRules reads the rules of a .gitignore style file if it exists.
+func readRules(filename, base string) ([]rule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return parseRules(f, base)
+}
+
+func parseRules(r io.Reader, base string) ([]rule, error) {
+	var rules []rule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		// Trailing spaces are ignored unless they are escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r := rule{base: base}
+		switch {
+		case strings.HasPrefix(line, "!"):
+			r.negate = true
+			line = line[1:]
+		case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		re, err := regexp.Compile("^" + globRegexp(line) + "$")
+		if err != nil {
+			// Git skips patterns it cannot match, like unterminated classes.
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// globRegexp returns the regular expression of a gitignore glob, where "**"
+// matches any number of directories.
+func globRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// EscapePattern escapes a path so that it is matched literally as an include
+// or exclude pattern.
+func EscapePattern(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.IndexByte(`*?[]\`, c) >= 0, i == 0 && c == '!':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
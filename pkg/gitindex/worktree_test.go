@@ -0,0 +1,189 @@
+package gitindex
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeWorktree writes files to a new worktree whose index tracks the given
+// paths.
+func writeWorktree(t *testing.T, root string, files map[string]string, tracked []indexEntry) {
+	for name, content := range files {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+	}
+
+	gitdir := filepath.Join(root, ".git")
+	require.NoError(t, os.MkdirAll(filepath.Join(gitdir, "info"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(gitdir, "index"), encodeIndex(t, 2, tracked), 0644))
+}
+
+func tracked(paths ...string) []indexEntry {
+	var entries []indexEntry
+	for _, p := range paths {
+		entries = append(entries, indexEntry{path: p, mode: ModeRegular})
+	}
+	return entries
+}
+
+func TestExcludePatterns(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		".gitignore":             "*.log\n/build/\n!keep.log\n",
+		"README.md":              "modified but not staged",
+		"go.mod":                 "module example",
+		"build/out":              "",
+		"node_modules/dep/a.js":  "",
+		"src/main.go":            "",
+		"src/debug.log":          "",
+		"src/keep.log":           "",
+		"src/untracked.go":       "",
+		"src/pkg/lib.go":         "",
+		"src/pkg/.gitignore":     "generated/\n",
+		"src/pkg/generated/x.go": "",
+		"src/[weird]*.go":        "",
+		"docs/guide.md":          "",
+	}
+	index := tracked(
+		".gitignore",
+		"README.md",
+		"docs/guide.md",
+		"go.mod",
+		"src/main.go",
+		"src/pkg/.gitignore",
+		"src/pkg/lib.go",
+	)
+
+	for _, tc := range []struct {
+		name     string
+		dir      string
+		opts     Options
+		expected []string
+	}{{
+		"tracked files",
+		"",
+		Options{},
+		[]string{
+			".git",
+			"build",
+			"node_modules",
+			`src/\[weird\]\*.go`,
+			"src/debug.log",
+			"src/keep.log",
+			"src/pkg/generated",
+			"src/untracked.go",
+		},
+	}, {
+		"untracked files that are not ignored",
+		"",
+		Options{Untracked: true},
+		[]string{
+			".git",
+			"build",
+			"src/debug.log",
+			"src/pkg/generated",
+		},
+	}, {
+		"subdir",
+		"src",
+		Options{},
+		[]string{
+			`\[weird\]\*.go`,
+			"debug.log",
+			"keep.log",
+			"pkg/generated",
+			"untracked.go",
+		},
+	}, {
+		"subdir with untracked files",
+		"/src/pkg/",
+		Options{Untracked: true},
+		[]string{
+			"generated",
+		},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root := t.TempDir()
+			writeWorktree(t, root, files, index)
+
+			actual, err := ExcludePatterns(root, tc.dir, tc.opts)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestExcludePatternsInfoExclude(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	writeWorktree(t, root, map[string]string{
+		"main.go":   "",
+		"notes.txt": "",
+		"todo.txt":  "",
+	}, tracked("main.go"))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".git", "info", "exclude"), []byte("notes.txt\n"), 0644))
+
+	actual, err := ExcludePatterns(root, "", Options{Untracked: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{".git", "notes.txt"}, actual)
+}
+
+func TestExcludePatternsSubmodules(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	writeWorktree(t, root, map[string]string{
+		"main.go":          "",
+		"lib/.git":         "gitdir: ../.git/modules/lib\n",
+		"lib/lib.go":       "",
+		"lib/untracked.go": "",
+	}, []indexEntry{
+		{path: "lib", mode: ModeGitlink},
+		{path: "main.go", mode: ModeRegular},
+	})
+
+	modules := filepath.Join(root, ".git", "modules", "lib")
+	require.NoError(t, os.MkdirAll(modules, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(modules, "index"), encodeIndex(t, 4, tracked("lib.go")), 0644))
+
+	actual, err := ExcludePatterns(root, "", Options{})
+	require.NoError(t, err)
+	require.Equal(t, []string{".git", "lib"}, actual)
+
+	actual, err = ExcludePatterns(root, "", Options{Submodules: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{".git", "lib/.git", "lib/untracked.go"}, actual)
+}
+
+func TestFindRoot(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	writeWorktree(t, root, map[string]string{"src/main.go": ""}, tracked("src/main.go"))
+
+	for _, p := range []string{root, filepath.Join(root, "src"), filepath.Join(root, "src", "main.go")} {
+		actual, err := FindRoot(p)
+		require.NoError(t, err)
+		require.Equal(t, root, actual)
+	}
+
+	_, err := FindRoot(t.TempDir())
+	require.ErrorIs(t, err, ErrNotRepository)
+}
+
+func TestEscapePattern(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "a/b.go", EscapePattern("a/b.go"))
+	require.Equal(t, `\!a/b\*\?\[c\]\\`, EscapePattern(`!a/b*?[c]\`))
+	require.Equal(t, "a/!b", EscapePattern("a/!b"))
+}
@@ -0,0 +1,104 @@
+// Package ignorefile reads .dockerignore style files into the exclude
+// patterns of a local source.
+package ignorefile
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/openllb/hlb/pkg/llbutil"
+)
+
+// ModuleName is the name of the ignore file in the directory of a module,
+// which applies to every local source and file import of the module.
+const ModuleName = ".hlbignore"
+
+// DefaultNames are the names of the ignore files that are looked up in the
+// root of a local context, with the first that exists being used.
+var DefaultNames = []string{".hlbignore", ".dockerignore"}
+
+// InvalidPatternError is the error of a pattern that cannot be compiled.
+type InvalidPatternError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *InvalidPatternError) Error() string {
+	return fmt.Sprintf("invalid pattern `%s`: %s", e.Pattern, e.Err)
+}
+
+func (e *InvalidPatternError) Unwrap() error {
+	return e.Err
+}
+
+// Parse reads an ignore file and returns its patterns in order, with the same
+// semantics as a .dockerignore file. Comments and blank lines are skipped,
+// patterns are cleaned and made relative to the root of the context, and
+// patterns prefixed with "!" re-include the paths they match. The last
+// pattern that matches a path wins.
+//
+// The ignore file is not excluded unless it is matched by a pattern, and
+// neither are modules, because they are read from the host instead of the
+// local source.
+func Parse(r io.Reader) ([]string, error) {
+	patterns, err := dockerignore.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		err = llbutil.ValidatePattern(pattern)
+		if err != nil {
+			return nil, &InvalidPatternError{Pattern: pattern, Err: err}
+		}
+	}
+	return patterns, nil
+}
+
+// Rebase returns the patterns that apply inside dir, a directory relative to
+// the root of the ignore file, made relative to dir. Patterns are matched
+// against dir one path segment at a time: patterns under dir are stripped of
+// it, patterns from a "**" segment on are kept since they match at any depth,
+// and patterns for other paths are dropped. Patterns that match dir itself or
+// one of its parents are dropped too, since dir is named explicitly.
+func Rebase(patterns []string, dir string) []string {
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	if dir == "." {
+		return patterns
+	}
+
+	dirSegments := strings.Split(dir, "/")
+	var rebased []string
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		rest, ok := rebase(strings.Split(pattern, "/"), dirSegments)
+		if !ok {
+			continue
+		}
+		if negate {
+			rest = "!" + rest
+		}
+		rebased = append(rebased, rest)
+	}
+	return rebased
+}
+
+func rebase(segments, dirSegments []string) (string, bool) {
+	for i, segment := range segments {
+		if segment == "**" {
+			return strings.Join(segments[i:], "/"), true
+		}
+		if i == len(dirSegments) {
+			return strings.Join(segments[i:], "/"), true
+		}
+		ok, err := filepath.Match(segment, dirSegments[i])
+		if err != nil || !ok {
+			return "", false
+		}
+	}
+	return "", false
+}
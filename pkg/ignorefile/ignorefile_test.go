@@ -0,0 +1,105 @@
+package ignorefile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected []string
+	}{{
+		"empty",
+		"",
+		nil,
+	}, {
+		"comments and blank lines",
+		"# comment\n\n  \n*.log\n",
+		[]string{"*.log"},
+	}, {
+		"leading slash is anchored to the root",
+		"/build\n/app/../dist/\n",
+		[]string{"build", "dist"},
+	}, {
+		"directory patterns",
+		"node_modules/\n**/tmp\n",
+		[]string{"node_modules", "**/tmp"},
+	}, {
+		"negations",
+		"*.md\n!README.md\n! /docs/*.md\n",
+		[]string{"*.md", "!README.md", "!docs/*.md"},
+	}, {
+		"byte order mark and crlf",
+		"\ufeff*.log\r\nkeep\r\n",
+		[]string{"*.log", "keep"},
+	}, {
+		"ignore file and modules",
+		".dockerignore\n*.hlb\n",
+		[]string{".dockerignore", "*.hlb"},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			patterns, err := Parse(strings.NewReader(tc.content))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, patterns)
+		})
+	}
+}
+
+func TestParseInvalidPattern(t *testing.T) {
+	t.Parallel()
+
+	_, err := Parse(strings.NewReader("*.log\n!\n"))
+	var ipe *InvalidPatternError
+	require.True(t, errors.As(err, &ipe))
+	require.Equal(t, "!", ipe.Pattern)
+}
+
+func TestRebase(t *testing.T) {
+	t.Parallel()
+
+	patterns := []string{
+		"*.log",
+		"app/node_modules",
+		"!app/node_modules/keep",
+		"*/dist",
+		"app",
+		"ap?",
+		"**/tmp",
+		"app/**/cache",
+		"docs/*.md",
+	}
+	for _, tc := range []struct {
+		name     string
+		dir      string
+		expected []string
+	}{{
+		"root",
+		".",
+		patterns,
+	}, {
+		"subdirectory",
+		"app",
+		[]string{"node_modules", "!node_modules/keep", "dist", "**/tmp", "**/cache"},
+	}, {
+		"nested subdirectory",
+		"app/src",
+		[]string{"**/tmp", "**/cache"},
+	}, {
+		"unrelated directory",
+		"docs",
+		[]string{"dist", "**/tmp", "*.md"},
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, Rebase(patterns, tc.dir))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package imageutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParsePortSpec parses a port specification of the form `port[/protocol]` or
+// `start-end[/protocol]` and returns the ports in the format used by the
+// ExposedPorts of an image config. The protocol defaults to TCP.
+func ParsePortSpec(spec string) ([]string, error) {
+	portRange, proto := spec, "tcp"
+	if i := strings.Index(spec, "/"); i >= 0 {
+		portRange, proto = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return nil, fmt.Errorf("unsupported protocol `%s`, expected tcp, udp or sctp", proto)
+	}
+
+	start, end := portRange, portRange
+	if i := strings.Index(portRange, "-"); i >= 0 {
+		start, end = portRange[:i], portRange[i+1:]
+	}
+
+	startPort, err := parsePort(start)
+	if err != nil {
+		return nil, err
+	}
+	endPort, err := parsePort(end)
+	if err != nil {
+		return nil, err
+	}
+	if startPort > endPort {
+		return nil, fmt.Errorf("invalid port range `%s`, start is greater than end", portRange)
+	}
+
+	var ports []string
+	for port := startPort; port <= endPort; port++ {
+		ports = append(ports, fmt.Sprintf("%d/%s", port, proto))
+	}
+	return ports, nil
+}
+
+func parsePort(str string) (int, error) {
+	port, err := strconv.Atoi(str)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port `%s`, expected a number between 1 and 65535", str)
+	}
+	return port, nil
+}
+
+// ParsePublishPort parses a port specification of the form `port[/protocol]`
+// of a single port, and returns the port in the format used by the
+// ExposedPorts of an image config.
+func ParsePublishPort(spec string) (string, error) {
+	if strings.Contains(spec, "-") {
+		return "", fmt.Errorf("port ranges cannot be published")
+	}
+	ports, err := ParsePortSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	return ports[0], nil
+}
+
+// ValidatePort returns an error if port is not a valid port number.
+func ValidatePort(port int) error {
+	_, err := parsePort(strconv.Itoa(port))
+	return err
+}
+
+// HostPort returns the port of the host that a container port in the format
+// of ExposedPorts is published on, which has the protocol of the container
+// port.
+func HostPort(hostPort int, containerPort string) string {
+	proto := "tcp"
+	if i := strings.Index(containerPort, "/"); i >= 0 {
+		proto = containerPort[i+1:]
+	}
+	return fmt.Sprintf("%d/%s", hostPort, proto)
+}
@@ -0,0 +1,289 @@
+package imageutil
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ArchiveImage is an image read from an OCI archive with the timestamps of
+// the files in its layers rewritten, so that builds that only differ in when
+// their files were written have the same digests.
+type ArchiveImage struct {
+	// Digest is the digest of the image's config and rewritten layers.
+	Digest digest.Digest
+
+	// Config is the digest of the image's config, whose layer diff ids are
+	// replaced by the digests of the rewritten layers.
+	Config digest.Digest
+
+	// Layers are the digests of the uncompressed layers with their timestamps
+	// rewritten, from the base layer up.
+	Layers []digest.Digest
+
+	// CreatedBy is the command that created each layer, from the history of
+	// the image's config, or empty if the history does not match the layers.
+	CreatedBy []string
+}
+
+// ReadArchive reads the image of an OCI archive, such as the one written by
+// BuildKit's OCI exporter. The timestamps of files in its layers that are
+// later than epoch are rewritten to epoch, like SOURCE_DATE_EPOCH does.
+//
+// Only archives of a single image manifest are supported.
+func ReadArchive(r io.Reader, epoch time.Time) (*ArchiveImage, error) {
+	var (
+		blobs  = make(map[digest.Digest][]byte)
+		layers = make(map[digest.Digest]digest.Digest)
+		index  []byte
+	)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == "index.json":
+			index, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(name))), path.Base(name))
+			br := bufio.NewReader(tr)
+			magic, _ := br.Peek(2)
+			switch {
+			case len(magic) > 0 && magic[0] == '{':
+				// Indexes, manifests and configs are JSON and small.
+				blobs[dgst], err = ioutil.ReadAll(br)
+			case len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+				var zr *gzip.Reader
+				zr, err = gzip.NewReader(br)
+				if err == nil {
+					layers[dgst], err = rewriteLayer(zr, epoch)
+				}
+			default:
+				layers[dgst], err = rewriteLayer(br, epoch)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read blob %s: %w", dgst, err)
+			}
+		}
+	}
+	if index == nil {
+		return nil, fmt.Errorf("no index.json in the archive")
+	}
+
+	mfst, err := archiveManifest(blobs, index)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &ArchiveImage{}
+	for _, desc := range mfst.Layers {
+		dgst, ok := layers[desc.Digest]
+		if !ok {
+			return nil, fmt.Errorf("layer %s is not in the archive", desc.Digest)
+		}
+		img.Layers = append(img.Layers, dgst)
+	}
+
+	dt, ok := blobs[mfst.Config.Digest]
+	if !ok {
+		return nil, fmt.Errorf("config %s is not in the archive", mfst.Config.Digest)
+	}
+	var config specs.Image
+	err = json.Unmarshal(dt, &config)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			img.CreatedBy = append(img.CreatedBy, h.CreatedBy)
+		}
+	}
+	if len(img.CreatedBy) != len(img.Layers) {
+		img.CreatedBy = make([]string, len(img.Layers))
+	}
+
+	// The diff ids of the config are the digests of the layers before they
+	// were rewritten, so the config is digested with the rewritten ones.
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(dt, &raw)
+	if err != nil {
+		return nil, err
+	}
+	raw["rootfs"], err = json.Marshal(specs.RootFS{Type: "layers", DiffIDs: img.Layers})
+	if err != nil {
+		return nil, err
+	}
+	dt, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	img.Config = digest.FromBytes(dt)
+
+	dt, err = json.Marshal(struct {
+		Config digest.Digest   `json:"config"`
+		Layers []digest.Digest `json:"layers"`
+	}{img.Config, img.Layers})
+	if err != nil {
+		return nil, err
+	}
+	img.Digest = digest.FromBytes(dt)
+	return img, nil
+}
+
+// archiveManifest returns the manifest of the only image in an archive's
+// index, following nested indexes.
+func archiveManifest(blobs map[digest.Digest][]byte, dt []byte) (*specs.Manifest, error) {
+	for {
+		var idx specs.Index
+		err := json.Unmarshal(dt, &idx)
+		if err != nil {
+			return nil, err
+		}
+		if len(idx.Manifests) != 1 {
+			return nil, fmt.Errorf("expected a single manifest in the index, found %d", len(idx.Manifests))
+		}
+
+		desc := idx.Manifests[0]
+		dt = blobs[desc.Digest]
+		if dt == nil {
+			return nil, fmt.Errorf("manifest %s is not in the archive", desc.Digest)
+		}
+
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2ManifestList, specs.MediaTypeImageIndex:
+			continue
+		case images.MediaTypeDockerSchema2Manifest, specs.MediaTypeImageManifest:
+			var mfst specs.Manifest
+			err = json.Unmarshal(dt, &mfst)
+			if err != nil {
+				return nil, err
+			}
+			return &mfst, nil
+		default:
+			return nil, fmt.Errorf("unexpected media type %v for %v", desc.MediaType, desc.Digest)
+		}
+	}
+}
+
+// rewriteLayer returns the digest of an uncompressed layer with the
+// timestamps of its files clamped to epoch.
+func rewriteLayer(r io.Reader, epoch time.Time) (digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	tw := tar.NewWriter(digester.Hash())
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if hdr.ModTime.After(epoch) {
+			hdr.ModTime = epoch
+		}
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		for _, key := range []string{"mtime", "atime", "ctime"} {
+			delete(hdr.PAXRecords, key)
+		}
+		hdr.Format = tar.FormatPAX
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}
+
+// Divergence is where two images first differ.
+type Divergence struct {
+	// Layer is the index of the first layer that differs, or -1 if the
+	// layers are the same and only the configs differ.
+	Layer int
+
+	// CreatedBy is the command that created the layer in the first image.
+	CreatedBy string
+
+	// Digests are the digests of the layer, or of the configs, of each
+	// image. A missing layer has an empty digest.
+	Digests [2]digest.Digest
+}
+
+func (d *Divergence) String() string {
+	if d.Layer < 0 {
+		return fmt.Sprintf("config differs: %s != %s", d.Digests[0], d.Digests[1])
+	}
+	createdBy := ""
+	if d.CreatedBy != "" {
+		createdBy = fmt.Sprintf(" (%s)", d.CreatedBy)
+	}
+	return fmt.Sprintf("layer %d%s differs: %s != %s", d.Layer, createdBy, d.Digests[0], d.Digests[1])
+}
+
+// Diverge returns where two images first differ, or nil if they have the same
+// digest.
+func Diverge(a, b *ArchiveImage) *Divergence {
+	if a.Digest == b.Digest {
+		return nil
+	}
+
+	n := len(a.Layers)
+	if len(b.Layers) > n {
+		n = len(b.Layers)
+	}
+	for i := 0; i < n; i++ {
+		d := &Divergence{Layer: i}
+		if i < len(a.Layers) {
+			d.Digests[0] = a.Layers[i]
+			d.CreatedBy = a.CreatedBy[i]
+		}
+		if i < len(b.Layers) {
+			d.Digests[1] = b.Layers[i]
+			if d.CreatedBy == "" {
+				d.CreatedBy = b.CreatedBy[i]
+			}
+		}
+		if d.Digests[0] != d.Digests[1] {
+			return d
+		}
+	}
+	return &Divergence{Layer: -1, Digests: [2]digest.Digest{a.Config, b.Config}}
+}
@@ -0,0 +1,203 @@
+package imageutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	name    string
+	content string
+	modTime time.Time
+}
+
+// testArchive writes an OCI archive like BuildKit's OCI exporter, with a
+// gzipped layer for each history entry that is not empty.
+type testArchive struct {
+	t     *testing.T
+	tw    *tar.Writer
+	blobs map[digest.Digest]bool
+}
+
+func (ta *testArchive) write(name string, dt []byte) {
+	require.NoError(ta.t, ta.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(dt)),
+	}))
+	_, err := ta.tw.Write(dt)
+	require.NoError(ta.t, err)
+}
+
+func (ta *testArchive) blob(mediaType string, dt []byte) specs.Descriptor {
+	desc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}
+	if !ta.blobs[desc.Digest] {
+		ta.blobs[desc.Digest] = true
+		ta.write("blobs/sha256/"+desc.Digest.Encoded(), dt)
+	}
+	return desc
+}
+
+func (ta *testArchive) json(mediaType string, v interface{}) specs.Descriptor {
+	dt, err := json.Marshal(v)
+	require.NoError(ta.t, err)
+	return ta.blob(mediaType, dt)
+}
+
+func writeTestArchive(t *testing.T, history []specs.History, layers ...[]testFile) []byte {
+	var buf bytes.Buffer
+	ta := &testArchive{t: t, tw: tar.NewWriter(&buf), blobs: make(map[digest.Digest]bool)}
+
+	config := specs.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       specs.RootFS{Type: "layers"},
+		History:      history,
+	}
+	mfst := specs.Manifest{MediaType: specs.MediaTypeImageManifest}
+	mfst.SchemaVersion = 2
+	for _, files := range layers {
+		var layer bytes.Buffer
+		ltw := tar.NewWriter(&layer)
+		for _, f := range files {
+			require.NoError(t, ltw.WriteHeader(&tar.Header{
+				Name:     f.name,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(f.content)),
+				ModTime:  f.modTime,
+			}))
+			_, err := ltw.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, ltw.Close())
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(layer.Bytes()))
+
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		_, err := zw.Write(layer.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		mfst.Layers = append(mfst.Layers, ta.blob(specs.MediaTypeImageLayerGzip, compressed.Bytes()))
+	}
+	mfst.Config = ta.json(specs.MediaTypeImageConfig, config)
+
+	idx := specs.Index{
+		MediaType: specs.MediaTypeImageIndex,
+		Manifests: []specs.Descriptor{ta.json(specs.MediaTypeImageManifest, mfst)},
+	}
+	idx.SchemaVersion = 2
+	dt, err := json.Marshal(idx)
+	require.NoError(t, err)
+	ta.write("index.json", dt)
+	ta.write("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	require.NoError(t, ta.tw.Close())
+	return buf.Bytes()
+}
+
+func TestReadArchive(t *testing.T) {
+	t.Parallel()
+
+	var (
+		epoch   = time.Unix(0, 0).UTC()
+		base    = []testFile{{"etc/os-release", "alpine", time.Unix(1600000000, 0)}}
+		history = []specs.History{
+			{CreatedBy: "ADD rootfs"},
+			{CreatedBy: "WORKDIR /", EmptyLayer: true},
+			{CreatedBy: "RUN date > /f"},
+		}
+		first  = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+		second = first.Add(time.Minute)
+	)
+
+	t.Run("timestamps are rewritten", func(t *testing.T) {
+		t.Parallel()
+
+		a, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history, base,
+			[]testFile{{"f", "hello\n", first}},
+		)), epoch)
+		require.NoError(t, err)
+		b, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history, base,
+			[]testFile{{"f", "hello\n", second}},
+		)), epoch)
+		require.NoError(t, err)
+
+		require.Len(t, a.Layers, 2)
+		require.Equal(t, []string{"ADD rootfs", "RUN date > /f"}, a.CreatedBy)
+		require.Equal(t, a.Digest, b.Digest)
+		require.Nil(t, Diverge(a, b))
+	})
+
+	t.Run("run date is not reproducible", func(t *testing.T) {
+		t.Parallel()
+
+		a, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history, base,
+			[]testFile{{"f", first.Format(time.UnixDate) + "\n", first}},
+		)), epoch)
+		require.NoError(t, err)
+		b, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history, base,
+			[]testFile{{"f", second.Format(time.UnixDate) + "\n", second}},
+		)), epoch)
+		require.NoError(t, err)
+
+		require.NotEqual(t, a.Digest, b.Digest)
+		d := Diverge(a, b)
+		require.NotNil(t, d)
+		require.Equal(t, 1, d.Layer)
+		require.Equal(t, "RUN date > /f", d.CreatedBy)
+		require.Equal(t, [2]digest.Digest{a.Layers[1], b.Layers[1]}, d.Digests)
+		require.Equal(t, "layer 1 (RUN date > /f) differs: "+a.Layers[1].String()+" != "+b.Layers[1].String(), d.String())
+	})
+
+	t.Run("timestamps before the epoch are kept", func(t *testing.T) {
+		t.Parallel()
+
+		epoch := time.Unix(1700000000, 0).UTC()
+		a, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history[:1], base)), epoch)
+		require.NoError(t, err)
+		b, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history[:1],
+			[]testFile{{"etc/os-release", "alpine", time.Unix(1500000000, 0)}},
+		)), epoch)
+		require.NoError(t, err)
+
+		d := Diverge(a, b)
+		require.NotNil(t, d)
+		require.Equal(t, 0, d.Layer)
+	})
+
+	t.Run("config differs", func(t *testing.T) {
+		t.Parallel()
+
+		a, err := ReadArchive(bytes.NewReader(writeTestArchive(t, history[:1], base)), epoch)
+		require.NoError(t, err)
+		b, err := ReadArchive(bytes.NewReader(writeTestArchive(t, []specs.History{{CreatedBy: "COPY rootfs"}}, base)), epoch)
+		require.NoError(t, err)
+
+		d := Diverge(a, b)
+		require.NotNil(t, d)
+		require.Equal(t, -1, d.Layer)
+		require.Equal(t, [2]digest.Digest{a.Config, b.Config}, d.Digests)
+	})
+
+	t.Run("missing index", func(t *testing.T) {
+		t.Parallel()
+
+		var buf bytes.Buffer
+		require.NoError(t, tar.NewWriter(&buf).Close())
+		_, err := ReadArchive(&buf, epoch)
+		require.EqualError(t, err, "no index.json in the archive")
+	})
+}
@@ -0,0 +1,74 @@
+package imageutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImageSize resolves ref and returns the size of its image in bytes, which is
+// the size of its config and compressed layers as stored in the registry.
+//
+// If ref points to a manifest list, the platform matcher is used to only
+// consider the manifest of the matching platform.
+func ImageSize(ctx context.Context, resolver remotes.Resolver, matcher platforms.MatchComparer, ref string) (int64, error) {
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	err = images.Walk(ctx, images.HandlerFunc(func(ctx context.Context, desc specs.Descriptor) ([]specs.Descriptor, error) {
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, specs.MediaTypeImageManifest:
+			rc, err := fetcher.Fetch(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+
+			var mfst specs.Manifest
+			err = json.NewDecoder(rc).Decode(&mfst)
+			if err != nil {
+				return nil, err
+			}
+
+			size += mfst.Config.Size
+			for _, layer := range mfst.Layers {
+				size += layer.Size
+			}
+			return nil, nil
+		case images.MediaTypeDockerSchema2ManifestList, specs.MediaTypeImageIndex:
+			rc, err := fetcher.Fetch(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+
+			var idx specs.Index
+			err = json.NewDecoder(rc).Decode(&idx)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, d := range idx.Manifests {
+				if d.Platform == nil || matcher.Match(*d.Platform) {
+					return []specs.Descriptor{d}, nil
+				}
+			}
+			return nil, fmt.Errorf("failed to find manifest matching platform")
+		}
+		return nil, fmt.Errorf("unexpected media type %v for %v", desc.MediaType, desc.Digest)
+	}), desc)
+	return size, err
+}
@@ -0,0 +1,157 @@
+package imageutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type testResolver struct {
+	refs  map[string]specs.Descriptor
+	blobs map[digest.Digest][]byte
+	store content.Store
+}
+
+func newTestResolver(t *testing.T) *testResolver {
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	return &testResolver{
+		refs:  make(map[string]specs.Descriptor),
+		blobs: make(map[digest.Digest][]byte),
+		store: store,
+	}
+}
+
+func (tr *testResolver) add(t *testing.T, mediaType string, v interface{}) specs.Descriptor {
+	dt, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	desc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}
+	tr.blobs[desc.Digest] = dt
+	return desc
+}
+
+func (tr *testResolver) Resolve(ctx context.Context, ref string) (string, specs.Descriptor, error) {
+	desc, ok := tr.refs[ref]
+	if !ok {
+		return "", specs.Descriptor{}, fmt.Errorf("unrecognized ref %s", ref)
+	}
+	return ref, desc, nil
+}
+
+func (tr *testResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return tr, nil
+}
+
+func (tr *testResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return &testPusher{tr, ref}, nil
+}
+
+// testPusher points its ref to the descriptors committed to it.
+type testPusher struct {
+	tr  *testResolver
+	ref string
+}
+
+func (tp *testPusher) Push(ctx context.Context, desc specs.Descriptor) (content.Writer, error) {
+	if existing, ok := tp.tr.refs[tp.ref]; ok && existing.Digest == desc.Digest {
+		return nil, errdefs.ErrAlreadyExists
+	}
+	w, err := content.OpenWriter(ctx, tp.tr.store, content.WithRef(tp.ref), content.WithDescriptor(desc))
+	if err != nil {
+		return nil, err
+	}
+	return &testWriter{w, tp, desc}, nil
+}
+
+type testWriter struct {
+	content.Writer
+	tp   *testPusher
+	desc specs.Descriptor
+}
+
+func (tw *testWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	err := tw.Writer.Commit(ctx, size, expected, opts...)
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	tw.tp.tr.refs[tw.tp.ref] = tw.desc
+	return nil
+}
+
+func (tr *testResolver) Fetch(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error) {
+	dt, ok := tr.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized digest %s", desc.Digest)
+	}
+	return ioutil.NopCloser(bytes.NewReader(dt)), nil
+}
+
+func TestImageSize(t *testing.T) {
+	t.Parallel()
+
+	tr := newTestResolver(t)
+	amd64 := tr.add(t, specs.MediaTypeImageManifest, specs.Manifest{
+		Config: specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Size: 1000},
+		Layers: []specs.Descriptor{
+			{MediaType: specs.MediaTypeImageLayerGzip, Size: 20000},
+			{MediaType: specs.MediaTypeImageLayerGzip, Size: 300},
+		},
+	})
+	arm64 := tr.add(t, images.MediaTypeDockerSchema2Manifest, specs.Manifest{
+		Config: specs.Descriptor{MediaType: images.MediaTypeDockerSchema2Config, Size: 2000},
+		Layers: []specs.Descriptor{
+			{MediaType: images.MediaTypeDockerSchema2LayerGzip, Size: 50000},
+		},
+	})
+	amd64.Platform = &specs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64.Platform = &specs.Platform{OS: "linux", Architecture: "arm64"}
+	index := tr.add(t, specs.MediaTypeImageIndex, specs.Index{
+		Manifests: []specs.Descriptor{amd64, arm64},
+	})
+
+	tr.refs["app:amd64"] = amd64
+	tr.refs["app:multiplatform"] = index
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		ref      string
+		platform specs.Platform
+		expected int64
+	}{{
+		"app:amd64", specs.Platform{OS: "linux", Architecture: "amd64"}, 21300,
+	}, {
+		"app:multiplatform", specs.Platform{OS: "linux", Architecture: "amd64"}, 21300,
+	}, {
+		"app:multiplatform", specs.Platform{OS: "linux", Architecture: "arm64"}, 52000,
+	}} {
+		tc := tc
+		t.Run(tc.ref+"/"+tc.platform.Architecture, func(t *testing.T) {
+			t.Parallel()
+			size, err := ImageSize(ctx, tr, platforms.Only(tc.platform), tc.ref)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, size)
+		})
+	}
+
+	_, err := ImageSize(ctx, tr, platforms.Only(specs.Platform{OS: "windows", Architecture: "amd64"}), "app:multiplatform")
+	require.Error(t, err)
+}
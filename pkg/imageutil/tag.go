@@ -0,0 +1,45 @@
+package imageutil
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+)
+
+// Tag points ref to the image already pushed to src, without pushing any of
+// its layers again. Both refs must be in the same repository.
+func Tag(ctx context.Context, resolver remotes.Resolver, src, ref string) error {
+	_, desc, err := resolver.Resolve(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	pusher, err := resolver.Pusher(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer w.Close()
+
+	return content.Copy(ctx, w, rc, desc.Size, desc.Digest)
+}
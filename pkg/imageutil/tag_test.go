@@ -0,0 +1,30 @@
+package imageutil
+
+import (
+	"context"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTag(t *testing.T) {
+	t.Parallel()
+
+	tr := newTestResolver(t)
+	desc := tr.add(t, specs.MediaTypeImageManifest, specs.Manifest{
+		Config: specs.Descriptor{MediaType: specs.MediaTypeImageConfig, Size: 1000},
+	})
+	pushed := "docker.io/library/app@" + desc.Digest.String()
+	tr.refs[pushed] = desc
+
+	ctx := context.Background()
+	err := Tag(ctx, tr, pushed, "docker.io/library/app:latest")
+	require.NoError(t, err)
+	require.Equal(t, desc, tr.refs["docker.io/library/app:latest"])
+
+	// Tagging the same image again is a no-op.
+	err = Tag(ctx, tr, pushed, "docker.io/library/app:latest")
+	require.NoError(t, err)
+	require.Equal(t, desc, tr.refs["docker.io/library/app:latest"])
+}
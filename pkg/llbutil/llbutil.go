@@ -1,8 +1,11 @@
 package llbutil
 
 import (
+	"context"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/moby/buildkit/client/llb"
@@ -37,6 +40,59 @@ func WithSourcePath(path string) SourcePathMountOption {
 	return SourcePathMountOption{Path: path}
 }
 
+// Barrier returns an empty state that can only be built after every step has
+// been built. Nothing is copied from the steps, so their contents don't affect
+// the cache key of ops depending on the barrier.
+func Barrier(steps ...llb.State) llb.State {
+	st := llb.Scratch()
+	for _, step := range steps {
+		st = st.File(llb.Copy(step, "/.hlb-barrier-*", "/", &llb.CopyInfo{
+			AllowWildcard:      true,
+			AllowEmptyWildcard: true,
+		}))
+	}
+	return st
+}
+
+// SourceOp returns the source op that st is defined by, or nil if st is not
+// directly a source.
+func SourceOp(ctx context.Context, st llb.State) (*pb.SourceOp, error) {
+	out := st.Output()
+	if out == nil {
+		return nil, nil
+	}
+
+	c := &llb.Constraints{}
+	_, dt, _, _, err := out.Vertex(ctx, c).Marshal(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var op pb.Op
+	err = op.Unmarshal(dt)
+	if err != nil {
+		return nil, err
+	}
+
+	src, ok := op.Op.(*pb.Op_Source)
+	if !ok {
+		return nil, nil
+	}
+	return src.Source, nil
+}
+
+type GitCommitOption struct {
+	SHA string
+}
+
+var commitSHA = regexp.MustCompile(`^[a-f0-9]{40}$`)
+
+// IsCommitSHA returns true if str is a full commit sha in the format accepted
+// by BuildKit git sources.
+func IsCommitSHA(str string) bool {
+	return commitSHA.MatchString(str)
+}
+
 type CacheMountOption struct {
 	ID      string
 	Sharing llb.CacheMountSharingMode
@@ -83,6 +139,19 @@ func (m *MountRunOption) IsReadonly() bool {
 	return false
 }
 
+// SelectPath returns a state rooted at path within st. Selecting the root
+// returns st unchanged, otherwise the contents at path are copied onto
+// scratch.
+func SelectPath(st llb.State, path string) llb.State {
+	if path == "" || filepath.Clean("/"+path) == "/" {
+		return st
+	}
+	return llb.Scratch().File(llb.Copy(st, path, "/", &llb.CopyInfo{
+		CopyDirContentsOnly: true,
+		FollowSymlinks:      true,
+	}))
+}
+
 type GatewayOption func(r *gateway.SolveRequest)
 
 func FrontendInput(key string, def *llb.Definition) GatewayOption {
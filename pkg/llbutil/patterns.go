@@ -0,0 +1,35 @@
+package llbutil
+
+import (
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// ValidatePattern returns an error if pattern cannot be compiled as a
+// dockerignore style pattern.
+func ValidatePattern(pattern string) error {
+	_, err := fileutils.NewPatternMatcher([]string{pattern})
+	return err
+}
+
+// MatchesPatterns returns whether filename or one of its parents is matched
+// by patterns, using the same semantics as BuildKit's include and exclude
+// patterns. Patterns prefixed with "!" re-include the paths they match, and
+// the last pattern that matches wins.
+func MatchesPatterns(filename string, patterns []string) (bool, error) {
+	var relative []string
+	for _, pattern := range patterns {
+		relative = append(relative, relativePattern(pattern))
+	}
+	return fileutils.MatchesOrParentMatches(strings.TrimPrefix(filename, "/"), relative)
+}
+
+// relativePattern strips the leading slash from a pattern, preserving its
+// "!" prefix if it has one.
+func relativePattern(pattern string) string {
+	if strings.HasPrefix(pattern, "!") {
+		return "!" + strings.TrimPrefix(pattern[1:], "/")
+	}
+	return strings.TrimPrefix(pattern, "/")
+}
@@ -0,0 +1,75 @@
+package llbutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchesPatterns(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		filename string
+		patterns []string
+		expected bool
+	}{{
+		"no patterns",
+		"app/main.go",
+		nil,
+		false,
+	}, {
+		"glob at any depth",
+		"/app/pkg/foo.test",
+		[]string{"/app/**/*.test"},
+		true,
+	}, {
+		"parent matched",
+		"app/keep/file",
+		[]string{"app"},
+		true,
+	}, {
+		"negation after match re-includes",
+		"app/keep.log",
+		[]string{"*/*.log", "!app/keep.log"},
+		false,
+	}, {
+		"match after negation excludes again",
+		"app/keep.log",
+		[]string{"!app/keep.log", "*/*.log"},
+		true,
+	}, {
+		"negation of child within matched parent",
+		"build/keep/file",
+		[]string{"build", "!build/keep"},
+		false,
+	}, {
+		"negation does not affect siblings",
+		"build/other",
+		[]string{"build", "!build/keep"},
+		true,
+	}, {
+		"last of several negations wins",
+		"app/a.log",
+		[]string{"**/*.log", "!app", "app/a.log"},
+		true,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			matched, err := MatchesPatterns(tc.filename, tc.patterns)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, matched)
+		})
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, ValidatePattern("!app/keep"))
+	require.NoError(t, ValidatePattern("**/*.log"))
+	require.Error(t, ValidatePattern("!"))
+	require.Error(t, ValidatePattern("[a-"))
+}
@@ -0,0 +1,150 @@
+package redact
+
+import "sort"
+
+// matcher finds occurrences of many patterns in a single pass over its input,
+// with the automaton of Aho-Corasick.
+type matcher struct {
+	nodes    []node
+	patterns []pattern
+}
+
+type pattern struct {
+	value string
+	name  string
+}
+
+type node struct {
+	next  map[byte]int
+	fail  int
+	depth int
+
+	// out is the index of the pattern that ends at the node, or -1.
+	out int
+
+	// dict is the nearest node on the chain of fail links with a pattern, or
+	// -1, so that every pattern ending at a position is found.
+	dict int
+}
+
+// match is an occurrence of a pattern in [start, end) of an input.
+type match struct {
+	start, end int
+	pattern    int
+}
+
+func newMatcher(patterns []pattern) *matcher {
+	m := &matcher{
+		nodes:    []node{{next: make(map[byte]int), out: -1, dict: -1}},
+		patterns: patterns,
+	}
+	for i, p := range patterns {
+		n := 0
+		for j := 0; j < len(p.value); j++ {
+			c := p.value[j]
+			next, ok := m.nodes[n].next[c]
+			if !ok {
+				next = len(m.nodes)
+				m.nodes = append(m.nodes, node{
+					next:  make(map[byte]int),
+					depth: m.nodes[n].depth + 1,
+					out:   -1,
+					dict:  -1,
+				})
+				m.nodes[n].next[c] = next
+			}
+			n = next
+		}
+		m.nodes[n].out = i
+	}
+
+	// Fail links are found breadth first, so that the fail link of a node is
+	// always found before its children need it.
+	queue := []int{}
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[n].next {
+			fail := m.nodes[n].fail
+			for {
+				if next, ok := m.nodes[fail].next[c]; ok && next != child {
+					m.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = m.nodes[fail].fail
+			}
+
+			f := m.nodes[child].fail
+			if m.nodes[f].out >= 0 {
+				m.nodes[child].dict = f
+			} else {
+				m.nodes[child].dict = m.nodes[f].dict
+			}
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+// step returns the node after n consumes c.
+func (m *matcher) step(n int, c byte) int {
+	for {
+		if next, ok := m.nodes[n].next[c]; ok {
+			return next
+		}
+		if n == 0 {
+			return 0
+		}
+		n = m.nodes[n].fail
+	}
+}
+
+// find returns the occurrences of the patterns in p, which don't overlap and
+// are the leftmost and then longest, and the length of the longest suffix of
+// p that starts a pattern.
+func (m *matcher) find(p []byte) ([]match, int) {
+	var (
+		all []match
+		n   int
+	)
+	for i := 0; i < len(p); i++ {
+		n = m.step(n, p[i])
+		for out := n; out >= 0; out = m.nodes[out].dict {
+			if m.nodes[out].out < 0 {
+				continue
+			}
+			pat := m.nodes[out].out
+			all = append(all, match{
+				start:   i + 1 - len(m.patterns[pat].value),
+				end:     i + 1,
+				pattern: pat,
+			})
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].start != all[j].start {
+			return all[i].start < all[j].start
+		}
+		return all[i].end > all[j].end
+	})
+
+	var (
+		matches []match
+		end     int
+	)
+	for _, mt := range all {
+		if mt.start < end {
+			continue
+		}
+		matches = append(matches, mt)
+		end = mt.end
+	}
+	return matches, m.nodes[n].depth
+}
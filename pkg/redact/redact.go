@@ -0,0 +1,221 @@
+// Package redact scrubs sensitive values, like the contents of secrets, from
+// output before it is written anywhere.
+package redact
+
+import (
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// MinLength is the length of the shortest value that is redacted. Shorter
+// values, like "1" or "true", are too likely to appear in unrelated output,
+// so redacting them would mangle logs without protecting much.
+const MinLength = 5
+
+// Set is a set of sensitive values, each with the name it is redacted as.
+// Values are also redacted in their base64 and URL encodings. A nil Set
+// redacts nothing.
+type Set struct {
+	mu     sync.RWMutex
+	values map[string]string
+
+	// m matches the values, and is built again once values are added.
+	m *matcher
+}
+
+// NewSet returns an empty Set.
+func NewSet() *Set {
+	return &Set{values: make(map[string]string)}
+}
+
+// Add registers a sensitive value, which is redacted as `[redacted:<name>]`
+// along with its encodings. Values shorter than MinLength are ignored. A value
+// added more than once keeps its first name.
+func (s *Set) Add(name, value string) {
+	if s == nil || len(value) < MinLength {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, encoded := range encodings(value) {
+		if _, ok := s.values[encoded]; ok {
+			continue
+		}
+		s.values[encoded] = name
+		s.m = nil
+	}
+}
+
+// encodings returns a value and its common encodings.
+func encodings(value string) []string {
+	dt := []byte(value)
+	return []string{
+		value,
+		base64.StdEncoding.EncodeToString(dt),
+		base64.RawStdEncoding.EncodeToString(dt),
+		base64.URLEncoding.EncodeToString(dt),
+		base64.RawURLEncoding.EncodeToString(dt),
+		url.QueryEscape(value),
+		url.PathEscape(value),
+	}
+}
+
+// Len returns the number of values registered, including their encodings.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values)
+}
+
+// matcher returns the matcher of the values, or nil if there are none.
+func (s *Set) matcher() *matcher {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	m, n := s.m, len(s.values)
+	s.mu.RUnlock()
+	if m != nil || n == 0 {
+		return m
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		var patterns []pattern
+		for value, name := range s.values {
+			patterns = append(patterns, pattern{value: value, name: name})
+		}
+		sort.Slice(patterns, func(i, j int) bool {
+			return patterns[i].value < patterns[j].value
+		})
+		s.m = newMatcher(patterns)
+	}
+	return s.m
+}
+
+// Redact returns str with every sensitive value replaced.
+func (s *Set) Redact(str string) string {
+	m := s.matcher()
+	if m == nil {
+		return str
+	}
+	out, _ := scrub(m, []byte(str), false)
+	return string(out)
+}
+
+// RedactBytes returns p with every sensitive value replaced. The p is returned
+// as is if it has none.
+func (s *Set) RedactBytes(p []byte) []byte {
+	m := s.matcher()
+	if m == nil {
+		return p
+	}
+	out, _ := scrub(m, p, false)
+	return out
+}
+
+// scrub replaces the matches in p. When streaming, the end of p that may be
+// the start of a value split across writes is held back and returned as the
+// rest.
+func scrub(m *matcher, p []byte, streaming bool) (out, rest []byte) {
+	matches, depth := m.find(p)
+
+	cut := len(p)
+	if streaming {
+		cut -= depth
+		for _, mt := range matches {
+			if mt.end > cut && mt.start < cut {
+				cut = mt.start
+				break
+			}
+		}
+	}
+
+	if len(matches) == 0 || matches[0].start >= cut {
+		return p[:cut], p[cut:]
+	}
+
+	var last int
+	for _, mt := range matches {
+		if mt.end > cut {
+			break
+		}
+		out = append(out, p[last:mt.start]...)
+		out = append(out, "[redacted:"...)
+		out = append(out, m.patterns[mt.pattern].name...)
+		out = append(out, ']')
+		last = mt.end
+	}
+	out = append(out, p[last:cut]...)
+	return out, p[cut:]
+}
+
+// Stream redacts a stream of output written in chunks, where a value may be
+// split across chunks. It holds back the end of a chunk that may start a
+// value until the next chunk or Flush.
+type Stream struct {
+	set     *Set
+	pending []byte
+}
+
+// Stream returns a new Stream redacting the values of s.
+func (s *Set) Stream() *Stream {
+	return &Stream{set: s}
+}
+
+// Write returns the redacted output of the stream that is ready after p.
+func (st *Stream) Write(p []byte) []byte {
+	m := st.set.matcher()
+	if m == nil {
+		out := append(st.pending, p...)
+		st.pending = nil
+		return out
+	}
+
+	out, rest := scrub(m, append(st.pending, p...), true)
+	st.pending = append([]byte(nil), rest...)
+	return out
+}
+
+// Flush returns the redacted output held back at the end of the stream.
+func (st *Stream) Flush() []byte {
+	out := st.set.RedactBytes(st.pending)
+	st.pending = nil
+	return out
+}
+
+// Writer redacts the output written to an underlying writer. Output that may
+// start a value is held back until it is written or flushed.
+type Writer struct {
+	w  io.Writer
+	st *Stream
+}
+
+// NewWriter returns a Writer redacting the values of s from the output
+// written to w.
+func (s *Set) NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, st: s.Stream()}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	_, err := w.w.Write(w.st.Write(p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the output held back.
+func (w *Writer) Flush() error {
+	_, err := w.w.Write(w.st.Flush())
+	return err
+}
@@ -0,0 +1,108 @@
+package redact
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	const token = "s3cr3t/t0ken+value"
+	s := NewSet()
+	s.Add("TOKEN", token)
+	s.Add("PASSWORD", "hunter2")
+	s.Add("PIN", "1234")
+
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected string
+	}{{
+		"plain",
+		"token is " + token + "\n",
+		"token is [redacted:TOKEN]\n",
+	}, {
+		"base64",
+		"Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(token)),
+		"Authorization: Basic [redacted:TOKEN]",
+	}, {
+		"url encoded",
+		"https://example.com/?token=" + url.QueryEscape(token),
+		"https://example.com/?token=[redacted:TOKEN]",
+	}, {
+		"many values",
+		"hunter2:" + token + ":hunter2",
+		"[redacted:PASSWORD]:[redacted:TOKEN]:[redacted:PASSWORD]",
+	}, {
+		"short values are not redacted",
+		"pin 1234",
+		"pin 1234",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.expected, s.Redact(tc.input))
+			require.Equal(t, tc.expected, string(s.RedactBytes([]byte(tc.input))))
+		})
+	}
+
+	// A nil set redacts nothing.
+	var nilSet *Set
+	nilSet.Add("TOKEN", token)
+	require.Equal(t, token, nilSet.Redact(token))
+}
+
+func TestRedactOverlapping(t *testing.T) {
+	t.Parallel()
+
+	s := NewSet()
+	s.Add("SHORT", "abcdef")
+	s.Add("LONG", "abcdefgh")
+	s.Add("SUFFIX", "defghij")
+
+	// The leftmost value is redacted first, and then the longest.
+	require.Equal(t, "x[redacted:LONG]ij", s.Redact("xabcdefghij"))
+	require.Equal(t, "[redacted:SHORT]x", s.Redact("abcdefx"))
+	require.Equal(t, "ab[redacted:SUFFIX]", s.Redact("abdefghij"))
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	const token = "s3cr3t-t0ken"
+	s := NewSet()
+	s.Add("TOKEN", token)
+
+	input := "export TOKEN=" + token + "\necho " + token + " " + token[:4] + "\n"
+	expected := s.Redact(input)
+	require.NotContains(t, expected, token)
+
+	// Values split at any point across writes are redacted.
+	for size := 1; size <= len(input); size++ {
+		var (
+			st  = s.Stream()
+			out strings.Builder
+		)
+		for i := 0; i < len(input); i += size {
+			end := i + size
+			if end > len(input) {
+				end = len(input)
+			}
+			out.Write(st.Write([]byte(input[i:end])))
+		}
+		out.Write(st.Flush())
+		require.Equal(t, expected, out.String(), "chunks of %d", size)
+	}
+
+	// Values added after a stream starts are redacted from later writes.
+	st := s.Stream()
+	require.Equal(t, "password=", string(st.Write([]byte("password="))))
+	s.Add("PASSWORD", "hunter2")
+	require.Equal(t, "[redacted:PASSWORD]\n", string(st.Write([]byte("hunter2\n"))))
+	require.Empty(t, st.Flush())
+}
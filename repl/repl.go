@@ -0,0 +1,379 @@
+// Package repl evaluates HLB interactively. Declarations are merged into a
+// module that persists across inputs, and expressions are evaluated against
+// it and printed.
+package repl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/chzyer/readline"
+	isatty "github.com/mattn/go-isatty"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/identity"
+	solvererrdefs "github.com/moby/buildkit/solver/errdefs"
+	"github.com/openllb/hlb/codegen"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/openllb/hlb/solver"
+)
+
+const (
+	prompt         = "hlb> "
+	continuePrompt = "...> "
+)
+
+// Info is the configuration of Run.
+type Info struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// HistoryFile is where the history of inputs is kept between sessions
+	// when reading from a terminal.
+	HistoryFile string
+
+	// CodeGenOptions are the options of the code generator that evaluates
+	// expressions.
+	CodeGenOptions []codegen.CodeGenOption
+}
+
+// Option is optional configuration for Run.
+type Option func(*Info)
+
+// WithStdio sets the reader that inputs are read from and the writers that
+// values and errors are written to. Prompts are only written when stdin is a
+// terminal.
+func WithStdio(stdin io.Reader, stdout, stderr io.Writer) Option {
+	return func(info *Info) {
+		info.Stdin = stdin
+		info.Stdout = stdout
+		info.Stderr = stderr
+	}
+}
+
+// WithHistoryFile sets the file that the history of inputs is kept in.
+func WithHistoryFile(filename string) Option {
+	return func(info *Info) {
+		info.HistoryFile = filename
+	}
+}
+
+// WithCodeGenOptions sets the options of the code generator that evaluates
+// expressions.
+func WithCodeGenOptions(opts ...codegen.CodeGenOption) Option {
+	return func(info *Info) {
+		info.CodeGenOptions = append(info.CodeGenOptions, opts...)
+	}
+}
+
+// Run reads inputs until the end of stdin or :quit. An input is a line, or
+// the lines until its braces are balanced. Inputs that declare functions,
+// imports or exports are merged into the session's module, and any other
+// input is evaluated as the statements of a function and its value printed.
+// Errors are printed and do not end the session.
+func Run(ctx context.Context, cln *client.Client, resolver codegen.Resolver, opts ...Option) error {
+	info := Info{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	for _, opt := range opts {
+		opt(&info)
+	}
+
+	s, err := newSession(cln, resolver, info.CodeGenOptions)
+	if err != nil {
+		return err
+	}
+
+	lr, err := newLineReader(s, info)
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+
+	ctx = codegen.WithSessionID(ctx, identity.NewID())
+	for {
+		input, err := readInput(lr)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, readline.ErrInterrupt) {
+				return nil
+			}
+			return err
+		}
+
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+
+		if strings.HasPrefix(input, ":") {
+			quit, err := s.command(ctx, info.Stdout, input)
+			if err != nil {
+				printError(ctx, info.Stderr, err)
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+
+		err = s.eval(ctx, info.Stdout, input)
+		if err != nil {
+			printError(ctx, info.Stderr, err)
+		}
+	}
+}
+
+// command runs a meta-command, and returns true if the session should end.
+func (s *session) command(ctx context.Context, w io.Writer, input string) (bool, error) {
+	args := strings.Fields(input)
+	switch args[0] {
+	case ":quit", ":q":
+		return true, nil
+	case ":help", ":h":
+		fmt.Fprint(w, help)
+		return false, nil
+	case ":solve":
+		if len(args) != 1 {
+			return false, fmt.Errorf(":solve takes no arguments")
+		}
+		return false, s.solve(ctx, nil)
+	case ":download":
+		if len(args) != 2 {
+			return false, fmt.Errorf(":download takes the local path to download to")
+		}
+		return false, s.solve(ctx, args[1:])
+	}
+	return false, fmt.Errorf("unknown command %s, type :help for a list of commands", args[0])
+}
+
+const help = `Declarations are added to the session, replacing those of the same name.
+Anything else is evaluated as the body of a function and its value printed.
+
+:solve            build the last filesystem evaluated
+:download <path>  build the last filesystem evaluated and download it to path
+:help             print this help
+:quit             end the session
+`
+
+// solve builds the last filesystem evaluated, and downloads it if a local
+// path is given.
+func (s *session) solve(ctx context.Context, download []string) error {
+	if s.last == nil {
+		return fmt.Errorf("no filesystem has been evaluated")
+	}
+	if s.cln == nil {
+		return fmt.Errorf("cannot solve without a buildkit client")
+	}
+
+	fs, err := s.last.Filesystem()
+	if err != nil {
+		return err
+	}
+	if len(download) > 0 {
+		fs.SolveOpts = append(fs.SolveOpts, solver.WithDownload(download[0]))
+		fs.SessionOpts = append(fs.SessionOpts, llbutil.WithSyncTargetDir(download[0]))
+	}
+
+	val, err := codegen.NewValue(ctx, fs)
+	if err != nil {
+		return err
+	}
+	request, err := val.Request()
+	if err != nil {
+		return err
+	}
+	return request.Solve(solver.WithRedactionSet(ctx, s.redactions), s.cln, codegen.MultiWriter(ctx))
+}
+
+// printError prints an error with the diagnostics of its spans.
+func printError(ctx context.Context, w io.Writer, err error) {
+	spans := diagnostic.SourcesToSpans(ctx, solvererrdefs.Sources(err), err)
+	if len(spans) > 0 {
+		diagnostic.DisplayError(ctx, w, spans, err, false)
+		return
+	}
+
+	spans = diagnostic.Spans(err)
+	if len(spans) == 0 {
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	for _, span := range spans {
+		fmt.Fprintln(w, span.Pretty(ctx))
+	}
+}
+
+// lineReader reads the lines of inputs.
+type lineReader interface {
+	Readline() (string, error)
+	SetPrompt(prompt string)
+	Close() error
+}
+
+func newLineReader(s *session, info Info) (lineReader, error) {
+	f, ok := info.Stdin.(*os.File)
+	if !ok || !isatty.IsTerminal(f.Fd()) {
+		return &scanReader{bufio.NewScanner(info.Stdin)}, nil
+	}
+
+	return readline.NewEx(&readline.Config{
+		Prompt:       prompt,
+		Stdin:        f,
+		Stdout:       info.Stdout,
+		Stderr:       info.Stderr,
+		HistoryFile:  info.HistoryFile,
+		AutoComplete: &completer{s},
+	})
+}
+
+// scanReader reads lines without prompts, for inputs that are not a
+// terminal.
+type scanReader struct {
+	*bufio.Scanner
+}
+
+func (r *scanReader) Readline() (string, error) {
+	if !r.Scan() {
+		if err := r.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.Text(), nil
+}
+
+func (r *scanReader) SetPrompt(string) {}
+
+func (r *scanReader) Close() error { return nil }
+
+// readInput reads lines until the braces of an input are balanced.
+func readInput(lr lineReader) (string, error) {
+	lr.SetPrompt(prompt)
+	defer lr.SetPrompt(prompt)
+
+	var (
+		sb  strings.Builder
+		bal balance
+	)
+	for {
+		line, err := lr.Readline()
+		if err != nil {
+			if errors.Is(err, io.EOF) && sb.Len() > 0 {
+				return sb.String(), nil
+			}
+			return "", err
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+
+		bal.scan(line)
+		if bal.done() {
+			return sb.String(), nil
+		}
+		lr.SetPrompt(continuePrompt)
+	}
+}
+
+// balance tracks the braces of an input that are still open, ignoring
+// those in strings, comments and heredocs.
+type balance struct {
+	braces  int
+	heredoc string
+}
+
+func (b *balance) done() bool {
+	return b.braces <= 0 && b.heredoc == ""
+}
+
+func (b *balance) scan(line string) {
+	if b.heredoc != "" {
+		if strings.TrimSpace(line) == b.heredoc {
+			b.heredoc = ""
+		}
+		return
+	}
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '#':
+			return
+		case c == '"' || c == '`':
+			for i++; i < len(line) && line[i] != c; i++ {
+				if c == '"' && line[i] == '\\' {
+					i++
+				}
+			}
+		case c == '<' && strings.HasPrefix(line[i:], "<<"):
+			j := i + 2
+			if j < len(line) && (line[j] == '-' || line[j] == '~') {
+				j++
+			}
+			if j < len(line) && line[j] == '`' {
+				j++
+			}
+			k := j
+			for k < len(line) && isWordChar(line[k]) {
+				k++
+			}
+			if k > j {
+				b.heredoc = line[j:k]
+				i = k - 1
+			}
+		case c == '{':
+			b.braces++
+		case c == '}':
+			b.braces--
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// completer completes the word before the cursor from the names in the
+// session's scope, which include the builtins, and the meta-commands.
+type completer struct {
+	s *session
+}
+
+var commands = []string{":download", ":help", ":quit", ":solve"}
+
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	start := pos
+	for start > 0 && (isWordChar(byte(line[start-1])) || line[start-1] == ':') {
+		start--
+	}
+	prefix := string(line[start:pos])
+
+	candidates := commands
+	if !strings.HasPrefix(prefix, ":") {
+		candidates = c.s.mod.Scope.Identifiers(nil)
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) && candidate != prefix {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+
+	var suffixes [][]rune
+	for i, match := range matches {
+		if i > 0 && match == matches[i-1] {
+			continue
+		}
+		suffixes = append(suffixes, []rune(match[len(prefix):]))
+	}
+	return suffixes, len(prefix)
+}
@@ -0,0 +1,121 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lithammer/dedent"
+	"github.com/openllb/hlb/builtin"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	ctx := filebuffer.WithBuffers(context.Background(), builtin.Buffers())
+	ctx = ast.WithModules(ctx, builtin.Modules())
+
+	input := dedent.Dedent(`
+	string greeting() { "hello"; }
+	greeting
+	format "%s world" greeting
+	fs hello() {
+		mkfile "/greeting" 0o644 greeting
+	}
+	hello
+	int greeting() { 1; }
+	string greeting() { "hi"; }
+	greeting
+	hello
+	int answer() { 42; }
+	answer
+	true
+	nope
+	string bad( { "x" }
+	:solve
+	:quit
+	greeting
+	`)
+
+	var out bytes.Buffer
+	err := Run(ctx, nil, nil, WithStdio(strings.NewReader(input), &out, &out))
+	require.NoError(t, err)
+
+	// Replacing greeting with an int fails to check the function that
+	// depends on it, so the string is kept.
+	expected := dedent.Dedent(`
+	"hello"
+	"hello world"
+	fs
+	#0 mkfile /greeting 0644 (<input 4>:2:2)
+	error: cannot use int as type string
+	<input 4>:2:27:
+	  │ 
+	2 │ 	mkfile "/greeting" 0o644 greeting
+	  │ 	                         ^^^^^^^^
+	  │ 	                         cannot use int as type string
+	<input 6>:1:5:
+	  │ 
+	1 │ int greeting() { 1; }
+	  │     --------
+	  │     defined here
+	"hi"
+	fs
+	#0 mkfile /greeting 0644 (<input 4>:2:2)
+	42
+	true
+	error: ` + "`nope`" + ` is undefined or not in scope
+	<input 13>:1:1:
+	  │ 
+	1 │ nope
+	  │ ^^^^
+	  │ undefined or not in scope
+	error: unexpected token "{" (expected CloseParen)
+	<input 14>:1:13:
+	  │ 
+	1 │ string bad( { "x" }
+	  │             ^
+	  │             unexpected token "{" (expected CloseParen)
+	error: cannot solve without a buildkit client
+	`)
+	require.Equal(t, strings.TrimPrefix(expected, "\n"), out.String())
+}
+
+func TestReadInput(t *testing.T) {
+	t.Parallel()
+
+	input := dedent.Dedent(`
+	string brace() { "{"; }
+	fs multi() {
+		# a comment with {
+		mkfile "/a" 0o644 <<~EOF
+			{
+		EOF
+	}
+	image "alpine"
+	fs unterminated() {
+	`)
+
+	lr := &scanReader{bufio.NewScanner(strings.NewReader(strings.TrimPrefix(input, "\n")))}
+	var inputs []string
+	for {
+		input, err := readInput(lr)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		inputs = append(inputs, input)
+	}
+	require.Equal(t, []string{
+		"string brace() { \"{\"; }\n",
+		"fs multi() {\n\t# a comment with {\n\tmkfile \"/a\" 0o644 <<~EOF\n\t\t{\n\tEOF\n}\n",
+		"image \"alpine\"\n",
+		"fs unterminated() {\n",
+	}, inputs)
+}
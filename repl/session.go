@@ -0,0 +1,322 @@
+package repl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/moby/buildkit/client"
+	"github.com/openllb/hlb/checker"
+	"github.com/openllb/hlb/codegen"
+	"github.com/openllb/hlb/diagnostic"
+	"github.com/openllb/hlb/parser"
+	"github.com/openllb/hlb/parser/ast"
+	"github.com/openllb/hlb/pkg/filebuffer"
+	"github.com/openllb/hlb/pkg/redact"
+)
+
+// stmtParser parses the statements of an expression input, which are
+// evaluated as the body of a function.
+var stmtParser = participle.MustBuild(
+	&stmtInput{},
+	participle.Lexer(ast.Lexer),
+	participle.Elide("Whitespace"),
+	participle.Unquote("QuotedIdent"),
+)
+
+type stmtInput struct {
+	ast.Mixin
+	Stmts []*ast.Stmt `parser:"@@*"`
+}
+
+// session is a synthetic module that inputs are evaluated in. Declarations
+// are merged into the module, and expressions are evaluated as the body of a
+// function that is only declared while it is evaluated.
+type session struct {
+	cln      *client.Client
+	resolver codegen.Resolver
+	opts     []codegen.CodeGenOption
+	modules  *codegen.ModuleCache
+
+	// redactions are the sensitive values of every input, which are redacted
+	// from the solves of :solve and :download.
+	redactions *redact.Set
+
+	mod    *ast.Module
+	inputs int
+
+	// last is the last filesystem evaluated, which is built by :solve and
+	// :download.
+	last codegen.Value
+}
+
+func newSession(cln *client.Client, resolver codegen.Resolver, opts []codegen.CodeGenOption) (*session, error) {
+	mod := &ast.Module{Directory: parser.NewLocalDirectory(".", "")}
+	mod.Pos.Filename = "<repl>"
+	err := checker.SemanticPass(mod)
+	if err != nil {
+		return nil, err
+	}
+	redactions := redact.NewSet()
+	return &session{
+		cln:        cln,
+		resolver:   resolver,
+		opts:       append([]codegen.CodeGenOption{codegen.WithRedaction(redactions)}, opts...),
+		modules:    codegen.NewModuleCache(),
+		redactions: redactions,
+		mod:        mod,
+	}, nil
+}
+
+// eval evaluates an input, which is either declarations or the statements of
+// an expression. Declarations replace previous declarations of the same
+// name, and expressions write their value to w.
+func (s *session) eval(ctx context.Context, w io.Writer, input string) error {
+	s.inputs++
+	name := fmt.Sprintf("<input %d>", s.inputs)
+
+	// Every input has its own buffer for diagnostics, and nodes parsed from
+	// it belong to the session's module. Buffers index lines by their
+	// newlines, so the last line must end with one.
+	if !strings.HasSuffix(input, "\n") {
+		input += "\n"
+	}
+	fb := filebuffer.New(name)
+	_, err := fb.Write([]byte(input))
+	if err != nil {
+		return err
+	}
+	filebuffer.Buffers(ctx).Set(name, fb)
+
+	mod, derr := parser.Parse(ctx, &parser.NamedReader{Reader: strings.NewReader(input), Value: name})
+	ast.Modules(ctx).Set(name, s.mod)
+	if derr == nil {
+		return s.declare(mod.Decls)
+	}
+
+	stmts := &stmtInput{}
+	serr := stmtParser.Parse(name, &parser.NewlinedReader{Reader: strings.NewReader(input)}, stmts)
+	if serr != nil {
+		if isDecl(input) {
+			return parseError(derr)
+		}
+		return parseError(serr)
+	}
+	return s.evaluate(ctx, w, name, stmts.Stmts)
+}
+
+// declare merges declarations into the module, replacing the declarations of
+// the same name. The module is checked again so that the declarations that
+// depend on a replaced one are checked against it, and nothing is declared
+// if the module fails to check.
+func (s *session) declare(decls []*ast.Decl) error {
+	prev := s.mod.Decls
+	next := make([]*ast.Decl, len(prev))
+	copy(next, prev)
+
+	for _, decl := range decls {
+		name := declName(decl)
+		if name == "" {
+			continue
+		}
+
+		replaced := false
+		for i, d := range next {
+			if declName(d) == name {
+				next[i] = decl
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			next = append(next, decl)
+		}
+	}
+	return s.check(prev, next)
+}
+
+// evaluate evaluates statements as the body of a function with the kind of
+// the first statement, and writes the value to w.
+func (s *session) evaluate(ctx context.Context, w io.Writer, name string, stmts []*ast.Stmt) error {
+	var first *ast.Stmt
+	for _, stmt := range stmts {
+		if stmt.Newline == nil && stmt.Comments == nil {
+			first = stmt
+			break
+		}
+	}
+	if first == nil {
+		return nil
+	}
+
+	fd := &ast.FuncDecl{
+		Sig: &ast.FuncSignature{
+			Type:   ast.NewType(stmtKind(s.mod.Scope, first)),
+			Name:   ast.NewIdent(name),
+			Params: ast.NewFieldList(),
+		},
+		Body: ast.NewBlockStmt(stmts...),
+	}
+	fd.Pos = first.Pos
+	fd.Sig.Name.Pos = first.Pos
+
+	prev := s.mod.Decls
+	next := append(append([]*ast.Decl{}, prev...), &ast.Decl{Func: fd})
+	err := s.check(prev, next)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The function is only declared while it is evaluated.
+		_ = s.check(next, prev)
+	}()
+
+	opts := append([]codegen.CodeGenOption{codegen.WithModuleCache(s.modules)}, s.opts...)
+	cg := codegen.New(s.cln, s.resolver, opts...)
+	val, err := cg.EmitTarget(ctx, s.mod, codegen.Target{Name: name})
+	if err != nil {
+		return err
+	}
+
+	out, err := codegen.FormatValue(ctx, val, codegen.WithMaxLength(0))
+	if err != nil {
+		return err
+	}
+	if val.Kind() == ast.Filesystem {
+		s.last = val
+	}
+	_, err = fmt.Fprintln(w, out)
+	return err
+}
+
+// check checks the module with the next declarations, and restores the
+// previous declarations if it fails.
+func (s *session) check(prev, next []*ast.Decl) error {
+	s.mod.Decls = next
+	err := checker.SemanticPass(s.mod)
+	if err == nil {
+		err = checker.Check(s.mod)
+	}
+	if err == nil {
+		return nil
+	}
+
+	s.mod.Decls = prev
+	if rerr := checker.SemanticPass(s.mod); rerr == nil {
+		_ = checker.Check(s.mod)
+	}
+	return err
+}
+
+// declName returns the name a declaration is merged by, or an empty string if
+// it declares nothing.
+func declName(decl *ast.Decl) string {
+	switch {
+	case decl.Func != nil:
+		return decl.Func.Sig.Name.Text
+	case decl.Import != nil:
+		return decl.Import.Name.Text
+	case decl.Export != nil:
+		return "export " + decl.Export.Name.Text
+	}
+	return ""
+}
+
+// stmtKind returns the kind of the function that a statement is evaluated
+// in. Builtins of several kinds are evaluated as filesystems when they can be,
+// and so are references to imported modules, whose kinds are unknown until
+// they are resolved.
+func stmtKind(scope *ast.Scope, stmt *ast.Stmt) ast.Kind {
+	var name *ast.IdentExpr
+	switch {
+	case stmt.From != nil:
+		return ast.Filesystem
+	case stmt.Call != nil:
+		name = stmt.Call.Name
+	case stmt.Expr != nil:
+		expr := stmt.Expr.Expr
+		switch {
+		case expr.FuncLit != nil:
+			return expr.FuncLit.Type.Kind
+		case expr.BasicLit != nil:
+			return basicLitKind(expr.BasicLit)
+		case expr.CallExpr != nil:
+			name = expr.CallExpr.Name
+		}
+	}
+	if name == nil || name.Reference != nil {
+		return ast.Filesystem
+	}
+
+	obj := scope.Lookup(name.Ident.Text)
+	if obj == nil {
+		return ast.Filesystem
+	}
+	if bd, ok := obj.Node.(*ast.BuiltinDecl); ok {
+		for _, kind := range bd.Kinds {
+			if kind == ast.Filesystem {
+				return kind
+			}
+		}
+		if len(bd.Kinds) > 0 {
+			return bd.Kinds[0]
+		}
+	}
+	return obj.Kind
+}
+
+func basicLitKind(lit *ast.BasicLit) ast.Kind {
+	switch {
+	case lit.Decimal != nil, lit.Numeric != nil:
+		return ast.Int
+	case lit.Bool != nil:
+		return ast.Bool
+	}
+	return ast.String
+}
+
+// isDecl returns true if an input that fails to parse looks like a
+// declaration rather than an expression.
+func isDecl(input string) bool {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "import", "export":
+		return true
+	}
+	return len(fields) > 1 && isTypeName(fields[0])
+}
+
+func isTypeName(s string) bool {
+	switch ast.Kind(s).Primary() {
+	case ast.String, ast.Int, ast.Bool, ast.Filesystem, ast.Pipeline, ast.Option:
+		return true
+	}
+	return false
+}
+
+// parseError decorates a syntax error with a diagnostic at its position.
+func parseError(err error) error {
+	var perr participle.Error
+	if !errors.As(err, &perr) {
+		return err
+	}
+	pos := perr.Position()
+	end := lexer.Position{
+		Filename: pos.Filename,
+		Offset:   pos.Offset + 1,
+		Line:     pos.Line,
+		Column:   pos.Column + 1,
+	}
+	return diagnostic.WithError(
+		errors.New(perr.Message()),
+		pos, end,
+		diagnostic.Spanf(diagnostic.Primary, pos, end, "%s", perr.Message()),
+	)
+}
@@ -726,6 +726,13 @@ func (s *Session) onVariablesRequest(ctx context.Context, req *dap.VariablesRequ
 		return fmt.Errorf("unknown variables reference %d", req.Arguments.VariablesReference)
 	}
 
+	// Values of sensitive strings are redacted, like in the progress of the
+	// build.
+	state, err := s.dbgr.GetState()
+	if err != nil {
+		return err
+	}
+
 	objs := v.([]*ast.Object)
 	vars := make([]dap.Variable, len(objs))
 
@@ -736,6 +743,7 @@ func (s *Session) onVariablesRequest(ctx context.Context, req *dap.VariablesRequ
 			value = fmt.Sprintf("<%s>", obj.Kind)
 		} else {
 			value, _ = val.String()
+			value = codegen.RedactString(state.Ctx, value)
 		}
 		vars[i] = dap.Variable{
 			Name:  obj.Ident.String(),
@@ -29,6 +29,10 @@ type LangServer struct {
 	cln      *client.Client
 	resolver codegen.Resolver
 
+	// modules are shared by every request, so that an import is only parsed
+	// and checked once while it is unchanged.
+	modules *codegen.ModuleCache
+
 	server *jrpc2.Server
 	capset map[Capability]struct{}
 
@@ -55,6 +59,7 @@ func NewServer(ctx context.Context, cln *client.Client) (*LangServer, error) {
 	ls := &LangServer{
 		cln:      cln,
 		resolver: resolver,
+		modules:  codegen.NewModuleCache(),
 		capset:   make(map[Capability]struct{}),
 		tds:      make(map[lsp.DocumentURI]TextDocument),
 		dbs:      make(map[lsp.DocumentURI]*debouncer),
@@ -279,6 +284,10 @@ func highlightBlock(lines map[int]lsp.SemanticHighlightingTokens, block *ast.Blo
 				highlightIdentExpr(lines, call.Name)
 			}
 
+			if call.From != nil {
+				highlightNode(lines, call.From, Keyword)
+			}
+
 			for _, arg := range call.Args {
 				highlightExpr(lines, arg)
 			}
@@ -309,6 +318,12 @@ func highlightBlock(lines map[int]lsp.SemanticHighlightingTokens, block *ast.Blo
 			}
 
 		},
+		func(from *ast.FromStmt) {
+			highlightNode(lines, from.From, Keyword)
+			if from.Expr != nil {
+				highlightExpr(lines, from.Expr)
+			}
+		},
 		func(expr *ast.ExprStmt) {
 			if expr.Expr != nil {
 				highlightExpr(lines, expr.Expr)
@@ -318,6 +333,9 @@ func highlightBlock(lines map[int]lsp.SemanticHighlightingTokens, block *ast.Blo
 }
 
 func highlightExpr(lines map[int]lsp.SemanticHighlightingTokens, expr *ast.Expr) {
+	if expr == nil {
+		return
+	}
 	switch {
 	case expr.FuncLit != nil:
 		if expr.FuncLit.Type != nil {
@@ -553,7 +571,7 @@ func (ls *LangServer) textDocumentDefinitionHandler(ctx context.Context, params
 				return
 			}
 
-			cg := codegen.New(ls.cln, ls.resolver)
+			cg := codegen.New(ls.cln, ls.resolver, codegen.WithModuleCache(ls.modules))
 			ctx = codegen.WithProgramCounter(ctx, id.Expr)
 			imod, err := cg.EmitImport(ctx, td.Module, id)
 			if err != nil {
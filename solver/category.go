@@ -0,0 +1,100 @@
+package solver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	gatewaypb "github.com/moby/buildkit/frontend/gateway/pb"
+	solvererrdefs "github.com/moby/buildkit/solver/errdefs"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/grpcerrors"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/errdefs"
+	"google.golang.org/grpc/codes"
+)
+
+// withSolveCategory categorizes the failure of a solve of def by the op of the
+// vertex that failed. Without a definition, only commands that exited with an
+// error are categorized.
+func withSolveCategory(err error, def *pb.Definition) error {
+	var exitErr *gatewaypb.ExitError
+	if errors.As(err, &exitErr) {
+		return errdefs.WithExecError(err, int(exitErr.ExitCode), sourcePosition(err))
+	}
+
+	var ve *solvererrdefs.VertexError
+	if def == nil || !errors.As(err, &ve) {
+		return err
+	}
+	op := findOp(def, digest.Digest(ve.Digest))
+	if op == nil {
+		return err
+	}
+	switch op.Op.(type) {
+	case *pb.Op_Source:
+		return errdefs.WithSourceFetchError(err)
+	case *pb.Op_Exec:
+		// The command failed without an exit code, like when its
+		// executable does not exist.
+		return errdefs.WithExecError(err, -1, sourcePosition(err))
+	}
+	return err
+}
+
+// withBuildCategory categorizes the failure of a build, where buildErr is the
+// failure of its build function, if it failed. exported is true if the build
+// function succeeded and its result had to be exported.
+func withBuildCategory(err, buildErr error, exported bool) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled), grpcerrors.Code(err) == codes.Canceled:
+		return errdefs.WithCancelled(err)
+	case IsConnectionError(err):
+		return errdefs.WithDaemonUnavailable(err)
+	case buildErr != nil && errdefs.Classify(err) == errdefs.Uncategorized:
+		// BuildKit also returns the failure of the build function, but
+		// without the category it was given in the build function.
+		if errdefs.Classify(buildErr) != errdefs.Uncategorized {
+			return buildErr
+		}
+	case exported:
+		return errdefs.WithExportError(err)
+	}
+	return withSolveCategory(err, nil)
+}
+
+// findOp returns the op of a vertex in a definition, or nil if it is not
+// found.
+func findOp(def *pb.Definition, dgst digest.Digest) *pb.Op {
+	for _, dt := range def.Def {
+		if digest.FromBytes(dt) != dgst {
+			continue
+		}
+		var op pb.Op
+		if err := (&op).Unmarshal(dt); err != nil {
+			return nil
+		}
+		return &op
+	}
+	return nil
+}
+
+// sourcePosition returns the position of the statement an error of BuildKit
+// is reported at, which is the last of its sources.
+func sourcePosition(err error) lexer.Position {
+	srcs := solvererrdefs.Sources(err)
+	if len(srcs) == 0 {
+		return lexer.Position{}
+	}
+	src := srcs[len(srcs)-1]
+	if src.Info == nil || len(src.Ranges) == 0 {
+		return lexer.Position{}
+	}
+	return lexer.Position{
+		Filename: src.Info.Filename,
+		Line:     int(src.Ranges[0].Start.Line),
+		Column:   int(src.Ranges[0].Start.Character),
+	}
+}
@@ -0,0 +1,179 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alecthomas/participle/v2/lexer"
+	"github.com/moby/buildkit/client/llb"
+	gatewayapi "github.com/moby/buildkit/frontend/gateway/pb"
+	solvererrdefs "github.com/moby/buildkit/solver/errdefs"
+	opspb "github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/grpcerrors"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/errdefs"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// opDigests returns the digests of the source and exec ops of a definition.
+func opDigests(t *testing.T, def *llb.Definition) (source, exec digest.Digest) {
+	for _, dt := range def.Def {
+		var op opspb.Op
+		require.NoError(t, op.Unmarshal(dt))
+		switch op.Op.(type) {
+		case *opspb.Op_Source:
+			source = digest.FromBytes(dt)
+		case *opspb.Op_Exec:
+			exec = digest.FromBytes(dt)
+		}
+	}
+	require.NotEmpty(t, source)
+	require.NotEmpty(t, exec)
+	return
+}
+
+func TestErrorCategories(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	def, err := llb.Image("alpine").Run(llb.Shlex("false")).Root().Marshal(ctx)
+	require.NoError(t, err)
+	source, exec := opDigests(t, def)
+
+	src := solvererrdefs.Source{
+		Info: &opspb.SourceInfo{Filename: "build.hlb"},
+		Ranges: []*opspb.Range{{
+			Start: opspb.Position{Line: 3, Character: 2},
+			End:   opspb.Position{Line: 3, Character: 13},
+		}},
+	}
+
+	type testCase struct {
+		name      string
+		solve     func(fb *fakeBuildkitd, cancel func()) func(ctx context.Context) error
+		exportErr error
+		opts      []SolveOption
+		category  errdefs.Category
+		fn        func(t *testing.T, err error)
+	}
+
+	for _, tc := range []testCase{{
+		name: "failing run",
+		solve: func(*fakeBuildkitd, func()) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				err := &gatewayapi.ExitError{
+					ExitCode: 2,
+					Err:      errors.New(`process "false" did not complete successfully: exit code: 2`),
+				}
+				return grpcerrors.ToGRPC(solvererrdefs.WithSource(solvererrdefs.WrapVertex(err, exec), src))
+			}
+		},
+		category: errdefs.ExecError,
+		fn: func(t *testing.T, err error) {
+			var ee *errdefs.ErrExec
+			require.True(t, errors.As(err, &ee))
+			require.Equal(t, 2, ee.ExitCode)
+			require.Equal(t, "build.hlb", ee.Pos.Filename)
+			require.Equal(t, 3, ee.Pos.Line)
+			require.Equal(t, 2, ee.Pos.Column)
+			require.Contains(t, err.Error(), "exit code: 2")
+		},
+	}, {
+		name: "missing image",
+		solve: func(*fakeBuildkitd, func()) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				err := errors.New("docker.io/library/missing:latest: not found")
+				return grpcerrors.ToGRPC(solvererrdefs.WrapVertex(err, source))
+			}
+		},
+		category: errdefs.SourceFetchError,
+		fn: func(t *testing.T, err error) {
+			var sfe *errdefs.ErrSourceFetch
+			require.True(t, errors.As(err, &sfe))
+			require.False(t, sfe.Transient())
+		},
+	}, {
+		name: "flaky registry",
+		solve: func(*fakeBuildkitd, func()) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				err := errors.New("failed to do request: Head https://registry-1.docker.io/v2/library/alpine/manifests/latest: dial tcp: i/o timeout")
+				return grpcerrors.ToGRPC(solvererrdefs.WrapVertex(err, source))
+			}
+		},
+		category: errdefs.SourceFetchError,
+		fn: func(t *testing.T, err error) {
+			var sfe *errdefs.ErrSourceFetch
+			require.True(t, errors.As(err, &sfe))
+			require.True(t, sfe.Transient())
+		},
+	}, {
+		name: "failing export",
+		solve: func(*fakeBuildkitd, func()) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				return nil
+			}
+		},
+		exportErr: status.Error(codes.Unknown, "failed to push docker.io/library/app: 401 Unauthorized"),
+		opts:      []SolveOption{WithPushImage("docker.io/library/app")},
+		category:  errdefs.ExportError,
+	}, {
+		name: "killed daemon",
+		solve: func(fb *fakeBuildkitd, _ func()) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				go fb.srv.Stop()
+				<-ctx.Done()
+				return ctx.Err()
+			}
+		},
+		category: errdefs.DaemonUnavailable,
+	}, {
+		name: "ctrl-c",
+		solve: func(_ *fakeBuildkitd, cancel func()) func(ctx context.Context) error {
+			return func(ctx context.Context) error {
+				cancel()
+				<-ctx.Done()
+				return ctx.Err()
+			}
+		},
+		category: errdefs.Cancelled,
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			var fb *fakeBuildkitd
+			fb = newFakeBuildkitd(t, func(ctx context.Context) error {
+				return tc.solve(fb, cancel)(ctx)
+			})
+			fb.exportErr = tc.exportErr
+
+			err := Single(&Params{Def: def}).Solve(ctx, fb.client(context.Background(), t), nil, tc.opts...)
+			require.Error(t, err)
+			require.Equal(t, tc.category, errdefs.Classify(err), "%s", err)
+			if tc.fn != nil {
+				tc.fn(t, err)
+			}
+		})
+	}
+}
+
+func TestErrorCategoriesWrapped(t *testing.T) {
+	t.Parallel()
+
+	err := errdefs.WithExecError(errors.New("exit code: 1"), 1, lexer.Position{Filename: "build.hlb", Line: 1})
+	// Categories are kept through wrapping, and the first category is kept
+	// when an error is categorized again.
+	wrapped := errdefs.WithExportError(solvererrdefs.WithSource(err, solvererrdefs.Source{}))
+	require.Equal(t, errdefs.ExecError, errdefs.Classify(wrapped))
+
+	require.Equal(t, errdefs.Uncategorized, errdefs.Classify(errors.New("unknown")))
+	require.Equal(t, errdefs.Cancelled, errdefs.Classify(context.Canceled))
+	require.Equal(t, errdefs.DaemonUnavailable, errdefs.Classify(status.Error(codes.Unavailable, "connection refused")))
+	require.Equal(t, errdefs.Uncategorized, errdefs.Classify(nil))
+}
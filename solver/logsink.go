@@ -0,0 +1,419 @@
+package solver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// LogSinkOption configures the build logs written by WithLogSink.
+type LogSinkOption func(*logSink)
+
+// WithLogMaxSize rotates the log of a target when writing a line would grow
+// it past size bytes. The rotated logs are kept as <target>.log.1 through
+// <target>.log.<backups>, newest first, and older logs are removed. Lines are
+// never split, so a single line longer than size is written to a log of its
+// own.
+func WithLogMaxSize(size int64, backups int) LogSinkOption {
+	return func(s *logSink) {
+		s.maxSize = size
+		s.maxBackups = backups
+	}
+}
+
+// WithLogTimestamps prefixes every line with the time BuildKit reported it.
+func WithLogTimestamps() LogSinkOption {
+	return func(s *logSink) {
+		s.timestamps = true
+	}
+}
+
+// WithLogOutputOnly only writes the output of processes, without the lines
+// for vertices starting and completing.
+func WithLogOutputOnly() LogSinkOption {
+	return func(s *logSink) {
+		s.outputOnly = true
+	}
+}
+
+// WithLogWarnings writes the warning for a sink that failed to write to w
+// instead of stderr.
+func WithLogWarnings(w io.Writer) LogSinkOption {
+	return func(s *logSink) {
+		s.warnings = w
+	}
+}
+
+// WithLogSink writes the progress of every named request to <dir>/<name>.log
+// as BuildKit reports it, in addition to the progress shown on the console.
+// Requests are named with Named, and the innermost name is used. If a log
+// fails to be written, a warning is printed once and no more logs are
+// written, but the build carries on.
+func WithLogSink(dir string, opts ...LogSinkOption) SolveOption {
+	s := &logSink{
+		dir:      dir,
+		warnings: os.Stderr,
+		files:    make(map[string]*logFile),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return func(info *SolveInfo) error {
+		info.LogSink = s
+		return nil
+	}
+}
+
+// withLogName names the logs of the requests solved with the option.
+func withLogName(name string) SolveOption {
+	return func(info *SolveInfo) error {
+		info.LogName = name
+		return nil
+	}
+}
+
+// logSink writes one log per name. Writes are serialized so that the lines of
+// a log are in the order BuildKit reported them, even when the same name is
+// solved by many requests in parallel.
+type logSink struct {
+	dir        string
+	maxSize    int64
+	maxBackups int
+	timestamps bool
+	outputOnly bool
+	warnings   io.Writer
+
+	mu       sync.Mutex
+	files    map[string]*logFile
+	disabled bool
+}
+
+// logFile is the log of a name, which is open while any request with the name
+// is being solved.
+type logFile struct {
+	path string
+	f    *os.File
+	size int64
+	refs int
+
+	// vertices are numbered in the order they are first reported, to
+	// attribute lines to vertices like BuildKit's plain progress.
+	vertices map[digest.Digest]*logVertex
+
+	// partial holds the output of a vertex's stream that is not yet
+	// terminated by a newline.
+	partial map[logStream][]byte
+}
+
+type logVertex struct {
+	index     int
+	started   bool
+	completed bool
+}
+
+type logStream struct {
+	vertex digest.Digest
+	stream int
+}
+
+var unsafeLogName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// logFilename returns the filename of the log of name. Names with characters
+// that are unsafe in filenames have them replaced, with a short hash of the
+// name appended so that names like "a/b" and "a_b" don't share a log.
+func logFilename(name string) string {
+	if !unsafeLogName.MatchString(name) {
+		return name + ".log"
+	}
+	return fmt.Sprintf("%s-%s.log", unsafeLogName.ReplaceAllString(name, "_"), digest.FromString(name).Encoded()[:8])
+}
+
+// writer returns a progress writer that writes to the log of name and to pw,
+// which may be nil. The writer must be closed after the solve.
+func (s *logSink) writer(name string, pw progress.Writer) *logWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lf, ok := s.files[name]
+	if !ok {
+		lf = &logFile{
+			path:     filepath.Join(s.dir, logFilename(name)),
+			vertices: make(map[digest.Digest]*logVertex),
+			partial:  make(map[logStream][]byte),
+		}
+		s.files[name] = lf
+	}
+	lf.refs++
+	return &logWriter{sink: s, file: lf, pw: pw}
+}
+
+// write writes the lines of a status, with the vertices that started before
+// their output and the vertices that completed after it.
+func (s *logSink) write(lf *logFile, status *client.SolveStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled {
+		return
+	}
+
+	var err error
+	if !s.outputOnly {
+		for _, v := range status.Vertexes {
+			lv := lf.vertex(v.Digest)
+			if v.Started == nil || lv.started {
+				continue
+			}
+			lv.started = true
+			err = s.writeLine(lf, *v.Started, fmt.Sprintf("#%d %s", lv.index, v.Name))
+			if err != nil {
+				s.fail(err)
+				return
+			}
+		}
+	}
+
+	for _, l := range status.Logs {
+		key := logStream{l.Vertex, l.Stream}
+		dt := append(lf.partial[key], l.Data...)
+		for {
+			i := bytes.IndexByte(dt, '\n')
+			if i < 0 {
+				break
+			}
+			err = s.writeOutput(lf, l.Timestamp, l.Vertex, string(dt[:i]))
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			dt = dt[i+1:]
+		}
+		if len(dt) == 0 {
+			delete(lf.partial, key)
+		} else {
+			lf.partial[key] = dt
+		}
+	}
+
+	for _, v := range status.Vertexes {
+		lv := lf.vertex(v.Digest)
+		if v.Completed == nil || lv.completed {
+			continue
+		}
+		lv.completed = true
+		err = s.flushVertex(lf, *v.Completed, v.Digest)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if s.outputOnly {
+			continue
+		}
+
+		line := fmt.Sprintf("#%d DONE", lv.index)
+		switch {
+		case v.Error != "":
+			line = fmt.Sprintf("#%d ERROR: %s", lv.index, v.Error)
+		case v.Cached:
+			line = fmt.Sprintf("#%d CACHED", lv.index)
+		}
+		err = s.writeLine(lf, *v.Completed, line)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (lf *logFile) vertex(dgst digest.Digest) *logVertex {
+	lv, ok := lf.vertices[dgst]
+	if !ok {
+		lv = &logVertex{index: len(lf.vertices) + 1}
+		lf.vertices[dgst] = lv
+	}
+	return lv
+}
+
+// flushVertex writes the unterminated output of a vertex, which has no more
+// output once it has completed.
+func (s *logSink) flushVertex(lf *logFile, t time.Time, dgst digest.Digest) error {
+	var streams []int
+	for key := range lf.partial {
+		if key.vertex == dgst {
+			streams = append(streams, key.stream)
+		}
+	}
+	sort.Ints(streams)
+	for _, stream := range streams {
+		key := logStream{dgst, stream}
+		dt := lf.partial[key]
+		delete(lf.partial, key)
+		err := s.writeOutput(lf, t, dgst, string(dt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *logSink) writeOutput(lf *logFile, t time.Time, dgst digest.Digest, line string) error {
+	if !s.outputOnly {
+		line = fmt.Sprintf("#%d %s", lf.vertex(dgst).index, line)
+	}
+	return s.writeLine(lf, t, line)
+}
+
+func (s *logSink) writeLine(lf *logFile, t time.Time, line string) error {
+	if s.timestamps {
+		line = t.UTC().Format(time.RFC3339Nano) + " " + line
+	}
+	line += "\n"
+
+	if lf.f == nil {
+		err := s.open(lf)
+		if err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && lf.size > 0 && lf.size+int64(len(line)) > s.maxSize {
+		err := s.rotate(lf)
+		if err != nil {
+			return err
+		}
+		err = s.open(lf)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := io.WriteString(lf.f, line)
+	lf.size += int64(n)
+	return err
+}
+
+func (s *logSink) open(lf *logFile) error {
+	err := os.MkdirAll(s.dir, 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = fi.Size()
+	return nil
+}
+
+// rotate moves the log to its first backup, shifting the older backups and
+// removing the oldest.
+func (s *logSink) rotate(lf *logFile) error {
+	err := lf.f.Close()
+	lf.f = nil
+	if err != nil {
+		return err
+	}
+
+	if s.maxBackups <= 0 {
+		return os.Remove(lf.path)
+	}
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", lf.path, i), fmt.Sprintf("%s.%d", lf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(lf.path, lf.path+".1")
+}
+
+// fail disables the sink and warns about the error that disabled it, which is
+// only done once.
+func (s *logSink) fail(err error) {
+	s.disabled = true
+	for _, lf := range s.files {
+		if lf.f != nil {
+			lf.f.Close()
+			lf.f = nil
+		}
+	}
+	fmt.Fprintf(s.warnings, "warning: no longer writing build logs to %s: %s\n", s.dir, err)
+}
+
+// release flushes the unterminated output of the log and closes it once no
+// request with its name is being solved.
+func (s *logSink) release(lf *logFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lf.refs--
+	if lf.refs > 0 || s.disabled {
+		return
+	}
+	for len(lf.partial) > 0 {
+		var dgst digest.Digest
+		for key := range lf.partial {
+			dgst = key.vertex
+			break
+		}
+		err := s.flushVertex(lf, time.Now(), dgst)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	if lf.f != nil {
+		err := lf.f.Close()
+		lf.f = nil
+		if err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+// logWriter writes the progress of a solve to a log, and passes it on to the
+// progress writer of the console.
+type logWriter struct {
+	sink *logSink
+	file *logFile
+	pw   progress.Writer
+}
+
+var _ progress.Writer = (*logWriter)(nil)
+
+func (w *logWriter) Write(s *client.SolveStatus) {
+	w.sink.write(w.file, s)
+	if w.pw != nil {
+		w.pw.Write(s)
+	}
+}
+
+func (w *logWriter) ValidateLogSource(dgst digest.Digest, v interface{}) bool {
+	if w.pw == nil {
+		return true
+	}
+	return w.pw.ValidateLogSource(dgst, v)
+}
+
+func (w *logWriter) ClearLogSource(v interface{}) {
+	if w.pw != nil {
+		w.pw.ClearLogSource(v)
+	}
+}
+
+func (w *logWriter) Close() {
+	w.sink.release(w.file)
+}
@@ -0,0 +1,226 @@
+package solver
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+// fakeStream builds the statuses BuildKit reports for vertices starting,
+// writing output and completing.
+type fakeStream struct {
+	now time.Time
+}
+
+func (fs *fakeStream) tick() *time.Time {
+	fs.now = fs.now.Add(time.Second)
+	t := fs.now
+	return &t
+}
+
+func (fs *fakeStream) started(name string) *client.SolveStatus {
+	return &client.SolveStatus{Vertexes: []*client.Vertex{{
+		Digest:  digest.FromString(name),
+		Name:    name,
+		Started: fs.tick(),
+	}}}
+}
+
+func (fs *fakeStream) output(name, data string) *client.SolveStatus {
+	return &client.SolveStatus{Logs: []*client.VertexLog{{
+		Vertex:    digest.FromString(name),
+		Stream:    1,
+		Data:      []byte(data),
+		Timestamp: *fs.tick(),
+	}}}
+}
+
+func (fs *fakeStream) completed(name string, cached bool, errMsg string) *client.SolveStatus {
+	now := fs.tick()
+	return &client.SolveStatus{Vertexes: []*client.Vertex{{
+		Digest:    digest.FromString(name),
+		Name:      name,
+		Started:   now,
+		Completed: now,
+		Cached:    cached,
+		Error:     errMsg,
+	}}}
+}
+
+func newTestLogSink(t *testing.T, dir string, opts ...LogSinkOption) *logSink {
+	info := &SolveInfo{}
+	err := WithLogSink(dir, opts...)(info)
+	require.NoError(t, err)
+	return info.LogSink
+}
+
+func readLog(t *testing.T, path string) string {
+	dt, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(dt)
+}
+
+func TestLogSink(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := newTestLogSink(t, dir)
+	fs := &fakeStream{}
+
+	var pw recordingWriter
+	build := s.writer("build.hlb:build", &pw)
+	test := s.writer("build.hlb:test", nil)
+
+	build.Write(fs.started("RUN make"))
+	test.Write(fs.started("RUN go test"))
+	build.Write(fs.output("RUN make", "compiling\nlink"))
+	test.Write(fs.output("RUN go test", "ok\n"))
+	build.Write(fs.output("RUN make", "ing\n"))
+	test.Write(fs.completed("RUN go test", false, "exit code: 1"))
+	build.Write(fs.completed("RUN make", false, ""))
+	build.Write(fs.started("COPY /out"))
+	build.Write(fs.completed("COPY /out", true, ""))
+	build.Write(fs.output("RUN tail", "no newline"))
+	build.Close()
+	test.Close()
+
+	require.Equal(t, strings.Join([]string{
+		"#1 RUN make",
+		"#1 compiling",
+		"#1 linking",
+		"#1 DONE",
+		"#2 COPY /out",
+		"#2 CACHED",
+		// Unterminated output is written when the solve is done.
+		"#3 no newline",
+		"",
+	}, "\n"), readLog(t, filepath.Join(dir, logFilename("build.hlb:build"))))
+
+	require.Equal(t, strings.Join([]string{
+		"#1 RUN go test",
+		"#1 ok",
+		"#1 ERROR: exit code: 1",
+		"",
+	}, "\n"), readLog(t, filepath.Join(dir, logFilename("build.hlb:test"))))
+
+	// The console still receives the progress of the build.
+	require.Len(t, pw.vertexes, 4)
+}
+
+func TestLogFilename(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "default.log", logFilename("default"))
+	require.Regexp(t, `^build\.hlb_build-[0-9a-f]{8}\.log$`, logFilename("build.hlb:build"))
+
+	// Names that are only the same once their unsafe characters are replaced
+	// have logs of their own.
+	require.Equal(t, "a_b.log", logFilename("a_b"))
+	require.NotEqual(t, logFilename("a/b"), logFilename("a_b"))
+	require.NotEqual(t, logFilename("a/b"), logFilename("a:b"))
+}
+
+func TestLogSinkOutputOnly(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := newTestLogSink(t, dir, WithLogOutputOnly(), WithLogTimestamps())
+	fs := &fakeStream{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	w := s.writer("default", nil)
+	w.Write(fs.started("RUN echo"))
+	w.Write(fs.output("RUN echo", "hello\nwor"))
+	w.Write(fs.output("RUN echo", "ld"))
+	w.Write(fs.completed("RUN echo", false, ""))
+	w.Close()
+
+	require.Equal(t, strings.Join([]string{
+		"2020-01-01T00:00:02Z hello",
+		// Unterminated output is written when its vertex completes.
+		"2020-01-01T00:00:04Z world",
+		"",
+	}, "\n"), readLog(t, filepath.Join(dir, "default.log")))
+}
+
+func TestLogSinkRotation(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := newTestLogSink(t, dir, WithLogOutputOnly(), WithLogMaxSize(8, 2))
+	fs := &fakeStream{}
+
+	w := s.writer("default", nil)
+	for _, line := range []string{"aaa", "bbb", "ccc", "dddddddddd", "eee", "fff"} {
+		w.Write(fs.output("RUN echo", line+"\n"))
+	}
+	w.Close()
+
+	path := filepath.Join(dir, "default.log")
+	require.Equal(t, "eee\nfff\n", readLog(t, path))
+	require.Equal(t, "dddddddddd\n", readLog(t, path+".1"))
+	require.Equal(t, "ccc\n", readLog(t, path+".2"))
+	_, err := os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLogSinkDisablesOnFailure(t *testing.T) {
+	t.Parallel()
+
+	// The sink can't create its directory under a regular file.
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+
+	var warnings bytes.Buffer
+	s := newTestLogSink(t, filepath.Join(file, "logs"), WithLogWarnings(&warnings))
+	fs := &fakeStream{}
+
+	var pw recordingWriter
+	w := s.writer("default", &pw)
+	w.Write(fs.started("RUN echo"))
+	w.Write(fs.output("RUN echo", "hello\n"))
+	w.Close()
+
+	require.Equal(t, 1, strings.Count(warnings.String(), "warning: no longer writing build logs"))
+	require.Len(t, pw.vertexes, 1)
+}
+
+type optionsRequest struct {
+	info *SolveInfo
+}
+
+func (r *optionsRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	for _, opt := range opts {
+		err := opt(r.info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *optionsRequest) Tree(tree treeprint.Tree) error {
+	return nil
+}
+
+func TestNamedLogName(t *testing.T) {
+	t.Parallel()
+
+	inner := &optionsRequest{info: &SolveInfo{}}
+	other := &optionsRequest{info: &SolveInfo{}}
+	req := Named("outer", Parallel(Named("inner", inner), other))
+
+	err := req.Solve(context.Background(), nil, nil, WithLogSink(t.TempDir()))
+	require.NoError(t, err)
+	require.Equal(t, "inner", inner.info.LogName)
+	require.Equal(t, "outer", other.info.LogName)
+	require.NotNil(t, inner.info.LogSink)
+}
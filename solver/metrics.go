@@ -0,0 +1,388 @@
+package solver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/xlab/treeprint"
+)
+
+// MetricsRegistry registers the collectors that solves observe, so that they
+// can be published to a metrics system like Prometheus without depending on
+// it. Registering a collector with the same name again must return the
+// collector registered first.
+type MetricsRegistry interface {
+	Counter(name, help string, labels ...string) Counter
+	Gauge(name, help string, labels ...string) Gauge
+	Histogram(name, help string, buckets []float64, labels ...string) Histogram
+}
+
+// Counter is a value that only goes up, with a value for each of the label
+// values it was registered with.
+type Counter interface {
+	Add(value float64, labelValues ...string)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge interface {
+	Add(value float64, labelValues ...string)
+}
+
+// Histogram counts observations in buckets.
+type Histogram interface {
+	Observe(value float64, labelValues ...string)
+}
+
+// The names of the collectors registered by WithMetrics.
+const (
+	MetricTargetDuration = "hlb_target_duration_seconds"
+	MetricSolves         = "hlb_solves_in_flight"
+	MetricVertices       = "hlb_vertices_total"
+	MetricSourceBytes    = "hlb_source_bytes_total"
+	MetricExportBytes    = "hlb_export_bytes_total"
+	MetricExportDuration = "hlb_export_duration_seconds"
+	MetricResolves       = "hlb_resolves_total"
+	MetricErrors         = "hlb_errors_total"
+)
+
+// DurationBuckets are the buckets of the duration histograms, in seconds,
+// from a cached target to a long build.
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// ErrorClass is the phase of a build that failed.
+type ErrorClass string
+
+const (
+	ErrorParse     ErrorClass = "parse"
+	ErrorCheck     ErrorClass = "check"
+	ErrorSolve     ErrorClass = "solve"
+	ErrorExport    ErrorClass = "export"
+	ErrorCancelled ErrorClass = "cancelled"
+)
+
+// Metrics are the collectors of a registry that builds are observed with.
+type Metrics struct {
+	// targetBuckets is the number of buckets target names are hashed into,
+	// or zero if they are not hashed.
+	targetBuckets uint64
+
+	targetDuration Histogram
+	solves         Gauge
+	vertices       Counter
+	sourceBytes    Counter
+	exportBytes    Counter
+	exportDuration Histogram
+	resolves       Counter
+	errors         Counter
+}
+
+// MetricsOption configures the metrics of WithMetrics.
+type MetricsOption func(*Metrics)
+
+// WithHashedTargetNames labels the durations of targets with one of a fixed
+// number of buckets their names hash into, instead of the names. Target names
+// come from modules and their imports, so a build of many generated targets or
+// modules can create a series for each of them. Hashing bounds the number of
+// series to the number of buckets, which is at least one, and keeps names
+// that may be sensitive out of the metrics.
+func WithHashedTargetNames(buckets int) MetricsOption {
+	if buckets < 1 {
+		buckets = 1
+	}
+	return func(m *Metrics) {
+		m.targetBuckets = uint64(buckets)
+	}
+}
+
+// WithMetrics observes the solves of a request with collectors registered in
+// reg, which are registered once when the option is created:
+//
+//	hlb_target_duration_seconds{target, status}  histogram of target durations
+//	hlb_solves_in_flight                         gauge of running solves
+//	hlb_vertices_total{cache}                    counter of vertices that hit or missed the cache
+//	hlb_source_bytes_total{source}               counter of bytes pulled for sources
+//	hlb_export_bytes_total{kind}                 counter of bytes pushed by exports
+//	hlb_export_duration_seconds{kind}            histogram of export durations
+//	hlb_resolves_total{kind}                     counter of image and module resolutions
+//	hlb_errors_total{class}                      counter of failures by ErrorClass
+//
+// Every label value is from a fixed set except target, which is the name of a
+// target unless names are hashed with WithHashedTargetNames. Targets are only
+// observed when generated with the option in the global solve options of
+// codegen.
+func WithMetrics(reg MetricsRegistry, opts ...MetricsOption) SolveOption {
+	m := &Metrics{
+		targetDuration: reg.Histogram(MetricTargetDuration, "Duration of targets by how they finished.", DurationBuckets, "target", "status"),
+		solves:         reg.Gauge(MetricSolves, "Number of solves sent to BuildKit that have not finished."),
+		vertices:       reg.Counter(MetricVertices, "Number of vertices solved, by whether they were cached.", "cache"),
+		sourceBytes:    reg.Counter(MetricSourceBytes, "Bytes pulled for sources, by the scheme of the source.", "source"),
+		exportBytes:    reg.Counter(MetricExportBytes, "Bytes pushed by exports, by the kind of export.", "kind"),
+		exportDuration: reg.Histogram(MetricExportDuration, "Duration of exports, by the kind of export.", DurationBuckets, "kind"),
+		resolves:       reg.Counter(MetricResolves, "Number of image config and module resolutions.", "kind"),
+		errors:         reg.Counter(MetricErrors, "Number of failures, by the phase that failed.", "class"),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return func(info *SolveInfo) error {
+		info.Metrics = m
+		return nil
+	}
+}
+
+// MetricsFromOptions returns the metrics of solve options, or nil if they have
+// none.
+func MetricsFromOptions(opts ...SolveOption) *Metrics {
+	info := &SolveInfo{}
+	for _, opt := range opts {
+		err := opt(info)
+		if err != nil {
+			return nil
+		}
+	}
+	return info.Metrics
+}
+
+// ObserveResolve counts a resolution of kind, like "image" or "module".
+func (m *Metrics) ObserveResolve(kind string) {
+	if m == nil {
+		return
+	}
+	m.resolves.Add(1, kind)
+}
+
+// ObserveError counts a failure. Parse and check errors happen before a build
+// is generated, so they are observed by whoever parses and checks the module,
+// like codegen.ParseModule and hlb.Compile.
+func (m *Metrics) ObserveError(class ErrorClass) {
+	if m == nil {
+		return
+	}
+	m.errors.Add(1, string(class))
+}
+
+// Target returns a request that observes the duration of req as the target
+// name, labeled by whether it succeeded, failed or was canceled.
+func (m *Metrics) Target(name string, req Request) Request {
+	if m == nil {
+		return req
+	}
+	if _, ok := req.(*nilRequest); ok {
+		return req
+	}
+	if m.targetBuckets > 0 {
+		sum := sha256.Sum256([]byte(name))
+		name = strconv.FormatUint(binary.BigEndian.Uint64(sum[:8])%m.targetBuckets, 10)
+	}
+	return &targetRequest{m: m, name: name, req: req}
+}
+
+type targetRequest struct {
+	m    *Metrics
+	name string
+	req  Request
+}
+
+func (r *targetRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	start := time.Now()
+	err := r.req.Solve(ctx, cln, mw, opts...)
+
+	status := "succeeded"
+	switch {
+	case err == nil:
+	case ctx.Err() != nil, errors.Is(err, context.Canceled):
+		status = "canceled"
+	default:
+		status = "failed"
+	}
+	r.m.targetDuration.Observe(time.Since(start).Seconds(), r.name, status)
+	return err
+}
+
+func (r *targetRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
+
+// exportKind returns the kind of the exports of a solve, or an empty string if
+// it has none.
+func exportKind(info *SolveInfo) string {
+	var kinds []string
+	if info.OutputDockerRef != "" {
+		if info.OutputMoby {
+			kinds = append(kinds, "moby")
+		} else {
+			kinds = append(kinds, "docker")
+		}
+	}
+	if info.OutputPushImage != "" {
+		kinds = append(kinds, "push")
+	}
+	if info.OutputLocal != "" {
+		kinds = append(kinds, "local")
+	}
+	if info.OutputLocalTarball {
+		kinds = append(kinds, "tarball")
+	}
+	if info.OutputLocalOCITarball {
+		kinds = append(kinds, "oci-tarball")
+	}
+	switch len(kinds) {
+	case 0:
+		return ""
+	case 1:
+		return kinds[0]
+	}
+	return "multiple"
+}
+
+// solve observes a solve sent to BuildKit by fn, which writes its progress to
+// the writer it is called with.
+func (m *Metrics) solve(ctx context.Context, info *SolveInfo, pw progress.Writer, fn func(pw progress.Writer) error) error {
+	if m == nil {
+		return fn(pw)
+	}
+
+	m.solves.Add(1)
+	defer m.solves.Add(-1)
+
+	so := &solveObserver{
+		m:        m,
+		kind:     exportKind(info),
+		vertices: make(map[digest.Digest]*observedVertex),
+		bytes:    make(map[string]int64),
+	}
+	err := fn(&observerWriter{fns: []StatusObserver{so.observe}, pw: pw})
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case ctx.Err() != nil, errors.Is(err, context.Canceled):
+		m.ObserveError(ErrorCancelled)
+	case so.exportFailed():
+		m.ObserveError(ErrorExport)
+	default:
+		m.ObserveError(ErrorSolve)
+	}
+	return err
+}
+
+// exportVertexPrefix is the prefix of the names BuildKit gives the vertices of
+// exporters.
+const exportVertexPrefix = "exporting to "
+
+// sourceMetricSchemes are the schemes of source vertices, which are the label
+// values of the bytes pulled for sources.
+var sourceMetricSchemes = []string{
+	"docker-image",
+	"oci-layout",
+	"git",
+	"https",
+	"http",
+	"local",
+}
+
+func sourceScheme(name string) string {
+	for _, scheme := range sourceMetricSchemes {
+		if strings.HasPrefix(name, scheme+"://") {
+			return scheme
+		}
+	}
+	return ""
+}
+
+type observedVertex struct {
+	source    string
+	export    bool
+	completed bool
+	failed    bool
+}
+
+// solveObserver observes the statuses of a single solve. BuildKit reports a
+// vertex again whenever it changes, and the bytes of a status as they grow, so
+// only what changed since the last status is counted.
+type solveObserver struct {
+	m    *Metrics
+	kind string
+
+	mu       sync.Mutex
+	vertices map[digest.Digest]*observedVertex
+	bytes    map[string]int64
+}
+
+func (so *solveObserver) observe(status *client.SolveStatus) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	for _, v := range status.Vertexes {
+		ov, ok := so.vertices[v.Digest]
+		if !ok {
+			ov = &observedVertex{
+				source: sourceScheme(v.Name),
+				export: strings.HasPrefix(v.Name, exportVertexPrefix),
+			}
+			so.vertices[v.Digest] = ov
+		}
+		if v.Error != "" {
+			ov.failed = true
+		}
+		if ov.completed || v.Completed == nil {
+			continue
+		}
+		ov.completed = true
+
+		switch {
+		case ov.export:
+			if v.Started != nil && so.kind != "" {
+				so.m.exportDuration.Observe(v.Completed.Sub(*v.Started).Seconds(), so.kind)
+			}
+		case v.Cached:
+			so.m.vertices.Add(1, "hit")
+		default:
+			so.m.vertices.Add(1, "miss")
+		}
+	}
+
+	for _, vs := range status.Statuses {
+		ov, ok := so.vertices[vs.Vertex]
+		if !ok || (ov.source == "" && !(ov.export && so.kind != "")) {
+			continue
+		}
+		n := vs.Current
+		if vs.Completed != nil && vs.Total > n {
+			n = vs.Total
+		}
+		id := vs.Vertex.String() + " " + vs.ID
+		delta := n - so.bytes[id]
+		if delta <= 0 {
+			continue
+		}
+		so.bytes[id] = n
+
+		if ov.export {
+			so.m.exportBytes.Add(float64(delta), so.kind)
+		} else {
+			so.m.sourceBytes.Add(float64(delta), ov.source)
+		}
+	}
+}
+
+func (so *solveObserver) exportFailed() bool {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+	for _, ov := range so.vertices {
+		if ov.export && ov.failed {
+			return true
+		}
+	}
+	return false
+}
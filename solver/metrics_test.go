@@ -0,0 +1,251 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+// fakeRegistry records the values of its collectors by their name and label
+// values joined with commas.
+type fakeRegistry struct {
+	mu           sync.Mutex
+	values       map[string]float64
+	observations map[string][]float64
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		values:       make(map[string]float64),
+		observations: make(map[string][]float64),
+	}
+}
+
+func (r *fakeRegistry) Counter(name, help string, labels ...string) Counter {
+	return &fakeCollector{r: r, name: name, labels: labels}
+}
+
+func (r *fakeRegistry) Gauge(name, help string, labels ...string) Gauge {
+	return &fakeCollector{r: r, name: name, labels: labels}
+}
+
+func (r *fakeRegistry) Histogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return &fakeCollector{r: r, name: name, labels: labels}
+}
+
+func (r *fakeRegistry) value(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.values[key]
+}
+
+func (r *fakeRegistry) count(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.observations[key])
+}
+
+type fakeCollector struct {
+	r      *fakeRegistry
+	name   string
+	labels []string
+}
+
+func (c *fakeCollector) key(labelValues []string) string {
+	if len(labelValues) != len(c.labels) {
+		panic("unexpected label values for " + c.name)
+	}
+	return strings.Join(append([]string{c.name}, labelValues...), ",")
+}
+
+func (c *fakeCollector) Add(value float64, labelValues ...string) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.r.values[c.key(labelValues)] += value
+}
+
+func (c *fakeCollector) Observe(value float64, labelValues ...string) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	key := c.key(labelValues)
+	c.r.observations[key] = append(c.r.observations[key], value)
+}
+
+// scriptedRequest writes statuses to the progress of a solve as if BuildKit
+// reported them, and fails with err.
+type scriptedRequest struct {
+	opts     []SolveOption
+	statuses []*client.SolveStatus
+	err      error
+}
+
+func (r *scriptedRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	info := &SolveInfo{}
+	for _, opt := range append(r.opts, opts...) {
+		err := opt(info)
+		if err != nil {
+			return err
+		}
+	}
+	return info.Metrics.solve(ctx, info, nil, func(pw progress.Writer) error {
+		for _, s := range r.statuses {
+			pw.Write(s)
+		}
+		return r.err
+	})
+}
+
+func (r *scriptedRequest) Tree(tree treeprint.Tree) error {
+	return nil
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	var (
+		start    = time.Unix(1700000000, 0)
+		done     = start.Add(2 * time.Second)
+		image    = digest.FromString("image")
+		exec     = digest.FromString("exec")
+		export   = digest.FromString("export")
+		failing  = digest.FromString("failing")
+		errBuild = errors.New("process did not complete successfully")
+	)
+
+	reg := newFakeRegistry()
+	opt := WithMetrics(reg)
+	m := MetricsFromOptions(opt)
+	require.NotNil(t, m)
+
+	req := Sequential(
+		m.Target("a.hlb:cached", &scriptedRequest{
+			statuses: []*client.SolveStatus{{
+				Vertexes: []*client.Vertex{
+					{Digest: image, Name: "docker-image://docker.io/library/alpine:latest", Cached: true, Started: &start, Completed: &start},
+					{Digest: exec, Name: "/bin/sh -c make", Cached: true, Started: &start, Completed: &start},
+				},
+			}},
+		}),
+		m.Target("a.hlb:push", &scriptedRequest{
+			opts: []SolveOption{WithPushImage("docker.io/openllb/app")},
+			statuses: []*client.SolveStatus{{
+				Vertexes: []*client.Vertex{
+					{Digest: image, Name: "docker-image://docker.io/library/alpine:latest", Started: &start},
+				},
+				Statuses: []*client.VertexStatus{
+					{ID: "sha256:layer", Vertex: image, Current: 40, Total: 100},
+				},
+			}, {
+				Vertexes: []*client.Vertex{
+					{Digest: image, Name: "docker-image://docker.io/library/alpine:latest", Started: &start, Completed: &done},
+					{Digest: exec, Name: "/bin/sh -c make", Started: &start, Completed: &done},
+				},
+				Statuses: []*client.VertexStatus{
+					{ID: "sha256:layer", Vertex: image, Current: 100, Total: 100, Completed: &done},
+				},
+			}, {
+				Vertexes: []*client.Vertex{
+					{Digest: export, Name: "exporting to image", Started: &start, Completed: &done},
+				},
+				Statuses: []*client.VertexStatus{
+					{ID: "pushing layers", Vertex: export, Current: 50},
+				},
+			}},
+		}),
+		m.Target("a.hlb:fail", &scriptedRequest{
+			statuses: []*client.SolveStatus{{
+				Vertexes: []*client.Vertex{
+					{Digest: failing, Name: "/bin/sh -c false", Started: &start, Completed: &done, Error: errBuild.Error()},
+				},
+			}},
+			err: errBuild,
+		}),
+	)
+
+	err := req.Solve(context.Background(), nil, nil, opt)
+	require.ErrorIs(t, err, errBuild)
+
+	require.Equal(t, 1, reg.count("hlb_target_duration_seconds,a.hlb:cached,succeeded"))
+	require.Equal(t, 1, reg.count("hlb_target_duration_seconds,a.hlb:push,succeeded"))
+	require.Equal(t, 1, reg.count("hlb_target_duration_seconds,a.hlb:fail,failed"))
+
+	require.Equal(t, float64(2), reg.value("hlb_vertices_total,hit"))
+	require.Equal(t, float64(3), reg.value("hlb_vertices_total,miss"))
+	require.Equal(t, float64(100), reg.value("hlb_source_bytes_total,docker-image"))
+
+	require.Equal(t, float64(50), reg.value("hlb_export_bytes_total,push"))
+	require.Equal(t, 1, reg.count("hlb_export_duration_seconds,push"))
+
+	require.Equal(t, float64(1), reg.value("hlb_errors_total,solve"))
+	require.Equal(t, float64(0), reg.value("hlb_errors_total,export"))
+	require.Equal(t, float64(0), reg.value("hlb_solves_in_flight"))
+
+	t.Run("export errors", func(t *testing.T) {
+		reg := newFakeRegistry()
+		opt := WithMetrics(reg)
+		err := (&scriptedRequest{
+			opts: []SolveOption{WithDownloadOCITarball()},
+			statuses: []*client.SolveStatus{{
+				Vertexes: []*client.Vertex{
+					{Digest: export, Name: "exporting to oci image format", Started: &start, Completed: &done, Error: "no space left on device"},
+				},
+			}},
+			err: errors.New("no space left on device"),
+		}).Solve(context.Background(), nil, nil, opt)
+		require.Error(t, err)
+		require.Equal(t, float64(1), reg.value("hlb_errors_total,export"))
+		require.Equal(t, 1, reg.count("hlb_export_duration_seconds,oci-tarball"))
+	})
+
+	t.Run("canceled targets", func(t *testing.T) {
+		reg := newFakeRegistry()
+		m := MetricsFromOptions(WithMetrics(reg, WithHashedTargetNames(4)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := m.Target("a.hlb:secret", &scriptedRequest{err: context.Canceled}).Solve(ctx, nil, nil)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 1, reg.count("hlb_target_duration_seconds,2,canceled"))
+	})
+
+	t.Run("hashed target names", func(t *testing.T) {
+		reg := newFakeRegistry()
+		m := MetricsFromOptions(WithMetrics(reg, WithHashedTargetNames(4)))
+
+		// However many targets there are, they are observed in at most as
+		// many series as there are buckets.
+		for i := 0; i < 100; i++ {
+			err := m.Target(fmt.Sprintf("a.hlb:target%d", i), &scriptedRequest{}).Solve(context.Background(), nil, nil)
+			require.NoError(t, err)
+		}
+		var series, observed int
+		for _, bucket := range []string{"0", "1", "2", "3"} {
+			n := reg.count("hlb_target_duration_seconds," + bucket + ",succeeded")
+			if n > 0 {
+				series++
+			}
+			observed += n
+		}
+		require.Equal(t, 100, observed)
+		require.Equal(t, 4, series)
+	})
+
+	t.Run("without metrics", func(t *testing.T) {
+		var m *Metrics
+		req := &scriptedRequest{}
+		require.Equal(t, Request(req), m.Target("a.hlb:default", req))
+		m.ObserveResolve("image")
+		m.ObserveError(ErrorParse)
+		require.Nil(t, MetricsFromOptions(WithPushImage("docker.io/openllb/app")))
+	})
+}
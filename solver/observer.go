@@ -0,0 +1,51 @@
+package solver
+
+import (
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// StatusObserver is called with every status BuildKit reports for a solve.
+type StatusObserver func(status *client.SolveStatus)
+
+// WithStatusObserver calls fn with every status of the solves of a request, in
+// addition to writing it to the progress, like to summarize what a build
+// pulled. Statuses of parallel solves may be observed concurrently.
+func WithStatusObserver(fn StatusObserver) SolveOption {
+	return func(info *SolveInfo) error {
+		info.StatusObservers = append(info.StatusObservers, fn)
+		return nil
+	}
+}
+
+// observerWriter passes the progress of a solve to its observers and to the
+// progress writer of the console, which may be nil.
+type observerWriter struct {
+	fns []StatusObserver
+	pw  progress.Writer
+}
+
+var _ progress.Writer = (*observerWriter)(nil)
+
+func (w *observerWriter) Write(s *client.SolveStatus) {
+	for _, fn := range w.fns {
+		fn(s)
+	}
+	if w.pw != nil {
+		w.pw.Write(s)
+	}
+}
+
+func (w *observerWriter) ValidateLogSource(dgst digest.Digest, v interface{}) bool {
+	if w.pw == nil {
+		return true
+	}
+	return w.pw.ValidateLogSource(dgst, v)
+}
+
+func (w *observerWriter) ClearLogSource(v interface{}) {
+	if w.pw != nil {
+		w.pw.ClearLogSource(v)
+	}
+}
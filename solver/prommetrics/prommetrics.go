@@ -0,0 +1,96 @@
+// Package prommetrics publishes the metrics of solves to Prometheus.
+package prommetrics
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/openllb/hlb/solver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Registry is a solver.MetricsRegistry that registers its collectors with a
+// Prometheus registerer.
+type Registry struct {
+	reg prometheus.Registerer
+
+	mu         sync.Mutex
+	collectors map[string]interface{}
+}
+
+var _ solver.MetricsRegistry = (*Registry)(nil)
+
+// NewRegistry returns a registry of collectors registered with reg. A
+// collector already registered with reg under the same name is reused, so
+// that the metrics of several builds in a process are published together.
+func NewRegistry(reg prometheus.Registerer) *Registry {
+	return &Registry{
+		reg:        reg,
+		collectors: make(map[string]interface{}),
+	}
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) solver.Counter {
+	return counter{r.register(name, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labels)).(*prometheus.CounterVec)}
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) solver.Gauge {
+	return gauge{r.register(name, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: name,
+		Help: help,
+	}, labels)).(*prometheus.GaugeVec)}
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) solver.Histogram {
+	return histogram{r.register(name, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}, labels)).(*prometheus.HistogramVec)}
+}
+
+func (r *Registry) register(name string, c prometheus.Collector) prometheus.Collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.collectors[name]; ok {
+		return existing.(prometheus.Collector)
+	}
+
+	err := r.reg.Register(c)
+	if err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			panic(err)
+		}
+		c = are.ExistingCollector
+	}
+	r.collectors[name] = c
+	return c
+}
+
+type counter struct {
+	vec *prometheus.CounterVec
+}
+
+func (c counter) Add(value float64, labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Add(value)
+}
+
+type gauge struct {
+	vec *prometheus.GaugeVec
+}
+
+func (g gauge) Add(value float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Add(value)
+}
+
+type histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+func (h histogram) Observe(value float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(value)
+}
@@ -0,0 +1,38 @@
+package prommetrics
+
+import (
+	"testing"
+
+	"github.com/openllb/hlb/solver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	preg := prometheus.NewRegistry()
+
+	// Metrics of builds in the same process share their collectors.
+	m1 := solver.MetricsFromOptions(solver.WithMetrics(NewRegistry(preg)))
+	m2 := solver.MetricsFromOptions(solver.WithMetrics(NewRegistry(preg)))
+	m1.ObserveResolve("image")
+	m2.ObserveResolve("image")
+	m2.ObserveError(solver.ErrorCheck)
+
+	families, err := preg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, mf := range families {
+		for _, metric := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, label := range metric.GetLabel() {
+				key += "," + label.GetValue()
+			}
+			values[key] = metric.GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, float64(2), values[solver.MetricResolves+",image"])
+	require.Equal(t, float64(1), values[solver.MetricErrors+",check"])
+}
@@ -0,0 +1,185 @@
+package solver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/grpcerrors"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultReconnectBudget         = time.Minute
+	defaultReconnectInitialBackoff = 500 * time.Millisecond
+	defaultReconnectMaxBackoff     = 10 * time.Second
+)
+
+// ReconnectPolicy configures how solves recover when the connection to
+// BuildKit is lost, for example when buildkitd is restarted mid-build.
+type ReconnectPolicy struct {
+	// Dial returns a new client connected to BuildKit.
+	Dial func(ctx context.Context) (*client.Client, error)
+
+	// Budget is the total time a solve may spend reconnecting before the
+	// connection failure is returned. Defaults to a minute.
+	Budget time.Duration
+
+	// InitialBackoff is the time to wait before the first reconnect attempt,
+	// which doubles after every failed attempt. Defaults to 500ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the longest time to wait between reconnect attempts.
+	// Defaults to 10s.
+	MaxBackoff time.Duration
+}
+
+// WithReconnect re-submits solve requests that failed because the connection
+// to BuildKit was lost, after connecting to BuildKit again. Requests are
+// content-addressed, so the work BuildKit already completed is reused. Build
+// failures are never retried.
+func WithReconnect(policy ReconnectPolicy) SolveOption {
+	if policy.Budget == 0 {
+		policy.Budget = defaultReconnectBudget
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaultReconnectInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultReconnectMaxBackoff
+	}
+	r := &reconnector{policy: policy}
+	return func(info *SolveInfo) error {
+		info.Reconnector = r
+		return nil
+	}
+}
+
+// reconnector shares the client of the latest connection between all the
+// requests solved with the same option, so that requests failing together
+// reconnect once.
+type reconnector struct {
+	policy ReconnectPolicy
+
+	mu  sync.Mutex
+	cln *client.Client
+
+	// dialing is closed when the request that is reconnecting gives up or
+	// connects, and is nil if no request is reconnecting.
+	dialing chan struct{}
+}
+
+// client returns the client of the latest connection, or cln if there has
+// been no reconnect.
+func (r *reconnector) client(cln *client.Client) *client.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cln != nil {
+		return r.cln
+	}
+	return cln
+}
+
+// reconnect returns a client with a new connection to replace cln, waiting
+// between attempts until the deadline. If another request has already
+// replaced cln, its client is returned instead, and if another request is
+// replacing it, reconnect waits for it to finish.
+func (r *reconnector) reconnect(ctx context.Context, cln *client.Client, deadline time.Time) (*client.Client, error) {
+	for {
+		r.mu.Lock()
+		if r.cln != nil && r.cln != cln {
+			next := r.cln
+			r.mu.Unlock()
+			return next, nil
+		}
+		dialing := r.dialing
+		if dialing == nil {
+			r.dialing = make(chan struct{})
+		}
+		r.mu.Unlock()
+
+		if dialing == nil {
+			return r.dial(ctx, deadline)
+		}
+
+		// If the other request gives up, this one tries to reconnect with its
+		// own budget.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-dialing:
+		}
+	}
+}
+
+// dial connects to BuildKit again, backing off between attempts without
+// holding the lock, so that other requests aren't blocked while it waits.
+func (r *reconnector) dial(ctx context.Context, deadline time.Time) (next *client.Client, err error) {
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if next != nil {
+			if r.cln != nil {
+				r.cln.Close()
+			}
+			r.cln = next
+		}
+		close(r.dialing)
+		r.dialing = nil
+	}()
+
+	backoff := r.policy.InitialBackoff
+	for {
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, errors.New("reconnect budget exhausted")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		next, err := r.policy.Dial(ctx)
+		if err == nil {
+			return next, nil
+		}
+		if next != nil {
+			next.Close()
+		}
+
+		backoff *= 2
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// IsConnectionError returns true if err is caused by losing the connection to
+// BuildKit, rather than by a failure of the build itself.
+func IsConnectionError(err error) bool {
+	return err != nil && grpcerrors.Code(err) == codes.Unavailable
+}
+
+// writeReconnectNotice writes a completed vertex to the progress writer so
+// that reconnects are visible alongside the build's progress.
+func writeReconnectNotice(pw progress.Writer, attempt int, cause error) {
+	if pw == nil {
+		return
+	}
+	now := time.Now()
+	name := fmt.Sprintf("[reconnect] reconnected to buildkitd after connection loss (attempt %d): %s", attempt, cause)
+	pw.Write(&client.SolveStatus{
+		Vertexes: []*client.Vertex{{
+			Digest:    digest.FromString(fmt.Sprintf("%s %d", name, now.UnixNano())),
+			Name:      name,
+			Started:   &now,
+			Completed: &now,
+		}},
+	})
+}
@@ -0,0 +1,322 @@
+package solver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	gatewayapi "github.com/moby/buildkit/frontend/gateway/pb"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	opspb "github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeBuildkitd is a BuildKit daemon that handles just enough of the control
+// and gateway APIs to run a build function, whose gateway solves are handled
+// by solve.
+type fakeBuildkitd struct {
+	controlapi.UnimplementedControlServer
+	gatewayapi.UnimplementedLLBBridgeServer
+
+	srv      *grpc.Server
+	lis      net.Listener
+	solve    func(ctx context.Context) error
+	returned chan *gatewayapi.ReturnRequest
+	finished chan struct{}
+
+	// exportErr fails builds whose build function succeeded, like a failure
+	// to export their result.
+	exportErr error
+
+	mu       sync.Mutex
+	solves   int
+	sessions []metadata.MD
+}
+
+func newFakeBuildkitd(t *testing.T, solve func(ctx context.Context) error) *fakeBuildkitd {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	fb := &fakeBuildkitd{
+		srv:      grpc.NewServer(),
+		lis:      lis,
+		solve:    solve,
+		returned: make(chan *gatewayapi.ReturnRequest, 1),
+		finished: make(chan struct{}),
+	}
+	controlapi.RegisterControlServer(fb.srv, fb)
+	gatewayapi.RegisterLLBBridgeServer(fb.srv, gatewayBridge{fb})
+	go fb.srv.Serve(lis)
+	t.Cleanup(fb.srv.Stop)
+	return fb
+}
+
+func (fb *fakeBuildkitd) client(ctx context.Context, t *testing.T) *client.Client {
+	cln, err := client.New(ctx, "", client.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", fb.lis.Addr().String())
+	}))
+	require.NoError(t, err)
+	return cln
+}
+
+func (fb *fakeBuildkitd) ListWorkers(ctx context.Context, req *controlapi.ListWorkersRequest) (*controlapi.ListWorkersResponse, error) {
+	return &controlapi.ListWorkersResponse{}, nil
+}
+
+func (fb *fakeBuildkitd) Session(stream controlapi.Control_SessionServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	fb.mu.Lock()
+	fb.sessions = append(fb.sessions, md)
+	fb.mu.Unlock()
+
+	// Like buildkitd, end the session once the build has finished so that the
+	// client can close it.
+	select {
+	case <-stream.Context().Done():
+	case <-fb.finished:
+	}
+	return nil
+}
+
+func (fb *fakeBuildkitd) Status(req *controlapi.StatusRequest, stream controlapi.Control_StatusServer) error {
+	return nil
+}
+
+func (fb *fakeBuildkitd) Solve(ctx context.Context, req *controlapi.SolveRequest) (*controlapi.SolveResponse, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ret := <-fb.returned:
+		close(fb.finished)
+		if ret.Error != nil {
+			return nil, status.Error(codes.Code(ret.Error.Code), ret.Error.Message)
+		}
+		if fb.exportErr != nil {
+			return nil, fb.exportErr
+		}
+		return &controlapi.SolveResponse{}, nil
+	}
+}
+
+func (fb *fakeBuildkitd) Ping(ctx context.Context, req *gatewayapi.PingRequest) (*gatewayapi.PongResponse, error) {
+	return &gatewayapi.PongResponse{
+		FrontendAPICaps: gatewayapi.Caps.All(),
+		LLBCaps:         opspb.Caps.All(),
+	}, nil
+}
+
+func (fb *fakeBuildkitd) Return(ctx context.Context, req *gatewayapi.ReturnRequest) (*gatewayapi.ReturnResponse, error) {
+	fb.returned <- req
+	return &gatewayapi.ReturnResponse{}, nil
+}
+
+func (fb *fakeBuildkitd) gatewaySolve(ctx context.Context) error {
+	fb.mu.Lock()
+	fb.solves++
+	fb.mu.Unlock()
+	return fb.solve(ctx)
+}
+
+// gatewayBridge serves the gateway API of a fakeBuildkitd, because its Solve
+// method conflicts with the control API.
+type gatewayBridge struct {
+	*fakeBuildkitd
+}
+
+func (gb gatewayBridge) Solve(ctx context.Context, req *gatewayapi.SolveRequest) (*gatewayapi.SolveResponse, error) {
+	err := gb.gatewaySolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewayapi.SolveResponse{}, nil
+}
+
+type recordingWriter struct {
+	mu       sync.Mutex
+	vertexes []*client.Vertex
+}
+
+func (w *recordingWriter) Write(s *client.SolveStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.vertexes = append(w.vertexes, s.Vertexes...)
+}
+
+func (w *recordingWriter) ValidateLogSource(digest.Digest, interface{}) bool { return true }
+
+func (w *recordingWriter) ClearLogSource(interface{}) {}
+
+var _ progress.Writer = &recordingWriter{}
+
+func TestReconnect(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	def, err := llb.Image("alpine").Marshal(ctx)
+	require.NoError(t, err)
+
+	req := Single(&Params{
+		Def: def,
+		SessionOpts: []llbutil.SessionOption{
+			llbutil.WithSecretSource("token", secretsprovider.Source{ID: "token", Env: "TOKEN"}),
+		},
+	})
+
+	t.Run("retries after connection loss", func(t *testing.T) {
+		var dropped *fakeBuildkitd
+		dropped = newFakeBuildkitd(t, func(ctx context.Context) error {
+			// Simulate buildkitd restarting in the middle of the solve.
+			go dropped.srv.Stop()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		restarted := newFakeBuildkitd(t, func(ctx context.Context) error {
+			return nil
+		})
+
+		var dials int
+		opt := WithReconnect(ReconnectPolicy{
+			Dial: func(ctx context.Context) (*client.Client, error) {
+				dials++
+				return restarted.client(ctx, t), nil
+			},
+			InitialBackoff: time.Millisecond,
+		})
+
+		var applied int
+		counted := func(info *SolveInfo) error {
+			applied++
+			return nil
+		}
+
+		w := &recordingWriter{}
+		err := req.Solve(ctx, dropped.client(ctx, t), NewMultiWriter(w), opt, counted)
+		require.NoError(t, err)
+		require.Equal(t, 1, dials)
+		require.Equal(t, 1, applied)
+		require.Equal(t, 1, dropped.solves)
+		require.Equal(t, 1, restarted.solves)
+
+		// Session attachables are registered again on the new connection.
+		require.Len(t, restarted.sessions, 1)
+		methods := strings.Join(restarted.sessions[0].Get("x-docker-expose-session-grpc-method"), " ")
+		require.Contains(t, methods, "moby.buildkit.secrets.v1.Secrets")
+
+		var notices int
+		for _, v := range w.vertexes {
+			if strings.Contains(v.Name, "reconnected to buildkitd") {
+				notices++
+			}
+		}
+		require.Equal(t, 1, notices)
+	})
+
+	t.Run("build failures are not retried", func(t *testing.T) {
+		failed := newFakeBuildkitd(t, func(ctx context.Context) error {
+			return status.Error(codes.Unknown, `process "/bin/sh -c false" did not complete successfully: exit code: 1`)
+		})
+
+		var dials int
+		opt := WithReconnect(ReconnectPolicy{
+			Dial: func(ctx context.Context) (*client.Client, error) {
+				dials++
+				return failed.client(ctx, t), nil
+			},
+			InitialBackoff: time.Millisecond,
+		})
+
+		err := req.Solve(ctx, failed.client(ctx, t), nil, opt)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "exit code: 1")
+		require.False(t, IsConnectionError(err))
+		require.Equal(t, 0, dials)
+		require.Equal(t, 1, failed.solves)
+	})
+
+	t.Run("gives up after budget", func(t *testing.T) {
+		var dropped *fakeBuildkitd
+		dropped = newFakeBuildkitd(t, func(ctx context.Context) error {
+			go dropped.srv.Stop()
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		opt := WithReconnect(ReconnectPolicy{
+			Dial: func(ctx context.Context) (*client.Client, error) {
+				return nil, status.Error(codes.Unavailable, "connection refused")
+			},
+			Budget:         20 * time.Millisecond,
+			InitialBackoff: time.Millisecond,
+		})
+
+		err := req.Solve(ctx, dropped.client(ctx, t), nil, opt)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to reconnect to buildkitd")
+		require.True(t, IsConnectionError(err))
+	})
+}
+
+func TestReconnectBackoffUnlocked(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dialed := make(chan struct{})
+	next := &client.Client{}
+	r := &reconnector{policy: ReconnectPolicy{
+		Dial: func(ctx context.Context) (*client.Client, error) {
+			<-dialed
+			return next, nil
+		},
+		Budget:         time.Minute,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}}
+
+	type result struct {
+		cln *client.Client
+		err error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			cln, err := r.reconnect(ctx, nil, time.Now().Add(time.Minute))
+			results <- result{cln, err}
+		}()
+	}
+
+	// Other requests get the current client while a request is reconnecting.
+	got := make(chan *client.Client)
+	go func() {
+		got <- r.client(nil)
+	}()
+	select {
+	case cln := <-got:
+		require.Nil(t, cln)
+	case <-time.After(5 * time.Second):
+		t.Fatal("client blocked while reconnecting")
+	}
+
+	// Both requests get the client of the single reconnect.
+	close(dialed)
+	for i := 0; i < 2; i++ {
+		res := <-results
+		require.NoError(t, res.err)
+		require.Same(t, next, res.cln)
+	}
+}
@@ -0,0 +1,205 @@
+package solver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/openllb/hlb/pkg/redact"
+)
+
+// WithRedaction scrubs the values of set from the progress of the solves of a
+// request, before it reaches the progress writer, log sinks or status
+// observers, and from the errors they fail with. Values may be added to the
+// set while solving.
+func WithRedaction(set *redact.Set) SolveOption {
+	return func(info *SolveInfo) error {
+		info.Redaction = set
+		return nil
+	}
+}
+
+type redactionSetKey struct{}
+
+// WithRedactionSet scrubs the values of set from the solves of the requests
+// solved with the returned context, like WithRedaction, unless they are solved
+// with a set of their own.
+func WithRedactionSet(ctx context.Context, set *redact.Set) context.Context {
+	return context.WithValue(ctx, redactionSetKey{}, set)
+}
+
+// RedactionSet returns the set of WithRedactionSet, or nil if there is none.
+func RedactionSet(ctx context.Context) *redact.Set {
+	set, _ := ctx.Value(redactionSetKey{}).(*redact.Set)
+	return set
+}
+
+// redactWriter scrubs sensitive values from the progress of a solve. Logs are
+// scrubbed as a stream for each vertex and stream, so that values split across
+// logs are still scrubbed. The end of a stream is written once its vertex
+// completes, or when the writer is closed for vertices that never complete.
+type redactWriter struct {
+	set *redact.Set
+	pw  progress.Writer
+
+	mu      sync.Mutex
+	streams map[logStream]*redact.Stream
+}
+
+var _ progress.Writer = (*redactWriter)(nil)
+
+// newRedactWriter returns a progress writer scrubbing the values of set, or
+// pw if it is nil or already scrubs them, and a function closing the writer
+// that must be called after the solve.
+func newRedactWriter(set *redact.Set, pw progress.Writer) (progress.Writer, func()) {
+	if set == nil || pw == nil {
+		return pw, func() {}
+	}
+	if rw, ok := pw.(*redactWriter); ok && rw.set == set {
+		return pw, func() {}
+	}
+	w := &redactWriter{
+		set:     set,
+		pw:      pw,
+		streams: make(map[logStream]*redact.Stream),
+	}
+	return w, w.Close
+}
+
+func (w *redactWriter) Write(s *client.SolveStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Statuses may be shared with other writers, so they are copied instead
+	// of scrubbed in place.
+	scrubbed := &client.SolveStatus{}
+	for _, log := range s.Logs {
+		key := logStream{log.Vertex, log.Stream}
+		st, ok := w.streams[key]
+		if !ok {
+			st = w.set.Stream()
+			w.streams[key] = st
+		}
+		if data := st.Write(log.Data); len(data) > 0 {
+			l := *log
+			l.Data = data
+			scrubbed.Logs = append(scrubbed.Logs, &l)
+		}
+	}
+
+	var flushed bool
+	for _, vtx := range s.Vertexes {
+		v := *vtx
+		v.Name = w.set.Redact(v.Name)
+		v.Error = w.set.Redact(v.Error)
+		scrubbed.Vertexes = append(scrubbed.Vertexes, &v)
+		if v.Completed == nil {
+			continue
+		}
+
+		// The end of the logs of a completed vertex is no longer held back.
+		for key, st := range w.streams {
+			if key.vertex != v.Digest {
+				continue
+			}
+			if data := st.Flush(); len(data) > 0 {
+				flushed = true
+				scrubbed.Logs = append(scrubbed.Logs, &client.VertexLog{
+					Vertex:    key.vertex,
+					Stream:    key.stream,
+					Data:      data,
+					Timestamp: *v.Completed,
+				})
+			}
+			delete(w.streams, key)
+		}
+	}
+
+	for _, status := range s.Statuses {
+		vs := *status
+		vs.ID = w.set.Redact(vs.ID)
+		vs.Name = w.set.Redact(vs.Name)
+		scrubbed.Statuses = append(scrubbed.Statuses, &vs)
+	}
+
+	for _, warning := range s.Warnings {
+		vw := *warning
+		vw.Short = w.set.RedactBytes(vw.Short)
+		vw.Detail = nil
+		for _, detail := range warning.Detail {
+			vw.Detail = append(vw.Detail, w.set.RedactBytes(detail))
+		}
+		scrubbed.Warnings = append(scrubbed.Warnings, &vw)
+	}
+
+	// Logs held back are written before the vertices are shown completed,
+	// because writers may handle the vertices of a status before its logs.
+	if flushed {
+		w.pw.Write(&client.SolveStatus{Logs: scrubbed.Logs})
+		scrubbed.Logs = nil
+	}
+	w.pw.Write(scrubbed)
+}
+
+// Close writes the ends of the streams of vertices that never completed, like
+// those of a solve that was canceled, which are otherwise held back.
+func (w *redactWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var (
+		logs []*client.VertexLog
+		now  = time.Now()
+	)
+	for key, st := range w.streams {
+		if data := st.Flush(); len(data) > 0 {
+			logs = append(logs, &client.VertexLog{
+				Vertex:    key.vertex,
+				Stream:    key.stream,
+				Data:      data,
+				Timestamp: now,
+			})
+		}
+		delete(w.streams, key)
+	}
+	if len(logs) > 0 {
+		w.pw.Write(&client.SolveStatus{Logs: logs})
+	}
+}
+
+func (w *redactWriter) ValidateLogSource(dgst digest.Digest, v interface{}) bool {
+	return w.pw.ValidateLogSource(dgst, v)
+}
+
+func (w *redactWriter) ClearLogSource(v interface{}) {
+	w.pw.ClearLogSource(v)
+}
+
+// RedactError returns err with the values of set scrubbed from its message.
+// The error it wraps is kept, so that it is still matched by errors.Is and
+// errors.As.
+func RedactError(set *redact.Set, err error) error {
+	if err == nil || set == nil {
+		return err
+	}
+	if re, ok := err.(*redactedError); ok && re.set == set {
+		return err
+	}
+	return &redactedError{set: set, err: err}
+}
+
+type redactedError struct {
+	set *redact.Set
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.set.Redact(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,124 @@
+package solver
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openllb/hlb/pkg/redact"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactWriter(t *testing.T) {
+	t.Parallel()
+
+	const token = "ghp_s3cr3t/t0ken+value"
+	set := redact.NewSet()
+	set.Add("GITHUB_TOKEN", token)
+
+	dir := t.TempDir()
+	s := newTestLogSink(t, dir)
+	fs := &fakeStream{}
+
+	// Scrubbing comes before the log sink, so that neither the log nor the
+	// console ever see the values.
+	var pw recordingWriter
+	lw := s.writer("build.hlb:build", &pw)
+	w, closeRedaction := newRedactWriter(set, lw)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(token))
+	w.Write(fs.started("RUN env"))
+	w.Write(fs.output("RUN env", "GITHUB_TOKEN="+token[:6]))
+	w.Write(fs.output("RUN env", token[6:]+"\nAUTH="+encoded+"\n"))
+	w.Write(fs.output("RUN env", "URL=https://example.com/?t="+url.QueryEscape(token)))
+	w.Write(fs.completed("RUN env", false, "token "+token+" was rejected"))
+	closeRedaction()
+	lw.Close()
+
+	require.Equal(t, strings.Join([]string{
+		"#1 RUN env",
+		"#1 GITHUB_TOKEN=[redacted:GITHUB_TOKEN]",
+		"#1 AUTH=[redacted:GITHUB_TOKEN]",
+		"#1 URL=https://example.com/?t=[redacted:GITHUB_TOKEN]",
+		"#1 ERROR: token [redacted:GITHUB_TOKEN] was rejected",
+		"",
+	}, "\n"), readLog(t, filepath.Join(dir, logFilename("build.hlb:build"))))
+
+	for _, v := range pw.vertexes {
+		require.NotContains(t, v.Error, token)
+	}
+
+	// Statuses are copied, so that other writers of them are unaffected.
+	status := fs.completed("RUN echo "+token, false, "")
+	w.Write(status)
+	require.Contains(t, status.Vertexes[0].Name, token)
+	require.Equal(t, "RUN echo [redacted:GITHUB_TOKEN]", pw.vertexes[len(pw.vertexes)-1].Name)
+
+	// Without values, the writer is not wrapped.
+	unwrapped, _ := newRedactWriter(nil, lw)
+	require.Equal(t, lw, unwrapped)
+	unwrapped, _ = newRedactWriter(set, w)
+	require.Equal(t, w, unwrapped)
+}
+
+func TestRedactWriterClose(t *testing.T) {
+	t.Parallel()
+
+	const token = "ghp_s3cr3t/t0ken+value"
+	set := redact.NewSet()
+	set.Add("GITHUB_TOKEN", token)
+
+	dir := t.TempDir()
+	s := newTestLogSink(t, dir)
+	fs := &fakeStream{}
+
+	lw := s.writer("build.hlb:build", nil)
+	w, closeRedaction := newRedactWriter(set, lw)
+
+	// The vertex never completes, like when its solve is canceled, so the
+	// end of its logs is only written when the writer is closed.
+	w.Write(fs.started("RUN env"))
+	w.Write(fs.output("RUN env", "TOKEN="+token[:6]))
+	closeRedaction()
+	lw.Close()
+
+	log := readLog(t, filepath.Join(dir, logFilename("build.hlb:build")))
+	require.Contains(t, log, "#1 TOKEN="+token[:6])
+}
+
+func TestRedactError(t *testing.T) {
+	t.Parallel()
+
+	const password = "hunter2!"
+	set := redact.NewSet()
+	set.Add("PASSWORD", password)
+
+	errFailed := errors.New("login with " + password + " failed")
+	err := RedactError(set, errFailed)
+	require.EqualError(t, err, "login with [redacted:PASSWORD] failed")
+	require.ErrorIs(t, err, errFailed)
+	require.Equal(t, err, RedactError(set, err))
+	require.NoError(t, RedactError(set, nil))
+	require.Equal(t, errFailed, RedactError(nil, errFailed))
+}
+
+func TestRedactionSet(t *testing.T) {
+	t.Parallel()
+
+	set, own := redact.NewSet(), redact.NewSet()
+	ctx := WithRedactionSet(context.Background(), set)
+
+	// Solves are redacted with the set of their context, unless they have
+	// a set of their own.
+	info, err := newSolveInfo(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, set, info.Redaction)
+
+	info, err = newSolveInfo(ctx, []SolveOption{WithRedaction(own)})
+	require.NoError(t, err)
+	require.Equal(t, own, info.Redaction)
+}
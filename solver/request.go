@@ -2,19 +2,29 @@ package solver
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/docker/buildx/util/progress"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/openllb/hlb/pkg/llbutil"
+	"github.com/pkg/errors"
 	"github.com/xlab/treeprint"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 // Request is a node in the solve request tree produced by the compiler. The
 // solve request tree has peer nodes that should be executed in parallel, and
 // next nodes that should be executed sequentially. These can be intermingled
 // to produce a complex build pipeline.
+//
+// Requests are composed with Sequential, Parallel, Limited, First, Named,
+// Grouped, OnFailure and Finally, which nest arbitrarily. A request stops
+// promptly when the context it is solved with is canceled, except for the
+// cleanup of Finally.
 type Request interface {
 	// Solve sends the request and its children to BuildKit. The request passes
 	// down the progress.Writer for them to spawn their own progress writers
@@ -59,6 +69,53 @@ func (r *singleRequest) Solve(ctx context.Context, cln *client.Client, mw *Multi
 		pw = mw.WithPrefix("", false)
 	}
 
+	// Options are applied once, even if the request is solved again after a
+	// reconnect.
+	info, err := newSolveInfo(ctx, append(r.params.SolveOpts, opts...))
+	if err != nil {
+		return err
+	}
+
+	if info.LogSink != nil && info.LogName != "" {
+		lw := info.LogSink.writer(info.LogName, pw)
+		defer lw.Close()
+		pw = lw
+	}
+	if len(info.StatusObservers) > 0 {
+		pw = &observerWriter{fns: info.StatusObservers, pw: pw}
+	}
+	// The redaction writer is closed before the log sink, so the ends of logs
+	// it holds back are written to the log too.
+	pw, closeRedaction := newRedactWriter(info.Redaction, pw)
+	defer closeRedaction()
+
+	rc := info.Reconnector
+	if rc == nil {
+		return r.solve(ctx, cln, pw, info)
+	}
+
+	var deadline time.Time
+	for attempt := 1; ; attempt++ {
+		cln = rc.client(cln)
+		cause := r.solve(ctx, cln, pw, info)
+		if !IsConnectionError(cause) || ctx.Err() != nil {
+			return cause
+		}
+
+		if deadline.IsZero() {
+			deadline = time.Now().Add(rc.policy.Budget)
+		}
+		cln, err = rc.reconnect(ctx, cln, deadline)
+		if err != nil {
+			return errors.Wrapf(cause, "failed to reconnect to buildkitd: %s", err)
+		}
+		writeReconnectNotice(pw, attempt, cause)
+	}
+}
+
+// solve sends the request with a new session, so that the session
+// attachables are registered again on every connection.
+func (r *singleRequest) solve(ctx context.Context, cln *client.Client, pw progress.Writer, info *SolveInfo) error {
 	s, err := llbutil.NewSession(ctx, r.params.SessionOpts...)
 	if err != nil {
 		return err
@@ -71,7 +128,7 @@ func (r *singleRequest) Solve(ctx context.Context, cln *client.Client, mw *Multi
 	})
 
 	g.Go(func() error {
-		return Solve(ctx, cln, s, pw, r.params.Def, append(r.params.SolveOpts, opts...)...)
+		return solveWithInfo(ctx, cln, s, pw, r.params.Def, info)
 	})
 
 	return g.Wait()
@@ -85,6 +142,10 @@ type parallelRequest struct {
 	reqs []Request
 }
 
+// Parallel returns a request that solves the candidates concurrently. It fails
+// fast: the first failure cancels the context of the others, and is returned
+// once all of them have returned. Nil requests are dropped and nested
+// parallel requests are flattened.
 func Parallel(candidates ...Request) Request {
 	var reqs []Request
 	for _, req := range candidates {
@@ -127,10 +188,68 @@ func (r *parallelRequest) Tree(tree treeprint.Tree) error {
 	return nil
 }
 
+type namedRequest struct {
+	name string
+	req  Request
+}
+
+// Named returns a request that attributes failures of req to name. Named
+// requests combined with Parallel identify which of many independent
+// requests failed, and their progress is written to the log of name when
+// solved with WithLogSink.
+func Named(name string, req Request) Request {
+	if _, ok := req.(*nilRequest); ok {
+		return req
+	}
+	return &namedRequest{name: name, req: req}
+}
+
+func (r *namedRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	opts = append(opts[:len(opts):len(opts)], withLogName(r.name))
+	err := r.req.Solve(ctx, cln, mw, opts...)
+	if err != nil {
+		return errors.Wrap(err, r.name)
+	}
+	return nil
+}
+
+func (r *namedRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree.AddMetaBranch("named", r.name))
+}
+
+type groupedRequest struct {
+	id   string
+	name string
+	req  Request
+}
+
+// Grouped returns a request that groups the vertices of req in progress, so
+// that the vertices of a target are shown together when targets are solved in
+// parallel. Vertices that req groups itself keep their group.
+func Grouped(id, name string, req Request) Request {
+	if _, ok := req.(*nilRequest); ok {
+		return req
+	}
+	return &groupedRequest{id: id, name: name, req: req}
+}
+
+func (r *groupedRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	opts = append(opts[:len(opts):len(opts)], WithProgressGroup(r.id, r.name))
+	return r.req.Solve(ctx, cln, mw, opts...)
+}
+
+func (r *groupedRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree)
+}
+
 type sequentialRequest struct {
 	reqs []Request
 }
 
+// Sequential returns a request that solves the candidates one after another
+// in order. It stops at the first failure, or when its context is canceled
+// before the next candidate, and returns that error. Nil requests are dropped
+// and nested sequential requests are flattened.
 func Sequential(candidates ...Request) Request {
 	var reqs []Request
 	for _, req := range candidates {
@@ -153,6 +272,9 @@ func Sequential(candidates ...Request) Request {
 
 func (r *sequentialRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
 	for _, req := range r.reqs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		err := req.Solve(ctx, cln, mw, opts...)
 		if err != nil {
 			return err
@@ -171,3 +293,217 @@ func (r *sequentialRequest) Tree(tree treeprint.Tree) error {
 	}
 	return nil
 }
+
+type limitedRequest struct {
+	n    int
+	reqs []Request
+}
+
+// Limited returns a request that solves the candidates like Parallel, but
+// with at most n of them at a time. Candidates start in order as others
+// finish. A limit less than one is no limit.
+func Limited(n int, candidates ...Request) Request {
+	var reqs []Request
+	for _, req := range candidates {
+		if _, ok := req.(*nilRequest); ok {
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	if n < 1 || n >= len(reqs) {
+		return Parallel(reqs...)
+	}
+	return &limitedRequest{n: n, reqs: reqs}
+}
+
+func (r *limitedRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	sem := semaphore.NewWeighted(int64(r.n))
+	g, gctx := errgroup.WithContext(ctx)
+	for _, req := range r.reqs {
+		// Acquiring in order starts the candidates in order, and fails once
+		// the context is canceled so that the rest never start.
+		err := sem.Acquire(gctx, 1)
+		if err != nil {
+			break
+		}
+
+		// A failed candidate keeps its slot, so that no other candidate
+		// starts before the failure cancels the context.
+		req := req
+		g.Go(func() error {
+			err := req.Solve(gctx, cln, mw, opts...)
+			if err == nil {
+				sem.Release(1)
+			}
+			return err
+		})
+	}
+	err := g.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func (r *limitedRequest) Tree(tree treeprint.Tree) error {
+	branch := tree.AddMetaBranch("limited", r.n)
+	for _, req := range r.reqs {
+		err := req.Tree(branch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type firstRequest struct {
+	reqs []Request
+}
+
+// First returns a request that solves the candidates concurrently, and
+// succeeds once any of them succeeds, like alternative sources of the same
+// result. The first success cancels the context of the others, and is
+// returned once all of them have returned. If all of them fail, the failure
+// of the first candidate is returned. A nil request always succeeds, so a
+// First of one is a nil request, and nested first requests are flattened.
+func First(candidates ...Request) Request {
+	var reqs []Request
+	for _, req := range candidates {
+		switch r := req.(type) {
+		case *nilRequest:
+			return NilRequest()
+		case *firstRequest:
+			reqs = append(reqs, r.reqs...)
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) == 0 {
+		return NilRequest()
+	} else if len(reqs) == 1 {
+		return reqs[0]
+	}
+	return &firstRequest{reqs: reqs}
+}
+
+func (r *firstRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(r.reqs))
+	)
+	for i, req := range r.reqs {
+		i, req := i, req
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = req.Solve(ctx, cln, mw, opts...)
+			if errs[i] == nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("all %d candidates failed: %w", len(errs), errs[0])
+}
+
+func (r *firstRequest) Tree(tree treeprint.Tree) error {
+	branch := tree.AddBranch("first")
+	for _, req := range r.reqs {
+		err := req.Tree(branch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type onFailureRequest struct {
+	req     Request
+	handler func(error) error
+}
+
+// OnFailure returns a request that passes the failure of req to handler, and
+// fails with the error it returns instead. A handler returning nil suppresses
+// the failure, like for a stage that is allowed to fail. Failures after the
+// context is canceled are returned as is, so that a cancellation is never
+// suppressed.
+func OnFailure(req Request, handler func(error) error) Request {
+	if _, ok := req.(*nilRequest); ok {
+		return req
+	}
+	return &onFailureRequest{req: req, handler: handler}
+}
+
+func (r *onFailureRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	err := r.req.Solve(ctx, cln, mw, opts...)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	return r.handler(err)
+}
+
+func (r *onFailureRequest) Tree(tree treeprint.Tree) error {
+	return r.req.Tree(tree.AddBranch("onFailure"))
+}
+
+type finallyRequest struct {
+	req     Request
+	cleanup Request
+}
+
+// Finally returns a request that solves cleanup after req, whether req
+// succeeds, fails or is canceled. The cleanup is solved without the
+// cancellation of the context, so it runs to completion. The failure of req
+// is returned over the failure of cleanup, which is added to its message.
+func Finally(req, cleanup Request) Request {
+	if _, ok := cleanup.(*nilRequest); ok {
+		return req
+	}
+	if _, ok := req.(*nilRequest); ok {
+		return cleanup
+	}
+	return &finallyRequest{req: req, cleanup: cleanup}
+}
+
+func (r *finallyRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	err := r.req.Solve(ctx, cln, mw, opts...)
+	cerr := r.cleanup.Solve(detach(ctx), cln, mw, opts...)
+	switch {
+	case err == nil:
+		return cerr
+	case cerr != nil:
+		return fmt.Errorf("%w (cleanup also failed: %s)", err, cerr)
+	}
+	return err
+}
+
+func (r *finallyRequest) Tree(tree treeprint.Tree) error {
+	branch := tree.AddBranch("finally")
+	err := r.req.Tree(branch)
+	if err != nil {
+		return err
+	}
+	return r.cleanup.Tree(branch.AddBranch("cleanup"))
+}
+
+// detachedContext has the values of a context without its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,444 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"github.com/xlab/treeprint"
+)
+
+type errRequest struct {
+	err error
+}
+
+func (r *errRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	return r.err
+}
+
+func (r *errRequest) Tree(tree treeprint.Tree) error {
+	tree.AddNode("err")
+	return nil
+}
+
+func TestNamed(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	req := Parallel(
+		Named("a.hlb:default", NilRequest()),
+		Named("b.hlb:build", &errRequest{errFailed}),
+	)
+
+	err := req.Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.EqualError(t, err, "b.hlb:build: failed")
+
+	tree := treeprint.New()
+	err = req.Tree(tree)
+	require.NoError(t, err)
+	require.Equal(t, ".\n└── [named]  b.hlb:build\n    └── err\n", tree.String())
+}
+
+// defRequest records the definition that a request would send to BuildKit.
+type defRequest struct {
+	def  *llb.Definition
+	sent *llb.Definition
+}
+
+func (r *defRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	info := &SolveInfo{}
+	for _, opt := range opts {
+		err := opt(info)
+		if err != nil {
+			return err
+		}
+	}
+	r.sent = withProgressGroup(r.def, info.ProgressGroup)
+	return nil
+}
+
+func (r *defRequest) Tree(tree treeprint.Tree) error {
+	return nil
+}
+
+// progressGroups returns the progress group id of every op in def.
+func progressGroups(t *testing.T, def *llb.Definition) map[string]string {
+	groups := make(map[string]string)
+	for _, dt := range def.Def {
+		var op pb.Op
+		require.NoError(t, op.Unmarshal(dt))
+
+		name := "output"
+		switch v := op.Op.(type) {
+		case *pb.Op_Source:
+			name = v.Source.Identifier
+		case *pb.Op_Exec:
+			name = strings.Join(v.Exec.Meta.Args, " ")
+		case *pb.Op_File:
+			name = "file"
+		}
+
+		var id string
+		if pg := def.Metadata[digest.FromBytes(dt)].ProgressGroup; pg != nil {
+			id = pg.Id
+		}
+		groups[name] = id
+	}
+	return groups
+}
+
+func TestGrouped(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	defA, err := llb.Image("alpine").Run(llb.Shlex("true")).Root().Marshal(ctx)
+	require.NoError(t, err)
+	defB, err := llb.Scratch().File(llb.Mkdir("/out", 0755), llb.ProgressGroup("mkdir", "mkdir", false)).Marshal(ctx)
+	require.NoError(t, err)
+
+	a, b := &defRequest{def: defA}, &defRequest{def: defB}
+	req := Parallel(
+		Grouped("a.hlb:default", "a.hlb:default", a),
+		Grouped("b.hlb:build", "b.hlb:build", b),
+	)
+	err = req.Solve(ctx, nil, nil)
+	require.NoError(t, err)
+
+	// Every op of a target is sent in its group, unless it has one.
+	require.Equal(t, map[string]string{
+		"docker-image://docker.io/library/alpine:latest": "a.hlb:default",
+		"true":   "a.hlb:default",
+		"output": "a.hlb:default",
+	}, progressGroups(t, a.sent))
+	require.Equal(t, map[string]string{
+		"file":   "mkdir",
+		"output": "b.hlb:build",
+	}, progressGroups(t, b.sent))
+
+	// The definitions of the requests are not modified.
+	require.Equal(t, map[string]string{
+		"docker-image://docker.io/library/alpine:latest": "",
+		"true":   "",
+		"output": "",
+	}, progressGroups(t, defA))
+
+	// Nested groups take precedence.
+	err = Grouped("outer", "outer", Grouped("inner", "inner", a)).Solve(ctx, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "inner", progressGroups(t, a.sent)["true"])
+}
+
+// events records the order in which fake requests start and end.
+type events struct {
+	mu     sync.Mutex
+	events []string
+
+	running, maxRunning int
+}
+
+func (e *events) add(event string, delta int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+	e.running += delta
+	if e.running > e.maxRunning {
+		e.maxRunning = e.running
+	}
+}
+
+func (e *events) list() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+// fakeRequest takes delay to solve and then fails with err, or fails with the
+// error of its context if it is canceled first.
+type fakeRequest struct {
+	name   string
+	events *events
+	delay  time.Duration
+	err    error
+}
+
+func (r *fakeRequest) Solve(ctx context.Context, cln *client.Client, mw *MultiWriter, opts ...SolveOption) error {
+	r.events.add("start "+r.name, 1)
+	select {
+	case <-ctx.Done():
+		r.events.add("cancel "+r.name, -1)
+		return ctx.Err()
+	case <-time.After(r.delay):
+	}
+	r.events.add("end "+r.name, -1)
+	return r.err
+}
+
+func (r *fakeRequest) Tree(tree treeprint.Tree) error {
+	tree.AddNode(r.name)
+	return nil
+}
+
+func TestSequential(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	e := &events{}
+	req := Sequential(
+		&fakeRequest{name: "a", events: e},
+		Sequential(&fakeRequest{name: "b", events: e}, NilRequest()),
+		&fakeRequest{name: "c", events: e, err: errFailed},
+		&fakeRequest{name: "d", events: e},
+	)
+
+	err := req.Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.Equal(t, []string{"start a", "end a", "start b", "end b", "start c", "end c"}, e.list())
+	require.Equal(t, 1, e.maxRunning)
+
+	// Canceling stops the current request and skips the rest.
+	e = &events{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = Sequential(
+		&fakeRequest{name: "a", events: e, delay: time.Minute},
+		&fakeRequest{name: "b", events: e},
+	).Solve(ctx, nil, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, []string{"start a", "cancel a"}, e.list())
+}
+
+func TestParallel(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	e := &events{}
+	req := Parallel(
+		&fakeRequest{name: "a", events: e, delay: 10 * time.Millisecond},
+		Parallel(&fakeRequest{name: "b", events: e, delay: 10 * time.Millisecond}),
+		&fakeRequest{name: "c", events: e, delay: 10 * time.Millisecond},
+	)
+	err := req.Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, e.maxRunning)
+
+	// The first failure cancels the others.
+	e = &events{}
+	start := time.Now()
+	err = Parallel(
+		&fakeRequest{name: "a", events: e, err: errFailed},
+		&fakeRequest{name: "b", events: e, delay: time.Minute},
+	).Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.Less(t, int64(time.Since(start)), int64(time.Minute))
+	require.Contains(t, e.list(), "cancel b")
+}
+
+func TestLimited(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	e := &events{}
+	var reqs []Request
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		reqs = append(reqs, &fakeRequest{name: name, events: e, delay: 5 * time.Millisecond})
+	}
+	err := Limited(2, reqs...).Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, e.maxRunning)
+
+	// Each request after the first two waits for one more to end.
+	var starts, ends int
+	for _, event := range e.list() {
+		switch {
+		case strings.HasPrefix(event, "start "):
+			starts++
+			require.GreaterOrEqual(t, ends, starts-2, event)
+		case strings.HasPrefix(event, "end "):
+			ends++
+		}
+	}
+	require.Equal(t, 5, starts)
+
+	// A failure cancels the running requests and the rest never start.
+	e = &events{}
+	err = Limited(1,
+		&fakeRequest{name: "a", events: e, err: errFailed},
+		&fakeRequest{name: "b", events: e},
+	).Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.Equal(t, []string{"start a", "end a"}, e.list())
+
+	// A limit less than one is no limit.
+	e = &events{}
+	err = Limited(0, reqs[:3]...).Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+
+	tree := treeprint.New()
+	err = Limited(1, &errRequest{}, &errRequest{}).Tree(tree)
+	require.NoError(t, err)
+	require.Equal(t, ".\n└── [limited]  1\n    ├── err\n    └── err\n", tree.String())
+}
+
+func TestFirst(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	e := &events{}
+	start := time.Now()
+	err := First(
+		&fakeRequest{name: "a", events: e, err: errFailed},
+		First(&fakeRequest{name: "b", events: e, delay: 10 * time.Millisecond}),
+		&fakeRequest{name: "c", events: e, delay: time.Minute},
+	).Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+
+	// The first success cancels the rest, and failures before it are ignored.
+	require.Less(t, int64(time.Since(start)), int64(time.Minute))
+	require.Contains(t, e.list(), "end a")
+	require.Contains(t, e.list(), "end b")
+	require.Contains(t, e.list(), "cancel c")
+
+	// If all fail, the failure of the first is returned.
+	errOther := errors.New("other")
+	err = First(&errRequest{errFailed}, &errRequest{errOther}).Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.EqualError(t, err, "all 2 candidates failed: failed")
+
+	// A nil request always succeeds.
+	_, ok := First(&errRequest{errFailed}, NilRequest()).(*nilRequest)
+	require.True(t, ok)
+
+	tree := treeprint.New()
+	err = First(&errRequest{}, First(&errRequest{}, &errRequest{})).Tree(tree)
+	require.NoError(t, err)
+	require.Equal(t, ".\n└── first\n    ├── err\n    ├── err\n    └── err\n", tree.String())
+}
+
+func TestOnFailure(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	errHandled := errors.New("handled")
+
+	var handled error
+	req := OnFailure(&errRequest{errFailed}, func(err error) error {
+		handled = err
+		return errHandled
+	})
+	err := req.Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errHandled)
+	require.ErrorIs(t, handled, errFailed)
+
+	// A suppressed failure doesn't cancel the requests in parallel with it.
+	e := &events{}
+	err = Parallel(
+		OnFailure(&fakeRequest{name: "a", events: e, err: errFailed}, func(error) error { return nil }),
+		&fakeRequest{name: "b", events: e, delay: 10 * time.Millisecond},
+	).Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Contains(t, e.list(), "end b")
+
+	// A cancellation is never passed to the handler.
+	e = &events{}
+	called := false
+	err = Parallel(
+		OnFailure(&fakeRequest{name: "a", events: e, delay: time.Minute}, func(error) error {
+			called = true
+			return nil
+		}),
+		&fakeRequest{name: "b", events: e, err: errFailed},
+	).Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.False(t, called)
+}
+
+func TestFinally(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	errCleanup := errors.New("cleanup failed")
+
+	e := &events{}
+	err := Finally(
+		&fakeRequest{name: "a", events: e},
+		&fakeRequest{name: "cleanup", events: e},
+	).Solve(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"start a", "end a", "start cleanup", "end cleanup"}, e.list())
+
+	// The cleanup runs after a failure, which is returned with the failure
+	// of the cleanup.
+	err = Finally(&errRequest{errFailed}, &errRequest{errCleanup}).Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+	require.EqualError(t, err, "failed (cleanup also failed: cleanup failed)")
+
+	err = Finally(NilRequest(), &errRequest{errCleanup}).Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errCleanup)
+
+	// The cleanup runs to completion after a cancellation.
+	e = &events{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = Finally(
+		&fakeRequest{name: "a", events: e, delay: time.Minute},
+		&fakeRequest{name: "cleanup", events: e, delay: 30 * time.Millisecond},
+	).Solve(ctx, nil, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, []string{"start a", "cancel a", "start cleanup", "end cleanup"}, e.list())
+}
+
+func TestCombinatorsNested(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	e := &events{}
+	req := Sequential(
+		Finally(
+			Limited(1,
+				Named("a", &fakeRequest{name: "a", events: e}),
+				OnFailure(&fakeRequest{name: "b", events: e, err: errFailed}, func(error) error { return nil }),
+			),
+			&fakeRequest{name: "push logs", events: e},
+		),
+		Parallel(
+			&fakeRequest{name: "c", events: e, err: errFailed},
+			&fakeRequest{name: "d", events: e, delay: time.Minute},
+		),
+		&fakeRequest{name: "e", events: e},
+	)
+
+	err := req.Solve(context.Background(), nil, nil)
+	require.ErrorIs(t, err, errFailed)
+
+	got := e.list()
+	require.Equal(t, []string{"start a", "end a", "start b", "end b", "start push logs", "end push logs"}, got[:6])
+	require.ElementsMatch(t, []string{"start c", "end c", "start d", "cancel d"}, got[6:])
+
+	tree := treeprint.New()
+	err = req.Tree(tree)
+	require.NoError(t, err)
+	require.Equal(t, `.
+└── sequential
+    ├── finally
+    │   ├── [limited]  1
+    │   │   ├── [named]  a
+    │   │   │   └── a
+    │   │   └── onFailure
+    │   │       └── b
+    │   └── cleanup
+    │       └── push logs
+    ├── parallel
+    │   ├── c
+    │   └── d
+    └── e
+`, strings.ReplaceAll(tree.String(), "\u00a0", " "))
+}
@@ -3,6 +3,7 @@ package solver
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/docker/buildx/util/progress"
 	"github.com/docker/distribution/reference"
@@ -11,8 +12,11 @@ import (
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver/pb"
 	"github.com/moby/buildkit/util/entitlements"
+	digest "github.com/opencontainers/go-digest"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openllb/hlb/pkg/redact"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -25,6 +29,7 @@ type SolveInfo struct {
 	OutputMoby             bool
 	OutputDockerRef        string
 	OutputPushImage        string
+	OutputPushByDigest     bool
 	OutputLocal            string
 	OutputLocalTarball     bool
 	OutputLocalOCITarball  bool
@@ -34,6 +39,15 @@ type SolveInfo struct {
 	ImageSpec              *ImageSpec
 	ErrorHandler           ErrorHandler
 	Entitlements           []entitlements.Entitlement
+	Reconnector            *reconnector      `json:"-"`
+	LogSink                *logSink          `json:"-"`
+	LogName                string            `json:"-"`
+	ProgressGroup          *pb.ProgressGroup `json:"-"`
+	StatusObservers        []StatusObserver  `json:"-"`
+	LargeFiles             []*LargeFiles     `json:"-"`
+	Preflights             []Preflight       `json:"-"`
+	Metrics                *Metrics          `json:"-"`
+	Redaction              *redact.Set       `json:"-"`
 }
 
 // ImageSpec is HLB's wrapper for the OCI specs image, allowing for backward
@@ -41,6 +55,10 @@ type SolveInfo struct {
 type ImageSpec struct {
 	specs.Image
 
+	// Config shadows the config of the OCI image with Docker's, which has
+	// more fields.
+	Config ImageConfig `json:"config,omitempty"`
+
 	ContainerConfig ContainerConfig `json:"container_config,omitempty"`
 
 	// Canonical is the fully qualified reference of the image with name and
@@ -48,6 +66,27 @@ type ImageSpec struct {
 	Canonical reference.Canonical `json:"-"`
 }
 
+// ImageConfig is the OCI image config with the fields that Docker adds to it.
+type ImageConfig struct {
+	specs.ImageConfig
+
+	Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+	ArgsEscaped bool          `json:"ArgsEscaped,omitempty"`
+}
+
+// HealthConfig is the check that a container is healthy.
+type HealthConfig struct {
+	// Test is the check to run, either ["NONE"] to disable the check of the
+	// base image, ["CMD", args...] to run a command or ["CMD-SHELL", command]
+	// to run a command with the default shell.
+	Test []string `json:",omitempty"`
+
+	Interval    time.Duration `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	StartPeriod time.Duration `json:",omitempty"`
+	Retries     int           `json:",omitempty"`
+}
+
 // ContainerConfig is the schema1-compatible configuration of the container
 // that is committed into the image.
 type ContainerConfig struct {
@@ -85,6 +124,15 @@ func WithPushImage(ref string) SolveOption {
 	}
 }
 
+// WithPushByDigest pushes the image of WithPushImage without its tag, so that
+// the image can be checked before it is tagged.
+func WithPushByDigest() SolveOption {
+	return func(info *SolveInfo) error {
+		info.OutputPushByDigest = true
+		return nil
+	}
+}
+
 func WithDownload(dest string) SolveOption {
 	return func(info *SolveInfo) error {
 		info.OutputLocal = dest
@@ -113,6 +161,41 @@ func WithCallback(fn SolveCallback) SolveOption {
 	}
 }
 
+// WithProgressGroup groups the vertices of a solve in progress, like the
+// vertices of a target. Vertices already in a group keep it.
+func WithProgressGroup(id, name string) SolveOption {
+	return func(info *SolveInfo) error {
+		info.ProgressGroup = &pb.ProgressGroup{Id: id, Name: name}
+		return nil
+	}
+}
+
+// withProgressGroup returns a copy of def whose ops without a progress group
+// are in pg.
+func withProgressGroup(def *llb.Definition, pg *pb.ProgressGroup) *llb.Definition {
+	if pg == nil {
+		return def
+	}
+
+	grouped := &llb.Definition{
+		Def:      def.Def,
+		Source:   def.Source,
+		Metadata: make(map[digest.Digest]pb.OpMetadata, len(def.Def)),
+	}
+	for dgst, md := range def.Metadata {
+		grouped.Metadata[dgst] = md
+	}
+	for _, dt := range def.Def {
+		dgst := digest.FromBytes(dt)
+		md := grouped.Metadata[dgst]
+		if md.ProgressGroup == nil {
+			md.ProgressGroup = pg
+			grouped.Metadata[dgst] = md
+		}
+	}
+	return grouped
+}
+
 func WithImageSpec(spec *ImageSpec) SolveOption {
 	return func(info *SolveInfo) error {
 		info.ImageSpec = spec
@@ -150,23 +233,68 @@ func WithStargz(forceCompression bool) SolveOption {
 }
 
 func Solve(ctx context.Context, c *client.Client, s *session.Session, pw progress.Writer, def *llb.Definition, opts ...SolveOption) error {
-	info := &SolveInfo{}
+	info, err := newSolveInfo(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return solveWithInfo(ctx, c, s, pw, def, info)
+}
+
+// newSolveInfo returns the info of solve options, which redact the values of
+// the set of the context unless they set their own.
+func newSolveInfo(ctx context.Context, opts []SolveOption) (*SolveInfo, error) {
+	info := &SolveInfo{Redaction: RedactionSet(ctx)}
 	for _, opt := range opts {
 		err := opt(info)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return info, nil
+}
 
-	return Build(ctx, c, s, pw, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
-		res, err := c.Solve(ctx, gateway.SolveRequest{
-			Definition: def.ToPB(),
-			Evaluate:   info.Evaluate,
-		})
-		if err != nil {
-			if info.ErrorHandler != nil {
-				return nil, info.ErrorHandler(ctx, c, err)
+// solveWithInfo solves def like Solve with options that are already applied,
+// so that a request that is solved again applies its options once.
+func solveWithInfo(ctx context.Context, c *client.Client, s *session.Session, pw progress.Writer, def *llb.Definition, info *SolveInfo) error {
+	var checkErr error
+	err := buildWithInfo(ctx, c, s, pw, func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+		solve := func(def *llb.Definition) (*gateway.Result, error) {
+			pbDef := withProgressGroup(def, info.ProgressGroup).ToPB()
+			res, err := c.Solve(ctx, gateway.SolveRequest{
+				Definition: pbDef,
+				Evaluate:   info.Evaluate,
+			})
+			if err != nil {
+				err = withSolveCategory(err, pbDef)
+				if info.ErrorHandler != nil {
+					return nil, info.ErrorHandler(ctx, c, err)
+				}
+				return nil, err
 			}
+			return res, nil
+		}
+
+		for _, pf := range info.Preflights {
+			res, err := solve(pf.Def)
+			if err != nil {
+				return nil, err
+			}
+
+			ref, err := res.SingleRef()
+			if err != nil {
+				return nil, err
+			}
+
+			// BuildKit only keeps the message of an error returned by the
+			// build, so the error of a check is returned as is after it.
+			checkErr = pf.Check(ctx, ref)
+			if checkErr != nil {
+				return nil, checkErr
+			}
+		}
+
+		res, err := solve(def)
+		if err != nil {
 			return nil, err
 		}
 
@@ -179,18 +307,52 @@ func Solve(ctx context.Context, c *client.Client, s *session.Session, pw progres
 			res.AddMeta(exptypes.ExporterImageConfigKey, config)
 		}
 		return res, nil
-	}, opts...)
+	}, info)
+	if checkErr != nil {
+		return checkErr
+	}
+	return err
+}
+
+// Preflight checks the result of a definition before a request is solved,
+// like the input of an exec before the exec. The definition is solved with
+// the request, so BuildKit reuses its result for the request.
+type Preflight struct {
+	Def *llb.Definition
+
+	// Check returns an error to fail the request with, instead of solving it.
+	Check func(ctx context.Context, ref gateway.Reference) error
+}
+
+// WithPreflight checks the result of a definition before the request is
+// solved. Preflights are checked in the order they are given.
+func WithPreflight(pf Preflight) SolveOption {
+	return func(info *SolveInfo) error {
+		info.Preflights = append(info.Preflights, pf)
+		return nil
+	}
 }
 
 func Build(ctx context.Context, c *client.Client, s *session.Session, pw progress.Writer, f gateway.BuildFunc, opts ...SolveOption) error {
-	info := &SolveInfo{}
-	for _, opt := range opts {
-		err := opt(info)
-		if err != nil {
-			return err
-		}
+	info, err := newSolveInfo(ctx, opts)
+	if err != nil {
+		return err
 	}
+	return buildWithInfo(ctx, c, s, pw, f, info)
+}
+
+// buildWithInfo runs f like Build with options that are already applied.
+func buildWithInfo(ctx context.Context, c *client.Client, s *session.Session, pw progress.Writer, f gateway.BuildFunc, info *SolveInfo) error {
+	pw, closeRedaction := newRedactWriter(info.Redaction, pw)
+	defer closeRedaction()
 
+	err := info.Metrics.solve(ctx, info, pw, func(pw progress.Writer) error {
+		return build(ctx, c, s, pw, f, info)
+	})
+	return RedactError(info.Redaction, err)
+}
+
+func build(ctx context.Context, c *client.Client, s *session.Session, pw progress.Writer, f gateway.BuildFunc, info *SolveInfo) error {
 	solveOpt := client.SolveOpt{
 		SharedSession:         s,
 		SessionPreInitialized: s != nil,
@@ -228,6 +390,9 @@ func Build(ctx context.Context, c *client.Client, s *session.Session, pw progres
 		if info.OutputForceCompression {
 			entry.Attrs["force-compression"] = "true"
 		}
+		if info.OutputPushByDigest {
+			entry.Attrs["push-by-digest"] = "true"
+		}
 		solveOpt.Exports = append(solveOpt.Exports, entry)
 	}
 
@@ -250,6 +415,10 @@ func Build(ctx context.Context, c *client.Client, s *session.Session, pw progres
 		})
 	}
 
+	for _, lf := range info.LargeFiles {
+		lf.precheck(ctx, c)
+	}
+
 	limiter := ConcurrencyLimiter(ctx)
 	if limiter != nil {
 		if err := limiter.Acquire(ctx, 1); err != nil {
@@ -274,9 +443,22 @@ func Build(ctx context.Context, c *client.Client, s *session.Session, pw progres
 		if limiter != nil {
 			defer limiter.Release(1)
 		}
-		var err error
-		resp, err = c.Build(ctx, solveOpt, "", f, statusCh)
-		return err
+		// The failure of the build function is kept, because BuildKit
+		// returns it without the category it was given.
+		var (
+			buildErr error
+			built    bool
+			err      error
+		)
+		resp, err = c.Build(ctx, solveOpt, "", func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
+			res, err := f(ctx, c)
+			buildErr, built = err, err == nil
+			return res, err
+		}, statusCh)
+		for _, lf := range info.LargeFiles {
+			lf.report(pw)
+		}
+		return withBuildCategory(err, buildErr, built && len(solveOpt.Exports) > 0)
 	}(); err != nil {
 		return err
 	}
@@ -0,0 +1,408 @@
+package solver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/buildx/util/progress"
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// TransferCache is a client-side cache of the large files synced up by local
+// sources, keyed by the local source and the path of each file. It records
+// the content digest of a file and the modification time it was synced up
+// with, so that a file whose content is unchanged is synced up with the same
+// modification time and BuildKit does not transfer it again.
+type TransferCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]map[string]TransferEntry
+}
+
+// TransferEntry is a large file recorded in a transfer cache.
+type TransferEntry struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+
+	// ModTime is the modification time the file was synced up with.
+	ModTime int64 `json:"modTime"`
+
+	// HostModTime is the modification time of the file on the host when its
+	// digest was computed, so that files that were not touched are not hashed
+	// again.
+	HostModTime int64 `json:"hostModTime"`
+}
+
+// NewTransferCache returns a transfer cache that is only kept in memory.
+func NewTransferCache() *TransferCache {
+	return &TransferCache{entries: make(map[string]map[string]TransferEntry)}
+}
+
+// OpenTransferCache returns a transfer cache that is read from and saved to a
+// file. A missing or unreadable file is an empty cache, since it only makes
+// transfers faster.
+func OpenTransferCache(path string) *TransferCache {
+	c := NewTransferCache()
+	c.path = path
+
+	dt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	var entries map[string]map[string]TransferEntry
+	if json.Unmarshal(dt, &entries) == nil && entries != nil {
+		c.entries = entries
+	}
+	return c
+}
+
+// DefaultTransferCachePath returns the path of the transfer cache in the
+// user's cache directory, or an empty string if there is none.
+func DefaultTransferCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hlb", "transfer.json")
+}
+
+func (c *TransferCache) lookup(key, path string) (TransferEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key][path]
+	return entry, ok
+}
+
+func (c *TransferCache) store(key, path string, entry TransferEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, ok := c.entries[key]
+	if !ok {
+		files = make(map[string]TransferEntry)
+		c.entries[key] = files
+	}
+	files[path] = entry
+}
+
+// Save writes the transfer cache to its file, if it has one. The file is
+// replaced atomically so that concurrent builds never read a partial cache.
+func (c *TransferCache) Save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	dt, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.path), ".transfer-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(dt)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// TransferDecision is whether a large file of a local source was expected to
+// be skipped or sent by the last sync.
+type TransferDecision struct {
+	Path    string
+	Size    int64
+	Digest  digest.Digest
+	Skipped bool
+}
+
+// LargeFiles skips transferring the files of a local source that are larger
+// than a threshold when their content is unchanged, even if their
+// modification time has changed.
+//
+// BuildKit keeps the files synced up by a local source and only transfers the
+// files whose size or modification time differ from its copy. Large files are
+// hashed before the build, and a file whose digest is in the transfer cache is
+// synced up with the modification time it was first synced up with, so
+// BuildKit does not transfer it again. The build checks the digests of the
+// large files it was sent and restores their modification times, so the files
+// are the same as a plain local source.
+type LargeFiles struct {
+	name      string
+	key       string
+	dir       string
+	threshold int64
+	cache     *TransferCache
+
+	mu        sync.Mutex
+	enabled   bool
+	synced    bool
+	files     map[string]LargeFile
+	decisions map[string]TransferDecision
+}
+
+// LargeFile is a large file of a local source as it was hashed before the
+// build.
+type LargeFile struct {
+	Path    string
+	Size    int64
+	ModTime int64
+	Digest  digest.Digest
+
+	// cached is true if the file was synced up before with the same content.
+	cached bool
+}
+
+// NewLargeFiles returns the large files of the local source name, whose files
+// are synced up from dir on the host. The key identifies the local source in
+// the transfer cache.
+func NewLargeFiles(cache *TransferCache, name, key, dir string, threshold int64) *LargeFiles {
+	return &LargeFiles{
+		name:      name,
+		key:       key,
+		dir:       dir,
+		threshold: threshold,
+		cache:     cache,
+		files:     make(map[string]LargeFile),
+		decisions: make(map[string]TransferDecision),
+	}
+}
+
+// WithLargeFiles checks whether BuildKit supports skipping the large files of
+// a local source before solving, and reports which were skipped after.
+func WithLargeFiles(lf *LargeFiles) SolveOption {
+	return func(info *SolveInfo) error {
+		info.LargeFiles = append(info.LargeFiles, lf)
+		return nil
+	}
+}
+
+// Scan hashes the large files synced up with include and exclude patterns,
+// and returns them in the order they are synced. Files whose size and
+// modification time are unchanged since they were recorded in the transfer
+// cache are not hashed again.
+func (lf *LargeFiles) Scan(ctx context.Context, includePatterns, excludePatterns []string) ([]LargeFile, error) {
+	var files []LargeFile
+	err := fsutil.Walk(ctx, lf.dir, &fsutil.WalkOpt{
+		IncludePatterns: includePatterns,
+		ExcludePatterns: excludePatterns,
+	}, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*fstypes.Stat)
+		if !ok || !fi.Mode().IsRegular() || st.Size_ < lf.threshold {
+			return nil
+		}
+
+		path = filepath.ToSlash(path)
+		entry, ok := lf.cache.lookup(lf.key, path)
+		dgst := entry.Digest
+		if !ok || entry.Size != st.Size_ || entry.HostModTime != st.ModTime {
+			dgst, err = digestFile(filepath.Join(lf.dir, path))
+			if err != nil {
+				return err
+			}
+		}
+
+		cached := ok && entry.Digest == dgst && entry.Size == st.Size_
+		if !cached {
+			entry = TransferEntry{
+				Digest:  dgst,
+				Size:    st.Size_,
+				ModTime: st.ModTime,
+			}
+		}
+		entry.HostModTime = st.ModTime
+		lf.cache.store(lf.key, path, entry)
+
+		files = append(files, LargeFile{
+			Path:    path,
+			Size:    st.Size_,
+			ModTime: st.ModTime,
+			Digest:  dgst,
+			cached:  cached,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	for _, file := range files {
+		lf.files[file.Path] = file
+	}
+	return files, nil
+}
+
+// Map is the map function of the synced directory of the local source, which
+// is called with the stat of every file before it is synced up.
+func (lf *LargeFiles) Map(path string, st *fstypes.Stat) bool {
+	if !os.FileMode(st.Mode).IsRegular() || st.Size_ < lf.threshold {
+		return true
+	}
+
+	lf.mu.Lock()
+	enabled, synced := lf.enabled, lf.synced
+	file, ok := lf.files[path]
+	lf.mu.Unlock()
+
+	// A file that changed since it was hashed is sent as is, and fails the
+	// check of its digest in the build.
+	if !ok || file.Size != st.Size_ || file.ModTime != st.ModTime {
+		return true
+	}
+
+	entry, ok := lf.cache.lookup(lf.key, path)
+	if !ok || entry.Digest != file.Digest {
+		return true
+	}
+
+	if !enabled {
+		// The file is synced up as usual, so BuildKit's copy of it has its
+		// modification time on the host.
+		entry.ModTime = st.ModTime
+		lf.cache.store(lf.key, path, entry)
+		return true
+	}
+	st.ModTime = entry.ModTime
+
+	lf.mu.Lock()
+	lf.decisions[path] = TransferDecision{
+		Path:    path,
+		Size:    st.Size_,
+		Digest:  file.Digest,
+		Skipped: synced && file.cached,
+	}
+	lf.mu.Unlock()
+	return true
+}
+
+// precheck enables skipping large files if BuildKit can list its cache, and
+// checks whether it still has a copy of the local source to skip them
+// against. Otherwise, the local source is transferred as usual.
+func (lf *LargeFiles) precheck(ctx context.Context, c *client.Client) {
+	enabled, synced := false, false
+	if c != nil {
+		filter := fmt.Sprintf("type==%s,description==%s", client.UsageRecordTypeLocalSource, strconv.Quote("local source for "+lf.name))
+		du, err := c.DiskUsage(ctx, client.WithFilter([]string{filter}))
+		if err == nil {
+			enabled, synced = true, len(du) > 0
+		}
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	lf.enabled, lf.synced = enabled, synced
+}
+
+// report writes the decisions of the last sync as a completed vertex with a
+// log line per file, and saves the transfer cache.
+func (lf *LargeFiles) report(pw progress.Writer) {
+	decisions := lf.takeDecisions()
+	if len(decisions) == 0 {
+		return
+	}
+
+	// The cache only makes transfers faster, so failing to save it does not
+	// fail the build.
+	_ = lf.cache.Save()
+
+	if pw == nil {
+		return
+	}
+
+	var (
+		skipped, sent         int
+		skippedSize, sentSize int64
+		now                   = time.Now()
+		logs                  []*client.VertexLog
+		dgst                  = digest.FromString(fmt.Sprintf("transfer %s %d", lf.name, now.UnixNano()))
+	)
+	for _, d := range decisions {
+		action := "sent"
+		if d.Skipped {
+			action = "skipped"
+			skipped++
+			skippedSize += d.Size
+		} else {
+			sent++
+			sentSize += d.Size
+		}
+		logs = append(logs, &client.VertexLog{
+			Vertex:    dgst,
+			Stream:    1,
+			Data:      []byte(fmt.Sprintf("%s %s (%d bytes, %s)\n", action, d.Path, d.Size, d.Digest)),
+			Timestamp: now,
+		})
+	}
+
+	name := fmt.Sprintf("[transfer] %s: skipped %d large files (%d bytes), sent %d large files (%d bytes)", lf.name, skipped, skippedSize, sent, sentSize)
+	pw.Write(&client.SolveStatus{
+		Vertexes: []*client.Vertex{{
+			Digest:    dgst,
+			Name:      name,
+			Started:   &now,
+			Completed: &now,
+		}},
+		Logs: logs,
+	})
+}
+
+// takeDecisions returns the decisions of the last sync sorted by path, and
+// clears them for the next sync.
+func (lf *LargeFiles) takeDecisions() []TransferDecision {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	decisions := make([]TransferDecision, 0, len(lf.decisions))
+	for _, d := range lf.decisions {
+		decisions = append(decisions, d)
+	}
+	lf.decisions = make(map[string]TransferDecision)
+
+	sort.Slice(decisions, func(i, j int) bool {
+		return decisions[i].Path < decisions[j].Path
+	})
+	return decisions
+}
+
+func digestFile(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return digest.NewDigest(digest.SHA256, h), nil
+}
@@ -0,0 +1,301 @@
+package solver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestLargeFiles(t *testing.T) {
+	t.Parallel()
+
+	src := t.TempDir()
+	writeFile(t, src, "small.txt", "small")
+	writeFile(t, src, "models/weights.bin", strings.Repeat("w", 4096))
+	writeFile(t, src, "models/archive.tar", strings.Repeat("a", 8192))
+
+	cache := NewTransferCache()
+	lf := NewLargeFiles(cache, ".", "key", src, 1024)
+	dest := t.TempDir()
+
+	// BuildKit has no copy of the files yet, so every large file is sent.
+	files := scan(t, lf)
+	require.Len(t, files, 2)
+	require.Equal(t, "models/archive.tar", files[0].Path)
+	require.Equal(t, digest.FromString(strings.Repeat("a", 8192)), files[0].Digest)
+	lf.enabled, lf.synced = true, false
+	sent := syncDir(t, src, dest, lf.Map)
+	require.Equal(t, int64(5+4096+8192), sent)
+	requireDecisions(t, lf, map[string]bool{
+		"models/archive.tar": false,
+		"models/weights.bin": false,
+	})
+	requireSameFiles(t, src, dest)
+
+	// Touching the large files does not change their content, so they are
+	// skipped.
+	touch(t, src, "models/weights.bin", time.Now().Add(time.Hour))
+	touch(t, src, "models/archive.tar", time.Now().Add(2*time.Hour))
+	files = scan(t, lf)
+	lf.enabled, lf.synced = true, true
+	sent = syncDir(t, src, dest, lf.Map)
+	require.Equal(t, int64(0), sent)
+	requireDecisions(t, lf, map[string]bool{
+		"models/archive.tar": true,
+		"models/weights.bin": true,
+	})
+	requireSameFiles(t, src, dest)
+
+	// The large files are hashed with their modification times on the host,
+	// which the build restores.
+	fi, err := os.Stat(filepath.Join(src, "models/archive.tar"))
+	require.NoError(t, err)
+	require.Equal(t, fi.ModTime().UnixNano(), files[0].ModTime)
+
+	// Modified large files are sent even if their size is the same.
+	writeFile(t, src, "models/weights.bin", strings.Repeat("x", 4096))
+	touch(t, src, "models/archive.tar", time.Now().Add(3*time.Hour))
+	scan(t, lf)
+	sent = syncDir(t, src, dest, lf.Map)
+	require.Equal(t, int64(4096), sent)
+	requireDecisions(t, lf, map[string]bool{
+		"models/archive.tar": true,
+		"models/weights.bin": false,
+	})
+	requireSameFiles(t, src, dest)
+
+	// Files modified after they were hashed are sent as they are, and fail
+	// the check of their digests in the build.
+	scan(t, lf)
+	touch(t, src, "models/archive.tar", time.Now().Add(4*time.Hour))
+	sent = syncDir(t, src, dest, lf.Map)
+	require.Equal(t, int64(8192), sent)
+	requireDecisions(t, lf, map[string]bool{
+		"models/weights.bin": true,
+	})
+	requireSameFiles(t, src, dest)
+
+	// Without support from BuildKit, files are synced as usual.
+	touch(t, src, "models/archive.tar", time.Now().Add(5*time.Hour))
+	scan(t, lf)
+	lf.enabled = false
+	sent = syncDir(t, src, dest, lf.Map)
+	require.Equal(t, int64(8192), sent)
+	requireDecisions(t, lf, map[string]bool{})
+	requireSameFiles(t, src, dest)
+
+	// Excluded files are not hashed.
+	files, err = lf.Scan(context.Background(), nil, []string{"models/weights.bin"})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "models/archive.tar", files[0].Path)
+}
+
+// scan hashes the large files of lf before a build.
+func scan(t *testing.T, lf *LargeFiles) []LargeFile {
+	t.Helper()
+	files, err := lf.Scan(context.Background(), nil, nil)
+	require.NoError(t, err)
+	return files
+}
+
+func TestTransferCache(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hlb", "transfer.json")
+	cache := OpenTransferCache(path)
+	_, ok := cache.lookup("key", "weights.bin")
+	require.False(t, ok)
+
+	entry := TransferEntry{
+		Digest:      "sha256:86a0c2bf8e8c43a5bc5e3f0e4fbb3c43ce57b3d0b6ab9ec5b7bf4e2d6e5d4a1a",
+		Size:        4096,
+		ModTime:     1,
+		HostModTime: 2,
+	}
+	cache.store("key", "weights.bin", entry)
+	require.NoError(t, cache.Save())
+
+	actual, ok := OpenTransferCache(path).lookup("key", "weights.bin")
+	require.True(t, ok)
+	require.Equal(t, entry, actual)
+
+	// A corrupt cache is empty rather than an error.
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0o644))
+	_, ok = OpenTransferCache(path).lookup("key", "weights.bin")
+	require.False(t, ok)
+}
+
+// syncDir syncs src to dest like a local source and returns the number of
+// bytes of file content that were transferred.
+func syncDir(t *testing.T, src, dest string, mapFn func(string, *fstypes.Stat) bool) int64 {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s1, s2 := streamPair(ctx)
+	fs := &countingFS{FS: fsutil.NewFS(src, &fsutil.WalkOpt{Map: mapFn})}
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer s1.closeSend()
+		return fsutil.Send(ctx, s1, fs, nil)
+	})
+	g.Go(func() error {
+		return fsutil.Receive(ctx, s2, dest, fsutil.ReceiveOpt{})
+	})
+	require.NoError(t, g.Wait())
+	return atomic.LoadInt64(&fs.n)
+}
+
+// countingFS counts the bytes read from the files it opens.
+type countingFS struct {
+	fsutil.FS
+	n int64
+}
+
+func (fs *countingFS) Open(p string) (io.ReadCloser, error) {
+	rc, err := fs.FS.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{ReadCloser: rc, n: &fs.n}, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// requireDecisions requires the decisions of the last sync, where true means
+// that a file was skipped.
+func requireDecisions(t *testing.T, lf *LargeFiles, expected map[string]bool) {
+	t.Helper()
+	actual := make(map[string]bool)
+	for _, d := range lf.takeDecisions() {
+		actual[d.Path] = d.Skipped
+	}
+	require.Equal(t, expected, actual)
+}
+
+// requireSameFiles requires dest to have the same files as a plain sync of
+// src into an empty directory.
+func requireSameFiles(t *testing.T, src, dest string) {
+	t.Helper()
+	plain := t.TempDir()
+	syncDir(t, src, plain, nil)
+
+	expected := readFiles(t, plain)
+	require.NotEmpty(t, expected)
+	require.Equal(t, expected, readFiles(t, dest))
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			files[rel] = fi.Mode().String()
+			return nil
+		}
+		dt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = fi.Mode().String() + " " + string(dt)
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0o644))
+}
+
+func touch(t *testing.T, dir, name string, mtime time.Time) {
+	t.Helper()
+	require.NoError(t, os.Chtimes(filepath.Join(dir, name), mtime, mtime))
+}
+
+func streamPair(ctx context.Context) (*packetStream, *packetStream) {
+	c1 := make(chan *fstypes.Packet, 32)
+	c2 := make(chan *fstypes.Packet, 32)
+	return &packetStream{ctx, c1, c2}, &packetStream{ctx, c2, c1}
+}
+
+// packetStream is one end of an in-memory stream of fsutil packets.
+type packetStream struct {
+	ctx      context.Context
+	recvChan chan *fstypes.Packet
+	sendChan chan *fstypes.Packet
+}
+
+func (ps *packetStream) Context() context.Context {
+	return ps.ctx
+}
+
+func (ps *packetStream) RecvMsg(m interface{}) error {
+	p, ok := m.(*fstypes.Packet)
+	if !ok {
+		return errors.Errorf("invalid msg: %#v", m)
+	}
+	select {
+	case <-ps.ctx.Done():
+		return ps.ctx.Err()
+	case p2, ok := <-ps.recvChan:
+		if !ok {
+			return io.EOF
+		}
+		*p = *p2
+		return nil
+	}
+}
+
+func (ps *packetStream) SendMsg(m interface{}) error {
+	p, ok := m.(*fstypes.Packet)
+	if !ok {
+		return errors.Errorf("invalid msg: %#v", m)
+	}
+	p2 := *p
+	p2.Data = append([]byte{}, p2.Data...)
+	select {
+	case <-ps.ctx.Done():
+		return ps.ctx.Err()
+	case ps.sendChan <- &p2:
+		return nil
+	}
+}
+
+func (ps *packetStream) closeSend() {
+	close(ps.sendChan)
+}